@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// checkMain is the moduleMain counterpart for the configuration check mode
+// (-check). It initializes all modules with config.CheckOnly set and reports
+// all errors found instead of stopping at the first one.
+func checkMain(cfg []config.Node) int {
+	errs := checkModules(cfg)
+	for _, err := range errs {
+		log.Println(err)
+	}
+	if len(errs) != 0 {
+		log.Printf("configuration check failed, %d error(s) found", len(errs))
+		return 2
+	}
+
+	log.Println("configuration is valid")
+	return 0
+}
+
+func checkModules(cfg []config.Node) []error {
+	globals, modBlocks, err := ReadGlobals(cfg)
+	if err != nil {
+		return []error{err}
+	}
+
+	if err := InitDirs(); err != nil {
+		return []error{err}
+	}
+
+	endpoints, mods, errs := registerModules(globals, modBlocks)
+
+	// Errors of the modules referenced by endpoints are reported as part of
+	// the endpoint initialization error. Each module is initialized only
+	// once, so the error is reported only for the first reference.
+	for _, endp := range endpoints {
+		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+			errs = append(errs, config.WrapBlockErr(endp.Cfg, err))
+		}
+	}
+
+	for _, inst := range mods {
+		if module.Initialized[inst.Instance.InstanceName()] {
+			continue
+		}
+
+		errs = append(errs, unusedBlockErr(inst))
+
+		// Still check the block contents so the user does not have to fix
+		// errors one by one.
+		if _, err := module.GetInstance(inst.Instance.InstanceName()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -21,18 +21,53 @@ package main
 /*
 #cgo LDFLAGS: -lpam
 #cgo CFLAGS: -DCGO -Wall -Wextra -Werror -Wno-unused-parameter -Wno-error=unused-parameter -Wpedantic -std=c99
+#include <stdlib.h>
+#include "pam.h"
 extern int run();
 */
 import "C"
-import "os"
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/foxcpp/maddy/internal/auth/helper"
+)
 
 /*
 Apparently, some people would not want to build it manually by calling GCC.
 Here we do it for them. Not going to tell them that resulting file is 800KiB
 bigger than one built using only C compiler.
+
+Persistent mode (-serve) is available only in the binary built this way.
 */
 
+func pamAuth(username, password string) error {
+	usernameC := C.CString(username)
+	passwordC := C.CString(password)
+	defer C.free(unsafe.Pointer(usernameC))
+	defer C.free(unsafe.Pointer(passwordC))
+
+	errObj := C.run_pam_auth(usernameC, passwordC)
+	switch errObj.status {
+	case 0:
+		return nil
+	case 1:
+		return helper.ErrUnknownCredentials
+	default:
+		return fmt.Errorf("%s: %s", C.GoString(errObj.func_name), C.GoString(errObj.error_msg))
+	}
+}
+
 func main() {
+	if len(os.Args) == 2 && os.Args[1] == helper.ServeFlag {
+		if err := helper.ServeFD(pamAuth); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	i := int(C.run())
 	os.Exit(i)
 }
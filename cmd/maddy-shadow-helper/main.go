@@ -23,10 +23,34 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/foxcpp/maddy/internal/auth/helper"
 	"github.com/foxcpp/maddy/internal/auth/shadow"
 )
 
+func verify(username, password string) error {
+	err := shadow.Verify(username, password)
+	switch err {
+	case nil:
+		return nil
+	case shadow.ErrNoSuchUser, shadow.ErrWrongPassword:
+		return helper.ErrUnknownCredentials
+	case shadow.ErrAccountExpired, shadow.ErrPasswordExpired:
+		fmt.Fprintln(os.Stderr, err)
+		return helper.ErrUnknownCredentials
+	default:
+		return err
+	}
+}
+
 func main() {
+	if len(os.Args) == 2 && os.Args[1] == helper.ServeFlag {
+		if err := helper.ServeFD(verify); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	scnr := bufio.NewScanner(os.Stdin)
 
 	if !scnr.Scan() {
@@ -41,30 +65,11 @@ func main() {
 	}
 	password := scnr.Text()
 
-	ent, err := shadow.Lookup(username)
-	if err != nil {
-		if err == shadow.ErrNoSuchUser {
+	if err := verify(username, password); err != nil {
+		if err == helper.ErrUnknownCredentials {
 			os.Exit(1)
 		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
-
-	if !ent.IsAccountValid() {
-		fmt.Fprintln(os.Stderr, "account is expired")
-		os.Exit(1)
-	}
-
-	if !ent.IsPasswordValid() {
-		fmt.Fprintln(os.Stderr, "password is expired")
-		os.Exit(1)
-	}
-
-	if err := ent.VerifyPassword(password); err != nil {
-		if err == shadow.ErrWrongPassword {
-			os.Exit(1)
-		}
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
 }
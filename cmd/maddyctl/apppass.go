@@ -0,0 +1,157 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/urfave/cli"
+)
+
+// appPasswordDB is implemented by credentials stores supporting app
+// passwords.
+type appPasswordDB interface {
+	ListAppPasswords(username string) ([]pass_table.AppPassword, error)
+	CreateAppPassword(username, name string, services []string) (string, error)
+	RevokeAppPassword(username, name string) error
+	RevokeStaleAppPasswords(username string, since time.Time) ([]string, error)
+}
+
+func appPasswords(be module.PlainUserDB, ctx *cli.Context) (appPasswordDB, error) {
+	db, ok := be.(appPasswordDB)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s does not support app passwords", ctx.String("cfg-block"))
+	}
+	return db, nil
+}
+
+func appPassList(be module.PlainUserDB, ctx *cli.Context) error {
+	db, err := appPasswords(be, ctx)
+	if err != nil {
+		return err
+	}
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	list, err := db.ListAppPasswords(username)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		return printJSON(list)
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No app passwords.")
+	}
+	for _, ap := range list {
+		services := "all services"
+		if len(ap.Services) != 0 {
+			services = strings.Join(ap.Services, ", ")
+		}
+		lastUsed := "never used"
+		if !ap.LastUsed.IsZero() {
+			lastUsed = "last used " + ap.LastUsed.Format(time.RFC3339)
+		}
+		fmt.Printf("%s: %s, created %s, %s\n", ap.Name, services, ap.Created.Format(time.RFC3339), lastUsed)
+	}
+	return nil
+}
+
+func appPassCreate(be module.PlainUserDB, ctx *cli.Context) error {
+	db, err := appPasswords(be, ctx)
+	if err != nil {
+		return err
+	}
+	username := ctx.Args().Get(0)
+	name := ctx.Args().Get(1)
+	if username == "" || name == "" {
+		return errors.New("Error: USERNAME and NAME are required")
+	}
+
+	pass, err := db.CreateAppPassword(username, name, ctx.StringSlice("service"))
+	if err != nil {
+		return err
+	}
+	if err := invalidateCache(username, nil); err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "App password (it will not be shown again):")
+	}
+	fmt.Println(pass)
+	return nil
+}
+
+func appPassRevoke(be module.PlainUserDB, ctx *cli.Context) error {
+	db, err := appPasswords(be, ctx)
+	if err != nil {
+		return err
+	}
+	username := ctx.Args().Get(0)
+	name := ctx.Args().Get(1)
+	if username == "" || name == "" {
+		return errors.New("Error: USERNAME and NAME are required")
+	}
+
+	return invalidateCache(username, db.RevokeAppPassword(username, name))
+}
+
+func appPassPrune(be module.PlainUserDB, ctx *cli.Context) error {
+	db, err := appPasswords(be, ctx)
+	if err != nil {
+		return err
+	}
+	unusedFor := ctx.Duration("unused-for")
+	if unusedFor <= 0 {
+		return errors.New("Error: --unused-for is required")
+	}
+	since := time.Now().Add(-unusedFor)
+
+	var users []string
+	if username := ctx.Args().First(); username != "" {
+		users = []string{username}
+	} else {
+		users, err = be.ListUsers()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, username := range users {
+		revoked, err := db.RevokeStaleAppPasswords(username, since)
+		if err := invalidateCache(username, err); err != nil {
+			return err
+		}
+		for _, name := range revoked {
+			fmt.Printf("%s: %s revoked\n", username, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli"
+)
+
+func blobStorage(be module.Storage) (module.BlobStorage, error) {
+	bbe, ok := be.(module.BlobStorage)
+	if !ok {
+		return nil, errors.New("Error: storage backend does not support message bodies store maintenance")
+	}
+	return bbe, nil
+}
+
+func blobsGC(be module.Storage, ctx *cli.Context) error {
+	bbe, err := blobStorage(be)
+	if err != nil {
+		return err
+	}
+
+	removed, err := bbe.CollectBlobs()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d unused files\n", removed)
+	return nil
+}
+
+func blobsVerify(be module.Storage, ctx *cli.Context) error {
+	bbe, err := blobStorage(be)
+	if err != nil {
+		return err
+	}
+
+	damaged := 0
+	checked, err := bbe.VerifyBlobs(func(key string, err error) {
+		damaged++
+		fmt.Printf("%s: %v\n", key, err)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checked %d message bodies, %d damaged\n", checked, damaged)
+	if damaged != 0 {
+		return errors.New("Error: damaged message bodies found")
+	}
+	return nil
+}
+
+func blobsMigrate(be module.Storage, ctx *cli.Context) error {
+	layout := ctx.Args().First()
+	if layout == "" {
+		return errors.New("Error: LAYOUT is required")
+	}
+
+	bbe, err := blobStorage(be)
+	if err != nil {
+		return err
+	}
+
+	converted, err := bbe.MigrateBlobs(layout)
+	fmt.Printf("Converted %d message bodies\n", converted)
+	return err
+}
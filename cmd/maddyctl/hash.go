@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
@@ -30,34 +31,43 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-func hashCommand(ctx *cli.Context) error {
-	hashFunc := ctx.String("hash")
-	if hashFunc == "" {
-		hashFunc = pass_table.DefaultHash
+var (
+	hashFlag = cli.StringFlag{
+		Name:  "hash",
+		Usage: "Use specified hash algorithm instead of the configured one. Valid values: bcrypt, argon2, sha512-crypt",
 	}
-
-	hashCompute := pass_table.HashCompute[hashFunc]
-	if hashCompute == nil {
-		var funcs []string
-		for k := range pass_table.HashCompute {
-			funcs = append(funcs, k)
-		}
-
-		return fmt.Errorf("Error: Unknown hash function, available: %s", strings.Join(funcs, ", "))
+	bcryptCostFlag = cli.IntFlag{
+		Name:  "bcrypt-cost",
+		Usage: "Specify bcrypt cost value",
+		Value: pass_table.DefaultHashOpts.BcryptCost,
 	}
-
-	opts := pass_table.HashOpts{
-		BcryptCost:    bcrypt.DefaultCost,
-		Argon2Memory:  1024,
-		Argon2Time:    2,
-		Argon2Threads: 1,
+	argon2TimeFlag = cli.IntFlag{
+		Name:  "argon2-time",
+		Usage: "Time factor for Argon2id",
+		Value: pass_table.DefaultArgon2Time,
 	}
+	argon2MemoryFlag = cli.IntFlag{
+		Name:  "argon2-memory",
+		Usage: "Memory in KiB to use for Argon2id",
+		Value: pass_table.DefaultArgon2Memory,
+	}
+	argon2ThreadsFlag = cli.IntFlag{
+		Name:  "argon2-threads",
+		Usage: "Threads to use for Argon2id",
+		Value: pass_table.DefaultArgon2Threads,
+	}
+)
+
+// hashOptsFromFlags returns the hash parameters specified using the
+// command-line flags. Parameters not specified are set to defaults.
+func hashOptsFromFlags(ctx *cli.Context) (pass_table.HashOpts, error) {
+	opts := pass_table.DefaultHashOpts
 	if ctx.IsSet("bcrypt-cost") {
 		if ctx.Int("bcrypt-cost") > bcrypt.MaxCost {
-			return errors.New("Error: too big bcrypt cost")
+			return opts, errors.New("Error: too big bcrypt cost")
 		}
 		if ctx.Int("bcrypt-cost") < bcrypt.MinCost {
-			return errors.New("Error: too small bcrypt cost")
+			return opts, errors.New("Error: too small bcrypt cost")
 		}
 		opts.BcryptCost = ctx.Int("bcrypt-cost")
 	}
@@ -65,11 +75,45 @@ func hashCommand(ctx *cli.Context) error {
 		opts.Argon2Memory = uint32(ctx.Int("argon2-memory"))
 	}
 	if ctx.IsSet("argon2-time") {
-		opts.Argon2Memory = uint32(ctx.Int("argon2-time"))
+		opts.Argon2Time = uint32(ctx.Int("argon2-time"))
 	}
 	if ctx.IsSet("argon2-threads") {
+		if ctx.Int("argon2-threads") < 1 || ctx.Int("argon2-threads") > 255 {
+			return opts, errors.New("Error: argon2 threads should be in range from 1 to 255")
+		}
 		opts.Argon2Threads = uint8(ctx.Int("argon2-threads"))
 	}
+	return opts, nil
+}
+
+// checkHashFunc checks whether the hash function can be used for new
+// passwords.
+func checkHashFunc(hashFunc string) error {
+	if pass_table.HashCompute[hashFunc] != nil {
+		return nil
+	}
+
+	var funcs []string
+	for k := range pass_table.HashCompute {
+		funcs = append(funcs, k)
+	}
+	sort.Strings(funcs)
+	return fmt.Errorf("Error: Unknown hash function, available: %s", strings.Join(funcs, ", "))
+}
+
+func hashCommand(ctx *cli.Context) error {
+	hashFunc := ctx.String("hash")
+	if hashFunc == "" {
+		hashFunc = pass_table.DefaultHash
+	}
+	if err := checkHashFunc(hashFunc); err != nil {
+		return err
+	}
+
+	opts, err := hashOptsFromFlags(ctx)
+	if err != nil {
+		return err
+	}
 
 	var pass string
 	if ctx.IsSet("password") {
@@ -86,7 +130,7 @@ func hashCommand(ctx *cli.Context) error {
 		fmt.Fprintln(os.Stderr, "WARNING: This is the hash of empty string")
 	}
 
-	hash, err := hashCompute(opts, pass)
+	hash, err := pass_table.HashCompute[hashFunc](opts, pass)
 	if err != nil {
 		return err
 	}
@@ -24,6 +24,7 @@ import (
 	"os"
 
 	specialuse "github.com/emersion/go-imap-specialuse"
+	imapbackend "github.com/emersion/go-imap/backend"
 	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/urfave/cli"
@@ -79,11 +80,18 @@ func imapAcctCreate(be module.Storage, ctx *cli.Context) error {
 		fmt.Fprintf(os.Stderr, "Note: Storage backend does not support SPECIAL-USE IMAP extension")
 	}
 
+	// Storage may create special-use mailboxes for new accounts itself.
 	createMbox := func(name, specialUseAttr string) error {
+		var err error
 		if suu == nil {
-			return act.CreateMailbox(name)
+			err = act.CreateMailbox(name)
+		} else {
+			err = suu.CreateMailboxSpecial(name, specialUseAttr)
 		}
-		return suu.CreateMailboxSpecial(name, specialUseAttr)
+		if err == imapbackend.ErrMailboxAlreadyExists {
+			return nil
+		}
+		return err
 	}
 
 	if name := ctx.String("sent-name"); name != "" {
@@ -24,15 +24,16 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/urfave/cli"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func closeIfNeeded(i interface{}) {
@@ -101,16 +102,11 @@ func main() {
 							Name:  "null,n",
 							Usage: "Create account with null password",
 						},
-						cli.StringFlag{
-							Name:  "hash",
-							Usage: "Use specified hash algorithm. Valid values: sha3-512, bcrypt",
-							Value: "bcrypt",
-						},
-						cli.IntFlag{
-							Name:  "bcrypt-cost",
-							Usage: "Specify bcrypt cost value",
-							Value: bcrypt.DefaultCost,
-						},
+						hashFlag,
+						bcryptCostFlag,
+						argon2TimeFlag,
+						argon2MemoryFlag,
+						argon2ThreadsFlag,
 					},
 					Action: func(ctx *cli.Context) error {
 						be, err := openUserDB(ctx)
@@ -162,6 +158,11 @@ func main() {
 							Name:  "password,p",
 							Usage: "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
 						},
+						hashFlag,
+						bcryptCostFlag,
+						argon2TimeFlag,
+						argon2MemoryFlag,
+						argon2ThreadsFlag,
 					},
 					Action: func(ctx *cli.Context) error {
 						be, err := openUserDB(ctx)
@@ -172,6 +173,141 @@ func main() {
 						return usersPassword(be, ctx)
 					},
 				},
+				{
+					Name:        "import",
+					Usage:       "Import credentials from htpasswd or Dovecot passwd-file",
+					Description: "Hashes using unsupported schemes are imported in the 'must reset' state.\n\t\tUse FILE '-' to read from stdin.",
+					ArgsUsage:   "FILE",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_authdb",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Usage: "Input file format. Valid values: htpasswd, dovecot",
+							Value: "htpasswd",
+						},
+						cli.BoolFlag{
+							Name:  "create",
+							Usage: "Create credentials for users that don't exist yet instead of skipping them",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openUserDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return usersImport(be, ctx)
+					},
+				},
+				{
+					Name:  "app-password",
+					Usage: "App-specific passwords management",
+					Subcommands: []cli.Command{
+						{
+							Name:      "list",
+							Usage:     "List app passwords of the user",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_authdb",
+								},
+								cli.BoolFlag{
+									Name:  "json",
+									Usage: "Print output in the JSON format",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPassList(be, ctx)
+							},
+						},
+						{
+							Name:        "create",
+							Usage:       "Generate new app password",
+							Description: "Generated password is printed to stdout.",
+							ArgsUsage:   "USERNAME NAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_authdb",
+								},
+								cli.StringSliceFlag{
+									Name:  "service,s",
+									Usage: "Allow password use only for the service (imap, smtp, pop3), can be repeated",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPassCreate(be, ctx)
+							},
+						},
+						{
+							Name:      "revoke",
+							Usage:     "Remove app password",
+							ArgsUsage: "USERNAME NAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_authdb",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPassRevoke(be, ctx)
+							},
+						},
+						{
+							Name:        "prune",
+							Usage:       "Remove app passwords not used for a long time",
+							Description: "Passwords of all users are checked if USERNAME is not specified.",
+							ArgsUsage:   "[USERNAME]",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_authdb",
+								},
+								cli.DurationFlag{
+									Name:  "unused-for",
+									Usage: "Remove passwords not used for `DURATION` (e.g. 2160h)",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPassPrune(be, ctx)
+							},
+						},
+					},
+				},
 			},
 		},
 		{
@@ -294,6 +430,61 @@ func main() {
 						return imapAcctAppendlimit(be, ctx)
 					},
 				},
+				{
+					Name:      "quota",
+					Usage:     "Query or set account's storage quota",
+					ArgsUsage: "USERNAME",
+					Description: "Without flags, shows the current usage and limits.\n\n" +
+						"0 means no limit, -1 resets the limit to the storage default.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+						cli.Int64Flag{
+							Name:  "bytes,b",
+							Usage: "Set the storage limit (in bytes)",
+						},
+						cli.Int64Flag{
+							Name:  "messages,m",
+							Usage: "Set the limit for the amount of messages",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctQuota(be, ctx)
+					},
+				},
+				{
+					Name:      "retention",
+					Usage:     "Query or override message retention rules for the account",
+					ArgsUsage: "USERNAME [MAILBOX PERIOD]",
+					Description: "Without MAILBOX and PERIOD, shows the rules in effect for the account.\n\n" +
+						"PERIOD is a duration such as 30d or 12h. 'off' disables the removal for the mailbox,\n" +
+						"'default' removes the override so the storage-wide rule applies.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctRetention(be, ctx)
+					},
+				},
 			},
 		},
 		{
@@ -655,6 +846,511 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "imap-blobs",
+			Usage: "Message bodies store maintenance",
+			Subcommands: []cli.Command{
+				{
+					Name:  "gc",
+					Usage: "Remove unused message bodies",
+					Description: "Bodies are removed automatically once the last message using them is deleted.\n" +
+						"This command cleans up files left behind if the server was stopped in the middle of that",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return blobsGC(be, ctx)
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "Check integrity of stored message bodies",
+					Description: "Reads all message bodies and reports ones that can't be read or don't match\n" +
+						"their checksum (for the hashed layout)",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return blobsVerify(be, ctx)
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "Convert stored message bodies to another layout",
+					Description: "LAYOUT is 'hashed' or 'plain', see fsstore_layout in maddy-storage(5).\n" +
+						"Convert bodies to 'plain' before downgrading to the version that does not support the hashed layout.\n" +
+						"It is recommended to stop the server and make a backup before running the command",
+					ArgsUsage: "LAYOUT",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return blobsMigrate(be, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:  "auth-throttle",
+			Usage: "Authentication failures rate limiting status",
+			Subcommands: []cli.Command{
+				{
+					Name:        "blocked",
+					Usage:       "List IPs blocked due to too many authentication failures",
+					Description: "The state file written by the server is used, so 'persist' should be enabled\n\t\tfor the module. It is updated every 30 seconds.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "auth_throttle",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						state, err := openThrottleState(ctx)
+						if err != nil {
+							return err
+						}
+						return throttleBlocked(state, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:  "queue",
+			Usage: "Outbound delivery queue management",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueList(location, ctx)
+					},
+				},
+				{
+					Name:        "show",
+					Usage:       "Show queued message details and delivery diagnostics",
+					ArgsUsage:   "MSGID",
+					Description: "Diagnostics for the latest failed delivery attempts are shown for each recipient.\nMessage header is printed at the end.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueShow(location, ctx)
+					},
+				},
+				{
+					Name:        "pause",
+					Usage:       "Pause delivery",
+					Description: "Messages are kept in the queue until delivery is resumed.\nIf --domain is not specified, all deliveries are paused.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "domain,d",
+							Usage: "Pause delivery only for recipients in the specified `DOMAIN`",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queuePause(location, ctx)
+					},
+				},
+				{
+					Name:        "resume",
+					Usage:       "Resume paused delivery",
+					Description: "Held messages are released gradually according to the resume_rate directive.\nIf --domain is not specified, the global pause is lifted.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "domain,d",
+							Usage: "Resume delivery for recipients in the specified `DOMAIN`",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueResume(location, ctx)
+					},
+				},
+				{
+					Name:        "reroute",
+					Usage:       "Retry queued messages using the current configuration",
+					Description: "Next hop (MX records, routing, relay credentials) is determined on each delivery\nattempt so this command resets the retry delay for the selected messages to make\nthe queue pick up configuration changes promptly.\nEither --domain or --all should be specified.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "domain,d",
+							Usage: "Select messages with recipients in the specified `DOMAIN`",
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "Select all messages",
+						},
+						cli.DurationFlag{
+							Name:  "wait",
+							Usage: "Time to wait for the running server to process the request",
+							Value: 15 * time.Second,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueReroute(location, ctx)
+					},
+				},
+				{
+					Name:        "flush",
+					Usage:       "Retry queued messages immediately",
+					Description: "Same as reroute, but selects all messages if --domain is not specified.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "domain,d",
+							Usage: "Select messages with recipients in the specified `DOMAIN`",
+						},
+						cli.DurationFlag{
+							Name:  "wait",
+							Usage: "Time to wait for the running server to process the request",
+							Value: 15 * time.Second,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueFlush(location, ctx)
+					},
+				},
+				{
+					Name:        "delete",
+					Usage:       "Remove messages from the queue",
+					ArgsUsage:   "[MSGID...]",
+					Description: "Messages are removed without sending any delivery status notifications.\nMessages being delivered right now are skipped.\nIf multiple selectors are specified, messages should match all of them.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "sender",
+							Usage: "Select messages from the specified `ADDRESS`",
+						},
+						cli.StringFlag{
+							Name:  "rcpt",
+							Usage: "Select messages with the specified recipient `ADDRESS`",
+						},
+						cli.DurationFlag{
+							Name:  "wait",
+							Usage: "Time to wait for the running server to process the request",
+							Value: 15 * time.Second,
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueControl(location, queue.ControlRequest{Action: queue.ControlDelete}, ctx)
+					},
+				},
+				{
+					Name:        "hold",
+					Usage:       "Put messages on hold",
+					ArgsUsage:   "[MSGID...]",
+					Description: "Held messages are not delivered until released.\nMessages being delivered right now are skipped.\nIf multiple selectors are specified, messages should match all of them.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "sender",
+							Usage: "Select messages from the specified `ADDRESS`",
+						},
+						cli.StringFlag{
+							Name:  "rcpt",
+							Usage: "Select messages with the specified recipient `ADDRESS`",
+						},
+						cli.DurationFlag{
+							Name:  "wait",
+							Usage: "Time to wait for the running server to process the request",
+							Value: 15 * time.Second,
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueControl(location, queue.ControlRequest{Action: queue.ControlHold}, ctx)
+					},
+				},
+				{
+					Name:        "release",
+					Usage:       "Release held messages",
+					ArgsUsage:   "[MSGID...]",
+					Description: "Released messages are scheduled for immediate delivery.\nIf multiple selectors are specified, messages should match all of them.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "sender",
+							Usage: "Select messages from the specified `ADDRESS`",
+						},
+						cli.StringFlag{
+							Name:  "rcpt",
+							Usage: "Select messages with the specified recipient `ADDRESS`",
+						},
+						cli.DurationFlag{
+							Name:  "wait",
+							Usage: "Time to wait for the running server to process the request",
+							Value: 15 * time.Second,
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueControl(location, queue.ControlRequest{Action: queue.ControlRelease}, ctx)
+					},
+				},
+				{
+					Name:        "defer",
+					Usage:       "Change the time messages are delivered at",
+					ArgsUsage:   "[MSGID...]",
+					Description: "Messages are not delivered before the specified time, it is capped by max_hold_time of the queue.\nMessages being delivered right now are skipped.\nIf multiple selectors are specified, messages should match all of them.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.StringFlag{
+							Name:  "sender",
+							Usage: "Select messages from the specified `ADDRESS`",
+						},
+						cli.StringFlag{
+							Name:  "rcpt",
+							Usage: "Select messages with the specified recipient `ADDRESS`",
+						},
+						cli.StringFlag{
+							Name:  "until",
+							Usage: "Deliver messages at the specified `TIME` (RFC 3339 format)",
+						},
+						cli.DurationFlag{
+							Name:  "for",
+							Usage: "Deliver messages after the specified `DURATION` from now",
+						},
+						cli.BoolFlag{
+							Name:  "clear",
+							Usage: "Remove the restriction, messages are scheduled for immediate delivery",
+						},
+						cli.DurationFlag{
+							Name:  "wait",
+							Usage: "Time to wait for the running server to process the request",
+							Value: 15 * time.Second,
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print output in the JSON format",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						location, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueDefer(location, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:  "tenants",
+			Usage: "Tenant sending domains management",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List accounts and domains they are allowed to send as",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "tenants",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tenantsList(tbl, ctx)
+					},
+				},
+				{
+					Name:        "set",
+					Usage:       "Set domains the account is allowed to send as",
+					Description: "Existing list of domains for the account is replaced.",
+					ArgsUsage:   "ACCOUNT DOMAIN...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "tenants",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tenantsSet(tbl, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove the account from the mapping",
+					ArgsUsage: "ACCOUNT",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "tenants",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tenantsRemove(tbl, ctx)
+					},
+				},
+			},
+		},
 		{
 			Name:   "hash",
 			Usage:  "Generate password hashes for use with pass_table",
@@ -669,26 +1365,10 @@ func main() {
 					Usage: "Use specified hash algorithm",
 					Value: "bcrypt",
 				},
-				cli.IntFlag{
-					Name:  "bcrypt-cost",
-					Usage: "Specify bcrypt cost value",
-					Value: bcrypt.DefaultCost,
-				},
-				cli.IntFlag{
-					Name:  "argon2-time",
-					Usage: "Time factor for Argon2id",
-					Value: 3,
-				},
-				cli.IntFlag{
-					Name:  "argon2-memory",
-					Usage: "Memory in KiB to use for Argon2id",
-					Value: 1024,
-				},
-				cli.IntFlag{
-					Name:  "argon2-threads",
-					Usage: "Threads to use for Argon2id",
-					Value: 1,
-				},
+				bcryptCostFlag,
+				argon2TimeFlag,
+				argon2MemoryFlag,
+				argon2ThreadsFlag,
 			},
 		},
 	}
@@ -789,3 +1469,42 @@ func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
 
 	return userDB, nil
 }
+
+func openTable(ctx *cli.Context) (module.MutableTable, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl, ok := mod.Instance.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s is not a mutable table", ctx.String("cfg-block"))
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return tbl, nil
+}
+
+func openQueue(ctx *cli.Context) (string, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q, ok := mod.Instance.(*queue.Queue)
+	if !ok {
+		return "", fmt.Errorf("Error: configuration block %s is not a queue", ctx.String("cfg-block"))
+	}
+
+	// Queue is not initialized to not start deliveries, only its directory
+	// is used.
+	location, err := q.ReadLocation(config.NewMap(globals, mod.Cfg))
+	if err != nil {
+		return "", fmt.Errorf("Error: failed to read queue configuration: %w", err)
+	}
+
+	return location, nil
+}
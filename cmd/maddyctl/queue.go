@@ -0,0 +1,398 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli"
+)
+
+func printPauseState(ps queue.PauseState) {
+	if ps.Global {
+		fmt.Printf("*** DELIVERY IS PAUSED (since %v) ***\n", ps.GlobalSince.Format(time.RFC3339))
+	}
+	for _, domain := range ps.DomainList() {
+		fmt.Printf("*** DELIVERY TO %s IS PAUSED (since %v) ***\n", domain, ps.Domains[domain].Format(time.RFC3339))
+	}
+	if ps.Paused() {
+		fmt.Println()
+	}
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type queueListRcpt struct {
+	Address   string
+	Held      bool
+	Attempts  int
+	LastError string `json:",omitempty"`
+}
+
+type queueListEntry struct {
+	ID           string
+	From         string
+	Size         int64
+	Held         bool
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	NextAttempt  time.Time `json:",omitempty"`
+	DeliverAfter time.Time `json:",omitempty"`
+	Rcpts        []queueListRcpt
+}
+
+func queueList(location string, ctx *cli.Context) error {
+	ps, err := queue.ReadPauseState(location)
+	if err != nil {
+		return err
+	}
+
+	list, err := queue.List(location)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]queueListEntry, 0, len(list))
+	for _, meta := range list {
+		// Size is not available for entries removed after List.
+		size, _ := queue.Size(location, meta.MsgMeta.ID)
+		entry := queueListEntry{
+			ID:           meta.MsgMeta.ID,
+			From:         meta.From,
+			Size:         size,
+			Held:         meta.Held,
+			FirstAttempt: meta.FirstAttempt,
+			LastAttempt:  meta.LastAttempt,
+			NextAttempt:  meta.NextAttempt,
+			DeliverAfter: meta.DeliverAfter,
+		}
+		for _, rcpt := range meta.To {
+			r := queueListRcpt{
+				Address:  rcpt,
+				Held:     meta.Held || ps.IsPaused(rcpt),
+				Attempts: meta.TriesCount[rcpt],
+			}
+			if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+				r.LastError = fmt.Sprintf("%d %d.%d.%d %s",
+					rcptErr.Code, rcptErr.EnhancedCode[0], rcptErr.EnhancedCode[1],
+					rcptErr.EnhancedCode[2], rcptErr.Message)
+			}
+			entry.Rcpts = append(entry.Rcpts, r)
+		}
+		entries = append(entries, entry)
+	}
+
+	if ctx.Bool("json") {
+		return printJSON(entries)
+	}
+
+	printPauseState(ps)
+	if len(entries) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No queued messages.")
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s: from <%s>, %d bytes, arrived %v, last attempt %v",
+			entry.ID, entry.From, entry.Size,
+			entry.FirstAttempt.Format(time.RFC3339), entry.LastAttempt.Format(time.RFC3339))
+		switch {
+		case entry.Held:
+			fmt.Print(", HELD")
+		case !entry.NextAttempt.IsZero():
+			fmt.Printf(", next attempt %v", entry.NextAttempt.Format(time.RFC3339))
+		}
+		if !entry.DeliverAfter.IsZero() {
+			fmt.Printf(", deferred until %v", entry.DeliverAfter.Format(time.RFC3339))
+		}
+		fmt.Println()
+		for _, rcpt := range entry.Rcpts {
+			var notes []string
+			if rcpt.Held {
+				notes = append(notes, "HELD")
+			}
+			notes = append(notes, fmt.Sprintf("attempts: %d", rcpt.Attempts))
+			if rcpt.LastError != "" {
+				notes = append(notes, "last error: "+rcpt.LastError)
+			}
+			fmt.Printf("  <%s> (%s)\n", rcpt.Address, strings.Join(notes, ", "))
+		}
+	}
+	return nil
+}
+
+func queueShow(location string, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("Error: MSGID is required")
+	}
+
+	ps, err := queue.ReadPauseState(location)
+	if err != nil {
+		return err
+	}
+	meta, err := queue.Read(location, id)
+	if err != nil {
+		return err
+	}
+	header, err := queue.ReadHeader(location, id)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		return printJSON(struct {
+			Meta   *queue.QueueMetadata
+			Header string
+		}{
+			Meta:   meta,
+			Header: string(header),
+		})
+	}
+
+	fmt.Println("Message ID:", meta.MsgMeta.ID)
+	fmt.Printf("From: <%s>\n", meta.From)
+	fmt.Println("Arrived:", meta.FirstAttempt.Format(time.RFC3339))
+	fmt.Println("Last attempt:", meta.LastAttempt.Format(time.RFC3339))
+	if !meta.NextAttempt.IsZero() {
+		fmt.Println("Next attempt:", meta.NextAttempt.Format(time.RFC3339))
+	}
+	if size, err := queue.Size(location, id); err == nil {
+		fmt.Println("Size:", size)
+	}
+	if !meta.DeliverAfter.IsZero() {
+		fmt.Println("Deferred until:", meta.DeliverAfter.Format(time.RFC3339))
+	}
+	if meta.Held {
+		fmt.Println("*** MESSAGE IS ON HOLD ***")
+	}
+
+	for _, rcpt := range meta.To {
+		fmt.Println()
+		fmt.Printf("<%s>", rcpt)
+		if original := meta.MsgMeta.OriginalRcpts[rcpt]; original != "" && original != rcpt {
+			fmt.Printf(" (originally <%s>)", original)
+		}
+		if ps.IsPaused(rcpt) {
+			fmt.Print(" HELD")
+		}
+		fmt.Println()
+		fmt.Println("  Attempts:", meta.TriesCount[rcpt])
+		for _, grp := range meta.RetryGroups {
+			for _, groupRcpt := range grp.Rcpts {
+				if groupRcpt == rcpt {
+					fmt.Println("  Next attempt:", grp.NextAttempt.Format(time.RFC3339))
+				}
+			}
+		}
+
+		diags := meta.Diagnostics[rcpt]
+		if len(diags) == 0 {
+			if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+				fmt.Printf("  Last error: %d %d.%d.%d %s\n",
+					rcptErr.Code, rcptErr.EnhancedCode[0], rcptErr.EnhancedCode[1],
+					rcptErr.EnhancedCode[2], rcptErr.Message)
+			}
+			continue
+		}
+		for _, diag := range diags {
+			fmt.Println("  Attempt at", diag.Time.Format(time.RFC3339))
+			if len(diag.MXCandidates) != 0 {
+				fmt.Println("    MX candidates:", strings.Join(diag.MXCandidates, ", "))
+			}
+			if diag.RemoteServer != "" {
+				fmt.Print("    Server: ", diag.RemoteServer)
+				if diag.RemoteAddr != "" {
+					fmt.Printf(" (%s)", diag.RemoteAddr)
+				}
+				fmt.Println()
+			}
+			if diag.Phase != "" {
+				fmt.Println("    Phase:", diag.Phase)
+			}
+			if diag.RemoteResponse != "" {
+				fmt.Println("    Response:", diag.RemoteResponse)
+			}
+			if diag.Reason != "" {
+				fmt.Println("    Reason:", diag.Reason)
+			}
+			if diag.Error != nil {
+				fmt.Printf("    Error: %d %d.%d.%d %s\n",
+					diag.Error.Code, diag.Error.EnhancedCode[0], diag.Error.EnhancedCode[1],
+					diag.Error.EnhancedCode[2], diag.Error.Message)
+			}
+		}
+	}
+
+	fmt.Println()
+	fmt.Print(strings.Replace(string(header), "\r\n", "\n", -1))
+	return nil
+}
+
+func queuePause(location string, ctx *cli.Context) error {
+	if err := queue.Pause(location, ctx.String("domain")); err != nil {
+		return err
+	}
+
+	ps, err := queue.ReadPauseState(location)
+	if err != nil {
+		return err
+	}
+	printPauseState(ps)
+	return nil
+}
+
+func queueResume(location string, ctx *cli.Context) error {
+	if err := queue.Resume(location, ctx.String("domain")); err != nil {
+		return err
+	}
+
+	ps, err := queue.ReadPauseState(location)
+	if err != nil {
+		return err
+	}
+	printPauseState(ps)
+	if !ps.Paused() && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Delivery is not paused.")
+	}
+	return nil
+}
+
+func queueReroute(location string, ctx *cli.Context) error {
+	domain := ctx.String("domain")
+	if domain == "" && !ctx.Bool("all") {
+		return errors.New("Error: either --domain or --all is required")
+	}
+	if domain != "" && ctx.Bool("all") {
+		return errors.New("Error: --domain and --all can't be used together")
+	}
+
+	return requestReroute(location, domain, ctx)
+}
+
+func queueFlush(location string, ctx *cli.Context) error {
+	return requestReroute(location, ctx.String("domain"), ctx)
+}
+
+func requestReroute(location, domain string, ctx *cli.Context) error {
+	req, err := queue.RequestReroute(location, domain)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(ctx.Duration("wait"))
+	for time.Now().Before(deadline) {
+		res, err := queue.ReadRerouteResult(location)
+		if err != nil {
+			return err
+		}
+		if res.Requested.Equal(req.Requested) {
+			fmt.Printf("%d queued messages are scheduled for immediate delivery\n", res.Rescheduled)
+			if res.Skipped != 0 {
+				fmt.Printf("%d messages are skipped (being delivered right now or held due to pause)\n", res.Skipped)
+			}
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Request is saved but not processed yet. Is the server running?")
+		fmt.Fprintln(os.Stderr, "It will be processed on the next start otherwise.")
+	}
+	return nil
+}
+
+func queueDefer(location string, ctx *cli.Context) error {
+	req := queue.ControlRequest{Action: queue.ControlDefer}
+	switch {
+	case ctx.Bool("clear"):
+		if ctx.IsSet("until") || ctx.IsSet("for") {
+			return errors.New("Error: --clear can't be used together with --until or --for")
+		}
+	case ctx.IsSet("until"):
+		if ctx.IsSet("for") {
+			return errors.New("Error: --until and --for can't be used together")
+		}
+		t, err := time.Parse(time.RFC3339, ctx.String("until"))
+		if err != nil {
+			return fmt.Errorf("Error: malformed --until value: %v", err)
+		}
+		req.DeliverAfter = t
+	case ctx.IsSet("for"):
+		req.DeliverAfter = time.Now().Add(ctx.Duration("for"))
+	default:
+		return errors.New("Error: --until, --for or --clear is required")
+	}
+
+	return queueControl(location, req, ctx)
+}
+
+func queueControl(location string, req queue.ControlRequest, ctx *cli.Context) error {
+	req.IDs = ctx.Args()
+	req.Sender = ctx.String("sender")
+	req.Rcpt = ctx.String("rcpt")
+	if len(req.IDs) == 0 && req.Sender == "" && req.Rcpt == "" {
+		return errors.New("Error: MSGID, --sender or --rcpt is required")
+	}
+
+	req, err := queue.RequestControl(location, req)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(ctx.Duration("wait"))
+	for time.Now().Before(deadline) {
+		res, err := queue.ReadControlResult(location)
+		if err != nil {
+			return err
+		}
+		if res.Requested.Equal(req.Requested) {
+			if ctx.Bool("json") {
+				return printJSON(res)
+			}
+			for _, id := range res.Affected {
+				fmt.Println(id)
+			}
+			if !ctx.GlobalBool("quiet") {
+				fmt.Fprintf(os.Stderr, "%d messages affected\n", len(res.Affected))
+				if res.Skipped != 0 {
+					fmt.Fprintf(os.Stderr, "%d messages are skipped (being delivered right now or not held)\n", res.Skipped)
+				}
+			}
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Request is saved but not processed yet. Is the server running?")
+		fmt.Fprintln(os.Stderr, "It will be processed on the next start otherwise.")
+	}
+	return nil
+}
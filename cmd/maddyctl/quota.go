@@ -0,0 +1,72 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli"
+)
+
+func formatLimit(used, max int64) string {
+	if max == 0 {
+		return strconv.FormatInt(used, 10) + " (no limit)"
+	}
+	return fmt.Sprintf("%d / %d (%d%%)", used, max, used*100/max)
+}
+
+func imapAcctQuota(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	qbe, ok := be.(module.QuotaStorage)
+	if !ok {
+		return errors.New("Error: storage backend does not support quotas")
+	}
+
+	if ctx.IsSet("bytes") || ctx.IsSet("messages") {
+		q, err := qbe.GetQuota(username)
+		if err != nil {
+			return err
+		}
+
+		// Keep the limit that is not specified unchanged.
+		maxBytes, maxMsgs := q.MaxBytes, q.MaxMsgs
+		if ctx.IsSet("bytes") {
+			maxBytes = ctx.Int64("bytes")
+		}
+		if ctx.IsSet("messages") {
+			maxMsgs = ctx.Int64("messages")
+		}
+		return qbe.SetQuota(username, maxBytes, maxMsgs)
+	}
+
+	q, err := qbe.GetQuota(username)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Storage (bytes):", formatLimit(q.UsedBytes, q.MaxBytes))
+	fmt.Println("Messages:", formatLimit(q.UsedMsgs, q.MaxMsgs))
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli"
+)
+
+func imapAcctRetention(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	rbe, ok := be.(module.RetentionStorage)
+	if !ok {
+		return errors.New("Error: storage backend does not support retention rules")
+	}
+
+	switch ctx.NArg() {
+	case 1:
+	case 3:
+		mbox, periodStr := ctx.Args().Get(1), ctx.Args().Get(2)
+
+		var period time.Duration
+		switch periodStr {
+		case "off":
+			period = 0
+		case "default":
+			period = -1
+		default:
+			var err error
+			period, err = config.ParseDuration(periodStr)
+			if err != nil {
+				return fmt.Errorf("Error: invalid period: %v", err)
+			}
+			if period <= 0 {
+				return errors.New("Error: period should be positive")
+			}
+		}
+		return rbe.SetRetention(username, mbox, period)
+	default:
+		return errors.New("Error: both MAILBOX and PERIOD are required to change the rule")
+	}
+
+	rules, err := rbe.GetRetention(username)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		fmt.Println("No retention rules defined")
+		return nil
+	}
+
+	mboxes := make([]string, 0, len(rules))
+	for mbox := range rules {
+		mboxes = append(mboxes, mbox)
+	}
+	sort.Strings(mboxes)
+	for _, mbox := range mboxes {
+		if rules[mbox] == 0 {
+			fmt.Printf("%s: off\n", mbox)
+			continue
+		}
+		fmt.Printf("%s: %v\n", mbox, rules[mbox])
+	}
+	return nil
+}
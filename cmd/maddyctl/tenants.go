@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tenancy"
+	"github.com/urfave/cli"
+)
+
+func tenantsList(tbl module.MutableTable, ctx *cli.Context) error {
+	accounts, err := tbl.Keys()
+	if err != nil {
+		return err
+	}
+	sort.Strings(accounts)
+
+	if len(accounts) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No accounts.")
+	}
+
+	for _, acct := range accounts {
+		val, _, err := tbl.Lookup(acct)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", acct, strings.Join(tenancy.SplitDomains(val), ", "))
+	}
+	return nil
+}
+
+func tenantsSet(tbl module.MutableTable, ctx *cli.Context) error {
+	account := ctx.Args().First()
+	if account == "" {
+		return errors.New("Error: ACCOUNT is required")
+	}
+	if ctx.NArg() < 2 {
+		return errors.New("Error: at least one DOMAIN is required")
+	}
+
+	domains := make([]string, 0, ctx.NArg()-1)
+	for _, arg := range ctx.Args().Tail() {
+		norm := tenancy.SplitDomains(arg)
+		if len(norm) != 1 {
+			return fmt.Errorf("Error: malformed domain name: %s", arg)
+		}
+		domains = append(domains, norm[0])
+	}
+
+	return tbl.SetKey(account, strings.Join(domains, " "))
+}
+
+func tenantsRemove(tbl module.MutableTable, ctx *cli.Context) error {
+	account := ctx.Args().First()
+	if account == "" {
+		return errors.New("Error: ACCOUNT is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to revoke all sender domains of this account?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return tbl.RemoveKey(account)
+}
@@ -0,0 +1,78 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
+	"github.com/urfave/cli"
+)
+
+func openThrottleState(ctx *cli.Context) (throttle.State, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return throttle.State{}, err
+	}
+
+	t, ok := mod.Instance.(*throttle.Throttle)
+	if !ok {
+		return throttle.State{}, fmt.Errorf("Error: configuration block %s is not auth.throttle", ctx.String("cfg-block"))
+	}
+
+	// The module is not initialized, the state file written by the
+	// server is read instead.
+	location, err := t.ReadLocation(config.NewMap(globals, mod.Cfg))
+	if err != nil {
+		return throttle.State{}, fmt.Errorf("Error: %w", err)
+	}
+
+	state, err := throttle.ReadState(location)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return throttle.State{}, nil
+		}
+		return throttle.State{}, fmt.Errorf("Error: %w", err)
+	}
+	return state, nil
+}
+
+func throttleBlocked(state throttle.State, ctx *cli.Context) error {
+	blocked := state.Blocked(time.Now())
+
+	if ctx.Bool("json") {
+		return printJSON(blocked)
+	}
+
+	if len(blocked) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No blocked IPs.")
+	}
+	for _, b := range blocked {
+		fmt.Printf("%s: %d failures, blocked until %v", b.IP, b.Failures, b.BlockedUntil.Format(time.RFC3339))
+		if b.LastUsername != "" {
+			fmt.Printf(", last username %q", b.LastUsername)
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -21,13 +21,53 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
 	"github.com/urfave/cli"
 )
 
+// hashUserDB is implemented by user databases that allow to select the hash
+// function for the password.
+type hashUserDB interface {
+	CreateUserHash(username, password, hashFn string, opts pass_table.HashOpts) error
+	SetUserPasswordHash(username, password, hashFn string, opts pass_table.HashOpts) error
+}
+
+// hashFlags returns the hash function and parameters specified using --hash
+// and related flags.
+func hashFlags(be module.PlainUserDB, ctx *cli.Context) (string, pass_table.HashOpts, error) {
+	if _, ok := be.(hashUserDB); !ok {
+		return "", pass_table.HashOpts{}, fmt.Errorf("Error: configuration block %s does not support the hash function selection", ctx.String("cfg-block"))
+	}
+
+	hashFn := ctx.String("hash")
+	if err := checkHashFunc(hashFn); err != nil {
+		return "", pass_table.HashOpts{}, err
+	}
+	opts, err := hashOptsFromFlags(ctx)
+	if err != nil {
+		return "", pass_table.HashOpts{}, err
+	}
+	return hashFn, opts, nil
+}
+
+// invalidateCache asks the running server to drop cached authentication
+// results for the user after its credentials were changed.
+func invalidateCache(username string, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := auth.InvalidateCachedCreds(username); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: failed to invalidate cached credentials:", err)
+	}
+	return nil
+}
+
 func usersList(be module.PlainUserDB, ctx *cli.Context) error {
 	list, err := be.ListUsers()
 	if err != nil {
@@ -61,7 +101,14 @@ func usersCreate(be module.PlainUserDB, ctx *cli.Context) error {
 		}
 	}
 
-	return be.CreateUser(username, pass)
+	if ctx.String("hash") == "" {
+		return invalidateCache(username, be.CreateUser(username, pass))
+	}
+	hashFn, opts, err := hashFlags(be, ctx)
+	if err != nil {
+		return err
+	}
+	return invalidateCache(username, be.(hashUserDB).CreateUserHash(username, pass, hashFn, opts))
 }
 
 func usersRemove(be module.PlainUserDB, ctx *cli.Context) error {
@@ -76,7 +123,7 @@ func usersRemove(be module.PlainUserDB, ctx *cli.Context) error {
 		}
 	}
 
-	return be.DeleteUser(username)
+	return invalidateCache(username, be.DeleteUser(username))
 }
 
 func usersPassword(be module.PlainUserDB, ctx *cli.Context) error {
@@ -96,5 +143,71 @@ func usersPassword(be module.PlainUserDB, ctx *cli.Context) error {
 		}
 	}
 
-	return be.SetUserPassword(username, pass)
+	if ctx.String("hash") == "" {
+		return invalidateCache(username, be.SetUserPassword(username, pass))
+	}
+	hashFn, opts, err := hashFlags(be, ctx)
+	if err != nil {
+		return err
+	}
+	return invalidateCache(username, be.(hashUserDB).SetUserPasswordHash(username, pass, hashFn, opts))
+}
+
+type hashImporter interface {
+	ImportUser(username, hash string, create bool) error
+}
+
+func usersImport(be module.PlainUserDB, ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return errors.New("Error: FILE is required")
+	}
+
+	importer, ok := be.(hashImporter)
+	if !ok {
+		return fmt.Errorf("Error: configuration block %s does not support credentials import", ctx.String("cfg-block"))
+	}
+
+	var f io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error: %w", err)
+		}
+		defer file.Close()
+		f = file
+	}
+
+	entries, err := pass_table.ReadImport(f, ctx.String("format"))
+	if err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+
+	var imported, mustReset, failed int
+	for _, e := range entries {
+		if e.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, e.Line, e.Err)
+			failed++
+			continue
+		}
+
+		err := importer.ImportUser(e.Username, e.Hash, ctx.Bool("create"))
+		if err := invalidateCache(e.Username, err); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, e.Line, err)
+			failed++
+			continue
+		}
+
+		if !e.Supported {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s: unsupported hash scheme, password must be reset\n", path, e.Line, e.Username)
+			mustReset++
+		}
+		imported++
+	}
+
+	fmt.Fprintf(os.Stderr, "%d imported (%d must reset password), %d failed\n", imported, mustReset, failed)
+	if failed != 0 {
+		return errors.New("Error: some entries failed to import")
+	}
+	return nil
 }
@@ -48,6 +48,17 @@ func logOutput(m *config.Map, node config.Node) (interface{}, error) {
 		return nil, config.NodeErr(node, "can't declare block here")
 	}
 
+	if config.CheckOnly {
+		// Do not open log files or connect to syslog, errors found during
+		// the check are reported to the -log targets.
+		for _, arg := range node.Args {
+			if arg == "off" && len(node.Args) != 1 {
+				return nil, config.NodeErr(node, "'off' can't be combined with other log targets")
+			}
+		}
+		return log.DefaultLogger.Out, nil
+	}
+
 	return LogOutputOption(node.Args)
 }
 
@@ -23,7 +23,6 @@ import (
 	"unicode/utf8"
 
 	"github.com/foxcpp/maddy/framework/dns"
-	"golang.org/x/net/idna"
 	"golang.org/x/text/unicode/norm"
 )
 
@@ -57,8 +56,8 @@ func ForLookup(addr string) (string, error) {
 
 // CleanDomain returns the address with the domain part converted into its canonical form.
 //
-// More specifically, converts the domain part of the address to U-labels,
-// normalizes it to NFC and then case-folds it.
+// More specifically, converts the domain part of the address to U-labels
+// and case-folds it as done by dns.ForLookup. The local-part is left as is.
 //
 // Original value is also returned on the error.
 func CleanDomain(addr string) (string, error) {
@@ -67,11 +66,10 @@ func CleanDomain(addr string) (string, error) {
 		return addr, err
 	}
 
-	uDomain, err := idna.ToUnicode(domain)
+	uDomain, err := dns.ForLookup(domain)
 	if err != nil {
 		return addr, err
 	}
-	uDomain = strings.ToLower(norm.NFC.String(uDomain))
 
 	if domain == "" {
 		return mbox, nil
@@ -106,7 +104,7 @@ func Equal(addr1, addr2 string) bool {
 
 func IsASCII(s string) bool {
 	for _, ch := range s {
-		if ch > utf8.RuneSelf {
+		if ch >= utf8.RuneSelf {
 			return false
 		}
 	}
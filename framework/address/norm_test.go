@@ -43,6 +43,7 @@ func TestForLookup(t *testing.T) {
 	test("test@example.org", "test@example.org", false)
 	test("E\u0301@example.org", "\u00E9@example.org", false)
 	test("test@EXAMPLE.org", "test@example.org", false)
+	test("test@ｅｘａｍｐｌｅ．ｏｒｇ", "test@example.org", false)
 	test("test@xn--e1aybc.example.org", "test@тест.example.org", false)
 	test("TEST@xn--99999999999.example.org", "test@xn--99999999999.example.org", true)
 	test("tESt@", "test@", true)
@@ -85,4 +86,7 @@ func TestIsASCII(t *testing.T) {
 	if IsASCII("тест") {
 		t.Errorf("'тест' is non-ASCII")
 	}
+	if IsASCII("\u0080") {
+		t.Errorf("'\\u0080' is non-ASCII")
+	}
 }
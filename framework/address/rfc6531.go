@@ -37,10 +37,8 @@ func ToASCII(addr string) (string, error) {
 		return addr, err
 	}
 
-	for _, ch := range mbox {
-		if ch > 128 {
-			return addr, ErrUnicodeMailbox
-		}
+	if !IsASCII(mbox) {
+		return addr, ErrUnicodeMailbox
 	}
 
 	if domain == "" {
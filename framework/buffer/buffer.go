@@ -21,7 +21,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package buffer
 
 import (
+	"errors"
 	"io"
+	"os"
 )
 
 // Buffer interface represents abstract temporary storage for blobs.
@@ -52,9 +54,59 @@ type Buffer interface {
 	// Multiple Buffer objects may refer to the same underlying storage.
 	// In this case, care should be taken to ensure that Remove is called
 	// only once since it will discard the shared storage and invalidate
-	// all Buffer objects using it.
+	// all Buffer objects using it. Implementations of RefCounted are an
+	// exception, see below.
 	//
 	// Readers previously created using Open can still be used, but
 	// new ones can't be created.
 	Remove() error
 }
+
+// RefCounted is implemented by Buffer implementations that allow sharing the
+// underlying storage without copying it.
+//
+// Ref returns a new Buffer referring to the same storage. The storage is
+// discarded only after Remove is called for the original Buffer and for
+// all Buffers returned by Ref. This allows a function to preserve the
+// storage contents after it returns (see Buffer).
+type RefCounted interface {
+	Buffer
+	Ref() Buffer
+}
+
+// ErrNotFile is returned by Link if the blob is not stored in a file.
+var ErrNotFile = errors.New("buffer: blob is not stored in a file")
+
+// FileBacked is implemented by Buffer implementations that may keep the blob
+// in a file.
+//
+// FilePath returns the path of the file if the blob is stored in one. This
+// allows to use the file directly instead of streaming it through Open, e.g. to
+// hard-link it (see Link) or to let the kernel copy it.
+//
+// The file is owned by the Buffer creator. Other users must not modify,
+// rename or remove it and should not use the path after they return control
+// to the creator (see Buffer for the lifetime convention). The file is
+// removed by Remove as usual, hard links created by other users are not
+// affected by it.
+type FileBacked interface {
+	FilePath() (string, bool)
+}
+
+// Link creates a hard link to the file storing the blob at the specified path,
+// this allows to persist the blob without copying it. ErrNotFile is returned
+// if b does not keep the blob in a file.
+//
+// The linked file should not be modified. Callers should fall back to copying
+// if Link fails, e.g. because the path is on a different file system.
+func Link(b Buffer, path string) error {
+	fb, ok := b.(FileBacked)
+	if !ok {
+		return ErrNotFile
+	}
+	src, ok := fb.FilePath()
+	if !ok {
+		return ErrNotFile
+	}
+	return os.Link(src, path)
+}
@@ -0,0 +1,470 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed blobs start with the header that consists of compressMagic,
+// algorithm ID and the size of the uncompressed blob (big-endian uint64).
+//
+// Blobs that don't start with compressMagic are considered to be stored as
+// is. This way stores containing both compressed and uncompressed blobs (e.g.
+// after compression was enabled) are read correctly. compressMagic starts
+// with NUL byte that does not appear at the start of messages and their
+// bodies, unless BINARYMIME is used.
+const (
+	compressMagic     = "\x00MZC"
+	compressHeaderLen = len(compressMagic) + 1 + 8
+)
+
+const (
+	algoGzip byte = 1
+	algoZstd byte = 2
+)
+
+var algoIDs = map[string]byte{
+	"gzip": algoGzip,
+	"zstd": algoZstd,
+}
+
+// Compression contains parameters for compression of blobs at rest.
+type Compression struct {
+	// Algo is the compression algorithm to use, either "gzip" or "zstd". Empty
+	// string disables compression.
+	Algo string
+
+	// Level is the algorithm-specific compression level, 0 means the
+	// default level.
+	Level int
+
+	// MinSize is the minimal size of the blob to compress. Smaller blobs are
+	// stored as is since the compression gives little benefit for them.
+	MinSize int
+}
+
+// ParseCompression parses the compression configuration in the "algo
+// [level]" format, as used in configuration directives. "off" disables
+// compression.
+func ParseCompression(args []string) (Compression, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return Compression{}, errors.New("expected 1 or 2 arguments")
+	}
+	if args[0] == "off" {
+		if len(args) != 1 {
+			return Compression{}, errors.New("unexpected compression level with compression disabled")
+		}
+		return Compression{}, nil
+	}
+
+	c := Compression{Algo: args[0]}
+	if _, ok := algoIDs[c.Algo]; !ok {
+		return Compression{}, fmt.Errorf("unknown compression algorithm: %s", c.Algo)
+	}
+	if len(args) == 2 {
+		var err error
+		c.Level, err = strconv.Atoi(args[1])
+		if err != nil {
+			return Compression{}, fmt.Errorf("malformed compression level: %v", err)
+		}
+		if c.Algo == "gzip" && (c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression) {
+			return Compression{}, fmt.Errorf("gzip compression level should be in range from %d to %d",
+				gzip.HuffmanOnly, gzip.BestCompression)
+		}
+	}
+	return c, nil
+}
+
+// Enabled reports whether the compression should be used.
+func (c Compression) Enabled() bool {
+	return c.Algo != ""
+}
+
+func (c Compression) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch c.Algo {
+	case "gzip":
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return getZstdEncoder(w, level)
+	default:
+		return nil, fmt.Errorf("buffer: unknown compression algorithm: %s", c.Algo)
+	}
+}
+
+// Encoders allocate a lot of memory for their state so they are reused.
+var zstdEncoders [zstd.SpeedBestCompression + 1]sync.Pool
+
+type pooledEncoder struct {
+	*zstd.Encoder
+	level zstd.EncoderLevel
+}
+
+func (pe pooledEncoder) Close() error {
+	err := pe.Encoder.Close()
+	pe.Encoder.Reset(nil)
+	zstdEncoders[pe.level].Put(pe.Encoder)
+	return err
+}
+
+func getZstdEncoder(w io.Writer, level zstd.EncoderLevel) (io.WriteCloser, error) {
+	if enc, ok := zstdEncoders[level].Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return pooledEncoder{Encoder: enc, level: level}, nil
+	}
+
+	// Messages are compressed in parallel anyway so there is no point in
+	// spawning more goroutines. Note that the encoder still writes complete
+	// blocks from a separate goroutine, see statWriter.
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return pooledEncoder{Encoder: enc, level: level}, nil
+}
+
+// NewWriter returns the CompressWriter that stores data written to it in f.
+//
+// The blob is written starting at the current offset of f, data before it is
+// left untouched. f should not contain any data after that offset.
+func (c Compression) NewWriter(f *os.File) *CompressWriter {
+	return &CompressWriter{c: c, f: &statWriter{w: f}, file: f}
+}
+
+// statWriter counts the bytes written to the underlying writer and the
+// time spent doing that so it can be excluded from the compression time.
+//
+// The zstd encoder calls Write from its own goroutine, so the counters are
+// protected by the mutex.
+type statWriter struct {
+	w io.Writer
+
+	lock    sync.Mutex
+	n       int64
+	elapsed time.Duration
+}
+
+func (sw *statWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := sw.w.Write(b)
+	elapsed := time.Since(start)
+
+	sw.lock.Lock()
+	sw.elapsed += elapsed
+	sw.n += int64(n)
+	sw.lock.Unlock()
+	return n, err
+}
+
+func (sw *statWriter) stats() (n int64, elapsed time.Duration) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	return sw.n, sw.elapsed
+}
+
+// CompressWriter compresses the data written to it if at least
+// Compression.MinSize bytes are written in total. Otherwise, data is stored
+// as is.
+//
+// Data is written to the underlying file as it is compressed, Close should be
+// called to flush the remaining data. It does not close the file.
+type CompressWriter struct {
+	c    Compression
+	f    *statWriter
+	file *os.File
+	// Offset of the blob header in file.
+	base int64
+
+	// Data written before the compression is started (less than MinSize).
+	pending []byte
+	// Compressor, nil if not started yet.
+	w       io.WriteCloser
+	size    int64
+	elapsed time.Duration
+	closed  bool
+}
+
+func (cw *CompressWriter) start() error {
+	var err error
+	cw.base, err = cw.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	var hdr [compressHeaderLen]byte
+	copy(hdr[:], compressMagic)
+	hdr[len(compressMagic)] = algoIDs[cw.c.Algo]
+	// Size is written on Close, once it is known.
+	if _, err := cw.f.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	cw.w, err = cw.c.compressor(cw.f)
+	if err != nil {
+		return err
+	}
+
+	pending := cw.pending
+	cw.pending = nil
+	return cw.compress(func() error {
+		_, err := cw.w.Write(pending)
+		return err
+	})
+}
+
+// compress calls f and adds the time spent in it to the compression time,
+// excluding the time spent writing to the file. File writes done by the zstd
+// encoder goroutine are excluded as well, so the result is approximate.
+func (cw *CompressWriter) compress(f func() error) error {
+	start := time.Now()
+	_, fileStart := cw.f.stats()
+	err := f()
+	_, fileEnd := cw.f.stats()
+	if elapsed := time.Since(start) - (fileEnd - fileStart); elapsed > 0 {
+		cw.elapsed += elapsed
+	}
+	return err
+}
+
+func (cw *CompressWriter) Write(b []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.New("buffer: write to closed CompressWriter")
+	}
+	cw.size += int64(len(b))
+
+	if cw.w != nil {
+		if err := cw.compress(func() error {
+			_, err := cw.w.Write(b)
+			return err
+		}); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	cw.pending = append(cw.pending, b...)
+	if !cw.c.Enabled() || len(cw.pending) < cw.c.MinSize {
+		return len(b), nil
+	}
+	if err := cw.start(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom implements io.ReaderFrom so io.Copy does not allocate an
+// intermediate buffer.
+func (cw *CompressWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n != 0 {
+			if _, err := cw.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Close flushes the remaining data to the file.
+func (cw *CompressWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+
+	if cw.w == nil {
+		_, err := cw.f.Write(cw.pending)
+		cw.pending = nil
+		return err
+	}
+
+	if err := cw.compress(cw.w.Close); err != nil {
+		return err
+	}
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(cw.size))
+	_, err := cw.file.WriteAt(size[:], cw.base+int64(len(compressMagic)+1))
+	return err
+}
+
+// Compressed reports whether the data is stored compressed. The value is
+// final only after Close.
+func (cw *CompressWriter) Compressed() bool {
+	return cw.w != nil
+}
+
+// Stats returns the amount of bytes written to CompressWriter, the amount of
+// bytes written to the file and the time spent compressing the data, without
+// the time spent writing it to the file. The values are final only after
+// Close.
+func (cw *CompressWriter) Stats() (in, out int64, elapsed time.Duration) {
+	out, _ = cw.f.stats()
+	return cw.size, out, cw.elapsed
+}
+
+type decompressReader struct {
+	io.Reader
+	close func()
+}
+
+func (dr decompressReader) Close() error {
+	if dr.close != nil {
+		dr.close()
+	}
+	return nil
+}
+
+// parseHeader checks whether the blob starting with hdr is compressed and
+// returns the algorithm ID and the size of the uncompressed blob.
+func parseHeader(hdr []byte) (algo byte, size int64, compressed bool) {
+	if len(hdr) < compressHeaderLen || string(hdr[:len(compressMagic)]) != compressMagic {
+		return 0, -1, false
+	}
+	algo = hdr[len(compressMagic)]
+	size = int64(binary.BigEndian.Uint64(hdr[len(compressMagic)+1:]))
+	return algo, size, true
+}
+
+// Decompress returns the reader for the blob stored using CompressWriter.
+//
+// If the blob is compressed, size of the uncompressed blob is returned,
+// otherwise the blob is returned as is and size is -1.
+//
+// Close on the returned reader does not close r.
+func Decompress(r io.Reader) (rd io.ReadCloser, size int64, err error) {
+	br := bufio.NewReader(r)
+	hdr, err := br.Peek(compressHeaderLen)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	algo, size, compressed := parseHeader(hdr)
+	if !compressed {
+		return decompressReader{Reader: br}, -1, nil
+	}
+	if _, err := br.Discard(compressHeaderLen); err != nil {
+		return nil, 0, err
+	}
+
+	switch algo {
+	case algoGzip:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		return decompressReader{Reader: gzr}, size, nil
+	case algoZstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, 0, err
+		}
+		return decompressReader{Reader: zr, close: zr.Close}, size, nil
+	default:
+		return nil, 0, fmt.Errorf("buffer: unknown compression algorithm ID: %d", algo)
+	}
+}
+
+// CompressedFileBuffer implements Buffer for files written using
+// CompressWriter that contain compressed data, see OpenFile.
+type CompressedFileBuffer struct {
+	Path string
+	// Size is the size of the uncompressed blob.
+	Size int
+}
+
+type fileReadCloser struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (frc fileReadCloser) Close() error {
+	frc.ReadCloser.Close()
+	return frc.f.Close()
+}
+
+func (cfb CompressedFileBuffer) Open() (io.ReadCloser, error) {
+	f, err := os.Open(cfb.Path)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := Decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fileReadCloser{ReadCloser: r, f: f}, nil
+}
+
+func (cfb CompressedFileBuffer) Len() int {
+	return cfb.Size
+}
+
+func (cfb CompressedFileBuffer) Remove() error {
+	return os.Remove(cfb.Path)
+}
+
+// OpenFile returns the Buffer for the file written using CompressWriter.
+//
+// FileBuffer is returned if the file is not compressed, otherwise
+// CompressedFileBuffer is returned.
+func OpenFile(path string) (Buffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, compressHeaderLen)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	_, size, compressed := parseHeader(hdr[:n])
+	if !compressed {
+		return FileBuffer{Path: path}, nil
+	}
+	return CompressedFileBuffer{Path: path, Size: int(size)}, nil
+}
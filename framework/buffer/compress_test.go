@@ -0,0 +1,374 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testWords = strings.Fields(`the of and to in is you that it he was for on are as with his they
+at be this have from or one had by word but not what all were we when your can said there use
+an each which she do how their if will up other about out many then them these so some her would
+make like him into time has look two more write go see number no way could people my than first
+meeting report attached please regards thanks best project update schedule review`)
+
+// testBody returns the text resembling a typical message body: plain text
+// followed by a base64-encoded attachment.
+func testBody(size int) string {
+	rnd := rand.New(rand.NewSource(1))
+
+	var sb strings.Builder
+	for line := 0; sb.Len() < size/2; line++ {
+		for i := 0; i < 12; i++ {
+			sb.WriteString(testWords[rnd.Intn(len(testWords))])
+			sb.WriteByte(' ')
+		}
+		sb.WriteString("\r\n")
+	}
+
+	attachment := make([]byte, size)
+	rnd.Read(attachment)
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	for len(encoded) > 76 && sb.Len() < size {
+		sb.WriteString(encoded[:76])
+		sb.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	return sb.String()[:size]
+}
+
+func writeCompressed(t testing.TB, c Compression, path, blob string) *CompressWriter {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cw := c.NewWriter(f)
+	if _, err := io.Copy(cw, strings.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return cw
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, algo := range []string{"gzip", "zstd"} {
+		algo := algo
+		t.Run(algo, func(t *testing.T) {
+			c := Compression{Algo: algo, MinSize: 4096}
+			path := filepath.Join(dir, algo)
+
+			blob := testBody(64 * 1024)
+			cw := writeCompressed(t, c, path, blob)
+			if !cw.Compressed() {
+				t.Fatal("blob is not compressed")
+			}
+			in, out, _ := cw.Stats()
+			if in != int64(len(blob)) {
+				t.Fatal("wrong input size:", in)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != info.Size() || out >= in {
+				t.Fatal("wrong output size:", out, info.Size())
+			}
+
+			buf, err := OpenFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := buf.(CompressedFileBuffer); !ok {
+				t.Fatalf("wrong buffer type: %T", buf)
+			}
+			if buf.Len() != len(blob) {
+				t.Fatal("wrong length:", buf.Len())
+			}
+			if readAll(t, buf) != blob {
+				t.Fatal("blob is corrupted")
+			}
+			if err := buf.Remove(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCompression_Stats(t *testing.T) {
+	// Blob spans multiple zstd blocks, so the encoder writes some of them
+	// from its own goroutine.
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blob")
+	blob := testBody(1024 * 1024)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cw := Compression{Algo: "zstd"}.NewWriter(f)
+	for i := 0; i < len(blob); i += 16 * 1024 {
+		if _, err := cw.Write([]byte(blob[i : i+16*1024])); err != nil {
+			t.Fatal(err)
+		}
+		cw.Stats()
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	in, out, elapsed := cw.Stats()
+	if in != int64(len(blob)) {
+		t.Fatal("wrong input size:", in)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != info.Size() {
+		t.Fatal("wrong output size:", out, info.Size())
+	}
+	if elapsed <= 0 {
+		t.Fatal("compression time is not measured:", elapsed)
+	}
+}
+
+func TestCompression_MinSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Compression{Algo: "zstd", MinSize: 4096}
+	path := filepath.Join(dir, "small")
+
+	blob := testBody(4095)
+	if writeCompressed(t, c, path, blob).Compressed() {
+		t.Fatal("blob below MinSize is compressed")
+	}
+
+	stored, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != blob {
+		t.Fatal("blob is not stored as is")
+	}
+
+	buf, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := buf.(FileBuffer); !ok {
+		t.Fatalf("wrong buffer type: %T", buf)
+	}
+	if readAll(t, buf) != blob {
+		t.Fatal("blob is corrupted")
+	}
+}
+
+func TestCompression_Uncompressed(t *testing.T) {
+	// Files written without compression enabled (or before it was enabled)
+	// should be readable.
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, blob := range []string{"", "a", testBody(64 * 1024)} {
+		path := filepath.Join(dir, "blob")
+		if err := ioutil.WriteFile(path, []byte(blob), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != len(blob) {
+			t.Fatal("wrong length:", buf.Len())
+		}
+		if readAll(t, buf) != blob {
+			t.Fatal("blob is corrupted")
+		}
+	}
+}
+
+func TestCompression_Offset(t *testing.T) {
+	// Blob can be preceded by other data, e.g. the header of the storage
+	// using it.
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("prefix")); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := testBody(64 * 1024)
+	cw := Compression{Algo: "zstd"}.NewWriter(f)
+	if _, err := io.Copy(cw, strings.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := make([]byte, 6)
+	if _, err := f.ReadAt(prefix, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(prefix) != "prefix" {
+		t.Fatalf("data before the blob is overwritten: %q", prefix)
+	}
+	if _, err := f.Seek(int64(len(prefix)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	r, size, err := Decompress(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if size != int64(len(blob)) {
+		t.Fatal("wrong size:", size)
+	}
+	stored, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != blob {
+		t.Fatal("blob is corrupted")
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, args := range [][]string{
+		{}, {"lzma"}, {"off", "1"}, {"zstd", "a"}, {"gzip", "10"}, {"zstd", "1", "2"},
+	} {
+		if _, err := ParseCompression(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+
+	c, err := ParseCompression([]string{"zstd", "19"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Algo != "zstd" || c.Level != 19 || !c.Enabled() {
+		t.Fatalf("wrong result: %+v", c)
+	}
+	c, err = ParseCompression([]string{"off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Enabled() {
+		t.Fatal("compression is enabled")
+	}
+}
+
+func benchmarkCompression(b *testing.B, c Compression) {
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blob := testBody(256 * 1024)
+	path := filepath.Join(dir, "blob")
+
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	var out int64
+	for i := 0; i < b.N; i++ {
+		cw := writeCompressed(b, c, path, blob)
+		_, out, _ = cw.Stats()
+	}
+	b.ReportMetric(float64(len(blob))/float64(out), "ratio")
+}
+
+func BenchmarkCompression_Off(b *testing.B) {
+	benchmarkCompression(b, Compression{})
+}
+
+func BenchmarkCompression_Gzip(b *testing.B) {
+	benchmarkCompression(b, Compression{Algo: "gzip"})
+}
+
+func BenchmarkCompression_Zstd(b *testing.B) {
+	benchmarkCompression(b, Compression{Algo: "zstd"})
+}
+
+func BenchmarkCompression_ZstdRead(b *testing.B) {
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blob := testBody(256 * 1024)
+	path := filepath.Join(dir, "blob")
+	writeCompressed(b, Compression{Algo: "zstd"}, path, blob)
+
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := OpenFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r, err := buf.Open()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
@@ -60,6 +60,10 @@ func (fb FileBuffer) Remove() error {
 	return os.Remove(fb.Path)
 }
 
+func (fb FileBuffer) FilePath() (string, bool) {
+	return fb.Path, true
+}
+
 // BufferInFile is a convenience function which creates FileBuffer with underlying
 // file created in the specified directory with the random name.
 func BufferInFile(r io.Reader, dir string) (Buffer, error) {
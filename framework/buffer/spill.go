@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// spillStorage is the storage shared by SpillBuffer handles.
+type spillStorage struct {
+	refs int32
+
+	// Either blob or path is set.
+	blob []byte
+	path string
+	size int
+}
+
+// SpillBuffer implements Buffer interface keeping small blobs in memory and
+// larger ones in a temporary file.
+//
+// SpillBuffer is reference-counted (see RefCounted): additional handles can be
+// created using Ref and the underlying file is removed only when Remove is
+// called for all of them. Multiple readers created using Open can be used
+// concurrently.
+type SpillBuffer struct {
+	s       *spillStorage
+	removed int32
+}
+
+// BufferSpill is a convenience function which creates SpillBuffer with
+// contents of the passed io.Reader. The blob is kept in memory if it is not
+// larger than threshold bytes, otherwise it is written to a file with a
+// random name in the specified directory.
+func BufferSpill(r io.Reader, threshold int, dir string) (*SpillBuffer, error) {
+	var initial bytes.Buffer
+	if _, err := initial.ReadFrom(io.LimitReader(r, int64(threshold)+1)); err != nil {
+		return nil, err
+	}
+	if initial.Len() <= threshold {
+		return &SpillBuffer{s: &spillStorage{
+			refs: 1,
+			blob: initial.Bytes(),
+			size: initial.Len(),
+		}}, nil
+	}
+
+	f, err := ioutil.TempFile(dir, "spill-")
+	if err != nil {
+		return nil, fmt.Errorf("buffer: failed to create file: %v", err)
+	}
+	size, err := io.Copy(f, io.MultiReader(&initial, r))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("buffer: failed to write file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("buffer: failed to close file: %v", err)
+	}
+
+	return &SpillBuffer{s: &spillStorage{
+		refs: 1,
+		path: f.Name(),
+		size: int(size),
+	}}, nil
+}
+
+func (sb *SpillBuffer) Open() (io.ReadCloser, error) {
+	if atomic.LoadInt32(&sb.removed) != 0 {
+		return nil, errors.New("buffer: Open called for removed buffer")
+	}
+	if sb.s.path == "" {
+		return NewBytesReader(sb.s.blob), nil
+	}
+	return os.Open(sb.s.path)
+}
+
+func (sb *SpillBuffer) Len() int {
+	return sb.s.size
+}
+
+// Ref creates a new handle referring to the same storage. It should not be
+// called after Remove.
+func (sb *SpillBuffer) Ref() Buffer {
+	atomic.AddInt32(&sb.s.refs, 1)
+	return &SpillBuffer{s: sb.s}
+}
+
+// Remove releases the handle. The underlying file is removed once all
+// handles are released. Subsequent calls are no-op.
+func (sb *SpillBuffer) Remove() error {
+	if !atomic.CompareAndSwapInt32(&sb.removed, 0, 1) {
+		return nil
+	}
+	if atomic.AddInt32(&sb.s.refs, -1) != 0 {
+		return nil
+	}
+	if sb.s.path == "" {
+		return nil
+	}
+	return os.Remove(sb.s.path)
+}
+
+// FilePath returns the path of the underlying file if the blob is not kept in
+// memory and the handle is not removed.
+func (sb *SpillBuffer) FilePath() (string, bool) {
+	if sb.s.path == "" || atomic.LoadInt32(&sb.removed) != 0 {
+		return "", false
+	}
+	return sb.s.path, true
+}
@@ -0,0 +1,158 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package buffer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func readAll(t *testing.T, b Buffer) string {
+	t.Helper()
+	r, err := b.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(blob)
+}
+
+func dirEntries(t *testing.T, dir string) int {
+	t.Helper()
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(list)
+}
+
+func TestSpillBuffer_Memory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, blob := range []string{"", "small", "0123456789"} {
+		b, err := BufferSpill(strings.NewReader(blob), 10, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() != len(blob) || readAll(t, b) != blob {
+			t.Fatal("Wrong contents for", blob)
+		}
+		if err := Link(b, filepath.Join(dir, "link")); err != ErrNotFile {
+			t.Fatal("Blob is not kept in memory:", err)
+		}
+		if err := b.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dirEntries(t, dir) != 0 {
+		t.Fatal("Files created for small blobs")
+	}
+}
+
+func TestSpillBuffer_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-buffer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blob := strings.Repeat("0123456789", 1000)
+	b, err := BufferSpill(strings.NewReader(blob), 100, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != len(blob) {
+		t.Fatal("Wrong length:", b.Len())
+	}
+	if dirEntries(t, dir) != 1 {
+		t.Fatal("Blob is not spilled to the file")
+	}
+
+	// Concurrent readers are independent.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := b.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer r.Close()
+			var buf bytes.Buffer
+			if _, err := buf.ReadFrom(r); err != nil {
+				t.Error(err)
+				return
+			}
+			if buf.String() != blob {
+				t.Error("Wrong contents")
+			}
+		}()
+	}
+	wg.Wait()
+
+	ref := b.Ref()
+	if err := b.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	// Repeated Remove does not drop the reference twice.
+	if err := b.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Open(); err == nil {
+		t.Fatal("Open succeeded for removed handle")
+	}
+	if readAll(t, ref) != blob {
+		t.Fatal("Wrong contents read using the reference")
+	}
+
+	if _, ok := b.FilePath(); ok {
+		t.Fatal("FilePath returned the path for removed handle")
+	}
+	if err := Link(ref, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ref.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if dirEntries(t, dir) != 1 {
+		t.Fatal("File is not removed after the last reference is released")
+	}
+	linked, err := ioutil.ReadFile(filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(linked) != blob {
+		t.Fatal("Wrong contents of the linked file")
+	}
+}
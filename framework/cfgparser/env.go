@@ -46,7 +46,7 @@ func expandEnvironment(nodes []Node) []Node {
 	return newNodes
 }
 
-var unixEnvvarRe = regexp.MustCompile(`{env:([^\$]+)}`)
+var unixEnvvarRe = regexp.MustCompile(`{env:([^\$}]+)}`)
 
 func removeUnexpandedEnvvars(s string) string {
 	s = unixEnvvarRe.ReplaceAllString(s, "")
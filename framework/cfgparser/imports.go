@@ -22,7 +22,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/foxcpp/maddy/framework/log"
 )
 
 func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, error) {
@@ -40,7 +43,7 @@ func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, err
 			return node, err
 		}
 
-		if child.Name == "import" {
+		if child.Name == "import" || child.Name == "include" {
 			// We check it here instead of function start so we can
 			// use line information from import directive that is likely
 			// caused this error.
@@ -49,11 +52,15 @@ func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, err
 			}
 
 			containsImports = true
-			if len(child.Args) != 1 {
-				return node, ctx.Err("import directive requires exactly 1 argument")
+			var subtree []Node
+			if child.Name == "import" {
+				if len(child.Args) != 1 {
+					return node, ctx.Err("import directive requires exactly 1 argument")
+				}
+				subtree, err = ctx.resolveImport(child, child.Args[0], expansionDepth)
+			} else {
+				subtree, err = ctx.resolveInclude(child, expansionDepth)
 			}
-
-			subtree, err := ctx.resolveImport(child, child.Args[0], expansionDepth)
 			if err != nil {
 				return node, err
 			}
@@ -80,21 +87,93 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 	}
 
 	file := filepath.Join(filepath.Dir(ctx.fileLocation), name)
-	src, err := os.Open(file)
-	if err != nil {
-		if os.IsNotExist(err) {
-			src, err = os.Open(file + ".conf")
+	if _, err := os.Stat(file); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		file += ".conf"
+		if _, err := os.Stat(file); err != nil {
+			if os.IsNotExist(err) {
+				return nil, NodeErr(node, "unknown import: "+name)
+			}
+			return nil, err
+		}
+	}
+	return ctx.readFile(node, file, expansionDepth)
+}
+
+// resolveInclude reads files matching patterns specified in the include
+// directive:
+//
+//   include [required] pattern...
+//
+// Patterns are relative to the directory of the including file, files
+// matching each pattern are included in lexicographical order.
+func (ctx *parseContext) resolveInclude(node Node, expansionDepth int) ([]Node, error) {
+	patterns := node.Args
+	required := false
+	if len(patterns) > 1 && patterns[0] == "required" {
+		required = true
+		patterns = patterns[1:]
+	}
+	if len(patterns) == 0 {
+		return nil, NodeErr(node, "include directive requires at least 1 argument")
+	}
+
+	var res []Node
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(ctx.fileLocation), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, NodeErr(node, "malformed pattern %s: %v", pattern, err)
+		}
+		if len(files) == 0 {
+			if required {
+				return nil, NodeErr(node, "no files match %s", pattern)
+			}
+			log.Printf("%s:%d: no files match %s, ignoring", node.File, node.Line, pattern)
+			continue
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil && info.IsDir() {
+				continue
+			}
+			nodes, err := ctx.readFile(node, file, expansionDepth)
 			if err != nil {
-				if os.IsNotExist(err) {
-					return nil, NodeErr(node, "unknown import: "+name)
-				}
 				return nil, err
 			}
-		} else {
-			return nil, err
+			res = append(res, nodes...)
 		}
 	}
-	nodes, snips, macros, err := readTree(src, file, expansionDepth+1)
+	return res, nil
+}
+
+// readFile reads the file referenced by the import or include directive.
+func (ctx *parseContext) readFile(node Node, file string, expansionDepth int) ([]Node, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	for i, parent := range ctx.fileChain {
+		if parent == absFile {
+			chain := append(ctx.fileChain[i:len(ctx.fileChain):len(ctx.fileChain)], absFile)
+			return nil, NodeErr(node, "import cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	// Macros defined in the importing file are available in the imported
+	// one.
+	nodes, snips, macros, err := readTree(src, file, expansionDepth+1, ctx)
 	if err != nil {
 		return nodes, err
 	}
@@ -108,17 +187,22 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 	return nodes, nil
 }
 
+// expandMacros replaces macro references in node arguments with their
+// values. Children of the node are not processed since they are expanded
+// when they are read, this way each argument is expanded exactly once.
 func (ctx *parseContext) expandMacros(node *Node) error {
 	if strings.HasPrefix(node.Name, "$(") && strings.HasSuffix(node.Name, ")") {
-		return ctx.Err("can't use macro argument as directive name")
+		return NodeErr(*node, "can't use macro argument as directive name")
 	}
 
 	newArgs := make([]string, 0, len(node.Args))
 	for _, arg := range node.Args {
-		if !strings.HasPrefix(arg, "$(") || !strings.HasSuffix(arg, ")") {
+		// The argument that is a single reference can be replaced with
+		// multiple arguments.
+		if loc := macroRe.FindStringIndex(arg); loc == nil || loc[0] != 0 || loc[1] != len(arg) {
 			if strings.Contains(arg, "$(") && strings.Contains(arg, ")") {
 				var err error
-				arg, err = ctx.expandSingleValueMacro(arg)
+				arg, err = ctx.expandSingleValueMacro(node, arg)
 				if err != nil {
 					return err
 				}
@@ -131,43 +215,45 @@ func (ctx *parseContext) expandMacros(node *Node) error {
 		macroName := arg[2 : len(arg)-1]
 		replacement, ok := ctx.macros[macroName]
 		if !ok {
-			// Undefined macros are expanded to zero arguments.
-			continue
+			return NodeErr(*node, "undefined macro: %s", macroName)
 		}
 
 		newArgs = append(newArgs, replacement...)
 	}
 	node.Args = newArgs
 
-	if node.Children != nil {
-		for i := range node.Children {
-			if err := ctx.expandMacros(&node.Children[i]); err != nil {
-				return err
-			}
-		}
-	}
-
 	return nil
 }
 
-var macroRe = regexp.MustCompile(`\$\(([^\$]+)\)`)
+var macroRe = regexp.MustCompile(`\$\(([^\$\)]+)\)`)
 
-func (ctx *parseContext) expandSingleValueMacro(arg string) (string, error) {
-	matches := macroRe.FindAllStringSubmatch(arg, -1)
-	for _, match := range matches {
-		macroName := match[1]
-		if len(ctx.macros[macroName]) > 1 {
-			return "", ctx.Err("can't expand macro with multiple arguments inside a string")
+func (ctx *parseContext) expandSingleValueMacro(node *Node, arg string) (string, error) {
+	var err error
+	res := macroRe.ReplaceAllStringFunc(arg, func(ref string) string {
+		if err != nil {
+			return ""
 		}
-
-		var value string
-		if ctx.macros[macroName] != nil {
-			// Macros have at least one argument.
-			value = ctx.macros[macroName][0]
+		macroName := ref[2 : len(ref)-1]
+		value, ok := ctx.macros[macroName]
+		if !ok {
+			err = NodeErr(*node, "undefined macro: %s", macroName)
+			return ""
 		}
-
-		arg = strings.Replace(arg, "$("+macroName+")", value, -1)
+		if len(value) > 1 {
+			err = NodeErr(*node, "can't expand macro with multiple arguments inside a string: %s", macroName)
+			return ""
+		}
+		// Macros have at least one argument.
+		return value[0]
+	})
+	if err != nil {
+		return "", err
+	}
+	// References are expanded in one pass, so the result can contain a
+	// reference only if it was constructed from another one.
+	if macroRe.MatchString(res) {
+		return "", NodeErr(*node, "nested macro references are not supported: %s", arg)
 	}
 
-	return arg, nil
+	return res, nil
 }
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path/filepath"
 	"strings"
 	"unicode"
 
@@ -60,6 +61,17 @@ type Node struct {
 	// Line is the line number where the directive is located in the source file. For
 	// blocks this is the line where "block header" (name + args) resides.
 	Line int
+
+	// Path contains headers (name + args) of blocks the node is nested in,
+	// starting from the top-level one. Nil for top-level nodes. Set by Read
+	// after snippets and imports are expanded.
+	Path []string
+}
+
+// Header returns the node name and arguments separated by spaces, as they are
+// written in the configuration file.
+func (n Node) Header() string {
+	return strings.Join(append([]string{n.Name}, n.Args...), " ")
 }
 
 type parseContext struct {
@@ -69,6 +81,9 @@ type parseContext struct {
 	macros   map[string][]string
 
 	fileLocation string
+	// Absolute paths of files being read, starting with the top-level one,
+	// used to detect import cycles.
+	fileChain []string
 }
 
 func validateNodeName(s string) error {
@@ -174,11 +189,67 @@ func (ctx *parseContext) readNode() (Node, error) {
 	return node, nil
 }
 
+// Error is the configuration error related to a certain node. It is returned
+// by NodeErr, BlockErr and WrapBlockErr.
+type Error struct {
+	File string
+	Line int
+	// Path of the enclosing blocks, see Node.Path.
+	Path []string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	msg := e.Err.Error()
+	if len(e.Path) != 0 {
+		msg = strings.Join(e.Path, " > ") + ": " + msg
+	}
+	if e.File == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NodeErr returns the error for the node prefixed with the node location
+// and the path of enclosing blocks:
+//
+//	maddy.conf:12: smtp tcp://0.0.0.0:25 > destination example.org: message
 func NodeErr(node Node, f string, args ...interface{}) error {
-	if node.File == "" {
-		return fmt.Errorf(f, args...)
+	return &Error{
+		File: node.File,
+		Line: node.Line,
+		Path: node.Path,
+		Err:  fmt.Errorf(f, args...),
+	}
+}
+
+// BlockErr is similar to NodeErr but also includes the block header into the
+// path. It is intended for errors related to the block contents as a whole
+// (e.g. a missing directive).
+func BlockErr(block Node, f string, args ...interface{}) error {
+	block.Path = append(block.Path[:len(block.Path):len(block.Path)], block.Header())
+	return NodeErr(block, f, args...)
+}
+
+// WrapBlockErr adds the block location to the error returned while
+// initializing the module defined by the block, the same way as BlockErr
+// does. Errors that already point to a certain node (e.g. an invalid
+// directive inside the block) are returned unchanged.
+func WrapBlockErr(block Node, err error) error {
+	var nodeErr *Error
+	if err == nil || errors.As(err, &nodeErr) {
+		return err
+	}
+	return &Error{
+		File: block.File,
+		Line: block.Line,
+		Path: append(block.Path[:len(block.Path):len(block.Path)], block.Header()),
+		Err:  err,
 	}
-	return fmt.Errorf("%s:%d: %s", node.File, node.Line, fmt.Sprintf(f, args...))
 }
 
 func (ctx *parseContext) isSnippet(name string) (bool, string) {
@@ -347,7 +418,7 @@ func (ctx *parseContext) readNodes() ([]Node, error) {
 	return res, nil
 }
 
-func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
+func readTree(r io.Reader, location string, expansionDepth int, parent *parseContext) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
 	ctx := parseContext{
 		Dispenser:    lexer.NewDispenser(location, r),
 		snippets:     make(map[string][]Node),
@@ -355,6 +426,15 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 		nesting:      -1,
 		fileLocation: location,
 	}
+	if parent != nil {
+		for k, v := range parent.macros {
+			ctx.macros[k] = v
+		}
+		ctx.fileChain = parent.fileChain
+	}
+	if absLocation, err := filepath.Abs(location); err == nil {
+		ctx.fileChain = append(ctx.fileChain[:len(ctx.fileChain):len(ctx.fileChain)], absLocation)
+	}
 
 	root := Node{}
 	root.File = location
@@ -384,7 +464,22 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 }
 
 func Read(r io.Reader, location string) (nodes []Node, err error) {
-	nodes, _, _, err = readTree(r, location, 0)
+	nodes, _, _, err = readTree(r, location, 0, nil)
 	nodes = expandEnvironment(nodes)
+	setPaths(nodes, nil)
 	return
 }
+
+// setPaths sets the Path field for all children of nodes recursively.
+func setPaths(nodes []Node, path []string) {
+	for i := range nodes {
+		nodes[i].Path = path
+		if len(nodes[i].Children) == 0 {
+			continue
+		}
+		// Use full slice expression so children of siblings do not share
+		// the underlying array.
+		childPath := append(path[:len(path):len(path)], nodes[i].Header())
+		setPaths(nodes[i].Children, childPath)
+	}
+}
@@ -19,7 +19,11 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package parser
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -104,6 +108,7 @@ var cases = []struct {
 						Children: nil,
 						File:     "test",
 						Line:     2,
+						Path:     []string{"a a1 a2"},
 					},
 					{
 						Name:     "a_child2",
@@ -111,6 +116,7 @@ var cases = []struct {
 						Children: nil,
 						File:     "test",
 						Line:     3,
+						Path:     []string{"a a1 a2"},
 					},
 				},
 				File: "test",
@@ -215,6 +221,7 @@ var cases = []struct {
 						Children: nil,
 						File:     "test",
 						Line:     2,
+						Path:     []string{"a a1 a2"},
 					},
 					{
 						Name:     "a_child2",
@@ -222,6 +229,7 @@ var cases = []struct {
 						Children: nil,
 						File:     "test",
 						Line:     3,
+						Path:     []string{"a a1 a2"},
 					},
 				},
 				File: "test",
@@ -251,6 +259,7 @@ var cases = []struct {
 						Children: nil,
 						File:     "test",
 						Line:     1,
+						Path:     []string{"a a1 a2"},
 					},
 				},
 				File: "test",
@@ -328,6 +337,20 @@ var cases = []struct {
 		},
 		false,
 	},
+	{
+		"multiple missing environment variables",
+		`a {env:TESTING_VARIABLE3}/{env:TESTING_VARIABLE4}`,
+		[]Node{
+			{
+				Name:     "a",
+				Args:     []string{"/"},
+				Children: nil,
+				File:     "test",
+				Line:     1,
+			},
+		},
+		false,
+	},
 	{
 		"incomplete environment variable syntax",
 		`a {env:TESTING_VARIABLE`,
@@ -374,12 +397,14 @@ var cases = []struct {
 						Args: []string{},
 						File: "test",
 						Line: 3,
+						Path: []string{"foo"},
 					},
 					{
 						Name: "a",
 						Args: []string{},
 						File: "test",
 						Line: 1,
+						Path: []string{"foo"},
 					},
 				},
 				File: "test",
@@ -476,16 +501,14 @@ var cases = []struct {
 	{
 		"macro expansion, undefined",
 		`dir $(foo)`,
-		[]Node{
-			{
-				Name:     "dir",
-				Args:     []string{},
-				Children: nil,
-				File:     "test",
-				Line:     1,
-			},
-		},
-		false,
+		nil,
+		true,
+	},
+	{
+		"macro expansion, undefined inside argument",
+		`dir aaa/$(foo)`,
+		nil,
+		true,
 	},
 	{
 		"macro expansion, empty",
@@ -558,10 +581,34 @@ var cases = []struct {
 			}
 			$(foo) = a
 			import bar`,
+		nil,
+		true,
+	},
+	{
+		"macro expansion, nested reference",
+		`$(foo) = bar
+			$(bar) = baz
+			dir $($(foo))`,
+		nil,
+		true,
+	},
+	{
+		"macro expansion, nested reference inside argument",
+		`$(foo) = bar
+			$(bar) = baz
+			dir aaa/$($(foo))`,
+		nil,
+		true,
+	},
+	{
+		"macro expansion, multiple references inside argument",
+		`$(foo) = a
+			$(bar) = b
+			dir $(foo)/$(bar)`,
 		[]Node{
 			{
 				Name:     "dir",
-				Args:     []string{},
+				Args:     []string{"a/b"},
 				Children: nil,
 				File:     "test",
 				Line:     3,
@@ -569,6 +616,21 @@ var cases = []struct {
 		},
 		false,
 	},
+	{
+		"macro expansion, environment variable",
+		`$(foo) = {env:TESTING_VARIABLE}
+			dir $(foo)`,
+		[]Node{
+			{
+				Name:     "dir",
+				Args:     []string{"ABCDEF"},
+				Children: nil,
+				File:     "test",
+				Line:     2,
+			},
+		},
+		false,
+	},
 }
 
 func printTree(t *testing.T, root Node, indent int) {
@@ -621,3 +683,199 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestRead_MacroError(t *testing.T) {
+	_, err := Read(strings.NewReader("a\n\tdir $(foo)"), "test")
+	if err == nil {
+		t.Fatal("expected failure")
+	}
+	if err.Error() != "test:2: undefined macro: foo" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestRead_MacroImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "macros.conf"), []byte("$(bar) = $(foo)/b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dirs.conf"), []byte("dir $(bar)"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := "$(foo) = a\nimport macros\nimport dirs"
+	tree, err := Read(strings.NewReader(cfg), filepath.Join(dir, "maddy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 1 || !reflect.DeepEqual(tree[0].Args, []string{"a/b"}) {
+		t.Fatalf("wrong result: %+v", tree)
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRead_Include(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"conf.d/b.conf":    "destination b.example.org",
+		"conf.d/a.conf":    "destination a.example.org\n(snip) {\n\tsnip\n}",
+		"conf.d/c.notconf": "destination c.example.org",
+	})
+
+	cfg := `dispatcher {
+		include conf.d/*.conf
+		include conf.d/*.missing
+		import snip
+	}`
+	tree, err := Read(strings.NewReader(cfg), filepath.Join(dir, "maddy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 1 {
+		t.Fatalf("wrong result: %+v", tree)
+	}
+	var got []string
+	for _, child := range tree[0].Children {
+		got = append(got, child.Name+" "+strings.Join(child.Args, " ")+" "+filepath.Base(child.File))
+	}
+	want := []string{
+		"destination a.example.org a.conf",
+		"destination b.example.org b.conf",
+		"snip  a.conf",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong result: %q", got)
+	}
+
+	_, err = Read(strings.NewReader("include required conf.d/*.missing"), filepath.Join(dir, "maddy.conf"))
+	if err == nil {
+		t.Fatal("expected failure for required include")
+	}
+}
+
+func TestRead_IncludeCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"maddy.conf":    "include conf.d/*.conf",
+		"conf.d/a.conf": "a {\n\tinclude ../maddy.conf\n}",
+	})
+
+	f, err := os.Open(filepath.Join(dir, "maddy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = Read(f, filepath.Join(dir, "maddy.conf"))
+	if err == nil {
+		t.Fatal("expected failure")
+	}
+	if !strings.HasPrefix(err.Error(), filepath.Join(dir, "conf.d/a.conf")+":2: import cycle") {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestRead_IncludeErrorLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"conf.d/a.conf": "a\nb $(undefined)",
+	})
+
+	_, err = Read(strings.NewReader("\n\ninclude conf.d/*.conf"), filepath.Join(dir, "maddy.conf"))
+	if err == nil {
+		t.Fatal("expected failure")
+	}
+	if err.Error() != filepath.Join(dir, "conf.d/a.conf")+":2: undefined macro: undefined" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestNodeErr_Path(t *testing.T) {
+	tree, err := Read(strings.NewReader(`smtp tcp://0.0.0.0:25 {
+	source example.org {
+		destination example.org example.com {
+			reject
+		}
+	}
+}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := tree[0].Children[0].Children[0]
+	err = NodeErr(dest.Children[0], "message")
+	if err.Error() != "test:4: smtp tcp://0.0.0.0:25 > source example.org > destination example.org example.com: message" {
+		t.Error("wrong NodeErr message:", err)
+	}
+	err = BlockErr(dest, "message")
+	if err.Error() != "test:3: smtp tcp://0.0.0.0:25 > source example.org > destination example.org example.com: message" {
+		t.Error("wrong BlockErr message:", err)
+	}
+	if len(dest.Path) != 2 {
+		t.Error("BlockErr modified the node path:", dest.Path)
+	}
+
+	err = NodeErr(tree[0], "message")
+	if err.Error() != "test:1: message" {
+		t.Error("wrong NodeErr message for top-level node:", err)
+	}
+}
+
+func TestWrapBlockErr(t *testing.T) {
+	tree, err := Read(strings.NewReader(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		deliver_to target.smtp {
+			hostname
+		}
+	}
+}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverTo := tree[0].Children[0].Children[0]
+	err = WrapBlockErr(deliverTo, errors.New("message"))
+	if err.Error() != "test:3: smtp tcp://0.0.0.0:25 > destination example.org > deliver_to target.smtp: message" {
+		t.Error("wrong WrapBlockErr message:", err)
+	}
+
+	nodeErr := NodeErr(deliverTo.Children[0], "message")
+	if err := WrapBlockErr(deliverTo, fmt.Errorf("wrapped: %w", nodeErr)); !errors.Is(err, nodeErr) || err.Error() != "wrapped: "+nodeErr.Error() {
+		t.Error("WrapBlockErr changed the error with location:", err)
+	}
+
+	if WrapBlockErr(deliverTo, nil) != nil {
+		t.Error("WrapBlockErr(nil) is not nil")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Write writes the configuration tree to w in the format accepted by Read.
+//
+// Nodes are expected to be the Read output: macros, snippets, imports and
+// environment variables are not handled specially. Top-level blocks are
+// separated by empty lines.
+func Write(w io.Writer, nodes []Node) error {
+	bw := bufio.NewWriter(w)
+	writeNodes(bw, nodes, 0)
+	return bw.Flush()
+}
+
+func writeNodes(w *bufio.Writer, nodes []Node, level int) {
+	indent := strings.Repeat("    ", level)
+	for i, node := range nodes {
+		if level == 0 && i != 0 && (node.Children != nil || nodes[i-1].Children != nil) {
+			w.WriteString("\n")
+		}
+
+		w.WriteString(indent)
+		w.WriteString(quoteArg(node.Name))
+		for _, arg := range node.Args {
+			w.WriteString(" ")
+			w.WriteString(quoteArg(arg))
+		}
+
+		// nil Children indicates "no block", keep empty blocks as is.
+		switch {
+		case node.Children == nil:
+			w.WriteString("\n")
+		case len(node.Children) == 0:
+			w.WriteString(" { }\n")
+		default:
+			w.WriteString(" {\n")
+			writeNodes(w, node.Children, level+1)
+			w.WriteString(indent)
+			w.WriteString("}\n")
+		}
+	}
+}
+
+// quoteArg wraps the argument into quotes if it would not be read back as a
+// single token otherwise.
+func quoteArg(arg string) string {
+	needQuotes := arg == "" || strings.IndexFunc(arg, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '#' || r == '{' || r == '}'
+	}) != -1
+	if !needQuotes {
+		return arg
+	}
+	return `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+}
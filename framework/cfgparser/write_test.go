@@ -0,0 +1,107 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stripLocation removes the information that is not preserved by Write.
+func stripLocation(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	res := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		node.File, node.Line, node.Path = "", 0, nil
+		node.Children = stripLocation(node.Children)
+		res = append(res, node)
+	}
+	return res
+}
+
+func TestWrite(t *testing.T) {
+	os.Setenv("TESTING_VARIABLE", "ABCDEF")
+	os.Setenv("TESTING_VARIABLE2", "ABC2 DEF2")
+
+	for _, case_ := range cases {
+		if case_.fail {
+			continue
+		}
+		case_ := case_
+		t.Run(case_.name, func(t *testing.T) {
+			tree, err := Read(strings.NewReader(case_.cfg), "test")
+			if err != nil {
+				t.Fatal("unexpected failure:", err)
+			}
+
+			var buf bytes.Buffer
+			if err := Write(&buf, tree); err != nil {
+				t.Fatal(err)
+			}
+			written, err := Read(&buf, "test")
+			if err != nil {
+				t.Fatalf("can't read the written configuration: %v\n%s", err, buf.String())
+			}
+
+			if !reflect.DeepEqual(stripLocation(tree), stripLocation(written)) {
+				t.Errorf("written configuration mismatch\nexpected: %+v\nactual:   %+v", tree, written)
+			}
+		})
+	}
+}
+
+func TestWrite_Quoting(t *testing.T) {
+	tree := []Node{
+		{
+			Name: "a",
+			Args: []string{"", "b c", `"quoted"`, "#", "a{2}", `$1@$3`},
+			Children: []Node{
+				{Name: "d", Args: []string{}, Children: []Node{}},
+			},
+		},
+		{Name: "e", Args: []string{}},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, tree); err != nil {
+		t.Fatal(err)
+	}
+	expected := `a "" "b c" "\"quoted\"" "#" "a{2}" $1@$3 {
+    d { }
+}
+
+e
+`
+	if buf.String() != expected {
+		t.Errorf("wrong output\nexpected:\n%s\nactual:\n%s", expected, buf.String())
+	}
+
+	written, err := Read(&buf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tree, stripLocation(written)) {
+		t.Errorf("written configuration mismatch\nexpected: %+v\nactual:   %+v", tree, written)
+	}
+}
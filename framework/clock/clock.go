@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package clock provides an abstraction over the time source used by
+// timer-driven parts of the server (queue scheduling, rate limiters).
+//
+// Production code should use Real. Tests can substitute a Fake to advance
+// the time explicitly instead of sleeping.
+package clock
+
+import "time"
+
+// Clock is the time source.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is the equivalent of time.Timer obtained from Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+// Real is the Clock implementation that uses functions from the time package.
+var Real Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (rt realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTimer) Stop() bool {
+	return rt.t.Stop()
+}
+
+func (rt realTimer) Reset(d time.Duration) bool {
+	return rt.t.Reset(d)
+}
@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(start)
+
+	t1 := clk.NewTimer(10 * time.Second)
+	t2 := clk.NewTimer(5 * time.Second)
+	after := clk.After(time.Minute)
+
+	if n := clk.Timers(); n != 3 {
+		t.Fatalf("expected 3 timers, got %d", n)
+	}
+
+	clk.Advance(4 * time.Second)
+	select {
+	case <-t1.C():
+		t.Fatal("t1 fired too early")
+	case <-t2.C():
+		t.Fatal("t2 fired too early")
+	default:
+	}
+
+	clk.Advance(6 * time.Second)
+	if fired := <-t2.C(); !fired.Equal(start.Add(5 * time.Second)) {
+		t.Error("wrong t2 fire time:", fired)
+	}
+	if fired := <-t1.C(); !fired.Equal(start.Add(10 * time.Second)) {
+		t.Error("wrong t1 fire time:", fired)
+	}
+	if !clk.Now().Equal(start.Add(10 * time.Second)) {
+		t.Error("wrong time after Advance:", clk.Now())
+	}
+
+	if t1.Reset(time.Second) {
+		t.Error("Reset returned true for a fired timer")
+	}
+	if !t1.Stop() {
+		t.Error("Stop returned false for an active timer")
+	}
+	clk.Advance(time.Hour)
+	select {
+	case <-t1.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+	<-after
+
+	if n := clk.Timers(); n != 0 {
+		t.Fatalf("expected no timers, got %d", n)
+	}
+}
+
+func TestFake_BlockUntil(t *testing.T) {
+	clk := NewFake(time.Now())
+
+	done := make(chan struct{})
+	go func() {
+		<-clk.After(time.Second)
+		close(done)
+	}()
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	<-done
+}
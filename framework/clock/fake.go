@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is the Clock implementation for use in tests. Time does not pass
+// unless Advance or Set is called.
+//
+// Timers fire (in deadline order) during the Advance call that moves the
+// time past their deadline. Like with time.Timer, the channel has a buffer
+// of one value, so a timer fired while nobody reads the channel does not
+// block the Advance call.
+type Fake struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	clk      *Fake
+	deadline time.Time
+	active   bool
+}
+
+func NewFake(start time.Time) *Fake {
+	f := &Fake{now: start}
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	t := &fakeTimer{
+		c:   make(chan time.Time, 1),
+		clk: f,
+	}
+	f.arm(t, d)
+	return t
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// arm should be called with f.lock held.
+func (f *Fake) arm(t *fakeTimer, d time.Duration) {
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		t.fire(f.now)
+		return
+	}
+	t.active = true
+	f.timers = append(f.timers, t)
+	f.cond.Broadcast()
+}
+
+// disarm should be called with f.lock held.
+func (f *Fake) disarm(t *fakeTimer) bool {
+	if !t.active {
+		return false
+	}
+	t.active = false
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			break
+		}
+	}
+	f.cond.Broadcast()
+	return true
+}
+
+// Advance moves the clock forward by d, firing all timers with deadlines
+// within the interval.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to the specified time, firing all timers with
+// deadlines before or at it. Attempts to move the clock backwards are
+// ignored.
+func (f *Fake) Set(t time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if t.Before(f.now) {
+		return
+	}
+
+	for {
+		var next *fakeTimer
+		for _, timer := range f.timers {
+			if timer.deadline.After(t) {
+				continue
+			}
+			if next == nil || timer.deadline.Before(next.deadline) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		f.now = next.deadline
+		f.disarm(next)
+		next.fire(f.now)
+	}
+	f.now = t
+}
+
+// Timers returns the amount of timers that are waiting to fire.
+func (f *Fake) Timers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil blocks until there are at least n timers waiting to fire.
+//
+// It is useful to make sure the code under test reached the point where it
+// waits for the time to pass before calling Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clk.lock.Lock()
+	defer t.clk.lock.Unlock()
+	return t.clk.disarm(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clk.lock.Lock()
+	defer t.clk.lock.Unlock()
+	wasActive := t.clk.disarm(t)
+	t.clk.arm(t, d)
+	return wasActive
+}
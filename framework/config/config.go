@@ -19,8 +19,6 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
-	"fmt"
-
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 )
 
@@ -28,9 +26,53 @@ type (
 	Node = parser.Node
 )
 
+// NodeErr returns the error for the node prefixed with the node location
+// and the path of enclosing blocks. See cfgparser.NodeErr.
 func NodeErr(node Node, f string, args ...interface{}) error {
-	if node.File == "" {
-		return fmt.Errorf(f, args...)
+	return parser.NodeErr(node, f, args...)
+}
+
+// BlockErr returns the error for the block contents as a whole. See
+// cfgparser.BlockErr.
+func BlockErr(block Node, f string, args ...interface{}) error {
+	return parser.BlockErr(block, f, args...)
+}
+
+// WrapBlockErr adds the block location to the module initialization error.
+// See cfgparser.WrapBlockErr.
+func WrapBlockErr(block Node, err error) error {
+	return parser.WrapBlockErr(block, err)
+}
+
+// NodesEqual reports whether a and b contain the same directives with the
+// same arguments, ignoring their location.
+func NodesEqual(a, b []Node) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	return fmt.Errorf("%s:%d: %s", node.File, node.Line, fmt.Sprintf(f, args...))
+	for i := range a {
+		if a[i].Name != b[i].Name || len(a[i].Args) != len(b[i].Args) {
+			return false
+		}
+		for j := range a[i].Args {
+			if a[i].Args[j] != b[i].Args[j] {
+				return false
+			}
+		}
+		if !NodesEqual(a[i].Children, b[i].Children) {
+			return false
+		}
+	}
+	return true
 }
+
+// CheckOnly is set if the configuration is loaded only to verify it (maddy
+// -check).
+//
+// Modules should process and validate their configuration as usual,
+// including reading referenced files and resolving references to other
+// modules, but skip any side effects: listening on sockets, connecting to
+// remote servers, opening databases, creating or changing files and starting
+// background goroutines. Modules are not used after Init in this mode and
+// Close is not called.
+var CheckOnly bool
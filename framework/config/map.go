@@ -20,6 +20,8 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"reflect"
 	"strconv"
 	"strings"
@@ -38,6 +40,13 @@ type matcher struct {
 	customCallback func(*Map, Node) error
 }
 
+// argsErr returns the error for the directive with invalid arguments. usage
+// is the expected arguments signature, it is included into the message
+// along with the directive name.
+func argsErr(node Node, usage string, f string, args ...interface{}) error {
+	return NodeErr(node, "%s (usage: %s %s)", fmt.Sprintf(f, args...), node.Name, usage)
+}
+
 func (m *matcher) assign(val interface{}) {
 	valRefl := reflect.ValueOf(val)
 	// Convert untyped nil into typed nil. Otherwise it will panic.
@@ -81,14 +90,15 @@ func (m *Map) AllowUnknown() {
 //
 // See Map.Custom for description of inheritGlobal and required.
 func (m *Map) EnumList(name string, inheritGlobal, required bool, allowed []string, defaultVal []string, store *[]string) {
+	usage := "<" + strings.Join(allowed, "|") + ">..."
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare a block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 		if len(node.Args) == 0 {
-			return nil, NodeErr(node, "expected at least one argument")
+			return nil, argsErr(node, usage, "expected at least 1 argument")
 		}
 
 		for _, arg := range node.Args {
@@ -99,7 +109,7 @@ func (m *Map) EnumList(name string, inheritGlobal, required bool, allowed []stri
 				}
 			}
 			if !isAllowed {
-				return nil, NodeErr(node, "invalid argument, valid values are: %v", allowed)
+				return nil, argsErr(node, usage, "invalid argument: %s", arg)
 			}
 		}
 
@@ -114,14 +124,15 @@ func (m *Map) EnumList(name string, inheritGlobal, required bool, allowed []stri
 //
 // See Map.Custom for description of inheritGlobal and required.
 func (m *Map) Enum(name string, inheritGlobal, required bool, allowed []string, defaultVal string, store *string) {
+	usage := "<" + strings.Join(allowed, "|") + ">"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare a block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected exactly one argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 
 		for _, str := range allowed {
@@ -130,7 +141,7 @@ func (m *Map) Enum(name string, inheritGlobal, required bool, allowed []string,
 			}
 		}
 
-		return nil, NodeErr(node, "invalid argument, valid values are: %v", allowed)
+		return nil, argsErr(node, usage, "invalid argument: %s", node.Args[0])
 	}, store)
 }
 
@@ -142,34 +153,49 @@ func (m *Map) Enum(name string, inheritGlobal, required bool, allowed []string,
 //
 // Note that for convenience, if directive does have multiple arguments, they will be joined
 // without separators. E.g. 'name 1h 2m' will become 'name 1h2m' and so '1h2m' will be passed
-// to time.ParseDuration.
+// to ParseDuration.
 //
 // See Map.Custom for description of arguments.
 func (m *Map) Duration(name string, inheritGlobal, required bool, defaultVal time.Duration, store *time.Duration) {
+	const usage = "<duration>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 		if len(node.Args) == 0 {
-			return nil, NodeErr(node, "at least one argument is required")
+			return nil, argsErr(node, usage, "expected at least 1 argument")
 		}
 
 		durationStr := strings.Join(node.Args, "")
-		dur, err := time.ParseDuration(durationStr)
+		dur, err := ParseDuration(durationStr)
 		if err != nil {
-			return nil, NodeErr(node, "%v", err)
+			return nil, argsErr(node, usage, "%v", err)
 		}
 
 		if dur < 0 {
-			return nil, NodeErr(node, "duration must not be negative")
+			return nil, argsErr(node, usage, "duration must not be negative")
 		}
 
 		return dur, nil
 	}, store)
 }
 
+// ParseDuration is similar to time.ParseDuration but additionally accepts
+// the number of days with the 'd' suffix (e.g. '30d'), which is convenient
+// for long periods.
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
 func ParseDataSize(s string) (int, error) {
 	if len(s) == 0 {
 		return 0, errors.New("missing a number")
@@ -232,20 +258,21 @@ func ParseDataSize(s string) (int, error) {
 //
 // See Map.Custom for description of arguments.
 func (m *Map) DataSize(name string, inheritGlobal, required bool, defaultVal int, store *int) {
+	const usage = "<size>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 		if len(node.Args) == 0 {
-			return nil, NodeErr(node, "at least one argument is required")
+			return nil, argsErr(node, usage, "expected at least 1 argument")
 		}
 
 		durationStr := strings.Join(node.Args, " ")
 		dur, err := ParseDataSize(durationStr)
 		if err != nil {
-			return nil, NodeErr(node, "%v", err)
+			return nil, argsErr(node, usage, "%v", err)
 		}
 
 		return dur, nil
@@ -260,18 +287,19 @@ func (m *Map) DataSize(name string, inheritGlobal, required bool, defaultVal int
 // the global configuration (if inheritGlobal is true) then Process will store
 // true in target variable.
 func (m *Map) Bool(name string, inheritGlobal, defaultVal bool, store *bool) {
+	const usage = "[yes|no]"
 	m.Custom(name, inheritGlobal, false, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		if len(node.Args) == 0 {
 			return true, nil
 		}
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected exactly 1 argument")
+			return nil, argsErr(node, usage, "expected at most 1 argument, got %d", len(node.Args))
 		}
 
 		switch strings.ToLower(node.Args[0]) {
@@ -280,7 +308,7 @@ func (m *Map) Bool(name string, inheritGlobal, defaultVal bool, store *bool) {
 		case "0", "false", "off", "no":
 			return false, nil
 		}
-		return nil, NodeErr(node, "bool argument should be 'yes' or 'no'")
+		return nil, argsErr(node, usage, "invalid argument: %s", node.Args[0])
 	}, store)
 }
 
@@ -293,20 +321,77 @@ func (m *Map) Bool(name string, inheritGlobal, defaultVal bool, store *bool) {
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) StringList(name string, inheritGlobal, required bool, defaultVal []string, store *[]string) {
+	const usage = "<value>..."
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) == 0 {
-			return nil, NodeErr(node, "expected at least one argument")
+			return nil, argsErr(node, usage, "expected at least 1 argument")
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		return node.Args, nil
 	}, store)
 }
 
+// ParseCIDRs parses the list of networks in CIDR notation. Plain IP
+// addresses are accepted too and are treated as single-address networks.
+func ParseCIDRs(list []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network: %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", s)
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
+
+// CIDRList maps configuration directive with the specified name to variable
+// referenced by 'store' pointer.
+//
+// Configuration directive must be in form 'name network network ...', where
+// networks are in the format accepted by ParseCIDRs. defaultVal is parsed
+// the same way.
+//
+// See Custom function for details about inheritGlobal, required and
+// defaultVal.
+func (m *Map) CIDRList(name string, inheritGlobal, required bool, defaultVal []string, store *[]net.IPNet) {
+	const usage = "<network>..."
+	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
+		return ParseCIDRs(defaultVal)
+	}, func(m *Map, node Node) (interface{}, error) {
+		if len(node.Args) == 0 {
+			return nil, argsErr(node, usage, "expected at least 1 argument")
+		}
+		if len(node.Children) != 0 {
+			return nil, argsErr(node, usage, "can't declare a block here")
+		}
+
+		nets, err := ParseCIDRs(node.Args)
+		if err != nil {
+			return nil, argsErr(node, usage, "%v", err)
+		}
+		return nets, nil
+	}, store)
+}
+
 // String maps configuration directive with the specified name to variable
 // referenced by 'store' pointer.
 //
@@ -315,14 +400,15 @@ func (m *Map) StringList(name string, inheritGlobal, required bool, defaultVal [
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) String(name string, inheritGlobal, required bool, defaultVal string, store *string) {
+	const usage = "<value>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		return node.Args[0], nil
@@ -337,19 +423,20 @@ func (m *Map) String(name string, inheritGlobal, required bool, defaultVal strin
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) Int(name string, inheritGlobal, required bool, defaultVal int, store *int) {
+	const usage = "<integer>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		i, err := strconv.Atoi(node.Args[0])
 		if err != nil {
-			return nil, NodeErr(node, "invalid integer: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid integer: %s", node.Args[0])
 		}
 		return i, nil
 	}, store)
@@ -363,19 +450,20 @@ func (m *Map) Int(name string, inheritGlobal, required bool, defaultVal int, sto
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) UInt(name string, inheritGlobal, required bool, defaultVal uint, store *uint) {
+	const usage = "<integer>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		i, err := strconv.ParseUint(node.Args[0], 10, 32)
 		if err != nil {
-			return nil, NodeErr(node, "invalid integer: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid integer: %s", node.Args[0])
 		}
 		return uint(i), nil
 	}, store)
@@ -389,19 +477,20 @@ func (m *Map) UInt(name string, inheritGlobal, required bool, defaultVal uint, s
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) Int32(name string, inheritGlobal, required bool, defaultVal int32, store *int32) {
+	const usage = "<integer>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		i, err := strconv.ParseInt(node.Args[0], 10, 32)
 		if err != nil {
-			return nil, NodeErr(node, "invalid integer: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid integer: %s", node.Args[0])
 		}
 		return int32(i), nil
 	}, store)
@@ -415,19 +504,20 @@ func (m *Map) Int32(name string, inheritGlobal, required bool, defaultVal int32,
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) UInt32(name string, inheritGlobal, required bool, defaultVal uint32, store *uint32) {
+	const usage = "<integer>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		i, err := strconv.ParseUint(node.Args[0], 10, 32)
 		if err != nil {
-			return nil, NodeErr(node, "invalid integer: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid integer: %s", node.Args[0])
 		}
 		return uint32(i), nil
 	}, store)
@@ -441,19 +531,20 @@ func (m *Map) UInt32(name string, inheritGlobal, required bool, defaultVal uint3
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) Int64(name string, inheritGlobal, required bool, defaultVal int64, store *int64) {
+	const usage = "<integer>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		i, err := strconv.ParseInt(node.Args[0], 10, 64)
 		if err != nil {
-			return nil, NodeErr(node, "invalid integer: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid integer: %s", node.Args[0])
 		}
 		return i, nil
 	}, store)
@@ -467,19 +558,20 @@ func (m *Map) Int64(name string, inheritGlobal, required bool, defaultVal int64,
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) UInt64(name string, inheritGlobal, required bool, defaultVal uint64, store *uint64) {
+	const usage = "<integer>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 		if len(node.Children) != 0 {
-			return nil, NodeErr(node, "can't declare block here")
+			return nil, argsErr(node, usage, "can't declare a block here")
 		}
 
 		i, err := strconv.ParseUint(node.Args[0], 10, 64)
 		if err != nil {
-			return nil, NodeErr(node, "invalid integer: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid integer: %s", node.Args[0])
 		}
 		return i, nil
 	}, store)
@@ -493,16 +585,17 @@ func (m *Map) UInt64(name string, inheritGlobal, required bool, defaultVal uint6
 // See Custom function for details about inheritGlobal, required and
 // defaultVal.
 func (m *Map) Float(name string, inheritGlobal, required bool, defaultVal float64, store *float64) {
+	const usage = "<number>"
 	m.Custom(name, inheritGlobal, required, func() (interface{}, error) {
 		return defaultVal, nil
 	}, func(m *Map, node Node) (interface{}, error) {
 		if len(node.Args) != 1 {
-			return nil, NodeErr(node, "expected 1 argument")
+			return nil, argsErr(node, usage, "expected 1 argument, got %d", len(node.Args))
 		}
 
 		f, err := strconv.ParseFloat(node.Args[0], 64)
 		if err != nil {
-			return nil, NodeErr(node, "invalid float: %s", node.Args[0])
+			return nil, argsErr(node, usage, "invalid number: %s", node.Args[0])
 		}
 		return f, nil
 	}, store)
@@ -580,6 +673,15 @@ func (m *Map) Callback(name string, mapper func(*Map, Node) error) {
 	}
 }
 
+// knownDirectives returns names of all directives that have a matcher.
+func (m *Map) knownDirectives() []string {
+	names := make([]string, 0, len(m.entries))
+	for name := range m.entries {
+		names = append(names, name)
+	}
+	return names
+}
+
 // Process maps variables from global configuration and block passed in NewMap.
 //
 // If Map instance was not created using NewMap - Process panics.
@@ -597,7 +699,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 		matcher, ok := m.entries[subnode.Name]
 		if !ok {
 			if !m.allowUnknown {
-				return nil, NodeErr(subnode, "unexpected directive: %s", subnode.Name)
+				return nil, UnknownDirectiveErr(subnode, m.knownDirectives())
 			}
 			unknown = append(unknown, subnode)
 			continue
@@ -648,7 +750,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 				return nil, err
 			}
 		} else {
-			return nil, NodeErr(block, "missing required directive: %s", matcher.name)
+			return nil, BlockErr(block, "missing required directive: %s", matcher.name)
 		}
 
 		// If we put zero values into map then code that checks globalCfg
@@ -19,7 +19,11 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
+	"net"
+	"strings"
 	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
 )
 
 func TestMapProcess(t *testing.T) {
@@ -308,6 +312,67 @@ func TestMapInt_Invalid(t *testing.T) {
 	}
 }
 
+func TestMapCIDRList(t *testing.T) {
+	cfg := Node{
+		Children: []Node{
+			{
+				Name: "foo",
+				Args: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"},
+			},
+		},
+	}
+
+	m := NewMap(nil, cfg)
+
+	var foo, bar []net.IPNet
+	m.CIDRList("foo", false, true, nil, &foo)
+	m.CIDRList("bar", false, false, []string{"127.0.0.0/8"}, &bar)
+
+	_, err := m.Process()
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+
+	var got []string
+	for _, ipNet := range foo {
+		got = append(got, ipNet.String())
+	}
+	if strings.Join(got, " ") != "10.0.0.0/8 192.0.2.1/32 2001:db8::1/128" {
+		t.Errorf("Incorrect value stored in variable: %v", got)
+	}
+	if len(bar) != 1 || bar[0].String() != "127.0.0.0/8" {
+		t.Errorf("Incorrect default value: %v", bar)
+	}
+	if !foo[1].Contains(net.IPv4(192, 0, 2, 1)) || foo[1].Contains(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("Plain IP address is not converted to a single-address network")
+	}
+}
+
+func TestMapCIDRList_Invalid(t *testing.T) {
+	for _, arg := range []string{"10.0.0.0/33", "example.org", "10.0.0.0/"} {
+		cfg := Node{
+			Children: []Node{
+				{
+					Name: "foo",
+					Args: []string{arg},
+				},
+			},
+		}
+
+		m := NewMap(nil, cfg)
+
+		var foo []net.IPNet
+		m.CIDRList("foo", false, true, nil, &foo)
+
+		_, err := m.Process()
+		if err == nil {
+			t.Errorf("Expected failure for %s", arg)
+		} else if !strings.Contains(err.Error(), "invalid network: "+arg) {
+			t.Errorf("Unexpected error for %s: %v", arg, err)
+		}
+	}
+}
+
 func TestMapFloat(t *testing.T) {
 	cfg := Node{
 		Children: []Node{
@@ -493,3 +558,76 @@ func TestMap_Callback(t *testing.T) {
 		t.Error("Wrong directive returned in unmatched slice:", others[0].Name)
 	}
 }
+
+func TestMapProcess_ErrorMessages(t *testing.T) {
+	test := func(cfg, expectedErr string) {
+		t.Helper()
+
+		nodes, err := parser.Read(strings.NewReader(cfg), "maddy.conf")
+		if err != nil {
+			t.Fatal("unexpected parse error:", err)
+		}
+
+		// Emulate nested block processing as done by modules.
+		block := nodes[0].Children[0]
+
+		var (
+			hostname string
+			port     int
+			mode     string
+			debug    bool
+		)
+		m := NewMap(nil, block)
+		m.String("hostname", false, true, "", &hostname)
+		m.Int("port", false, false, 25, &port)
+		m.Enum("mode", false, false, []string{"strict", "relaxed"}, "strict", &mode)
+		m.Bool("debug", false, false, &debug)
+		_, err = m.Process()
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if err.Error() != expectedErr {
+			t.Errorf("wrong error message\nwant: %s\ngot:  %s", expectedErr, err.Error())
+		}
+	}
+
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		hostnme mx.example.org
+	}
+}`, `maddy.conf:3: smtp tcp://0.0.0.0:25 > destination example.org: unknown directive: hostnme, did you mean hostname?`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		hostname mx.example.org
+		timeout 5s
+	}
+}`, `maddy.conf:4: smtp tcp://0.0.0.0:25 > destination example.org: unknown directive: timeout`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		hostname mx.example.org mx2.example.org
+	}
+}`, `maddy.conf:3: smtp tcp://0.0.0.0:25 > destination example.org: expected 1 argument, got 2 (usage: hostname <value>)`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		hostname mx.example.org
+		port abc
+	}
+}`, `maddy.conf:4: smtp tcp://0.0.0.0:25 > destination example.org: invalid integer: abc (usage: port <integer>)`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		hostname mx.example.org
+		mode lax
+	}
+}`, `maddy.conf:4: smtp tcp://0.0.0.0:25 > destination example.org: invalid argument: lax (usage: mode <strict|relaxed>)`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		hostname mx.example.org
+		debug yes no
+	}
+}`, `maddy.conf:4: smtp tcp://0.0.0.0:25 > destination example.org: expected at most 1 argument, got 2 (usage: debug [yes|no])`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		port 25
+	}
+}`, `maddy.conf:2: smtp tcp://0.0.0.0:25 > destination example.org: missing required directive: hostname`)
+}
@@ -27,10 +27,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package modconfig
 
 import (
-	"fmt"
 	"io"
 	"reflect"
 	"strings"
+	"sync"
 
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
@@ -40,7 +40,7 @@ import (
 )
 
 // createInlineModule is a helper function for config matchers that can create inline modules.
-func createInlineModule(preferredNamespace string, modName string, args []string) (module.Module, error) {
+func createInlineModule(preferredNamespace string, modName string, args []string, inlineCfg config.Node) (module.Module, error) {
 	var newMod module.FuncNewModule
 	var originalModName = modName
 
@@ -53,17 +53,37 @@ func createInlineModule(preferredNamespace string, modName string, args []string
 
 	// Then try global namespace for compatibility and complex modules.
 	if newMod == nil {
-		newMod = module.Get(originalModName)
+		modName = originalModName
+		newMod = module.Get(modName)
 	}
 
 	// Bail if both failed.
 	if newMod == nil {
-		return nil, fmt.Errorf("unknown module: %s (namespace: %s)", originalModName, preferredNamespace)
+		return nil, unknownModuleErr(preferredNamespace, originalModName, inlineCfg)
 	}
 
 	return newMod(modName, "", nil, args)
 }
 
+// unknownModuleErr returns the error for the unknown inline module name,
+// suggesting a registered module with a similar name, if any.
+func unknownModuleErr(preferredNamespace, modName string, inlineCfg config.Node) error {
+	registered := module.RegisteredModules()
+	known := make([]string, 0, len(registered))
+	for _, name := range registered {
+		if preferredNamespace != "" && strings.HasPrefix(name, preferredNamespace+".") {
+			known = append(known, strings.TrimPrefix(name, preferredNamespace+"."))
+			continue
+		}
+		known = append(known, name)
+	}
+
+	if suggestion := config.Suggest(modName, known); suggestion != "" {
+		return parser.NodeErr(inlineCfg, "unknown module: %s (namespace: %s), did you mean %s?", modName, preferredNamespace, suggestion)
+	}
+	return parser.NodeErr(inlineCfg, "unknown module: %s (namespace: %s)", modName, preferredNamespace)
+}
+
 // initInlineModule constructs "faked" config tree and passes it to module
 // Init function to make it look like it is defined at top-level.
 //
@@ -71,21 +91,99 @@ func createInlineModule(preferredNamespace string, modName string, args []string
 func initInlineModule(modObj module.Module, globals map[string]interface{}, block config.Node) error {
 	err := modObj.Init(config.NewMap(globals, block))
 	if err != nil {
-		return err
+		return config.WrapBlockErr(block, err)
 	}
 
-	if closer, ok := modObj.(io.Closer); ok {
-		hooks.AddHook(hooks.EventShutdown, func() {
-			log.Debugf("close %s (%s)", modObj.Name(), modObj.InstanceName())
-			if err := closer.Close(); err != nil {
-				log.Printf("module %s (%s) close failed: %v", modObj.Name(), modObj.InstanceName(), err)
-			}
-		})
+	if _, ok := modObj.(io.Closer); ok {
+		scopeLck.Lock()
+		defer scopeLck.Unlock()
+		if curScope != nil {
+			curScope.mods = append(curScope.mods, modObj)
+		} else {
+			closeOnShutdown(modObj)
+		}
 	}
 
 	return nil
 }
 
+func closeOnShutdown(modObj module.Module) {
+	hooks.AddHook(hooks.EventShutdown, func() {
+		closeInline(modObj)
+	})
+}
+
+func closeInline(modObj module.Module) {
+	log.Debugf("close %s (%s)", modObj.Name(), modObj.InstanceName())
+	if err := modObj.(io.Closer).Close(); err != nil {
+		log.Printf("module %s (%s) close failed: %v", modObj.Name(), modObj.InstanceName(), err)
+	}
+}
+
+var (
+	scopeLck sync.Mutex
+	curScope *Scope
+)
+
+// Scope tracks inline module instances that need to be closed so they can be
+// released if the configuration that created them is discarded (e.g. on a
+// failed configuration reload).
+//
+// Inline modules created outside of any scope are closed on shutdown.
+type Scope struct {
+	parent *Scope
+	mods   []module.Module
+}
+
+// BeginScope starts tracking inline module instances created by the current
+// goroutine. Either Keep or Discard must be called to end the scope, scopes
+// can be nested.
+//
+// Configuration is processed by a single goroutine, BeginScope should not be
+// used concurrently.
+func BeginScope() *Scope {
+	scopeLck.Lock()
+	defer scopeLck.Unlock()
+
+	curScope = &Scope{parent: curScope}
+	return curScope
+}
+
+func (s *Scope) end() {
+	if curScope != s {
+		panic("modconfig: scopes ended out of order")
+	}
+	curScope = s.parent
+}
+
+// Keep ends the scope, created instances are closed on shutdown or by the
+// parent scope if it is discarded.
+func (s *Scope) Keep() {
+	scopeLck.Lock()
+	defer scopeLck.Unlock()
+	s.end()
+
+	if s.parent != nil {
+		s.parent.mods = append(s.parent.mods, s.mods...)
+		return
+	}
+	for _, modObj := range s.mods {
+		closeOnShutdown(modObj)
+	}
+}
+
+// Discard ends the scope and closes all instances created within it in the
+// reverse order.
+func (s *Scope) Discard() {
+	scopeLck.Lock()
+	s.end()
+	scopeLck.Unlock()
+
+	for i := len(s.mods) - 1; i >= 0; i-- {
+		closeInline(s.mods[i])
+	}
+}
+
 // ModuleFromNode does all work to create or get existing module object with a certain type.
 // It is not used by top-level module definitions, only for references from other
 // modules configuration blocks.
@@ -117,11 +215,14 @@ func ModuleFromNode(preferredNamespace string, args []string, inlineCfg config.N
 		if len(args) != 1 || inlineCfg.Children != nil {
 			return parser.NodeErr(inlineCfg, "exactly one argument is required to use existing config block")
 		}
+		if !module.HasInstance(args[0][1:]) {
+			return parser.NodeErr(inlineCfg, "unknown config block: %s", args[0][1:])
+		}
 		modObj, err = module.GetInstance(args[0][1:])
 		log.Debugf("%s:%d: reference %s", inlineCfg.File, inlineCfg.Line, args[0])
 	} else {
 		log.Debugf("%s:%d: new module %s %v", inlineCfg.File, inlineCfg.Line, args[0], args[1:])
-		modObj, err = createInlineModule(preferredNamespace, args[0], args[1:])
+		modObj, err = createInlineModule(preferredNamespace, args[0], args[1:], inlineCfg)
 	}
 	if err != nil {
 		return err
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modconfig
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type inlineMod struct {
+	args   []string
+	value  string
+	closed bool
+}
+
+func (m *inlineMod) Init(cfg *config.Map) error {
+	cfg.String("value", false, false, "", &m.value)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if m.value == "fail" {
+		return errors.New("target.test_inline: init failed")
+	}
+	return nil
+}
+
+func (m *inlineMod) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *inlineMod) Name() string {
+	return "target.test_inline"
+}
+
+func (m *inlineMod) InstanceName() string {
+	return ""
+}
+
+func init() {
+	module.Register("target.test_inline", func(_, _ string, _, inlineArgs []string) (module.Module, error) {
+		return &inlineMod{args: inlineArgs}, nil
+	})
+}
+
+func inlineNode(t *testing.T, str string) config.Node {
+	t.Helper()
+
+	tree, err := parser.Read(strings.NewReader(str), "literal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree[0].Children[0].Children[0]
+}
+
+func TestModuleFromNode_Inline(t *testing.T) {
+	node := inlineNode(t, `smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		deliver_to test_inline tcp://127.0.0.1:25 {
+			value a
+		}
+	}
+}`)
+
+	var mod *inlineMod
+	if err := ModuleFromNode("target", node.Args, node, nil, &mod); err != nil {
+		t.Fatal(err)
+	}
+	if len(mod.args) != 1 || mod.args[0] != "tcp://127.0.0.1:25" {
+		t.Error("wrong inline args:", mod.args)
+	}
+	if mod.value != "a" {
+		t.Error("block is not passed to Init, value:", mod.value)
+	}
+
+	hooks.RunHooks(hooks.EventShutdown)
+	if !mod.closed {
+		t.Error("inline module is not closed on shutdown")
+	}
+}
+
+func TestModuleFromNode_InlineErrors(t *testing.T) {
+	test := func(str, expectedErr string) {
+		t.Helper()
+
+		node := inlineNode(t, str)
+		var mod *inlineMod
+		err := ModuleFromNode("target", node.Args, node, nil, &mod)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if err.Error() != expectedErr {
+			t.Errorf("wrong error message\nwant: %s\ngot:  %s", expectedErr, err.Error())
+		}
+	}
+
+	// Init error is reported at the inline definition.
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		deliver_to test_inline {
+			value fail
+		}
+	}
+}`, `literal:3: smtp tcp://0.0.0.0:25 > destination example.org > deliver_to test_inline: target.test_inline: init failed`)
+	// Errors for directives in the block keep their location.
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		deliver_to test_inline {
+			valeu a
+		}
+	}
+}`, `literal:4: smtp tcp://0.0.0.0:25 > destination example.org > deliver_to test_inline: unknown directive: valeu, did you mean value?`)
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		deliver_to test_inlin
+	}
+}`, `literal:3: smtp tcp://0.0.0.0:25 > destination example.org: unknown module: test_inlin (namespace: target), did you mean test_inline?`)
+}
+
+func TestModuleFromNode_Scope(t *testing.T) {
+	node := inlineNode(t, `smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		deliver_to test_inline
+	}
+}`)
+
+	outer := BeginScope()
+	var kept *inlineMod
+	if err := ModuleFromNode("target", node.Args, node, nil, &kept); err != nil {
+		t.Fatal(err)
+	}
+
+	inner := BeginScope()
+	var innerMod *inlineMod
+	if err := ModuleFromNode("target", node.Args, node, nil, &innerMod); err != nil {
+		t.Fatal(err)
+	}
+	inner.Keep()
+	if innerMod.closed {
+		t.Error("inline module is closed by Keep")
+	}
+
+	outer.Discard()
+	if !kept.closed {
+		t.Error("inline module is not closed by Discard")
+	}
+	if !innerMod.closed {
+		t.Error("inline module from the nested scope is not closed by Discard")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"sort"
+)
+
+// UnknownDirectiveErr returns the error for the directive that is not
+// allowed in the enclosing block. If there is a known directive with a
+// similar name, it is suggested in the error message.
+func UnknownDirectiveErr(node Node, known []string) error {
+	if suggestion := Suggest(node.Name, known); suggestion != "" {
+		return NodeErr(node, "unknown directive: %s, did you mean %s?", node.Name, suggestion)
+	}
+	return NodeErr(node, "unknown directive: %s", node.Name)
+}
+
+// Suggest returns the string from known that is the closest to s by the edit
+// distance. Empty string is returned if there is no string close enough to
+// be a likely typo.
+//
+// If there are multiple strings with the same distance, the lexicographically
+// smallest one is returned.
+func Suggest(s string, known []string) string {
+	// Allow one edit for short strings and up to 3 for long ones.
+	maxDist := len(s)/4 + 1
+	if maxDist > 3 {
+		maxDist = 3
+	}
+
+	sorted := make([]string, len(known))
+	copy(sorted, known)
+	sort.Strings(sorted)
+
+	best, bestDist := "", maxDist+1
+	for _, k := range sorted {
+		if d := editDistance(s, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+
+	prev := make([]int, len(br)+1)
+	curr := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		curr[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(br)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,47 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	known := []string{"deliver_to", "destination", "default_destination", "reject", "tls", "debug"}
+
+	for _, c := range []struct {
+		s    string
+		want string
+	}{
+		{"delivr_to", "deliver_to"},
+		{"deliverto", "deliver_to"},
+		{"destinaton", "destination"},
+		{"defualt_destination", "default_destination"},
+		{"rejetc", "reject"},
+		{"tsl", ""}, // Transposition is 2 edits, too many for a short name.
+		{"tl", "tls"},
+		{"debug", "debug"},
+		{"timeout", ""},
+		{"", ""},
+	} {
+		if got := Suggest(c.s, known); got != c.want {
+			t.Errorf("Suggest(%q) = %q, want %q", c.s, got, c.want)
+		}
+	}
+}
@@ -20,9 +20,6 @@ package tls
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"io/ioutil"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -56,15 +53,9 @@ func TLSClientBlock(m *config.Map, node config.Node) (interface{}, error) {
 	}
 
 	if len(rootCAPaths) != 0 {
-		pool := x509.NewCertPool()
-		for _, path := range rootCAPaths {
-			blob, err := ioutil.ReadFile(path)
-			if err != nil {
-				return nil, err
-			}
-			if !pool.AppendCertsFromPEM(blob) {
-				return nil, fmt.Errorf("no certificates was loaded from %s", path)
-			}
+		pool, err := loadCAPool(rootCAPaths)
+		if err != nil {
+			return nil, err
 		}
 		cfg.RootCAs = pool
 	}
@@ -20,6 +20,9 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -33,6 +36,14 @@ var strVersionsMap = map[string]uint16{
 	"":       0, // use crypto/tls defaults if value is not specified
 }
 
+var strClientAuthMap = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
 var strCiphersMap = map[string]uint16{
 	// TLS 1.0 - 1.2 cipher suites.
 	"RSA-WITH-RC4128-SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
@@ -134,3 +145,18 @@ func TLSCurvesDirective(m *config.Map, node config.Node) (interface{}, error) {
 	log.Debugln("tls: using non-default curve preferences:", node.Args)
 	return res, nil
 }
+
+// loadCAPool reads PEM-encoded CA certificates from the files.
+func loadCAPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		blob, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, fmt.Errorf("no certificates was loaded from %s", path)
+		}
+	}
+	return pool, nil
+}
@@ -92,13 +92,17 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 	}
 
 	childM := config.NewMap(globals, blockNode)
-	var tlsVersions [2]uint16
+	var (
+		tlsVersions   [2]uint16
+		clientAuth    string
+		clientCAPaths []string
+	)
 
 	childM.Custom("loader", false, false, func() (interface{}, error) {
 		return loader, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
 		var l module.TLSLoader
-		err := modconfig.ModuleFromNode("tls.loader", blockNode.Args, config.Node{}, globals, &l)
+		err := modconfig.ModuleFromNode("tls.loader", node.Args, node, globals, &l)
 		return l, err
 	}, &loader)
 
@@ -114,10 +118,26 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 		return nil, nil
 	}, TLSCurvesDirective, &baseCfg.CurvePreferences)
 
+	childM.Enum("client_auth", false, false,
+		[]string{"none", "request", "require", "verify_if_given", "require_and_verify"},
+		"none", &clientAuth)
+	childM.StringList("client_ca", false, false, nil, &clientCAPaths)
+
 	if _, err := childM.Process(); err != nil {
 		return nil, err
 	}
 
+	baseCfg.ClientAuth = strClientAuthMap[clientAuth]
+	if len(clientCAPaths) != 0 {
+		pool, err := loadCAPool(clientCAPaths)
+		if err != nil {
+			return nil, config.NodeErr(blockNode, "tls: %v", err)
+		}
+		baseCfg.ClientCAs = pool
+	} else if baseCfg.ClientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, config.NodeErr(blockNode, "tls: client_ca is required for client_auth %s", clientAuth)
+	}
+
 	if len(baseCfg.CipherSuites) != 0 {
 		baseCfg.PreferServerCipherSuites = true
 	}
@@ -30,16 +30,39 @@ func FQDN(domain string) string {
 	return dns.Fqdn(domain)
 }
 
+// lookupProfile implements the UTS #46 mapping in the non-transitional
+// (IDNA2008) mode. It is more permissive than idna.Lookup since configuration
+// may contain names that are not valid host names (e.g. containing
+// underscores).
+var lookupProfile = idna.New(
+	idna.MapForLookup(),
+	idna.StrictDomainName(false),
+	idna.BidiRule(),
+)
+
 // ForLookup converts the domain into a canonical form suitable for table
 // lookups and other comparisons.
 //
 // TL;DR Use this instead of strings.ToLower to prepare domain for lookups.
 //
+// The domain is converted to U-labels with UTS #46 mapping applied, so
+// all case and width variants of a name map to the same string.
+// Domains rejected by UTS #46 processing (e.g. because of disallowed
+// characters) are converted to U-labels as is, normalized to NFC and
+// converted to lower case.
+//
 // Domains that contain invalid UTF-8 or invalid A-label
 // domains are simply converted to local-case using strings.ToLower, but the
 // error is also returned.
 func ForLookup(domain string) (string, error) {
-	uDomain, err := idna.ToUnicode(domain)
+	uDomain, err := lookupProfile.ToUnicode(domain)
+	if err == nil {
+		return strings.TrimSuffix(uDomain, "."), nil
+	}
+
+	// Lower-case the domain before the conversion so "XN--" prefix is
+	// also recognized.
+	uDomain, err = idna.ToUnicode(strings.ToLower(domain))
 	if err != nil {
 		return strings.ToLower(domain), err
 	}
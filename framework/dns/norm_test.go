@@ -0,0 +1,51 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package dns
+
+import (
+	"testing"
+)
+
+func TestForLookup(t *testing.T) {
+	test := func(in, wantOut string, fail bool) {
+		t.Helper()
+
+		out, err := ForLookup(in)
+		if err != nil && !fail {
+			t.Errorf("Unexpected failure for %s: %v", in, err)
+		}
+		if err == nil && fail {
+			t.Errorf("Expected failure for %s, got none", in)
+		}
+		if out != wantOut {
+			t.Errorf("Wrong result for %s: want '%s', got '%s'", in, wantOut, out)
+		}
+	}
+
+	test("example.org", "example.org", false)
+	test("EXAMPLE.org.", "example.org", false)
+	test("xn--e1aybc.example.org", "тест.example.org", false)
+	test("XN--E1AYBC.example.org", "тест.example.org", false)
+	test("ТЕСТ.example.org", "тест.example.org", false)
+	// UTS #46 width mapping.
+	test("ｅｘａｍｐｌｅ．ｏｒｇ", "example.org", false)
+	// IDNA2008, ß is not mapped to ss.
+	test("faß.example.org", "faß.example.org", false)
+	test("_dmarc.example.org", "_dmarc.example.org", false)
+	test("XN--99999999999.example.org", "xn--99999999999.example.org", true)
+}
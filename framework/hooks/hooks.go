@@ -27,12 +27,12 @@ const (
 	EventShutdown Event = iota
 
 	// EventReload is triggered when the server process receives the SIGUSR2
-	// signal (on POSIX platforms) and indicates the request to reload the
-	// server configuration from persistent storage.
+	// or SIGHUP signal (on POSIX platforms) and indicates the request to
+	// reload the server configuration from persistent storage.
 	//
-	// Since it is by design problematic to reload the modules configuration,
-	// this event only applies to secondary files such as aliases mapping and
-	// TLS certificates.
+	// Modules configuration is reloaded separately using the
+	// module.ReloadModule interface, this event applies only to secondary
+	// files such as aliases mapping and TLS certificates.
 	EventReload
 
 	// EventLogRotate is triggered when the server process receives the SIGUSR1
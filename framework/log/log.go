@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/sanitize"
 )
 
 // Logger is the structure that writes formatted output to the underlying
@@ -157,7 +158,10 @@ func fieldsToMap(fields []interface{}, out map[string]interface{}) {
 func (l Logger) formatMsg(msg string, fields map[string]interface{}) string {
 	formatted := strings.Builder{}
 
-	formatted.WriteString(msg)
+	// Message text often contains values provided by the remote side, escape
+	// control characters so it can't be used to forge log records. Fields are
+	// taken care of by JSON encoding.
+	formatted.WriteString(sanitize.EscapeControl(msg))
 	formatted.WriteRune('\t')
 
 	if len(l.Fields)+len(fields) != 0 {
@@ -184,7 +188,7 @@ type LogFormatter interface {
 // to it will be written as a separate log messages.
 // No line-buffering is done.
 func (l Logger) Write(s []byte) (int, error) {
-	l.log(false, strings.TrimRight(string(s), "\n"))
+	l.log(false, sanitize.EscapeControl(strings.TrimRight(string(s), "\n")))
 	return len(s), nil
 }
 
@@ -24,8 +24,14 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	"github.com/foxcpp/maddy/framework/sanitize"
 )
 
+// maxFieldLen is the maximum length of a string field value. Longer values
+// are truncated to keep log records readable.
+const maxFieldLen = 2048
+
 // To support ad-hoc parsing in a better way we want to make order of fields in
 // output JSON documents determistics. Additionally, this will make them more
 // human-readable when values from multiple messages are lined up to each
@@ -65,6 +71,9 @@ func marshalOrderedJSON(output *strings.Builder, m map[string]interface{}) error
 		case error:
 			val = casted.Error()
 		}
+		if str, ok := val.(string); ok {
+			val = sanitize.Truncate(str, maxFieldLen)
+		}
 
 		jsonValue, err := json.Marshal(val)
 		if err != nil {
@@ -35,6 +35,42 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// CanonicalPlainAuth is an optional interface implemented by PlainAuth
+// modules that can report the canonical name of the authenticated user. It
+// can differ from the username supplied by the client, e.g. if the
+// credentials store ignores case or performs some normalization.
+type CanonicalPlainAuth interface {
+	AuthPlainCanonical(username, password string) (string, error)
+}
+
+// Service names passed to ServicePlainAuth.
+const (
+	ServiceIMAP = "imap"
+	ServiceSMTP = "smtp"
+	ServicePOP3 = "pop3"
+)
+
+// ServicePlainAuth is an optional interface implemented by PlainAuth modules
+// whose decision depends on the service the client authenticates for, e.g.
+// if some credentials are valid only for specific protocols.
+//
+// AuthPlainService returns the canonical username similarly to
+// CanonicalPlainAuth. Empty service means that it is not known.
+type ServicePlainAuth interface {
+	AuthPlainService(service, username, password string) (string, error)
+}
+
+// BearerAuth is the interface implemented by modules providing authentication
+// using OAuth 2.0 bearer tokens (RFC 6750).
+//
+// AuthBearer checks the token and returns the username it was issued for.
+// ErrUnknownCredentials should be returned if the token is not valid.
+//
+// Modules implementing this interface should be registered with "auth." prefix in name.
+type BearerAuth interface {
+	AuthBearer(token string) (string, error)
+}
+
 // PlainUserDB is a local credentials store that can be managed using maddyctl
 // utility.
 type PlainUserDB interface {
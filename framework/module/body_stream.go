@@ -0,0 +1,60 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// StreamingDelivery is an optional interface that may be implemented by the
+// object returned by DeliveryTarget.Start if it can process the message body
+// while it is being received by the message source.
+//
+// Message sources that support it call StreamBody once the header is read,
+// write the body to the returned BodyStream as it is received and close the
+// stream before calling Body (or BodyNonAtomic) with the buffered body as
+// usual.
+type StreamingDelivery interface {
+	// StreamBody prepares the delivery for streaming the message body.
+	//
+	// It returns nil BodyStream if streaming is not possible for the message,
+	// in which case the message source should not do anything special.
+	StreamBody(ctx context.Context, header textproto.Header) (BodyStream, error)
+}
+
+// BodyStream accepts the message body as it is received.
+//
+// Write returns an error if the message is rejected, the message source
+// should stop reading the body and report the error to the client. Stream
+// should be released using Abort in this case.
+type BodyStream interface {
+	io.Writer
+
+	// Close is called once the whole body is written. It blocks until the
+	// body is processed and returns the error if the message is rejected.
+	Close() error
+
+	// Abort releases resources associated with the stream if the body is
+	// not going to be completely written (e.g. because of an I/O error or
+	// if Write returned an error).
+	Abort(err error)
+}
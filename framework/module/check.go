@@ -20,6 +20,7 @@ package module
 
 import (
 	"context"
+	"io"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -56,6 +57,66 @@ type EarlyCheck interface {
 	CheckConnection(ctx context.Context, state *smtp.ConnectionState) error
 }
 
+// OptionalConnCheck is an optional module interface that can be implemented
+// by module implementing Check if it needs state tied to the client
+// connection, not to the individual message (e.g. rate limiting or caching of
+// results that depend only on the client IP).
+//
+// Per-connection state should be stored in conn.Data and can be accessed
+// by per-message CheckState objects via MsgMetadata.Conn.Data.
+//
+// The following ordering guarantees are provided by message sources
+// supporting the interface (currently, only SMTP and LMTP endpoints):
+//
+//   - ConnOpened is called once per connection for each check instance
+//     used in the endpoint pipeline configuration (nested pipelines used via
+//     reroute are not included), when the connection is accepted, before
+//     any command is processed. The same applies to connections with
+//     multiple SMTP sessions (e.g. after STARTTLS or for each
+//     authentication).
+//   - Only the connection addresses and Data are set in conn passed to
+//     ConnOpened and ConnClosed, the HELO hostname, TLS and authentication
+//     information are not known at that point.
+//   - All ConnOpened calls complete before the first CheckStateForMsg call
+//     for messages received over that connection.
+//   - ConnClosed is called once per connection after all CheckState objects
+//     created for messages received over that connection are closed.
+//   - There is no ordering between calls for different check instances.
+//
+// ConnOpened can't reject the connection. If the check wants to do that, it
+// should save the decision in conn.Data and return it from the
+// CheckState.CheckConnection.
+//
+// Messages not received over the network (Conn is nil) or received via
+// message sources not supporting the interface (Conn.Data is nil) should be
+// handled gracefully.
+type OptionalConnCheck interface {
+	ConnOpened(ctx context.Context, conn *ConnState)
+	ConnClosed(conn *ConnState)
+}
+
+// CacheableCheck is an optional module interface that can be implemented by
+// module implementing Check if results of its CheckConnection and CheckSender
+// depend only on the connection parameters (client IP, HELO hostname,
+// authenticated user, TLS use) and on the MAIL FROM domain.
+//
+// For such checks, the message pipeline caches results for the duration of
+// the client connection and does not call the corresponding CheckState
+// methods again for subsequent messages with the same inputs. Cached entry
+// is discarded once any of the inputs changes.
+//
+// Note that CheckState objects are still created for each message and
+// CheckRcpt and CheckBody are called as usual. Checks that need
+// CheckConnection or CheckSender to be called to prepare state for later
+// stages should not implement this interface.
+//
+// Cache is available only for message sources supporting OptionalConnCheck.
+type CacheableCheck interface {
+	// CacheResults reports whether the results can be cached. It allows
+	// the check to opt out of caching depending on its configuration.
+	CacheResults() bool
+}
+
 type CheckState interface {
 	// CheckConnection is executed once when client sends a new message.
 	//
@@ -106,4 +167,41 @@ type CheckResult struct {
 	// Header is the header fields that should be
 	// added to the header after all checks.
 	Header textproto.Header
+
+	// Score is the contribution of the check to the message spam score.
+	//
+	// Scores reported by all checks are summed by the message pipeline and
+	// compared with its thresholds, independently of Reject and Quarantine
+	// flags set by the check itself. Score can be reported without Reason.
+	Score int
+}
+
+// StreamingCheckState is an optional interface that can be implemented by
+// CheckState if the check can process the message body as it is received
+// instead of looking at the fully buffered body.
+//
+// If all body checks configured for the message implement it, the message
+// pipeline feeds the body to them while it is being received and rejects the
+// message as soon as any check does so, without waiting for the rest of the
+// body to arrive. CheckBody is not called for the state in this case.
+// Otherwise, CheckBody is used as usual.
+type StreamingCheckState interface {
+	// CheckBodyStream is the streaming variant of CheckBody.
+	//
+	// The body reader returns the message body as it is received. The
+	// check does not have to read it until EOF, it should return as soon as
+	// it has enough information to make a decision. Errors returned by body
+	// indicate that the message is aborted and the check result is not
+	// going to be used.
+	CheckBodyStream(ctx context.Context, header textproto.Header, body io.Reader) CheckResult
+}
+
+// FailActionCheck is an optional interface that can be implemented by Check
+// modules that have a single configurable action for failures (usually set
+// using the fail_action directive).
+//
+// It is used by the message pipeline to handle failures detected outside of
+// the check code, such as the check block timeout.
+type FailActionCheck interface {
+	ApplyFailAction(res CheckResult) CheckResult
 }
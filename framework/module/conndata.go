@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import "sync"
+
+// ConnData is the storage area for module data that is tied to the client
+// connection rather than to an individual message.
+//
+// It works similarly to context.Context values. Keys are compared using ==,
+// so to avoid collisions with other modules each module must define its own
+// unexported key type and never use built-in types (such as string) as
+// keys:
+//
+//	type connDataKey struct{}
+//
+//	conn.Data.Set(connDataKey{}, &myState{})
+//	state, _ := conn.Data.Get(connDataKey{}).(*myState)
+//
+// The key type is unexported, so only the module defining it can access the
+// value. If the state needs to be shared with other modules, the module
+// should provide functions to access it instead of exporting the key.
+//
+// ConnData is created when the connection is accepted and is shared by all
+// sessions on that connection (e.g. the sessions before and after STARTTLS).
+//
+// All methods are safe for concurrent use. Methods are no-op (Get returns
+// nil) if called on the nil ConnData, this is the case for connections
+// created by message sources that do not support connection-level checks.
+type ConnData struct {
+	lock   sync.Mutex
+	values map[interface{}]interface{}
+}
+
+func NewConnData() *ConnData {
+	return &ConnData{values: make(map[interface{}]interface{})}
+}
+
+// Get returns the value associated with the key or nil if there is none.
+func (d *ConnData) Get(key interface{}) interface{} {
+	if d == nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.values[key]
+}
+
+// Set associates the value with the key, replacing the existing value.
+func (d *ConnData) Set(key, value interface{}) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.values[key] = value
+}
+
+// LoadOrStore returns the existing value for the key if present.
+// Otherwise, it stores and returns the given value. The loaded result is true
+// if the value was loaded, false if stored.
+//
+// It should be used when multiple module instances may initialize the
+// same value concurrently.
+func (d *ConnData) LoadOrStore(key, value interface{}) (actual interface{}, loaded bool) {
+	if d == nil {
+		return value, false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if existing, ok := d.values[key]; ok {
+		return existing, true
+	}
+	d.values[key] = value
+	return value, false
+}
+
+// Delete removes the value associated with the key.
+func (d *ConnData) Delete(key interface{}) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.values, key)
+}
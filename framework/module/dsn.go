@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package module
+
+// Conditions for DSN generation requested using the NOTIFY parameter.
+const (
+	DSNNotifyNever   = "NEVER"
+	DSNNotifySuccess = "SUCCESS"
+	DSNNotifyFailure = "FAILURE"
+	DSNNotifyDelay   = "DELAY"
+)
+
+// Values of the RET parameter.
+const (
+	DSNReturnFull    = "FULL"
+	DSNReturnHeaders = "HDRS"
+)
+
+// DSNOpts contains parameters of the SMTP DSN extension (RFC 3461).
+//
+// Zero value means the client did not request anything specific and the
+// default behavior should be used.
+type DSNOpts struct {
+	// Value of the RET parameter, DSNReturnFull or DSNReturnHeaders.
+	Return string `json:",omitempty"`
+
+	// Value of the ENVID parameter, decoded from xtext.
+	EnvID string `json:",omitempty"`
+
+	// Parameters specified for recipients, keyed by the recipient address
+	// as presented by the client (with the domain normalized), see
+	// MsgMetadata.RcptDSN.
+	Rcpts map[string]DSNRcptOpts `json:",omitempty"`
+}
+
+// DSNRcptOpts contains RCPT TO parameters of the SMTP DSN extension.
+type DSNRcptOpts struct {
+	// Values of the NOTIFY parameter. Empty if the parameter was not
+	// specified.
+	Notify []string `json:",omitempty"`
+
+	// Value of the ORCPT parameter in the "addr-type;address" form, decoded
+	// from xtext.
+	OriginalRcpt string `json:",omitempty"`
+}
+
+// ShouldNotify reports whether the DSN should be generated for the event
+// (DSNNotifySuccess, DSNNotifyFailure or DSNNotifyDelay).
+//
+// If NOTIFY was not specified, DSNs are generated for failures and delays
+// (RFC 3461 Section 4.1).
+func (opts DSNRcptOpts) ShouldNotify(event string) bool {
+	if len(opts.Notify) == 0 {
+		return event == DSNNotifyFailure || event == DSNNotifyDelay
+	}
+	for _, n := range opts.Notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
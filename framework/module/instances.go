@@ -89,6 +89,9 @@ func GetInstance(name string) (Module, error) {
 
 	Initialized[name] = true
 	if err := mod.mod.Init(mod.cfg); err != nil {
+		if mod.cfg != nil {
+			err = config.WrapBlockErr(mod.cfg.Block, err)
+		}
 		return mod.mod, err
 	}
 
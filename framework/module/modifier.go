@@ -33,7 +33,8 @@ import (
 // can invalidate assertions made on the body contents before modification and
 // will break DKIM signatures.
 //
-// Only message header can be modified. Furthermore, it is highly discouraged for
+// Only message header can be modified (except for modifiers implementing
+// BodyReplacingModifierState). Furthermore, it is highly discouraged for
 // modifiers to remove or change existing fields to prevent issues outlined
 // above.
 //
@@ -63,12 +64,14 @@ type ModifierState interface {
 	RewriteSender(ctx context.Context, mailFrom string) (string, error)
 
 	// RewriteRcpt replaces RCPT TO value.
-	// If no changed are required, this method returns its argument, otherwise
-	// it returns a new value.
+	// If no changed are required, this method returns its argument as a
+	// single-element slice, otherwise it returns a list of new values. The
+	// original recipient is replaced with all of them (e.g. alias expansion),
+	// the list should not be empty.
 	//
 	// MsgPipeline will take of populating MsgMeta.OriginalRcpts. RewriteRcpt
 	// doesn't do it.
-	RewriteRcpt(ctx context.Context, rcptTo string) (string, error)
+	RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error)
 
 	// RewriteBody modifies passed Header argument and may optionally
 	// inspect the passed body buffer to make a decision on new header field values.
@@ -81,3 +84,45 @@ type ModifierState interface {
 	// Rewrite* functions return an error.
 	Close() error
 }
+
+// SealingModifierState is an optional interface that can be implemented by
+// ModifierState if the modifier needs to see the final message header, e.g.
+// to cover all other changes with a signature (ARC sealing).
+//
+// SealBody is called by the message pipeline after RewriteBody of all
+// modifiers (global, per-source and per-destination ones) so it is
+// guaranteed that no other modifier changes the header after it. RewriteBody
+// is still called for such modifiers in the normal order.
+type SealingModifierState interface {
+	SealBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error
+}
+
+// BodyReplacingModifierState is an optional interface that can be implemented
+// by ModifierState if the modifier needs to change the message body, despite
+// the concerns outlined in the Modifier documentation.
+//
+// ReplaceBody is called by the message pipeline for global and per-source
+// modifiers before RewriteBody of any modifier so that signatures added by
+// other modifiers (e.g. DKIM) cover the new body. It returns the new body or
+// nil if the body is left as is. Header can be changed to match the new body
+// (e.g. Content-Transfer-Encoding).
+//
+// Since the body is shared by all recipients, per-destination modifiers can't
+// replace it, the message pipeline fails the delivery if they attempt to.
+type BodyReplacingModifierState interface {
+	ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+}
+
+// RcptHeaderModifierState is an optional interface that can be implemented
+// by ModifierState if the modifier needs to add header fields that differ for
+// each recipient (e.g. Delivered-To).
+//
+// If any modifier state used for the recipient implements the interface, the
+// message pipeline starts a separate delivery for that recipient and calls
+// RcptHeader with the copy of the final message header (after SealBody)
+// before passing it to the delivery target. Error returned by RcptHeader
+// fails the delivery only for that recipient if the message source supports
+// per-recipient statuses (see PartialDelivery).
+type RcptHeaderModifierState interface {
+	RcptHeader(ctx context.Context, rcptTo string, h *textproto.Header) error
+}
@@ -34,6 +34,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"errors"
+
 	"github.com/foxcpp/maddy/framework/config"
 )
 
@@ -88,3 +90,25 @@ type FuncNewModule func(modName, instName string, aliases, inlineArgs []string)
 // As a consequence of having no per-instance name, InstanceName of the module
 // object always returns the same value as Name.
 type FuncNewEndpoint func(modName string, addrs []string) (Module, error)
+
+// ReloadModule is an optional interface implemented by modules that can
+// switch to the changed configuration block without the server restart.
+//
+// On configuration reload (SIGHUP), Reload is called for module instances
+// whose configuration block has changed. The module should process the new
+// configuration the same way Init does, but without changing the running
+// configuration, and return the function that switches to it.
+//
+// The apply function is called only if the configuration of all changed
+// modules is processed successfully. It should not fail and it should switch
+// the configuration atomically, operations in progress are allowed to
+// complete using the old configuration.
+type ReloadModule interface {
+	Reload(cfg *config.Map) (apply func(), err error)
+}
+
+// ErrRestartRequired can be returned (possibly wrapped) by
+// ReloadModule.Reload to indicate that the configuration change can't be
+// applied without the server restart. The change is then reported and not
+// applied, it does not prevent changes of other modules from being applied.
+var ErrRestartRequired = errors.New("restart is required to apply changes")
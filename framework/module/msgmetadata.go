@@ -21,7 +21,10 @@ package module
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"strconv"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/future"
@@ -61,8 +64,35 @@ type ConnState struct {
 	// If the client successfully authenticated using a username/password pair.
 	// This field should be cleaned if the ConnState object is serialized
 	AuthPassword string
+
+	// RelayIdentity is set if the client did not authenticate and AuthUser
+	// is the synthetic identity assigned to its network by the message
+	// source (see relay_identity in endpoint/smtp).
+	RelayIdentity bool
+
+	// EarlyTalker is set if the client sent data before the server greeting.
+	// It is populated by endpoint/smtp only if greeting_delay is used.
+	EarlyTalker bool
+
+	// TLSPolicy is the decision made by the message source according to the
+	// TLS requirement configured for it, either TLSPolicyRequired or
+	// TLSPolicyExempt. It is empty if no requirement is configured.
+	TLSPolicy string
+
+	// Data is the per-connection storage area for modules implementing
+	// OptionalConnCheck. It is nil if the message source does not support
+	// connection-level checks.
+	Data *ConnData `json:"-"`
 }
 
+// Values of ConnState.TLSPolicy.
+const (
+	// TLS is required for the connection. Set for TLS connections too.
+	TLSPolicyRequired = "required"
+	// TLS is required but the client is exempt from the requirement.
+	TLSPolicyExempt = "exempt"
+)
+
 // MsgMetadata structure contains all information about the origin of
 // the message and all associated flags indicating how it should be handled
 // by components.
@@ -91,25 +121,63 @@ type MsgMetadata struct {
 	// header. These fields are still written to the server log.
 	DontTraceSender bool
 
+	// If set - TLS version and cipher suite used by the client are added
+	// to the Received header.
+	TraceTLS bool
+
+	// If set - the username of the authenticated client (Conn.AuthUser) is
+	// added to the Received header.
+	TraceAuthUser bool
+
+	// If set - the message pipeline does not add the Received header at
+	// all. Used by message sources for hops from trusted internal relays.
+	DontAddReceived bool
+
 	// Quarantine is a message flag that is should be set if message is
 	// considered "suspicious" and should be put into "Junk" folder
 	// in the storage.
 	//
 	// This field should not be modified by the checks that verify
-	// the message. It is set only by the message pipeline.
+	// the message. It is set by the message pipeline and by modifiers
+	// that detect dangerous content (e.g. modify.strip_attachments).
 	Quarantine bool
 
+	// QuarantineRcpts contains final recipient addresses (as passed to
+	// the delivery target) the message should be quarantined for, in
+	// addition to the message-level Quarantine flag.
+	//
+	// It is set by the message pipeline before the message body is passed
+	// to delivery targets, targets should use IsQuarantined to check both.
+	QuarantineRcpts map[string]struct{}
+
 	// OriginalRcpts contains the mapping from the final recipient to the
 	// recipient that was presented by the client.
 	//
 	// MsgPipeline will update that field when recipient modifiers
-	// are executed.
+	// are executed. If the same final recipient is produced for multiple
+	// recipients, the first one is used (the message is delivered to the
+	// final recipient only once).
 	//
 	// It should be used when reporting information back to client (via DSN,
 	// for example) to prevent disclosing information about aliases
 	// which is usually unwanted.
 	OriginalRcpts map[string]string
 
+	// ForwardRcpts contains recipient addresses produced by modifiers that
+	// point back to the remote origin of the message, e.g. SRS addresses
+	// unwrapped by modify.srs.
+	//
+	// MsgPipeline routes such recipients using the forward_destination
+	// block, if it is defined.
+	ForwardRcpts map[string]struct{}
+
+	// RcptFolders contains the mailbox the message should be stored in for
+	// the final recipient, overriding the storage default (normally INBOX).
+	//
+	// It is set by filtering targets (e.g. target.sieve) before passing the
+	// message to the storage. Quarantine takes precedence over it.
+	RcptFolders map[string]string
+
 	// SMTPOpts contains the SMTP MAIL FROM command arguments, if the message
 	// was accepted over SMTP or SMTP-like protocol (such as LMTP).
 	//
@@ -129,6 +197,49 @@ type MsgMetadata struct {
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
 	TLSRequireOverride bool
+
+	// DSN contains parameters of the SMTP DSN extension (RFC 3461), see
+	// dsn.go.
+	DSN DSNOpts
+
+	// Priority is the delivery priority of the message, from PriorityMin to
+	// PriorityMax, 0 is normal. It is used by the queue to pick messages
+	// to deliver first. Modifiers are allowed to change it.
+	Priority int
+
+	// DeliverAfter is the time the message should not be delivered before
+	// (FUTURERELEASE extension, RFC 4865). Zero value means no restriction.
+	// It is enforced by the queue, capped by its max_hold_time.
+	DeliverAfter time.Time
+}
+
+const (
+	PriorityMin  = -9
+	PriorityBulk = -5
+	PriorityHigh = 5
+	PriorityMax  = 9
+)
+
+// ParsePriority converts the priority name (bulk, normal, high) or number
+// into the MsgMetadata.Priority value.
+func ParsePriority(s string) (int, error) {
+	switch s {
+	case "bulk":
+		return PriorityBulk, nil
+	case "normal":
+		return 0, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+
+	value, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("priority should be bulk, normal, high or a number: %s", s)
+	}
+	if value < PriorityMin || value > PriorityMax {
+		return 0, fmt.Errorf("priority should be in range from %d to %d", PriorityMin, PriorityMax)
+	}
+	return value, nil
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
@@ -143,6 +254,27 @@ func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	return &cpy
 }
 
+// IsQuarantined reports whether the message should be quarantined for the
+// recipient.
+func (msgMeta *MsgMetadata) IsQuarantined(rcpt string) bool {
+	if msgMeta.Quarantine {
+		return true
+	}
+	_, ok := msgMeta.QuarantineRcpts[rcpt]
+	return ok
+}
+
+// RcptDSN returns DSN parameters for the final recipient.
+//
+// Parameters are stored for the recipient as it was presented by the client,
+// so OriginalRcpts is used to find them.
+func (msgMeta *MsgMetadata) RcptDSN(rcpt string) DSNRcptOpts {
+	if original, ok := msgMeta.OriginalRcpts[rcpt]; ok {
+		rcpt = original
+	}
+	return msgMeta.DSN.Rcpts[rcpt]
+}
+
 // GenerateMsgID generates a string usable as MsgID field in module.MsgMeta.
 func GenerateMsgID() (string, error) {
 	rawID := make([]byte, 4)
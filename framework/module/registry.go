@@ -70,6 +70,31 @@ func Get(name string) FuncNewModule {
 	return modules[name]
 }
 
+// RegisteredModules returns names of all registered modules, including
+// deprecated names. Endpoint modules are not included.
+func RegisteredModules() []string {
+	modulesLock.RLock()
+	defer modulesLock.RUnlock()
+
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	return names
+}
+
+// RegisteredEndpoints returns names of all registered endpoint modules.
+func RegisteredEndpoints() []string {
+	modulesLock.RLock()
+	defer modulesLock.RUnlock()
+
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	return names
+}
+
 // GetEndpoints returns an endpoint module from global registry.
 //
 // Nil is returned if no module with specified name is registered.
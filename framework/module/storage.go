@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"time"
+
 	imapbackend "github.com/emersion/go-imap/backend"
 )
 
@@ -48,3 +50,52 @@ type ManageableStorage interface {
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
 }
+
+// Quota contains the storage usage and limits for an account.
+//
+// Zero limit means there is no limit.
+type Quota struct {
+	UsedBytes int64
+	MaxBytes  int64
+	UsedMsgs  int64
+	MaxMsgs   int64
+}
+
+// QuotaStorage is an optional interface implemented by Storage modules
+// that enforce per-account quotas.
+type QuotaStorage interface {
+	GetQuota(username string) (Quota, error)
+
+	// SetQuota changes limits for the account. Negative value resets
+	// the limit to the storage default.
+	SetQuota(username string, maxBytes, maxMsgs int64) error
+}
+
+// RetentionStorage is an optional interface implemented by Storage modules
+// that automatically remove old messages from mailboxes.
+type RetentionStorage interface {
+	// GetRetention returns retention periods used for the account, mailbox
+	// name -> period.
+	GetRetention(username string) (map[string]time.Duration, error)
+
+	// SetRetention overrides the retention period for the account mailbox.
+	// Zero period disables the removal, negative value resets it to the
+	// storage default.
+	SetRetention(username, mailbox string, period time.Duration) error
+}
+
+// BlobStorage is an optional interface implemented by Storage modules that
+// keep message bodies in a filesystem blob store.
+type BlobStorage interface {
+	// CollectBlobs removes stored blobs that are not used by any message and
+	// returns the amount of removed files.
+	CollectBlobs() (int, error)
+
+	// VerifyBlobs reads all stored message bodies and calls bad for ones
+	// that are damaged. It returns the amount of checked bodies.
+	VerifyBlobs(bad func(key string, err error)) (int, error)
+
+	// MigrateBlobs converts stored message bodies to the specified layout
+	// and returns the amount of converted bodies.
+	MigrateBlobs(layout string) (int, error)
+}
@@ -24,9 +24,20 @@ package module
 // Modules implementing this interface should be registered with prefix
 // "table." in name.
 type Table interface {
+	// Lookup returns the value for the key s.
+	//
+	// If there is no such key, ("", false, nil) is returned. Non-nil error
+	// is returned only if the lookup itself failed (e.g. the database is
+	// not available) and callers should not treat it as a missing key.
 	Lookup(s string) (string, bool, error)
 }
 
+// MultiTable is an optional interface that can be implemented by Table
+// modules that can store multiple values for a single key.
+type MultiTable interface {
+	LookupMulti(s string) ([]string, error)
+}
+
 type MutableTable interface {
 	Table
 	Keys() ([]string, error)
@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sanitize contains helpers to safely include untrusted strings
+// (addresses, HELO hostnames, header values, remote server responses) into
+// log messages, protocol replies and message header fields.
+//
+// Values controlled by the remote party should pass through these functions
+// at the points where output is generated (log formatting, SMTP reply
+// construction, trace header generation) instead of at each call site.
+package sanitize
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Ellipsis is appended to the values shortened by Truncate.
+	Ellipsis = "..."
+
+	// MaxReplyText is the maximum length of the text used in SMTP reply
+	// lines. RFC 5321 limits the whole reply line to 512 octets, this leaves
+	// some space for status codes and message IDs.
+	MaxReplyText = 400
+)
+
+func isControl(b byte) bool {
+	return b < 0x20 || b == 0x7f
+}
+
+// hasControl reports whether the string contains any control character. It
+// allows the functions below to avoid allocations in the common case.
+func hasControl(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if isControl(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// EscapeControl replaces all ASCII control characters (including CR, LF and
+// TAB) with their \xNN escaped form.
+//
+// It is meant to be used for log output where the original value should be
+// visible to the administrator but must not break the line structure.
+func EscapeControl(s string) string {
+	if !hasControl(s) {
+		return s
+	}
+
+	const hex = "0123456789abcdef"
+
+	b := strings.Builder{}
+	b.Grow(len(s) + 8)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isControl(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString(`\x`)
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// Truncate shortens the string to at most max bytes (including the ellipsis
+// marker) without splitting UTF-8 sequences.
+func Truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	if max <= len(Ellipsis) {
+		return Ellipsis[:max]
+	}
+
+	cut := max - len(Ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + Ellipsis
+}
+
+// ReplyText makes the string safe for use as a text of the protocol reply
+// (e.g. SMTP or IMAP response line).
+//
+// Control characters are replaced with '?' so the reply can't be split
+// into multiple ones and the result is truncated to MaxReplyText bytes.
+func ReplyText(s string) string {
+	if hasControl(s) {
+		b := []byte(s)
+		for i, c := range b {
+			if isControl(c) {
+				b[i] = '?'
+			}
+		}
+		s = string(b)
+	}
+	return Truncate(s, MaxReplyText)
+}
+
+// HeaderValue makes the string safe for use as a part of a message header
+// field value.
+//
+// CR and LF characters are removed so the value can't be used to inject
+// additional fields, other control characters except TAB are replaced with
+// '?'.
+func HeaderValue(s string) string {
+	if !hasControl(s) {
+		return s
+	}
+
+	b := strings.Builder{}
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\r' || c == '\n':
+		case c == '\t' || !isControl(c):
+			b.WriteByte(c)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sanitize
+
+import (
+	"testing"
+)
+
+func TestEscapeControl(t *testing.T) {
+	for in, out := range map[string]string{
+		"":                       "",
+		"plain text":             "plain text",
+		"a\r\nb":                 `a\x0d\x0ab`,
+		"tab\there":              `tab\x09here`,
+		"del\x7f":                `del\x7f`,
+		"\x00":                   `\x00`,
+		"юникод\nтоже":           `юникод\x0aтоже`,
+		"<evil\r\nX-Hdr: 1@a.b>": `<evil\x0d\x0aX-Hdr: 1@a.b>`,
+	} {
+		if res := EscapeControl(in); res != out {
+			t.Errorf("EscapeControl(%q) = %q, want %q", in, res, out)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	test := func(in string, max int, out string) {
+		t.Helper()
+		if res := Truncate(in, max); res != out {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", in, max, res, out)
+		}
+	}
+
+	test("short", 10, "short")
+	test("exactly10!", 10, "exactly10!")
+	test("a bit longer string", 10, "a bit l...")
+	test("abc", 2, "..")
+	// Do not split multibyte sequences.
+	test("ааааа", 8, "аа...")
+	test("ааааа", 9, "ааа...")
+}
+
+func TestReplyText(t *testing.T) {
+	if res := ReplyText("User <a\r\n250 OK\r\n@b> unknown"); res != "User <a??250 OK??@b> unknown" {
+		t.Errorf("unexpected result: %q", res)
+	}
+
+	long := ReplyText(string(make([]byte, 1000)))
+	if len(long) != MaxReplyText {
+		t.Errorf("reply text is not truncated: %d", len(long))
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	for in, out := range map[string]string{
+		"mx.example.org":        "mx.example.org",
+		"mx\r\nX-Injected: yes": "mxX-Injected: yes",
+		"mx\rX-Injected: yes":   "mxX-Injected: yes",
+		"with\ttab and\x00null": "with\ttab and?null",
+	} {
+		if res := HeaderValue(in); res != out {
+			t.Errorf("HeaderValue(%q) = %q, want %q", in, res, out)
+		}
+	}
+}
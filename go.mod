@@ -25,9 +25,11 @@ require (
 	github.com/foxcpp/go-imap-sql v0.4.1-0.20200823124337-2f57903a7ed0
 	github.com/foxcpp/go-mockdns v0.0.0-20201212160233-ede2f9158d15
 	github.com/foxcpp/go-mtasts v0.0.0-20191219193356-62bc3f1f74b8
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/google/uuid v1.1.1
-	github.com/klauspost/compress v1.10.11 // indirect
+	github.com/klauspost/compress v1.10.11
 	github.com/lib/pq v1.8.0
 	github.com/mailru/easyjson v0.7.6 // indirect
 	github.com/martinlindhe/base36 v1.1.0 // indirect
@@ -39,7 +41,11 @@ require (
 	golang.org/x/crypto v0.0.0-20201117144127-c1f2f97bffc9
 	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
-	golang.org/x/sys v0.0.0-20200821140526-fda516888d29 // indirect
+	golang.org/x/sys v0.0.0-20200821140526-fda516888d29
 	golang.org/x/text v0.3.5-0.20201125200606-c27b9fd57aec
 	google.golang.org/protobuf v1.25.0 // indirect
 )
+
+// Patched copy with the server-side support for SMTP extensions not
+// implemented upstream, see third_party/go-smtp/README.md.
+replace github.com/emersion/go-smtp => ./third_party/go-smtp
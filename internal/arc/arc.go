@@ -0,0 +1,263 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package arc implements verification and sealing of Authenticated Received
+// Chain (ARC) header fields (RFC 8617).
+//
+// Only the subset of DKIM features allowed by RFC 8617 is supported: signing
+// algorithms are rsa-sha256 and ed25519-sha256, l= tag is not supported.
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	FieldSeal        = "ARC-Seal"
+	FieldMsgSig      = "ARC-Message-Signature"
+	FieldAuthResults = "ARC-Authentication-Results"
+
+	// MaxInstance is the maximum amount of ARC sets that can be present in
+	// the message (RFC 8617 Section 4.2.1).
+	MaxInstance = 50
+)
+
+// Status is the chain validation status, as used in the cv= tag of
+// ARC-Seal and in the arc= Authentication-Results method.
+type Status string
+
+const (
+	StatusNone Status = "none"
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+)
+
+type arcSet struct {
+	instance int
+
+	authRes string
+	msgSig  string
+	seal    string
+}
+
+// rawField returns the header field in the "Key: Value\r\n" form.
+func rawField(fields textproto.HeaderFields) string {
+	raw, err := fields.Raw()
+	if err != nil {
+		// Should not happen for fields that were parsed or added by maddy.
+		return fields.Key() + ": " + fields.Value() + "\r\n"
+	}
+	return fixCRLF(string(raw))
+}
+
+// fieldValue returns the value part of the raw header field.
+func fieldValue(raw string) string {
+	return raw[strings.IndexByte(raw, ':')+1:]
+}
+
+// parseInstance extracts the value of the i= tag from the ARC header field
+// value.
+//
+// For ARC-Authentication-Results it should be the first tag in the value
+// (RFC 8617 Section 4.1.1), for other fields it can be located anywhere.
+func parseInstance(key, value string) (int, error) {
+	var iVal string
+	if strings.EqualFold(key, FieldAuthResults) {
+		value = strings.TrimSpace(unfold(value))
+		parts := strings.SplitN(value, ";", 2)
+		kv := strings.SplitN(parts[0], "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "i" {
+			return 0, errors.New("missing instance tag")
+		}
+		iVal = strings.TrimSpace(kv[1])
+	} else {
+		params, err := parseTags(value)
+		if err != nil {
+			return 0, err
+		}
+		var ok bool
+		iVal, ok = params["i"]
+		if !ok {
+			return 0, errors.New("missing instance tag")
+		}
+	}
+
+	i, err := strconv.Atoi(iVal)
+	if err != nil {
+		return 0, fmt.Errorf("malformed instance tag: %v", iVal)
+	}
+	if i < 1 || i > MaxInstance {
+		return 0, fmt.Errorf("instance number out of range: %d", i)
+	}
+	return i, nil
+}
+
+// collectSets extracts ARC sets from the header.
+//
+// If the chain structure is invalid, non-empty reason is returned. highest is
+// the highest instance number seen in the header (even if the structure is
+// invalid).
+func collectSets(h textproto.Header) (sets []arcSet, highest int, reason string) {
+	byInstance := make(map[int]*arcSet)
+
+	fields := h.Fields()
+	for fields.Next() {
+		key := fields.Key()
+		if !strings.EqualFold(key, FieldSeal) &&
+			!strings.EqualFold(key, FieldMsgSig) &&
+			!strings.EqualFold(key, FieldAuthResults) {
+			continue
+		}
+
+		raw := rawField(fields)
+		i, err := parseInstance(key, fieldValue(raw))
+		if err != nil {
+			if reason == "" {
+				reason = fmt.Sprintf("%s: %v", key, err)
+			}
+			continue
+		}
+		if i > highest {
+			highest = i
+		}
+
+		set := byInstance[i]
+		if set == nil {
+			set = &arcSet{instance: i}
+			byInstance[i] = set
+		}
+
+		var dst *string
+		switch {
+		case strings.EqualFold(key, FieldSeal):
+			dst = &set.seal
+		case strings.EqualFold(key, FieldMsgSig):
+			dst = &set.msgSig
+		default:
+			dst = &set.authRes
+		}
+		if *dst != "" {
+			if reason == "" {
+				reason = fmt.Sprintf("duplicate %s for instance %d", key, i)
+			}
+			continue
+		}
+		*dst = raw
+	}
+
+	if reason != "" {
+		return nil, highest, reason
+	}
+
+	for i := 1; i <= highest; i++ {
+		set := byInstance[i]
+		if set == nil || set.seal == "" || set.msgSig == "" || set.authRes == "" {
+			return nil, highest, fmt.Sprintf("incomplete ARC set for instance %d", i)
+		}
+		sets = append(sets, *set)
+	}
+
+	return sets, highest, ""
+}
+
+// parseTags parses the DKIM-style tag-value list (RFC 6376 Section 3.2).
+func parseTags(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(unfold(part))
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed tag-value pair: %s", part)
+		}
+		k := strings.TrimSpace(kv[0])
+		if _, ok := params[k]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", k)
+		}
+		params[k] = strings.TrimSpace(kv[1])
+	}
+	return params, nil
+}
+
+var signatureTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// stripSignature removes the value of the b= tag from the raw signature
+// header field.
+func stripSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	return raw[:colon+1] + signatureTag.ReplaceAllString(raw[colon+1:], "$1$2")
+}
+
+func unfold(s string) string {
+	return strings.NewReplacer("\r\n", "", "\n", "", "\r", "").Replace(s)
+}
+
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func collapseWSP(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// fixCRLF converts all line endings in s to CRLF.
+func fixCRLF(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func keyAlgo(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("arc: unsupported key type: %T", pub)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+)
+
+const testMsg = "From: <foo@example.org>\r\n" +
+	"To: <bar@example.com>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello, world!\r\n"
+
+var testKeys = []string{"From", "To", "Subject"}
+
+func testHeader(t *testing.T, authRes string) (textproto.Header, string) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(testMsg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authRes != "" {
+		hdr.Add("Authentication-Results", authRes)
+	}
+	body := testMsg[strings.Index(testMsg, "\r\n\r\n")+4:]
+	return hdr, body
+}
+
+func testSigner(t *testing.T, zones map[string]mockdns.Zone, domain string, rsaKey bool) crypto.Signer {
+	t.Helper()
+
+	var (
+		signer crypto.Signer
+		record string
+	)
+	if rsaKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer = key
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(blob)
+	} else {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer = key
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	}
+
+	zones["arc._domainkey."+domain+"."] = mockdns.Zone{TXT: []string{record}}
+	return signer
+}
+
+func seal(t *testing.T, hdr *textproto.Header, body, domain string, signer crypto.Signer, cv Status) {
+	t.Helper()
+	err := Seal(hdr, strings.NewReader(body), SealOptions{
+		Domain:      domain,
+		Selector:    "arc",
+		Signer:      signer,
+		AuthServID:  "mx." + domain,
+		ChainStatus: cv,
+		HeaderKeys:  testKeys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verify(t *testing.T, zones map[string]mockdns.Zone, hdr textproto.Header, body string) Result {
+	t.Helper()
+	res, err := Verify(context.Background(), &mockdns.Resolver{Zones: zones}, hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestVerify_NoChain(t *testing.T) {
+	hdr, body := testHeader(t, "")
+	res := verify(t, map[string]mockdns.Zone{}, hdr, body)
+	if res.Status != StatusNone {
+		t.Fatalf("expected none, got %v (%s)", res.Status, res.Reason)
+	}
+}
+
+func TestSeal_Roundtrip(t *testing.T) {
+	for _, rsaKey := range []bool{false, true} {
+		zones := map[string]mockdns.Zone{}
+		signer1 := testSigner(t, zones, "example.org", rsaKey)
+		signer2 := testSigner(t, zones, "example.net", !rsaKey)
+
+		hdr, body := testHeader(t, "mx.example.org; spf=pass smtp.mailfrom=example.org")
+		seal(t, &hdr, body, "example.org", signer1, StatusNone)
+
+		if !strings.HasPrefix(hdr.Get(FieldAuthResults), "i=1; mx.example.org; spf=pass") {
+			t.Errorf("unexpected ARC-Authentication-Results: %s", hdr.Get(FieldAuthResults))
+		}
+		if !strings.Contains(hdr.Get(FieldSeal), "cv=none") {
+			t.Errorf("first ARC-Seal should have cv=none: %s", hdr.Get(FieldSeal))
+		}
+
+		res := verify(t, zones, hdr, body)
+		if res.Status != StatusPass || res.Instances != 1 || res.Domain != "example.org" {
+			t.Fatalf("unexpected result after the first hop: %+v", res)
+		}
+
+		// Simulate the forwarding by the second hop that changes the header.
+		hdr.Add("Authentication-Results", "mx.example.net; arc=pass")
+		hdr.Add("Received", "from mx.example.org by mx.example.net")
+		seal(t, &hdr, body, "example.net", signer2, res.Status)
+
+		res = verify(t, zones, hdr, body)
+		if res.Status != StatusPass || res.Instances != 2 || res.Domain != "example.net" {
+			t.Fatalf("unexpected result after the second hop: %+v", res)
+		}
+		if !strings.Contains(hdr.Get(FieldSeal), "cv=pass") {
+			t.Errorf("second ARC-Seal should have cv=pass: %s", hdr.Get(FieldSeal))
+		}
+	}
+}
+
+func TestVerify_ModifiedBody(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	signer := testSigner(t, zones, "example.org", false)
+
+	hdr, body := testHeader(t, "")
+	seal(t, &hdr, body, "example.org", signer, StatusNone)
+
+	res := verify(t, zones, hdr, body+"Appended footer\r\n")
+	if res.Status != StatusFail {
+		t.Fatalf("expected fail, got %+v", res)
+	}
+
+	// Trailing empty lines and whitespace changes are ignored by relaxed
+	// canonicalization.
+	res = verify(t, zones, hdr, strings.Replace(body, " ", "  ", -1)+"\r\n\r\n")
+	if res.Status != StatusPass {
+		t.Fatalf("expected pass, got %+v", res)
+	}
+}
+
+func TestVerify_ModifiedHeader(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	signer := testSigner(t, zones, "example.org", false)
+
+	hdr, body := testHeader(t, "")
+	seal(t, &hdr, body, "example.org", signer, StatusNone)
+	hdr.Set("Subject", "Changed")
+
+	res := verify(t, zones, hdr, body)
+	if res.Status != StatusFail {
+		t.Fatalf("expected fail, got %+v", res)
+	}
+}
+
+func TestVerify_BrokenChain(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	signer := testSigner(t, zones, "example.org", false)
+
+	hdr, body := testHeader(t, "")
+	seal(t, &hdr, body, "example.org", signer, StatusNone)
+	seal(t, &hdr, body, "example.org", signer, StatusPass)
+
+	// Remove ARC-Message-Signature of the first instance.
+	fields := hdr.FieldsByKey(FieldMsgSig)
+	for fields.Next() {
+		if strings.HasPrefix(fields.Value(), "i=1;") {
+			fields.Del()
+		}
+	}
+
+	res := verify(t, zones, hdr, body)
+	if res.Status != StatusFail {
+		t.Fatalf("expected fail, got %+v", res)
+	}
+
+	// Sealing the broken chain should produce cv=fail and verification
+	// should keep failing.
+	seal(t, &hdr, body, "example.org", signer, StatusPass)
+	if !strings.Contains(hdr.Get(FieldSeal), "cv=fail") || !strings.Contains(hdr.Get(FieldSeal), "i=3") {
+		t.Errorf("unexpected ARC-Seal: %s", hdr.Get(FieldSeal))
+	}
+	res = verify(t, zones, hdr, body)
+	if res.Status != StatusFail {
+		t.Fatalf("expected fail, got %+v", res)
+	}
+
+	// Failed chain can't be extended.
+	err := Seal(&hdr, strings.NewReader(body), SealOptions{
+		Domain:     "example.org",
+		Selector:   "arc",
+		Signer:     signer,
+		HeaderKeys: testKeys,
+	})
+	if err != ErrChainFailed {
+		t.Fatalf("expected ErrChainFailed, got %v", err)
+	}
+}
+
+func TestVerify_FailedValidation(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	signer := testSigner(t, zones, "example.org", false)
+
+	hdr, body := testHeader(t, "")
+	seal(t, &hdr, body, "example.org", signer, StatusNone)
+
+	// The second hop found the chain to be invalid (e.g. due to body
+	// modification).
+	seal(t, &hdr, body, "example.org", signer, StatusFail)
+	if !strings.Contains(hdr.Get(FieldSeal), "cv=fail") {
+		t.Errorf("unexpected ARC-Seal: %s", hdr.Get(FieldSeal))
+	}
+
+	res := verify(t, zones, hdr, body)
+	if res.Status != StatusFail {
+		t.Fatalf("expected fail, got %+v", res)
+	}
+}
+
+func TestVerify_MissingKey(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	signer := testSigner(t, zones, "example.org", false)
+
+	hdr, body := testHeader(t, "")
+	seal(t, &hdr, body, "example.org", signer, StatusNone)
+
+	res := verify(t, map[string]mockdns.Zone{}, hdr, body)
+	if res.Status != StatusFail {
+		t.Fatalf("expected fail, got %+v", res)
+	}
+}
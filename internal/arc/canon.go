@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	canonSimple  = "simple"
+	canonRelaxed = "relaxed"
+)
+
+// canonHeader implements header canonicalization algorithms (RFC 6376
+// Section 3.4.1 and 3.4.2).
+func canonHeader(canon, raw string) string {
+	if canon == canonSimple {
+		raw = fixCRLF(raw)
+		if !strings.HasSuffix(raw, "\r\n") {
+			raw += "\r\n"
+		}
+		return raw
+	}
+
+	colon := strings.IndexByte(raw, ':')
+	k := strings.ToLower(strings.TrimRight(raw[:colon], " \t"))
+	v := strings.Trim(collapseWSP(unfold(raw[colon+1:])), " ")
+	return k + ":" + v + "\r\n"
+}
+
+// writeSigField writes the canonicalized signature header field with the
+// value of b= tag removed and without the trailing CRLF, as required for
+// signature computation.
+func writeSigField(w io.Writer, canon, raw string) {
+	io.WriteString(w, strings.TrimSuffix(canonHeader(canon, stripSignature(raw)), "\r\n"))
+}
+
+// bodyHash computes the SHA-256 hash of the canonicalized message body (RFC
+// 6376 Section 3.4.3 and 3.4.4).
+func bodyHash(canon string, body io.Reader) ([]byte, error) {
+	h := sha256.New()
+	br := bufio.NewReader(body)
+	pendingEmpty := 0
+	empty := true
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+			line = strings.TrimSuffix(line, "\r")
+			if canon == canonRelaxed {
+				line = strings.TrimRight(collapseWSP(line), " ")
+			}
+
+			// Trailing empty lines are ignored by both algorithms so
+			// write them only when we see the next non-empty line.
+			if line == "" {
+				pendingEmpty++
+			} else {
+				for ; pendingEmpty > 0; pendingEmpty-- {
+					io.WriteString(h, "\r\n")
+				}
+				io.WriteString(h, line+"\r\n")
+				empty = false
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if empty && canon == canonSimple {
+		io.WriteString(h, "\r\n")
+	}
+	return h.Sum(nil), nil
+}
+
+// writeSignedFields writes canonicalized header fields selected by the h= tag
+// value (RFC 6376 Section 5.4.2).
+//
+// Fields are picked from the bottom of the header, each instance is used
+// only once, non-existent fields are ignored.
+func writeSignedFields(w hash.Hash, canon string, h textproto.Header, keys []string) {
+	type field struct {
+		key string
+		raw string
+	}
+	var all []field
+	fields := h.Fields()
+	for fields.Next() {
+		all = append(all, field{key: strings.ToLower(fields.Key()), raw: rawField(fields)})
+	}
+
+	used := make([]bool, len(all))
+	for _, key := range keys {
+		key = strings.ToLower(strings.TrimSpace(key))
+		for i := len(all) - 1; i >= 0; i-- {
+			if used[i] || all[i].key != key {
+				continue
+			}
+			used[i] = true
+			io.WriteString(w, canonHeader(canon, all[i].raw))
+			break
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+var (
+	// ErrChainFailed is returned by Seal if the most recent ARC set in the
+	// message already has cv=fail. Such chain can't be extended.
+	ErrChainFailed = errors.New("arc: chain is already marked as failed")
+
+	// ErrTooManySets is returned by Seal if the message contains the maximum
+	// allowed amount of ARC sets.
+	ErrTooManySets = errors.New("arc: too many ARC sets")
+)
+
+// SealOptions contains the parameters for the new ARC set.
+type SealOptions struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+
+	// AuthServID is the authserv-id of the Authentication-Results field that
+	// should be copied into ARC-Authentication-Results.
+	AuthServID string
+
+	// ChainStatus is the validation status of the existing chain as
+	// determined by Verify. It is ignored if the message has no ARC sets.
+	ChainStatus Status
+
+	// HeaderKeys is the list of header fields covered by
+	// ARC-Message-Signature.
+	HeaderKeys []string
+
+	// Time is used as the signature timestamp. Current time is used if it
+	// is zero.
+	Time time.Time
+}
+
+// Seal adds a new ARC set to the message header as described in RFC 8617
+// Section 5.1.
+//
+// If the existing chain is not valid (ChainStatus is StatusFail or the chain
+// structure is broken), the new ARC-Seal has cv=fail and covers only the
+// new set.
+func Seal(h *textproto.Header, body io.Reader, opts SealOptions) error {
+	algo, err := keyAlgo(opts.Signer.Public())
+	if err != nil {
+		return err
+	}
+
+	sets, highest, reason := collectSets(*h)
+	if highest >= MaxInstance {
+		return ErrTooManySets
+	}
+
+	cv := opts.ChainStatus
+	switch {
+	case reason != "":
+		cv = StatusFail
+	case len(sets) == 0:
+		cv = StatusNone
+	case cv != StatusPass:
+		cv = StatusFail
+	}
+	if latestSealFailed(*h, highest) {
+		return ErrChainFailed
+	}
+
+	t := opts.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	newSet := arcSet{instance: highest + 1}
+
+	newSet.authRes = FieldAuthResults + ": " + fmt.Sprintf("i=%d; ", newSet.instance) +
+		authResults(*h, opts.AuthServID) + "\r\n"
+
+	bh, err := bodyHash(canonRelaxed, body)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, key := range opts.HeaderKeys {
+		if strings.EqualFold(key, FieldSeal) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	msgSig := fmt.Sprintf("%s: i=%d; a=%s; c=relaxed/relaxed;\r\n\td=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		FieldMsgSig, newSet.instance, algo, opts.Domain, opts.Selector, t.Unix(),
+		foldList(keys), base64.StdEncoding.EncodeToString(bh))
+	hasher := sha256.New()
+	writeSignedFields(hasher, canonRelaxed, *h, keys)
+	writeSigField(hasher, canonRelaxed, msgSig)
+	sig, err := sign(opts.Signer, hasher.Sum(nil))
+	if err != nil {
+		return err
+	}
+	newSet.msgSig = msgSig + sig + "\r\n"
+
+	seal := fmt.Sprintf("%s: i=%d; a=%s; t=%d; cv=%s;\r\n\td=%s; s=%s;\r\n\tb=",
+		FieldSeal, newSet.instance, algo, t.Unix(), cv, opts.Domain, opts.Selector)
+	newSet.seal = seal
+	hasher = sha256.New()
+	if cv == StatusFail {
+		writeSealedSets(hasher, []arcSet{newSet})
+	} else {
+		writeSealedSets(hasher, append(sets, newSet))
+	}
+	sig, err = sign(opts.Signer, hasher.Sum(nil))
+	if err != nil {
+		return err
+	}
+	newSet.seal = seal + sig + "\r\n"
+
+	// Add prepends fields so the resulting order is AS, AMS, AAR.
+	h.AddRaw([]byte(newSet.authRes))
+	h.AddRaw([]byte(newSet.msgSig))
+	h.AddRaw([]byte(newSet.seal))
+
+	return nil
+}
+
+// latestSealFailed reports whether the ARC-Seal with the specified instance
+// number has cv=fail. The rest of the chain is not checked since it is
+// possible that it is broken.
+func latestSealFailed(h textproto.Header, instance int) bool {
+	fields := h.FieldsByKey(FieldSeal)
+	for fields.Next() {
+		params, err := parseTags(fields.Value())
+		if err != nil {
+			continue
+		}
+		if params["i"] == strconv.Itoa(instance) && Status(params["cv"]) == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// authResults returns the value of the topmost Authentication-Results field
+// with the specified authserv-id without the "i=" prefix.
+func authResults(h textproto.Header, authServID string) string {
+	fields := h.FieldsByKey("Authentication-Results")
+	for fields.Next() {
+		id, _, err := authres.Parse(fields.Value())
+		if err != nil || !strings.EqualFold(id, authServID) {
+			continue
+		}
+		return strings.TrimSpace(collapseWSP(unfold(fieldValue(rawField(fields)))))
+	}
+	return authServID + "; none"
+}
+
+func sign(signer crypto.Signer, hashed []byte) (string, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		// Ed25519 signs the hash directly (RFC 8463 Section 3).
+		opts = crypto.Hash(0)
+	}
+	sig, err := signer.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return "", err
+	}
+	return foldString(base64.StdEncoding.EncodeToString(sig), 70), nil
+}
+
+// foldList formats the h= tag value, folding it into multiple lines.
+func foldList(keys []string) string {
+	var (
+		b       strings.Builder
+		lineLen int
+	)
+	for i, key := range keys {
+		if i != 0 {
+			b.WriteString(":")
+			lineLen++
+		}
+		if lineLen+len(key) > 70 {
+			b.WriteString("\r\n\t")
+			lineLen = 0
+		}
+		b.WriteString(key)
+		lineLen += len(key)
+	}
+	return b.String()
+}
+
+func foldString(s string, width int) string {
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString("\r\n\t")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
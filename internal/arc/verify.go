@@ -0,0 +1,314 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// Result is the outcome of the ARC chain validation.
+type Result struct {
+	Status Status
+
+	// Instances is the amount of ARC sets in the message.
+	Instances int
+
+	// Domain is the d= value of the most recent ARC-Seal.
+	Domain string
+
+	// Reason is the human-readable explanation of the validation failure.
+	Reason string
+}
+
+// Verify validates the ARC chain in the message header as described in RFC
+// 8617 Section 5.2.
+//
+// Returned error is non-nil only if the validation can't be completed due to
+// a temporary error (e.g. DNS server failure).
+func Verify(ctx context.Context, r dns.Resolver, h textproto.Header, body io.Reader) (Result, error) {
+	sets, highest, reason := collectSets(h)
+	if reason != "" {
+		return Result{Status: StatusFail, Instances: highest, Reason: reason}, nil
+	}
+	if len(sets) == 0 {
+		return Result{Status: StatusNone}, nil
+	}
+
+	res := Result{Status: StatusFail, Instances: len(sets)}
+
+	seals := make([]map[string]string, len(sets))
+	for i, set := range sets {
+		params, err := parseTags(fieldValue(set.seal))
+		if err != nil {
+			res.Reason = fmt.Sprintf("ARC-Seal i=%d: %v", set.instance, err)
+			return res, nil
+		}
+		seals[i] = params
+	}
+	res.Domain = seals[len(seals)-1]["d"]
+
+	for i, params := range seals {
+		cv := Status(params["cv"])
+		if cv == StatusFail {
+			res.Reason = fmt.Sprintf("ARC-Seal i=%d: chain is marked as failed", i+1)
+			return res, nil
+		}
+
+		expected := StatusPass
+		if i == 0 {
+			expected = StatusNone
+		}
+		if cv != expected {
+			res.Reason = fmt.Sprintf("ARC-Seal i=%d: unexpected cv=%s", i+1, cv)
+			return res, nil
+		}
+	}
+
+	reason, err := verifyMsgSig(ctx, r, h, body, sets[len(sets)-1])
+	if err != nil {
+		return Result{}, err
+	}
+	if reason != "" {
+		res.Reason = fmt.Sprintf("ARC-Message-Signature i=%d: %s", len(sets), reason)
+		return res, nil
+	}
+
+	for i := len(sets); i >= 1; i-- {
+		reason, err := verifySeal(ctx, r, sets[:i], seals[i-1])
+		if err != nil {
+			return Result{}, err
+		}
+		if reason != "" {
+			res.Reason = fmt.Sprintf("ARC-Seal i=%d: %s", i, reason)
+			return res, nil
+		}
+	}
+
+	res.Status = StatusPass
+	return res, nil
+}
+
+func requireTags(params map[string]string, tags ...string) string {
+	for _, tag := range tags {
+		if _, ok := params[tag]; !ok {
+			return "missing " + tag + "= tag"
+		}
+	}
+	return ""
+}
+
+func parseCanon(c string) (header, body string, ok bool) {
+	if c == "" {
+		return canonSimple, canonSimple, true
+	}
+	parts := strings.SplitN(c, "/", 2)
+	header = parts[0]
+	body = canonSimple
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+	for _, c := range []string{header, body} {
+		if c != canonSimple && c != canonRelaxed {
+			return "", "", false
+		}
+	}
+	return header, body, true
+}
+
+func verifyMsgSig(ctx context.Context, r dns.Resolver, h textproto.Header, body io.Reader, set arcSet) (string, error) {
+	params, err := parseTags(fieldValue(set.msgSig))
+	if err != nil {
+		return err.Error(), nil
+	}
+	if reason := requireTags(params, "a", "b", "bh", "d", "s", "h"); reason != "" {
+		return reason, nil
+	}
+	if _, ok := params["l"]; ok {
+		return "l= tag is not allowed", nil
+	}
+	headerCanon, bodyCanon, ok := parseCanon(params["c"])
+	if !ok {
+		return "unknown canonicalization: " + params["c"], nil
+	}
+
+	keys := strings.Split(stripWSP(params["h"]), ":")
+	for _, key := range keys {
+		if strings.EqualFold(key, FieldSeal) {
+			return "ARC-Seal must not be signed", nil
+		}
+	}
+
+	expectedHash, err := base64.StdEncoding.DecodeString(stripWSP(params["bh"]))
+	if err != nil {
+		return "malformed body hash", nil
+	}
+	actualHash, err := bodyHash(bodyCanon, body)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(expectedHash, actualHash) {
+		return "body hash did not verify", nil
+	}
+
+	hasher := sha256.New()
+	writeSignedFields(hasher, headerCanon, h, keys)
+	writeSigField(hasher, headerCanon, set.msgSig)
+
+	return verifySig(ctx, r, params, hasher.Sum(nil))
+}
+
+func verifySeal(ctx context.Context, r dns.Resolver, sets []arcSet, params map[string]string) (string, error) {
+	if reason := requireTags(params, "a", "b", "cv", "d", "s"); reason != "" {
+		return reason, nil
+	}
+
+	hasher := sha256.New()
+	writeSealedSets(hasher, sets)
+	return verifySig(ctx, r, params, hasher.Sum(nil))
+}
+
+// writeSealedSets writes the data covered by the ARC-Seal of the last set in
+// the list (RFC 8617 Section 5.1.1).
+func writeSealedSets(w io.Writer, sets []arcSet) {
+	for i, set := range sets {
+		io.WriteString(w, canonHeader(canonRelaxed, set.authRes))
+		io.WriteString(w, canonHeader(canonRelaxed, set.msgSig))
+		if i == len(sets)-1 {
+			writeSigField(w, canonRelaxed, set.seal)
+		} else {
+			io.WriteString(w, canonHeader(canonRelaxed, set.seal))
+		}
+	}
+}
+
+func verifySig(ctx context.Context, r dns.Resolver, params map[string]string, hashed []byte) (string, error) {
+	algo := params["a"]
+	if algo != "rsa-sha256" && algo != "ed25519-sha256" {
+		return "unsupported algorithm: " + algo, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(stripWSP(params["b"]))
+	if err != nil {
+		return "malformed signature", nil
+	}
+
+	pub, reason, err := lookupKey(ctx, r, params["d"], params["s"])
+	if err != nil || reason != "" {
+		return reason, err
+	}
+	if keyAlgo, _ := keyAlgo(pub); keyAlgo != algo {
+		return "key type does not match the signature algorithm", nil
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig); err != nil {
+			return "signature did not verify", nil
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, hashed, sig) {
+			return "signature did not verify", nil
+		}
+	}
+	return "", nil
+}
+
+func lookupKey(ctx context.Context, r dns.Resolver, domain, selector string) (crypto.PublicKey, string, error) {
+	if domain == "" || selector == "" {
+		return nil, "empty domain or selector", nil
+	}
+
+	txts, err := r.LookupTXT(ctx, dns.FQDN(selector+"._domainkey."+domain))
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, "no key for signature", nil
+		}
+		return nil, "", err
+	}
+	if len(txts) == 0 {
+		return nil, "no key for signature", nil
+	}
+
+	var lastErr error
+	for _, txt := range txts {
+		pub, err := parseKey(txt)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return pub, "", nil
+	}
+	return nil, "malformed key record: " + lastErr.Error(), nil
+}
+
+func parseKey(txt string) (crypto.PublicKey, error) {
+	params, err := parseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := params["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported version: %s", v)
+	}
+	p := stripWSP(params["p"])
+	if p == "" {
+		return nil, errors.New("key is revoked")
+	}
+	blob, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed public key")
+	}
+
+	switch k := params["k"]; k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(blob)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(blob)
+			if err != nil {
+				return nil, errors.New("malformed RSA public key")
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not a RSA public key")
+		}
+		if rsaPub.Size()*8 < 1024 {
+			return nil, errors.New("RSA key is too short")
+		}
+		return rsaPub, nil
+	case "ed25519":
+		if len(blob) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed Ed25519 public key")
+		}
+		return ed25519.PublicKey(blob), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k)
+	}
+}
@@ -51,3 +51,22 @@ func CheckDomainAuth(username string, perDomain bool, allowedDomains []string) (
 
 	return accountName, allowed
 }
+
+// SystemUsername converts the login name into the system account name using
+// the domain suffix. If domain is empty, username is returned as is.
+// Otherwise, username should be in the local@domain form, with domain
+// matching case-insensitively, and the local part is returned.
+func SystemUsername(username, domain string) (string, bool) {
+	if domain == "" {
+		return username, true
+	}
+
+	idx := strings.LastIndexByte(username, '@')
+	if idx == -1 || idx == 0 {
+		return "", false
+	}
+	if !strings.EqualFold(username[idx+1:], domain) {
+		return "", false
+	}
+	return username[:idx], true
+}
@@ -20,7 +20,13 @@ package auth
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
 )
 
 func TestCheckDomainAuth(t *testing.T) {
@@ -91,3 +97,171 @@ func TestCheckDomainAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestSystemUsername(t *testing.T) {
+	cases := []struct {
+		username string
+		domain   string
+		sysName  string
+		ok       bool
+	}{
+		{"user", "", "user", true},
+		{"user@example.org", "", "user@example.org", true},
+		{"user@example.org", "example.org", "user", true},
+		{"user@EXAMPLE.org", "example.org", "user", true},
+		{"user@example.com", "example.org", "", false},
+		{"user", "example.org", "", false},
+		{"@example.org", "example.org", "", false},
+	}
+	for _, case_ := range cases {
+		sysName, ok := SystemUsername(case_.username, case_.domain)
+		if sysName != case_.sysName || ok != case_.ok {
+			t.Errorf("SystemUsername(%q, %q) = %q, %v; want %q, %v",
+				case_.username, case_.domain, sysName, ok, case_.sysName, case_.ok)
+		}
+	}
+}
+
+func TestCredsCache(t *testing.T) {
+	c, err := NewCredsCache(time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Check("user", "pass") {
+		t.Fatal("Empty cache reports a hit")
+	}
+	c.Add("user", "pass")
+	if !c.Check("user", "pass") {
+		t.Fatal("Cached credentials are not accepted")
+	}
+	if c.Check("user", "wrong") {
+		t.Fatal("Wrong password is accepted")
+	}
+	if c.Check("user2", "pass") {
+		t.Fatal("Credentials of other user are accepted")
+	}
+	c.Remove("user")
+	if c.Check("user", "pass") {
+		t.Fatal("Removed credentials are accepted")
+	}
+
+	c.Add("user", "pass")
+	c.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if c.Check("user", "pass") {
+		t.Fatal("Expired credentials are accepted")
+	}
+}
+
+func TestCredsCache_Negative(t *testing.T) {
+	c, err := NewCredsCache(time.Minute, 10*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AddCanonical("User", "pass", "user")
+	c.AddFailure("User", "wrong")
+	if res, canonical := c.Lookup("User", "pass"); res != CredsCacheHit || canonical != "user" {
+		t.Fatal("Unexpected lookup result:", res, canonical)
+	}
+	if res, _ := c.Lookup("User", "wrong"); res != CredsCacheNegativeHit {
+		t.Fatal("Unexpected lookup result for failure:", res)
+	}
+	if res, _ := c.Lookup("User", "other"); res != CredsCacheMiss {
+		t.Fatal("Unexpected lookup result for unknown password:", res)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(30 * time.Second) }
+	if res, _ := c.Lookup("User", "wrong"); res != CredsCacheMiss {
+		t.Fatal("Negative entry is not expired:", res)
+	}
+	if res, _ := c.Lookup("User", "pass"); res != CredsCacheHit {
+		t.Fatal("Positive entry is expired too early:", res)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.NegativeHits != 1 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestCredsCache_LRU(t *testing.T) {
+	c, err := NewCredsCache(time.Minute, time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Add("user1", "pass")
+	c.Add("user2", "pass")
+	c.AddFailure("user3", "pass")
+	// Make user1 most recently used.
+	c.Check("user1", "pass")
+	c.Add("user4", "pass")
+
+	if !c.Check("user1", "pass") {
+		t.Error("Recently used entry is evicted")
+	}
+	if c.Check("user2", "pass") {
+		t.Error("Least recently used entry is not evicted")
+	}
+	if res, _ := c.Lookup("user3", "pass"); res != CredsCacheNegativeHit {
+		t.Error("Negative entry is evicted")
+	}
+	if !c.Check("user4", "pass") {
+		t.Error("New entry is not added")
+	}
+}
+
+func TestCredsCache_Invalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldState := config.StateDirectory
+	config.StateDirectory = dir
+	defer func() { config.StateDirectory = oldState }()
+
+	if err := InvalidateCachedCreds("user1"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCredsCache(time.Minute, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add("user1", "pass")
+	c.Add("user2", "pass")
+	c.AddFailure("user2", "wrong")
+	if !c.Check("user1", "pass") {
+		t.Fatal("Invalidation made before the cache creation is applied")
+	}
+
+	if err := InvalidateCachedCreds("user2"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Check("user2", "pass") {
+		t.Fatal("Invalidated credentials are accepted")
+	}
+	if res, _ := c.Lookup("user2", "wrong"); res != CredsCacheMiss {
+		t.Fatal("Invalidated negative entry is not removed")
+	}
+	if !c.Check("user1", "pass") {
+		t.Fatal("Credentials of other user are invalidated")
+	}
+
+	// Compacted file is re-read from the start.
+	if err := compactInvalidations(filepath.Join(dir, credsInvalidateFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := InvalidateCachedCreds("user3"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Check("user1", "pass") {
+		t.Fatal("Invalidation is not applied after compaction")
+	}
+
+	if err := InvalidateCachedCreds("user\nfoo"); err == nil {
+		t.Fatal("Username with line break is accepted")
+	}
+}
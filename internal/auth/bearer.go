@@ -0,0 +1,242 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of the SASL mechanism used by Google and Microsoft
+// to pass OAuth 2.0 bearer tokens. It predates OAUTHBEARER (RFC 7628) and
+// is still more widely supported by clients.
+const XOAuth2 = "XOAUTH2"
+
+// IsBearerMech reports whether the SASL mechanism passes OAuth 2.0 bearer
+// tokens. Such mechanisms should be offered only over TLS since tokens can
+// be replayed.
+func IsBearerMech(mech string) bool {
+	return mech == sasl.OAuthBearer || mech == XOAuth2
+}
+
+// AuthBearer checks the bearer token using the configured providers and
+// returns the username the token was issued for.
+//
+// If username is not empty, it should match the one the token was issued for
+// (case-insensitive).
+func (s *SASLAuth) AuthBearer(username, token string) (string, error) {
+	if len(s.Bearer) == 0 {
+		return "", ErrUnsupportedMech
+	}
+
+	var lastErr error
+	for _, p := range s.Bearer {
+		identity, err := p.AuthBearer(token)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if username != "" && !strings.EqualFold(username, identity) {
+			return "", fmt.Errorf("token was issued for a different user: %s", identity)
+		}
+		return identity, nil
+	}
+
+	return "", fmt.Errorf("no auth. provider accepted token, last err: %w", lastErr)
+}
+
+// AuthBearerFrom is similar to AuthBearer but also applies the
+// authentication failures rate limiting for the client address.
+func (s *SASLAuth) AuthBearerFrom(remoteAddr net.Addr, username, token string) (string, error) {
+	return s.Throttled(remoteAddr, username, func() (string, error) {
+		return s.AuthBearer(username, token)
+	})
+}
+
+// bearerServer implements the server side of OAUTHBEARER (RFC 7628) and
+// XOAUTH2 mechanisms.
+//
+// go-sasl has the OAUTHBEARER server implementation, but it does not accept
+// the empty authorization identity and does not support XOAUTH2.
+type bearerServer struct {
+	mech         string
+	authenticate func(username, token string) error
+
+	done    bool
+	failErr error
+}
+
+func newBearerServer(mech string, authenticate func(username, token string) error) sasl.Server {
+	return &bearerServer{mech: mech, authenticate: authenticate}
+}
+
+// errorBlob returns the JSON error the client is expected to acknowledge
+// before the failure is reported by the protocol.
+func (s *bearerServer) errorBlob(invalidRequest bool) []byte {
+	var status string
+	switch {
+	case s.mech == XOAuth2 && invalidRequest:
+		status = "400"
+	case s.mech == XOAuth2:
+		status = "401"
+	case invalidRequest:
+		status = "invalid_request"
+	default:
+		status = "invalid_token"
+	}
+
+	blob, err := json.Marshal(sasl.OAuthBearerError{
+		Status:  status,
+		Schemes: "bearer",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return blob
+}
+
+func (s *bearerServer) fail(err error, invalidRequest bool) ([]byte, bool, error) {
+	s.failErr = err
+	return s.errorBlob(invalidRequest), false, nil
+}
+
+func (s *bearerServer) Next(response []byte) ([]byte, bool, error) {
+	if s.failErr != nil {
+		// The client is expected to send the dummy response (0x01 for
+		// OAUTHBEARER and the empty one for XOAUTH2), it does not matter
+		// what it actually sends.
+		return nil, true, s.failErr
+	}
+	if s.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	// Request the initial response.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	s.done = true
+
+	var (
+		username, token string
+		err             error
+	)
+	if s.mech == XOAuth2 {
+		username, token, err = parseXOAuth2(response)
+	} else {
+		username, token, err = parseOAuthBearer(response)
+	}
+	if err != nil {
+		return s.fail(ErrInvalidCredentials, true)
+	}
+
+	if err := s.authenticate(username, token); err != nil {
+		return s.fail(err, false)
+	}
+	return nil, true, nil
+}
+
+// parseBearer extracts the token from the "Bearer <token>" value.
+func parseBearer(value string) (string, error) {
+	const prefix = "bearer "
+	if len(value) <= len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", errors.New("unsupported token type")
+	}
+	return value[len(prefix):], nil
+}
+
+// parseXOAuth2 parses the XOAUTH2 initial response:
+//
+//	user=<username>\x01auth=Bearer <token>\x01\x01
+func parseXOAuth2(response []byte) (username, token string, err error) {
+	for _, p := range bytes.Split(response, []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+		kv := strings.SplitN(string(p), "=", 2)
+		if len(kv) != 2 {
+			return "", "", errors.New("malformed response")
+		}
+		switch kv[0] {
+		case "user":
+			username = kv[1]
+		case "auth":
+			token, err = parseBearer(kv[1])
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	if token == "" {
+		return "", "", errors.New("missing token")
+	}
+	return username, token, nil
+}
+
+// parseOAuthBearer parses the OAUTHBEARER initial response (RFC 7628 Section
+// 3.1):
+//
+//	n,a=<username>,\x01host=...\x01port=...\x01auth=Bearer <token>\x01\x01
+//
+// The authorization identity is optional.
+func parseOAuthBearer(response []byte) (username, token string, err error) {
+	parts := bytes.SplitN(response, []byte{','}, 3)
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed response")
+	}
+	// Channel binding is not supported, but the client may use it if it
+	// thinks the server does not support it ('y').
+	if string(parts[0]) != "n" && string(parts[0]) != "y" {
+		return "", "", errors.New("channel binding is not supported")
+	}
+	if len(parts[1]) != 0 {
+		if !bytes.HasPrefix(parts[1], []byte("a=")) {
+			return "", "", errors.New("malformed authorization identity")
+		}
+		username = string(parts[1][2:])
+		// RFC 5801 Section 4, saslname escaping.
+		username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(username)
+	}
+
+	for _, p := range bytes.Split(parts[2], []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+		kv := strings.SplitN(string(p), "=", 2)
+		if len(kv) != 2 {
+			return "", "", errors.New("malformed response")
+		}
+		if kv[0] == "auth" {
+			token, err = parseBearer(kv[1])
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	if token == "" {
+		return "", "", errors.New("missing token")
+	}
+	return username, token, nil
+}
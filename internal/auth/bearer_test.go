@@ -0,0 +1,107 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockBearer struct{}
+
+func (mockBearer) AuthBearer(token string) (string, error) {
+	if token == "valid" {
+		return "user@example.org", nil
+	}
+	return "", module.ErrUnknownCredentials
+}
+
+func TestCreateSASL_Bearer(t *testing.T) {
+	a := SASLAuth{
+		Log:    testutils.Logger(t, "saslauth"),
+		Bearer: []module.BearerAuth{mockBearer{}},
+	}
+
+	mechs := a.SASLMechanisms()
+	if len(mechs) != 2 || mechs[0] != sasl.OAuthBearer || mechs[1] != XOAuth2 {
+		t.Fatal("Wrong mechanisms:", mechs)
+	}
+
+	test := func(mech, response, expectedID string) {
+		t.Helper()
+		var identity string
+		srv := a.CreateSASL(mech, &net.TCPAddr{}, func(id string) error {
+			identity = id
+			return nil
+		})
+
+		challenge, done, err := srv.Next(nil)
+		if err != nil || done || len(challenge) != 0 {
+			t.Fatal("Unexpected initial challenge:", challenge, done, err)
+		}
+
+		challenge, done, err = srv.Next([]byte(response))
+		if expectedID != "" {
+			if err != nil || !done {
+				t.Fatal("Unexpected error:", err)
+			}
+			if identity != expectedID {
+				t.Fatal("Wrong identity:", identity)
+			}
+			return
+		}
+
+		if err != nil || done {
+			t.Fatal("Expected the error challenge, got", err)
+		}
+		var blob sasl.OAuthBearerError
+		if err := json.Unmarshal(challenge, &blob); err != nil {
+			t.Fatal("Malformed error challenge:", err)
+		}
+		if blob.Status == "" || blob.Schemes != "bearer" {
+			t.Fatal("Wrong error challenge:", string(challenge))
+		}
+		if identity != "" {
+			t.Fatal("Callback called for failed authentication")
+		}
+
+		_, done, err = srv.Next([]byte{0x01})
+		if err != ErrInvalidCredentials || !done {
+			t.Fatal("Expected ErrInvalidCredentials, got", err)
+		}
+	}
+
+	test(sasl.OAuthBearer, "n,a=user@example.org,\x01host=mx.example.org\x01port=993\x01auth=Bearer valid\x01\x01", "user@example.org")
+	test(sasl.OAuthBearer, "n,,\x01auth=Bearer valid\x01\x01", "user@example.org")
+	test(sasl.OAuthBearer, "n,,\x01auth=Bearer invalid\x01\x01", "")
+	test(sasl.OAuthBearer, "n,a=admin@example.org,\x01auth=Bearer valid\x01\x01", "")
+	test(sasl.OAuthBearer, "p=tls-unique,,\x01auth=Bearer valid\x01\x01", "")
+	test(sasl.OAuthBearer, "garbage", "")
+
+	test(XOAuth2, "user=user@example.org\x01auth=Bearer valid\x01\x01", "user@example.org")
+	test(XOAuth2, "user=User@Example.org\x01auth=Bearer valid\x01\x01", "user@example.org")
+	test(XOAuth2, "user=user@example.org\x01auth=Bearer invalid\x01\x01", "")
+	test(XOAuth2, "user=admin@example.org\x01auth=Bearer valid\x01\x01", "")
+	test(XOAuth2, "user=user@example.org\x01auth=Basic dXNlcjpwYXNz\x01\x01", "")
+}
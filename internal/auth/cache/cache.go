@@ -0,0 +1,161 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cache implements the auth.cache module that remembers results of
+// the wrapped authentication provider.
+package cache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const modName = "auth.cache"
+
+var lookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "auth_cache",
+		Name:      "lookups",
+		Help:      "Credentials cache lookups",
+	},
+	[]string{"module", "result"},
+)
+
+type Cache struct {
+	instName string
+	log      log.Logger
+
+	backend module.PlainAuth
+	cache   *auth.CredsCache
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Cache{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Cache) Name() string {
+	return modName
+}
+
+func (c *Cache) InstanceName() string {
+	return c.instName
+}
+
+func (c *Cache) Init(cfg *config.Map) error {
+	var (
+		ttl, negativeTTL time.Duration
+		maxEntries       int
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("auth", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var backend module.PlainAuth
+		err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &backend)
+		return backend, err
+	}, &c.backend)
+	cfg.Duration("ttl", false, false, 5*time.Minute, &ttl)
+	cfg.Duration("negative_ttl", false, false, 30*time.Second, &negativeTTL)
+	cfg.Int("max_entries", false, false, auth.DefaultCredsCacheMaxEntries, &maxEntries)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if maxEntries <= 0 {
+		return fmt.Errorf("%s: max_entries should be positive", modName)
+	}
+
+	var err error
+	c.cache, err = auth.NewCredsCache(ttl, negativeTTL, maxEntries)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+func (c *Cache) AuthPlain(username, password string) error {
+	_, err := c.AuthPlainCanonical(username, password)
+	return err
+}
+
+func (c *Cache) AuthPlainCanonical(username, password string) (string, error) {
+	return c.AuthPlainService("", username, password)
+}
+
+// AuthPlainService is similar to AuthPlainCanonical but caches results
+// separately for each service since the wrapped provider can accept some
+// credentials only for specific services.
+func (c *Cache) AuthPlainService(service, username, password string) (string, error) {
+	// The service is made a part of the hashed value.
+	cacheKey := service + "\x00" + password
+
+	res, canonical := c.cache.Lookup(username, cacheKey)
+	switch res {
+	case auth.CredsCacheHit:
+		lookups.WithLabelValues(c.instName, "hit").Inc()
+		c.log.DebugMsg("cache hit", "username", username)
+		return canonical, nil
+	case auth.CredsCacheNegativeHit:
+		lookups.WithLabelValues(c.instName, "negative_hit").Inc()
+		c.log.DebugMsg("negative cache hit", "username", username)
+		return "", module.ErrUnknownCredentials
+	}
+	lookups.WithLabelValues(c.instName, "miss").Inc()
+	c.log.DebugMsg("cache miss", "username", username)
+
+	canonical, err := c.authBackend(service, username, password)
+	if err != nil {
+		// Backend failures should not lock out the user.
+		if !exterrors.IsTemporary(err) {
+			c.cache.AddFailure(username, cacheKey)
+		}
+		return "", err
+	}
+	c.cache.AddCanonical(username, cacheKey, canonical)
+	return canonical, nil
+}
+
+func (c *Cache) authBackend(service, username, password string) (string, error) {
+	if serviceAuth, ok := c.backend.(module.ServicePlainAuth); ok {
+		return serviceAuth.AuthPlainService(service, username, password)
+	}
+	if canonAuth, ok := c.backend.(module.CanonicalPlainAuth); ok {
+		return canonAuth.AuthPlainCanonical(username, password)
+	}
+	if err := c.backend.AuthPlain(username, password); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func init() {
+	prometheus.MustRegister(lookups)
+	module.Register(modName, New)
+}
@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type countingAuth struct {
+	calls int
+	err   error
+}
+
+func (c *countingAuth) AuthPlain(username, password string) error {
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+	if password != "pass" {
+		return module.ErrUnknownCredentials
+	}
+	return nil
+}
+
+func testCache(t *testing.T, backend module.PlainAuth) *Cache {
+	t.Helper()
+
+	credsCache, err := auth.NewCredsCache(time.Minute, 10*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Cache{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		backend:  backend,
+		cache:    credsCache,
+	}
+}
+
+func TestCache(t *testing.T) {
+	backend := &countingAuth{}
+	c := testCache(t, backend)
+
+	for i := 0; i < 3; i++ {
+		if err := c.AuthPlain("user", "pass"); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if backend.calls != 1 {
+		t.Fatal("Successful result is not cached, backend calls:", backend.calls)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.AuthPlain("user", "wrong"); !errors.Is(err, module.ErrUnknownCredentials) {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if backend.calls != 2 {
+		t.Fatal("Failure is not cached, backend calls:", backend.calls)
+	}
+}
+
+func TestCache_TemporaryError(t *testing.T) {
+	backend := &countingAuth{err: exterrors.WithTemporary(errors.New("backend is down"), true)}
+	c := testCache(t, backend)
+
+	if err := c.AuthPlain("user", "pass"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	backend.err = nil
+	if err := c.AuthPlain("user", "pass"); err != nil {
+		t.Fatal("Temporary error is cached:", err)
+	}
+	if backend.calls != 2 {
+		t.Fatal("Unexpected backend calls:", backend.calls)
+	}
+}
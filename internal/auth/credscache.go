@@ -0,0 +1,388 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+const (
+	// DefaultCredsCacheMaxEntries is the default limit for the amount of
+	// cached authentication results. Least recently used entries are evicted
+	// once it is reached.
+	DefaultCredsCacheMaxEntries = 10000
+
+	// credsInvalidateFile is the name of the file in the state directory
+	// usernames are appended to by InvalidateCachedCreds.
+	credsInvalidateFile = "auth_cache_invalidate"
+
+	// credsInvalidateMaxSize is the size of the invalidation file after
+	// which it is compacted by InvalidateCachedCreds.
+	credsInvalidateMaxSize = 256 * 1024
+
+	// credsInvalidateKeep is how long lines are kept in the invalidation
+	// file during the compaction. Running instances check the file on each
+	// lookup so it should not matter much.
+	credsInvalidateKeep = 24 * time.Hour
+)
+
+// CredsCacheResult is the result of CredsCache.Lookup.
+type CredsCacheResult int
+
+const (
+	// CredsCacheMiss means there is no cached result for the credentials.
+	CredsCacheMiss CredsCacheResult = iota
+	// CredsCacheHit means the credentials were successfully verified
+	// recently.
+	CredsCacheHit
+	// CredsCacheNegativeHit means the credentials were rejected recently.
+	CredsCacheNegativeHit
+)
+
+type credsCacheEntry struct {
+	key       [sha256.Size]byte
+	username  string
+	canonical string
+	ok        bool
+	expires   time.Time
+}
+
+// CredsCacheStats contains the CredsCache counters.
+type CredsCacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Entries      int
+}
+
+// CredsCache remembers recent authentication results to avoid calling
+// expensive authentication backends for each connection.
+//
+// Passwords are not stored, entries are keyed by salted hashes of the
+// username and password pair. The salt is random for each CredsCache
+// instance. The amount of entries is limited, least recently used ones
+// are evicted first.
+//
+// Entries for the user are dropped if its credentials are changed using
+// maddyctl, see InvalidateCachedCreds.
+type CredsCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	salt        [32]byte
+
+	lck     sync.Mutex
+	lru     *list.List
+	entries map[[sha256.Size]byte]*list.Element
+	stats   CredsCacheStats
+
+	invalidatePath   string
+	invalidateFile   os.FileInfo
+	invalidateOffset int64
+
+	now func() time.Time
+}
+
+// NewCredsCache creates the cache keeping successful authentications for
+// ttl and failed ones for negativeTTL. Zero ttl or negativeTTL disables
+// caching of the corresponding results. If maxEntries is 0,
+// DefaultCredsCacheMaxEntries is used.
+func NewCredsCache(ttl, negativeTTL time.Duration, maxEntries int) (*CredsCache, error) {
+	if maxEntries == 0 {
+		maxEntries = DefaultCredsCacheMaxEntries
+	}
+	c := &CredsCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		lru:         list.New(),
+		entries:     make(map[[sha256.Size]byte]*list.Element),
+		now:         time.Now,
+	}
+	if _, err := rand.Read(c.salt[:]); err != nil {
+		return nil, err
+	}
+
+	if config.StateDirectory != "" {
+		c.invalidatePath = filepath.Join(config.StateDirectory, credsInvalidateFile)
+		// Only invalidations made after the start are relevant.
+		if fi, err := os.Stat(c.invalidatePath); err == nil {
+			c.invalidateFile = fi
+			c.invalidateOffset = fi.Size()
+		}
+	}
+
+	return c, nil
+}
+
+func (c *CredsCache) hash(username, password string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(c.salt[:])
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Lookup returns the cached authentication result for the credentials. For
+// CredsCacheHit, the canonical username passed to AddCanonical is also
+// returned.
+func (c *CredsCache) Lookup(username, password string) (CredsCacheResult, string) {
+	if c.ttl == 0 && c.negativeTTL == 0 {
+		return CredsCacheMiss, ""
+	}
+
+	key := c.hash(username, password)
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	c.checkInvalidations()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return CredsCacheMiss, ""
+	}
+	ent := elem.Value.(*credsCacheEntry)
+	if c.now().After(ent.expires) {
+		c.remove(elem)
+		c.stats.Misses++
+		return CredsCacheMiss, ""
+	}
+	c.lru.MoveToFront(elem)
+
+	if !ent.ok {
+		c.stats.NegativeHits++
+		return CredsCacheNegativeHit, ""
+	}
+	c.stats.Hits++
+	return CredsCacheHit, ent.canonical
+}
+
+// Check reports whether the credentials were successfully verified within
+// the TTL.
+func (c *CredsCache) Check(username, password string) bool {
+	res, _ := c.Lookup(username, password)
+	return res == CredsCacheHit
+}
+
+// Add records successful authentication.
+func (c *CredsCache) Add(username, password string) {
+	c.AddCanonical(username, password, username)
+}
+
+// AddCanonical records successful authentication along with the canonical
+// username reported by the authentication provider.
+func (c *CredsCache) AddCanonical(username, password, canonical string) {
+	if c.ttl == 0 {
+		return
+	}
+	c.add(&credsCacheEntry{
+		key:       c.hash(username, password),
+		username:  username,
+		canonical: canonical,
+		ok:        true,
+		expires:   c.now().Add(c.ttl),
+	})
+}
+
+// AddFailure records failed authentication.
+func (c *CredsCache) AddFailure(username, password string) {
+	if c.negativeTTL == 0 {
+		return
+	}
+	c.add(&credsCacheEntry{
+		key:      c.hash(username, password),
+		username: username,
+		expires:  c.now().Add(c.negativeTTL),
+	})
+}
+
+func (c *CredsCache) add(ent *credsCacheEntry) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if elem, ok := c.entries[ent.key]; ok {
+		elem.Value = ent
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	c.entries[ent.key] = c.lru.PushFront(ent)
+}
+
+func (c *CredsCache) remove(elem *list.Element) {
+	ent := c.lru.Remove(elem).(*credsCacheEntry)
+	delete(c.entries, ent.key)
+}
+
+// Remove drops cached results for the user.
+func (c *CredsCache) Remove(username string) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.removeUser(username)
+}
+
+func (c *CredsCache) removeUser(username string) {
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*credsCacheEntry).username == username {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// Stats returns the current values of counters.
+func (c *CredsCache) Stats() CredsCacheStats {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// checkInvalidations reads usernames added to the invalidation file since
+// the last check and drops their entries. c.lck should be held.
+func (c *CredsCache) checkInvalidations() {
+	if c.invalidatePath == "" {
+		return
+	}
+
+	fi, err := os.Stat(c.invalidatePath)
+	if err != nil {
+		return
+	}
+	sameFile := c.invalidateFile != nil && os.SameFile(fi, c.invalidateFile)
+	if sameFile && fi.Size() == c.invalidateOffset {
+		return
+	}
+	if !sameFile || fi.Size() < c.invalidateOffset {
+		// The file was compacted, re-reading it is harmless.
+		c.invalidateOffset = 0
+	}
+
+	f, err := os.Open(c.invalidatePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(c.invalidateOffset, io.SeekStart); err != nil {
+		return
+	}
+
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			// Incomplete line is read again next time.
+			break
+		}
+		c.invalidateOffset += int64(len(line))
+
+		parts := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		c.removeUser(parts[1])
+	}
+	c.invalidateFile = fi
+}
+
+// InvalidateCachedCreds asks CredsCache instances in the running server to
+// drop cached authentication results for the user. It should be called
+// after the user credentials are changed.
+//
+// config.StateDirectory should be set.
+func InvalidateCachedCreds(username string) error {
+	if config.StateDirectory == "" {
+		return errors.New("auth: state directory is not set")
+	}
+	if strings.ContainsAny(username, "\r\n") {
+		return errors.New("auth: username can't contain line breaks")
+	}
+	path := filepath.Join(config.StateDirectory, credsInvalidateFile)
+
+	if fi, err := os.Stat(path); err == nil && fi.Size() > credsInvalidateMaxSize {
+		if err := compactInvalidations(path); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %s\n", time.Now().Unix(), username); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compactInvalidations rewrites the invalidation file keeping only recent
+// lines.
+func compactInvalidations(path string) error {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	threshold := time.Now().Add(-credsInvalidateKeep).Unix()
+	for _, line := range strings.SplitAfter(string(blob), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || !strings.HasSuffix(line, "\n") {
+			continue
+		}
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || ts < threshold {
+			continue
+		}
+		sb.WriteString(line)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(sb.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -19,27 +19,27 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package dovecotsasl
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"time"
 
-	"github.com/emersion/go-sasl"
-	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
-	"github.com/foxcpp/maddy/internal/auth"
 )
 
 type Auth struct {
 	instName       string
 	serverEndpoint string
+	userdbEndpoint string
+	service        string
 	log            log.Logger
 
-	network string
-	addr    string
-
-	mechanisms map[string]dovecotsasl.Mechanism
+	auth   *connPool
+	userdb *connPool
 }
 
 const modName = "dovecot_sasl"
@@ -69,93 +69,147 @@ func (a *Auth) InstanceName() string {
 	return a.instName
 }
 
-func (a *Auth) getConn() (*dovecotsasl.Client, error) {
-	// TODO: Connection pooling
-	conn, err := net.Dial(a.network, a.addr)
+func parseEndpoint(s string) (config.Endpoint, error) {
+	endp, err := config.ParseEndpoint(s)
 	if err != nil {
-		return nil, fmt.Errorf("%s: unable to contact server: %v", modName, err)
+		return config.Endpoint{}, err
 	}
-
-	cl, err := dovecotsasl.NewClient(conn)
-	if err != nil {
-		return nil, fmt.Errorf("%s: unable to contact server: %v", modName, err)
+	switch endp.Scheme {
+	case "unix":
+	case "tcp":
+		if endp.Path != "" {
+			return config.Endpoint{}, fmt.Errorf("unexpected path in endpoint")
+		}
+	default:
+		return config.Endpoint{}, fmt.Errorf("unsupported scheme: %s", endp.Scheme)
 	}
-
-	return cl, nil
-}
-
-func (a *Auth) returnConn(cl *dovecotsasl.Client) {
-	cl.Close()
+	return endp, nil
 }
 
 func (a *Auth) Init(cfg *config.Map) error {
+	var (
+		timeout time.Duration
+		maxIdle int
+	)
 	cfg.String("endpoint", false, false, a.serverEndpoint, &a.serverEndpoint)
+	cfg.String("userdb_endpoint", false, false, "", &a.userdbEndpoint)
+	cfg.String("service", false, false, "smtp", &a.service)
+	cfg.Duration("timeout", false, false, 30*time.Second, &timeout)
+	cfg.Int("max_idle_conns", false, false, 4, &maxIdle)
+	cfg.Bool("debug", true, false, &a.log.Debug)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
-	if a.serverEndpoint == "" {
+	if a.serverEndpoint == "" && a.userdbEndpoint == "" {
 		return fmt.Errorf("%s: missing server endpoint", modName)
 	}
 
-	endp, err := config.ParseEndpoint(a.serverEndpoint)
-	if err != nil {
-		return fmt.Errorf("%s: invalid server endpoint: %v", modName, err)
+	if a.serverEndpoint != "" {
+		endp, err := parseEndpoint(a.serverEndpoint)
+		if err != nil {
+			return fmt.Errorf("%s: invalid server endpoint: %v", modName, err)
+		}
+		a.auth = newConnPool(endp.Scheme, endp.Address(), timeout, maxIdle, func(conn net.Conn) (io.Closer, error) {
+			return newAuthConn(conn, timeout)
+		})
+
+		// Dial once to check usability. The server can be started after
+		// maddy so the failure is not fatal.
+		if !config.CheckOnly {
+			c, err := a.auth.get()
+			if err != nil {
+				a.log.Error("unable to contact server, will retry later", err, "endpoint", a.serverEndpoint)
+			} else {
+				a.auth.put(c)
+			}
+		}
 	}
-	if endp.Path == "" {
-		return fmt.Errorf("%s: unexpected path in endpoint ", modName)
+
+	if a.userdbEndpoint != "" {
+		endp, err := parseEndpoint(a.userdbEndpoint)
+		if err != nil {
+			return fmt.Errorf("%s: invalid userdb endpoint: %v", modName, err)
+		}
+		a.userdb = newConnPool(endp.Scheme, endp.Address(), timeout, maxIdle, func(conn net.Conn) (io.Closer, error) {
+			return newUserdbConn(conn, timeout)
+		})
 	}
 
-	// Dial once to check usability and also to get list of mechanisms.
-	conn, err := net.Dial(endp.Scheme, endp.Address())
-	if err != nil {
-		return fmt.Errorf("%s: unable to contact server: %v", modName, err)
+	return nil
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	_, err := a.AuthPlainCanonical(username, password)
+	return err
+}
+
+// AuthPlainCanonical verifies the credentials using Dovecot and returns the
+// username reported by it (that is, after all passdb transformations).
+func (a *Auth) AuthPlainCanonical(username, password string) (string, error) {
+	if a.auth == nil {
+		return "", fmt.Errorf("%s: endpoint is not configured, authentication is not possible", modName)
 	}
 
-	cl, err := dovecotsasl.NewClient(conn)
+	c, err := a.auth.get()
 	if err != nil {
-		return fmt.Errorf("%s: unable to contact server: %v", modName, err)
+		return "", exterrors.WithTemporary(fmt.Errorf("%s: unable to contact server: %w", modName, err), true)
 	}
+	conn := c.(*authConn)
 
-	defer cl.Close()
-	a.mechanisms = make(map[string]dovecotsasl.Mechanism, len(cl.ConnInfo().Mechs))
-	for name, mech := range cl.ConnInfo().Mechs {
-		if mech.Private {
-			continue
+	canonical, err := conn.auth(a.service, username, password)
+	if err != nil {
+		var fail serverFail
+		if errors.As(err, &fail) {
+			a.auth.put(conn)
+			return "", fail.err
 		}
-		a.mechanisms[name] = mech
+		conn.Close()
+		return "", exterrors.WithTemporary(fmt.Errorf("%s: %w", modName, err), true)
 	}
+	a.auth.put(conn)
 
-	a.network = endp.Scheme
-	a.addr = endp.Address()
-
-	return nil
+	if canonical != username {
+		a.log.DebugMsg("username changed by server", "username", username, "canonical", canonical)
+	}
+	return canonical, nil
 }
 
-func (a *Auth) AuthPlain(username, password string) error {
-	if _, ok := a.mechanisms[sasl.Plain]; ok {
-		cl, err := a.getConn()
-		if err != nil {
-			return exterrors.WithTemporary(err, true)
-		}
-		defer a.returnConn(cl)
+// Lookup checks whether the user exists using the userdb socket. The
+// username returned by the server is used as a value.
+func (a *Auth) Lookup(username string) (string, bool, error) {
+	if a.userdb == nil {
+		return "", false, fmt.Errorf("%s: userdb_endpoint is not configured, lookups are not possible", modName)
+	}
 
-		// Pretend it is SMTPS even though we really don't know.
-		// We also have no connection information to pass to the server...
-		return cl.Do("SMTP", sasl.NewPlainClient("", username, password),
-			dovecotsasl.Secured, dovecotsasl.NoPenalty)
+	c, err := a.userdb.get()
+	if err != nil {
+		return "", false, exterrors.WithTemporary(fmt.Errorf("%s: unable to contact userdb: %w", modName, err), true)
 	}
-	if _, ok := a.mechanisms[sasl.Login]; ok {
-		cl, err := a.getConn()
-		if err != nil {
-			return err
-		}
-		defer a.returnConn(cl)
+	conn := c.(*userdbConn)
 
-		return cl.Do("SMTP", sasl.NewLoginClient(username, password),
-			dovecotsasl.Secured, dovecotsasl.NoPenalty)
+	canonical, ok, err := conn.lookup(a.service, username)
+	if err != nil {
+		var fail serverFail
+		if errors.As(err, &fail) {
+			a.userdb.put(conn)
+			return "", false, fail.err
+		}
+		conn.Close()
+		return "", false, exterrors.WithTemporary(fmt.Errorf("%s: %w", modName, err), true)
 	}
+	a.userdb.put(conn)
 
-	return auth.ErrUnsupportedMech
+	return canonical, ok, nil
+}
+
+func (a *Auth) Close() error {
+	if a.auth != nil {
+		a.auth.Close()
+	}
+	if a.userdb != nil {
+		a.userdb.Close()
+	}
+	return nil
 }
 
 func init() {
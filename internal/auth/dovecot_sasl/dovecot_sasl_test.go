@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dovecotsasl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockServer struct {
+	l     net.Listener
+	conns int32
+}
+
+func (s *mockServer) endpoint() string {
+	return "tcp://" + s.l.Addr().String()
+}
+
+func startMockServer(t *testing.T, handle func(conn net.Conn)) *mockServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &mockServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func authServer(conn net.Conn) {
+	scnr := bufio.NewScanner(conn)
+	conn.Write([]byte("VERSION\t1\t2\nMECH\tPLAIN\tplaintext\nSPID\t1\nCUID\t1\nCOOKIE\t00\nDONE\n"))
+	for scnr.Scan() {
+		fields := strings.Split(scnr.Text(), "\t")
+		if fields[0] != "AUTH" {
+			continue
+		}
+		id := fields[1]
+
+		var resp []byte
+		for _, f := range fields {
+			if strings.HasPrefix(f, "resp=") {
+				resp, _ = base64.StdEncoding.DecodeString(strings.TrimPrefix(f, "resp="))
+			}
+		}
+		parts := bytes.Split(resp, []byte{0})
+		if len(parts) != 3 {
+			conn.Write([]byte("FAIL\t" + id + "\n"))
+			continue
+		}
+
+		switch username, password := string(parts[1]), string(parts[2]); {
+		case password == "temp":
+			conn.Write([]byte("FAIL\t" + id + "\tcode=temp_fail\n"))
+		case password == "password":
+			conn.Write([]byte("OK\t" + id + "\tuser=" + strings.ToLower(username) + "\n"))
+		default:
+			conn.Write([]byte("FAIL\t" + id + "\tuser=" + username + "\treason=Password mismatch\n"))
+		}
+	}
+}
+
+func userdbServer(conn net.Conn) {
+	scnr := bufio.NewScanner(conn)
+	conn.Write([]byte("VERSION\t1\t0\nSPID\t1\n"))
+	for scnr.Scan() {
+		fields := strings.Split(scnr.Text(), "\t")
+		if fields[0] != "USER" {
+			continue
+		}
+		id := fields[1]
+
+		switch fields[2] {
+		case "fail":
+			conn.Write([]byte("FAIL\t" + id + "\treason=backend failure\n"))
+		case "User@example.org", "user@example.org":
+			conn.Write([]byte("USER\t" + id + "\tuser@example.org\tuid=1000\n"))
+		default:
+			conn.Write([]byte("NOTFOUND\t" + id + "\n"))
+		}
+	}
+}
+
+func testAuth(t *testing.T, cfg []config.Node) *Auth {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	if err := a.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestAuthPlain(t *testing.T) {
+	srv := startMockServer(t, authServer)
+	a := testAuth(t, []config.Node{
+		{Name: "endpoint", Args: []string{srv.endpoint()}},
+	})
+
+	canonical, err := a.AuthPlainCanonical("User@example.org", "password")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if canonical != "user@example.org" {
+		t.Fatal("Wrong canonical username:", canonical)
+	}
+
+	_, err = a.AuthPlainCanonical("user@example.org", "wrong")
+	if !errors.Is(err, module.ErrUnknownCredentials) || exterrors.IsTemporary(err) {
+		t.Fatal("Expected ErrUnknownCredentials, got", err)
+	}
+
+	_, err = a.AuthPlainCanonical("user@example.org", "temp")
+	if !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+
+	if err := a.AuthPlain("user@example.org", "password"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// The connection is kept after both successful and failed attempts.
+	if conns := atomic.LoadInt32(&srv.conns); conns != 1 {
+		t.Fatal("Connection is not reused, connections made:", conns)
+	}
+}
+
+func TestAuthPlain_Unavailable(t *testing.T) {
+	srv := startMockServer(t, authServer)
+	srv.l.Close()
+
+	a := testAuth(t, []config.Node{
+		{Name: "endpoint", Args: []string{srv.endpoint()}},
+	})
+
+	err := a.AuthPlain("user@example.org", "password")
+	if !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+	if a.auth.retryAt.IsZero() {
+		t.Fatal("Backoff is not used")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	srv := startMockServer(t, userdbServer)
+	a := testAuth(t, []config.Node{
+		{Name: "userdb_endpoint", Args: []string{srv.endpoint()}},
+	})
+
+	val, ok, err := a.Lookup("User@example.org")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !ok || val != "user@example.org" {
+		t.Fatal("Wrong lookup result:", val, ok)
+	}
+
+	_, ok, err = a.Lookup("nonexistent@example.org")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ok {
+		t.Fatal("Non-existent user found")
+	}
+
+	_, _, err = a.Lookup("fail")
+	if !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+
+	if conns := atomic.LoadInt32(&srv.conns); conns != 1 {
+		t.Fatal("Connection is not reused, connections made:", conns)
+	}
+
+	if err := a.AuthPlain("user@example.org", "password"); err == nil {
+		t.Fatal("Expected error without endpoint")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dovecotsasl
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 1 * time.Minute
+)
+
+// connPool keeps idle connections to the server for reuse and limits the
+// rate of connection attempts if the server is unavailable.
+type connPool struct {
+	network string
+	addr    string
+	timeout time.Duration
+	maxIdle int
+
+	// handshake is called for each new connection.
+	handshake func(net.Conn) (io.Closer, error)
+
+	lck         sync.Mutex
+	idle        []io.Closer
+	failures    int
+	retryAt     time.Time
+	lastDialErr error
+	closed      bool
+}
+
+func newConnPool(network, addr string, timeout time.Duration, maxIdle int, handshake func(net.Conn) (io.Closer, error)) *connPool {
+	return &connPool{
+		network:   network,
+		addr:      addr,
+		timeout:   timeout,
+		maxIdle:   maxIdle,
+		handshake: handshake,
+	}
+}
+
+// get returns an idle connection or establishes a new one.
+func (p *connPool) get() (io.Closer, error) {
+	p.lck.Lock()
+	if n := len(p.idle); n != 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lck.Unlock()
+		return c, nil
+	}
+	if wait := time.Until(p.retryAt); wait > 0 {
+		err := p.lastDialErr
+		p.lck.Unlock()
+		return nil, fmt.Errorf("server is unavailable, next attempt in %v: %w", wait.Round(time.Second), err)
+	}
+	p.lck.Unlock()
+
+	c, err := p.dial()
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if err != nil {
+		backoff := minBackoff << p.failures
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		} else {
+			p.failures++
+		}
+		p.retryAt = time.Now().Add(backoff)
+		p.lastDialErr = err
+		return nil, err
+	}
+	p.failures = 0
+	p.retryAt = time.Time{}
+	return c, nil
+}
+
+func (p *connPool) dial() (io.Closer, error) {
+	conn, err := net.DialTimeout(p.network, p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns the connection to the pool. Connections that failed with an
+// error should be closed instead.
+func (p *connPool) put(c io.Closer) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	if p.closed || len(p.idle) >= p.maxIdle {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+func (p *connPool) Close() error {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+	return nil
+}
@@ -0,0 +1,340 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dovecotsasl
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// The implementation of the client side of Dovecot authentication protocol
+// (auth-client socket) and Dovecot auth-master protocol (auth-userdb socket).
+// See https://doc.dovecot.org/developer_manual/design/auth_protocol/ and
+// https://doc.dovecot.org/developer_manual/design/auth_protocol/#master-protocol
+
+const (
+	authProtoMajor = 1
+	authProtoMinor = 2
+
+	masterProtoMajor = 1
+	masterProtoMinor = 0
+)
+
+var tabEscaper = strings.NewReplacer(
+	"\x01", "\x011",
+	"\t", "\x01t",
+	"\r", "\x01r",
+	"\n", "\x01n",
+)
+
+var tabUnescaper = strings.NewReplacer(
+	"\x011", "\x01",
+	"\x01t", "\t",
+	"\x01r", "\r",
+	"\x01n", "\n",
+)
+
+type protoConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	nextID  int
+}
+
+func newProtoConn(conn net.Conn, timeout time.Duration) *protoConn {
+	return &protoConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: timeout,
+	}
+}
+
+func (c *protoConn) writeln(fields ...string) error {
+	escaped := make([]string, len(fields))
+	for i, f := range fields {
+		escaped[i] = tabEscaper.Replace(f)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write([]byte(strings.Join(escaped, "\t") + "\n"))
+	return err
+}
+
+func (c *protoConn) readln() ([]string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimRight(line, "\n"), "\t")
+	for i, f := range fields {
+		fields[i] = tabUnescaper.Replace(f)
+	}
+	return fields, nil
+}
+
+func (c *protoConn) newID() string {
+	c.nextID++
+	return strconv.Itoa(c.nextID)
+}
+
+func (c *protoConn) Close() error {
+	return c.conn.Close()
+}
+
+// checkVersion checks the VERSION line sent by the server.
+func checkVersion(fields []string, major int) error {
+	if len(fields) != 3 || fields[0] != "VERSION" {
+		return errors.New("protocol error: VERSION expected")
+	}
+	if fields[1] != strconv.Itoa(major) {
+		return fmt.Errorf("protocol error: unsupported protocol version: %s.%s", fields[1], fields[2])
+	}
+	return nil
+}
+
+func params(fields []string) map[string]string {
+	res := make(map[string]string, len(fields))
+	for _, f := range fields {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) == 1 {
+			res[parts[0]] = ""
+		} else {
+			res[parts[0]] = parts[1]
+		}
+	}
+	return res
+}
+
+type authConn struct {
+	*protoConn
+	mechs map[string]struct{}
+}
+
+func newAuthConn(conn net.Conn, timeout time.Duration) (*authConn, error) {
+	c := &authConn{
+		protoConn: newProtoConn(conn, timeout),
+		mechs:     make(map[string]struct{}),
+	}
+
+	if err := c.writeln("VERSION", strconv.Itoa(authProtoMajor), strconv.Itoa(authProtoMinor)); err != nil {
+		return nil, err
+	}
+	if err := c.writeln("CPID", strconv.Itoa(os.Getpid())); err != nil {
+		return nil, err
+	}
+
+	fields, err := c.readln()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(fields, authProtoMajor); err != nil {
+		return nil, err
+	}
+
+	for {
+		fields, err := c.readln()
+		if err != nil {
+			return nil, err
+		}
+		switch fields[0] {
+		case "MECH":
+			if len(fields) < 2 {
+				return nil, errors.New("protocol error: malformed MECH")
+			}
+			c.mechs[strings.ToUpper(fields[1])] = struct{}{}
+		case "DONE":
+			return c, nil
+		}
+	}
+}
+
+// auth runs the authentication exchange and returns the username reported by
+// the server.
+func (c *authConn) auth(service, username, password string) (string, error) {
+	var cl sasl.Client
+	if _, ok := c.mechs[sasl.Plain]; ok {
+		cl = sasl.NewPlainClient("", username, password)
+	} else if _, ok := c.mechs[sasl.Login]; ok {
+		cl = sasl.NewLoginClient(username, password)
+	} else {
+		return "", errors.New("server supports neither PLAIN nor LOGIN mechanism")
+	}
+
+	mech, ir, err := cl.Start()
+	if err != nil {
+		return "", err
+	}
+
+	id := c.newID()
+	// We have no information about the connection, so pretend it is secure
+	// as maddy rejects plaintext authentication over insecure connections
+	// anyway. Penalty for failed attempts is applied by Dovecot to the
+	// connection as a whole, so disable it.
+	args := []string{"AUTH", id, mech, "service=" + service, "secured", "no-penalty"}
+	if ir != nil {
+		args = append(args, "resp="+base64.StdEncoding.EncodeToString(ir))
+	}
+	if err := c.writeln(args...); err != nil {
+		return "", err
+	}
+
+	for {
+		fields, err := c.readln()
+		if err != nil {
+			return "", err
+		}
+		if len(fields) < 2 || fields[1] != id {
+			return "", fmt.Errorf("protocol error: unexpected reply: %s", fields[0])
+		}
+
+		switch fields[0] {
+		case "OK":
+			if user := params(fields[2:])["user"]; user != "" {
+				return user, nil
+			}
+			return username, nil
+		case "FAIL":
+			return "", failError(params(fields[2:]))
+		case "CONT":
+			if len(fields) < 3 {
+				return "", errors.New("protocol error: malformed CONT")
+			}
+			challenge, err := base64.StdEncoding.DecodeString(fields[2])
+			if err != nil {
+				return "", fmt.Errorf("protocol error: malformed challenge: %v", err)
+			}
+			resp, err := cl.Next(challenge)
+			if err != nil {
+				return "", err
+			}
+			if err := c.writeln("CONT", id, base64.StdEncoding.EncodeToString(resp)); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("protocol error: unexpected reply: %s", fields[0])
+		}
+	}
+}
+
+// serverFail wraps errors reported by the server using FAIL reply. The
+// connection is still usable after them, as opposed to I/O and protocol
+// errors.
+type serverFail struct {
+	err error
+}
+
+func (f serverFail) Error() string {
+	return f.err.Error()
+}
+
+func (f serverFail) Unwrap() error {
+	return f.err
+}
+
+// failError converts FAIL reply parameters into an error. Temporary failures
+// (e.g. passdb backend being unavailable) are distinguished from invalid
+// credentials so they can be reported to the client correctly.
+func failError(p map[string]string) error {
+	fields := map[string]interface{}{}
+	if reason := p["reason"]; reason != "" {
+		fields["reason"] = reason
+	}
+	code := p["code"]
+	if code != "" {
+		fields["code"] = code
+	}
+
+	_, legacyTemp := p["temp"]
+	if code == "temp_fail" || legacyTemp {
+		return serverFail{exterrors.WithFields(exterrors.WithTemporary(
+			errors.New("dovecot_sasl: temporary authentication failure"), true), fields)}
+	}
+	return serverFail{exterrors.WithFields(module.ErrUnknownCredentials, fields)}
+}
+
+type userdbConn struct {
+	*protoConn
+}
+
+func newUserdbConn(conn net.Conn, timeout time.Duration) (*userdbConn, error) {
+	c := &userdbConn{protoConn: newProtoConn(conn, timeout)}
+
+	if err := c.writeln("VERSION", strconv.Itoa(masterProtoMajor), strconv.Itoa(masterProtoMinor)); err != nil {
+		return nil, err
+	}
+	fields, err := c.readln()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(fields, masterProtoMajor); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lookup runs the USER command and returns the username reported by the
+// server.
+func (c *userdbConn) lookup(service, username string) (string, bool, error) {
+	id := c.newID()
+	if err := c.writeln("USER", id, username, "service="+service); err != nil {
+		return "", false, err
+	}
+
+	for {
+		fields, err := c.readln()
+		if err != nil {
+			return "", false, err
+		}
+		// SPID is sent by the server after the handshake.
+		if fields[0] == "SPID" {
+			continue
+		}
+		if len(fields) < 2 || fields[1] != id {
+			return "", false, fmt.Errorf("protocol error: unexpected reply: %s", fields[0])
+		}
+
+		switch fields[0] {
+		case "USER":
+			if len(fields) >= 3 && fields[2] != "" {
+				return fields[2], true, nil
+			}
+			return username, true, nil
+		case "NOTFOUND":
+			return "", false, nil
+		case "FAIL":
+			reason := params(fields[2:])["reason"]
+			return "", false, serverFail{exterrors.WithTemporary(
+				fmt.Errorf("dovecot_sasl: userdb lookup failed: %s", reason), true)}
+		default:
+			return "", false, fmt.Errorf("protocol error: unexpected reply: %s", fields[0])
+		}
+	}
+}
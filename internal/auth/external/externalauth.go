@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package external
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -95,7 +96,7 @@ func (ea *ExternalAuth) AuthPlain(username, password string) error {
 		return module.ErrUnknownCredentials
 	}
 
-	return AuthUsingHelper(ea.helperPath, accountName, password)
+	return AuthUsingHelper(context.Background(), ea.helperPath, accountName, password)
 }
 
 func init() {
@@ -0,0 +1,251 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package external
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/helper"
+)
+
+// restartDelay is the minimal interval between helper process restarts.
+const restartDelay = 1 * time.Second
+
+// HelperProcess manages the persistent helper process (see package
+// internal/auth/helper) and sends authentication requests to it.
+//
+// The process is started on the first request and restarted if it exits or
+// does not respond to a request in time.
+type HelperProcess struct {
+	path    string
+	timeout time.Duration
+	log     log.Logger
+
+	lck       sync.Mutex
+	conn      net.Conn
+	cmd       *exec.Cmd
+	lastStart time.Time
+	closed    bool
+	nextID    uint64
+	pending   map[uint64]chan helper.Response
+
+	wLck sync.Mutex
+}
+
+func NewHelperProcess(path string, timeout time.Duration, log log.Logger) *HelperProcess {
+	return &HelperProcess{
+		path:    path,
+		timeout: timeout,
+		log:     log,
+		pending: make(map[uint64]chan helper.Response),
+	}
+}
+
+// start launches the helper process. It should be called with p.lck held.
+func (p *HelperProcess) start() error {
+	if time.Since(p.lastStart) < restartDelay {
+		return errors.New("helperproc: helper process is restarting")
+	}
+	p.lastStart = time.Now()
+
+	local, remote, err := socketPair()
+	if err != nil {
+		return fmt.Errorf("helperproc: %w", err)
+	}
+	defer remote.Close()
+
+	cmd := exec.Command(p.path, helper.ServeFlag)
+	cmd.ExtraFiles = []*os.File{remote}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		local.Close()
+		return fmt.Errorf("helperproc: stderr init: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		local.Close()
+		return fmt.Errorf("helperproc: process start: %w", err)
+	}
+
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("helperproc: %w", err)
+	}
+
+	p.log.DebugMsg("helper process started", "pid", cmd.Process.Pid)
+	p.conn = conn
+	p.cmd = cmd
+
+	go p.logStderr(stderr)
+	go p.readResponses(conn, cmd)
+
+	return nil
+}
+
+func (p *HelperProcess) logStderr(stderr io.Reader) {
+	scnr := bufio.NewScanner(stderr)
+	for scnr.Scan() {
+		p.log.Printf("helper: %s", scnr.Text())
+	}
+}
+
+func (p *HelperProcess) readResponses(conn net.Conn, cmd *exec.Cmd) {
+	r := bufio.NewReaderSize(conn, helper.MaxLineLength)
+	var err error
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		var resp helper.Response
+		resp, err = helper.ParseResponse(line)
+		if err != nil {
+			break
+		}
+
+		p.lck.Lock()
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.lck.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+
+	p.lck.Lock()
+	closed := p.closed
+	if p.conn == conn {
+		p.conn = nil
+		p.cmd = nil
+	}
+	// Requests sent to the dead process will not get a response.
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+	p.lck.Unlock()
+
+	conn.Close()
+	waitErr := cmd.Wait()
+	if !closed {
+		if err == io.EOF {
+			err = waitErr
+		}
+		p.log.Error("helper process terminated", err, "pid", cmd.Process.Pid)
+	}
+}
+
+// kill terminates the helper process if it is still the current one.
+func (p *HelperProcess) kill(conn net.Conn) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	if p.conn != conn || p.cmd == nil {
+		return
+	}
+	p.cmd.Process.Kill()
+}
+
+func (p *HelperProcess) AuthPlain(username, password string) error {
+	p.lck.Lock()
+	if p.closed {
+		p.lck.Unlock()
+		return errors.New("helperproc: module is closed")
+	}
+	if p.conn == nil {
+		if err := p.start(); err != nil {
+			p.lck.Unlock()
+			return exterrors.WithTemporary(err, true)
+		}
+	}
+	conn := p.conn
+	p.nextID++
+	id := p.nextID
+	ch := make(chan helper.Response, 1)
+	p.pending[id] = ch
+	p.lck.Unlock()
+
+	req := helper.Request{ID: id, Username: username, Password: password}
+	p.wLck.Lock()
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err := io.WriteString(conn, req.Marshal())
+	p.wLck.Unlock()
+	if err != nil {
+		p.lck.Lock()
+		delete(p.pending, id)
+		p.lck.Unlock()
+		p.kill(conn)
+		return exterrors.WithTemporary(fmt.Errorf("helperproc: request write: %w", err), true)
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return exterrors.WithTemporary(errors.New("helperproc: helper process terminated"), true)
+		}
+		switch resp.Status {
+		case helper.StatusOK:
+			return nil
+		case helper.StatusFail:
+			return module.ErrUnknownCredentials
+		default:
+			return fmt.Errorf("helperproc: %s", resp.Message)
+		}
+	case <-timer.C:
+		p.lck.Lock()
+		delete(p.pending, id)
+		p.lck.Unlock()
+
+		// The helper is likely stuck, restart it so the following requests
+		// do not time out too.
+		p.log.Msg("helper process did not respond in time, restarting", "timeout", p.timeout)
+		p.kill(conn)
+		return exterrors.WithTemporary(errors.New("helperproc: request timed out"), true)
+	}
+}
+
+// Close stops the helper process. It exits once its end of the socket is
+// closed.
+func (p *HelperProcess) Close() error {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	p.closed = true
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+//+build !windows,!plan9
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package external
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/helper"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testHelperEnv = "MADDY_TEST_AUTH_HELPER"
+
+// TestMain makes the test binary act as a persistent helper if it is started
+// by HelperProcess.
+func TestMain(m *testing.M) {
+	if os.Getenv(testHelperEnv) == "1" {
+		err := helper.ServeFD(func(username, password string) error {
+			switch username {
+			case "hang":
+				time.Sleep(time.Hour)
+			case "crash":
+				os.Exit(3)
+			case "error":
+				return errors.New("backend failure")
+			}
+			if password != "password" {
+				return helper.ErrUnknownCredentials
+			}
+			return nil
+		})
+		if err != nil {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func testHelperProcess(t *testing.T, timeout time.Duration) *HelperProcess {
+	t.Helper()
+
+	os.Setenv(testHelperEnv, "1")
+	t.Cleanup(func() { os.Unsetenv(testHelperEnv) })
+
+	p := NewHelperProcess(os.Args[0], timeout, testutils.Logger(t, "helperproc"))
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestHelperProcess(t *testing.T) {
+	p := testHelperProcess(t, 5*time.Second)
+
+	if err := p.AuthPlain("user", "password"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := p.AuthPlain("user", "wrong"); err != module.ErrUnknownCredentials {
+		t.Fatal("Expected ErrUnknownCredentials, got", err)
+	}
+	if err := p.AuthPlain("error", "password"); err == nil || err == module.ErrUnknownCredentials {
+		t.Fatal("Expected backend error, got", err)
+	}
+	// Special characters should pass unchanged.
+	if err := p.AuthPlain("user name\n", "password"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestHelperProcess_Restart(t *testing.T) {
+	p := testHelperProcess(t, 5*time.Second)
+
+	if err := p.AuthPlain("crash", "password"); err == nil {
+		t.Fatal("Expected error for crashed helper")
+	}
+
+	time.Sleep(restartDelay)
+	if err := p.AuthPlain("user", "password"); err != nil {
+		t.Fatal("Helper is not restarted:", err)
+	}
+}
+
+func TestHelperProcess_Timeout(t *testing.T) {
+	p := testHelperProcess(t, 250*time.Millisecond)
+
+	if err := p.AuthPlain("hang", "password"); err == nil {
+		t.Fatal("Expected timeout error")
+	}
+
+	time.Sleep(restartDelay)
+	if err := p.AuthPlain("user", "password"); err != nil {
+		t.Fatal("Helper is not restarted:", err)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package helper implements the protocol used to talk to privileged
+// authentication helpers (maddy-pam-helper, maddy-shadow-helper) running as
+// persistent processes.
+//
+// The helper is started by maddy with one end of a Unix socket pair passed as
+// file descriptor 3 and the -serve flag. Each request is a single line:
+//
+//	ID BASE64(username) BASE64(password)
+//
+// Responses can be sent in any order and are also single lines:
+//
+//	ID OK
+//	ID FAIL
+//	ID ERR message
+//
+// FAIL means the credentials are invalid, ERR is used for all other errors.
+// The helper exits once the socket is closed by maddy.
+//
+// The package should not depend on the rest of maddy to keep the helper
+// binaries small.
+package helper
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// SocketFD is the file descriptor number of the socket in the helper
+	// process.
+	SocketFD = 3
+
+	// ServeFlag is the command line argument that switches the helper
+	// binary into the persistent mode.
+	ServeFlag = "-serve"
+
+	// MaxLineLength is the maximum length of requests and responses.
+	MaxLineLength = 4096
+
+	// maxConcurrent is the amount of requests processed by the helper in
+	// parallel.
+	maxConcurrent = 8
+)
+
+// ErrUnknownCredentials should be returned by the helper authentication
+// function if the credentials are invalid.
+var ErrUnknownCredentials = errors.New("helper: invalid credentials")
+
+type Status string
+
+const (
+	StatusOK   Status = "OK"
+	StatusFail Status = "FAIL"
+	StatusErr  Status = "ERR"
+)
+
+type Request struct {
+	ID       uint64
+	Username string
+	Password string
+}
+
+type Response struct {
+	ID      uint64
+	Status  Status
+	Message string
+}
+
+func (r Request) Marshal() string {
+	return fmt.Sprintf("%d %s %s\n", r.ID,
+		base64.StdEncoding.EncodeToString([]byte(r.Username)),
+		base64.StdEncoding.EncodeToString([]byte(r.Password)))
+}
+
+func ParseRequest(line string) (Request, error) {
+	parts := strings.Split(strings.TrimRight(line, "\r\n"), " ")
+	if len(parts) != 3 {
+		return Request{}, errors.New("helper: malformed request")
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Request{}, fmt.Errorf("helper: malformed request ID: %w", err)
+	}
+	username, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Request{}, fmt.Errorf("helper: malformed username: %w", err)
+	}
+	password, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Request{}, fmt.Errorf("helper: malformed password: %w", err)
+	}
+	return Request{ID: id, Username: string(username), Password: string(password)}, nil
+}
+
+func (r Response) Marshal() string {
+	if r.Status != StatusErr {
+		return fmt.Sprintf("%d %s\n", r.ID, r.Status)
+	}
+	msg := strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, r.Message)
+	return fmt.Sprintf("%d %s %s\n", r.ID, r.Status, msg)
+}
+
+func ParseResponse(line string) (Response, error) {
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(parts) < 2 {
+		return Response{}, errors.New("helper: malformed response")
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Response{}, fmt.Errorf("helper: malformed response ID: %w", err)
+	}
+	resp := Response{ID: id, Status: Status(parts[1])}
+	switch resp.Status {
+	case StatusOK, StatusFail:
+	case StatusErr:
+		if len(parts) == 3 {
+			resp.Message = parts[2]
+		}
+	default:
+		return Response{}, fmt.Errorf("helper: unknown response status: %s", parts[1])
+	}
+	return resp, nil
+}
+
+// Serve reads requests from the socket and answers them using authFunc
+// until the socket is closed by the other end.
+func Serve(conn io.ReadWriter, authFunc func(username, password string) error) error {
+	var (
+		wg   sync.WaitGroup
+		wLck sync.Mutex
+		sem  = make(chan struct{}, maxConcurrent)
+		r    = bufio.NewReaderSize(conn, MaxLineLength)
+	)
+	defer wg.Wait()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(line) > MaxLineLength {
+			return errors.New("helper: request is too long")
+		}
+
+		req, err := ParseRequest(line)
+		if err != nil {
+			return err
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			resp := Response{ID: req.ID, Status: StatusOK}
+			if err := authFunc(req.Username, req.Password); err != nil {
+				if errors.Is(err, ErrUnknownCredentials) {
+					resp.Status = StatusFail
+				} else {
+					resp.Status = StatusErr
+					resp.Message = err.Error()
+				}
+			}
+
+			wLck.Lock()
+			defer wLck.Unlock()
+			io.WriteString(conn, resp.Marshal())
+		}()
+	}
+}
+
+// ServeFD runs Serve on the socket passed to the helper process by maddy.
+func ServeFD(authFunc func(username, password string) error) error {
+	f := os.NewFile(SocketFD, "socket")
+	if f == nil {
+		return errors.New("helper: no socket passed")
+	}
+	defer f.Close()
+	return Serve(f, authFunc)
+}
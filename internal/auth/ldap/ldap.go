@@ -0,0 +1,547 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package ldap implements authentication and lookups using an LDAP directory.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	modName = "auth.ldap"
+
+	// maxReferralHops limits the length of referral chains.
+	maxReferralHops = 5
+)
+
+type Auth struct {
+	instName string
+	urls     []string
+	log      log.Logger
+
+	baseDN       string
+	filter       string
+	dnTemplate   string
+	authzFilter  string
+	requireGroup string
+	lookupFilter string
+	senderAttrs  []string
+
+	followReferrals bool
+
+	pool *connPool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Auth{
+		instName: instName,
+		urls:     inlineArgs,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func bindDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one argument is required")
+	}
+	switch node.Args[0] {
+	case "off", "external":
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "no additional arguments are expected for %s", node.Args[0])
+		}
+		return bindMethod{kind: node.Args[0]}, nil
+	case "unauth":
+		if len(node.Args) != 2 {
+			return nil, config.NodeErr(node, "usage: bind unauth <dn>")
+		}
+		return bindMethod{kind: "unauth", dn: node.Args[1]}, nil
+	case "plain":
+		if len(node.Args) != 3 {
+			return nil, config.NodeErr(node, "usage: bind plain <dn> <password>")
+		}
+		return bindMethod{kind: "plain", dn: node.Args[1], password: node.Args[2]}, nil
+	default:
+		return nil, config.NodeErr(node, "unknown bind method: %s", node.Args[0])
+	}
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var (
+		urls           []string
+		tlsConfig      tls.Config
+		startTLS       bool
+		connectTimeout time.Duration
+		requestTimeout time.Duration
+		bind           bindMethod
+		maxIdle        int
+	)
+	cfg.StringList("urls", false, false, nil, &urls)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	cfg.Bool("starttls", false, false, &startTLS)
+	cfg.Duration("connect_timeout", false, false, 10*time.Second, &connectTimeout)
+	cfg.Duration("request_timeout", false, false, 30*time.Second, &requestTimeout)
+	cfg.Custom("bind", false, false, func() (interface{}, error) {
+		return bindMethod{kind: "off"}, nil
+	}, bindDirective, &bind)
+	cfg.String("base_dn", false, false, "", &a.baseDN)
+	cfg.String("filter", false, false, "", &a.filter)
+	cfg.String("dn_template", false, false, "", &a.dnTemplate)
+	cfg.String("authz_filter", false, false, "", &a.authzFilter)
+	cfg.String("require_group", false, false, "", &a.requireGroup)
+	cfg.String("lookup_filter", false, false, "", &a.lookupFilter)
+	cfg.StringList("sender_attrs", false, false, []string{"mail", "mailAlternateAddress"}, &a.senderAttrs)
+	cfg.Bool("follow_referrals", false, true, &a.followReferrals)
+	cfg.Int("max_idle_conns", false, false, 4, &maxIdle)
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	a.urls = append(a.urls, urls...)
+	if len(a.urls) == 0 {
+		return fmt.Errorf("%s: at least one server URL is required", modName)
+	}
+	for _, u := range a.urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("%s: invalid server URL %s: %v", modName, u, err)
+		}
+		switch parsed.Scheme {
+		case "ldap", "ldaps", "ldapi":
+		default:
+			return fmt.Errorf("%s: unsupported URL scheme: %s", modName, parsed.Scheme)
+		}
+	}
+
+	if a.dnTemplate == "" && a.filter == "" {
+		return fmt.Errorf("%s: either dn_template or filter is required", modName)
+	}
+	if a.dnTemplate != "" && a.filter != "" {
+		return fmt.Errorf("%s: dn_template and filter can't be used together", modName)
+	}
+	if a.filter != "" && a.baseDN == "" {
+		return fmt.Errorf("%s: base_dn is required to use filter", modName)
+	}
+	if a.lookupFilter == "" {
+		a.lookupFilter = a.filter
+	}
+	if a.lookupFilter != "" && a.baseDN == "" {
+		return fmt.Errorf("%s: base_dn is required to use lookup_filter", modName)
+	}
+
+	a.pool = newConnPool(a.urls, &tlsConfig, startTLS, connectTimeout, requestTimeout, bind, maxIdle)
+
+	if config.CheckOnly {
+		return nil
+	}
+
+	// Check the configuration and server availability. Servers can be
+	// started after maddy so the failure is not fatal.
+	c, err := a.pool.get()
+	if err != nil {
+		a.log.Error("unable to contact any server, will retry later", err)
+	} else {
+		a.pool.put(c)
+	}
+
+	return nil
+}
+
+// expandPlaceholders replaces the username placeholders in the filter or DN
+// template. {username} (%u) is replaced with the full username, {local} (%n)
+// and {domain} (%d) with its local part and domain, if it is an email
+// address.
+//
+// escape is used to escape the values.
+func expandPlaceholders(template, username string, escape func(string) string) string {
+	local, domain, err := address.Split(username)
+	if err != nil {
+		local, domain = username, ""
+	}
+
+	return strings.NewReplacer(
+		"{username}", escape(username),
+		"%u", escape(username),
+		"{local}", escape(local),
+		"%n", escape(local),
+		"{domain}", escape(domain),
+		"%d", escape(domain),
+	).Replace(template)
+}
+
+// escapeDN escapes the value for use as an attribute value in the DN as
+// described in RFC 4514 Section 2.4.
+func escapeDN(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '+' || c == ',' || c == ';' || c == '<' || c == '>' || c == '\\' || c == '=':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '#' && i == 0, c == ' ' && (i == 0 || i == len(value)-1):
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == 0:
+			sb.WriteString("\\00")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// search executes the search request following referrals if enabled.
+func (a *Auth) search(c *ldap.Conn, req *ldap.SearchRequest, hops int) ([]*ldap.Entry, error) {
+	res, err := c.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) && a.followReferrals {
+			return a.followReferral(referralURLs(err), req, hops)
+		}
+		if res != nil {
+			// Partial results, e.g. if the size limit is exceeded.
+			return res.Entries, err
+		}
+		return nil, err
+	}
+
+	entries := res.Entries
+	if !a.followReferrals {
+		return entries, nil
+	}
+	// Continuation references returned along with other results, typically
+	// pointing to other parts of the directory tree.
+	for _, ref := range res.Referrals {
+		refEntries, err := a.followReferral([]string{ref}, req, hops)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, refEntries...)
+	}
+	return entries, nil
+}
+
+// followReferral repeats the search using the first reachable server
+// from the referral.
+func (a *Auth) followReferral(refs []string, req *ldap.SearchRequest, hops int) ([]*ldap.Entry, error) {
+	if hops >= maxReferralHops {
+		return nil, fmt.Errorf("too many referral hops")
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("referral without URLs")
+	}
+
+	var lastErr error
+	for _, ref := range refs {
+		u, err := url.Parse(ref)
+		if err != nil {
+			lastErr = fmt.Errorf("malformed referral URL %s: %w", ref, err)
+			continue
+		}
+
+		refReq := *req
+		if dn := strings.TrimPrefix(u.Path, "/"); dn != "" {
+			refReq.BaseDN = dn
+		}
+
+		a.log.DebugMsg("following referral", "url", ref, "base_dn", refReq.BaseDN, "hops", hops+1)
+
+		c, err := a.pool.dial(u.Scheme + "://" + u.Host)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", ref, err)
+			continue
+		}
+		entries, err := a.search(c, &refReq, hops+1)
+		c.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", ref, err)
+			continue
+		}
+		return entries, nil
+	}
+	return nil, lastErr
+}
+
+// referralURLs extracts referral URLs from the LDAPResult carried by the
+// error.
+func referralURLs(err error) []string {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.Packet == nil || len(ldapErr.Packet.Children) < 2 {
+		return nil
+	}
+
+	var urls []string
+	for _, child := range ldapErr.Packet.Children[1].Children {
+		// Referral [3] SEQUENCE OF URI, RFC 4511 Section 4.1.9.
+		if child.Tag != 3 {
+			continue
+		}
+		for _, u := range child.Children {
+			if s, ok := u.Value.(string); ok {
+				urls = append(urls, s)
+			} else {
+				urls = append(urls, u.Data.String())
+			}
+		}
+	}
+	return urls
+}
+
+// wrapErr converts the LDAP error into the error returned by the module.
+func (a *Auth) wrapErr(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return module.ErrUnknownCredentials
+	}
+	temporary := ldap.IsErrorAnyOf(err,
+		ldap.ErrorNetwork,
+		ldap.LDAPResultBusy,
+		ldap.LDAPResultUnavailable,
+		ldap.LDAPResultTimeLimitExceeded,
+		ldap.LDAPResultAdminLimitExceeded,
+		ldap.LDAPResultOther,
+	)
+	return exterrors.WithTemporary(fmt.Errorf("%s: %w", modName, err), temporary)
+}
+
+// findUser returns the entry for the user using filter or nil if the user does
+// not exist.
+func (a *Auth) findUser(c *conn, filter, username string, attrs []string) (*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(
+		a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false,
+		expandPlaceholders(filter, username, ldap.EscapeFilter),
+		attrs, nil,
+	)
+	entries, err := a.search(c.Conn, req, 0)
+	if err != nil {
+		// Too many entries matched, this is handled below.
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, err
+		}
+	}
+	switch len(entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return entries[0], nil
+	default:
+		return nil, fmt.Errorf("filter matched multiple entries for %s", username)
+	}
+}
+
+// userDN returns the DN of the user entry.
+func (a *Auth) userDN(c *conn, username string) (string, error) {
+	if a.dnTemplate != "" {
+		return expandPlaceholders(a.dnTemplate, username, escapeDN), nil
+	}
+
+	entry, err := a.findUser(c, a.filter, username, []string{"1.1"})
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return "", module.ErrUnknownCredentials
+	}
+	return entry.DN, nil
+}
+
+// authorized checks whether the user is allowed to use the server according
+// to authz_filter and require_group.
+func (a *Auth) authorized(c *conn, userDN, username string) (bool, error) {
+	if a.authzFilter != "" {
+		req := ldap.NewSearchRequest(
+			userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, 0, false,
+			expandPlaceholders(a.authzFilter, username, ldap.EscapeFilter),
+			[]string{"1.1"}, nil,
+		)
+		entries, err := a.search(c.Conn, req, 0)
+		if err != nil {
+			return false, err
+		}
+		if len(entries) == 0 {
+			a.log.DebugMsg("authz_filter does not match", "username", username, "dn", userDN)
+			return false, nil
+		}
+	}
+
+	if a.requireGroup != "" {
+		req := ldap.NewSearchRequest(
+			a.requireGroup, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, 0, false,
+			fmt.Sprintf("(|(member=%s)(uniqueMember=%s)(memberUid=%s))",
+				ldap.EscapeFilter(userDN), ldap.EscapeFilter(userDN), ldap.EscapeFilter(username)),
+			[]string{"1.1"}, nil,
+		)
+		entries, err := a.search(c.Conn, req, 0)
+		if err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				return false, fmt.Errorf("group %s does not exist", a.requireGroup)
+			}
+			return false, err
+		}
+		if len(entries) == 0 {
+			a.log.DebugMsg("user is not a group member", "username", username, "dn", userDN, "group", a.requireGroup)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	// Simple bind with an empty password is an unauthenticated bind and
+	// succeeds for any DN on many servers, see RFC 4513 Section 5.1.2.
+	if password == "" {
+		return module.ErrUnknownCredentials
+	}
+
+	c, err := a.pool.get()
+	if err != nil {
+		return exterrors.WithTemporary(fmt.Errorf("%s: unable to contact server: %w", modName, err), true)
+	}
+
+	err = a.authPlain(c, username, password)
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		c.Close()
+	} else {
+		a.pool.put(c)
+	}
+	if err != nil && !errors.Is(err, module.ErrUnknownCredentials) {
+		return a.wrapErr(err)
+	}
+	return err
+}
+
+func (a *Auth) authPlain(c *conn, username, password string) error {
+	userDN, err := a.userDN(c, username)
+	if err != nil {
+		return err
+	}
+
+	c.userBound = true
+	if err := c.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			a.log.DebugMsg("bind failed", "username", username, "dn", userDN, "reason", err)
+			return module.ErrUnknownCredentials
+		}
+		return err
+	}
+
+	// Authorization checks are done using the service account since users
+	// are usually not allowed to read group entries.
+	if a.authzFilter == "" && a.requireGroup == "" {
+		return nil
+	}
+	if err := a.pool.rebind(c); err != nil {
+		return err
+	}
+	ok, err := a.authorized(c, userDN, username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return module.ErrUnknownCredentials
+	}
+	return nil
+}
+
+// LookupMulti returns the sender addresses of the user, as stored in
+// sender_attrs.
+//
+// If the user entry exists but has no such attributes, the key itself is
+// returned.
+func (a *Auth) LookupMulti(key string) ([]string, error) {
+	if a.lookupFilter == "" {
+		return nil, fmt.Errorf("%s: lookups are not possible with dn_template, set lookup_filter", modName)
+	}
+
+	c, err := a.pool.get()
+	if err != nil {
+		return nil, exterrors.WithTemporary(fmt.Errorf("%s: unable to contact server: %w", modName, err), true)
+	}
+
+	entry, err := a.findUser(c, a.lookupFilter, key, a.senderAttrs)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			c.Close()
+		} else {
+			a.pool.put(c)
+		}
+		return nil, a.wrapErr(err)
+	}
+	a.pool.put(c)
+	if entry == nil {
+		return nil, nil
+	}
+
+	var addrs []string
+	for _, attr := range a.senderAttrs {
+		addrs = append(addrs, entry.GetAttributeValues(attr)...)
+	}
+	if len(addrs) == 0 {
+		addrs = []string{key}
+	}
+	return addrs, nil
+}
+
+// Lookup checks whether the user exists. The value is the list of the user
+// sender addresses separated by commas, this allows the module to be used
+// as a sender ownership table.
+func (a *Auth) Lookup(key string) (string, bool, error) {
+	addrs, err := a.LookupMulti(key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(addrs) == 0 {
+		return "", false, nil
+	}
+	return strings.Join(addrs, ","), true, nil
+}
+
+func (a *Auth) Close() error {
+	return a.pool.Close()
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,494 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ldap
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/testutils"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	serviceDN = "cn=maddy,dc=example,dc=org"
+	groupDN   = "cn=mail,ou=groups,dc=example,dc=org"
+)
+
+type mockEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// mockServer implements a tiny subset of LDAP sufficient to test the module:
+// simple binds and searches with equality, presence and boolean filters.
+//
+// Group entries are visible only to the service account.
+type mockServer struct {
+	l       net.Listener
+	entries []mockEntry
+	// refs are returned as continuation references for subtree searches.
+	refs  []string
+	conns int32
+}
+
+func (s *mockServer) url() string {
+	return "ldap://" + s.l.Addr().String()
+}
+
+func startMockServer(t *testing.T, entries []mockEntry) *mockServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &mockServer{l: l, entries: entries}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func ldapResult(msgID int64, tag ber.Tag, code int64) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, ""))
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	envelope.AppendChild(res)
+	return envelope
+}
+
+func (s *mockServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var boundDN string
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		msgID := req.Children[0].Value.(int64)
+		op := req.Children[1]
+
+		switch op.Tag {
+		case 0: // BindRequest
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := int64(49)
+			if dn == "" && password == "" {
+				code = 0
+			}
+			for _, e := range s.entries {
+				if strings.EqualFold(e.dn, dn) && e.password != "" && e.password == password {
+					code = 0
+				}
+			}
+			if code == 0 {
+				boundDN = dn
+			}
+			conn.Write(ldapResult(msgID, 1, code).Bytes())
+		case 2: // UnbindRequest
+			return
+		case 3: // SearchRequest
+			base := op.Children[0].Value.(string)
+			scope := op.Children[1].Value.(int64)
+			filter := op.Children[6]
+
+			found := false
+			for _, e := range s.entries {
+				if strings.HasSuffix(e.dn, groupDN) && boundDN != serviceDN {
+					continue
+				}
+				if strings.EqualFold(e.dn, base) {
+					found = true
+				}
+				if scope == 0 && !strings.EqualFold(e.dn, base) {
+					continue
+				}
+				if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(base)) {
+					continue
+				}
+				if !matchFilter(e, filter) {
+					continue
+				}
+
+				envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, ""))
+				res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+				res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for _, reqAttr := range op.Children[7].Children {
+					name := reqAttr.Value.(string)
+					values, ok := e.attrs[name]
+					if !ok {
+						continue
+					}
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				res.AppendChild(attrs)
+				envelope.AppendChild(res)
+				conn.Write(envelope.Bytes())
+			}
+
+			if scope != 0 {
+				for _, ref := range s.refs {
+					envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, ""))
+					res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 19, nil, "")
+					res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ref, ""))
+					envelope.AppendChild(res)
+					conn.Write(envelope.Bytes())
+				}
+			}
+
+			code := int64(0)
+			if scope == 0 && !found {
+				code = 32
+			}
+			conn.Write(ldapResult(msgID, 5, code).Bytes())
+		default:
+			conn.Write(ldapResult(msgID, 24, 2).Bytes())
+		}
+	}
+}
+
+func matchFilter(e mockEntry, f *ber.Packet) bool {
+	switch f.Tag {
+	case 0: // and
+		for _, c := range f.Children {
+			if !matchFilter(e, c) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, c := range f.Children {
+			if matchFilter(e, c) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return !matchFilter(e, f.Children[0])
+	case 3: // equalityMatch
+		name := f.Children[0].Data.String()
+		value := f.Children[1].Data.String()
+		for attr, values := range e.attrs {
+			if !strings.EqualFold(attr, name) {
+				continue
+			}
+			for _, v := range values {
+				if strings.EqualFold(v, value) {
+					return true
+				}
+			}
+		}
+		return false
+	case 7: // present
+		name := f.Data.String()
+		for attr := range e.attrs {
+			if strings.EqualFold(attr, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+var testEntries = []mockEntry{
+	{
+		dn:       serviceDN,
+		password: "svcpass",
+	},
+	{
+		dn:       "uid=alice,ou=people,dc=example,dc=org",
+		password: "alicepass",
+		attrs: map[string][]string{
+			"objectClass":          {"inetOrgPerson"},
+			"uid":                  {"alice"},
+			"mail":                 {"alice@example.org"},
+			"mailAlternateAddress": {"postmaster@example.org"},
+		},
+	},
+	{
+		dn:       "uid=bob,ou=people,dc=example,dc=org",
+		password: "bobpass",
+		attrs: map[string][]string{
+			"objectClass": {"inetOrgPerson"},
+			"uid":         {"bob"},
+			"mail":        {"bob@example.org"},
+		},
+	},
+	{
+		dn: groupDN,
+		attrs: map[string][]string{
+			"member": {"uid=alice,ou=people,dc=example,dc=org"},
+		},
+	},
+}
+
+func testAuth(t *testing.T, cfg []config.Node) *Auth {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	if err := a.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func searchConfig(urls ...string) []config.Node {
+	return []config.Node{
+		{Name: "urls", Args: urls},
+		{Name: "bind", Args: []string{"plain", serviceDN, "svcpass"}},
+		{Name: "base_dn", Args: []string{"dc=example,dc=org"}},
+		{Name: "filter", Args: []string{"(&(objectClass=inetOrgPerson)(mail={username}))"}},
+	}
+}
+
+func TestAuthPlain(t *testing.T) {
+	srv := startMockServer(t, testEntries)
+	a := testAuth(t, searchConfig(srv.url()))
+
+	if err := a.AuthPlain("alice@example.org", "alicepass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("ALICE@example.org", "alicepass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	for _, creds := range [][2]string{
+		{"alice@example.org", "wrong"},
+		{"alice@example.org", ""},
+		{"nobody@example.org", "alicepass"},
+		{"*", "alicepass"},
+	} {
+		err := a.AuthPlain(creds[0], creds[1])
+		if !errors.Is(err, module.ErrUnknownCredentials) || exterrors.IsTemporary(err) {
+			t.Errorf("%v: expected ErrUnknownCredentials, got %v", creds, err)
+		}
+	}
+
+	// The connection is kept after both successful and failed attempts.
+	if conns := atomic.LoadInt32(&srv.conns); conns != 1 {
+		t.Fatal("Connection is not reused, connections made:", conns)
+	}
+}
+
+func TestAuthPlain_DNTemplate(t *testing.T) {
+	srv := startMockServer(t, testEntries)
+	a := testAuth(t, []config.Node{
+		{Name: "urls", Args: []string{srv.url()}},
+		{Name: "dn_template", Args: []string{"uid={local},ou=people,dc=example,dc=org"}},
+	})
+
+	if err := a.AuthPlain("bob@example.org", "bobpass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("bob@example.org", "alicepass"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("Expected ErrUnknownCredentials, got", err)
+	}
+}
+
+func TestAuthPlain_RequireGroup(t *testing.T) {
+	srv := startMockServer(t, testEntries)
+	a := testAuth(t, append(searchConfig(srv.url()),
+		config.Node{Name: "require_group", Args: []string{groupDN}},
+	))
+
+	// Group entry is not readable by the user so this also checks that the
+	// connection is bound back to the service account.
+	if err := a.AuthPlain("alice@example.org", "alicepass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("bob@example.org", "bobpass"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("Expected ErrUnknownCredentials, got", err)
+	}
+	if err := a.AuthPlain("alice@example.org", "alicepass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestAuthPlain_AuthzFilter(t *testing.T) {
+	srv := startMockServer(t, testEntries)
+	a := testAuth(t, append(searchConfig(srv.url()),
+		config.Node{Name: "authz_filter", Args: []string{"(mailAlternateAddress=*)"}},
+	))
+
+	if err := a.AuthPlain("alice@example.org", "alicepass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("bob@example.org", "bobpass"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("Expected ErrUnknownCredentials, got", err)
+	}
+}
+
+func TestAuthPlain_Failover(t *testing.T) {
+	down := startMockServer(t, testEntries)
+	down.l.Close()
+	srv := startMockServer(t, testEntries)
+
+	a := testAuth(t, searchConfig(down.url(), srv.url()))
+
+	if err := a.AuthPlain("alice@example.org", "alicepass"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if a.pool.servers[0].retryAt.IsZero() {
+		t.Fatal("Backoff is not used for the failed server")
+	}
+}
+
+func TestAuthPlain_Unavailable(t *testing.T) {
+	srv := startMockServer(t, testEntries)
+	srv.l.Close()
+
+	a := testAuth(t, searchConfig(srv.url()))
+
+	err := a.AuthPlain("alice@example.org", "alicepass")
+	if !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	srv := startMockServer(t, testEntries)
+	a := testAuth(t, searchConfig(srv.url()))
+
+	val, ok, err := a.Lookup("alice@example.org")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !ok || val != "alice@example.org,postmaster@example.org" {
+		t.Fatal("Wrong lookup result:", val, ok)
+	}
+
+	_, ok, err = a.Lookup("nobody@example.org")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ok {
+		t.Fatal("Unexpected lookup success")
+	}
+
+	// Check that the value works as a sender ownership table.
+	for addr, expected := range map[string]bool{
+		"postmaster@example.org": true,
+		"alice@example.org":      true,
+		"bob@example.org":        false,
+	} {
+		authorized, err := auth.SenderAuthorized(a, "alice@example.org", addr)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if authorized != expected {
+			t.Errorf("SenderAuthorized(%s) = %v, want %v", addr, authorized, expected)
+		}
+	}
+}
+
+func TestLookup_Referral(t *testing.T) {
+	remote := startMockServer(t, []mockEntry{
+		{dn: serviceDN, password: "svcpass"},
+		{
+			dn: "uid=carol,ou=remote,dc=example,dc=org",
+			attrs: map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"mail":        {"carol@example.org"},
+			},
+		},
+	})
+	srv := startMockServer(t, testEntries)
+	srv.refs = []string{remote.url() + "/ou=remote,dc=example,dc=org"}
+
+	a := testAuth(t, searchConfig(srv.url()))
+
+	val, ok, err := a.Lookup("carol@example.org")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !ok || val != "carol@example.org" {
+		t.Fatal("Wrong lookup result:", val, ok)
+	}
+
+	a.followReferrals = false
+	_, ok, err = a.Lookup("carol@example.org")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if ok {
+		t.Fatal("Referral is followed with follow_referrals off")
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		username string
+		escape   func(string) string
+		expected string
+	}{
+		{"(mail=%u)", "user@example.org", ldap.EscapeFilter, "(mail=user@example.org)"},
+		{"(uid={local})", "user@example.org", ldap.EscapeFilter, "(uid=user)"},
+		{"(uid={username})", "user", ldap.EscapeFilter, "(uid=user)"},
+		{"(&(uid=%n)(domain=%d))", "user@example.org", ldap.EscapeFilter, "(&(uid=user)(domain=example.org))"},
+		{"(mail={username})", "*)(uid=*", ldap.EscapeFilter, `(mail=\2a\29\28uid=\2a)`},
+		{"uid={local},dc=example", "a,b=c@example.org", escapeDN, `uid=a\,b\=c,dc=example`},
+		{"cn={username},dc=example", " #x ", escapeDN, `cn=\ #x\ ,dc=example`},
+	} {
+		actual := expandPlaceholders(c.template, c.username, c.escape)
+		if actual != c.expected {
+			t.Errorf("expandPlaceholders(%q, %q) = %q, want %q", c.template, c.username, actual, c.expected)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 1 * time.Minute
+)
+
+// bindMethod specifies the identity used for searches.
+type bindMethod struct {
+	kind     string // "off", "unauth", "external" or "plain"
+	dn       string
+	password string
+}
+
+// conn is a connection to one of the servers along with the identity it is
+// currently bound as.
+type conn struct {
+	*ldap.Conn
+	url string
+
+	// userBound is set after the connection was used to verify the user
+	// password. Such connections should be re-bound using the service
+	// account before the next search.
+	userBound bool
+}
+
+// server tracks the availability of a single server URL.
+type server struct {
+	url      string
+	failures int
+	retryAt  time.Time
+}
+
+// connPool keeps idle connections for reuse and picks the server to connect
+// to. Servers are tried in order they are configured, unavailable ones are
+// skipped until the backoff time passes.
+type connPool struct {
+	servers        []*server
+	tlsConfig      *tls.Config
+	startTLS       bool
+	connectTimeout time.Duration
+	requestTimeout time.Duration
+	bind           bindMethod
+	maxIdle        int
+
+	lck    sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func newConnPool(urls []string, tlsConfig *tls.Config, startTLS bool, connectTimeout, requestTimeout time.Duration, bind bindMethod, maxIdle int) *connPool {
+	p := &connPool{
+		tlsConfig:      tlsConfig,
+		startTLS:       startTLS,
+		connectTimeout: connectTimeout,
+		requestTimeout: requestTimeout,
+		bind:           bind,
+		maxIdle:        maxIdle,
+	}
+	for _, u := range urls {
+		p.servers = append(p.servers, &server{url: u})
+	}
+	return p
+}
+
+// get returns an idle connection or connects to the first available server.
+// The returned connection is bound using the service account.
+func (p *connPool) get() (*conn, error) {
+	for {
+		p.lck.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.lck.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lck.Unlock()
+
+		if c.IsClosing() {
+			c.Close()
+			continue
+		}
+		if c.userBound {
+			if err := p.rebind(c); err != nil {
+				c.Close()
+				continue
+			}
+		}
+		return c, nil
+	}
+
+	var lastErr error
+	for _, srv := range p.servers {
+		p.lck.Lock()
+		retryAt := srv.retryAt
+		p.lck.Unlock()
+		if time.Now().Before(retryAt) {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("%s is unavailable, next attempt in %v", srv.url, time.Until(retryAt).Round(time.Second))
+			}
+			continue
+		}
+
+		c, err := p.dial(srv.url)
+
+		p.lck.Lock()
+		if err != nil {
+			backoff := minBackoff << srv.failures
+			if backoff > maxBackoff || backoff <= 0 {
+				backoff = maxBackoff
+			} else {
+				srv.failures++
+			}
+			srv.retryAt = time.Now().Add(backoff)
+			p.lck.Unlock()
+			lastErr = fmt.Errorf("%s: %w", srv.url, err)
+			continue
+		}
+		srv.failures = 0
+		srv.retryAt = time.Time{}
+		p.lck.Unlock()
+
+		return &conn{Conn: c, url: srv.url}, nil
+	}
+	return nil, lastErr
+}
+
+// dial connects to the server, does StartTLS if needed and binds using the
+// service account.
+func (p *connPool) dial(serverURL string) (*ldap.Conn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := p.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	c, err := ldap.DialURL(serverURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: p.connectTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(p.requestTimeout)
+
+	if p.startTLS && u.Scheme == "ldap" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("StartTLS failed: %w", err)
+		}
+	}
+
+	if err := p.serviceBind(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("bind failed: %w", err)
+	}
+
+	return c, nil
+}
+
+func (p *connPool) serviceBind(c *ldap.Conn) error {
+	switch p.bind.kind {
+	case "unauth":
+		return c.UnauthenticatedBind(p.bind.dn)
+	case "external":
+		return c.ExternalBind()
+	case "plain":
+		return c.Bind(p.bind.dn, p.bind.password)
+	}
+	return nil
+}
+
+// rebind restores the service account identity of the connection that was
+// used to verify the user password.
+func (p *connPool) rebind(c *conn) error {
+	var err error
+	if p.bind.kind == "off" {
+		// Go back to anonymous access.
+		err = c.UnauthenticatedBind("")
+	} else {
+		err = p.serviceBind(c.Conn)
+	}
+	if err != nil {
+		return err
+	}
+	c.userBound = false
+	return nil
+}
+
+// put returns the connection to the pool. Connections that failed with a
+// network error should be closed instead.
+func (p *connPool) put(c *conn) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	if p.closed || len(p.idle) >= p.maxIdle || c.IsClosing() {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+func (p *connPool) Close() error {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+	return nil
+}
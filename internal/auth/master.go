@@ -0,0 +1,146 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// ErrMasterNetwork is returned if the master user login is attempted from
+// the address outside of the allowed networks.
+var ErrMasterNetwork = errors.New("auth: master user login is not allowed from this address")
+
+// MasterUsers contains the configuration of master users that are allowed
+// to log in as any other user using their own credentials.
+//
+// The target user is specified either using the authorization identity
+// (SASL PLAIN) or by appending the separator and the master username to the
+// target username, e.g. "user@example.org*admin".
+type MasterUsers struct {
+	// Plain contains providers master credentials are checked against.
+	// These should not be the same as the providers used for regular
+	// users.
+	Plain []module.PlainAuth
+
+	Separator string
+	Networks  []net.IPNet
+}
+
+// Split splits the username into the target and master usernames.
+func (mu *MasterUsers) Split(username string) (target, master string, ok bool) {
+	idx := strings.LastIndex(username, mu.Separator)
+	if idx <= 0 || idx == len(username)-len(mu.Separator) {
+		return "", "", false
+	}
+	return username[:idx], username[idx+len(mu.Separator):], true
+}
+
+// Allowed reports whether the master user login is allowed from the address.
+func (mu *MasterUsers) Allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case nil:
+		return false
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range mu.Networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthPlain checks the master user credentials.
+func (mu *MasterUsers) AuthPlain(username, password string) error {
+	var lastErr error
+	for _, p := range mu.Plain {
+		err := p.AuthPlain(username, password)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("no auth. provider accepted master creds, last err: %w", lastErr)
+}
+
+// authMaster checks the master user credentials and returns the target
+// username if the login is allowed.
+func (s *SASLAuth) authMaster(remoteAddr net.Addr, target, master, password string) (string, error) {
+	return s.Throttled(remoteAddr, master, func() (string, error) {
+		if !s.Master.Allowed(remoteAddr) {
+			return "", ErrMasterNetwork
+		}
+		if err := s.Master.AuthPlain(master, password); err != nil {
+			return "", err
+		}
+
+		s.Log.Msg("master user login", "master_user", master, "username", target, "src_ip", remoteAddr)
+		return target, nil
+	})
+}
+
+// SetMasterUsers enables the master users login by parsing the
+// 'master_users' configuration block.
+func (s *SASLAuth) SetMasterUsers(m *config.Map, node config.Node) error {
+	mu := &MasterUsers{}
+
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		var plainAuth module.PlainAuth
+		if err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &plainAuth); err != nil {
+			return err
+		}
+		mu.Plain = append(mu.Plain, plainAuth)
+		return nil
+	})
+	cfg.String("separator", false, false, "*", &mu.Separator)
+	cfg.CIDRList("networks", false, true, nil, &mu.Networks)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(mu.Plain) == 0 {
+		return config.NodeErr(node, "master_users: at least one auth provider is required")
+	}
+	if mu.Separator == "" {
+		return config.NodeErr(node, "master_users: separator can't be empty")
+	}
+
+	s.Master = mu
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// jwk is the JSON Web Key (RFC 7517) with the parameters used for the
+// supported key types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type verificationKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e is too big")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+// parseJWKS parses the JSON Web Key Set. Keys of unsupported types and keys
+// not meant for signatures are skipped.
+func parseJWKS(blob []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(blob, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]verificationKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pubKey, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, verificationKey{kid: k.Kid, alg: k.Alg, key: pubKey})
+	}
+	return keys, nil
+}
+
+// verifySignature checks the JWS signature using the algorithm from the
+// token header (RFC 7518 Section 3). The "none" and HMAC algorithms are not
+// supported.
+func verifySignature(alg string, key crypto.PublicKey, signingInput, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if !ed25519.Verify(edKey, signingInput, sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch alg[0] {
+	case 'R', 'P':
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(rsaKey, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(rsaKey, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	default: // 'E'
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature size")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// splitJWT splits the compact JWS serialization into the decoded header,
+// claims and signature.
+func splitJWT(token string) (header jwtHeader, claims map[string]interface{}, signingInput, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtHeader{}, nil, nil, nil, errors.New("not a JWT")
+	}
+
+	headerBlob, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("malformed header: %w", err)
+	}
+	if err := json.Unmarshal(headerBlob, &header); err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("malformed header: %w", err)
+	}
+
+	claimsBlob, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(claimsBlob)))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("malformed claims: %w", err)
+	}
+
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	return header, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// looksLikeJWT reports whether the token is in the JWS compact
+// serialization form. Opaque tokens are usually not.
+func looksLikeJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil
+}
@@ -0,0 +1,426 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package oauth2 implements the auth.oauth2 module that checks OAuth 2.0
+// bearer tokens either by verifying JWT signatures using the JSON Web Key Set
+// published by the authorization server or by using the token introspection
+// endpoint (RFC 7662).
+package oauth2
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	modName = "auth.oauth2"
+
+	// clockSkew is the allowed difference between the local clock and the
+	// authorization server clock for exp and nbf checks.
+	clockSkew = 1 * time.Minute
+
+	// minForcedRefresh limits how often the key set is fetched if the token
+	// references an unknown key.
+	minForcedRefresh = 1 * time.Minute
+
+	// maxResponseSize limits the size of the JWKS and introspection
+	// responses.
+	maxResponseSize = 1024 * 1024
+)
+
+type Auth struct {
+	instName string
+	log      log.Logger
+
+	jwksURL       string
+	jwksRefresh   time.Duration
+	issuer        string
+	audience      []string
+	usernameClaim string
+
+	introspectionURL string
+	clientID         string
+	clientSecret     string
+
+	client *http.Client
+
+	keysLock      sync.Mutex
+	keys          []verificationKey
+	keysFetched   time.Time
+	keysRefreshed time.Time
+
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var (
+		tlsConfig      tls.Config
+		requestTimeout time.Duration
+	)
+	cfg.String("jwks_url", false, false, "", &a.jwksURL)
+	cfg.Duration("jwks_refresh", false, false, 1*time.Hour, &a.jwksRefresh)
+	cfg.String("issuer", false, false, "", &a.issuer)
+	cfg.StringList("audience", false, false, nil, &a.audience)
+	cfg.String("username_claim", false, false, "email", &a.usernameClaim)
+	cfg.String("introspection_url", false, false, "", &a.introspectionURL)
+	cfg.String("client_id", false, false, "", &a.clientID)
+	cfg.String("client_secret", false, false, "", &a.clientSecret)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	cfg.Duration("request_timeout", false, false, 10*time.Second, &requestTimeout)
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if a.jwksURL == "" && a.introspectionURL == "" {
+		return fmt.Errorf("%s: either jwks_url or introspection_url is required", modName)
+	}
+	for _, u := range []string{a.jwksURL, a.introspectionURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("%s: invalid URL %s: %v", modName, u, err)
+		}
+		if parsed.Scheme != "https" && parsed.Scheme != "http" {
+			return fmt.Errorf("%s: unsupported URL scheme: %s", modName, parsed.Scheme)
+		}
+	}
+	if a.jwksURL != "" {
+		// Any token issued by the authorization server (for example, to
+		// other applications) would be accepted otherwise.
+		if a.issuer == "" {
+			return fmt.Errorf("%s: issuer is required to use jwks_url", modName)
+		}
+		if len(a.audience) == 0 {
+			return fmt.Errorf("%s: audience is required to use jwks_url", modName)
+		}
+	}
+	if a.clientSecret != "" && a.clientID == "" {
+		return fmt.Errorf("%s: client_id is required to use client_secret", modName)
+	}
+
+	a.client = &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tlsConfig,
+		},
+	}
+
+	return nil
+}
+
+// AuthBearer implements module.BearerAuth.
+func (a *Auth) AuthBearer(token string) (string, error) {
+	if a.jwksURL != "" && looksLikeJWT(token) {
+		return a.verifyJWT(token)
+	}
+	if a.introspectionURL != "" {
+		return a.introspect(token)
+	}
+	return "", module.ErrUnknownCredentials
+}
+
+func (a *Auth) fetch(req *http.Request) ([]byte, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, exterrors.WithTemporary(err, true)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, exterrors.WithTemporary(err, true)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Errors reported by the server are not client errors (even 401
+		// means misconfigured client_id and client_secret).
+		return nil, exterrors.WithTemporary(fmt.Errorf("%s: unexpected status: %s", req.URL, resp.Status), true)
+	}
+	return body, nil
+}
+
+// signingKeys returns the keys from the JWKS, fetching it if the cached copy
+// is too old. If force is set, the key set is fetched unless it was fetched
+// recently.
+func (a *Auth) signingKeys(force bool) ([]verificationKey, error) {
+	a.keysLock.Lock()
+	defer a.keysLock.Unlock()
+
+	now := a.now()
+	stale := a.keys == nil || now.Sub(a.keysFetched) > a.jwksRefresh
+	if force && now.Sub(a.keysRefreshed) > minForcedRefresh {
+		stale = true
+	}
+	if !stale {
+		return a.keys, nil
+	}
+
+	req, err := http.NewRequest("GET", a.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.keysRefreshed = now
+	blob, err := a.fetch(req)
+	if err != nil {
+		if a.keys != nil {
+			// Keep using the old key set.
+			a.log.Error("failed to refresh JWKS", err)
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	keys, err := parseJWKS(blob)
+	if err != nil {
+		err = exterrors.WithTemporary(fmt.Errorf("malformed JWKS: %w", err), true)
+		if a.keys != nil {
+			a.log.Error("failed to refresh JWKS", err)
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	a.log.DebugMsg("fetched JWKS", "keys", len(keys))
+
+	a.keys = keys
+	a.keysFetched = now
+	return a.keys, nil
+}
+
+func matchKeys(keys []verificationKey, header jwtHeader) []verificationKey {
+	var matching []verificationKey
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		matching = append(matching, k)
+	}
+	return matching
+}
+
+func (a *Auth) verifyJWT(token string) (string, error) {
+	header, claims, signingInput, sig, err := splitJWT(token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", module.ErrUnknownCredentials, err)
+	}
+
+	keys, err := a.signingKeys(false)
+	if err != nil {
+		return "", err
+	}
+	matching := matchKeys(keys, header)
+	if len(matching) == 0 {
+		// Keys may have been rotated.
+		keys, err = a.signingKeys(true)
+		if err != nil {
+			return "", err
+		}
+		matching = matchKeys(keys, header)
+	}
+	if len(matching) == 0 {
+		return "", fmt.Errorf("%w: no matching key for kid %q", module.ErrUnknownCredentials, header.Kid)
+	}
+
+	verified := false
+	for _, k := range matching {
+		err = verifySignature(header.Alg, k.key, signingInput, sig)
+		if err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", fmt.Errorf("%w: %v", module.ErrUnknownCredentials, err)
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return "", fmt.Errorf("%w: missing exp claim", module.ErrUnknownCredentials)
+	}
+	if _, ok := claims["iss"]; !ok {
+		return "", fmt.Errorf("%w: missing iss claim", module.ErrUnknownCredentials)
+	}
+	if _, ok := claims["aud"]; !ok {
+		return "", fmt.Errorf("%w: missing aud claim", module.ErrUnknownCredentials)
+	}
+	return a.checkClaims(claims)
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// checkClaims validates exp, nbf, iss and aud claims, if they are present,
+// and returns the username.
+func (a *Auth) checkClaims(claims map[string]interface{}) (string, error) {
+	now := a.now()
+
+	if v, ok := claims["exp"]; ok {
+		exp, ok := numericDate(v)
+		if !ok {
+			return "", fmt.Errorf("%w: malformed exp claim", module.ErrUnknownCredentials)
+		}
+		if now.After(exp.Add(clockSkew)) {
+			return "", fmt.Errorf("%w: token is expired", module.ErrUnknownCredentials)
+		}
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, ok := numericDate(v)
+		if !ok {
+			return "", fmt.Errorf("%w: malformed nbf claim", module.ErrUnknownCredentials)
+		}
+		if now.Add(clockSkew).Before(nbf) {
+			return "", fmt.Errorf("%w: token is not valid yet", module.ErrUnknownCredentials)
+		}
+	}
+
+	if v, ok := claims["iss"]; ok && a.issuer != "" {
+		if iss, _ := v.(string); iss != a.issuer {
+			return "", fmt.Errorf("%w: unexpected issuer: %v", module.ErrUnknownCredentials, v)
+		}
+	}
+
+	if v, ok := claims["aud"]; ok && len(a.audience) != 0 {
+		var aud []string
+		switch v := v.(type) {
+		case string:
+			aud = []string{v}
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					aud = append(aud, s)
+				}
+			}
+		}
+		if !matchAudience(aud, a.audience) {
+			return "", fmt.Errorf("%w: unexpected audience: %v", module.ErrUnknownCredentials, v)
+		}
+	}
+
+	username, _ := claims[a.usernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("%w: missing %s claim", module.ErrUnknownCredentials, a.usernameClaim)
+	}
+	if a.usernameClaim == "email" {
+		// OpenID Connect Core 1.0, Section 5.1.
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "", fmt.Errorf("%w: email is not verified", module.ErrUnknownCredentials)
+		}
+	}
+
+	return username, nil
+}
+
+func matchAudience(aud, allowed []string) bool {
+	for _, a := range aud {
+		for _, b := range allowed {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// introspect checks the token using the token introspection endpoint
+// (RFC 7662).
+func (a *Auth) introspect(token string) (string, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest("POST", a.introspectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if a.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	}
+
+	blob, err := a.fetch(req)
+	if err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(string(blob)))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return "", exterrors.WithTemporary(fmt.Errorf("malformed introspection response: %w", err), true)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		return "", fmt.Errorf("%w: token is not active", module.ErrUnknownCredentials)
+	}
+	if tokenType, _ := claims["token_type"].(string); tokenType == "refresh_token" {
+		return "", fmt.Errorf("%w: refresh token used", module.ErrUnknownCredentials)
+	}
+
+	return a.checkClaims(claims)
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,337 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testTime = time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+}
+
+func genKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey, ed: edKey}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pad(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func (k testKeys) jwks() []byte {
+	blob, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "rsa", "use": "sig", "alg": "RS256",
+				"n": b64(k.rsa.N.Bytes()),
+				"e": b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+			},
+			{
+				"kty": "EC", "kid": "ec", "crv": "P-256",
+				"x": b64(pad(k.ec.X, 32)),
+				"y": b64(pad(k.ec.Y, 32)),
+			},
+			{
+				"kty": "OKP", "kid": "ed", "crv": "Ed25519",
+				"x": b64(k.ed.Public().(ed25519.PublicKey)),
+			},
+			{
+				"kty": "oct", "kid": "hmac", "k": "c2VjcmV0",
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return blob
+}
+
+func (k testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(body)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err == nil {
+			sig = append(pad(r, 32), pad(s, 32)...)
+		}
+	case "EdDSA":
+		sig = ed25519.Sign(k.ed, []byte(signingInput))
+	case "none":
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + b64(sig)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://idp.example.org",
+		"aud":   []string{"other", "maddy"},
+		"exp":   testTime.Add(time.Hour).Unix(),
+		"email": "user@example.org",
+	}
+}
+
+func testAuth(t *testing.T, cfg []config.Node) *Auth {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	a.now = func() time.Time { return testTime }
+	if err := a.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func jwksConfig(url string) []config.Node {
+	return []config.Node{
+		{Name: "jwks_url", Args: []string{url}},
+		{Name: "issuer", Args: []string{"https://idp.example.org"}},
+		{Name: "audience", Args: []string{"maddy"}},
+	}
+}
+
+func TestAuthBearer_JWT(t *testing.T) {
+	keys := genKeys(t)
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(keys.jwks())
+	}))
+	defer srv.Close()
+
+	a := testAuth(t, jwksConfig(srv.URL))
+
+	for _, alg := range []struct{ alg, kid string }{
+		{"RS256", "rsa"},
+		{"ES256", "ec"},
+		{"EdDSA", "ed"},
+	} {
+		username, err := a.AuthBearer(keys.sign(t, alg.alg, alg.kid, validClaims()))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", alg.alg, err)
+		}
+		if username != "user@example.org" {
+			t.Fatalf("%s: wrong username: %s", alg.alg, username)
+		}
+	}
+	if fetches != 1 {
+		t.Fatal("JWKS is not cached, fetches:", fetches)
+	}
+
+	check := func(name, token string) {
+		t.Helper()
+		if _, err := a.AuthBearer(token); !errors.Is(err, module.ErrUnknownCredentials) {
+			t.Errorf("%s: expected ErrUnknownCredentials, got %v", name, err)
+		}
+	}
+	modified := func(f func(claims map[string]interface{})) map[string]interface{} {
+		claims := validClaims()
+		f(claims)
+		return claims
+	}
+
+	check("expired", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		c["exp"] = testTime.Add(-time.Hour).Unix()
+	})))
+	check("no exp", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		delete(c, "exp")
+	})))
+	check("nbf", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		c["nbf"] = testTime.Add(time.Hour).Unix()
+	})))
+	check("issuer", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		c["iss"] = "https://evil.example.org"
+	})))
+	check("audience", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		c["aud"] = "other"
+	})))
+	check("no email", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		delete(c, "email")
+	})))
+	check("email not verified", keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		c["email_verified"] = false
+	})))
+	check("alg none", keys.sign(t, "none", "rsa", validClaims()))
+	check("wrong alg for the key", keys.sign(t, "PS256", "rsa", validClaims()))
+
+	// Claims are replaced, signature is kept.
+	valid := strings.Split(keys.sign(t, "RS256", "rsa", validClaims()), ".")
+	other := strings.Split(keys.sign(t, "RS256", "rsa", modified(func(c map[string]interface{}) {
+		c["email"] = "admin@example.org"
+	})), ".")
+	check("bad signature", valid[0]+"."+other[1]+"."+valid[2])
+	check("not a token", "aaaa.bbbb.cccc")
+
+	// Unknown key triggers the refresh, but it is rate-limited.
+	a.now = func() time.Time { return testTime.Add(2 * time.Minute) }
+	check("unknown kid", keys.sign(t, "RS256", "rsa2", validClaims()))
+	check("unknown kid", keys.sign(t, "RS256", "rsa2", validClaims()))
+	if fetches != 2 {
+		t.Fatal("Wrong amount of JWKS fetches:", fetches)
+	}
+}
+
+func TestAuthBearer_JWKSUnavailable(t *testing.T) {
+	keys := genKeys(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	a := testAuth(t, jwksConfig(srv.URL))
+	_, err := a.AuthBearer(keys.sign(t, "RS256", "rsa", validClaims()))
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+}
+
+func TestAuthBearer_Introspection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "maddy" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		resp := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "valid":
+			resp = map[string]interface{}{
+				"active":   true,
+				"username": "user",
+				"email":    "user@example.org",
+				"exp":      testTime.Add(time.Hour).Unix(),
+			}
+		case "expired":
+			resp = map[string]interface{}{
+				"active": true,
+				"email":  "user@example.org",
+				"exp":    testTime.Add(-time.Hour).Unix(),
+			}
+		case "refresh":
+			resp = map[string]interface{}{
+				"active":     true,
+				"email":      "user@example.org",
+				"token_type": "refresh_token",
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	a := testAuth(t, []config.Node{
+		{Name: "introspection_url", Args: []string{srv.URL}},
+		{Name: "client_id", Args: []string{"maddy"}},
+		{Name: "client_secret", Args: []string{"secret"}},
+	})
+
+	username, err := a.AuthBearer("valid")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if username != "user@example.org" {
+		t.Fatal("Wrong username:", username)
+	}
+	for _, token := range []string{"invalid", "expired", "refresh"} {
+		if _, err := a.AuthBearer(token); !errors.Is(err, module.ErrUnknownCredentials) {
+			t.Errorf("%s: expected ErrUnknownCredentials, got %v", token, err)
+		}
+	}
+
+	a.clientSecret = "wrong"
+	if _, err := a.AuthBearer("valid"); !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+}
+
+func TestInit_JWKSRequiresAudience(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "jwks_url", Args: []string{"https://idp.example.org/jwks"}},
+		{Name: "issuer", Args: []string{"https://idp.example.org"}},
+	}}))
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+}
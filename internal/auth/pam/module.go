@@ -19,21 +19,30 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pam
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/auth/external"
 )
 
 type Auth struct {
-	instName   string
-	useHelper  bool
-	helperPath string
+	instName         string
+	useHelper        bool
+	persistentHelper bool
+	helperPath       string
+	helperTimeout    time.Duration
+	domain           string
+
+	helper *external.HelperProcess
+	cache  *auth.CredsCache
 
 	Log log.Logger
 }
@@ -59,9 +68,24 @@ func (a *Auth) InstanceName() string {
 func (a *Auth) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &a.Log.Debug)
 	cfg.Bool("use_helper", false, false, &a.useHelper)
+	cfg.Bool("persistent_helper", false, false, &a.persistentHelper)
+	cfg.Duration("helper_timeout", false, false, 10*time.Second, &a.helperTimeout)
+	cfg.String("domain", false, false, "", &a.domain)
+	var cacheTTL time.Duration
+	cfg.Duration("cache_ttl", false, false, 30*time.Second, &cacheTTL)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if a.persistentHelper && !a.useHelper {
+		return errors.New("pam: persistent_helper requires use_helper")
+	}
+
+	var err error
+	a.cache, err = auth.NewCredsCache(cacheTTL, 0, 0)
+	if err != nil {
+		return fmt.Errorf("pam: %w", err)
+	}
+
 	if !canCallDirectly && !a.useHelper {
 		return errors.New("pam: this build lacks support for direct libpam invocation, use helper binary")
 	}
@@ -71,21 +95,48 @@ func (a *Auth) Init(cfg *config.Map) error {
 		if _, err := os.Stat(a.helperPath); err != nil {
 			return fmt.Errorf("pam: no helper binary (maddy-pam-helper) found in %s", config.LibexecDirectory)
 		}
+		if a.persistentHelper {
+			a.helper = external.NewHelperProcess(a.helperPath, a.helperTimeout, a.Log)
+		}
 	}
 
 	return nil
 }
 
 func (a *Auth) AuthPlain(username, password string) error {
-	if a.useHelper {
-		if err := external.AuthUsingHelper(a.helperPath, username, password); err != nil {
-			return err
-		}
+	sysName, ok := auth.SystemUsername(username, a.domain)
+	if !ok {
+		return module.ErrUnknownCredentials
+	}
+
+	if a.cache.Check(sysName, password) {
+		a.Log.DebugMsg("using cached authentication result", "username", sysName)
+		return nil
+	}
+
+	var err error
+	switch {
+	case a.helper != nil:
+		err = a.helper.AuthPlain(sysName, password)
+	case a.useHelper:
+		ctx, cancel := context.WithTimeout(context.Background(), a.helperTimeout)
+		err = external.AuthUsingHelper(ctx, a.helperPath, sysName, password)
+		cancel()
+	default:
+		err = runPAMAuth(sysName, password)
 	}
-	err := runPAMAuth(username, password)
 	if err != nil {
 		return err
 	}
+
+	a.cache.Add(sysName, password)
+	return nil
+}
+
+func (a *Auth) Close() error {
+	if a.helper != nil {
+		return a.helper.Close()
+	}
 	return nil
 }
 
@@ -0,0 +1,306 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	// appPasswordLen is the amount of random bytes in generated app
+	// passwords.
+	appPasswordLen = 15
+
+	// appPasswordUsedPrecision is the precision of AppPassword.LastUsed.
+	// The timestamp is not updated more often to avoid writing to the
+	// table on each login.
+	appPasswordUsedPrecision = time.Hour
+)
+
+var (
+	appPasswordName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+	appPasswordServices = []string{module.ServiceIMAP, module.ServiceSMTP, module.ServicePOP3}
+
+	appPasswordEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// AppPassword is the application-specific password entry, as stored in the
+// app_passwords table.
+type AppPassword struct {
+	Name string
+	// Hash is the salted SHA-256 hash of the password. Passwords are random
+	// so slower hash functions are not needed.
+	Hash string
+	// Services the password is valid for. Empty list means all services.
+	Services []string `json:",omitempty"`
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// ValidFor reports whether the password can be used for the service.
+func (ap AppPassword) ValidFor(service string) bool {
+	if len(ap.Services) == 0 {
+		return true
+	}
+	for _, s := range ap.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+func checkServices(services []string) error {
+outer:
+	for _, s := range services {
+		for _, known := range appPasswordServices {
+			if s == known {
+				continue outer
+			}
+		}
+		return fmt.Errorf("unknown service: %s (known: %s)", s, strings.Join(appPasswordServices, ", "))
+	}
+	return nil
+}
+
+func (a *Auth) readAppPasswords(key string) ([]AppPassword, error) {
+	val, ok, err := a.appTable.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	var list []AppPassword
+	if err := json.Unmarshal([]byte(val), &list); err != nil {
+		return nil, fmt.Errorf("malformed app passwords entry: %w", err)
+	}
+	return list, nil
+}
+
+func (a *Auth) writeAppPasswords(key string, list []AppPassword) error {
+	tbl, ok := a.appTable.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("app_passwords table is not mutable, no management functionality available")
+	}
+	if len(list) == 0 {
+		return tbl.RemoveKey(key)
+	}
+	val, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(key, string(val))
+}
+
+// authAppPassword checks the password against app passwords of the user
+// valid for the service.
+func (a *Auth) authAppPassword(service, key, password string) (bool, error) {
+	list, err := a.readAppPasswords(key)
+	if err != nil {
+		return false, fmt.Errorf("%s: auth plain %s: %w", a.modName, key, err)
+	}
+
+	for _, ap := range list {
+		if !ap.ValidFor(service) {
+			continue
+		}
+		if verifySHA256(password, ap.Hash) != nil {
+			continue
+		}
+
+		a.log.DebugMsg("app password used", "username", key, "app_password", ap.Name, "service", service)
+		if time.Since(ap.LastUsed) > appPasswordUsedPrecision {
+			a.markAppPasswordUsed(key, ap.Name)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// markAppPasswordUsed updates the last used timestamp. Failures are logged
+// and do not affect the authentication.
+func (a *Auth) markAppPasswordUsed(key, name string) {
+	if _, ok := a.appTable.(module.MutableTable); !ok {
+		return
+	}
+
+	// Re-read the list to not overwrite concurrent changes.
+	list, err := a.readAppPasswords(key)
+	if err != nil {
+		a.log.Error("app password timestamp update failed", err, "username", key)
+		return
+	}
+	for i := range list {
+		if list[i].Name == name {
+			list[i].LastUsed = time.Now()
+		}
+	}
+	if err := a.writeAppPasswords(key, list); err != nil {
+		a.log.Error("app password timestamp update failed", err, "username", key)
+	}
+}
+
+func (a *Auth) appPasswordKey(username string) (string, error) {
+	if a.appTable == nil {
+		return "", fmt.Errorf("%s: app passwords are not enabled, set app_passwords", a.modName)
+	}
+	return precis.UsernameCaseMapped.CompareKey(username)
+}
+
+// ListAppPasswords returns app passwords of the user.
+func (a *Auth) ListAppPasswords(username string) ([]AppPassword, error) {
+	key, err := a.appPasswordKey(username)
+	if err != nil {
+		return nil, err
+	}
+	list, err := a.readAppPasswords(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: list app passwords %s: %w", a.modName, key, err)
+	}
+	return list, nil
+}
+
+// CreateAppPassword generates the new app password for the user valid for
+// the specified services (all if none are specified) and returns it.
+func (a *Auth) CreateAppPassword(username, name string, services []string) (string, error) {
+	key, err := a.appPasswordKey(username)
+	if err != nil {
+		return "", err
+	}
+	if !appPasswordName.MatchString(name) {
+		return "", fmt.Errorf("%s: create app password %s: invalid name, only letters, digits, '.', '_' and '-' are allowed", a.modName, key)
+	}
+	if err := checkServices(services); err != nil {
+		return "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+
+	_, ok, err := a.table.Lookup(key)
+	if err != nil {
+		return "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	if !ok {
+		return "", fmt.Errorf("%s: create app password %s: no such user", a.modName, key)
+	}
+
+	list, err := a.readAppPasswords(key)
+	if err != nil {
+		return "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	for _, ap := range list {
+		if ap.Name == name {
+			return "", fmt.Errorf("%s: create app password %s: %s already exists", a.modName, key, name)
+		}
+	}
+
+	raw := make([]byte, appPasswordLen)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	password := appPasswordEncoding.EncodeToString(raw)
+	hash, err := computeSHA256(HashOpts{}, password)
+	if err != nil {
+		return "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+
+	list = append(list, AppPassword{
+		Name:     name,
+		Hash:     hash,
+		Services: services,
+		Created:  time.Now(),
+	})
+	if err := a.writeAppPasswords(key, list); err != nil {
+		return "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	return password, nil
+}
+
+// RevokeAppPassword removes the app password of the user.
+func (a *Auth) RevokeAppPassword(username, name string) error {
+	key, err := a.appPasswordKey(username)
+	if err != nil {
+		return err
+	}
+	list, err := a.readAppPasswords(key)
+	if err != nil {
+		return fmt.Errorf("%s: revoke app password %s: %w", a.modName, key, err)
+	}
+
+	newList := list[:0]
+	for _, ap := range list {
+		if ap.Name != name {
+			newList = append(newList, ap)
+		}
+	}
+	if len(newList) == len(list) {
+		return fmt.Errorf("%s: revoke app password %s: no such app password: %s", a.modName, key, name)
+	}
+	if err := a.writeAppPasswords(key, newList); err != nil {
+		return fmt.Errorf("%s: revoke app password %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
+// RevokeStaleAppPasswords removes app passwords of the user not used since
+// the specified time and returns their names. Passwords that were never
+// used are removed based on their creation time.
+func (a *Auth) RevokeStaleAppPasswords(username string, since time.Time) ([]string, error) {
+	key, err := a.appPasswordKey(username)
+	if err != nil {
+		return nil, err
+	}
+	list, err := a.readAppPasswords(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: revoke app passwords %s: %w", a.modName, key, err)
+	}
+
+	var (
+		revoked []string
+		newList = make([]AppPassword, 0, len(list))
+	)
+	for _, ap := range list {
+		lastUsed := ap.LastUsed
+		if lastUsed.IsZero() {
+			lastUsed = ap.Created
+		}
+		if lastUsed.Before(since) {
+			revoked = append(revoked, ap.Name)
+			continue
+		}
+		newList = append(newList, ap)
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+	if err := a.writeAppPasswords(key, newList); err != nil {
+		return nil, fmt.Errorf("%s: revoke app passwords %s: %w", a.modName, key, err)
+	}
+	return revoked, nil
+}
@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestAuth_AppPasswords(t *testing.T) {
+	mod, err := New("pass_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	err = a.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "table", Args: []string{"dummy"}},
+			{Name: "app_passwords", Args: []string{"dummy"}},
+			{Name: "require_app_password", Args: []string{"imap", "smtp"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.table = testutils.Table{M: map[string]string{
+		"user": "{PLAIN}password",
+	}}
+	appTbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.appTable = appTbl
+
+	check := func(service, pass string, ok bool) {
+		t.Helper()
+		_, err := a.AuthPlainService(service, "User", pass)
+		if (err == nil) != ok {
+			t.Errorf("service=%s, ok=%v, err: %v", service, ok, err)
+		}
+	}
+
+	if _, err := a.CreateAppPassword("nobody", "phone", nil); err == nil {
+		t.Fatal("App password created for unknown user")
+	}
+	if _, err := a.CreateAppPassword("user", "phone", []string{"webmail"}); err == nil {
+		t.Fatal("Unknown service accepted")
+	}
+	phone, err := a.CreateAppPassword("User", "phone", []string{"imap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := a.CreateAppPassword("user", "laptop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.CreateAppPassword("user", "laptop", nil); err == nil {
+		t.Fatal("Duplicate name accepted")
+	}
+
+	check(module.ServiceIMAP, "password", false)
+	check(module.ServiceSMTP, "password", false)
+	check(module.ServicePOP3, "password", true)
+	check("", "password", true)
+
+	check(module.ServiceIMAP, phone, true)
+	check(module.ServiceSMTP, phone, false)
+	check("", phone, false)
+	check(module.ServiceSMTP, laptop, true)
+	check("", laptop, true)
+	check(module.ServiceIMAP, "wrong", false)
+
+	list, err := a.ListAppPasswords("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "phone" || list[0].LastUsed.IsZero() {
+		t.Fatalf("Unexpected list: %+v", list)
+	}
+
+	if err := a.RevokeAppPassword("user", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RevokeAppPassword("user", "phone"); err == nil {
+		t.Fatal("Revoking non-existent password succeeded")
+	}
+	check(module.ServiceIMAP, phone, false)
+
+	revoked, err := a.RevokeStaleAppPasswords("user", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 0 {
+		t.Fatal("Recently used password revoked:", revoked)
+	}
+	revoked, err = a.RevokeStaleAppPasswords("user", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0] != "laptop" {
+		t.Fatal("Unexpected revoked list:", revoked)
+	}
+	if len(appTbl.M) != 0 {
+		t.Fatal("Empty entry is not removed:", appTbl.M)
+	}
+}
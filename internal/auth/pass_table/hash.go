@@ -28,6 +28,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/GehirnInc/crypt"
+	"github.com/GehirnInc/crypt/sha512_crypt"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -37,10 +39,29 @@ const (
 	HashBcrypt = "bcrypt"
 	HashArgon2 = "argon2"
 
+	// HashSHA512Crypt is the crypt(3) SHA-512 scheme ("$6$"), used by
+	// default on most Linux systems and by Dovecot's SHA512-CRYPT.
+	HashSHA512Crypt = "sha512-crypt"
+
+	// HashPlain is the plain-text password. It can be only verified and
+	// exists to support entries imported or written manually using the
+	// Dovecot {PLAIN} scheme.
+	HashPlain = "plain"
+
+	// HashMustReset is not a real hash function. It marks entries that were
+	// imported from a foreign format using an unsupported scheme. The
+	// original value is kept after the tag for reference but authentication
+	// always fails until the password is reset.
+	HashMustReset = "must-reset"
+
 	DefaultHash = HashBcrypt
 
 	Argon2Salt = 16
 	Argon2Size = 64
+
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 1024
+	DefaultArgon2Threads = 1
 )
 
 type (
@@ -64,17 +85,115 @@ type (
 
 var (
 	HashCompute = map[string]FuncHashCompute{
-		HashBcrypt: computeBcrypt,
-		HashArgon2: computeArgon2,
+		HashBcrypt:      computeBcrypt,
+		HashArgon2:      computeArgon2,
+		HashSHA512Crypt: computeSHA512Crypt,
 	}
 	HashVerify = map[string]FuncHashVerify{
-		HashBcrypt: verifyBcrypt,
-		HashArgon2: verifyArgon2,
+		HashBcrypt:      verifyBcrypt,
+		HashArgon2:      verifyArgon2,
+		HashSHA512Crypt: verifySHA512Crypt,
+		HashPlain:       verifyPlain,
 	}
 
-	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2}
+	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2, HashSHA512Crypt}
+
+	// DefaultHashOpts contains parameters used for new passwords unless
+	// configured otherwise.
+	DefaultHashOpts = HashOpts{
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Time:    DefaultArgon2Time,
+		Argon2Memory:  DefaultArgon2Memory,
+		Argon2Threads: DefaultArgon2Threads,
+	}
+
+	// dovecotSchemes maps Dovecot password scheme names to hash functions
+	// that can verify them.
+	dovecotSchemes = map[string]string{
+		"BLF-CRYPT":    HashBcrypt,
+		"BCRYPT":       HashBcrypt,
+		"SHA512-CRYPT": HashSHA512Crypt,
+		"ARGON2ID":     HashArgon2,
+		"PLAIN":        HashPlain,
+		"CLEARTEXT":    HashPlain,
+		"CLEAR":        HashPlain,
+	}
 )
 
+// ParseHash splits the stored password hash into the hash function name and
+// the value passed to the verification function.
+//
+// Two forms are supported: the native "function:value" one and the
+// "{SCHEME}value" one used by Dovecot. Dovecot schemes are mapped onto
+// the corresponding hash functions, {CRYPT} is mapped using the crypt(3)
+// prefix of the value. Unknown Dovecot schemes are reported as an error.
+func ParseHash(hash string) (string, string, error) {
+	if strings.HasPrefix(hash, "{") {
+		end := strings.IndexByte(hash, '}')
+		if end == -1 {
+			return "", "", fmt.Errorf("pass_table: malformed scheme prefix")
+		}
+		scheme := strings.ToUpper(hash[1:end])
+		value := hash[end+1:]
+
+		if scheme == "CRYPT" {
+			if fn := cryptFunc(value); fn != "" {
+				return fn, value, nil
+			}
+			return "", "", fmt.Errorf("pass_table: unsupported crypt(3) function")
+		}
+		fn, ok := dovecotSchemes[scheme]
+		if !ok {
+			return "", "", fmt.Errorf("pass_table: unsupported scheme: %s", scheme)
+		}
+		return fn, value, nil
+	}
+
+	parts := strings.SplitN(hash, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("pass_table: no hash tag")
+	}
+	return parts[0], parts[1], nil
+}
+
+// cryptFunc detects the hash function using the crypt(3) prefix of the
+// value. Empty string is returned for unsupported functions.
+func cryptFunc(value string) string {
+	switch {
+	case strings.HasPrefix(value, sha512_crypt.MagicPrefix):
+		return HashSHA512Crypt
+	case isBcrypt(value):
+		return HashBcrypt
+	}
+	return ""
+}
+
+// NeedsRehash reports whether the hash computed using the function fn should
+// be replaced with the one computed using defaultFn and opts, either because
+// the different function is preferred or because the hash parameters are
+// weaker than configured.
+func NeedsRehash(fn, hashSalt, defaultFn string, opts HashOpts) bool {
+	if fn != defaultFn {
+		return true
+	}
+
+	switch fn {
+	case HashBcrypt:
+		cost, err := bcrypt.Cost([]byte(hashSalt))
+		if err != nil {
+			return false
+		}
+		return cost < opts.BcryptCost
+	case HashArgon2:
+		time, memory, threads, _, _, err := parseArgon2(hashSalt)
+		if err != nil {
+			return false
+		}
+		return time < opts.Argon2Time || memory < opts.Argon2Memory || threads < opts.Argon2Threads
+	}
+	return false
+}
+
 func computeArgon2(opts HashOpts, pass string) (string, error) {
 	salt := make([]byte, Argon2Salt)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
@@ -95,31 +214,96 @@ func computeArgon2(opts HashOpts, pass string) (string, error) {
 	return out.String(), nil
 }
 
-func verifyArgon2(pass, hashSalt string) error {
+// parseArgon2 parses the argon2 hash string either in the native
+// "time:memory:threads:salt:hash" form or in the PHC string form
+// ("$argon2id$v=19$m=...,t=...,p=...$salt$hash") used by Dovecot and
+// libargon2.
+func parseArgon2(hashSalt string) (time, memory uint32, threads uint8, salt, hash []byte, err error) {
+	if strings.HasPrefix(hashSalt, "$") {
+		return parseArgon2PHC(hashSalt)
+	}
+
 	parts := strings.SplitN(hashSalt, ":", 5)
+	if len(parts) != 5 {
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string, expected 5 fields")
+	}
 
-	time, err := strconv.ParseUint(parts[0], 10, 32)
+	timeVal, err := strconv.ParseUint(parts[0], 10, 32)
 	if err != nil {
-		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
 	}
-	memory, err := strconv.ParseUint(parts[1], 10, 32)
+	memoryVal, err := strconv.ParseUint(parts[1], 10, 32)
 	if err != nil {
-		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
 	}
-	threads, err := strconv.ParseUint(parts[2], 10, 8)
+	threadsVal, err := strconv.ParseUint(parts[2], 10, 8)
 	if err != nil {
-		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
 	}
-	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	salt, err = base64.StdEncoding.DecodeString(parts[3])
 	if err != nil {
-		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
 	}
-	hash, err := base64.StdEncoding.DecodeString(parts[4])
+	hash, err = base64.StdEncoding.DecodeString(parts[4])
 	if err != nil {
-		return fmt.Errorf("pass_table: malformed hash string: %w", err)
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
 	}
+	return uint32(timeVal), uint32(memoryVal), uint8(threadsVal), salt, hash, nil
+}
 
-	passHash := argon2.IDKey([]byte(pass), salt, uint32(time), uint32(memory), uint8(threads), Argon2Size)
+func parseArgon2PHC(hashSalt string) (time, memory uint32, threads uint8, salt, hash []byte, err error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=1", salt, hash
+	parts := strings.Split(hashSalt, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string, not an argon2id PHC string")
+	}
+	if parts[2] != "v=19" {
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: unsupported argon2 version: %s", parts[2])
+	}
+
+	for _, param := range strings.Split(parts[3], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string, invalid parameter: %s", param)
+		}
+		val, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
+		}
+		switch kv[0] {
+		case "m":
+			memory = uint32(val)
+		case "t":
+			time = uint32(val)
+		case "p":
+			if val > 255 {
+				return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string, too many threads")
+			}
+			threads = uint8(val)
+		}
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
+	}
+	hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("pass_table: malformed hash string: %w", err)
+	}
+	return time, memory, threads, salt, hash, nil
+}
+
+func verifyArgon2(pass, hashSalt string) error {
+	time, memory, threads, salt, hash, err := parseArgon2(hashSalt)
+	if err != nil {
+		return err
+	}
+	if len(hash) == 0 {
+		return fmt.Errorf("pass_table: malformed hash string, empty hash")
+	}
+
+	passHash := argon2.IDKey([]byte(pass), salt, time, memory, threads, uint32(len(hash)))
 	if subtle.ConstantTimeCompare(passHash, hash) != 1 {
 		return fmt.Errorf("pass_table: hash mismatch")
 	}
@@ -174,6 +358,31 @@ func verifyBcrypt(pass, hashSalt string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashSalt), []byte(pass))
 }
 
+func computeSHA512Crypt(_ HashOpts, pass string) (string, error) {
+	return sha512_crypt.New().Generate([]byte(pass), nil)
+}
+
+func verifySHA512Crypt(pass, hashSalt string) error {
+	if !strings.HasPrefix(hashSalt, sha512_crypt.MagicPrefix) {
+		return fmt.Errorf("pass_table: malformed hash string, not a SHA-512 crypt hash")
+	}
+	err := sha512_crypt.New().Verify(hashSalt, []byte(pass))
+	if err == crypt.ErrKeyMismatch {
+		return fmt.Errorf("pass_table: hash mismatch")
+	}
+	return err
+}
+
+func verifyPlain(pass, hashSalt string) error {
+	if hashSalt == "" {
+		return fmt.Errorf("pass_table: empty password")
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(hashSalt)) != 1 {
+		return fmt.Errorf("pass_table: hash mismatch")
+	}
+	return nil
+}
+
 func addSHA256() {
 	HashCompute[HashSHA256] = computeSHA256
 	HashVerify[HashSHA256] = verifySHA256
@@ -0,0 +1,166 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// FormatHtpasswd is the Apache htpasswd format: "user:hash" per line.
+	FormatHtpasswd = "htpasswd"
+
+	// FormatDovecot is the Dovecot passwd-file format:
+	// "user:{SCHEME}hash:uid:gid:gecos:home:shell:extra" per line. Only the
+	// first two fields are used.
+	FormatDovecot = "dovecot"
+)
+
+// ImportEntry is a single credentials entry read from a foreign
+// credentials file.
+type ImportEntry struct {
+	// Line number in the source file, for error reporting.
+	Line int
+
+	Username string
+
+	// Hash is the value in pass_table format ("tag:value"). For entries
+	// using unsupported schemes, it is tagged with HashMustReset.
+	Hash string
+
+	// Supported is false if the original hash scheme can't be verified by
+	// pass_table and the entry requires a password reset.
+	Supported bool
+
+	// Err is set if the line cannot be parsed at all. Other fields are
+	// undefined in this case.
+	Err error
+}
+
+// ReadImport parses the credentials file in the specified format.
+//
+// Errors related to the individual lines are reported via ImportEntry.Err,
+// returned error is non-nil only if the input can't be read at all.
+func ReadImport(r io.Reader, format string) ([]ImportEntry, error) {
+	if format != FormatHtpasswd && format != FormatDovecot {
+		return nil, fmt.Errorf("pass_table: unknown import format: %s", format)
+	}
+
+	var entries []ImportEntry
+	scnr := bufio.NewScanner(r)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := ImportEntry{Line: lineNum}
+
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || parts[0] == "" {
+			entry.Err = errors.New("malformed line, expected at least 2 colon-separated fields")
+			entries = append(entries, entry)
+			continue
+		}
+		if format == FormatHtpasswd && len(parts) != 2 {
+			entry.Err = errors.New("malformed line, expected exactly 2 colon-separated fields")
+			entries = append(entries, entry)
+			continue
+		}
+
+		entry.Username = parts[0]
+		entry.Hash, entry.Supported, entry.Err = convertHash(parts[1], format)
+		entries = append(entries, entry)
+	}
+	if err := scnr.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// convertHash maps the hash string from the foreign format onto one of the
+// pass_table hash functions.
+func convertHash(value, format string) (string, bool, error) {
+	if value == "" {
+		return "", false, errors.New("empty password hash")
+	}
+
+	scheme := ""
+	if format == FormatDovecot && strings.HasPrefix(value, "{") {
+		end := strings.IndexByte(value, '}')
+		if end == -1 {
+			return "", false, errors.New("malformed scheme prefix")
+		}
+		scheme = strings.ToUpper(value[1:end])
+		value = value[end+1:]
+	}
+
+	switch scheme {
+	case "PLAIN", "CLEARTEXT", "CLEAR":
+		hash, err := computeBcrypt(HashOpts{BcryptCost: bcrypt.DefaultCost}, value)
+		if err != nil {
+			return "", false, err
+		}
+		return HashBcrypt + ":" + hash, true, nil
+	case "SHA512-CRYPT":
+		if !strings.HasPrefix(value, sha512_crypt.MagicPrefix) {
+			return "", false, errors.New("SHA512-CRYPT hash without $6$ prefix")
+		}
+		return HashSHA512Crypt + ":" + value, true, nil
+	case "BLF-CRYPT", "BCRYPT":
+		if !isBcrypt(value) {
+			return "", false, errors.New("BLF-CRYPT hash without $2?$ prefix")
+		}
+		return HashBcrypt + ":" + value, true, nil
+	case "ARGON2ID":
+		if _, _, _, _, _, err := parseArgon2PHC(value); err != nil {
+			return "", false, err
+		}
+		return HashArgon2 + ":" + value, true, nil
+	case "", "CRYPT":
+		// Detect the actual function using the crypt(3) prefix.
+		if fn := cryptFunc(value); fn != "" {
+			return fn + ":" + value, true, nil
+		}
+	}
+
+	if scheme != "" {
+		return HashMustReset + ":{" + scheme + "}" + value, false, nil
+	}
+	return HashMustReset + ":" + value, false, nil
+}
+
+func isBcrypt(value string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"strings"
+	"testing"
+)
+
+const sha512Pass = "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"
+
+func TestReadImport_Htpasswd(t *testing.T) {
+	entries, err := ReadImport(strings.NewReader(`# comment
+user1:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa
+user2:`+sha512Pass+`
+
+user3:$apr1$abcdefgh$0123456789
+malformed line
+user4:a:b
+`), FormatHtpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries, got %d: %+v", len(entries), entries)
+	}
+
+	expect := []ImportEntry{
+		{Line: 2, Username: "user1", Hash: "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa", Supported: true},
+		{Line: 3, Username: "user2", Hash: "sha512-crypt:" + sha512Pass, Supported: true},
+		{Line: 5, Username: "user3", Hash: "must-reset:$apr1$abcdefgh$0123456789", Supported: false},
+	}
+	for i, e := range expect {
+		if entries[i] != e {
+			t.Errorf("entry %d: expected %+v, got %+v", i, e, entries[i])
+		}
+	}
+	if entries[3].Err == nil || entries[3].Line != 6 {
+		t.Errorf("expected error for line 6, got %+v", entries[3])
+	}
+	if entries[4].Err == nil || entries[4].Line != 7 {
+		t.Errorf("expected error for line 7, got %+v", entries[4])
+	}
+}
+
+func TestReadImport_Dovecot(t *testing.T) {
+	entries, err := ReadImport(strings.NewReader(`user1:{BLF-CRYPT}$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa:1000:1000::/home/user1::
+user2:{SHA512-CRYPT}`+sha512Pass+`::::::
+user3:{SSHA512}aGFzaA==
+user4:{PLAIN}password
+user5:{SHA512-CRYPT}notahash
+`), FormatDovecot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries, got %d: %+v", len(entries), entries)
+	}
+
+	if entries[0].Hash != "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa" || !entries[0].Supported {
+		t.Errorf("wrong entry 0: %+v", entries[0])
+	}
+	if entries[1].Hash != "sha512-crypt:"+sha512Pass || !entries[1].Supported {
+		t.Errorf("wrong entry 1: %+v", entries[1])
+	}
+	if entries[2].Hash != "must-reset:{SSHA512}aGFzaA==" || entries[2].Supported {
+		t.Errorf("wrong entry 2: %+v", entries[2])
+	}
+	if !strings.HasPrefix(entries[3].Hash, "bcrypt:") || !entries[3].Supported {
+		t.Errorf("wrong entry 3: %+v", entries[3])
+	}
+	if err := verifyBcrypt("password", strings.TrimPrefix(entries[3].Hash, "bcrypt:")); err != nil {
+		t.Errorf("re-hashed plain password does not match: %v", err)
+	}
+	if entries[4].Err == nil {
+		t.Errorf("expected error for entry 4: %+v", entries[4])
+	}
+}
@@ -20,10 +20,10 @@ package pass_table
 
 import (
 	"fmt"
-	"strings"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
@@ -35,6 +35,20 @@ type Auth struct {
 	inlineArgs []string
 
 	table module.Table
+	log   log.Logger
+
+	// Hash function and its parameters used for new passwords.
+	hash     string
+	hashOpts HashOpts
+
+	// Replace hashes of other functions or with weaker parameters on
+	// successful authentication.
+	rehash bool
+
+	// App passwords, see apppass.go.
+	appTable module.Table
+	// Services the main password is not accepted for.
+	requireAppPassword []string
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -42,6 +56,10 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 		modName:    modName,
 		instName:   instName,
 		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
+		hash:       DefaultHash,
+		hashOpts:   DefaultHashOpts,
+		rehash:     true,
 	}, nil
 }
 
@@ -50,9 +68,39 @@ func (a *Auth) Init(cfg *config.Map) error {
 		return modconfig.ModuleFromNode("table", a.inlineArgs, cfg.Block, cfg.Globals, &a.table)
 	}
 
+	var argon2Threads int
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
-	_, err := cfg.Process()
-	return err
+	cfg.Enum("hash", false, false, []string{HashBcrypt, HashArgon2, HashSHA512Crypt}, DefaultHash, &a.hash)
+	cfg.Int("bcrypt_cost", false, false, DefaultHashOpts.BcryptCost, &a.hashOpts.BcryptCost)
+	cfg.UInt32("argon2_time", false, false, DefaultHashOpts.Argon2Time, &a.hashOpts.Argon2Time)
+	cfg.UInt32("argon2_memory", false, false, DefaultHashOpts.Argon2Memory, &a.hashOpts.Argon2Memory)
+	cfg.Int("argon2_threads", false, false, int(DefaultHashOpts.Argon2Threads), &argon2Threads)
+	cfg.Bool("rehash", false, true, &a.rehash)
+	cfg.Custom("app_passwords", false, false, nil, modconfig.TableDirective, &a.appTable)
+	cfg.StringList("require_app_password", false, false, nil, &a.requireAppPassword)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(a.requireAppPassword) != 0 && a.appTable == nil {
+		return fmt.Errorf("%s: require_app_password is used without app_passwords", a.modName)
+	}
+	if err := checkServices(a.requireAppPassword); err != nil {
+		return fmt.Errorf("%s: require_app_password: %w", a.modName, err)
+	}
+
+	if a.hashOpts.BcryptCost < bcrypt.MinCost || a.hashOpts.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%s: bcrypt_cost should be in range from %d to %d", a.modName, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if argon2Threads < 1 || argon2Threads > 255 {
+		return fmt.Errorf("%s: argon2_threads should be in range from 1 to 255", a.modName)
+	}
+	a.hashOpts.Argon2Threads = uint8(argon2Threads)
+	if a.hashOpts.Argon2Time < 1 || a.hashOpts.Argon2Memory < 8*uint32(argon2Threads) {
+		return fmt.Errorf("%s: argon2_time should be at least 1 and argon2_memory at least 8 KiB per thread", a.modName)
+	}
+
+	return nil
 }
 
 func (a *Auth) Name() string {
@@ -73,11 +121,42 @@ func (a *Auth) Lookup(username string) (string, bool, error) {
 }
 
 func (a *Auth) AuthPlain(username, password string) error {
+	_, err := a.AuthPlainService("", username, password)
+	return err
+}
+
+// AuthPlainService checks the password against app passwords valid for the
+// service and then against the main password, unless the service requires
+// app passwords.
+func (a *Auth) AuthPlainService(service, username, password string) (string, error) {
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if a.appTable != nil {
+		ok, err := a.authAppPassword(service, key, password)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return username, nil
+		}
+		for _, s := range a.requireAppPassword {
+			if s == service {
+				a.log.DebugMsg("main password is not accepted for the service", "username", key, "service", service)
+				return "", module.ErrUnknownCredentials
+			}
+		}
 	}
 
+	if err := a.authMainPassword(key, password); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func (a *Auth) authMainPassword(key, password string) error {
 	hash, ok, err := a.table.Lookup(key)
 	if !ok {
 		return module.ErrUnknownCredentials
@@ -86,15 +165,70 @@ func (a *Auth) AuthPlain(username, password string) error {
 		return err
 	}
 
-	parts := strings.SplitN(hash, ":", 2)
-	if len(parts) != 2 {
-		return fmt.Errorf("%s: auth plain %s: no hash tag", a.modName, key)
+	fn, hashSalt, err := ParseHash(hash)
+	if err != nil {
+		return fmt.Errorf("%s: auth plain %s: %w", a.modName, key, err)
 	}
-	hashVerify := HashVerify[parts[0]]
+	if fn == HashMustReset {
+		a.log.Msg("password reset required, refusing authentication", "username", key)
+		return fmt.Errorf("%s: auth plain %s: password must be reset, imported hash is not supported", a.modName, key)
+	}
+	hashVerify := HashVerify[fn]
 	if hashVerify == nil {
-		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, parts[0])
+		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, fn)
+	}
+	if err := hashVerify(password, hashSalt); err != nil {
+		return err
+	}
+
+	if a.rehash && NeedsRehash(fn, hashSalt, a.hash, a.hashOpts) {
+		a.rehashPassword(key, hash, password)
+	}
+	return nil
+}
+
+// rehashPassword replaces the stored hash using the configured hash function.
+// Failures are logged and do not affect the authentication.
+func (a *Auth) rehashPassword(key, oldHash, password string) {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return
+	}
+
+	newHash, err := a.computeHash(a.hash, a.hashOpts, password)
+	if err != nil {
+		a.log.Error("rehash failed", err, "username", key)
+		return
+	}
+
+	// Do not overwrite the password if it was changed concurrently.
+	current, ok, err := tbl.Lookup(key)
+	if err != nil {
+		a.log.Error("rehash failed", err, "username", key)
+		return
+	}
+	if !ok || current != oldHash {
+		return
+	}
+
+	if err := tbl.SetKey(key, newHash); err != nil {
+		a.log.Error("rehash failed", err, "username", key)
+		return
 	}
-	return hashVerify(password, parts[1])
+	a.log.DebugMsg("password rehashed", "username", key, "hash", a.hash)
+}
+
+// computeHash returns the password hash in the form stored in the table.
+func (a *Auth) computeHash(fn string, opts HashOpts, password string) (string, error) {
+	hashCompute := HashCompute[fn]
+	if hashCompute == nil {
+		return "", fmt.Errorf("unknown hash function: %s", fn)
+	}
+	hash, err := hashCompute(opts, password)
+	if err != nil {
+		return "", err
+	}
+	return fn + ":" + hash, nil
 }
 
 func (a *Auth) ListUsers() ([]string, error) {
@@ -111,6 +245,12 @@ func (a *Auth) ListUsers() ([]string, error) {
 }
 
 func (a *Auth) CreateUser(username, password string) error {
+	return a.CreateUserHash(username, password, a.hash, a.hashOpts)
+}
+
+// CreateUserHash creates the user using the specified hash function instead of
+// the configured one.
+func (a *Auth) CreateUserHash(username, password, hashFn string, opts HashOpts) error {
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
@@ -129,21 +269,24 @@ func (a *Auth) CreateUser(username, password string) error {
 		return fmt.Errorf("%s: credentials for %s already exist", a.modName, key)
 	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	hash, err := a.computeHash(hashFn, opts, password)
 	if err != nil {
 		return fmt.Errorf("%s: create user %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
 	return nil
 }
 
 func (a *Auth) SetUserPassword(username, password string) error {
+	return a.SetUserPasswordHash(username, password, a.hash, a.hashOpts)
+}
+
+// SetUserPasswordHash changes the password using the specified hash function
+// instead of the configured one.
+func (a *Auth) SetUserPasswordHash(username, password, hashFn string, opts HashOpts) error {
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
@@ -154,20 +297,46 @@ func (a *Auth) SetUserPassword(username, password string) error {
 		return fmt.Errorf("%s: set password %s (raw): %w", a.modName, username, err)
 	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	hash, err := a.computeHash(hashFn, opts, password)
 	if err != nil {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
 	return nil
 }
 
+// ImportUser stores the already computed hash (in "tag:value" form) for the
+// user, creating the entry only if create is true.
+func (a *Auth) ImportUser(username, hash string, create bool) error {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: import user %s (raw): %w", a.modName, username, err)
+	}
+
+	if !create {
+		_, ok, err = tbl.Lookup(key)
+		if err != nil {
+			return fmt.Errorf("%s: import user %s: %w", a.modName, key, err)
+		}
+		if !ok {
+			return fmt.Errorf("%s: import user %s: no such user", a.modName, key)
+		}
+	}
+
+	if err := tbl.SetKey(key, hash); err != nil {
+		return fmt.Errorf("%s: import user %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
 func (a *Auth) DeleteUser(username string) error {
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
@@ -182,6 +351,11 @@ func (a *Auth) DeleteUser(username string) error {
 	if err := tbl.RemoveKey(key); err != nil {
 		return fmt.Errorf("%s: del user %s: %w", a.modName, key, err)
 	}
+	if a.appTable != nil {
+		if err := a.writeAppPasswords(key, nil); err != nil {
+			return fmt.Errorf("%s: del user %s: app passwords: %w", a.modName, key, err)
+		}
+	}
 	return nil
 }
 
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/config"
@@ -44,6 +45,14 @@ func TestAuth_AuthPlain(t *testing.T) {
 			"foxcpp":       "sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=",
 			"not-foxcpp":   "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
 			"not-foxcpp-2": "argon2:1:8:1:U0FBQUFBTFQ=:KHUshl3DcpHR3AoVd28ZeBGmZ1Fj1gwJgNn98Ia8DAvGHqI0BvFOMJPxtaAfO8F+qomm2O3h0P0yV50QGwXI/Q==",
+			"not-foxcpp-3": "sha512-crypt:$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/",
+			"not-foxcpp-4": "must-reset:{SSHA}password",
+			"dovecot-1":    "{SHA512-CRYPT}$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/",
+			"dovecot-2":    "{CRYPT}$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
+			"dovecot-3":    "{ARGON2ID}$argon2id$v=19$m=64,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$i6P6cCvSwI/Gp4MO3l8wvjoXUe1JLzHNfXagpIByW1o",
+			"dovecot-4":    "{PLAIN}password",
+			"dovecot-5":    "{SSHA}password",
+			"empty":        "{PLAIN}",
 		},
 	}
 
@@ -61,4 +70,125 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "password", true)
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
+	check("not-foxcpp-3", "password", true)
+	check("not-foxcpp-3", "different-password", false)
+	check("not-foxcpp-4", "password", false)
+	check("not-foxcpp-4", "{SSHA}password", false)
+	check("dovecot-1", "password", true)
+	check("dovecot-1", "different-password", false)
+	check("dovecot-2", "password", true)
+	check("dovecot-3", "password", true)
+	check("dovecot-3", "different-password", false)
+	check("dovecot-4", "password", true)
+	check("dovecot-4", "different-password", false)
+	check("dovecot-5", "password", false)
+	check("empty", "", false)
+}
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func TestAuth_Rehash(t *testing.T) {
+	mod, err := New("pass_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	err = a.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "table", Args: []string{"dummy"}},
+			{Name: "bcrypt_cost", Args: []string{"5"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mutableTable{testutils.Table{M: map[string]string{
+		"sha512":  "sha512-crypt:$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/",
+		"plain":   "{PLAIN}password",
+		"weak":    "bcrypt:$2a$04$gwnmygSZsl37nQoLJEDk0OfQmJUAKZbCXXlXDNm/YQg.mS9U7lXAe",
+		"current": "bcrypt:$2a$05$edQ4664JdZQ0FhDAh3czXO9PND9W49W.9PA43H5zF6sOzvG5XeaCG",
+	}}}
+	a.table = tbl
+
+	for _, user := range []string{"sha512", "plain", "weak"} {
+		old := tbl.M[user]
+		if err := a.AuthPlain(user, "different-password"); err == nil {
+			t.Fatal("AuthPlain succeeded with wrong password for", user)
+		}
+		if tbl.M[user] != old {
+			t.Fatal("Hash changed after failed authentication for", user)
+		}
+
+		if err := a.AuthPlain(user, "password"); err != nil {
+			t.Fatal("AuthPlain failed for", user, err)
+		}
+		fn, hashSalt, err := ParseHash(tbl.M[user])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn != HashBcrypt || NeedsRehash(fn, hashSalt, HashBcrypt, a.hashOpts) {
+			t.Fatal("Hash is not upgraded for", user, tbl.M[user])
+		}
+		if err := a.AuthPlain(user, "password"); err != nil {
+			t.Fatal("AuthPlain failed after rehash for", user, err)
+		}
+	}
+
+	current := tbl.M["current"]
+	if err := a.AuthPlain("current", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if tbl.M["current"] != current {
+		t.Fatal("Hash with up-to-date parameters is changed")
+	}
+
+	a.rehash = false
+	tbl.M["sha512"] = "sha512-crypt:$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"
+	if err := a.AuthPlain("sha512", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["sha512"], "sha512-crypt:") {
+		t.Fatal("Hash is upgraded with rehash off")
+	}
+}
+
+func TestAuth_CreateUserHash(t *testing.T) {
+	mod, err := New("pass_table", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.table = tbl
+
+	if err := a.CreateUserHash("user", "password", HashArgon2, DefaultHashOpts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["user"], "argon2:") {
+		t.Fatal("Wrong hash function used:", tbl.M["user"])
+	}
+	if err := a.SetUserPasswordHash("user", "password2", HashSHA512Crypt, DefaultHashOpts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["user"], "sha512-crypt:") {
+		t.Fatal("Wrong hash function used:", tbl.M["user"])
+	}
+	if err := a.CreateUserHash("user2", "password", "md5", DefaultHashOpts); err == nil {
+		t.Fatal("Unknown hash function accepted")
+	}
 }
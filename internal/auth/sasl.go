@@ -22,28 +22,54 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
 )
 
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
+
+	// ErrInvalidCredentials is returned by sasl.Server implementations
+	// created by SASLAuth if authentication failed.
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+	// ErrTemporaryFailure is returned by sasl.Server implementations
+	// created by SASLAuth if credentials can't be verified due to a
+	// temporary error (e.g. the authentication server is unavailable).
+	ErrTemporaryFailure = exterrors.WithTemporary(errors.New("auth: temporary authentication failure"), true)
+	// ErrTooManyFailures is returned if the client address is blocked by
+	// the auth.throttle module. Credentials are not checked in this case.
+	ErrTooManyFailures = exterrors.WithTemporary(errors.New("auth: too many authentication failures"), true)
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
 // call maddy module objects.
 //
-// It supports reporting of multiple authorization identities so multiple
-// accounts can be associated with a single set of credentials.
+// The authorization identity different from the username is accepted only
+// for master users (see MasterUsers).
 type SASLAuth struct {
 	Log         log.Logger
 	OnlyFirstID bool
 
-	Plain []module.PlainAuth
+	Plain  []module.PlainAuth
+	Bearer []module.BearerAuth
+
+	// Service is the service name passed to providers implementing
+	// module.ServicePlainAuth.
+	Service string
+
+	// Throttle, if set, limits the rate of authentication failures for
+	// AuthPlainFrom and CreateSASL.
+	Throttle *throttle.Throttle
+
+	// Master, if set, allows master users to log in as other users.
+	Master *MasterUsers
 }
 
 func (s *SASLAuth) SASLMechanisms() []string {
@@ -52,28 +78,104 @@ func (s *SASLAuth) SASLMechanisms() []string {
 	if len(s.Plain) != 0 {
 		mechs = append(mechs, sasl.Plain, sasl.Login)
 	}
+	if len(s.Bearer) != 0 {
+		mechs = append(mechs, sasl.OAuthBearer, XOAuth2)
+	}
 
 	return mechs
 }
 
 func (s *SASLAuth) AuthPlain(username, password string) error {
+	_, err := s.AuthPlainCanonical(username, password)
+	return err
+}
+
+// AuthPlainCanonical is similar to AuthPlain but also returns the canonical
+// username if the provider that accepted credentials reports it (see
+// module.CanonicalPlainAuth). Otherwise, the username is returned as is.
+func (s *SASLAuth) AuthPlainCanonical(username, password string) (string, error) {
 	if len(s.Plain) == 0 {
-		return ErrUnsupportedMech
+		return "", ErrUnsupportedMech
 	}
 
 	var lastErr error
 	for _, p := range s.Plain {
-		err := p.AuthPlain(username, password)
-		if err == nil {
-			return nil
+		if sp, ok := p.(module.ServicePlainAuth); ok {
+			canonical, err := sp.AuthPlainService(s.Service, username, password)
+			if err == nil {
+				return canonical, nil
+			}
+			lastErr = err
+			continue
 		}
-		if err != nil {
+		if cp, ok := p.(module.CanonicalPlainAuth); ok {
+			canonical, err := cp.AuthPlainCanonical(username, password)
+			if err == nil {
+				return canonical, nil
+			}
 			lastErr = err
 			continue
 		}
+
+		err := p.AuthPlain(username, password)
+		if err == nil {
+			return username, nil
+		}
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
+}
+
+// AuthPlainFrom is similar to AuthPlainCanonical but also applies the
+// authentication failures rate limiting for the client address and handles
+// master user logins (username*master).
+func (s *SASLAuth) AuthPlainFrom(remoteAddr net.Addr, username, password string) (string, error) {
+	if s.Master != nil {
+		if target, master, ok := s.Master.Split(username); ok {
+			return s.authMaster(remoteAddr, target, master, password)
+		}
+	}
+
+	return s.Throttled(remoteAddr, username, func() (string, error) {
+		return s.AuthPlainCanonical(username, password)
+	})
+}
+
+// Throttled runs authFunc applying the authentication failures rate limiting
+// for the client address. If the address is blocked, authFunc is not called
+// and ErrTooManyFailures is returned.
+//
+// Failed attempts are delayed according to the Throttle configuration.
+// Temporary errors are not counted as failures.
+func (s *SASLAuth) Throttled(remoteAddr net.Addr, username string, authFunc func() (string, error)) (string, error) {
+	if s.Throttle == nil {
+		return authFunc()
+	}
+
+	if s.Throttle.Blocked(remoteAddr) {
+		return "", ErrTooManyFailures
+	}
+
+	canonical, err := authFunc()
+	if err != nil {
+		if !exterrors.IsTemporary(err) {
+			time.Sleep(s.Throttle.Failed(remoteAddr, username))
+		}
+		return "", err
 	}
+	s.Throttle.Succeeded(remoteAddr, username)
+	return canonical, nil
+}
 
-	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
+func saslError(err error) error {
+	if errors.Is(err, ErrTooManyFailures) {
+		return ErrTooManyFailures
+	}
+	if exterrors.IsTemporary(err) {
+		return ErrTemporaryFailure
+	}
+	return ErrInvalidCredentials
 }
 
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
@@ -81,27 +183,46 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
-			if identity == "" {
-				identity = username
+			if identity != "" && identity != username && s.Master != nil {
+				target, err := s.authMaster(remoteAddr, identity, username, password)
+				if err != nil {
+					s.Log.Error("authentication failed", err, "username", username, "authz_id", identity, "src_ip", remoteAddr)
+					return saslError(err)
+				}
+				return successCb(target)
 			}
 
-			err := s.AuthPlain(username, password)
+			canonical, err := s.AuthPlainFrom(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
-				return errors.New("auth: invalid credentials")
+				return saslError(err)
 			}
 
-			return successCb(identity)
+			if identity != "" && identity != username && identity != canonical {
+				s.Log.Msg("authorization identity mismatch", "username", username, "authz_id", identity, "src_ip", remoteAddr)
+				return ErrInvalidCredentials
+			}
+			return successCb(canonical)
 		})
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.AuthPlain(username, password)
+			canonical, err := s.AuthPlainFrom(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
-				return errors.New("auth: invalid credentials")
+				return saslError(err)
 			}
 
-			return successCb(username)
+			return successCb(canonical)
+		})
+	case sasl.OAuthBearer, XOAuth2:
+		return newBearerServer(mech, func(username, token string) error {
+			identity, err := s.AuthBearerFrom(remoteAddr, username, token)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "mech", mech, "src_ip", remoteAddr)
+				return saslError(err)
+			}
+
+			return successCb(identity)
 		})
 	}
 	return FailingSASLServ{Err: ErrUnsupportedMech}
@@ -120,6 +241,10 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 		s.Plain = append(s.Plain, plainAuth)
 		hasAny = true
 	}
+	if bearerAuth, ok := any.(module.BearerAuth); ok {
+		s.Bearer = append(s.Bearer, bearerAuth)
+		hasAny = true
+	}
 
 	if !hasAny {
 		return config.NodeErr(node, "auth: specified module does not provide any SASL mechanism")
@@ -127,6 +252,12 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// SetThrottle sets the authentication failures rate limiting module by
+// parsing the 'auth_throttle' configuration directive.
+func (s *SASLAuth) SetThrottle(m *config.Map, node config.Node) error {
+	return modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &s.Throttle)
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
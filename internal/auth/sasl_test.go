@@ -21,9 +21,13 @@ package auth
 import (
 	"errors"
 	"net"
+	"strings"
 	"testing"
 
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -75,15 +79,260 @@ func TestCreateSASL(t *testing.T) {
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
 		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
-			if id != "user1a" {
+			if id != "user1" {
 				t.Fatal("Wrong authorization identity passed:", id)
 			}
 			return nil
 		})
 
-		_, _, err := srv.Next([]byte("user1a\x00user1\x00aa"))
+		_, _, err := srv.Next([]byte("user1\x00user1\x00aa"))
 		if err != nil {
 			t.Error("Unexpected error:", err)
 		}
 	})
+
+	t.Run("PLAIN with different authorization identity", func(t *testing.T) {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+			t.Fatal("Callback called for different authorization identity:", id)
+			return nil
+		})
+
+		_, _, err := srv.Next([]byte("user1a\x00user1\x00aa"))
+		if err != ErrInvalidCredentials {
+			t.Error("Expected ErrInvalidCredentials, got", err)
+		}
+	})
+}
+
+type canonicalAuth struct{}
+
+func (canonicalAuth) AuthPlain(username, password string) error {
+	_, err := canonicalAuth{}.AuthPlainCanonical(username, password)
+	return err
+}
+
+func (canonicalAuth) AuthPlainCanonical(username, password string) (string, error) {
+	switch password {
+	case "temp":
+		return "", exterrors.WithTemporary(errors.New("server unavailable"), true)
+	case "password":
+		return strings.ToLower(username), nil
+	}
+	return "", module.ErrUnknownCredentials
+}
+
+func TestCreateSASL_Canonical(t *testing.T) {
+	a := SASLAuth{
+		Log:   testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{canonicalAuth{}},
+	}
+
+	for _, mech := range []string{"PLAIN", "LOGIN"} {
+		mech := mech
+		t.Run(mech, func(t *testing.T) {
+			var identity string
+			srv := a.CreateSASL(mech, &net.TCPAddr{}, func(id string) error {
+				identity = id
+				return nil
+			})
+			if mech == "PLAIN" {
+				_, _, err := srv.Next([]byte("\x00User1\x00password"))
+				if err != nil {
+					t.Fatal("Unexpected error:", err)
+				}
+			} else {
+				srv.Next(nil)
+				srv.Next([]byte("User1"))
+				if _, _, err := srv.Next([]byte("password")); err != nil {
+					t.Fatal("Unexpected error:", err)
+				}
+			}
+			if identity != "user1" {
+				t.Fatal("Canonical username is not used:", identity)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(string) error { return nil })
+		if _, _, err := srv.Next([]byte("\x00user1\x00wrong")); err != ErrInvalidCredentials {
+			t.Error("Expected ErrInvalidCredentials, got", err)
+		}
+
+		srv = a.CreateSASL("PLAIN", &net.TCPAddr{}, func(string) error { return nil })
+		if _, _, err := srv.Next([]byte("\x00user1\x00temp")); !exterrors.IsTemporary(err) {
+			t.Error("Expected temporary error, got", err)
+		}
+	})
+}
+
+type serviceAuth struct{}
+
+func (serviceAuth) AuthPlain(username, password string) error {
+	_, err := serviceAuth{}.AuthPlainService("", username, password)
+	return err
+}
+
+func (serviceAuth) AuthPlainService(service, username, password string) (string, error) {
+	if password != service+"-password" {
+		return "", module.ErrUnknownCredentials
+	}
+	return username, nil
+}
+
+func TestAuthPlain_Service(t *testing.T) {
+	a := SASLAuth{
+		Log:     testutils.Logger(t, "saslauth"),
+		Plain:   []module.PlainAuth{serviceAuth{}},
+		Service: module.ServiceIMAP,
+	}
+
+	if err := a.AuthPlain("user", "imap-password"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("user", "smtp-password"); err == nil {
+		t.Fatal("Password for other service is accepted")
+	}
+}
+
+func TestAuthPlainFrom_Throttle(t *testing.T) {
+	mod, err := throttle.New("auth.throttle", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "max_failures", Args: []string{"2"}},
+		{Name: "delay_base", Args: []string{"0s"}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.(*throttle.Throttle).Close()
+
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+		Throttle: mod.(*throttle.Throttle),
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	if _, err := a.AuthPlainFrom(addr, "user2", "aa"); err == nil || errors.Is(err, ErrTooManyFailures) {
+		t.Fatal("Unexpected error:", err)
+	}
+	if _, err := a.AuthPlainFrom(addr, "user1", "aa"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	// Counter is reset by the successful attempt.
+	if _, err := a.AuthPlainFrom(addr, "user2", "aa"); err == nil || errors.Is(err, ErrTooManyFailures) {
+		t.Fatal("Unexpected error:", err)
+	}
+	if _, err := a.AuthPlainFrom(addr, "user2", "aa"); err == nil || errors.Is(err, ErrTooManyFailures) {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Credentials are not checked for blocked addresses.
+	if _, err := a.AuthPlainFrom(addr, "user1", "aa"); !errors.Is(err, ErrTooManyFailures) {
+		t.Fatal("Expected ErrTooManyFailures, got", err)
+	}
+	srv := a.CreateSASL("PLAIN", addr, func(string) error { return nil })
+	if _, _, err := srv.Next([]byte("\x00user1\x00aa")); err != ErrTooManyFailures {
+		t.Fatal("Expected ErrTooManyFailures, got", err)
+	}
+
+	// Other addresses are not affected.
+	if _, err := a.AuthPlainFrom(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}, "user1", "aa"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestCreateSASL_MasterUsers(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+	}
+	mu := &MasterUsers{
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"admin": true,
+				},
+			},
+		},
+		Separator: "*",
+	}
+	_, ipNet, _ := net.ParseCIDR("192.0.2.0/24")
+	mu.Networks = []net.IPNet{*ipNet}
+
+	allowed := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	disallowed := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1234}
+
+	t.Run("disabled", func(t *testing.T) {
+		if _, err := a.AuthPlainFrom(allowed, "user2*admin", "aa"); err == nil {
+			t.Fatal("Master user login accepted without configuration")
+		}
+	})
+
+	a.Master = mu
+
+	t.Run("separator", func(t *testing.T) {
+		target, err := a.AuthPlainFrom(allowed, "user2*admin", "aa")
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if target != "user2" {
+			t.Fatal("Wrong target user:", target)
+		}
+
+		if _, err := a.AuthPlainFrom(allowed, "user2*user1", "aa"); err == nil {
+			t.Fatal("Regular user accepted as master")
+		}
+		if _, err := a.AuthPlainFrom(disallowed, "user2*admin", "aa"); !errors.Is(err, ErrMasterNetwork) {
+			t.Fatal("Expected ErrMasterNetwork, got", err)
+		}
+		if _, err := a.AuthPlainFrom(allowed, "user1", "aa"); err != nil {
+			t.Fatal("Unexpected error for regular login:", err)
+		}
+	})
+
+	t.Run("PLAIN authorization identity", func(t *testing.T) {
+		var identity string
+		srv := a.CreateSASL("PLAIN", allowed, func(id string) error {
+			identity = id
+			return nil
+		})
+		if _, _, err := srv.Next([]byte("user2\x00admin\x00aa")); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if identity != "user2" {
+			t.Fatal("Wrong target user:", identity)
+		}
+
+		srv = a.CreateSASL("PLAIN", disallowed, func(id string) error {
+			t.Fatal("Callback called for disallowed address")
+			return nil
+		})
+		if _, _, err := srv.Next([]byte("user2\x00admin\x00aa")); err != ErrInvalidCredentials {
+			t.Fatal("Expected ErrInvalidCredentials, got", err)
+		}
+
+		srv = a.CreateSASL("PLAIN", allowed, func(id string) error {
+			t.Fatal("Callback called for regular user")
+			return nil
+		})
+		if _, _, err := srv.Next([]byte("user2\x00user1\x00aa")); err != ErrInvalidCredentials {
+			t.Fatal("Expected ErrInvalidCredentials, got", err)
+		}
+	})
 }
@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// allowedSenders returns the list of addresses and domains the user is
+// allowed to use. Domains are prefixed with '@'.
+//
+// If the table is nil or has no entry for the user, the username itself is
+// the only allowed address.
+func allowedSenders(table module.Table, username string) ([]string, error) {
+	if table != nil {
+		val, ok, err := table.Lookup(username)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return strings.FieldsFunc(val, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			}), nil
+		}
+	}
+	return []string{username}, nil
+}
+
+// SenderAuthorized checks whether the user is allowed to use the sender
+// address according to the sender ownership table.
+//
+// Table maps usernames to the lists of addresses separated by commas or
+// spaces, '@domain' entries allow any address in the domain.
+func SenderAuthorized(table module.Table, username, addr string) (bool, error) {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return false, nil
+	}
+	_, domain, err := address.Split(normAddr)
+	if err != nil {
+		return false, nil
+	}
+
+	allowed, err := allowedSenders(table, username)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range allowed {
+		if strings.HasPrefix(entry, "@") {
+			// Catch-all rule, the user can send as any address in the domain.
+			normDomain, err := dns.ForLookup(entry[1:])
+			if err != nil {
+				continue
+			}
+			if normDomain == domain {
+				return true, nil
+			}
+			continue
+		}
+
+		normEntry, err := address.ForLookup(entry)
+		if err != nil {
+			continue
+		}
+		if normEntry == normAddr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
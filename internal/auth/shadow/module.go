@@ -21,21 +21,30 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package shadow
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/auth/external"
 )
 
 type Auth struct {
-	instName   string
-	useHelper  bool
-	helperPath string
+	instName         string
+	useHelper        bool
+	persistentHelper bool
+	helperPath       string
+	helperTimeout    time.Duration
+	domain           string
+
+	helper *external.HelperProcess
+	cache  *auth.CredsCache
 
 	Log log.Logger
 }
@@ -61,15 +70,32 @@ func (a *Auth) InstanceName() string {
 func (a *Auth) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &a.Log.Debug)
 	cfg.Bool("use_helper", false, false, &a.useHelper)
+	cfg.Bool("persistent_helper", false, false, &a.persistentHelper)
+	cfg.Duration("helper_timeout", false, false, 10*time.Second, &a.helperTimeout)
+	cfg.String("domain", false, false, "", &a.domain)
+	var cacheTTL time.Duration
+	cfg.Duration("cache_ttl", false, false, 30*time.Second, &cacheTTL)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if a.persistentHelper && !a.useHelper {
+		return errors.New("shadow: persistent_helper requires use_helper")
+	}
+
+	var err error
+	a.cache, err = auth.NewCredsCache(cacheTTL, 0, 0)
+	if err != nil {
+		return fmt.Errorf("shadow: %w", err)
+	}
 
 	if a.useHelper {
 		a.helperPath = filepath.Join(config.LibexecDirectory, "maddy-shadow-helper")
 		if _, err := os.Stat(a.helperPath); err != nil {
 			return fmt.Errorf("shadow: no helper binary (maddy-shadow-helper) found in %s", config.LibexecDirectory)
 		}
+		if a.persistentHelper {
+			a.helper = external.NewHelperProcess(a.helperPath, a.helperTimeout, a.Log)
+		}
 	} else {
 		f, err := os.Open("/etc/shadow")
 		if err != nil {
@@ -89,7 +115,12 @@ func (a *Auth) Lookup(username string) (string, bool, error) {
 		return "", false, fmt.Errorf("shadow: table lookup are not possible when using a helper")
 	}
 
-	ent, err := Lookup(username)
+	sysName, ok := auth.SystemUsername(username, a.domain)
+	if !ok {
+		return "", false, nil
+	}
+
+	ent, err := Lookup(sysName)
 	if err != nil {
 		return "", false, nil
 	}
@@ -102,30 +133,43 @@ func (a *Auth) Lookup(username string) (string, bool, error) {
 }
 
 func (a *Auth) AuthPlain(username, password string) error {
-	if a.useHelper {
-		return external.AuthUsingHelper(a.helperPath, username, password)
+	sysName, ok := auth.SystemUsername(username, a.domain)
+	if !ok {
+		return module.ErrUnknownCredentials
 	}
 
-	ent, err := Lookup(username)
-	if err != nil {
-		return err
+	if a.cache.Check(sysName, password) {
+		a.Log.DebugMsg("using cached authentication result", "username", sysName)
+		return nil
 	}
 
-	if !ent.IsAccountValid() {
-		return fmt.Errorf("shadow: account is expired")
-	}
-
-	if !ent.IsPasswordValid() {
-		return fmt.Errorf("shadow: password is expired")
-	}
-
-	if err := ent.VerifyPassword(password); err != nil {
-		if err == ErrWrongPassword {
-			return module.ErrUnknownCredentials
+	var err error
+	switch {
+	case a.helper != nil:
+		err = a.helper.AuthPlain(sysName, password)
+	case a.useHelper:
+		ctx, cancel := context.WithTimeout(context.Background(), a.helperTimeout)
+		err = external.AuthUsingHelper(ctx, a.helperPath, sysName, password)
+		cancel()
+	default:
+		err = Verify(sysName, password)
+		switch err {
+		case ErrNoSuchUser, ErrWrongPassword:
+			err = module.ErrUnknownCredentials
 		}
+	}
+	if err != nil {
 		return err
 	}
 
+	a.cache.Add(sysName, password)
+	return nil
+}
+
+func (a *Auth) Close() error {
+	if a.helper != nil {
+		return a.helper.Close()
+	}
 	return nil
 }
 
@@ -32,6 +32,32 @@ import (
 
 const secsInDay = 86400
 
+var (
+	ErrAccountExpired  = errors.New("shadow: account is expired")
+	ErrPasswordExpired = errors.New("shadow: password is expired")
+)
+
+// Verify checks the password of the user against the shadow database.
+//
+// ErrNoSuchUser, ErrWrongPassword, ErrAccountExpired or ErrPasswordExpired is
+// returned if the user should not be allowed to log in.
+func Verify(username, password string) error {
+	ent, err := Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	if !ent.IsAccountValid() {
+		return ErrAccountExpired
+	}
+
+	if !ent.IsPasswordValid() {
+		return ErrPasswordExpired
+	}
+
+	return ent.VerifyPassword(password)
+}
+
 func (e *Entry) IsAccountValid() bool {
 	if e.AcctExpiry == -1 {
 		return true
@@ -0,0 +1,473 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package throttle implements the auth.throttle module that limits the rate
+// of authentication failures per client IP and username.
+package throttle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	modName = "auth.throttle"
+
+	// syncInterval is the interval between removals of expired entries and
+	// state file updates.
+	syncInterval = 30 * time.Second
+)
+
+// IPState is the failures counter for a single IP address (or an IPv6
+// network).
+type IPState struct {
+	// Failures is the amount of authentication failures since WindowStart.
+	Failures    int
+	WindowStart time.Time
+
+	// BlockedUntil is set if the address is blocked.
+	BlockedUntil time.Time `json:",omitempty"`
+
+	// LastUsername is the username used for the last failed attempt.
+	LastUsername string `json:",omitempty"`
+}
+
+// State is the serialized module state, as stored in the state file.
+type State struct {
+	IPs map[string]IPState
+}
+
+// BlockedIP describes the address blocked due to too many authentication
+// failures.
+type BlockedIP struct {
+	IP           string
+	Failures     int
+	BlockedUntil time.Time
+	LastUsername string
+}
+
+// Blocked returns the list of addresses blocked at the time now, sorted by
+// the block expiration time.
+func (s State) Blocked(now time.Time) []BlockedIP {
+	var list []BlockedIP
+	for ip, st := range s.IPs {
+		if !st.BlockedUntil.After(now) {
+			continue
+		}
+		list = append(list, BlockedIP{
+			IP:           ip,
+			Failures:     st.Failures,
+			BlockedUntil: st.BlockedUntil,
+			LastUsername: st.LastUsername,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BlockedUntil.Before(list[j].BlockedUntil)
+	})
+	return list
+}
+
+// ReadState reads the state file written by the module.
+func ReadState(location string) (State, error) {
+	var s State
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("malformed state file: %w", err)
+	}
+	return s, nil
+}
+
+type userState struct {
+	failures int
+	last     time.Time
+}
+
+type userKey struct {
+	ip       string
+	username string
+}
+
+type Throttle struct {
+	instName string
+	log      log.Logger
+
+	maxFailures int
+	window      time.Duration
+	blockTime   time.Duration
+	delayBase   time.Duration
+	delayMax    time.Duration
+	exempt      []net.IPNet
+	ipv6Prefix  int
+
+	persist  bool
+	location string
+
+	now func() time.Time
+
+	lock  sync.Mutex
+	ips   map[string]*IPState
+	users map[userKey]*userState
+	dirty bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Throttle{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+		ips:      map[string]*IPState{},
+		users:    map[userKey]*userState{},
+	}, nil
+}
+
+func (t *Throttle) Name() string {
+	return modName
+}
+
+func (t *Throttle) InstanceName() string {
+	return t.instName
+}
+
+func (t *Throttle) readLocation(cfg *config.Map) {
+	cfg.Bool("persist", false, false, &t.persist)
+	cfg.String("location", false, false, "", &t.location)
+}
+
+func (t *Throttle) defaultLocation() error {
+	if t.location != "" {
+		if !filepath.IsAbs(t.location) {
+			t.location = filepath.Join(config.StateDirectory, t.location)
+		}
+		return nil
+	}
+	if t.instName == "" {
+		return fmt.Errorf("%s: location is required for inline definitions", modName)
+	}
+	t.location = filepath.Join(config.StateDirectory, "auth_throttle", t.instName+".json")
+	return nil
+}
+
+// ReadLocation returns the state file location from the module
+// configuration without initializing the module. It is used by maddyctl to
+// read the state directly.
+func (t *Throttle) ReadLocation(cfg *config.Map) (string, error) {
+	t.readLocation(cfg)
+	cfg.AllowUnknown()
+	if _, err := cfg.Process(); err != nil {
+		return "", err
+	}
+	if !t.persist {
+		return "", fmt.Errorf("%s: persistence is disabled, state is not available", modName)
+	}
+	if err := t.defaultLocation(); err != nil {
+		return "", err
+	}
+	return t.location, nil
+}
+
+func (t *Throttle) Init(cfg *config.Map) error {
+	cfg.Int("max_failures", false, false, 10, &t.maxFailures)
+	cfg.Duration("window", false, false, 1*time.Hour, &t.window)
+	cfg.Duration("block_time", false, false, 1*time.Hour, &t.blockTime)
+	cfg.Duration("delay_base", false, false, 1*time.Second, &t.delayBase)
+	cfg.Duration("delay_max", false, false, 16*time.Second, &t.delayMax)
+	cfg.CIDRList("exempt", false, false, []string{"127.0.0.0/8", "::1/128"}, &t.exempt)
+	cfg.Int("ipv6_prefix", false, false, 64, &t.ipv6Prefix)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	t.readLocation(cfg)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.maxFailures < 0 {
+		return fmt.Errorf("%s: max_failures can't be negative", modName)
+	}
+	if t.ipv6Prefix < 0 || t.ipv6Prefix > 128 {
+		return fmt.Errorf("%s: ipv6_prefix should be in range from 0 to 128", modName)
+	}
+	if config.CheckOnly {
+		return nil
+	}
+
+	if t.persist {
+		if err := t.defaultLocation(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(t.location), 0700); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		if err := t.load(); err != nil {
+			return err
+		}
+	}
+
+	t.stop = make(chan struct{})
+	t.stopped = make(chan struct{})
+	go t.syncLoop()
+
+	return nil
+}
+
+// key returns the counter key for the address or an empty string if the
+// address is exempt or its IP is not known.
+func (t *Throttle) key(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case nil:
+		return ""
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return ""
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		// Unix sockets are used by local clients.
+		return ""
+	}
+
+	for _, ipNet := range t.exempt {
+		if ipNet.Contains(ip) {
+			return ""
+		}
+	}
+
+	if ip.To4() == nil {
+		// Clients usually get the whole /64 so counting individual
+		// addresses is pointless.
+		ipNet := net.IPNet{IP: ip.Mask(net.CIDRMask(t.ipv6Prefix, 128)), Mask: net.CIDRMask(t.ipv6Prefix, 128)}
+		return ipNet.String()
+	}
+	return ip.String()
+}
+
+// Blocked reports whether authentication attempts from the address should be
+// rejected without checking credentials.
+func (t *Throttle) Blocked(addr net.Addr) bool {
+	key := t.key(addr)
+	if key == "" {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	st := t.ips[key]
+	return st != nil && st.BlockedUntil.After(t.now())
+}
+
+// Failed records the authentication failure and returns the delay that
+// should be applied before replying to the client.
+//
+// The delay grows exponentially with each failure for the same IP and
+// username pair.
+func (t *Throttle) Failed(addr net.Addr, username string) time.Duration {
+	key := t.key(addr)
+	if key == "" {
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	t.dirty = true
+
+	st := t.ips[key]
+	expiredBlock := st != nil && !st.BlockedUntil.IsZero() && !st.BlockedUntil.After(now)
+	if st == nil || now.Sub(st.WindowStart) > t.window || expiredBlock {
+		st = &IPState{WindowStart: now}
+		t.ips[key] = st
+	}
+	st.Failures++
+	st.LastUsername = username
+	if t.maxFailures != 0 && st.Failures >= t.maxFailures && !st.BlockedUntil.After(now) {
+		st.BlockedUntil = now.Add(t.blockTime)
+		t.log.Msg("too many authentication failures, blocking IP", "ip", key, "failures", st.Failures, "until", st.BlockedUntil, "username", username)
+	}
+
+	ukey := userKey{ip: key, username: username}
+	ust := t.users[ukey]
+	if ust == nil || now.Sub(ust.last) > t.window {
+		ust = &userState{}
+		t.users[ukey] = ust
+	}
+	ust.failures++
+	ust.last = now
+
+	if t.delayBase == 0 {
+		return 0
+	}
+	delay := t.delayBase << (ust.failures - 1)
+	if delay > t.delayMax || delay <= 0 {
+		delay = t.delayMax
+	}
+	t.log.DebugMsg("authentication failed", "ip", key, "username", username, "failures", st.Failures, "delay", delay)
+	return delay
+}
+
+// Succeeded resets failure counters for the address and username.
+func (t *Throttle) Succeeded(addr net.Addr, username string) {
+	key := t.key(addr)
+	if key == "" {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if st := t.ips[key]; st != nil && !st.BlockedUntil.After(t.now()) {
+		delete(t.ips, key)
+		t.dirty = true
+	}
+	delete(t.users, userKey{ip: key, username: username})
+}
+
+// State returns the copy of the module state.
+func (t *Throttle) State() State {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := State{IPs: make(map[string]IPState, len(t.ips))}
+	for ip, st := range t.ips {
+		s.IPs[ip] = *st
+	}
+	return s
+}
+
+// expire removes counters that are not relevant anymore.
+func (t *Throttle) expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	for ip, st := range t.ips {
+		if now.Sub(st.WindowStart) > t.window && !st.BlockedUntil.After(now) {
+			delete(t.ips, ip)
+			t.dirty = true
+		}
+	}
+	for key, ust := range t.users {
+		if now.Sub(ust.last) > t.window {
+			delete(t.users, key)
+		}
+	}
+}
+
+func (t *Throttle) syncLoop() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.expire()
+			if err := t.save(); err != nil {
+				t.log.Error("failed to save state", err)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *Throttle) load() error {
+	s, err := ReadState(t.location)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		// Corrupted state should not prevent the server from starting.
+		t.log.Error("failed to load state, starting from scratch", err, "location", t.location)
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for ip, st := range s.IPs {
+		st := st
+		t.ips[ip] = &st
+	}
+	return nil
+}
+
+func (t *Throttle) save() error {
+	if !t.persist {
+		return nil
+	}
+
+	t.lock.Lock()
+	if !t.dirty {
+		t.lock.Unlock()
+		return nil
+	}
+	s := State{IPs: make(map[string]IPState, len(t.ips))}
+	for ip, st := range t.ips {
+		s.IPs[ip] = *st
+	}
+	t.dirty = false
+	t.lock.Unlock()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so maddyctl never sees a partially
+	// written state.
+	tmp := t.location + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.location)
+}
+
+func (t *Throttle) Close() error {
+	if t.stop != nil {
+		close(t.stop)
+		<-t.stopped
+		t.stop = nil
+	}
+	return t.save()
+}
+
+func init() {
+	module.Register(modName, New)
+}
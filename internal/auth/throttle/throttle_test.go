@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package throttle
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testThrottle(t *testing.T, cfg []config.Node) (*Throttle, *time.Time) {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := mod.(*Throttle)
+	th.log = testutils.Logger(t, modName)
+
+	now := time.Unix(1600000000, 0)
+	th.now = func() time.Time { return now }
+
+	if err := th.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { th.Close() })
+	return th, &now
+}
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestThrottle_Block(t *testing.T) {
+	th, now := testThrottle(t, []config.Node{
+		{Name: "max_failures", Args: []string{"3"}},
+		{Name: "window", Args: []string{"10m"}},
+		{Name: "block_time", Args: []string{"5m"}},
+	})
+	a := addr("192.0.2.1")
+
+	for i := 0; i < 2; i++ {
+		th.Failed(a, "user"+string(rune('a'+i)))
+		if th.Blocked(a) {
+			t.Fatal("Blocked too early, after failure", i+1)
+		}
+	}
+	th.Failed(a, "userc")
+	if !th.Blocked(a) {
+		t.Fatal("Not blocked after max_failures")
+	}
+	if th.Blocked(addr("192.0.2.2")) {
+		t.Fatal("Other IP is blocked")
+	}
+
+	blocked := th.State().Blocked(*now)
+	if len(blocked) != 1 || blocked[0].IP != "192.0.2.1" || blocked[0].LastUsername != "userc" {
+		t.Fatal("Wrong blocked list:", blocked)
+	}
+
+	// Successful authentication does not lift the block.
+	th.Succeeded(a, "userc")
+	if !th.Blocked(a) {
+		t.Fatal("Block is lifted by Succeeded")
+	}
+
+	*now = now.Add(6 * time.Minute)
+	if th.Blocked(a) {
+		t.Fatal("Still blocked after block_time")
+	}
+	// Counter starts from scratch after the block expiration.
+	th.Failed(a, "user")
+	if th.Blocked(a) {
+		t.Fatal("Blocked again after a single failure")
+	}
+}
+
+func TestThrottle_Window(t *testing.T) {
+	th, now := testThrottle(t, []config.Node{
+		{Name: "max_failures", Args: []string{"2"}},
+		{Name: "window", Args: []string{"10m"}},
+	})
+	a := addr("192.0.2.1")
+
+	th.Failed(a, "user")
+	*now = now.Add(11 * time.Minute)
+	th.Failed(a, "user")
+	if th.Blocked(a) {
+		t.Fatal("Failures outside of the window are counted")
+	}
+
+	th.Succeeded(a, "user")
+	th.Failed(a, "user")
+	if th.Blocked(a) {
+		t.Fatal("Failures are not reset by Succeeded")
+	}
+}
+
+func TestThrottle_Delay(t *testing.T) {
+	th, _ := testThrottle(t, []config.Node{
+		{Name: "max_failures", Args: []string{"0"}},
+		{Name: "delay_base", Args: []string{"1s"}},
+		{Name: "delay_max", Args: []string{"5s"}},
+	})
+	a := addr("192.0.2.1")
+
+	for i, expected := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := th.Failed(a, "user"); delay != expected {
+			t.Errorf("Wrong delay after %d failures: %v, want %v", i+1, delay, expected)
+		}
+	}
+	// Delays are counted per username.
+	if delay := th.Failed(a, "user2"); delay != 1*time.Second {
+		t.Error("Wrong delay for a different username:", delay)
+	}
+
+	th.Succeeded(a, "user")
+	if delay := th.Failed(a, "user"); delay != 1*time.Second {
+		t.Error("Delay is not reset by Succeeded:", delay)
+	}
+}
+
+func TestThrottle_Exempt(t *testing.T) {
+	th, _ := testThrottle(t, []config.Node{
+		{Name: "max_failures", Args: []string{"1"}},
+		{Name: "exempt", Args: []string{"10.0.0.0/8"}},
+	})
+
+	for _, a := range []net.Addr{addr("10.1.2.3"), &net.UnixAddr{Name: "/run/maddy.sock"}, nil} {
+		if delay := th.Failed(a, "user"); delay != 0 {
+			t.Error("Delay for exempt address", a)
+		}
+		if th.Blocked(a) {
+			t.Error("Exempt address is blocked:", a)
+		}
+	}
+}
+
+func TestThrottle_IPv6Prefix(t *testing.T) {
+	th, _ := testThrottle(t, []config.Node{
+		{Name: "max_failures", Args: []string{"2"}},
+	})
+
+	th.Failed(addr("2001:db8:1:2::1"), "user")
+	th.Failed(addr("2001:db8:1:2::2"), "user")
+	if !th.Blocked(addr("2001:db8:1:2::3")) {
+		t.Fatal("Addresses in the same /64 are not counted together")
+	}
+	if th.Blocked(addr("2001:db8:1:3::1")) {
+		t.Fatal("Different /64 is blocked")
+	}
+}
+
+func TestThrottle_Persist(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "state.json")
+	cfg := []config.Node{
+		{Name: "max_failures", Args: []string{"1"}},
+		{Name: "persist", Args: []string{"yes"}},
+		{Name: "location", Args: []string{location}},
+	}
+
+	th, _ := testThrottle(t, cfg)
+	th.Failed(addr("192.0.2.1"), "user")
+	if err := th.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := ReadState(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.IPs) != 1 || state.IPs["192.0.2.1"].Failures != 1 {
+		t.Fatal("Wrong state saved:", state)
+	}
+
+	th2, _ := testThrottle(t, cfg)
+	if !th2.Blocked(addr("192.0.2.1")) {
+		t.Fatal("Block is not restored from the state file")
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batv implements the Bounce Address Tag Validation (BATV) signing
+// scheme as described in draft-levine-smtp-batv-01 ("prvs" tags).
+//
+// Tagged address has the following format:
+//
+//	prvs=KDDDSSSSSS=local-part@domain
+//
+// Where K is the key number (0-9), DDD - the last three digits of the
+// expiration day number (days since Unix epoch) and SSSSSS - first three bytes
+// of HMAC-SHA1 of "KDDD" + original address, hex-encoded.
+package batv
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const prefix = "prvs="
+
+var (
+	ErrUntagged   = errors.New("batv: address is not tagged")
+	ErrMalformed  = errors.New("batv: malformed tag")
+	ErrUnknownKey = errors.New("batv: tag uses an unknown key")
+	ErrExpired    = errors.New("batv: tag expired")
+	ErrSignature  = errors.New("batv: signature mismatch")
+)
+
+// Tagger creates and verifies BATV tags.
+type Tagger struct {
+	// Keys by number. Multiple keys can be used to allow key rotation:
+	// new tags are created using SignKey, tags created using other keys are
+	// still accepted until they expire.
+	Keys    map[int][]byte
+	SignKey int
+
+	// Validity is the amount of time the tag is considered valid for. It is
+	// rounded up to whole days and must be less than 999 days.
+	Validity time.Duration
+}
+
+// LoadKeys reads keys from the file.
+//
+// Each non-empty line that does not start with '#' should contain key number
+// (0-9) and the secret separated by whitespace.
+func LoadKeys(path string) (map[int][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[int][]byte)
+	scnr := bufio.NewScanner(f)
+	lineNo := 0
+	for scnr.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("batv: %s:%d: expected key number and secret", path, lineNo)
+		}
+		num, err := strconv.Atoi(parts[0])
+		if err != nil || num < 0 || num > 9 {
+			return nil, fmt.Errorf("batv: %s:%d: key number should be in 0-9 range", path, lineNo)
+		}
+		if _, ok := keys[num]; ok {
+			return nil, fmt.Errorf("batv: %s:%d: duplicate key number %d", path, lineNo, num)
+		}
+		keys[num] = []byte(parts[1])
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("batv: no keys in %s", path)
+	}
+	return keys, nil
+}
+
+// NewTagger loads keys from keysFile and checks the configuration for
+// validity. signKey < 0 means to use the key with the highest number.
+func NewTagger(keysFile string, signKey int, validity time.Duration) (*Tagger, error) {
+	keys, err := LoadKeys(keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if signKey < 0 {
+		for num := range keys {
+			if num > signKey {
+				signKey = num
+			}
+		}
+	}
+	if _, ok := keys[signKey]; !ok {
+		return nil, fmt.Errorf("batv: no key with number %d in %s", signKey, keysFile)
+	}
+
+	if validity <= 0 || validity >= 999*24*time.Hour {
+		return nil, errors.New("batv: validity should be between 1 and 998 days")
+	}
+
+	return &Tagger{
+		Keys:     keys,
+		SignKey:  signKey,
+		Validity: validity,
+	}, nil
+}
+
+func dayNumber(t time.Time) int {
+	return int(t.Unix() / (24 * 60 * 60))
+}
+
+func (t *Tagger) validityDays() int {
+	days := int((t.Validity + 24*time.Hour - 1) / (24 * time.Hour))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+func (t *Tagger) signature(key []byte, keyNum int, day string, addr string) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(strconv.Itoa(keyNum) + day + strings.ToLower(addr)))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// IsTagged reports whether the address has a BATV tag. It does not verify
+// the tag.
+func IsTagged(addr string) bool {
+	return len(addr) > len(prefix) && strings.EqualFold(addr[:len(prefix)], prefix)
+}
+
+// Sign returns the tagged version of addr. Null and already tagged addresses
+// are returned unchanged.
+func (t *Tagger) Sign(addr string, now time.Time) (string, error) {
+	if addr == "" || IsTagged(addr) {
+		return addr, nil
+	}
+
+	key, ok := t.Keys[t.SignKey]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if mbox == "" || domain == "" || strings.HasPrefix(mbox, `"`) {
+		// Quoted local-parts and special addresses (e.g. postmaster) are
+		// left as is.
+		return addr, nil
+	}
+
+	day := fmt.Sprintf("%03d", (dayNumber(now)+t.validityDays())%1000)
+	return prefix + strconv.Itoa(t.SignKey) + day + t.signature(key, t.SignKey, day, addr) + "=" + mbox + "@" + domain, nil
+}
+
+// Strip splits the tagged address into the original address and the tag
+// value. It returns ErrUntagged if the address is not tagged and ErrMalformed
+// if the tag has invalid format.
+func Strip(addr string) (orig, tag string, err error) {
+	if !IsTagged(addr) {
+		return addr, "", ErrUntagged
+	}
+
+	rest := addr[len(prefix):]
+	eq := strings.IndexByte(rest, '=')
+	if eq == -1 {
+		return addr, "", ErrMalformed
+	}
+	tag = rest[:eq]
+	orig = rest[eq+1:]
+	if len(tag) != 10 || orig == "" || strings.HasPrefix(orig, "@") {
+		return addr, "", ErrMalformed
+	}
+	for _, ch := range tag[:4] {
+		if ch < '0' || ch > '9' {
+			return addr, "", ErrMalformed
+		}
+	}
+	if _, err := hex.DecodeString(tag[4:]); err != nil {
+		return addr, "", ErrMalformed
+	}
+
+	return orig, tag, nil
+}
+
+// Verify checks the tag of the address and returns the original address if
+// it is valid.
+func (t *Tagger) Verify(addr string, now time.Time) (string, error) {
+	orig, tag, err := Strip(addr)
+	if err != nil {
+		return addr, err
+	}
+
+	keyNum := int(tag[0] - '0')
+	key, ok := t.Keys[keyNum]
+	if !ok {
+		return addr, ErrUnknownKey
+	}
+
+	expDay, _ := strconv.Atoi(tag[1:4])
+	// Day numbers wrap around every 1000 days, so compare the distance
+	// between them instead of the values.
+	left := (expDay - dayNumber(now)%1000 + 1000) % 1000
+	if left > t.validityDays() {
+		return addr, ErrExpired
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(tag[4:])), []byte(t.signature(key, keyNum, tag[1:4], orig))) {
+		return addr, ErrSignature
+	}
+
+	return orig, nil
+}
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package batv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTagger() *Tagger {
+	return &Tagger{
+		Keys: map[int][]byte{
+			0: []byte("old-secret"),
+			1: []byte("new-secret"),
+		},
+		SignKey:  1,
+		Validity: 7 * 24 * time.Hour,
+	}
+}
+
+func TestTagger(t *testing.T) {
+	tg := testTagger()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tagged, err := tg.Sign("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tagged, "prvs=1") || !strings.HasSuffix(tagged, "=foo@example.org") {
+		t.Fatal("Unexpected tagged address:", tagged)
+	}
+
+	orig, err := tg.Verify(tagged, now.Add(6*24*time.Hour))
+	if err != nil {
+		t.Fatal("Verify:", err)
+	}
+	if orig != "foo@example.org" {
+		t.Fatal("Wrong original address:", orig)
+	}
+
+	// Case-folding by remote MTAs should not break the signature.
+	if _, err := tg.Verify(strings.ToUpper(tagged), now); err != nil {
+		t.Fatal("Verify (uppercase):", err)
+	}
+
+	if _, err := tg.Verify(tagged, now.Add(9*24*time.Hour)); err != ErrExpired {
+		t.Fatal("Expected ErrExpired, got", err)
+	}
+
+	forged := strings.Replace(tagged, "foo@", "bar@", 1)
+	if _, err := tg.Verify(forged, now); err != ErrSignature {
+		t.Fatal("Expected ErrSignature, got", err)
+	}
+
+	if _, err := tg.Verify("foo@example.org", now); err != ErrUntagged {
+		t.Fatal("Expected ErrUntagged, got", err)
+	}
+	if _, err := tg.Verify("prvs=xx=foo@example.org", now); err != ErrMalformed {
+		t.Fatal("Expected ErrMalformed, got", err)
+	}
+
+	if again, _ := tg.Sign(tagged, now); again != tagged {
+		t.Fatal("Already tagged address was signed again:", again)
+	}
+	if null, _ := tg.Sign("", now); null != "" {
+		t.Fatal("Null address was signed:", null)
+	}
+}
+
+func TestTagger_KeyRotation(t *testing.T) {
+	tg := testTagger()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tg.SignKey = 0
+	oldTagged, err := tg.Sign("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tg.SignKey = 1
+	if _, err := tg.Verify(oldTagged, now); err != nil {
+		t.Fatal("Tag created using the old key is not accepted:", err)
+	}
+
+	delete(tg.Keys, 0)
+	if _, err := tg.Verify(oldTagged, now); err != ErrUnknownKey {
+		t.Fatal("Expected ErrUnknownKey, got", err)
+	}
+}
+
+func TestTagger_DayWraparound(t *testing.T) {
+	tg := testTagger()
+	// Day 18997, expiration day number wraps to 004.
+	now := time.Unix(18997*24*60*60, 0)
+
+	tagged, err := tg.Sign("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tagged, "prvs=1004") {
+		t.Fatal("Unexpected tagged address:", tagged)
+	}
+	if _, err := tg.Verify(tagged, now.Add(5*24*time.Hour)); err != nil {
+		t.Fatal("Verify:", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-batv-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte("# comment\n0 secret0\n\n1 secret1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[0]) != "secret0" || string(keys[1]) != "secret1" {
+		t.Fatal("Wrong keys:", keys)
+	}
+
+	for _, bad := range []string{"", "10 secret\n", "0 a b\n", "0 a\n0 b\n"} {
+		if err := ioutil.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeys(path); err == nil {
+			t.Errorf("No error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package arc implements the check.arc module that validates the ARC chain
+// (RFC 8617) of the incoming message and reports the result in the
+// Authentication-Results header field.
+package arc
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.arc"
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	failAction    modconfig.FailAction
+	tempErrAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.arc: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("temperror_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.tempErrAction)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{
+					"check":    modName,
+					"smtp_msg": "Internal I/O error",
+				}),
+				true,
+			),
+		}
+	}
+	defer bodyRdr.Close()
+
+	res, err := arc.Verify(ctx, s.c.resolver, header, bodyRdr)
+	if err != nil {
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		return s.c.tempErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 29},
+				Message:      "Temporary error during ARC validation",
+				CheckName:    modName,
+				Err:          err,
+				Reason:       reason,
+				Misc:         misc,
+			},
+			AuthResult: []authres.Result{
+				&authres.GenericResult{
+					Method: "arc",
+					Value:  authres.ResultTempError,
+				},
+			},
+		})
+	}
+
+	authRes := &authres.GenericResult{
+		Method: "arc",
+		Value:  authres.ResultValue(res.Status),
+	}
+
+	switch res.Status {
+	case arc.StatusNone:
+		s.log.Debugf("no ARC chain")
+		return module.CheckResult{AuthResult: []authres.Result{authRes}}
+	case arc.StatusPass:
+		s.log.DebugMsg("valid ARC chain", "instances", res.Instances, "domain", res.Domain)
+		return module.CheckResult{AuthResult: []authres.Result{authRes}}
+	default:
+		s.log.DebugMsg("invalid ARC chain", "reason", res.Reason, "instances", res.Instances)
+		authRes.Params = map[string]string{"reason": res.Reason}
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 29},
+				Message:      "ARC chain validation failed",
+				CheckName:    modName,
+				Reason:       res.Reason,
+			},
+			AuthResult: []authres.Result{authRes},
+		})
+	}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,139 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testMsg(t *testing.T, sealed bool, zones map[string]mockdns.Zone) (textproto.Header, []byte) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader("From: <foo@example.org>\r\nSubject: Hello\r\n\r\nHello!\r\n"))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sealed {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zones["arc._domainkey.example.org."] = mockdns.Zone{
+			TXT: []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+		}
+		err = arc.Seal(&hdr, strings.NewReader(string(body)), arc.SealOptions{
+			Domain:     "example.org",
+			Selector:   "arc",
+			Signer:     key,
+			AuthServID: "mx.example.org",
+			HeaderKeys: []string{"From", "Subject"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return hdr, body
+}
+
+func runCheck(t *testing.T, zones map[string]mockdns.Zone, hdr textproto.Header, body []byte) module.CheckResult {
+	t.Helper()
+
+	c := &Check{
+		log:        testutils.Logger(t, modName),
+		resolver:   &mockdns.Resolver{Zones: zones},
+		failAction: modconfig.FailAction{Reject: true},
+	}
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	return s.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: body})
+}
+
+func checkAuthRes(t *testing.T, res module.CheckResult, val authres.ResultValue) {
+	t.Helper()
+	if len(res.AuthResult) != 1 {
+		t.Fatalf("expected 1 auth result, got %d", len(res.AuthResult))
+	}
+	arcRes, ok := res.AuthResult[0].(*authres.GenericResult)
+	if !ok || arcRes.Method != "arc" {
+		t.Fatalf("wrong auth result: %#v", res.AuthResult[0])
+	}
+	if arcRes.Value != val {
+		t.Errorf("wrong arc result: want %s, got %s", val, arcRes.Value)
+	}
+}
+
+func TestCheck_NoChain(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	hdr, body := testMsg(t, false, zones)
+
+	res := runCheck(t, zones, hdr, body)
+	if res.Reject {
+		t.Fatal("message without ARC chain is rejected:", res.Reason)
+	}
+	checkAuthRes(t, res, authres.ResultNone)
+}
+
+func TestCheck_Pass(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	hdr, body := testMsg(t, true, zones)
+
+	res := runCheck(t, zones, hdr, body)
+	if res.Reject {
+		t.Fatal("valid ARC chain is rejected:", res.Reason)
+	}
+	checkAuthRes(t, res, authres.ResultPass)
+}
+
+func TestCheck_Fail(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	hdr, body := testMsg(t, true, zones)
+	hdr.Set("Subject", "Changed")
+
+	res := runCheck(t, zones, hdr, body)
+	if !res.Reject {
+		t.Fatal("invalid ARC chain is not rejected")
+	}
+	checkAuthRes(t, res, authres.ResultFail)
+}
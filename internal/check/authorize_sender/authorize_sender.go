@@ -0,0 +1,206 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package authorize_sender implements the check that verifies that the
+// authenticated user is allowed to use the sender address.
+package authorize_sender
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.authorize_sender"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	table       module.Table
+	checkHeader bool
+	failAction  modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.authorize_sender: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// ApplyFailAction implements module.FailActionCheck.
+func (c *Check) ApplyFailAction(res module.CheckResult) module.CheckResult {
+	return c.failAction.Apply(res)
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &c.table)
+	cfg.Bool("check_header", false, false, &c.checkHeader)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) authUser() string {
+	if s.msgMeta.Conn == nil {
+		return ""
+	}
+	return s.msgMeta.Conn.AuthUser
+}
+
+func (s *state) check(username, addr, field string) module.CheckResult {
+	ok, err := auth.SenderAuthorized(s.c.table, username, addr)
+	if err != nil {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         exterrors.SMTPCode(err, 451, 554),
+				EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 1}),
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+			Reject: true,
+		}
+	}
+	if ok {
+		return module.CheckResult{}
+	}
+
+	s.log.Msg("unauthorized sender address", "username", username, "addr", addr, "field", field)
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "You are not allowed to use this sender address",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"username": username,
+				"addr":     addr,
+				"field":    field,
+			},
+		},
+	})
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckSender").End()
+
+	username := s.authUser()
+	if username == "" {
+		s.log.Debugf("unauthenticated client, skipping")
+		return module.CheckResult{}
+	}
+	if mailFrom == "" {
+		// Null return-path is used for bounces and is not attributable to
+		// any user.
+		return module.CheckResult{}
+	}
+
+	return s.check(username, mailFrom, "MAIL FROM")
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	if !s.c.checkHeader {
+		return module.CheckResult{}
+	}
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	username := s.authUser()
+	if username == "" {
+		return module.CheckResult{}
+	}
+
+	mailHdr := mail.Header{Header: message.Header{Header: hdr}}
+	from, err := mailHdr.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         553,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Missing or malformed From header field",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+
+	for _, addr := range from {
+		if res := s.check(username, addr.Address, "From"); res.Reason != nil {
+			return res
+		}
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
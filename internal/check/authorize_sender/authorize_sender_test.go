@@ -0,0 +1,107 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package authorize_sender
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T) *Check {
+	return &Check{
+		log: testutils.Logger(t, modName),
+		table: testutils.Table{M: map[string]string{
+			"alice":           "alice@example.org, alice.smith@example.org",
+			"admin":           "@example.org @Example.COM",
+			"bob@example.org": "bob@example.org,bobby@example.org",
+		}},
+		failAction: modconfig.FailAction{Reject: true},
+	}
+}
+
+func newState(t *testing.T, c *Check, authUser string) module.CheckState {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{AuthUser: authUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCheck_Sender(t *testing.T) {
+	c := testCheck(t)
+	test := func(authUser, mailFrom string, reject bool) {
+		t.Helper()
+		s := newState(t, c, authUser)
+		defer s.Close()
+
+		res := s.CheckSender(context.Background(), mailFrom)
+		if res.Reject != reject {
+			t.Errorf("%s as %q: want reject=%v, got %v (%v)", authUser, mailFrom, reject, res.Reject, res.Reason)
+		}
+	}
+
+	test("", "whoever@example.com", false)
+	test("alice", "alice@example.org", false)
+	test("alice", "Alice.Smith@EXAMPLE.org", false)
+	test("alice", "bob@example.org", true)
+	test("alice", "", false)
+	test("admin", "anyone@example.org", false)
+	test("admin", "anyone@example.com", false)
+	test("admin", "anyone@example.net", true)
+	test("bob@example.org", "bobby@example.org", false)
+	test("bob@example.org", "alice@example.org", true)
+	// No table entry, only own address is allowed.
+	test("carol@example.org", "carol@example.org", false)
+	test("carol@example.org", "alice@example.org", true)
+	test("alice", "malformed", true)
+}
+
+func TestCheck_Header(t *testing.T) {
+	c := testCheck(t)
+	test := func(authUser, from string, checkHeader, reject bool) {
+		t.Helper()
+		c.checkHeader = checkHeader
+		s := newState(t, c, authUser)
+		defer s.Close()
+
+		hdr := textproto.Header{}
+		if from != "" {
+			hdr.Add("From", from)
+		}
+		res := s.CheckBody(context.Background(), hdr, nil)
+		if res.Reject != reject {
+			t.Errorf("%s with From %q: want reject=%v, got %v (%v)", authUser, from, reject, res.Reject, res.Reason)
+		}
+	}
+
+	test("alice", "Eve <eve@example.org>", false, false)
+	test("alice", "Alice <alice@example.org>", true, false)
+	test("alice", "Eve <eve@example.org>", true, true)
+	test("alice", "Alice <alice@example.org>, Eve <eve@example.org>", true, true)
+	test("alice", "", true, true)
+	test("", "Eve <eve@example.org>", true, false)
+}
@@ -0,0 +1,193 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batv implements the check that rejects bounces (messages with null
+// MAIL FROM) sent to addresses without a valid BATV tag.
+//
+// See internal/batv for the tagging scheme and modify.batv for the paired
+// modifier that tags outbound messages.
+package batv
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/batv"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.batv"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	tagger     *batv.Tagger
+	bypass     []string
+	failAction modconfig.FailAction
+	now        func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// ApplyFailAction implements module.FailActionCheck.
+func (c *Check) ApplyFailAction(res module.CheckResult) module.CheckResult {
+	return c.failAction.Apply(res)
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		keysFile string
+		validity time.Duration
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("keys_file", false, true, "", &keysFile)
+	cfg.Duration("validity", false, false, 7*24*time.Hour, &validity)
+	cfg.StringList("bypass", false, false, nil, &c.bypass)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, pattern := range c.bypass {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: malformed bypass pattern %s: %v", modName, pattern, err)
+		}
+	}
+
+	var err error
+	c.tagger, err = batv.NewTagger(keysFile, -1, validity)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+type state struct {
+	c        *Check
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
+	mailFrom string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = addr
+	return module.CheckResult{}
+}
+
+func (s *state) bypassed(rcptTo string) bool {
+	normAddr, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range s.c.bypass {
+		if ok, _ := path.Match(pattern, normAddr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckRcpt").End()
+
+	if s.mailFrom != "" {
+		return module.CheckResult{}
+	}
+	if s.bypassed(rcptTo) {
+		s.log.Debugf("%s matches bypass list, not checking", rcptTo)
+		return module.CheckResult{}
+	}
+
+	_, err := s.c.tagger.Verify(rcptTo, s.c.now())
+	if err == nil {
+		return module.CheckResult{}
+	}
+
+	msg := "Bounce sent to the address that did not send any messages"
+	if err == batv.ErrExpired {
+		msg = "Bounce sent to the address tag that is expired"
+	}
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      msg,
+			CheckName:    modName,
+			Err:          err,
+			Misc: map[string]interface{}{
+				"rcpt": rcptTo,
+			},
+		},
+	})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,78 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package batv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/batv"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheck(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tagger := &batv.Tagger{
+		Keys:     map[int][]byte{0: []byte("secret")},
+		SignKey:  0,
+		Validity: 7 * 24 * time.Hour,
+	}
+	tagged, err := tagger.Sign("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Check{
+		log:    testutils.Logger(t, modName),
+		tagger: tagger,
+		bypass: []string{"*-bounces+*@example.org"},
+		now:    func() time.Time { return now },
+	}
+	c.failAction.Reject = true
+
+	test := func(mailFrom, rcptTo string, fail bool) {
+		t.Helper()
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		s.CheckSender(context.Background(), mailFrom)
+		res := s.CheckRcpt(context.Background(), rcptTo)
+		if fail && (res.Reason == nil || !res.Reject) {
+			t.Errorf("%q -> %q: expected rejection", mailFrom, rcptTo)
+		}
+		if !fail && res.Reason != nil {
+			t.Errorf("%q -> %q: unexpected error: %v", mailFrom, rcptTo, res.Reason)
+		}
+	}
+
+	test("", tagged, false)
+	test("", "foo@example.org", true)
+	test("", "prvs=0000aabbcc=foo@example.org", true)
+	test("", "list-bounces+foo=example.com@example.org", false)
+	test("bar@example.com", "foo@example.org", false)
+
+	c.now = func() time.Time { return now.Add(10 * 24 * time.Hour) }
+	test("", tagged, true)
+}
@@ -25,6 +25,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
@@ -32,6 +33,8 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -56,6 +59,24 @@ const (
 
 var placeholderRe = regexp.MustCompile(`{[a-zA-Z0-9_]+?}`)
 
+// placeholders lists the names of values passed to the command. They are
+// available both as argument placeholders ({name}) and environment variables
+// (MADDY_NAME).
+var placeholders = []string{
+	"auth_user",
+	"source_ip",
+	"source_host",
+	"source_rdns",
+	"msg_id",
+	"sender",
+	"rcpts",
+	"address",
+}
+
+// maxStderr is the maximum amount of command stderr output that is captured
+// into the log.
+const maxStderr = 4096
+
 type Check struct {
 	instName string
 	log      log.Logger
@@ -64,11 +85,17 @@ type Check struct {
 	actions map[int]modconfig.FailAction
 	cmd     string
 	cmdArgs []string
+	timeout time.Duration
+
+	// Semaphore limiting the amount of concurrently running commands, nil if
+	// there is no limit.
+	sem chan struct{}
 }
 
 func New(modName, instName string, aliases, inlineArgs []string) (module.Module, error) {
 	c := &Check{
 		instName: instName,
+		log:      log.Logger{Name: modName},
 		actions: map[int]modconfig.FailAction{
 			1: modconfig.FailAction{
 				Reject: true,
@@ -76,6 +103,14 @@ func New(modName, instName string, aliases, inlineArgs []string) (module.Module,
 			2: modconfig.FailAction{
 				Quarantine: true,
 			},
+			3: modconfig.FailAction{
+				Reject: true,
+				ReasonOverride: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+					Message:      "Message rejected due to a local policy, try again later",
+				},
+			},
 		},
 	}
 
@@ -103,9 +138,13 @@ func (c *Check) Init(cfg *config.Map) error {
 		return fmt.Errorf("command: %w", err)
 	}
 
+	var maxConcurrency int
+	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.Enum("run_on", false, false,
 		[]string{StageConnection, StageSender, StageRcpt, StageBody}, StageBody,
 		(*string)(&c.stage))
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.Int("max_concurrency", false, false, 20, &maxConcurrency)
 
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
@@ -134,6 +173,10 @@ func (c *Check) Init(cfg *config.Map) error {
 		}
 	}
 
+	if maxConcurrency > 0 {
+		c.sem = make(chan struct{}, maxConcurrency)
+	}
+
 	return nil
 }
 
@@ -154,51 +197,61 @@ func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadat
 	}, nil
 }
 
+func (s *state) placeholderValue(name, address string) string {
+	switch name {
+	case "auth_user":
+		if s.msgMeta.Conn == nil {
+			return ""
+		}
+		return s.msgMeta.Conn.AuthUser
+	case "source_ip":
+		if s.msgMeta.Conn == nil {
+			return ""
+		}
+		tcpAddr, _ := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+		if tcpAddr == nil {
+			return ""
+		}
+		return tcpAddr.IP.String()
+	case "source_host":
+		if s.msgMeta.Conn == nil {
+			return ""
+		}
+		return s.msgMeta.Conn.Hostname
+	case "source_rdns":
+		if s.msgMeta.Conn == nil || s.msgMeta.Conn.RDNSName == nil {
+			return ""
+		}
+		valI, err := s.msgMeta.Conn.RDNSName.Get()
+		if err != nil {
+			return ""
+		}
+		if valI == nil {
+			return ""
+		}
+		return valI.(string)
+	case "msg_id":
+		return s.msgMeta.ID
+	case "sender":
+		return s.mailFrom
+	case "rcpts":
+		return strings.Join(s.rcpts, "\n")
+	case "address":
+		return address
+	}
+	return ""
+}
+
 func (s *state) expandCommand(address string) (string, []string) {
 	expArgs := make([]string, len(s.c.cmdArgs))
 
 	for i, arg := range s.c.cmdArgs {
 		expArgs[i] = placeholderRe.ReplaceAllStringFunc(arg, func(placeholder string) string {
-			switch placeholder {
-			case "{auth_user}":
-				if s.msgMeta.Conn == nil {
-					return ""
-				}
-				return s.msgMeta.Conn.AuthUser
-			case "{source_ip}":
-				if s.msgMeta.Conn == nil {
-					return ""
+			name := placeholder[1 : len(placeholder)-1]
+			for _, known := range placeholders {
+				if name == known {
+					return s.placeholderValue(name, address)
 				}
-				tcpAddr, _ := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
-				if tcpAddr == nil {
-					return ""
-				}
-				return tcpAddr.IP.String()
-			case "{source_host}":
-				if s.msgMeta.Conn == nil {
-					return ""
-				}
-				return s.msgMeta.Conn.Hostname
-			case "{source_rdns}":
-				if s.msgMeta.Conn == nil {
-					return ""
-				}
-				valI, err := s.msgMeta.Conn.RDNSName.Get()
-				if err != nil {
-					return ""
-				}
-				if valI == nil {
-					return ""
-				}
-				return valI.(string)
-			case "{msg_id}":
-				return s.msgMeta.ID
-			case "{sender}":
-				return s.mailFrom
-			case "{rcpts}":
-				return strings.Join(s.rcpts, "\n")
-			case "{address}":
-				return address
 			}
 			return placeholder
 		})
@@ -207,74 +260,135 @@ func (s *state) expandCommand(address string) (string, []string) {
 	return s.c.cmd, expArgs
 }
 
-func (s *state) run(cmdName string, args []string, stdin io.Reader) module.CheckResult {
+// env returns the environment for the command: maddy environment plus
+// MADDY_* variables with the same values as placeholders.
+func (s *state) env(address string) []string {
+	env := os.Environ()
+	env = append(env, "MADDY_STAGE="+string(s.c.stage))
+	for _, name := range placeholders {
+		env = append(env, "MADDY_"+strings.ToUpper(name)+"="+s.placeholderValue(name, address))
+	}
+	return env
+}
+
+// limitedBuffer is io.Writer that keeps only first max bytes written to it.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(b []byte) (int, error) {
+	if left := lb.max - lb.buf.Len(); left < len(b) {
+		lb.truncated = true
+		if left > 0 {
+			lb.buf.Write(b[:left])
+		}
+		return len(b), nil
+	}
+	return lb.buf.Write(b)
+}
+
+func (s *state) logStderr(stderr *limitedBuffer, cmdLine string) {
+	if stderr.buf.Len() == 0 {
+		return
+	}
+	scnr := bufio.NewScanner(&stderr.buf)
+	for scnr.Scan() {
+		s.log.Msg("command stderr", "cmd", cmdLine, "line", scnr.Text())
+	}
+	if stderr.truncated {
+		s.log.Msg("command stderr is truncated", "cmd", cmdLine, "max_size", maxStderr)
+	}
+}
+
+func internalErr(err error, reason, cmdLine string) module.CheckResult {
+	return module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:      450,
+			Message:   "Internal server error",
+			CheckName: "command",
+			Err:       err,
+			Reason:    reason,
+			Misc: map[string]interface{}{
+				"cmd": cmdLine,
+			},
+		},
+		Reject: true,
+	}
+}
+
+func (s *state) run(ctx context.Context, address string, stdin io.Reader) module.CheckResult {
+	cmdName, args := s.expandCommand(address)
 	cmd := exec.Command(cmdName, args...)
+	cmdLine := cmd.String()
+
+	if s.c.sem != nil {
+		select {
+		case s.c.sem <- struct{}{}:
+			defer func() { <-s.c.sem }()
+		case <-ctx.Done():
+			return internalErr(ctx.Err(), "", cmdLine)
+		}
+	}
+
+	cmd.Env = s.env(address)
 	cmd.Stdin = stdin
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	setProcGroup(cmd)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:      450,
-				Message:   "Internal server error",
-				CheckName: "command",
-				Err:       err,
-				Misc: map[string]interface{}{
-					"cmd": cmd.String(),
-				},
-			},
-			Reject: true,
-		}
+		return internalErr(err, "", cmdLine)
 	}
 
 	if err := cmd.Start(); err != nil {
-		return module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:      450,
-				Message:   "Internal server error",
-				CheckName: "command",
-				Err:       err,
-				Misc: map[string]interface{}{
-					"cmd": cmd.String(),
-				},
-			},
-			Reject: true,
-		}
+		return internalErr(err, "", cmdLine)
+	}
+
+	var (
+		timedOut int32
+		timer    *time.Timer
+	)
+	if s.c.timeout != 0 {
+		timer = time.AfterFunc(s.c.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			if err := killProcGroup(cmd); err != nil {
+				s.log.Error("failed to kill process", err, "cmd", cmdLine)
+			}
+		})
 	}
 
 	bufOut := bufio.NewReader(stdout)
-	hdr, err := textproto.ReadHeader(bufOut)
-	if err != nil && !errors.Is(err, io.EOF) {
-		if err := cmd.Process.Signal(os.Interrupt); err != nil {
-			s.log.Error("failed to kill process", err)
+	hdr, hdrErr := textproto.ReadHeader(bufOut)
+	if hdrErr != nil && !errors.Is(hdrErr, io.EOF) {
+		if err := killProcGroup(cmd); err != nil {
+			s.log.Error("failed to kill process", err, "cmd", cmdLine)
 		}
+	} else {
+		hdrErr = nil
+	}
+	// Anything after the header is ignored, but we still need to read it so
+	// the command will not block on write.
+	_, _ = io.Copy(ioutil.Discard, bufOut)
 
-		return module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:      450,
-				Message:   "Internal server error",
-				CheckName: "command",
-				Err:       err,
-				Misc: map[string]interface{}{
-					"cmd": cmd.String(),
-				},
-			},
-			Reject: true,
-		}
+	err = cmd.Wait()
+	if timer != nil {
+		timer.Stop()
+	}
+	s.logStderr(stderr, cmdLine)
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return internalErr(err, "command timed out", cmdLine)
+	}
+	if hdrErr != nil {
+		return internalErr(hdrErr, "malformed header in command output", cmdLine)
 	}
 
 	res := module.CheckResult{}
 	res.Header = hdr
-
-	err = cmd.Wait()
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); !ok {
-			// If that's not ExitError, the process may still be running. We do
-			// not want this.
-			if err := cmd.Process.Signal(os.Interrupt); err != nil {
-				s.log.Error("failed to kill process", err)
-			}
-		}
-		return s.errorRes(err, res, cmd.String())
+		return s.errorRes(err, res, cmdLine)
 	}
 	return res
 }
@@ -333,8 +447,7 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 
 	defer trace.StartRegion(ctx, "command/CheckConnection-"+s.c.cmd).End()
 
-	cmdName, cmdArgs := s.expandCommand("")
-	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
+	return s.run(ctx, "", bytes.NewReader(nil))
 }
 
 func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
@@ -346,8 +459,7 @@ func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult
 
 	defer trace.StartRegion(ctx, "command/CheckSender"+s.c.cmd).End()
 
-	cmdName, cmdArgs := s.expandCommand(addr)
-	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
+	return s.run(ctx, addr, bytes.NewReader(nil))
 }
 
 func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
@@ -358,8 +470,7 @@ func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
 	}
 	defer trace.StartRegion(ctx, "command/CheckRcpt"+s.c.cmd).End()
 
-	cmdName, cmdArgs := s.expandCommand(addr)
-	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
+	return s.run(ctx, addr, bytes.NewReader(nil))
 }
 
 func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
@@ -369,27 +480,16 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 
 	defer trace.StartRegion(ctx, "command/CheckBody"+s.c.cmd).End()
 
-	cmdName, cmdArgs := s.expandCommand("")
-
 	var buf bytes.Buffer
 	_ = textproto.WriteHeader(&buf, hdr)
 	bR, err := body.Open()
 	if err != nil {
-		return module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:      450,
-				Message:   "Internal server error",
-				CheckName: "command",
-				Err:       err,
-				Misc: map[string]interface{}{
-					"cmd": cmdName + " " + strings.Join(cmdArgs, " "),
-				},
-			},
-			Reject: true,
-		}
+		cmdName, cmdArgs := s.expandCommand("")
+		return internalErr(err, "", cmdName+" "+strings.Join(cmdArgs, " "))
 	}
+	defer bR.Close()
 
-	return s.run(cmdName, cmdArgs, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
+	return s.run(ctx, "", io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
 }
 
 func (s *state) Close() error {
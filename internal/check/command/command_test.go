@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package command
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, script string) *Check {
+	return &Check{
+		log:     testutils.Logger(t, modName),
+		stage:   StageSender,
+		cmd:     "/bin/sh",
+		cmdArgs: []string{"-c", script},
+		timeout: 5 * time.Second,
+		actions: map[int]modconfig.FailAction{
+			1: {Reject: true},
+			3: {
+				Reject: true,
+				ReasonOverride: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+				},
+			},
+		},
+	}
+}
+
+func runSender(t *testing.T, c *Check, ctx context.Context, sender string) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: "test-msg",
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				Hostname: "mx.example.org",
+			},
+			AuthUser: "user",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckSender(ctx, sender)
+}
+
+func TestCheck_Env(t *testing.T) {
+	c := testCheck(t, `echo "X-Env: $MADDY_STAGE $MADDY_SENDER $MADDY_ADDRESS $MADDY_MSG_ID $MADDY_AUTH_USER $MADDY_SOURCE_HOST"`)
+	res := runSender(t, c, context.Background(), "foo@example.org")
+	if res.Reason != nil {
+		t.Fatal("unexpected failure:", res.Reason)
+	}
+	if val := res.Header.Get("X-Env"); val != "sender foo@example.org foo@example.org test-msg user mx.example.org" {
+		t.Error("wrong environment passed:", val)
+	}
+}
+
+func TestCheck_ExitCodes(t *testing.T) {
+	c := testCheck(t, `echo "rejected!" >&2; exit 1`)
+	if res := runSender(t, c, context.Background(), "foo@example.org"); !res.Reject {
+		t.Error("exit code 1 should cause rejection")
+	}
+
+	c = testCheck(t, `exit 3`)
+	res := runSender(t, c, context.Background(), "foo@example.org")
+	if !res.Reject {
+		t.Fatal("exit code 3 should cause rejection")
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Error("exit code 3 should cause temporary rejection, got", res.Reason)
+	}
+
+	c = testCheck(t, `exit 42`)
+	if res := runSender(t, c, context.Background(), "foo@example.org"); !res.Reject {
+		t.Error("unknown exit code should cause rejection")
+	}
+}
+
+func TestCheck_Timeout(t *testing.T) {
+	// Background process keeps stdout open, it should be killed too.
+	c := testCheck(t, `sleep 10 & sleep 10`)
+	c.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	res := runSender(t, c, context.Background(), "foo@example.org")
+	if !res.Reject {
+		t.Error("timed out command should cause rejection")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("process group is not killed on timeout")
+	}
+}
+
+func TestCheck_Concurrency(t *testing.T) {
+	c := testCheck(t, `exit 0`)
+	c.sem = make(chan struct{}, 1)
+	c.sem <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if res := runSender(t, c, ctx, "foo@example.org"); !res.Reject {
+		t.Error("command should not be executed if the limit is reached")
+	}
+
+	<-c.sem
+	if res := runSender(t, c, context.Background(), "foo@example.org"); res.Reason != nil {
+		t.Error("unexpected failure:", res.Reason)
+	}
+}
@@ -57,10 +57,15 @@ var defaultBL = List{
 }
 
 type DNSBL struct {
-	instName   string
-	checkEarly bool
-	inlineBls  []string
-	bls        []List
+	instName string
+
+	// Protects the configuration fields below, they are replaced on
+	// configuration reload.
+	cfgLck       sync.RWMutex
+	checkEarly   bool
+	cacheResults bool
+	inlineBls    []string
+	bls          []List
 
 	quarantineThres int
 	rejectThres     int
@@ -87,11 +92,48 @@ func (bl *DNSBL) InstanceName() string {
 	return bl.instName
 }
 
+// CacheResults implements module.CacheableCheck.
+func (bl *DNSBL) CacheResults() bool {
+	bl.cfgLck.RLock()
+	defer bl.cfgLck.RUnlock()
+	return bl.cacheResults
+}
+
 func (bl *DNSBL) Init(cfg *config.Map) error {
+	return bl.readConfig(cfg)
+}
+
+// Reload implements module.ReloadModule.
+//
+// Checks in progress complete using the old list of DNSBLs and thresholds.
+func (bl *DNSBL) Reload(cfg *config.Map) (func(), error) {
+	newBl := &DNSBL{
+		instName:  bl.instName,
+		inlineBls: bl.inlineBls,
+		resolver:  bl.resolver,
+		log:       bl.log,
+	}
+	if err := newBl.readConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		bl.cfgLck.Lock()
+		defer bl.cfgLck.Unlock()
+		bl.checkEarly = newBl.checkEarly
+		bl.cacheResults = newBl.cacheResults
+		bl.bls = newBl.bls
+		bl.quarantineThres = newBl.quarantineThres
+		bl.rejectThres = newBl.rejectThres
+	}, nil
+}
+
+func (bl *DNSBL) readConfig(cfg *config.Map) error {
 	cfg.Bool("debug", false, false, &bl.log.Debug)
 	cfg.Bool("check_early", false, false, &bl.checkEarly)
 	cfg.Int("quarantine_threshold", false, false, 1, &bl.quarantineThres)
 	cfg.Int("reject_threshold", false, false, 9999, &bl.rejectThres)
+	cfg.Bool("cache_results", false, true, &bl.cacheResults)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
@@ -101,7 +143,9 @@ func (bl *DNSBL) Init(cfg *config.Map) error {
 	for _, inlineBl := range bl.inlineBls {
 		cfg := defaultBL
 		cfg.Zone = inlineBl
-		go bl.testList(cfg)
+		if !config.CheckOnly {
+			go bl.testList(cfg)
+		}
 		bl.bls = append(bl.bls, cfg)
 	}
 
@@ -168,7 +212,9 @@ func (bl *DNSBL) readListCfg(node config.Node) error {
 		// Sadly, however, many DNSBLs lack test records so at most we can
 		// log a warning. Also, DNS is kinda slow so we do checks
 		// asynchronously to prevent slowing down server start-up.
-		go bl.testList(zoneCfg)
+		if !config.CheckOnly {
+			go bl.testList(zoneCfg)
+		}
 	}
 
 	return nil
@@ -301,7 +347,11 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		reasons  []string
 	)
 
-	for _, list := range bl.bls {
+	bl.cfgLck.RLock()
+	bls, quarantineThres, rejectThres := bl.bls, bl.quarantineThres, bl.rejectThres
+	bl.cfgLck.RUnlock()
+
+	for _, list := range bls {
 		list := list
 		eg.Go(func() error {
 			err := bl.checkList(ctx, list, ip, ehlo, mailFrom)
@@ -336,9 +386,10 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		}
 	}
 
-	if score >= bl.rejectThres {
+	if score >= rejectThres {
 		return module.CheckResult{
 			Reject: true,
+			Score:  score,
 			Reason: &exterrors.SMTPError{
 				Code:         554,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
@@ -348,9 +399,10 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 			},
 		}
 	}
-	if score >= bl.quarantineThres {
+	if score >= quarantineThres {
 		return module.CheckResult{
 			Quarantine: true,
+			Score:      score,
 			Reason: &exterrors.SMTPError{
 				Code:         554,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
@@ -361,12 +413,18 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		}
 	}
 
-	return module.CheckResult{}
+	return module.CheckResult{Score: score}
+}
+
+func (bl *DNSBL) isCheckEarly() bool {
+	bl.cfgLck.RLock()
+	defer bl.cfgLck.RUnlock()
+	return bl.checkEarly
 }
 
 // CheckConnection implements module.EarlyCheck.
 func (bl *DNSBL) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
-	if !bl.checkEarly {
+	if !bl.isCheckEarly() {
 		return nil
 	}
 
@@ -403,7 +461,7 @@ func (bl *DNSBL) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetada
 }
 
 func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
-	if s.bl.checkEarly {
+	if s.bl.isCheckEarly() {
 		// Already checked before.
 		return module.CheckResult{}
 	}
@@ -25,6 +25,8 @@ import (
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -211,3 +213,49 @@ func TestCheckLists(t *testing.T) {
 		true, false,
 	)
 }
+
+func TestDNSBL_Reload(t *testing.T) {
+	listCfg := func(rejectThres string) *config.Map {
+		return config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "reject_threshold", Args: []string{rejectThres}},
+				{Name: "example.org"},
+			},
+		})
+	}
+
+	mod := &DNSBL{
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"4.3.2.1.example.org.": {
+				A: []string{"127.0.0.1"},
+			},
+		}},
+		// testList goroutines may outlive the test, so do not use t.Log.
+		log: log.Logger{Name: "dnsbl", Out: log.NopOutput{}},
+	}
+	if err := mod.Init(listCfg("5")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(reject bool) {
+		t.Helper()
+		result := mod.checkLists(context.Background(), net.IPv4(1, 2, 3, 4), "", "")
+		if result.Reject != reject {
+			t.Errorf("expected reject=%v, got %v", reject, result.Reject)
+		}
+	}
+	check(false)
+
+	if _, err := mod.Reload(listCfg("-")); err == nil {
+		t.Fatal("expected an error for invalid threshold")
+	}
+	check(false)
+
+	apply, err := mod.Reload(listCfg("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+	apply()
+	check(true)
+}
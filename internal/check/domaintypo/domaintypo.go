@@ -0,0 +1,335 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package domaintypo implements the check that detects likely typos in
+// recipient domains (e.g. gmial.com instead of gmail.com).
+package domaintypo
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "check.domain_typo"
+
+	// WarningHeader is the header field added to the message if the action is
+	// 'header'.
+	WarningHeader = "X-Recipient-Domain-Warning"
+)
+
+// builtinDomains is a list of high-traffic mailbox providers. Most of typos
+// happen in these.
+var builtinDomains = []string{
+	"aol.com",
+	"att.net",
+	"comcast.net",
+	"fastmail.com",
+	"gmail.com",
+	"gmx.com",
+	"gmx.de",
+	"gmx.net",
+	"googlemail.com",
+	"hotmail.co.uk",
+	"hotmail.com",
+	"hotmail.fr",
+	"icloud.com",
+	"live.com",
+	"mail.ru",
+	"me.com",
+	"msn.com",
+	"outlook.com",
+	"proton.me",
+	"protonmail.com",
+	"verizon.net",
+	"web.de",
+	"yahoo.co.uk",
+	"yahoo.com",
+	"yahoo.fr",
+	"yandex.ru",
+	"zoho.com",
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	domains     map[string]struct{}
+	allowed     map[string]struct{}
+	maxDistance int
+	skipIfMX    bool
+	action      string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.domain_typo: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func normalizeList(list []string) (map[string]struct{}, error) {
+	res := make(map[string]struct{}, len(list))
+	for _, domain := range list {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return nil, err
+		}
+		res[normDomain] = struct{}{}
+	}
+	return res, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		useBuiltin bool
+		domains    []string
+		allowed    []string
+		err        error
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Bool("builtin_domains", false, true, &useBuiltin)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.StringList("allow_domains", false, false, nil, &allowed)
+	cfg.Int("max_distance", false, false, 1, &c.maxDistance)
+	cfg.Bool("skip_if_mx", false, false, &c.skipIfMX)
+	cfg.Enum("action", false, false, []string{"reject", "header"}, "reject", &c.action)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if useBuiltin {
+		domains = append(domains, builtinDomains...)
+	}
+	if len(domains) == 0 {
+		return errors.New("check.domain_typo: no domains to compare against")
+	}
+	if c.maxDistance < 1 {
+		return errors.New("check.domain_typo: max_distance should be at least 1")
+	}
+
+	c.domains, err = normalizeList(domains)
+	if err != nil {
+		return err
+	}
+	c.allowed, err = normalizeList(allowed)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// distance computes the optimal string alignment distance between a and b
+// (Levenshtein distance that also counts transposition of two adjacent
+// characters as a single edit).
+//
+// Computation stops early and max+1 is returned if the distance is
+// known to be bigger than max.
+func distance(a, b string, max int) int {
+	ar, br := []rune(a), []rune(b)
+	if diff := len(ar) - len(br); diff > max || -diff > max {
+		return max + 1
+	}
+
+	// Three rows are enough for OSA.
+	prev2 := make([]int, len(br)+1)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+
+			d := prev[j] + 1
+			if ins := cur[j-1] + 1; ins < d {
+				d = ins
+			}
+			if sub := prev[j-1] + cost; sub < d {
+				d = sub
+			}
+			if i > 1 && j > 1 && ar[i-1] == br[j-2] && ar[i-2] == br[j-1] {
+				if tr := prev2[j-2] + 1; tr < d {
+					d = tr
+				}
+			}
+
+			cur[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(br)]
+}
+
+// suggest returns the known domain the specified one is likely a misspelling
+// of or an empty string.
+func (c *Check) suggest(domain string) string {
+	if _, ok := c.domains[domain]; ok {
+		return ""
+	}
+	if _, ok := c.allowed[domain]; ok {
+		return ""
+	}
+
+	best, bestDist := "", c.maxDistance+1
+	for known := range c.domains {
+		dist := distance(domain, known, c.maxDistance)
+		// Prefer lexicographically smaller domain for equal distances to
+		// make the result deterministic.
+		if dist < bestDist || (dist == bestDist && best != "" && known < best) {
+			best, bestDist = known, dist
+		}
+	}
+	return best
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// hasMX reports whether the domain has usable MX records. DNS errors are
+// logged and treated as no MX.
+func (s *state) hasMX(ctx context.Context, domain string) bool {
+	mxs, err := s.c.resolver.LookupMX(ctx, dns.FQDN(domain))
+	if err != nil {
+		if !dns.IsNotFound(err) {
+			s.log.Error("MX lookup failed", err, "domain", domain)
+		}
+		return false
+	}
+	for _, mx := range mxs {
+		if mx.Host != "." {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckRcpt").End()
+
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return module.CheckResult{}
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		s.log.Debugf("malformed domain %s: %v", domain, err)
+		return module.CheckResult{}
+	}
+
+	suggestion := s.c.suggest(domain)
+	if suggestion == "" {
+		return module.CheckResult{}
+	}
+
+	if s.c.skipIfMX && s.hasMX(ctx, domain) {
+		s.log.Debugf("%s looks like a typo of %s, but has MX records", domain, suggestion)
+		return module.CheckResult{}
+	}
+
+	s.log.Msg("possible recipient domain typo", "rcpt", addr, "suggestion", suggestion)
+
+	if s.c.action == "header" {
+		hdr := textproto.Header{}
+		hdr.Add(WarningHeader, addr+"; did you mean "+suggestion+"?")
+		return module.CheckResult{Header: hdr}
+	}
+
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "Recipient domain " + domain + " looks like a typo, did you mean " + suggestion + "?",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"suggestion": suggestion,
+			},
+		},
+	}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
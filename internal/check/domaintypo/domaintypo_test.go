@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package domaintypo
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		max  int
+		dist int
+	}{
+		{"gmail.com", "gmail.com", 2, 0},
+		{"gmial.com", "gmail.com", 2, 1},
+		{"gmal.com", "gmail.com", 2, 1},
+		{"gmail.con", "gmail.com", 2, 1},
+		{"gnail.com", "gmail.com", 2, 1},
+		{"gmaail.com", "gmail.com", 2, 1},
+		{"hotmial.con", "hotmail.com", 2, 2},
+		{"hotmial.con", "hotmail.com", 1, 2},
+		{"example.org", "gmail.com", 1, 2},
+		{"gmail.com", "a.b", 2, 3},
+	} {
+		if dist := distance(c.a, c.b, c.max); dist != c.dist {
+			t.Errorf("distance(%s, %s, %d) = %d, want %d", c.a, c.b, c.max, dist, c.dist)
+		}
+	}
+}
+
+func testCheck(t *testing.T, action string, skipIfMX bool) *Check {
+	domains, _ := normalizeList(builtinDomains)
+	allowed, _ := normalizeList([]string{"gmx.org"})
+	return &Check{
+		log: testutils.Logger(t, modName),
+		resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"yahoo.cm.": {
+					MX: []net.MX{{Host: "mx.yahoo.cm.", Pref: 10}},
+				},
+			},
+		},
+		domains:     domains,
+		allowed:     allowed,
+		maxDistance: 1,
+		skipIfMX:    skipIfMX,
+		action:      action,
+	}
+}
+
+func checkRcpt(t *testing.T, c *Check, rcpt string) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckRcpt(context.Background(), rcpt)
+}
+
+func TestCheck_Reject(t *testing.T) {
+	c := testCheck(t, "reject", false)
+
+	for _, rcpt := range []string{
+		"test@gmail.com",
+		"test@example.org",
+		"test@GMAIL.COM",
+		// Allowlisted.
+		"test@gmx.org",
+		"postmaster",
+	} {
+		if res := checkRcpt(t, c, rcpt); res.Reject || res.Reason != nil {
+			t.Errorf("%s: unexpected rejection: %v", rcpt, res.Reason)
+		}
+	}
+
+	res := checkRcpt(t, c, "test@gmial.com")
+	if !res.Reject {
+		t.Fatal("typo is not detected")
+	}
+	if code := exterrors.Fields(res.Reason)["smtp_code"]; code != 553 {
+		t.Error("wrong SMTP code:", code)
+	}
+	if msg := exterrors.Fields(res.Reason)["smtp_msg"]; msg != "Recipient domain gmial.com looks like a typo, did you mean gmail.com?" {
+		t.Error("wrong SMTP message:", msg)
+	}
+}
+
+func TestCheck_Header(t *testing.T) {
+	c := testCheck(t, "header", false)
+
+	res := checkRcpt(t, c, "test@hotmial.com")
+	if res.Reject || res.Reason != nil {
+		t.Fatal("unexpected rejection:", res.Reason)
+	}
+	if val := res.Header.Get(WarningHeader); val != "test@hotmial.com; did you mean hotmail.com?" {
+		t.Errorf("wrong header value: %q", val)
+	}
+}
+
+func TestCheck_SkipIfMX(t *testing.T) {
+	c := testCheck(t, "reject", true)
+
+	if res := checkRcpt(t, c, "test@yahoo.cm"); res.Reject {
+		t.Error("domain with MX records is rejected")
+	}
+	if res := checkRcpt(t, c, "test@yahooo.com"); !res.Reject {
+		t.Error("domain without MX records is not rejected")
+	}
+}
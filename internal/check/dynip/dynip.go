@@ -0,0 +1,417 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package dynip implements the check that detects clients connecting from
+// dynamic (residential) IP addresses using PTR naming patterns and DNS-based
+// lists of dynamic address ranges (such as Spamhaus PBL).
+package dynip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"runtime/trace"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.dynamic_ip"
+
+type pattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// builtinPatterns match PTR names commonly used by ISPs for dynamically
+// assigned addresses. Names are matched in lower case without the trailing
+// dot.
+var builtinPatterns = []pattern{
+	{"dynamic", regexp.MustCompile(`(^|[.-])dyn(amic)?(ip)?[0-9]*([.-]|$)`)},
+	{"dsl", regexp.MustCompile(`(^|[.-])[a-z]?dsl[0-9]*([.-]|$)`)},
+	{"dialup", regexp.MustCompile(`(^|[.-])(dial-?up|dialin|ppp|pppoe)[0-9]*([.-]|$)`)},
+	{"pool", regexp.MustCompile(`(^|[.-])(pool|dhcp|cable|broadband|residential|cpe|customer|cust|clients?)[0-9]*([.-]|$)`)},
+}
+
+// ipInNamePattern is the name used in logs for PTR names that contain the
+// client IP address (e.g. ip-1-2-3-4.example.net).
+const ipInNamePattern = "ip_in_name"
+
+var defaultTrustedNets = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	patterns      []pattern
+	zones         []string
+	zoneResponses []net.IPNet
+	trustedNets   []net.IPNet
+
+	patternScore    int
+	zoneScore       int
+	noFCrDNSScore   int
+	quarantineThres int
+	rejectThres     int
+
+	cacheResults bool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.dynamic_ip: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// CacheResults implements module.CacheableCheck.
+func (c *Check) CacheResults() bool {
+	return c.cacheResults
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		builtin bool
+		customs []pattern
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Bool("builtin_patterns", false, true, &builtin)
+	cfg.Callback("pattern", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments: name and regexp")
+		}
+		re, err := regexp.Compile(node.Args[1])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		customs = append(customs, pattern{name: node.Args[0], re: re})
+		return nil
+	})
+	cfg.StringList("zones", false, false, nil, &c.zones)
+	cfg.CIDRList("zone_responses", false, false, nil, &c.zoneResponses)
+	cfg.CIDRList("trusted_networks", false, false, defaultTrustedNets, &c.trustedNets)
+	cfg.Int("pattern_score", false, false, 2, &c.patternScore)
+	cfg.Int("zone_score", false, false, 2, &c.zoneScore)
+	cfg.Int("no_fcrdns_score", false, false, 1, &c.noFCrDNSScore)
+	cfg.Int("quarantine_threshold", false, false, 2, &c.quarantineThres)
+	cfg.Int("reject_threshold", false, false, 3, &c.rejectThres)
+	cfg.Bool("cache_results", false, true, &c.cacheResults)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if builtin {
+		c.patterns = append(c.patterns, builtinPatterns...)
+	}
+	c.patterns = append(c.patterns, customs...)
+	return nil
+}
+
+// ipInName checks whether the PTR name contains the IPv4 address octets in
+// one of formats commonly used by ISPs: 1-2-3-4, 1.2.3.4, 4-3-2-1,
+// 001002003004, 01020304 (hex).
+func ipInName(name string, ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+
+	oct := make([]string, 4)
+	padded := make([]string, 4)
+	for i, b := range ip4 {
+		oct[i] = strconv.Itoa(int(b))
+		padded[i] = fmt.Sprintf("%03d", b)
+	}
+	rev := []string{oct[3], oct[2], oct[1], oct[0]}
+
+	variants := []string{
+		strings.Join(padded, ""),
+		fmt.Sprintf("%02x%02x%02x%02x", ip4[0], ip4[1], ip4[2], ip4[3]),
+	}
+	for _, sep := range []string{"-", ".", "_"} {
+		variants = append(variants, strings.Join(oct, sep), strings.Join(rev, sep), strings.Join(padded, sep))
+	}
+
+	for _, v := range variants {
+		idx := strings.Index(name, v)
+		if idx == -1 {
+			continue
+		}
+		// Make sure we matched the whole number, e.g. 11-2-3-4 should not
+		// match 1-2-3-4.
+		if idx > 0 && name[idx-1] >= '0' && name[idx-1] <= '9' {
+			continue
+		}
+		if end := idx + len(v); end < len(name) && name[end] >= '0' && name[end] <= '9' {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchPatterns returns names of all patterns matching the PTR name.
+func (c *Check) matchPatterns(name string, ip net.IP) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	var matched []string
+	if ipInName(name, ip) {
+		matched = append(matched, ipInNamePattern)
+	}
+	for _, p := range c.patterns {
+		if p.re.MatchString(name) {
+			matched = append(matched, p.name)
+		}
+	}
+	return matched
+}
+
+// checkZones returns the list of zones the IP is listed in.
+func (c *Check) checkZones(ctx context.Context, ip net.IP) ([]string, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		// Dynamic address lists are IPv4-only.
+		return nil, nil
+	}
+	reversed := fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+
+	var listed []string
+	for _, zone := range c.zones {
+		addrs, err := c.resolver.LookupIPAddr(ctx, reversed+"."+dns.FQDN(zone))
+		if err != nil {
+			if dns.IsNotFound(err) {
+				continue
+			}
+			return listed, err
+		}
+		for _, addr := range addrs {
+			if c.responseMatches(addr.IP) {
+				listed = append(listed, zone)
+				break
+			}
+		}
+	}
+	return listed, nil
+}
+
+func (c *Check) responseMatches(ip net.IP) bool {
+	if len(c.zoneResponses) == 0 {
+		return true
+	}
+	for _, respNet := range c.zoneResponses {
+		if respNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fcrdns checks whether the PTR name resolves back to the client IP.
+func (c *Check) fcrdns(ctx context.Context, name string, ip net.IP) bool {
+	addrs, err := c.resolver.LookupIPAddr(ctx, dns.FQDN(name))
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Check) trusted(ip net.IP) bool {
+	for _, trustedNet := range c.trustedNets {
+		if trustedNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) ptrName(ctx context.Context, ip net.IP) (string, error) {
+	if s.msgMeta.Conn.RDNSName != nil {
+		nameI, err := s.msgMeta.Conn.RDNSName.GetContext(ctx)
+		if err != nil {
+			return "", err
+		}
+		if nameI == nil {
+			return "", nil
+		}
+		return nameI.(string), nil
+	}
+
+	names, err := s.c.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	return names[0], nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.Debugf("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.msgMeta.Conn.AuthUser != "" {
+		s.log.Debugf("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.Debugf("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.trusted(tcpAddr.IP) {
+		s.log.Debugf("trusted network, skipping")
+		return module.CheckResult{}
+	}
+
+	var score int
+
+	name, err := s.ptrName(ctx, tcpAddr.IP)
+	if err != nil {
+		// Not a reason to reject, treat as if there is no PTR record.
+		s.log.Error("PTR lookup failed", err, "src_ip", tcpAddr.IP)
+	}
+	var patterns []string
+	if name != "" {
+		patterns = s.c.matchPatterns(name, tcpAddr.IP)
+		if len(patterns) != 0 {
+			score += s.c.patternScore
+		}
+	}
+
+	zones, err := s.c.checkZones(ctx, tcpAddr.IP)
+	if err != nil {
+		s.log.Error("dynamic IP list lookup failed", err, "src_ip", tcpAddr.IP)
+	}
+	if len(zones) != 0 {
+		score += s.c.zoneScore
+	}
+
+	if score == 0 {
+		return module.CheckResult{}
+	}
+
+	// Missing FCrDNS makes the dynamic client classification more reliable.
+	fcrdns := name != "" && s.c.fcrdns(ctx, name, tcpAddr.IP)
+	if !fcrdns {
+		score += s.c.noFCrDNSScore
+	}
+
+	res := module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message: "Your IP address looks like a dynamic (residential) address, " +
+				"please use the smarthost of your ISP or authenticated submission",
+			CheckName: modName,
+			Misc: map[string]interface{}{
+				"ptr":      name,
+				"patterns": patterns,
+				"zones":    zones,
+				"fcrdns":   fcrdns,
+				"score":    score,
+			},
+		},
+	}
+	switch {
+	case score >= s.c.rejectThres:
+		res.Reject = true
+	case score >= s.c.quarantineThres:
+		res.Quarantine = true
+	default:
+		s.log.DebugMsg("dynamic IP score is below thresholds", "reason", res.Reason)
+		return module.CheckResult{Score: score}
+	}
+	res.Score = score
+
+	s.log.Msg("dynamic IP detected", "src_ip", tcpAddr.IP, "ptr", name,
+		"patterns", patterns, "zones", zones, "fcrdns", fcrdns, "score", score)
+	return res
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,138 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dynip
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	c := &Check{patterns: builtinPatterns}
+	ip := net.IPv4(1, 2, 3, 4)
+
+	test := func(name string, dynamic bool) {
+		t.Helper()
+		matched := c.matchPatterns(name, ip)
+		if (len(matched) != 0) != dynamic {
+			t.Errorf("%s: want dynamic=%v, got patterns %v", name, dynamic, matched)
+		}
+	}
+
+	test("mx.example.org", false)
+	test("mail.dynamicsoft.com", false)
+	test("smtp-out.example.net", false)
+	test("host.dyn.example.net", true)
+	test("1-2-3-4.dynamic.example.net", true)
+	test("ip-1-2-3-4.example.net", true)
+	test("4.3.2.1.example.net.", true)
+	test("001002003004.example.net", true)
+	test("01020304.example.net", true)
+	test("11-2-3-4.example.net", false)
+	test("abc-adsl-42.example.net", true)
+	test("ppp-12.example.net", true)
+	test("dhcp-5.pool.example.net", true)
+	test("cpe-98-0-0-1.example.net", true)
+}
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone) *Check {
+	return &Check{
+		log:             testutils.Logger(t, modName),
+		resolver:        &mockdns.Resolver{Zones: zones},
+		patterns:        builtinPatterns,
+		zones:           []string{"pbl.example.org"},
+		patternScore:    2,
+		zoneScore:       2,
+		noFCrDNSScore:   1,
+		quarantineThres: 2,
+		rejectThres:     3,
+	}
+}
+
+func runCheck(t *testing.T, c *Check, authUser string) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+			},
+			AuthUser: authUser,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckConnection(context.Background())
+}
+
+func TestCheck(t *testing.T) {
+	test := func(name string, zones map[string]mockdns.Zone, reject, quarantine bool) {
+		t.Helper()
+		res := runCheck(t, testCheck(t, zones), "")
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Errorf("%s: want reject=%v quarantine=%v, got reject=%v quarantine=%v (%v)",
+				name, reject, quarantine, res.Reject, res.Quarantine, res.Reason)
+		}
+	}
+
+	test("static", map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {PTR: []string{"mx.example.org."}},
+		"mx.example.org.":       {A: []string{"1.2.3.4"}},
+	}, false, false)
+	test("dynamic, FCrDNS", map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.":    {PTR: []string{"dyn-1-2-3-4.example.net."}},
+		"dyn-1-2-3-4.example.net.": {A: []string{"1.2.3.4"}},
+	}, false, true)
+	test("dynamic, no FCrDNS", map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {PTR: []string{"dyn-1-2-3-4.example.net."}},
+	}, true, false)
+	test("listed, no PTR", map[string]mockdns.Zone{
+		"4.3.2.1.pbl.example.org.": {A: []string{"127.0.0.10"}},
+	}, true, false)
+	test("listed, FCrDNS", map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.":    {PTR: []string{"mx.example.org."}},
+		"mx.example.org.":          {A: []string{"1.2.3.4"}},
+		"4.3.2.1.pbl.example.org.": {A: []string{"127.0.0.10"}},
+	}, false, true)
+	test("no PTR", map[string]mockdns.Zone{}, false, false)
+}
+
+func TestCheck_Bypass(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {PTR: []string{"dyn-1-2-3-4.example.net."}},
+	}
+
+	c := testCheck(t, zones)
+	if res := runCheck(t, c, "user"); res.Reason != nil {
+		t.Error("authenticated client is not exempt:", res.Reason)
+	}
+
+	_, trusted, _ := net.ParseCIDR("1.2.3.0/24")
+	c.trustedNets = []net.IPNet{*trusted}
+	if res := runCheck(t, c, ""); res.Reason != nil {
+		t.Error("trusted network is not exempt:", res.Reason)
+	}
+}
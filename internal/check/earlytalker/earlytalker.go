@@ -0,0 +1,49 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package earlytalker implements the check that acts on clients that sent
+// data before the server greeting.
+//
+// Detection is done by endpoint/smtp (see greeting_delay and
+// early_talker_action directives), the check only uses the recorded result.
+package earlytalker
+
+import (
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check"
+)
+
+func earlyTalker(ctx check.StatelessCheckContext) module.CheckResult {
+	if ctx.MsgMeta.Conn == nil || !ctx.MsgMeta.Conn.EarlyTalker {
+		return module.CheckResult{}
+	}
+
+	return module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 5, 0},
+			Message:      "Protocol violation: data sent before greeting",
+			CheckName:    "early_talker",
+		},
+	}
+}
+
+func init() {
+	check.RegisterStatelessCheck("early_talker", modconfig.FailAction{Quarantine: true}, earlyTalker, nil, nil, nil)
+}
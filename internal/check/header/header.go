@@ -0,0 +1,270 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package header implements the check that enforces basic RFC 5322 header
+// hygiene: presence of required fields, uniqueness of fields that must be
+// specified only once and absence of non-ASCII bytes in non-SMTPUTF8
+// messages.
+package header
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.header"
+
+// subCheck is the configuration of an individual header test.
+type subCheck struct {
+	Action modconfig.FailAction
+	Score  int
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	singleFields    []string
+	quarantineThres int
+	rejectThres     int
+
+	missingFrom      subCheck
+	missingDate      subCheck
+	missingMessageID subCheck
+	duplicate        subCheck
+	eightBit         subCheck
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.header: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func subCheckDirective(def subCheck) func(*config.Map, config.Node) (interface{}, error) {
+	return func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Children) == 0 {
+			action, err := modconfig.ParseActionDirective(node.Args)
+			if err != nil {
+				return nil, config.NodeErr(node, "%v", err)
+			}
+			return subCheck{Action: action, Score: def.Score}, nil
+		}
+		if len(node.Args) != 0 {
+			return nil, config.NodeErr(node, "can't specify both arguments and a block")
+		}
+
+		var sc subCheck
+		cfg := config.NewMap(nil, node)
+		cfg.Custom("action", false, false,
+			func() (interface{}, error) {
+				return def.Action, nil
+			}, modconfig.FailActionDirective, &sc.Action)
+		cfg.Int("score", false, false, def.Score, &sc.Score)
+		if _, err := cfg.Process(); err != nil {
+			return nil, err
+		}
+		return sc, nil
+	}
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	subCheckCfg := func(name string, def subCheck, out *subCheck) {
+		cfg.Custom(name, false, false, func() (interface{}, error) {
+			return def, nil
+		}, subCheckDirective(def), out)
+	}
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("single_fields", false, false,
+		[]string{"From", "Subject", "Message-ID"}, &c.singleFields)
+	cfg.Int("quarantine_threshold", false, false, 1, &c.quarantineThres)
+	cfg.Int("reject_threshold", false, false, 9999, &c.rejectThres)
+	subCheckCfg("missing_from", subCheck{Action: modconfig.FailAction{Reject: true}}, &c.missingFrom)
+	subCheckCfg("missing_date", subCheck{Action: modconfig.FailAction{Reject: true}}, &c.missingDate)
+	subCheckCfg("missing_message_id", subCheck{}, &c.missingMessageID)
+	subCheckCfg("duplicate", subCheck{Action: modconfig.FailAction{Reject: true}}, &c.duplicate)
+	subCheckCfg("eight_bit", subCheck{Action: modconfig.FailAction{Reject: true}}, &c.eightBit)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) fail(msg, test, field string) error {
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+		Message:      msg + ": " + field,
+		CheckName:    modName,
+		Misc: map[string]interface{}{
+			"header_test": test,
+			"field":       field,
+		},
+	}
+}
+
+func has8Bit(b []byte) bool {
+	for _, ch := range b {
+		if ch > 0x7F {
+			return true
+		}
+	}
+	return false
+}
+
+// runTests runs all header tests and calls the callback for each failed one.
+func (s *state) runTests(hdr textproto.Header, failed func(sc subCheck, reason error)) {
+	if !hdr.Has("From") {
+		failed(s.c.missingFrom, s.fail("Missing required header field", "missing_from", "From"))
+	}
+	if !hdr.Has("Date") {
+		failed(s.c.missingDate, s.fail("Missing required header field", "missing_date", "Date"))
+	}
+	authenticated := s.msgMeta.Conn != nil && s.msgMeta.Conn.AuthUser != ""
+	if !authenticated && !hdr.Has("Message-ID") {
+		failed(s.c.missingMessageID, s.fail("Missing required header field", "missing_message_id", "Message-ID"))
+	}
+
+	for _, field := range s.c.singleFields {
+		if hdr.FieldsByKey(field).Len() > 1 {
+			failed(s.c.duplicate, s.fail("Header field specified more than once", "duplicate", field))
+		}
+	}
+
+	if !s.msgMeta.SMTPOpts.UTF8 {
+		for field := hdr.Fields(); field.Next(); {
+			raw, err := field.Raw()
+			if err != nil {
+				s.log.Error("malformed header field", err)
+				continue
+			}
+			if has8Bit(raw) {
+				failed(s.c.eightBit, s.fail("Non-ASCII header field in non-SMTPUTF8 message", "eight_bit", field.Key()))
+				// Report only the first offending field.
+				break
+			}
+		}
+	}
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+	return s.checkHeader(hdr)
+}
+
+// CheckBodyStream implements module.StreamingCheckState. The body is not
+// needed at all so the message can be rejected right after the header is
+// received.
+func (s *state) CheckBodyStream(ctx context.Context, hdr textproto.Header, _ io.Reader) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBodyStream").End()
+	return s.checkHeader(hdr)
+}
+
+func (s *state) checkHeader(hdr textproto.Header) module.CheckResult {
+	var (
+		res   module.CheckResult
+		score int
+	)
+	s.runTests(hdr, func(sc subCheck, reason error) {
+		score += sc.Score
+		testRes := sc.Action.Apply(module.CheckResult{Reason: reason})
+		if !testRes.Reject && !testRes.Quarantine {
+			s.log.DebugMsg("header test failed, ignored", "reason", reason)
+		}
+
+		// Report the most severe result.
+		switch {
+		case res.Reason == nil, testRes.Reject && !res.Reject,
+			testRes.Quarantine && !res.Reject && !res.Quarantine:
+			res = testRes
+		}
+	})
+	if res.Reason == nil {
+		return module.CheckResult{Score: score}
+	}
+
+	res.Score = score
+	if score >= s.c.rejectThres {
+		res.Reject = true
+	} else if score >= s.c.quarantineThres {
+		res.Quarantine = true
+	}
+	if !res.Reject && !res.Quarantine {
+		return module.CheckResult{Score: score}
+	}
+
+	s.log.Msg("header check failed", "reason", res.Reason, "score", score,
+		"reject", res.Reject, "quarantine", res.Quarantine)
+	return res
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
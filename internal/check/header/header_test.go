@@ -0,0 +1,141 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package header
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T) *Check {
+	return &Check{
+		log:             testutils.Logger(t, modName),
+		singleFields:    []string{"From", "Subject", "Message-ID"},
+		quarantineThres: 1,
+		rejectThres:     9999,
+
+		missingFrom:      subCheck{Action: modconfig.FailAction{Reject: true}},
+		missingDate:      subCheck{Action: modconfig.FailAction{Reject: true}},
+		missingMessageID: subCheck{Action: modconfig.FailAction{Quarantine: true}},
+		duplicate:        subCheck{Action: modconfig.FailAction{Reject: true}},
+		eightBit:         subCheck{Action: modconfig.FailAction{Reject: true}},
+	}
+}
+
+func runCheck(t *testing.T, c *Check, hdrText string, utf8 bool, authUser string) module.CheckResult {
+	t.Helper()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdrText + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn:     &module.ConnState{AuthUser: authUser},
+		SMTPOpts: smtp.MailOptions{UTF8: utf8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	return s.CheckBody(context.Background(), hdr, nil)
+}
+
+const validHdr = "From: <foo@example.org>\r\n" +
+	"Date: Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+	"Subject: Hello\r\n" +
+	"Message-ID: <1@example.org>\r\n"
+
+func TestCheck(t *testing.T) {
+	test := func(name, hdr string, utf8 bool, reject, quarantine bool, field string) {
+		t.Helper()
+
+		res := runCheck(t, testCheck(t), hdr, utf8, "")
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Errorf("%s: want reject=%v quarantine=%v, got reject=%v quarantine=%v (%v)",
+				name, reject, quarantine, res.Reject, res.Quarantine, res.Reason)
+			return
+		}
+		if field == "" {
+			return
+		}
+		smtpErr, ok := res.Reason.(*exterrors.SMTPError)
+		if !ok {
+			t.Errorf("%s: not an SMTPError: %v", name, res.Reason)
+			return
+		}
+		if !strings.HasSuffix(smtpErr.Message, ": "+field) {
+			t.Errorf("%s: field name is not in the message: %s", name, smtpErr.Message)
+		}
+	}
+
+	test("valid", validHdr, false, false, false, "")
+	test("missing From", "Date: Mon, 2 Jan 2006 15:04:05 +0000\r\nMessage-ID: <1@example.org>\r\n",
+		false, true, false, "From")
+	test("missing Date", "From: <foo@example.org>\r\nMessage-ID: <1@example.org>\r\n",
+		false, true, false, "Date")
+	test("missing Message-ID", "From: <foo@example.org>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\n",
+		false, false, true, "Message-ID")
+	test("duplicate From", validHdr+"From: <bar@example.org>\r\n", false, true, false, "From")
+	test("duplicate Subject", validHdr+"Subject: Hello again\r\n", false, true, false, "Subject")
+	test("duplicate To", validHdr+"To: <a@example.org>\r\nTo: <b@example.org>\r\n", false, false, false, "")
+	test("8-bit", validHdr+"X-Greeting: Привет\r\n", false, true, false, "X-Greeting")
+	test("8-bit SMTPUTF8", validHdr+"X-Greeting: Привет\r\n", true, false, false, "")
+}
+
+func TestCheck_Authenticated(t *testing.T) {
+	c := testCheck(t)
+	hdr := "From: <foo@example.org>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\n"
+	if res := runCheck(t, c, hdr, false, "user"); res.Reason != nil {
+		t.Error("missing Message-ID is not ignored for authenticated client:", res.Reason)
+	}
+}
+
+func TestCheck_Score(t *testing.T) {
+	c := testCheck(t)
+	c.missingDate = subCheck{Score: 2}
+	c.missingMessageID = subCheck{Score: 2}
+	c.quarantineThres = 3
+	c.rejectThres = 5
+
+	hdr := "From: <foo@example.org>\r\nMessage-ID: <1@example.org>\r\n"
+	if res := runCheck(t, c, hdr, false, ""); res.Reject || res.Quarantine {
+		t.Error("score below thresholds should be ignored:", res.Reason)
+	}
+
+	hdr = "From: <foo@example.org>\r\n"
+	if res := runCheck(t, c, hdr, false, ""); res.Reject || !res.Quarantine {
+		t.Error("score over quarantine_threshold should quarantine:", res.Reason)
+	}
+
+	c.missingMessageID = subCheck{Score: 3}
+	if res := runCheck(t, c, hdr, false, ""); !res.Reject {
+		t.Error("score over reject_threshold should reject:", res.Reason)
+	}
+}
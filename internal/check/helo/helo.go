@@ -0,0 +1,384 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package helo implements the check that validates the hostname specified by
+// the client in the HELO/EHLO command.
+package helo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.helo"
+
+// subCheck is the configuration of an individual HELO test.
+type subCheck struct {
+	Action modconfig.FailAction
+	Score  int
+}
+
+// enabled reports whether the test can affect the result. It is used to skip
+// expensive tests (DNS lookups) if they are not used.
+func (sc subCheck) enabled() bool {
+	return sc.Action.Reject || sc.Action.Quarantine || sc.Score != 0
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	localHostnames    []string
+	skipAuthenticated bool
+	cacheResults      bool
+	quarantineThres   int
+	rejectThres       int
+
+	invalidSyntax subCheck
+	unqualified   subCheck
+	ipMismatch    subCheck
+	ownHostname   subCheck
+	noResolve     subCheck
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.helo: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func subCheckDirective(def subCheck) func(*config.Map, config.Node) (interface{}, error) {
+	return func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Children) == 0 {
+			// Short form: invalid_syntax reject 550 5.7.0
+			action, err := modconfig.ParseActionDirective(node.Args)
+			if err != nil {
+				return nil, config.NodeErr(node, "%v", err)
+			}
+			return subCheck{Action: action, Score: def.Score}, nil
+		}
+		if len(node.Args) != 0 {
+			return nil, config.NodeErr(node, "can't specify both arguments and a block")
+		}
+
+		var sc subCheck
+		cfg := config.NewMap(nil, node)
+		cfg.Custom("action", false, false,
+			func() (interface{}, error) {
+				return def.Action, nil
+			}, modconfig.FailActionDirective, &sc.Action)
+		cfg.Int("score", false, false, def.Score, &sc.Score)
+		if _, err := cfg.Process(); err != nil {
+			return nil, err
+		}
+		return sc, nil
+	}
+}
+
+// CacheResults implements module.CacheableCheck.
+func (c *Check) CacheResults() bool {
+	return c.cacheResults
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		hostname       string
+		localHostnames []string
+	)
+
+	subCheckCfg := func(name string, def subCheck, out *subCheck) {
+		cfg.Custom(name, false, false, func() (interface{}, error) {
+			return def, nil
+		}, subCheckDirective(def), out)
+	}
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("local_hostnames", false, false, nil, &localHostnames)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuthenticated)
+	cfg.Bool("cache_results", false, true, &c.cacheResults)
+	cfg.Int("quarantine_threshold", false, false, 1, &c.quarantineThres)
+	cfg.Int("reject_threshold", false, false, 9999, &c.rejectThres)
+	subCheckCfg("invalid_syntax", subCheck{Action: modconfig.FailAction{Reject: true}}, &c.invalidSyntax)
+	subCheckCfg("unqualified", subCheck{Action: modconfig.FailAction{Quarantine: true}}, &c.unqualified)
+	subCheckCfg("ip_mismatch", subCheck{Action: modconfig.FailAction{Quarantine: true}}, &c.ipMismatch)
+	subCheckCfg("own_hostname", subCheck{Action: modconfig.FailAction{Reject: true}}, &c.ownHostname)
+	subCheckCfg("no_resolve", subCheck{}, &c.noResolve)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if hostname != "" {
+		c.localHostnames = append(c.localHostnames, hostname)
+	}
+	c.localHostnames = append(c.localHostnames, localHostnames...)
+
+	return nil
+}
+
+// validHostname checks whether the string is a syntactically valid DNS name
+// as defined by RFC 1123 (letters, digits and hyphens). Non-ASCII labels are
+// allowed to support RFC 6531 U-labels.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			switch {
+			case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+			case ch == '-':
+			case ch > 0x7F:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseIPLiteral parses the address literal in the HELO argument. Bare IP
+// addresses without brackets are accepted too since they are commonly used by
+// broken clients.
+//
+// ok is false if the value does not look like an IP address at all.
+func parseIPLiteral(helo string) (ip net.IP, ok bool) {
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := helo[1 : len(helo)-1]
+		literal = strings.TrimPrefix(literal, "IPv6:")
+		return net.ParseIP(literal), true
+	}
+
+	ip = net.ParseIP(helo)
+	return ip, ip != nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) fail(code int, enchCode exterrors.EnhancedCode, msg, test string) error {
+	return &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      msg,
+		CheckName:    modName,
+		Misc: map[string]interface{}{
+			"helo":      s.msgMeta.Conn.Hostname,
+			"helo_test": test,
+		},
+	}
+}
+
+// runTests runs all enabled HELO tests and calls the callback for each
+// failed one.
+func (s *state) runTests(ctx context.Context, failed func(sc subCheck, reason error)) {
+	helo := s.msgMeta.Conn.Hostname
+
+	if ip, ok := parseIPLiteral(helo); ok {
+		if ip == nil {
+			failed(s.c.invalidSyntax, s.fail(550, exterrors.EnhancedCode{5, 7, 0},
+				"Malformed IP in HELO", "invalid_syntax"))
+			return
+		}
+
+		tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+		if !ok {
+			s.log.Debugf("non-TCP/IP source, skipping IP literal test")
+			return
+		}
+		if !ip.Equal(tcpAddr.IP) {
+			failed(s.c.ipMismatch, s.fail(550, exterrors.EnhancedCode{5, 7, 0},
+				"IP in HELO is not the same as the actual client IP", "ip_mismatch"))
+		}
+		return
+	}
+
+	if !validHostname(helo) {
+		failed(s.c.invalidSyntax, s.fail(550, exterrors.EnhancedCode{5, 7, 0},
+			"Malformed HELO hostname", "invalid_syntax"))
+		return
+	}
+
+	for _, local := range s.c.localHostnames {
+		if dns.Equal(strings.TrimSuffix(helo, "."), local) {
+			failed(s.c.ownHostname, s.fail(550, exterrors.EnhancedCode{5, 7, 0},
+				"HELO hostname belongs to this server", "own_hostname"))
+			// Does not make sense to check anything else, this is a forgery.
+			return
+		}
+	}
+
+	if !strings.Contains(strings.TrimSuffix(helo, "."), ".") {
+		failed(s.c.unqualified, s.fail(550, exterrors.EnhancedCode{5, 7, 0},
+			"HELO hostname is not fully qualified", "unqualified"))
+	}
+
+	if s.c.noResolve.enabled() {
+		if err := s.checkResolve(ctx, helo); err != nil {
+			failed(s.c.noResolve, err)
+		}
+	}
+}
+
+func (s *state) checkResolve(ctx context.Context, helo string) error {
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.Debugf("non-TCP/IP source, skipping no_resolve test")
+		return nil
+	}
+
+	ips, err := s.c.resolver.LookupIPAddr(ctx, dns.FQDN(helo))
+	if err != nil && !dns.IsNotFound(err) {
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		misc["helo"] = helo
+		misc["helo_test"] = "no_resolve"
+		return &exterrors.SMTPError{
+			Code:         exterrors.SMTPCode(err, 450, 550),
+			EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 0}),
+			Message:      "DNS error during policy check",
+			CheckName:    modName,
+			Err:          err,
+			Reason:       reason,
+			Misc:         misc,
+		}
+	}
+
+	for _, ip := range ips {
+		if tcpAddr.IP.Equal(ip.IP) {
+			s.log.Debugf("A/AAAA record found for %s for %s", tcpAddr.IP, helo)
+			return nil
+		}
+	}
+	return s.fail(550, exterrors.EnhancedCode{5, 7, 0},
+		"HELO hostname does not resolve to the client IP", "no_resolve")
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.Debugf("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuthenticated && s.msgMeta.Conn.AuthUser != "" {
+		s.log.Debugf("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+
+	var (
+		res   module.CheckResult
+		score int
+	)
+	s.runTests(ctx, func(sc subCheck, reason error) {
+		score += sc.Score
+		testRes := sc.Action.Apply(module.CheckResult{Reason: reason})
+		if !testRes.Reject && !testRes.Quarantine {
+			s.log.DebugMsg("HELO test failed, ignored", "reason", reason)
+		}
+
+		// Report the most severe result.
+		switch {
+		case res.Reason == nil, testRes.Reject && !res.Reject,
+			testRes.Quarantine && !res.Reject && !res.Quarantine:
+			res = testRes
+		}
+	})
+	if res.Reason == nil {
+		return module.CheckResult{Score: score}
+	}
+
+	res.Score = score
+	if score >= s.c.rejectThres {
+		res.Reject = true
+	} else if score >= s.c.quarantineThres {
+		res.Quarantine = true
+	}
+	if !res.Reject && !res.Quarantine {
+		return module.CheckResult{Score: score}
+	}
+
+	s.log.Msg("HELO check failed", "reason", res.Reason, "score", score,
+		"reject", res.Reject, "quarantine", res.Quarantine)
+	return res
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package helo
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T) *Check {
+	return &Check{
+		log: testutils.Logger(t, modName),
+		resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"mx.example.org.": {
+					A: []string{"1.2.3.4"},
+				},
+				"other.example.org.": {
+					A: []string{"5.6.7.8"},
+				},
+			},
+		},
+		localHostnames:    []string{"mx.example.com"},
+		skipAuthenticated: true,
+		quarantineThres:   1,
+		rejectThres:       9999,
+
+		invalidSyntax: subCheck{Action: modconfig.FailAction{Reject: true}},
+		unqualified:   subCheck{Action: modconfig.FailAction{Quarantine: true}},
+		ipMismatch:    subCheck{Action: modconfig.FailAction{Quarantine: true}},
+		ownHostname:   subCheck{Action: modconfig.FailAction{Reject: true}},
+		noResolve:     subCheck{Action: modconfig.FailAction{Quarantine: true}},
+	}
+}
+
+func runCheck(t *testing.T, c *Check, helo, authUser string) module.CheckResult {
+	t.Helper()
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+				Hostname:   helo,
+			},
+			AuthUser: authUser,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	return s.CheckConnection(context.Background())
+}
+
+func TestCheck(t *testing.T) {
+	test := func(helo string, reject, quarantine bool) {
+		t.Helper()
+
+		res := runCheck(t, testCheck(t), helo, "")
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Errorf("%q: want reject=%v quarantine=%v, got reject=%v quarantine=%v (%v)",
+				helo, reject, quarantine, res.Reject, res.Quarantine, res.Reason)
+		}
+	}
+
+	test("mx.example.org", false, false)
+	test("mx.example.org.", false, false)
+	test("[1.2.3.4]", false, false)
+	test("1.2.3.4", false, false)
+
+	// invalid_syntax
+	test("", true, false)
+	test("mx..example.org", true, false)
+	test("-mx.example.org", true, false)
+	test("mx_1.example.org", true, false)
+	test("[1.2.3.256]", true, false)
+
+	// ip_mismatch
+	test("[5.6.7.8]", false, true)
+	test("[IPv6:beef::1]", false, true)
+	test("5.6.7.8", false, true)
+
+	// own_hostname
+	test("mx.example.com", true, false)
+	test("MX.EXAMPLE.COM.", true, false)
+
+	// unqualified, also does not resolve.
+	test("localhost", false, true)
+
+	// no_resolve
+	test("other.example.org", false, true)
+	test("nonexistent.example.org", false, true)
+}
+
+func TestCheck_Authenticated(t *testing.T) {
+	c := testCheck(t)
+	if res := runCheck(t, c, "mx.example.com", "user"); res.Reason != nil {
+		t.Error("authenticated client is not exempt:", res.Reason)
+	}
+
+	c.skipAuthenticated = false
+	if res := runCheck(t, c, "mx.example.com", "user"); !res.Reject {
+		t.Error("authenticated client is exempt with skip_authenticated=no")
+	}
+}
+
+func TestCheck_Score(t *testing.T) {
+	c := testCheck(t)
+	c.unqualified = subCheck{Score: 2}
+	c.noResolve = subCheck{Score: 1}
+	c.quarantineThres = 2
+	c.rejectThres = 5
+
+	if res := runCheck(t, c, "other.example.org", ""); res.Reject || res.Quarantine {
+		t.Error("score below thresholds should be ignored:", res.Reason)
+	}
+
+	c.noResolve = subCheck{Score: 2}
+	if res := runCheck(t, c, "other.example.org", ""); res.Reject || !res.Quarantine {
+		t.Error("score over quarantine_threshold should quarantine:", res.Reason)
+	}
+
+	c.noResolve = subCheck{Score: 3}
+	if res := runCheck(t, c, "localhost", ""); !res.Reject {
+		t.Error("score over reject_threshold should reject:", res.Reason)
+	}
+}
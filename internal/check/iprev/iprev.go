@@ -0,0 +1,322 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package iprev implements the forward-confirmed reverse DNS (FCrDNS) check
+// producing "iprev" Authentication-Results (RFC 8601 Section 3).
+package iprev
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/trace"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.iprev"
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	missingPTRAction  modconfig.FailAction
+	unconfirmedAction modconfig.FailAction
+	tempErrAction     modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.iprev: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("missing_ptr_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.missingPTRAction)
+	cfg.Custom("unconfirmed_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.unconfirmedAction)
+	cfg.Custom("temperror_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.tempErrAction)
+	_, err := cfg.Process()
+	return err
+}
+
+// Status is the outcome of the FCrDNS lookup.
+type Status int
+
+const (
+	StatusPass Status = iota
+	StatusNoPTR
+	StatusUnconfirmed
+	StatusTempError
+)
+
+// Result contains the outcome of the FCrDNS lookup for the client IP.
+type Result struct {
+	Status Status
+	// Confirmed PTR name (for StatusPass) or the name that failed forward
+	// confirmation (for StatusUnconfirmed), trailing dot stripped.
+	Name string
+	Err  error
+}
+
+// The lookup result depends only on the client IP so it is cached for the
+// whole connection and shared by all check.iprev instances (e.g. in global and
+// per-source check lists).
+type connEntry struct {
+	once sync.Once
+	res  *future.Future
+
+	// Make sure iprev is included into Authentication-Results only once per
+	// message.
+	authResLock  sync.Mutex
+	authResMsgID string
+}
+
+type connDataKey struct{}
+
+func newConnEntry() *connEntry {
+	return &connEntry{res: future.New()}
+}
+
+// claimAuthRes reports whether the caller should include the iprev result into
+// Authentication-Results for the message.
+func (e *connEntry) claimAuthRes(msgID string) bool {
+	e.authResLock.Lock()
+	defer e.authResLock.Unlock()
+
+	if msgID != "" && e.authResMsgID == msgID {
+		return false
+	}
+	e.authResMsgID = msgID
+	return true
+}
+
+// ConnOpened implements module.OptionalConnCheck.
+func (c *Check) ConnOpened(ctx context.Context, conn *module.ConnState) {
+	conn.Data.LoadOrStore(connDataKey{}, newConnEntry())
+}
+
+// ConnClosed implements module.OptionalConnCheck.
+func (c *Check) ConnClosed(conn *module.ConnState) {}
+
+// lookup performs the FCrDNS lookup for the client IP.
+//
+// The PTR lookup done by the endpoint (ConnState.RDNSName) is reused if
+// available.
+func lookup(ctx context.Context, r dns.Resolver, conn *module.ConnState, ip net.IP) Result {
+	var names []string
+	if conn.RDNSName != nil {
+		nameI, err := conn.RDNSName.GetContext(ctx)
+		if err != nil {
+			return Result{Status: StatusTempError, Err: err}
+		}
+		if nameI != nil {
+			names = []string{nameI.(string)}
+		}
+	} else {
+		var err error
+		names, err = r.LookupAddr(ctx, ip.String())
+		if err != nil && !dns.IsNotFound(err) {
+			return Result{Status: StatusTempError, Err: err}
+		}
+	}
+	if len(names) == 0 {
+		return Result{Status: StatusNoPTR}
+	}
+
+	var lastErr error
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := r.LookupIPAddr(ctx, dns.FQDN(name))
+		if err != nil {
+			if !dns.IsNotFound(err) {
+				lastErr = err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return Result{Status: StatusPass, Name: name}
+			}
+		}
+	}
+	if lastErr != nil {
+		return Result{Status: StatusTempError, Err: lastErr}
+	}
+	return Result{Status: StatusUnconfirmed, Name: strings.TrimSuffix(names[0], ".")}
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+	entry   *connEntry
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	var entry *connEntry
+	if msgMeta.Conn != nil {
+		entry, _ = msgMeta.Conn.Data.Get(connDataKey{}).(*connEntry)
+	}
+	if entry == nil {
+		// Message source does not support connection-level checks, do not
+		// cache anything.
+		entry = newConnEntry()
+	}
+
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+		entry:   entry,
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.Debugf("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.Debugf("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+
+	s.entry.once.Do(func() {
+		res := lookup(ctx, s.c.resolver, s.msgMeta.Conn, tcpAddr.IP)
+		s.entry.res.Set(res, nil)
+	})
+	resI, _ := s.entry.res.GetContext(ctx)
+	if resI == nil {
+		return module.CheckResult{}
+	}
+	res := resI.(Result)
+
+	authRes := &authres.IPRevResult{IP: tcpAddr.IP.String()}
+	var authResList []authres.Result
+	if s.entry.claimAuthRes(s.msgMeta.ID) {
+		authResList = []authres.Result{authRes}
+	}
+
+	switch res.Status {
+	case StatusPass:
+		s.log.Debugf("PTR record %s is forward-confirmed", res.Name)
+		authRes.Value = authres.ResultPass
+		return module.CheckResult{AuthResult: authResList}
+	case StatusNoPTR:
+		authRes.Value = authres.ResultFail
+		authRes.Reason = "no PTR record"
+		return s.c.missingPTRAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+				Message:      "No PTR record found",
+				CheckName:    modName,
+			},
+			AuthResult: authResList,
+		})
+	case StatusUnconfirmed:
+		authRes.Value = authres.ResultFail
+		authRes.Reason = "PTR record is not forward-confirmed"
+		return s.c.unconfirmedAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+				Message:      "Reverse DNS name does not resolve to the client IP",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"ptr": res.Name,
+				},
+			},
+			AuthResult: authResList,
+		})
+	default:
+		authRes.Value = authres.ResultTempError
+		reason, misc := exterrors.UnwrapDNSErr(res.Err)
+		return s.c.tempErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         450,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 25},
+				Message:      "DNS error during policy check",
+				CheckName:    modName,
+				Err:          res.Err,
+				Reason:       reason,
+				Misc:         misc,
+			},
+			AuthResult: authResList,
+		})
+	}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
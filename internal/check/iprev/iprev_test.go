@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package iprev
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone) *Check {
+	return &Check{
+		log:               testutils.Logger(t, modName),
+		resolver:          &mockdns.Resolver{Zones: zones},
+		missingPTRAction:  modconfig.FailAction{Reject: true},
+		unconfirmedAction: modconfig.FailAction{Quarantine: true},
+		tempErrAction:     modconfig.FailAction{Reject: true},
+	}
+}
+
+func testMeta(rdns *future.Future) *module.MsgMetadata {
+	return &module.MsgMetadata{
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+			},
+			RDNSName: rdns,
+		},
+	}
+}
+
+func runCheck(t *testing.T, c *Check, msgMeta *module.MsgMetadata) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckConnection(context.Background())
+}
+
+func checkAuthRes(t *testing.T, res module.CheckResult, val authres.ResultValue) {
+	t.Helper()
+	if len(res.AuthResult) != 1 {
+		t.Fatalf("expected 1 auth result, got %d", len(res.AuthResult))
+	}
+	iprevRes, ok := res.AuthResult[0].(*authres.IPRevResult)
+	if !ok {
+		t.Fatalf("wrong auth result type: %T", res.AuthResult[0])
+	}
+	if iprevRes.Value != val {
+		t.Errorf("wrong iprev result: want %s, got %s", val, iprevRes.Value)
+	}
+	if iprevRes.IP != "1.2.3.4" {
+		t.Errorf("wrong policy.iprev: %s", iprevRes.IP)
+	}
+}
+
+func TestCheck_Pass(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"mx.example.org."},
+		},
+		"mx.example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+
+	res := runCheck(t, c, testMeta(nil))
+	if res.Reason != nil {
+		t.Fatal("unexpected failure:", res.Reason)
+	}
+	checkAuthRes(t, res, authres.ResultPass)
+}
+
+func TestCheck_ReuseRDNSName(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"mx.example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+
+	rdns := future.New()
+	rdns.Set("mx.example.org", nil)
+
+	res := runCheck(t, c, testMeta(rdns))
+	if res.Reason != nil {
+		t.Fatal("unexpected failure:", res.Reason)
+	}
+	checkAuthRes(t, res, authres.ResultPass)
+
+	// No PTR according to the endpoint lookup.
+	rdns = future.New()
+	rdns.Set(nil, nil)
+	res = runCheck(t, c, testMeta(rdns))
+	if !res.Reject {
+		t.Fatal("missing PTR is not rejected")
+	}
+	checkAuthRes(t, res, authres.ResultFail)
+}
+
+func TestCheck_NoPTR(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{})
+
+	res := runCheck(t, c, testMeta(nil))
+	if !res.Reject {
+		t.Fatal("missing PTR is not rejected")
+	}
+	checkAuthRes(t, res, authres.ResultFail)
+}
+
+func TestCheck_Unconfirmed(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"mx.example.org."},
+		},
+		"mx.example.org.": {
+			A: []string{"5.6.7.8"},
+		},
+	})
+
+	res := runCheck(t, c, testMeta(nil))
+	if res.Reject || !res.Quarantine {
+		t.Fatal("unconfirmed PTR is not quarantined:", res.Reason)
+	}
+	checkAuthRes(t, res, authres.ResultFail)
+}
+
+func TestCheck_TempError(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"mx.example.org."},
+		},
+		"mx.example.org.": {
+			Err: &net.DNSError{Err: "SERVFAIL", IsTemporary: true},
+		},
+	})
+
+	res := runCheck(t, c, testMeta(nil))
+	if !res.Reject {
+		t.Fatal("temporary error is not rejected")
+	}
+	checkAuthRes(t, res, authres.ResultTempError)
+
+	rdns := future.New()
+	rdns.Set(nil, errors.New("lookup failed"))
+	res = runCheck(t, c, testMeta(rdns))
+	checkAuthRes(t, res, authres.ResultTempError)
+}
+
+func TestCheck_Cached(t *testing.T) {
+	c1 := testCheck(t, map[string]mockdns.Zone{
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"mx.example.org."},
+		},
+		"mx.example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	// Second instance would fail if it did the lookup itself.
+	c2 := testCheck(t, map[string]mockdns.Zone{})
+
+	conn := testMeta(nil).Conn
+	conn.Data = module.NewConnData()
+	c1.ConnOpened(context.Background(), conn)
+	c2.ConnOpened(context.Background(), conn)
+	defer c1.ConnClosed(conn)
+	defer c2.ConnClosed(conn)
+
+	for _, msgID := range []string{"test-msg-1", "test-msg-2"} {
+		msgMeta := &module.MsgMetadata{ID: msgID, Conn: conn}
+
+		s1, err := c1.CheckStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s2, err := c2.CheckStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res1 := s1.CheckConnection(context.Background())
+		res2 := s2.CheckConnection(context.Background())
+		if res1.Reason != nil || res2.Reason != nil {
+			t.Fatal("unexpected failure:", res1.Reason, res2.Reason)
+		}
+		if len(res1.AuthResult)+len(res2.AuthResult) != 1 {
+			t.Error("iprev result should be reported once per message")
+		}
+
+		s1.Close()
+		s2.Close()
+	}
+}
@@ -29,6 +29,11 @@ func requireTLS(ctx check.StatelessCheckContext) module.CheckResult {
 	if ctx.MsgMeta.Conn != nil && ctx.MsgMeta.Conn.TLS.HandshakeComplete {
 		return module.CheckResult{}
 	}
+	// Client is explicitly exempt by the endpoint configuration
+	// (tls_required_exempt).
+	if ctx.MsgMeta.Conn != nil && ctx.MsgMeta.Conn.TLSPolicy == module.TLSPolicyExempt {
+		return module.CheckResult{}
+	}
 
 	return module.CheckResult{
 		Reason: &exterrors.SMTPError{
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package size implements the check that enforces the message size limit
+// independently of the SMTP endpoint-wide SIZE value.
+package size
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.size"
+
+type Check struct {
+	instName   string
+	log        log.Logger
+	inlineArgs []string
+
+	maxSize    int
+	failAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Check{
+		instName:   instName,
+		log:        log.Logger{Name: modName},
+		inlineArgs: inlineArgs,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// ApplyFailAction implements module.FailActionCheck.
+func (c *Check) ApplyFailAction(res module.CheckResult) module.CheckResult {
+	return c.failAction.Apply(res)
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.DataSize("max_size", false, len(c.inlineArgs) == 0, 0, &c.maxSize)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(c.inlineArgs) != 0 {
+		var err error
+		c.maxSize, err = config.ParseDataSize(strings.Join(c.inlineArgs, " "))
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+	if c.maxSize <= 0 {
+		return fmt.Errorf("%s: max_size should be positive", modName)
+	}
+
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) tooBig(size int, declared bool) module.CheckResult {
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds the maximum allowed",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"size":     size,
+				"declared": declared,
+				"max_size": s.c.maxSize,
+			},
+		},
+	})
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	// SIZE= is optional. If it is present, it allows us to reject the message
+	// before the client sends it.
+	if declared := s.msgMeta.SMTPOpts.Size; declared > s.c.maxSize {
+		s.log.Debugf("declared size %d is over the limit %d", declared, s.c.maxSize)
+		return s.tooBig(declared, true)
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+type countWriter int
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	*cw += countWriter(len(b))
+	return len(b), nil
+}
+
+func (s *state) headerSize(hdr textproto.Header) int {
+	// Header is serialized to account for its size too since SIZE= counts
+	// the whole message.
+	var hdrLen countWriter
+	if err := textproto.WriteHeader(&hdrLen, hdr); err != nil {
+		s.log.Error("failed to serialize header", err)
+	}
+	return int(hdrLen)
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	// Buffer.Len is cheap for all buffer implementations (it is either known
+	// in advance or obtained using stat), so there is no need to read the
+	// body here.
+	size := s.headerSize(hdr) + body.Len()
+	if size > s.c.maxSize {
+		return s.tooBig(size, false)
+	}
+	return module.CheckResult{}
+}
+
+// CheckBodyStream implements module.StreamingCheckState. It allows to
+// reject the message as soon as the limit is exceeded, without waiting for
+// the rest of it.
+func (s *state) CheckBodyStream(ctx context.Context, hdr textproto.Header, body io.Reader) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBodyStream").End()
+
+	size := s.headerSize(hdr)
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(chunk)
+		size += n
+		if size > s.c.maxSize {
+			s.log.Debugf("message is over the limit %d, stopped at %d bytes", s.c.maxSize, size)
+			return s.tooBig(size, false)
+		}
+		if err != nil {
+			// Either io.EOF or the message is aborted and the result
+			// does not matter.
+			return module.CheckResult{}
+		}
+	}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package size
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, inlineArgs []string) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, inlineArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	return c
+}
+
+func expectCode(t *testing.T, res module.CheckResult, rejected bool) {
+	t.Helper()
+	if !rejected {
+		if res.Reason != nil {
+			t.Fatalf("unexpected failure: %v", res.Reason)
+		}
+		return
+	}
+	if res.Reason == nil || !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) {
+		t.Fatalf("not a SMTPError: %v", res.Reason)
+	}
+	if smtpErr.Code != 552 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 3, 4}) {
+		t.Fatalf("wrong code: %d %v", smtpErr.Code, smtpErr.EnhancedCode)
+	}
+}
+
+func TestSizeCheck_Declared(t *testing.T) {
+	c := testCheck(t, []string{"1K"})
+
+	for _, declared := range []int{0, 1000, 1024} {
+		st, _ := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			SMTPOpts: smtp.MailOptions{Size: declared},
+		})
+		expectCode(t, st.CheckSender(context.Background(), "test@example.org"), false)
+	}
+
+	st, _ := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{Size: 1025},
+	})
+	expectCode(t, st.CheckSender(context.Background(), "test@example.org"), true)
+}
+
+func TestSizeCheck_Body(t *testing.T) {
+	c := testCheck(t, []string{"100B"})
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello") // 16 bytes with CRLF, + 2 for the header end.
+
+	st, _ := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	expectCode(t, st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: make([]byte, 82)}), false)
+	expectCode(t, st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: make([]byte, 83)}), true)
+}
+
+type failReader struct {
+	t *testing.T
+}
+
+func (r failReader) Read([]byte) (int, error) {
+	r.t.Error("body read after the limit is reached")
+	return 0, io.EOF
+}
+
+func TestSizeCheck_BodyStream(t *testing.T) {
+	c := testCheck(t, []string{"100B"})
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+
+	st, _ := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	stream := st.(module.StreamingCheckState)
+	expectCode(t, stream.CheckBodyStream(context.Background(), hdr, bytes.NewReader(make([]byte, 82))), false)
+
+	// The check should return without reading the rest of the body.
+	body := io.MultiReader(bytes.NewReader(make([]byte, 83)), failReader{t})
+	expectCode(t, stream.CheckBodyStream(context.Background(), hdr, body), true)
+}
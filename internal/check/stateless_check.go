@@ -66,6 +66,8 @@ type statelessCheck struct {
 	// The actual fail action that should be applied.
 	failAction modconfig.FailAction
 
+	cacheResults bool
+
 	connCheck   FuncConnCheck
 	senderCheck FuncSenderCheck
 	rcptCheck   FuncRcptCheck
@@ -158,10 +160,22 @@ func (c *statelessCheck) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return c.defaultFailAction, nil
 		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Bool("cache_results", false, true, &c.cacheResults)
 	_, err := cfg.Process()
 	return err
 }
 
+// CacheResults implements module.CacheableCheck. Stateless checks by
+// definition depend only on their arguments.
+func (c *statelessCheck) CacheResults() bool {
+	return c.cacheResults
+}
+
+// ApplyFailAction implements module.FailActionCheck.
+func (c *statelessCheck) ApplyFailAction(res module.CheckResult) module.CheckResult {
+	return c.failAction.Apply(res)
+}
+
 func (c *statelessCheck) Name() string {
 	return c.modName
 }
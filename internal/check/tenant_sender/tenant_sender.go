@@ -0,0 +1,205 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tenant_sender implements the check that enforces the tenant
+// sending policy (see package tenancy) for the envelope sender and the
+// message header.
+package tenant_sender
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tenancy"
+)
+
+const modName = "check.tenant_sender"
+
+// headerFields are the header fields containing addresses that identify the
+// message author to the recipient.
+var headerFields = []string{"From", "Sender"}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	policy     tenancy.Policy
+	failAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.tenant_sender: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// ApplyFailAction implements module.FailActionCheck.
+func (c *Check) ApplyFailAction(res module.CheckResult) module.CheckResult {
+	return c.failAction.Apply(res)
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &c.policy.Table)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) authUser() string {
+	if s.msgMeta.Conn == nil {
+		return ""
+	}
+	return s.msgMeta.Conn.AuthUser
+}
+
+func (s *state) violation(username, addr, field, what string) module.CheckResult {
+	s.log.Msg("tenant policy violation", "username", username, "addr", addr, "field", field)
+	err := tenancy.ViolationError(what, map[string]interface{}{
+		"username": username,
+		"addr":     addr,
+		"field":    field,
+	})
+	err.CheckName = modName
+	return s.c.failAction.Apply(module.CheckResult{Reason: err})
+}
+
+func (s *state) check(username, addr, field string) module.CheckResult {
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return s.violation(username, addr, field, "malformed sender address")
+	}
+
+	ok, err := s.c.policy.Allowed(username, domain)
+	if err != nil {
+		lookupErr := tenancy.LookupError(err)
+		lookupErr.CheckName = modName
+		return module.CheckResult{Reason: lookupErr, Reject: true}
+	}
+	if !ok {
+		return s.violation(username, addr, field, "sender domain is not allowed for the account")
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckSender").End()
+
+	username := s.authUser()
+	if username == "" {
+		s.log.Debugf("unauthenticated client, skipping")
+		return module.CheckResult{}
+	}
+	if mailFrom == "" {
+		// Null return-path is not attributable to any domain, header fields
+		// are still checked.
+		return module.CheckResult{}
+	}
+
+	return s.check(username, mailFrom, "MAIL FROM")
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	username := s.authUser()
+	if username == "" {
+		return module.CheckResult{}
+	}
+
+	if !hdr.Has("From") {
+		return s.violation(username, "", "From", "missing From header field")
+	}
+
+	// Each occurrence of the field is checked separately, MUAs are not
+	// consistent in which one is shown if there are multiple.
+	for _, key := range headerFields {
+		for field := hdr.FieldsByKey(key); field.Next(); {
+			var single textproto.Header
+			single.Add(key, field.Value())
+			mailHdr := mail.Header{Header: message.Header{Header: single}}
+
+			addrs, err := mailHdr.AddressList(key)
+			if err != nil || len(addrs) == 0 {
+				return s.violation(username, field.Value(), key, "malformed "+key+" header field")
+			}
+			for _, addr := range addrs {
+				if res := s.check(username, addr.Address, key); res.Reason != nil {
+					return res
+				}
+			}
+		}
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tenant_sender
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tenancy"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T) *Check {
+	return &Check{
+		log: testutils.Logger(t, modName),
+		policy: tenancy.Policy{Table: testutils.Table{M: map[string]string{
+			"alice@a.example": "a.example, A.example.NET",
+			"bob@b.example":   "b.example",
+		}}},
+		failAction: modconfig.FailAction{Reject: true},
+	}
+}
+
+func newState(t *testing.T, c *Check, authUser string) module.CheckState {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{AuthUser: authUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCheck_Sender(t *testing.T) {
+	c := testCheck(t)
+	test := func(authUser, mailFrom string, reject bool) {
+		t.Helper()
+		s := newState(t, c, authUser)
+		defer s.Close()
+
+		res := s.CheckSender(context.Background(), mailFrom)
+		if res.Reject != reject {
+			t.Errorf("%s as %q: want reject=%v, got %v (%v)", authUser, mailFrom, reject, res.Reject, res.Reason)
+		}
+		var smtpErr *exterrors.SMTPError
+		if reject && (!errors.As(res.Reason, &smtpErr) || smtpErr.Code != 550) {
+			t.Errorf("%s as %q: wrong error: %v", authUser, mailFrom, res.Reason)
+		}
+	}
+
+	test("", "whoever@b.example", false)
+	test("alice@a.example", "alice@a.example", false)
+	test("alice@a.example", "anyone@A.EXAMPLE.net", false)
+	test("alice@a.example", "bob@b.example", true)
+	test("alice@a.example", "alice@sub.a.example", true)
+	test("alice@a.example", "", false)
+	test("alice@a.example", "malformed", true)
+	// No mapping entry.
+	test("carol@c.example", "carol@c.example", true)
+}
+
+func TestCheck_Header(t *testing.T) {
+	c := testCheck(t)
+	test := func(authUser string, fields [][2]string, reject bool) {
+		t.Helper()
+		s := newState(t, c, authUser)
+		defer s.Close()
+
+		hdr := textproto.Header{}
+		for _, f := range fields {
+			hdr.Add(f[0], f[1])
+		}
+		res := s.CheckBody(context.Background(), hdr, nil)
+		if res.Reject != reject {
+			t.Errorf("%s with %v: want reject=%v, got %v (%v)", authUser, fields, reject, res.Reject, res.Reason)
+		}
+	}
+
+	test("alice@a.example", [][2]string{{"From", "Alice <alice@a.example>"}}, false)
+	test("alice@a.example", [][2]string{{"From", "Bob <bob@b.example>"}}, true)
+	test("alice@a.example", [][2]string{{"From", "Alice <alice@a.example>, Bob <bob@b.example>"}}, true)
+	test("alice@a.example", nil, true)
+	test("alice@a.example", [][2]string{{"From", "undisclosed:;"}}, true)
+	test("alice@a.example", [][2]string{{"From", "garbage <<"}}, true)
+	test("", [][2]string{{"From", "Bob <bob@b.example>"}}, false)
+
+	// Crafted messages attempting to hide the address from the check.
+	test("alice@a.example", [][2]string{
+		{"From", "Alice <alice@a.example>"},
+		{"From", "Bob <bob@b.example>"},
+	}, true)
+	test("alice@a.example", [][2]string{
+		{"From", "Alice <alice@a.example>"},
+		{"Sender", "bob@b.example"},
+	}, true)
+	test("alice@a.example", [][2]string{{"From", "=?utf-8?q?bob=40b.example?= <bob@b.example>"}}, true)
+}
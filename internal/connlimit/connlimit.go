@@ -0,0 +1,292 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package connlimit implements connection-level limits for endpoint
+// listeners: total amount of simultaneous sessions, per-IP concurrent
+// connections and per-IP connection rate.
+package connlimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// Amount of tracked addresses after which stale rate counters are removed.
+const maxRateEntries = 20000
+
+var (
+	ErrTooManySessions  = errors.New("connlimit: too many sessions")
+	ErrTooManyFromIP    = errors.New("connlimit: too many connections from IP")
+	ErrRateLimitedForIP = errors.New("connlimit: connection rate limit exceeded for IP")
+)
+
+// Text sent to the client for each of the errors above.
+var replyText = map[error]string{
+	ErrTooManySessions:  "Too many connections, try again later",
+	ErrTooManyFromIP:    "Too many connections from your IP, try again later",
+	ErrRateLimitedForIP: "Connection rate limit exceeded, try again later",
+}
+
+type rateEntry struct {
+	start time.Time
+	count int
+}
+
+// Limits is the configuration and the state of connection limits. A single
+// Limits object should be shared between all listeners of an endpoint.
+type Limits struct {
+	maxSessions int
+	perIP       int
+	rateCount   int
+	ratePeriod  time.Duration
+	exempt      []net.IPNet
+
+	lock     sync.Mutex
+	sessions int
+	ipConns  map[string]int
+	ipRate   map[string]*rateEntry
+
+	now func() time.Time
+}
+
+// LimitsDirective parses the connection_limits configuration directive:
+//
+//	connection_limits {
+//	    max_sessions <n>
+//	    per_ip <n>
+//	    per_ip_rate <n> [period]
+//	    exempt <networks...>
+//	}
+func LimitsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	lim := &Limits{
+		ipConns: make(map[string]int),
+		ipRate:  make(map[string]*rateEntry),
+		now:     time.Now,
+	}
+	cfg := config.NewMap(nil, node)
+	cfg.Int("max_sessions", false, false, 0, &lim.maxSessions)
+	cfg.Int("per_ip", false, false, 0, &lim.perIP)
+	cfg.Callback("per_ip_rate", func(_ *config.Map, node config.Node) error {
+		var err error
+		lim.rateCount, lim.ratePeriod, err = parseRate(node)
+		return err
+	})
+	cfg.CIDRList("exempt", false, false, nil, &lim.exempt)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+	if lim.maxSessions < 0 || lim.perIP < 0 {
+		return nil, config.NodeErr(node, "limits can't be negative")
+	}
+
+	return lim, nil
+}
+
+func parseRate(node config.Node) (int, time.Duration, error) {
+	period := time.Second
+	switch len(node.Args) {
+	case 2:
+		var err error
+		period, err = time.ParseDuration(node.Args[1])
+		if err != nil {
+			return 0, 0, config.NodeErr(node, "%v", err)
+		}
+		if period <= 0 {
+			return 0, 0, config.NodeErr(node, "period should be positive")
+		}
+		fallthrough
+	case 1:
+		count, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return 0, 0, config.NodeErr(node, "%v", err)
+		}
+		if count <= 0 {
+			return 0, 0, config.NodeErr(node, "connections count should be positive")
+		}
+		return count, period, nil
+	default:
+		return 0, 0, config.NodeErr(node, "expected 1 or 2 arguments")
+	}
+}
+
+// key returns the per-IP counter key for the address or an empty string if
+// the address is exempt from limits.
+func (lim *Limits) key(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets are used by local clients.
+		return ""
+	}
+	for _, ipNet := range lim.exempt {
+		if ipNet.Contains(tcpAddr.IP) {
+			return ""
+		}
+	}
+	return tcpAddr.IP.String()
+}
+
+// take accounts a new connection from addr. On success, it returns the key
+// that should be passed to release when the connection is closed.
+func (lim *Limits) take(addr net.Addr) (string, error) {
+	key := lim.key(addr)
+	if key == "" {
+		return "", nil
+	}
+
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+
+	if lim.maxSessions != 0 && lim.sessions >= lim.maxSessions {
+		return "", ErrTooManySessions
+	}
+	if lim.perIP != 0 && lim.ipConns[key] >= lim.perIP {
+		return "", ErrTooManyFromIP
+	}
+	if lim.rateCount != 0 {
+		now := lim.now()
+		if len(lim.ipRate) >= maxRateEntries {
+			lim.reapRate(now)
+		}
+		entry := lim.ipRate[key]
+		if entry == nil || now.Sub(entry.start) >= lim.ratePeriod {
+			entry = &rateEntry{start: now}
+			lim.ipRate[key] = entry
+		}
+		if entry.count >= lim.rateCount {
+			return "", ErrRateLimitedForIP
+		}
+		entry.count++
+	}
+
+	lim.sessions++
+	lim.ipConns[key]++
+	return key, nil
+}
+
+// reapRate removes rate counters for expired periods. lim.lock should be
+// held.
+func (lim *Limits) reapRate(now time.Time) {
+	for key, entry := range lim.ipRate {
+		if now.Sub(entry.start) >= lim.ratePeriod {
+			delete(lim.ipRate, key)
+		}
+	}
+}
+
+func (lim *Limits) release(key string) {
+	if key == "" {
+		return
+	}
+
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+
+	lim.sessions--
+	lim.ipConns[key]--
+	if lim.ipConns[key] <= 0 {
+		delete(lim.ipConns, key)
+	}
+}
+
+// Sessions returns the current amount of accounted connections.
+func (lim *Limits) Sessions() int {
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	return lim.sessions
+}
+
+type listener struct {
+	net.Listener
+	lim         *Limits
+	rejectReply string
+	log         log.Logger
+}
+
+// NewListener wraps the listener l to enforce limits on accepted
+// connections.
+//
+// rejectReply is the format string (with a single %s for the reason) of the
+// reply sent to clients before closing the connection when a limit is
+// exceeded, e.g. "421 4.7.0 %s\r\n". If it is empty, connections are closed
+// without a reply.
+//
+// The wrapper should be applied before TLS so the client address is
+// available and rejected clients do not cost a TLS handshake.
+func NewListener(l net.Listener, lim *Limits, rejectReply string, logger log.Logger) net.Listener {
+	return &listener{
+		Listener:    l,
+		lim:         lim,
+		rejectReply: rejectReply,
+		log:         logger,
+	}
+}
+
+func (ll *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ll.lim.take(conn.RemoteAddr())
+		if err != nil {
+			ll.log.Msg("connection rejected", "reason", err.Error(), "src_ip", conn.RemoteAddr())
+			go ll.reject(conn, err)
+			continue
+		}
+		return &limitedConn{Conn: conn, lim: ll.lim, key: key}, nil
+	}
+}
+
+func (ll *listener) reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	if ll.rejectReply == "" {
+		return
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return
+	}
+	fmt.Fprintf(conn, ll.rejectReply, replyText[reason])
+}
+
+// limitedConn releases the accounted connection when closed. Servers close
+// connections that die abnormally too so counters do not leak.
+type limitedConn struct {
+	net.Conn
+	lim *Limits
+	key string
+
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.lim.release(c.key)
+	})
+	return c.Conn.Close()
+}
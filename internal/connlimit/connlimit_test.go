@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package connlimit
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testLimits(t *testing.T, children ...config.Node) *Limits {
+	t.Helper()
+
+	lim, err := LimitsDirective(nil, config.Node{
+		Name:     "connection_limits",
+		Children: children,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lim.(*Limits)
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 2525}
+}
+
+func TestLimits_MaxSessions(t *testing.T) {
+	lim := testLimits(t, config.Node{Name: "max_sessions", Args: []string{"2"}})
+
+	key1, err := lim.take(tcpAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lim.take(tcpAddr("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lim.take(tcpAddr("192.0.2.3")); err != ErrTooManySessions {
+		t.Fatal("Expected ErrTooManySessions, got", err)
+	}
+
+	lim.release(key1)
+	if _, err := lim.take(tcpAddr("192.0.2.3")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimits_PerIP(t *testing.T) {
+	lim := testLimits(t, config.Node{Name: "per_ip", Args: []string{"1"}})
+
+	key, err := lim.take(tcpAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lim.take(tcpAddr("192.0.2.1")); err != ErrTooManyFromIP {
+		t.Fatal("Expected ErrTooManyFromIP, got", err)
+	}
+	if _, err := lim.take(tcpAddr("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	lim.release(key)
+	if _, err := lim.take(tcpAddr("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(lim.ipConns) != 2 {
+		t.Error("Wrong amount of tracked addresses:", len(lim.ipConns))
+	}
+}
+
+func TestLimits_Rate(t *testing.T) {
+	lim := testLimits(t, config.Node{Name: "per_ip_rate", Args: []string{"2", "1m"}})
+	now := time.Now()
+	lim.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		key, err := lim.take(tcpAddr("192.0.2.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lim.release(key)
+	}
+	if _, err := lim.take(tcpAddr("192.0.2.1")); err != ErrRateLimitedForIP {
+		t.Fatal("Expected ErrRateLimitedForIP, got", err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := lim.take(tcpAddr("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimits_Exempt(t *testing.T) {
+	lim := testLimits(t,
+		config.Node{Name: "max_sessions", Args: []string{"1"}},
+		config.Node{Name: "exempt", Args: []string{"192.0.2.0/24", "2001:db8::1"}},
+	)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "2001:db8::1"} {
+		key, err := lim.take(tcpAddr(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			t.Fatal("Non-empty key for exempt address")
+		}
+	}
+	if _, err := lim.take(&net.UnixAddr{Name: "/run/maddy/smtp.sock", Net: "unix"}); err != nil {
+		t.Fatal(err)
+	}
+	if lim.Sessions() != 0 {
+		t.Fatal("Exempt connections are accounted")
+	}
+}
+
+func TestListener(t *testing.T) {
+	lim := testLimits(t, config.Node{Name: "per_ip", Args: []string{"1"}})
+
+	rawL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(rawL, lim, "421 4.7.0 %s\r\n", testutils.Logger(t, "connlimit"))
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	cl1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl1.Close()
+	srv1 := <-accepted
+
+	cl2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl2.Close()
+	if err := cl2.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(cl2).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "421 4.7.0 Too many connections from your IP, try again later\r\n" {
+		t.Fatalf("Wrong reply: %q", reply)
+	}
+
+	// Double close should not break accounting.
+	srv1.Close()
+	srv1.Close()
+	if lim.Sessions() != 0 {
+		t.Fatal("Connection is not released on close:", lim.Sessions())
+	}
+
+	cl3, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl3.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection is not accepted after release")
+	}
+}
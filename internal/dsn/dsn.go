@@ -36,6 +36,9 @@ import (
 )
 
 type ReportingMTAInfo struct {
+	// Value of the ENVID parameter of the original message (RFC 3461).
+	OriginalEnvelopeID string
+
 	ReportingMTA    string
 	ReceivedFromMTA string
 
@@ -57,6 +60,10 @@ func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
 	// MIME generator here.
 	h := textproto.Header{}
 
+	if info.OriginalEnvelopeID != "" {
+		h.Add("Original-Envelope-Id", info.OriginalEnvelopeID)
+	}
+
 	if info.ReportingMTA == "" {
 		return errors.New("dsn: Reporting-MTA field is mandatory")
 	}
@@ -96,7 +103,7 @@ func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
 	if !info.ArrivalDate.IsZero() {
 		h.Add("Arrival-Date", info.ArrivalDate.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
 	}
-	if !info.ArrivalDate.IsZero() {
+	if !info.LastAttemptDate.IsZero() {
 		h.Add("Last-Attempt-Date", info.LastAttemptDate.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
 	}
 
@@ -114,6 +121,10 @@ const (
 )
 
 type RecipientInfo struct {
+	// Value of the ORCPT parameter in the "addr-type;address" form (RFC
+	// 3461).
+	OriginalRecipient string
+
 	FinalRecipient string
 	RemoteMTA      string
 
@@ -122,6 +133,14 @@ type RecipientInfo struct {
 
 	// DiagnosticCode is the error that will be returned to the sender.
 	DiagnosticCode error
+
+	// Details is the list of additional lines (e.g. descriptions of previous
+	// delivery attempts) included in the human-readable part only.
+	Details []string
+
+	// WillRetryUntil is the time after which delivery attempts will stop,
+	// used for delayed recipients.
+	WillRetryUntil time.Time
 }
 
 func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
@@ -129,6 +148,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 	// MIME generator here.
 	h := textproto.Header{}
 
+	if info.OriginalRecipient != "" {
+		h.Add("Original-Recipient", info.OriginalRecipient)
+	}
+
 	if info.FinalRecipient == "" {
 		return errors.New("dsn: Final-Recipient is required")
 	}
@@ -157,7 +180,7 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Diagnostic-Code", fmt.Sprintf("smtp; %d %d.%d.%d %s",
 			smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2],
 			strings.ReplaceAll(strings.ReplaceAll(smtpErr.Message, "\n", " "), "\r", " ")))
-	} else if utf8 {
+	} else if utf8 && info.DiagnosticCode != nil {
 		// It might contain Unicode, so don't include it if we are not allowed to.
 		// ... I didn't bother implementing mangling logic to remove Unicode
 		// characters.
@@ -176,6 +199,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Remote-MTA", "dns; "+remoteMTA)
 	}
 
+	if !info.WillRetryUntil.IsZero() {
+		h.Add("Will-Retry-Until", info.WillRetryUntil.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+
 	return textproto.WriteHeader(w, h)
 }
 
@@ -187,8 +214,11 @@ type Envelope struct {
 
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
+// If failedBody is not nil, the original message is included in full,
+// otherwise only its header is included.
+//
 // DSN header will be returned, body itself will be written to outWriter.
-func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, failedBody io.Reader, outWriter io.Writer) (textproto.Header, error) {
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
 	reportHeader := textproto.Header{}
@@ -200,7 +230,14 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	switch reportAction(rcptsInfo) {
+	case ActionDelayed:
+		reportHeader.Add("Subject", "Delayed Mail (still being retried)")
+	case ActionDelivered:
+		reportHeader.Add("Subject", "Successful Mail Delivery Report")
+	default:
+		reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	}
 
 	defer partWriter.Close()
 
@@ -210,9 +247,47 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
 		return textproto.Header{}, err
 	}
+	if failedBody != nil {
+		return reportHeader, writeMessage(utf8, partWriter, failedHeader, failedBody)
+	}
 	return reportHeader, writeHeader(utf8, partWriter, failedHeader)
 }
 
+func writeMessage(utf8 bool, w *textproto.MultipartWriter, header textproto.Header, body io.Reader) error {
+	partHeader := textproto.Header{}
+	partHeader.Add("Content-Description", "Undelivered message")
+	if utf8 {
+		partHeader.Add("Content-Type", "message/global")
+	} else {
+		partHeader.Add("Content-Type", "message/rfc822")
+	}
+	partHeader.Add("Content-Transfer-Encoding", "8bit")
+	msgWriter, err := w.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+	if err := textproto.WriteHeader(msgWriter, header); err != nil {
+		return err
+	}
+	_, err = io.Copy(msgWriter, body)
+	return err
+}
+
+// reportAction returns the action used for all recipients in the report or
+// ActionFailed if they are different.
+func reportAction(rcptsInfo []RecipientInfo) Action {
+	if len(rcptsInfo) == 0 {
+		return ActionFailed
+	}
+	action := rcptsInfo[0].Action
+	for _, rcpt := range rcptsInfo[1:] {
+		if rcpt.Action != action {
+			return ActionFailed
+		}
+	}
+	return action
+}
+
 func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
 	partHeader := textproto.Header{}
 	partHeader.Add("Content-Description", "Undelivered message header")
@@ -271,6 +346,34 @@ Last delivery attempt: {{.LastAttemptDate}}
 
 `))
 
+// delayedText is the text of the human-readable part of delayed delivery
+// warnings.
+var delayedText = template.Must(template.New("dsn-delayed-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message could not be delivered to one or more recipients yet.
+Delivery will be retried, you do not have to resend the message. You will
+be notified if delivery fails permanently.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+`))
+
+// deliveredText is the text of the human-readable part of the successful
+// delivery reports.
+var deliveredText = template.Must(template.New("dsn-delivered-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was successfully delivered to the recipients listed below,
+as you requested.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+
+`))
+
 func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
@@ -284,14 +387,45 @@ func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, mta
 	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
 	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
 
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
+	text := failedText
+	switch reportAction(rcptsInfo) {
+	case ActionDelayed:
+		text = delayedText
+	case ActionDelivered:
+		text = deliveredText
+	}
+	if err := text.Execute(humanWriter, mtaInfo); err != nil {
 		return err
 	}
 
 	for _, rcpt := range rcptsInfo {
-		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
+		var err error
+		switch rcpt.Action {
+		case ActionDelivered, ActionRelayed:
+			_, err = fmt.Fprintf(humanWriter, "Delivered to %s\n", rcpt.FinalRecipient)
+		case ActionDelayed:
+			_, err = fmt.Fprintf(humanWriter, "Delivery to %s is delayed due to error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode)
+		default:
+			_, err = fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode)
+		}
+		if err != nil {
 			return err
 		}
+		if !rcpt.WillRetryUntil.IsZero() {
+			if _, err := fmt.Fprintf(humanWriter, "Delivery will be retried until %v\n", rcpt.WillRetryUntil.Truncate(time.Second)); err != nil {
+				return err
+			}
+		}
+		if len(rcpt.Details) != 0 {
+			if _, err := fmt.Fprintln(humanWriter, "Delivery attempts:"); err != nil {
+				return err
+			}
+			for _, line := range rcpt.Details {
+				if _, err := fmt.Fprintf(humanWriter, "  %s\n", line); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
 	return nil
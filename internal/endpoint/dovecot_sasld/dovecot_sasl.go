@@ -67,6 +67,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("auth_throttle", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetThrottle(m, node)
+	})
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -75,6 +78,12 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.srv.Log = stdlog.New(endp.log, "", 0)
 
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
+		// Bearer tokens should be accepted only over TLS, but the 'secured'
+		// flag reported by the client is not checked currently.
+		if auth.IsBearerMech(mech) {
+			continue
+		}
+
 		mech := mech
 		endp.srv.AddMechanism(mech, mechInfo[mech], func(req *dovecotsasl.AuthReq) sasl.Server {
 			var remoteAddr net.Addr
@@ -91,6 +100,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
+		if config.CheckOnly {
+			continue
+		}
 
 		l, err := net.Listen(parsed.Network(), parsed.Address())
 		if err != nil {
@@ -48,9 +48,15 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/connlimit"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 )
 
+// errTooManyAuthFailures is returned by Login if the client address is
+// blocked by auth_throttle.
+var errTooManyAuthFailures = errors.New("Too many authentication failures, try again later")
+
 type Endpoint struct {
 	addrs     []string
 	serv      *imapserver.Server
@@ -58,9 +64,13 @@ type Endpoint struct {
 	Store     module.Storage
 
 	updater     imapbackend.BackendUpdater
+	updates     <-chan imapbackend.Update
 	tlsConfig   *tls.Config
 	listenersWg sync.WaitGroup
 
+	proxyProtocol *proxy_protocol.ProxyProtocol
+	connLimits    *connlimit.Limits
+
 	saslAuth auth.SASLAuth
 
 	Log log.Logger
@@ -71,7 +81,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		Log:   log.Logger{Name: "imap"},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: "imap/sasl"},
+			Log:     log.Logger{Name: "imap/sasl"},
+			Service: module.ServiceIMAP,
 		},
 	}
 
@@ -88,8 +99,16 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("auth_throttle", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetThrottle(m, node)
+	})
+	cfg.Callback("master_users", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetMasterUsers(m, node)
+	})
 	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
 	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Custom("connection_limits", false, false, nil, connlimit.LimitsDirective, &endp.connLimits)
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
@@ -104,16 +123,22 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		return fmt.Errorf("imap: storage module %T does not implement imapbackend.BackendUpdater", endp.Store)
 	}
 
-	if updBe, ok := endp.Store.(updatepipe.Backend); ok {
-		if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
-			endp.Log.Error("failed to initialize updates pipe", err)
+	// Storage is not usable in the check mode.
+	if !config.CheckOnly {
+		if updBe, ok := endp.Store.(updatepipe.Backend); ok {
+			if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
+				endp.Log.Error("failed to initialize updates pipe", err)
+			}
 		}
-	}
 
-	// Call Updates once at start, some storage backends initialize update
-	// channel lazily and may not generate updates at all unless it is called.
-	if endp.updater.Updates() == nil {
-		return fmt.Errorf("imap: failed to init backend: nil update channel")
+		// Call Updates once at start, some storage backends initialize update
+		// channel lazily and may not generate updates at all unless it is called.
+		// The channel is then reused for all listeners since storage backends
+		// may create a separate subscription on each call.
+		endp.updates = endp.updater.Updates()
+		if endp.updates == nil {
+			return fmt.Errorf("imap: failed to init backend: nil update channel")
+		}
 	}
 
 	addresses := make([]config.Endpoint, 0, len(endp.addrs))
@@ -143,6 +168,14 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	}
 
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
+		// AUTH= capabilities are advertised only over TLS unless
+		// insecure_auth is used, there is no way to hide specific
+		// mechanisms.
+		if auth.IsBearerMech(mech) && (endp.serv.AllowInsecureAuth || endp.serv.TLSConfig == nil) {
+			endp.Log.Msg("bearer token authentication is disabled since authentication over unencrypted connections is allowed", "mech", mech)
+			continue
+		}
+
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
 			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
@@ -151,6 +184,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		})
 	}
 
+	if config.CheckOnly {
+		return nil
+	}
+
 	if err := endp.setupListeners(addresses); err != nil {
 		return err
 	}
@@ -159,6 +196,14 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 }
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
+	if endp.serv.AllowInsecureAuth {
+		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
+	}
+	if endp.serv.TLSConfig == nil {
+		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
+		endp.serv.AllowInsecureAuth = true
+	}
+
 	for _, addr := range addresses {
 		var l net.Listener
 		var err error
@@ -168,6 +213,19 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		// PROXY protocol header is sent before the TLS handshake.
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
+		}
+
+		if endp.connLimits != nil {
+			reply := "* BYE %s\r\n"
+			if addr.IsTLS() {
+				reply = ""
+			}
+			l = connlimit.NewListener(l, endp.connLimits, reply, endp.Log)
+		}
+
 		if addr.IsTLS() {
 			if endp.tlsConfig == nil {
 				return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
@@ -187,19 +245,11 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}()
 	}
 
-	if endp.serv.AllowInsecureAuth {
-		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
-	}
-	if endp.serv.TLSConfig == nil {
-		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
-		endp.serv.AllowInsecureAuth = true
-	}
-
 	return nil
 }
 
 func (endp *Endpoint) Updates() <-chan imapbackend.Update {
-	return endp.updater.Updates()
+	return endp.updates
 }
 
 func (endp *Endpoint) Name() string {
@@ -233,13 +283,16 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 }
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
-	err := endp.saslAuth.AuthPlain(username, password)
+	canonical, err := endp.saslAuth.AuthPlainFrom(connInfo.RemoteAddr, username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
+		if errors.Is(err, auth.ErrTooManyFailures) {
+			return nil, errTooManyAuthFailures
+		}
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
-	return endp.Store.GetOrCreateIMAPAcct(username)
+	return endp.Store.GetOrCreateIMAPAcct(canonical)
 }
 
 func (endp *Endpoint) EnableChildrenExt() bool {
@@ -270,6 +323,10 @@ func (endp *Endpoint) enableExtensions() error {
 			endp.serv.Enable(i18nlevel.NewExtension())
 		case "SORT":
 			endp.serv.Enable(sortthread.NewSortExtension())
+		case "QUOTA":
+			if store, ok := endp.Store.(module.QuotaStorage); ok {
+				endp.serv.Enable(&quotaExtension{store: store})
+			}
 		}
 		if strings.HasPrefix(ext, "THREAD") {
 			endp.serv.Enable(sortthread.NewThreadExtension())
@@ -0,0 +1,248 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package imap
+
+import (
+	"errors"
+	"flag"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/client"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testPort string
+
+type mockAuth struct{}
+
+func (mockAuth) AuthPlain(username, password string) error {
+	if password != "password" {
+		return errors.New("invalid creds")
+	}
+	return nil
+}
+
+func testStorage(t *testing.T) string {
+	t.Helper()
+
+	dir := testutils.Dir(t)
+	oldRuntime := config.RuntimeDirectory
+	config.RuntimeDirectory = dir
+	t.Cleanup(func() { config.RuntimeDirectory = oldRuntime })
+
+	instName := "test_imap_" + t.Name()
+	mod, err := imapsql.New("imapsql", instName, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*imapsql.Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	module.RegisterInstance(store, config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "test.db")}},
+			{Name: "fsstore", Args: []string{filepath.Join(dir, "messages")}},
+		},
+	}))
+	t.Cleanup(func() {
+		store.Close()
+		delete(module.Initialized, instName)
+	})
+
+	return instName
+}
+
+func testEndpoint(t *testing.T, storeInst, port string) *Endpoint {
+	t.Helper()
+
+	mod, err := New("imap", []string{"tcp://127.0.0.1:" + port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endp := mod.(*Endpoint)
+	endp.Log = testutils.Logger(t, "imap")
+
+	err = endp.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "storage", Args: []string{"&" + storeInst}},
+			{Name: "tls", Args: []string{"off"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { endp.Close() })
+
+	endp.saslAuth = auth.SASLAuth{
+		Log:   testutils.Logger(t, "imap/saslauth"),
+		Plain: []module.PlainAuth{mockAuth{}},
+	}
+
+	return endp
+}
+
+type idleClient struct {
+	c        *client.Client
+	updates  chan client.Update
+	stop     chan struct{}
+	idleDone chan error
+}
+
+// startIdle logs in, selects INBOX and starts IDLE command.
+func startIdle(t *testing.T, port string) *idleClient {
+	t.Helper()
+
+	c, err := client.Dial("127.0.0.1:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login("test@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+
+	ic := &idleClient{
+		c:        c,
+		updates:  make(chan client.Update, 10),
+		stop:     make(chan struct{}),
+		idleDone: make(chan error, 1),
+	}
+	c.Updates = ic.updates
+	go func() {
+		ic.idleDone <- idle.NewClient(c).Idle(ic.stop)
+	}()
+
+	return ic
+}
+
+func (ic *idleClient) expectExists(t *testing.T, count uint32) {
+	t.Helper()
+
+	select {
+	case upd := <-ic.updates:
+		mboxUpd, ok := upd.(*client.MailboxUpdate)
+		if !ok {
+			t.Fatalf("Unexpected update: %T", upd)
+		}
+		if mboxUpd.Mailbox.Messages != count {
+			t.Fatalf("Wrong EXISTS count: %v", mboxUpd.Mailbox.Messages)
+		}
+	case err := <-ic.idleDone:
+		t.Fatal("IDLE terminated:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No update received while IDLE-ing")
+	}
+}
+
+func (ic *idleClient) finish(t *testing.T) {
+	t.Helper()
+
+	close(ic.stop)
+	if err := <-ic.idleDone; err != nil {
+		t.Fatal(err)
+	}
+	ic.c.Updates = nil
+}
+
+func TestIdleDelivery(t *testing.T) {
+	endp := testEndpoint(t, testStorage(t), testPort)
+	if err := endp.Store.(module.ManageableStorage).CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	ic := startIdle(t, testPort)
+	// Make sure the IDLE command reaches the server before the delivery.
+	time.Sleep(250 * time.Millisecond)
+
+	testutils.DoTestDelivery(t, endp.Store.(module.DeliveryTarget), "sender@example.org", []string{"test@example.org"})
+	ic.expectExists(t, 1)
+
+	testutils.DoTestDelivery(t, endp.Store.(module.DeliveryTarget), "sender@example.org", []string{"test@example.org"})
+	ic.expectExists(t, 2)
+
+	ic.finish(t)
+
+	status, err := ic.c.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 2 {
+		t.Fatal("Wrong message count after IDLE:", status.Messages)
+	}
+}
+
+func TestIdleDelivery_MultipleEndpoints(t *testing.T) {
+	port2 := strconv.Itoa(mustAtoi(t, testPort) + 1)
+
+	storeInst := testStorage(t)
+	endp := testEndpoint(t, storeInst, testPort)
+	testEndpoint(t, storeInst, port2)
+	if err := endp.Store.(module.ManageableStorage).CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	ic1 := startIdle(t, testPort)
+	ic2 := startIdle(t, port2)
+	time.Sleep(250 * time.Millisecond)
+
+	testutils.DoTestDelivery(t, endp.Store.(module.DeliveryTarget), "sender@example.org", []string{"test@example.org"})
+
+	// Each endpoint should get its own copy of the update.
+	ic1.expectExists(t, 1)
+	ic2.expectExists(t, 1)
+
+	ic1.finish(t)
+	ic2.finish(t)
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestMain(m *testing.M) {
+	remoteImapPort := flag.String("test.imapport", "random", "(maddy) IMAP port to use for connections in tests")
+	flag.Parse()
+
+	if *remoteImapPort == "random" {
+		rand.Seed(time.Now().UnixNano())
+		*remoteImapPort = strconv.Itoa(rand.Intn(65536-10001) + 10000)
+	}
+
+	testPort = *remoteImapPort
+	os.Exit(m.Run())
+}
@@ -0,0 +1,141 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// quotaRoot is the name of the single quota root that includes all
+// mailboxes of the account.
+const quotaRoot = ""
+
+// quotaExtension implements the read-only part of the IMAP QUOTA extension
+// (RFC 2087). Quotas can't be changed using SETQUOTA.
+type quotaExtension struct {
+	store module.QuotaStorage
+}
+
+func (ext *quotaExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"QUOTA"}
+}
+
+func (ext *quotaExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() imapserver.Handler {
+			return &getQuotaHandler{store: ext.store}
+		}
+	case "GETQUOTAROOT":
+		return func() imapserver.Handler {
+			return &getQuotaHandler{store: ext.store, byMailbox: true}
+		}
+	case "SETQUOTA":
+		return func() imapserver.Handler {
+			return &setQuotaHandler{}
+		}
+	}
+	return nil
+}
+
+type getQuotaHandler struct {
+	store module.QuotaStorage
+
+	// Set for GETQUOTAROOT.
+	byMailbox bool
+	// Quota root name or mailbox name for GETQUOTAROOT.
+	name string
+}
+
+func (h *getQuotaHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("Exactly one argument is required")
+	}
+	name, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.name = name
+	return nil
+}
+
+func quotaResp(q module.Quota) imap.WriterTo {
+	var resources []interface{}
+	if q.MaxBytes != 0 {
+		// STORAGE is specified in units of 1024 octets.
+		resources = append(resources, imap.RawString("STORAGE"),
+			uint32(q.UsedBytes/1024), uint32(q.MaxBytes/1024))
+	}
+	if q.MaxMsgs != 0 {
+		resources = append(resources, imap.RawString("MESSAGE"),
+			uint32(q.UsedMsgs), uint32(q.MaxMsgs))
+	}
+	return imap.NewUntaggedResp([]interface{}{imap.RawString("QUOTA"), quotaRoot, resources})
+}
+
+func (h *getQuotaHandler) Handle(conn imapserver.Conn) error {
+	u := conn.Context().User
+	if u == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if h.byMailbox {
+		mboxName, err := utf7.Encoding.NewDecoder().String(h.name)
+		if err != nil {
+			return err
+		}
+		if _, err := u.GetMailbox(mboxName); err != nil {
+			return err
+		}
+		if err := conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+			imap.RawString("QUOTAROOT"), h.name, quotaRoot,
+		})); err != nil {
+			return err
+		}
+	} else if h.name != quotaRoot {
+		return errors.New("No such quota root")
+	}
+
+	q, err := h.store.GetQuota(u.Username())
+	if err != nil {
+		return err
+	}
+	return conn.WriteResp(quotaResp(q))
+}
+
+type setQuotaHandler struct{}
+
+func (h *setQuotaHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *setQuotaHandler) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	return errors.New("Quota can't be changed")
+}
@@ -67,6 +67,9 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 		if endp.IsTLS() {
 			return fmt.Errorf("%s: TLS is not supported yet", modName)
 		}
+		if config.CheckOnly {
+			continue
+		}
 		l, err := net.Listen(endp.Network(), endp.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
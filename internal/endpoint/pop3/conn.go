@@ -0,0 +1,618 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pop3
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/auth"
+)
+
+const (
+	// RFC 2449 Section 4 limits commands to 255 octets.
+	maxLineLength = 512
+
+	maxAuthFailures = 3
+)
+
+var errLineTooLong = errors.New("pop3: line too long")
+
+type conn struct {
+	endp    *Endpoint
+	netConn net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	isTLS   bool
+
+	// APOP timestamp sent in the greeting, empty if APOP is disabled.
+	timestamp    string
+	userArg      string
+	authFailures int
+
+	// Set in the TRANSACTION state.
+	user      imapbackend.User
+	lockedFor string
+	md        *maildrop
+	// Numbers of messages retrieved using RETR, see delete_on_retrieval.
+	retrieved map[int]struct{}
+	// Highest message number accessed, reported by LAST.
+	last     int
+	usedLast bool
+
+	closeOnce sync.Once
+}
+
+func newConn(endp *Endpoint, netConn net.Conn) *conn {
+	_, isTLS := netConn.(*tls.Conn)
+	return &conn{
+		endp:      endp,
+		netConn:   netConn,
+		r:         bufio.NewReaderSize(netConn, maxLineLength),
+		w:         bufio.NewWriter(netConn),
+		isTLS:     isTLS,
+		retrieved: make(map[int]struct{}),
+	}
+}
+
+func (c *conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.netConn.Close()
+	})
+	return err
+}
+
+func (c *conn) reply(ok bool, format string, args ...interface{}) {
+	if ok {
+		c.w.WriteString("+OK")
+	} else {
+		c.w.WriteString("-ERR")
+	}
+	if format != "" {
+		c.w.WriteByte(' ')
+		fmt.Fprintf(c.w, format, args...)
+	}
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) flush() error {
+	return c.w.Flush()
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Skip the rest of the line.
+		for err == bufio.ErrBufferFull {
+			_, err = c.r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (c *conn) serve() {
+	defer c.cleanup()
+
+	if c.endp.apopSecrets != nil {
+		// RFC 1939 Section 7 requires the timestamp to be unique for each
+		// greeting.
+		c.timestamp = fmt.Sprintf("<%d.%d.%d@%s>", os.Getpid(), rand.Int63(), time.Now().UnixNano(), c.endp.hostname)
+		c.reply(true, "%s POP3 server ready %s", c.endp.hostname, c.timestamp)
+	} else {
+		c.reply(true, "%s POP3 server ready", c.endp.hostname)
+	}
+
+	for {
+		if err := c.flush(); err != nil {
+			return
+		}
+
+		c.netConn.SetReadDeadline(time.Now().Add(c.endp.idleTimeout))
+		line, err := c.readLine()
+		if err != nil {
+			if err == errLineTooLong {
+				c.reply(false, "Line too long")
+				continue
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.reply(false, "Autologout timer expired")
+				c.flush()
+			}
+			return
+		}
+
+		cmd, args := line, []string(nil)
+		if parts := strings.Fields(line); len(parts) != 0 {
+			cmd, args = parts[0], parts[1:]
+		}
+		cmd = strings.ToUpper(cmd)
+
+		var quit bool
+		if c.md == nil {
+			quit = c.handleAuthorization(cmd, args)
+		} else {
+			quit = c.handleTransaction(cmd, args)
+		}
+		if quit {
+			c.flush()
+			return
+		}
+	}
+}
+
+// cleanup releases the maildrop if the session ended without QUIT. Deleted
+// messages are not removed in this case (RFC 1939 Section 6).
+func (c *conn) cleanup() {
+	c.releaseMaildrop()
+	c.Close()
+}
+
+func (c *conn) releaseMaildrop() {
+	if c.user != nil {
+		if err := c.user.Logout(); err != nil {
+			c.endp.Log.Error("logout failed", err, "username", c.lockedFor)
+		}
+		c.user = nil
+	}
+	if c.lockedFor != "" {
+		c.endp.unlockMaildrop(c.lockedFor)
+		c.lockedFor = ""
+	}
+	c.md = nil
+}
+
+func (c *conn) authAllowed() bool {
+	return c.isTLS || c.endp.insecureAuth
+}
+
+func (c *conn) capabilities() {
+	c.reply(true, "Capability list follows")
+	c.w.WriteString("TOP\r\n")
+	c.w.WriteString("UIDL\r\n")
+	c.w.WriteString("RESP-CODES\r\n")
+	c.w.WriteString("AUTH-RESP-CODE\r\n")
+	c.w.WriteString("PIPELINING\r\n")
+	if c.md == nil && c.authAllowed() {
+		c.w.WriteString("USER\r\n")
+	}
+	if c.md == nil && !c.isTLS && c.endp.tlsConfig != nil {
+		c.w.WriteString("STLS\r\n")
+	}
+	if c.endp.retrDelete {
+		c.w.WriteString("EXPIRE 0\r\n")
+	} else {
+		c.w.WriteString("EXPIRE NEVER\r\n")
+	}
+	c.w.WriteString("IMPLEMENTATION maddy\r\n")
+	c.w.WriteString(".\r\n")
+}
+
+func (c *conn) handleAuthorization(cmd string, args []string) (quit bool) {
+	switch cmd {
+	case "CAPA":
+		c.capabilities()
+	case "QUIT":
+		c.reply(true, "%s POP3 server signing off", c.endp.hostname)
+		return true
+	case "STLS":
+		c.startTLS()
+	case "USER":
+		if !c.authAllowed() {
+			c.reply(false, "Plaintext authentication is disallowed, use STLS")
+			return false
+		}
+		if len(args) != 1 {
+			c.reply(false, "Usage: USER name")
+			return false
+		}
+		c.userArg = args[0]
+		c.reply(true, "Send PASS")
+	case "PASS":
+		if c.userArg == "" {
+			c.reply(false, "USER required first")
+			return false
+		}
+		if len(args) == 0 {
+			c.reply(false, "Usage: PASS password")
+			return false
+		}
+		username := c.userArg
+		c.userArg = ""
+
+		// Passwords can contain spaces, RFC 1939 is not clear about that.
+		password := strings.Join(args, " ")
+		canonical, err := c.endp.saslAuth.AuthPlainFrom(c.netConn.RemoteAddr(), username, password)
+		if err != nil {
+			c.endp.Log.Error("authentication failed", err, "username", username, "src_ip", c.netConn.RemoteAddr())
+			if errors.Is(err, auth.ErrTooManyFailures) {
+				c.reply(false, "[SYS/TEMP] Too many authentication failures, try again later")
+				return true
+			}
+			if exterrors.IsTemporary(err) {
+				c.reply(false, "[SYS/TEMP] Temporary authentication failure")
+				return false
+			}
+			return c.authFailed()
+		}
+		c.openMaildrop(canonical)
+	case "APOP":
+		if c.timestamp == "" {
+			c.reply(false, "APOP is not supported")
+			return false
+		}
+		if len(args) != 2 {
+			c.reply(false, "Usage: APOP name digest")
+			return false
+		}
+		_, err := c.endp.saslAuth.Throttled(c.netConn.RemoteAddr(), args[0], func() (string, error) {
+			return args[0], c.checkAPOP(args[0], args[1])
+		})
+		if err != nil {
+			c.endp.Log.Error("authentication failed", err, "username", args[0], "src_ip", c.netConn.RemoteAddr())
+			if errors.Is(err, auth.ErrTooManyFailures) {
+				c.reply(false, "[SYS/TEMP] Too many authentication failures, try again later")
+				return true
+			}
+			return c.authFailed()
+		}
+		c.openMaildrop(args[0])
+	case "STAT", "LIST", "RETR", "DELE", "NOOP", "RSET", "TOP", "UIDL", "LAST":
+		c.reply(false, "Command is not permitted before authentication")
+	default:
+		c.reply(false, "Unknown command")
+	}
+	return false
+}
+
+func (c *conn) authFailed() (quit bool) {
+	c.authFailures++
+	if c.authFailures >= maxAuthFailures {
+		c.reply(false, "[AUTH] Too many authentication failures")
+		return true
+	}
+	c.reply(false, "[AUTH] Invalid credentials")
+	return false
+}
+
+func (c *conn) checkAPOP(username, digest string) error {
+	secret, ok, err := c.endp.apopSecrets.Lookup(username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("pop3: no APOP secret for user")
+	}
+
+	sum := md5.Sum([]byte(c.timestamp + secret))
+	expected := hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(digest))) != 1 {
+		return errors.New("pop3: APOP digest mismatch")
+	}
+	return nil
+}
+
+func (c *conn) startTLS() {
+	if c.isTLS {
+		c.reply(false, "Already running in TLS")
+		return
+	}
+	if c.endp.tlsConfig == nil {
+		c.reply(false, "TLS is not supported")
+		return
+	}
+
+	c.reply(true, "Begin TLS negotiation")
+	if err := c.flush(); err != nil {
+		return
+	}
+
+	tlsConn := tls.Server(c.netConn, c.endp.tlsConfig)
+	c.netConn.SetDeadline(time.Now().Add(c.endp.idleTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		c.endp.Log.Error("TLS handshake failed", err, "src_ip", c.netConn.RemoteAddr())
+		c.netConn.Close()
+		return
+	}
+	c.netConn.SetDeadline(time.Time{})
+
+	c.netConn = tlsConn
+	c.isTLS = true
+	// Data pipelined after STLS is discarded, see RFC 2595 Section 4.
+	c.r = bufio.NewReaderSize(tlsConn, maxLineLength)
+	c.w = bufio.NewWriter(tlsConn)
+	c.userArg = ""
+}
+
+func (c *conn) openMaildrop(username string) {
+	u, err := c.endp.Store.GetOrCreateIMAPAcct(username)
+	if err != nil {
+		c.endp.Log.Error("failed to open the account", err, "username", username)
+		c.reply(false, "[SYS/TEMP] Unable to open the maildrop")
+		return
+	}
+
+	lockName := u.Username()
+	if !c.endp.lockMaildrop(lockName) {
+		if err := u.Logout(); err != nil {
+			c.endp.Log.Error("logout failed", err, "username", lockName)
+		}
+		c.endp.Log.Msg("maildrop is locked by another session", "username", lockName, "src_ip", c.netConn.RemoteAddr())
+		c.reply(false, "[IN-USE] Maildrop is locked by another session")
+		return
+	}
+	c.user = u
+	c.lockedFor = lockName
+
+	md, err := openMaildrop(u)
+	if err != nil {
+		c.endp.Log.Error("failed to open the maildrop", err, "username", lockName)
+		c.releaseMaildrop()
+		c.reply(false, "[SYS/TEMP] Unable to open the maildrop")
+		return
+	}
+	c.md = md
+
+	count, size := md.stat()
+	c.endp.Log.DebugMsg("maildrop opened", "username", lockName, "src_ip", c.netConn.RemoteAddr(), "messages", count)
+	c.reply(true, "Maildrop locked and ready, %d messages (%d octets)", count, size)
+}
+
+// msgArg parses the message number argument and reports the error to the
+// client if it does not refer to an existing message.
+func (c *conn) msgArg(arg string) (int, *maildropMsg, bool) {
+	num, err := strconv.Atoi(arg)
+	if err != nil {
+		c.reply(false, "Invalid message number")
+		return 0, nil, false
+	}
+	msg, ok := c.md.msg(num)
+	if !ok {
+		c.reply(false, "No such message")
+		return 0, nil, false
+	}
+	return num, msg, true
+}
+
+func (c *conn) handleTransaction(cmd string, args []string) (quit bool) {
+	switch cmd {
+	case "CAPA":
+		c.capabilities()
+	case "STAT":
+		count, size := c.md.stat()
+		c.reply(true, "%d %d", count, size)
+	case "LIST", "UIDL":
+		c.list(cmd == "UIDL", args)
+	case "RETR":
+		if len(args) != 1 {
+			c.reply(false, "Usage: RETR msg")
+			return false
+		}
+		num, msg, ok := c.msgArg(args[0])
+		if !ok {
+			return false
+		}
+		if c.sendMsg(msg, -1) {
+			c.retrieved[num] = struct{}{}
+			c.access(num)
+		}
+	case "TOP":
+		if len(args) != 2 {
+			c.reply(false, "Usage: TOP msg n")
+			return false
+		}
+		lines, err := strconv.Atoi(args[1])
+		if err != nil || lines < 0 {
+			c.reply(false, "Invalid number of lines")
+			return false
+		}
+		num, msg, ok := c.msgArg(args[0])
+		if !ok {
+			return false
+		}
+		if c.sendMsg(msg, lines) {
+			c.access(num)
+		}
+	case "DELE":
+		if len(args) != 1 {
+			c.reply(false, "Usage: DELE msg")
+			return false
+		}
+		num, msg, ok := c.msgArg(args[0])
+		if !ok {
+			return false
+		}
+		msg.deleted = true
+		c.reply(true, "Message %d deleted", num)
+	case "NOOP":
+		c.reply(true, "")
+	case "RSET":
+		c.md.reset()
+		c.retrieved = make(map[int]struct{})
+		c.last = 0
+		count, size := c.md.stat()
+		c.reply(true, "Maildrop has %d messages (%d octets)", count, size)
+	case "LAST":
+		// RFC 1460. Clients using it keep track of retrieved messages
+		// themselves, so delete_on_retrieval is not applied to them.
+		c.usedLast = true
+		c.reply(true, "%d", c.last)
+	case "QUIT":
+		c.update()
+		return true
+	case "USER", "PASS", "APOP", "STLS":
+		c.reply(false, "Already authenticated")
+	default:
+		c.reply(false, "Unknown command")
+	}
+	return false
+}
+
+func (c *conn) access(num int) {
+	if num > c.last {
+		c.last = num
+	}
+}
+
+func (c *conn) list(uidl bool, args []string) {
+	value := func(msg *maildropMsg) string {
+		if uidl {
+			return c.md.uidl(msg)
+		}
+		return strconv.FormatUint(uint64(msg.size), 10)
+	}
+
+	if len(args) != 0 {
+		num, msg, ok := c.msgArg(args[0])
+		if !ok {
+			return
+		}
+		c.reply(true, "%d %s", num, value(msg))
+		return
+	}
+
+	count, size := c.md.stat()
+	if uidl {
+		c.reply(true, "")
+	} else {
+		c.reply(true, "%d messages (%d octets)", count, size)
+	}
+	for i := range c.md.msgs {
+		msg, ok := c.md.msg(i + 1)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(c.w, "%d %s\r\n", i+1, value(msg))
+	}
+	c.w.WriteString(".\r\n")
+}
+
+// sendMsg writes the message as a multi-line response. If lines is not
+// negative, only the header and the specified amount of body lines are
+// sent (TOP command).
+func (c *conn) sendMsg(msg *maildropMsg, lines int) bool {
+	body, err := c.md.body(msg, lines >= 0)
+	if err != nil {
+		if err == errMsgGone {
+			c.reply(false, "Message was removed by another session")
+			return false
+		}
+		c.endp.Log.Error("failed to fetch the message", err, "username", c.lockedFor, "uid", msg.uid)
+		c.reply(false, "[SYS/TEMP] Unable to read the message")
+		return false
+	}
+
+	if lines < 0 {
+		c.reply(true, "%d octets", msg.size)
+	} else {
+		c.reply(true, "")
+	}
+
+	dw := textproto.NewWriter(c.w).DotWriter()
+	if lines < 0 {
+		_, err = io.Copy(dw, body)
+	} else {
+		err = copyTop(dw, body, lines)
+	}
+	if err != nil {
+		// The response is already started, there is no way to report the
+		// error to the client.
+		c.endp.Log.Error("failed to send the message", err, "username", c.lockedFor, "uid", msg.uid)
+		c.Close()
+		return false
+	}
+	if err := dw.Close(); err != nil {
+		return false
+	}
+	return true
+}
+
+// copyTop copies the message header and the first n lines of the body.
+func copyTop(w io.Writer, r io.Reader, n int) error {
+	br := bufio.NewReader(r)
+	inHeader := true
+	for inHeader || n > 0 {
+		line, err := br.ReadString('\n')
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if inHeader {
+			inHeader = line != "\r\n" && line != "\n"
+		} else {
+			n--
+		}
+	}
+	return nil
+}
+
+// update implements the UPDATE state entered after QUIT.
+func (c *conn) update() {
+	if c.endp.retrDelete && !c.usedLast {
+		for num := range c.retrieved {
+			if msg, ok := c.md.msg(num); ok {
+				msg.deleted = true
+			}
+		}
+	}
+
+	deleted, err := c.md.commit()
+	count, _ := c.md.stat()
+	username := c.lockedFor
+	c.releaseMaildrop()
+
+	if err != nil {
+		c.endp.Log.Error("failed to remove messages", err, "username", username)
+		c.reply(false, "[SYS/TEMP] Some deleted messages were not removed")
+		return
+	}
+
+	c.endp.Log.DebugMsg("maildrop updated", "username", username, "deleted", deleted)
+	c.reply(true, "%s POP3 server signing off (%d messages left)", c.endp.hostname, count)
+}
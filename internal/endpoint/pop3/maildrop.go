@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pop3
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+)
+
+var errMsgGone = errors.New("pop3: message was removed from the maildrop")
+
+// msgDeleter is implemented by storage backends that can delete messages by
+// UID without affecting messages marked as \Deleted by IMAP clients.
+type msgDeleter interface {
+	DelMessages(uid bool, seqset *imap.SeqSet) error
+}
+
+type maildropMsg struct {
+	uid     uint32
+	size    uint32
+	deleted bool
+}
+
+// maildrop is the snapshot of INBOX taken when the POP3 session enters the
+// TRANSACTION state.
+//
+// Messages are referred to by UID so changes made by IMAP clients while the
+// session is active do not change message numbers. Messages removed
+// concurrently can't be retrieved and are silently skipped when
+// committing deletions.
+type maildrop struct {
+	mbox        imapbackend.Mailbox
+	uidValidity uint32
+	msgs        []maildropMsg
+}
+
+func openMaildrop(u imapbackend.User) (*maildrop, error) {
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return nil, err
+	}
+
+	md := &maildrop{
+		mbox:        mbox,
+		uidValidity: status.UidValidity,
+	}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddRange(1, 0)
+	ch := make(chan *imap.Message, 32)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mbox.ListMessages(true, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}, ch)
+	}()
+	for msg := range ch {
+		md.msgs = append(md.msgs, maildropMsg{uid: msg.Uid, size: msg.Size})
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(md.msgs, func(i, j int) bool {
+		return md.msgs[i].uid < md.msgs[j].uid
+	})
+
+	return md, nil
+}
+
+// msg returns the message by its number as seen by the client (starting
+// at 1). Deleted messages are not returned.
+func (md *maildrop) msg(num int) (*maildropMsg, bool) {
+	if num < 1 || num > len(md.msgs) {
+		return nil, false
+	}
+	msg := &md.msgs[num-1]
+	if msg.deleted {
+		return nil, false
+	}
+	return msg, true
+}
+
+// stat returns the amount of not deleted messages and their total size.
+func (md *maildrop) stat() (count int, size int64) {
+	for _, msg := range md.msgs {
+		if msg.deleted {
+			continue
+		}
+		count++
+		size += int64(msg.size)
+	}
+	return
+}
+
+// uidl returns the unique-id of the message that is stable across
+// sessions.
+func (md *maildrop) uidl(msg *maildropMsg) string {
+	return fmt.Sprintf("%d.%d", md.uidValidity, msg.uid)
+}
+
+// body returns the full message. If peek is false, the message is marked as
+// \Seen for IMAP clients.
+func (md *maildrop) body(msg *maildropMsg, peek bool) (imap.Literal, error) {
+	section := &imap.BodySectionName{Peek: peek}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddNum(msg.uid)
+	ch := make(chan *imap.Message, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- md.mbox.ListMessages(true, seqset, []imap.FetchItem{section.FetchItem()}, ch)
+	}()
+
+	var body imap.Literal
+	for fetched := range ch {
+		if fetched.Uid != 0 && fetched.Uid != msg.uid {
+			continue
+		}
+		// GetBody can't be used since backends key the body by the
+		// requested section, including the Peek flag.
+		for _, literal := range fetched.Body {
+			body = literal
+		}
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, errMsgGone
+	}
+	return body, nil
+}
+
+func (md *maildrop) reset() {
+	for i := range md.msgs {
+		md.msgs[i].deleted = false
+	}
+}
+
+// commit removes messages marked as deleted from the storage.
+func (md *maildrop) commit() (int, error) {
+	seqset := &imap.SeqSet{}
+	count := 0
+	for _, msg := range md.msgs {
+		if msg.deleted {
+			seqset.AddNum(msg.uid)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	if deleter, ok := md.mbox.(msgDeleter); ok {
+		return count, deleter.DelMessages(true, seqset)
+	}
+
+	// Fallback for backends without a way to remove specific messages, it
+	// also expunges messages marked as \Deleted by IMAP clients.
+	if err := md.mbox.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return 0, err
+	}
+	return count, md.mbox.Expunge()
+}
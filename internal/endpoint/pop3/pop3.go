@@ -0,0 +1,266 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package pop3 implements the POP3 endpoint (RFC 1939) on top of the
+// storage modules.
+//
+// Only INBOX is accessible over POP3.
+package pop3
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/connlimit"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
+)
+
+type Endpoint struct {
+	addrs     []string
+	hostname  string
+	listeners []net.Listener
+	Store     module.Storage
+
+	tlsConfig     *tls.Config
+	insecureAuth  bool
+	idleTimeout   time.Duration
+	retrDelete    bool
+	apopSecrets   module.Table
+	proxyProtocol *proxy_protocol.ProxyProtocol
+	connLimits    *connlimit.Limits
+
+	saslAuth auth.SASLAuth
+
+	// Maildrops locked by active sessions, see lockMaildrop.
+	locksLck sync.Mutex
+	locks    map[string]struct{}
+
+	connsLck sync.Mutex
+	conns    map[*conn]struct{}
+	closing  bool
+
+	listenersWg sync.WaitGroup
+	connsWg     sync.WaitGroup
+
+	Log log.Logger
+}
+
+func New(modName string, addrs []string) (module.Module, error) {
+	endp := &Endpoint{
+		addrs: addrs,
+		locks: make(map[string]struct{}),
+		conns: make(map[*conn]struct{}),
+		Log:   log.Logger{Name: "pop3"},
+		saslAuth: auth.SASLAuth{
+			Log:     log.Logger{Name: "pop3/sasl"},
+			Service: module.ServicePOP3,
+		},
+	}
+
+	return endp, nil
+}
+
+func (endp *Endpoint) Init(cfg *config.Map) error {
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddProvider(m, node)
+	})
+	cfg.Callback("auth_throttle", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetThrottle(m, node)
+	})
+	cfg.Callback("master_users", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetMasterUsers(m, node)
+	})
+	cfg.String("hostname", true, false, "localhost", &endp.hostname)
+	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
+	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Custom("connection_limits", false, false, nil, connlimit.LimitsDirective, &endp.connLimits)
+	cfg.Custom("apop_secrets", false, false, nil, modconfig.TableDirective, &endp.apopSecrets)
+	cfg.Bool("insecure_auth", false, false, &endp.insecureAuth)
+	// RFC 1939 Section 3 requires the autologout timer to be at least 10
+	// minutes.
+	cfg.Duration("idle_timeout", false, false, 10*time.Minute, &endp.idleTimeout)
+	cfg.Bool("delete_on_retrieval", false, false, &endp.retrDelete)
+	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	addresses := make([]config.Endpoint, 0, len(endp.addrs))
+	for _, addr := range endp.addrs {
+		saddr, err := config.ParseEndpoint(addr)
+		if err != nil {
+			return fmt.Errorf("pop3: invalid address: %s", addr)
+		}
+		addresses = append(addresses, saddr)
+	}
+	if config.CheckOnly {
+		return nil
+	}
+
+	return endp.setupListeners(addresses)
+}
+
+func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
+	if endp.insecureAuth {
+		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
+	}
+	if endp.tlsConfig == nil {
+		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
+		endp.insecureAuth = true
+	}
+
+	for _, addr := range addresses {
+		var l net.Listener
+		var err error
+		l, err = net.Listen(addr.Network(), addr.Address())
+		if err != nil {
+			return fmt.Errorf("pop3: %v", err)
+		}
+		endp.Log.Printf("listening on %v", addr)
+
+		// PROXY protocol header is sent before the TLS handshake.
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
+		}
+
+		if endp.connLimits != nil {
+			reply := "-ERR [SYS/TEMP] %s\r\n"
+			if addr.IsTLS() {
+				reply = ""
+			}
+			l = connlimit.NewListener(l, endp.connLimits, reply, endp.Log)
+		}
+
+		if addr.IsTLS() {
+			if endp.tlsConfig == nil {
+				return errors.New("pop3: can't bind on POP3S endpoint without TLS configuration")
+			}
+			l = tls.NewListener(l, endp.tlsConfig)
+		}
+
+		endp.listeners = append(endp.listeners, l)
+
+		endp.listenersWg.Add(1)
+		addr := addr
+		go func() {
+			if err := endp.serve(l); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				endp.Log.Printf("pop3: failed to serve %s: %s", addr, err)
+			}
+			endp.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func (endp *Endpoint) serve(l net.Listener) error {
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		c := newConn(endp, netConn)
+
+		endp.connsLck.Lock()
+		if endp.closing {
+			endp.connsLck.Unlock()
+			netConn.Close()
+			continue
+		}
+		endp.conns[c] = struct{}{}
+		endp.connsWg.Add(1)
+		endp.connsLck.Unlock()
+
+		go func() {
+			c.serve()
+
+			endp.connsLck.Lock()
+			delete(endp.conns, c)
+			endp.connsLck.Unlock()
+			endp.connsWg.Done()
+		}()
+	}
+}
+
+// lockMaildrop acquires the exclusive-access lock on the maildrop of the
+// user as required by RFC 1939 Section 8. It returns false if the maildrop
+// is already locked by another POP3 session.
+//
+// The lock is not visible to IMAP sessions, they are allowed to access the
+// mailbox concurrently.
+func (endp *Endpoint) lockMaildrop(username string) bool {
+	endp.locksLck.Lock()
+	defer endp.locksLck.Unlock()
+
+	if _, ok := endp.locks[username]; ok {
+		return false
+	}
+	endp.locks[username] = struct{}{}
+	return true
+}
+
+func (endp *Endpoint) unlockMaildrop(username string) {
+	endp.locksLck.Lock()
+	defer endp.locksLck.Unlock()
+
+	delete(endp.locks, username)
+}
+
+func (endp *Endpoint) Name() string {
+	return "pop3"
+}
+
+func (endp *Endpoint) InstanceName() string {
+	return "pop3"
+}
+
+func (endp *Endpoint) Close() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	endp.listenersWg.Wait()
+
+	// Sessions are terminated without entering the UPDATE state so no
+	// messages are removed.
+	endp.connsLck.Lock()
+	endp.closing = true
+	for c := range endp.conns {
+		c.Close()
+	}
+	endp.connsLck.Unlock()
+	endp.connsWg.Wait()
+
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint("pop3", New)
+}
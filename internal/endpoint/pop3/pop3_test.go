@@ -0,0 +1,380 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	_ "github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockAuth struct{}
+
+func (mockAuth) AuthPlain(username, password string) error {
+	if password != "password" {
+		return errors.New("invalid creds")
+	}
+	return nil
+}
+
+func testStorage(t *testing.T) string {
+	t.Helper()
+
+	dir := testutils.Dir(t)
+	oldRuntime := config.RuntimeDirectory
+	config.RuntimeDirectory = dir
+	t.Cleanup(func() { config.RuntimeDirectory = oldRuntime })
+
+	instName := "test_pop3_" + t.Name()
+	mod, err := imapsql.New("imapsql", instName, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*imapsql.Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	module.RegisterInstance(store, config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "test.db")}},
+			{Name: "fsstore", Args: []string{filepath.Join(dir, "messages")}},
+		},
+	}))
+	t.Cleanup(func() {
+		store.Close()
+		delete(module.Initialized, instName)
+	})
+
+	return instName
+}
+
+func testEndpoint(t *testing.T, cfg []config.Node) *Endpoint {
+	t.Helper()
+
+	mod, err := New("pop3", []string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endp := mod.(*Endpoint)
+	endp.Log = testutils.Logger(t, "pop3")
+
+	err = endp.Init(config.NewMap(nil, config.Node{
+		Children: append([]config.Node{
+			{Name: "hostname", Args: []string{"mx.example.org"}},
+			{Name: "storage", Args: []string{"&" + testStorage(t)}},
+			{Name: "tls", Args: []string{"off"}},
+		}, cfg...),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { endp.Close() })
+
+	endp.saslAuth = auth.SASLAuth{
+		Log:   testutils.Logger(t, "pop3/saslauth"),
+		Plain: []module.PlainAuth{mockAuth{}},
+	}
+
+	if err := endp.Store.(module.ManageableStorage).CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	return endp
+}
+
+func deliver(t *testing.T, endp *Endpoint, body string) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(body))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := br.Peek(br.Buffered())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := endp.Store.(module.DeliveryTarget)
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: append([]byte(nil), text...)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type client struct {
+	t        *testing.T
+	conn     net.Conn
+	r        *bufio.Reader
+	greeting string
+}
+
+func dial(t *testing.T, endp *Endpoint) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", endp.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.greeting = c.expect("+OK")
+	return c
+}
+
+func (c *client) line() string {
+	c.t.Helper()
+	l, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal("Unexpected read error:", err)
+	}
+	return strings.TrimRight(l, "\r\n")
+}
+
+func (c *client) expect(prefix string) string {
+	c.t.Helper()
+	l := c.line()
+	if !strings.HasPrefix(l, prefix) {
+		c.t.Fatalf("Expected %q, got %q", prefix, l)
+	}
+	return l
+}
+
+func (c *client) cmd(cmd, prefix string) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(prefix)
+}
+
+// multiline reads the multi-line response body, undoing the dot-stuffing.
+func (c *client) multiline() []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		l := c.line()
+		if l == "." {
+			return lines
+		}
+		lines = append(lines, strings.TrimPrefix(l, "."))
+	}
+}
+
+func (c *client) login() {
+	c.t.Helper()
+	c.cmd("USER test@example.org", "+OK")
+	c.cmd("PASS password", "+OK")
+}
+
+func TestPOP3_Login(t *testing.T) {
+	endp := testEndpoint(t, nil)
+	deliver(t, endp, "Subject: 1\r\n\r\nfoobar\r\n")
+
+	c := dial(t, endp)
+	c.cmd("STAT", "-ERR")
+	c.cmd("USER test@example.org", "+OK")
+	c.cmd("PASS wrong", "-ERR [AUTH]")
+	c.cmd("PASS password", "-ERR")
+	c.login()
+	c.cmd("STAT", "+OK 1 ")
+	c.cmd("QUIT", "+OK")
+}
+
+func TestPOP3_TooManyFailures(t *testing.T) {
+	endp := testEndpoint(t, nil)
+
+	c := dial(t, endp)
+	for i := 0; i < maxAuthFailures-1; i++ {
+		c.cmd("USER test@example.org", "+OK")
+		c.cmd("PASS wrong", "-ERR [AUTH] Invalid")
+	}
+	c.cmd("USER test@example.org", "+OK")
+	c.cmd("PASS wrong", "-ERR [AUTH] Too many")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("Connection is not closed")
+	}
+}
+
+func TestPOP3_Retrieve(t *testing.T) {
+	endp := testEndpoint(t, nil)
+	deliver(t, endp, "Subject: 1\r\n\r\nfoobar\r\n")
+	deliver(t, endp, "Subject: 2\r\n\r\n.leading dot\r\nline 2\r\n")
+
+	c := dial(t, endp)
+	c.login()
+
+	c.cmd("LIST", "+OK 2 messages")
+	if list := c.multiline(); len(list) != 2 || !strings.HasPrefix(list[0], "1 ") || !strings.HasPrefix(list[1], "2 ") {
+		t.Fatal("Wrong LIST response:", list)
+	}
+
+	c.cmd("RETR 2", "+OK")
+	// The storage prepends Delivered-To and Return-Path.
+	body := c.multiline()
+	if len(body) != 6 || body[2] != "Subject: 2" || body[4] != ".leading dot" || body[5] != "line 2" {
+		t.Fatalf("Wrong message body: %q", body)
+	}
+
+	c.cmd("TOP 2 1", "+OK")
+	body = c.multiline()
+	if len(body) != 5 || body[4] != ".leading dot" {
+		t.Fatalf("Wrong TOP response: %q", body)
+	}
+
+	c.cmd("RETR 3", "-ERR")
+	c.cmd("LAST", "+OK 2")
+	c.cmd("QUIT", "+OK")
+}
+
+func TestPOP3_UIDLStable(t *testing.T) {
+	endp := testEndpoint(t, nil)
+	deliver(t, endp, "Subject: 1\r\n\r\nfoobar\r\n")
+	deliver(t, endp, "Subject: 2\r\n\r\nfoobar\r\n")
+
+	c := dial(t, endp)
+	c.login()
+	c.cmd("UIDL", "+OK")
+	before := c.multiline()
+	c.cmd("DELE 1", "+OK")
+	c.cmd("UIDL 1", "-ERR")
+	c.cmd("QUIT", "+OK")
+
+	c = dial(t, endp)
+	c.login()
+	c.cmd("UIDL", "+OK")
+	after := c.multiline()
+	c.cmd("QUIT", "+OK")
+
+	if len(before) != 2 || len(after) != 1 {
+		t.Fatalf("Wrong UIDL responses: %q, %q", before, after)
+	}
+	// Message numbers change after deletion, unique-ids should not.
+	if strings.Fields(before[1])[1] != strings.Fields(after[0])[1] {
+		t.Fatalf("Unique-id changed: %q, %q", before[1], after[0])
+	}
+}
+
+func TestPOP3_DeleteNoQuit(t *testing.T) {
+	endp := testEndpoint(t, nil)
+	deliver(t, endp, "Subject: 1\r\n\r\nfoobar\r\n")
+
+	c := dial(t, endp)
+	c.login()
+	c.cmd("DELE 1", "+OK")
+	c.cmd("STAT", "+OK 0 0")
+	c.cmd("RSET", "+OK")
+	c.cmd("DELE 1", "+OK")
+	c.conn.Close()
+
+	// Messages are not removed if the session is terminated without QUIT.
+	c = dial(t, endp)
+	c.login()
+	c.cmd("STAT", "+OK 1 ")
+}
+
+func TestPOP3_Lock(t *testing.T) {
+	endp := testEndpoint(t, nil)
+
+	c1 := dial(t, endp)
+	c1.login()
+
+	c2 := dial(t, endp)
+	c2.cmd("USER test@example.org", "+OK")
+	c2.cmd("PASS password", "-ERR [IN-USE]")
+
+	c1.cmd("QUIT", "+OK")
+
+	c2.cmd("USER test@example.org", "+OK")
+	c2.cmd("PASS password", "+OK")
+}
+
+func TestPOP3_DeleteOnRetrieval(t *testing.T) {
+	endp := testEndpoint(t, []config.Node{
+		{Name: "delete_on_retrieval", Args: []string{"yes"}},
+	})
+	deliver(t, endp, "Subject: 1\r\n\r\nfoobar\r\n")
+	deliver(t, endp, "Subject: 2\r\n\r\nfoobar\r\n")
+
+	c := dial(t, endp)
+	c.login()
+	c.cmd("RETR 1", "+OK")
+	c.multiline()
+	c.cmd("QUIT", "+OK")
+
+	c = dial(t, endp)
+	c.login()
+	c.cmd("STAT", "+OK 1 ")
+
+	// Clients using LAST manage deletions themselves.
+	c.cmd("LAST", "+OK 0")
+	c.cmd("RETR 1", "+OK")
+	c.multiline()
+	c.cmd("QUIT", "+OK")
+
+	c = dial(t, endp)
+	c.login()
+	c.cmd("STAT", "+OK 1 ")
+}
+
+func TestPOP3_APOP(t *testing.T) {
+	endp := testEndpoint(t, []config.Node{
+		{
+			Name: "apop_secrets",
+			Args: []string{"static"},
+			Children: []config.Node{
+				{Name: "entry", Args: []string{"test@example.org", "secret"}},
+			},
+		},
+	})
+
+	c := dial(t, endp)
+	timestamp := c.greeting[strings.Index(c.greeting, "<"):]
+	c.cmd("APOP test@example.org 0123456789abcdef0123456789abcdef", "-ERR [AUTH]")
+
+	sum := md5.Sum([]byte(timestamp + "secret"))
+	c.cmd("APOP test@example.org "+hex.EncodeToString(sum[:]), "+OK")
+}
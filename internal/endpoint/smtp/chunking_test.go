@@ -0,0 +1,314 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type rawClient struct {
+	t *testing.T
+	*textproto.Conn
+}
+
+func dialRaw(t *testing.T) rawClient {
+	t.Helper()
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rawClient{t: t, Conn: conn}
+	c.expect(220)
+	return c
+}
+
+// cmd sends a command and returns the reply code and text.
+func (c rawClient) cmd(format string, args ...interface{}) (int, string) {
+	c.t.Helper()
+
+	if _, err := c.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.reply()
+}
+
+func (c rawClient) reply() (int, string) {
+	c.t.Helper()
+
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			c.t.Fatal(err)
+		}
+	}
+	return code, msg
+}
+
+func (c rawClient) expect(code int) string {
+	c.t.Helper()
+
+	actual, msg := c.reply()
+	if actual != code {
+		c.t.Fatalf("Expected %d, got %d %s", code, actual, msg)
+	}
+	return msg
+}
+
+func (c rawClient) expectCmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+
+	actual, msg := c.cmd(format, args...)
+	if actual != code {
+		c.t.Fatalf("Expected %d for %s, got %d %s", code, fmt.Sprintf(format, args...), actual, msg)
+	}
+	return msg
+}
+
+// bdat sends a BDAT command with the chunk and returns the reply code.
+func (c rawClient) bdat(chunk string, last bool) int {
+	c.t.Helper()
+
+	lastArg := ""
+	if last {
+		lastArg = " LAST"
+	}
+	if _, err := fmt.Fprintf(c.W, "BDAT %d%s\r\n%s", len(chunk), lastArg, chunk); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.W.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+	code, _ := c.reply()
+	return code
+}
+
+func (c rawClient) startTxn(mailArgs string, rcpt string) {
+	c.t.Helper()
+
+	c.expectCmd(250, "MAIL FROM:<sender@example.org>%s", mailArgs)
+	c.expectCmd(250, "RCPT TO:<%s>", rcpt)
+}
+
+func TestSMTPDelivery_BDAT(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	caps := c.expectCmd(250, "EHLO mx.example.org")
+	if !strings.Contains(caps, "CHUNKING") {
+		t.Fatal("CHUNKING is not advertised:", caps)
+	}
+
+	c.startTxn("", "rcpt@example.com")
+	// Split in the middle of the header and in the middle of the body.
+	chunks := []string{testMsg[:10], testMsg[10:50], testMsg[50:]}
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		if code := c.bdat(chunk, last); code != 250 {
+			t.Fatalf("Chunk %d: expected 250, got %d", i, code)
+		}
+	}
+
+	// The empty LAST chunk is allowed too.
+	c.startTxn("", "rcpt@example.com")
+	if code := c.bdat(testMsg, false); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+	if code := c.bdat("", true); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+	for _, msg := range tgt.Messages {
+		testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt@example.com"}, "")
+		if msg.Header.Get("Subject") != "Hello there!" {
+			t.Error("Wrong Subject:", msg.Header.Get("Subject"))
+		}
+		if string(msg.Body) != "foobar\r\n" {
+			t.Errorf("Wrong body: %q", msg.Body)
+		}
+	}
+}
+
+func TestSMTPDelivery_BDAT_SizeLimit(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_message_size",
+			Args: []string{"100b"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+	c.expectCmd(250, "EHLO mx.example.org")
+
+	c.startTxn("", "rcpt@example.com")
+	if code := c.bdat(testMsg, false); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+	// The limit is exceeded by the second chunk, it should be rejected
+	// without waiting for LAST and its contents should be discarded.
+	if code := c.bdat(strings.Repeat("A", 80), false); code != 552 {
+		t.Fatal("Expected 552, got", code)
+	}
+	c.expectCmd(250, "NOOP")
+
+	// The transaction is aborted, a new one can be started.
+	c.startTxn("", "rcpt@example.com")
+	if code := c.bdat(testMsg, true); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_BDAT_FailMidChunk(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+	c.expectCmd(250, "EHLO mx.example.org")
+
+	// Header parsing fails early and the rest of the chunk is not read by
+	// the message handler. The server should still consume it.
+	c.startTxn("", "rcpt@example.com")
+	chunk := "Malformed header line\r\n\r\n" + strings.Repeat(strings.Repeat("A", 78)+"\r\n", 2000)
+	if code := c.bdat(chunk, false); code < 400 {
+		t.Fatal("Expected an error, got", code)
+	}
+	c.expectCmd(250, "NOOP")
+
+	c.startTxn("", "rcpt@example.com")
+	if code := c.bdat(testMsg, true); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_BDAT_CheckFail(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			BodyRes: module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:    550,
+					Message: "Hey",
+				},
+				Reject: true,
+			},
+		},
+	}, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+	c.expectCmd(250, "EHLO mx.example.org")
+
+	c.startTxn("", "rcpt@example.com")
+	if code := c.bdat(testMsg[:20], false); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+	if code := c.bdat(testMsg[20:], true); code != 550 {
+		t.Fatal("Expected 550, got", code)
+	}
+	c.expectCmd(250, "NOOP")
+
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_BDAT_Reset(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+	c.expectCmd(250, "EHLO mx.example.org")
+
+	c.startTxn("", "rcpt@example.com")
+	if code := c.bdat(testMsg[:20], false); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+	c.expectCmd(250, "RSET")
+
+	// BDAT without a transaction.
+	if code := c.bdat(testMsg[20:], true); code != 502 {
+		t.Fatal("Expected 502, got", code)
+	}
+
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+	endp.txnLock.Lock()
+	activeTxns := endp.activeTxns
+	endp.txnLock.Unlock()
+	if activeTxns != 0 {
+		t.Fatal("Transaction is not ended by RSET")
+	}
+}
+
+func TestSMTPDelivery_BDAT_BINARYMIME(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	// Messages are not converted when relayed to servers that do not
+	// support BINARYMIME so it should not be accepted.
+	caps := c.expectCmd(250, "EHLO mx.example.org")
+	if strings.Contains(caps, "BINARYMIME") {
+		t.Fatal("BINARYMIME is advertised:", caps)
+	}
+	c.expectCmd(504, "MAIL FROM:<sender@example.org> BODY=BINARYMIME")
+
+	c.startTxn(" BODY=8BITMIME", "rcpt@example.com")
+	if code := c.bdat("From: <sender@example.org>\r\n\r\nпривет\r\n", true); code != 250 {
+		t.Fatal("Expected 250, got", code)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+)
+
+// go-smtp passes only the connection addresses to the backend, so the
+// per-connection data is attached to the local address of the accepted
+// connection. Listener wrappers and the session access it using
+// connDataOf.
+
+// connLocalAddr is the local address of the accepted connection that carries
+// the per-connection data.
+type connLocalAddr struct {
+	net.Addr
+	data *module.ConnData
+}
+
+// connDataListener attaches the per-connection data to accepted connections
+// and runs the connection-level checks (module.OptionalConnCheck) of the
+// pipeline once per connection.
+type connDataListener struct {
+	net.Listener
+	endp *Endpoint
+}
+
+func (l connDataListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &connDataConn{
+		Conn: conn,
+		endp: l.endp,
+		addr: &connLocalAddr{Addr: conn.LocalAddr(), data: module.NewConnData()},
+	}, nil
+}
+
+type connDataConn struct {
+	net.Conn
+	endp *Endpoint
+	addr *connLocalAddr
+
+	// ConnOpened is called on the first I/O operation instead of Accept so
+	// slow checks do not block the accept loop. It is done by the goroutine
+	// serving the connection before any command is read.
+	openOnce  sync.Once
+	closeOnce sync.Once
+	pipeline  *msgpipeline.MsgPipeline
+	state     module.ConnState
+}
+
+func (c *connDataConn) open() {
+	c.openOnce.Do(func() {
+		c.pipeline = c.endp.currentPipeline()
+		c.state = module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				LocalAddr:  c.addr,
+				RemoteAddr: c.Conn.RemoteAddr(),
+			},
+			Data: c.addr.data,
+		}
+		c.pipeline.RunConnOpened(context.Background(), &c.state)
+
+		// Sessions use the same pipeline even if the configuration is
+		// reloaded meanwhile.
+		c.addr.data.Set(pipelineDataKey{}, c.pipeline)
+	})
+}
+
+func (c *connDataConn) Read(b []byte) (int, error) {
+	c.open()
+	return c.Conn.Read(b)
+}
+
+func (c *connDataConn) Write(b []byte) (int, error) {
+	c.open()
+	return c.Conn.Write(b)
+}
+
+// Close calls ConnClosed if ConnOpened was called. go-smtp ends the session
+// before closing the connection, so all CheckState objects are closed
+// already.
+func (c *connDataConn) Close() error {
+	c.closeOnce.Do(func() {
+		// Prevent ConnOpened calls after the connection is closed.
+		c.openOnce.Do(func() {})
+		if c.pipeline != nil {
+			c.pipeline.RunConnClosed(&c.state)
+		}
+		closeCmdLimiter(c.addr.data)
+	})
+	return c.Conn.Close()
+}
+
+func (c *connDataConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// pipelineDataKey is the per-connection data key for the message pipeline
+// ConnOpened was called for.
+type pipelineDataKey struct{}
+
+// connPipeline returns the message pipeline to use for sessions on the
+// connection.
+func (endp *Endpoint) connPipeline(connData *module.ConnData) *msgpipeline.MsgPipeline {
+	if pipeline, ok := connData.Get(pipelineDataKey{}).(*msgpipeline.MsgPipeline); ok {
+		return pipeline
+	}
+	return endp.currentPipeline()
+}
+
+// connDataOf returns the per-connection data for the connection with the
+// specified local address. nil is returned for connections not accepted by
+// connDataListener.
+func connDataOf(localAddr net.Addr) *module.ConnData {
+	addr, ok := localAddr.(*connLocalAddr)
+	if !ok {
+		return nil
+	}
+	return addr.data
+}
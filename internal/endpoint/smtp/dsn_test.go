@@ -0,0 +1,147 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestSMTPDelivery_DSN(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"rejected@example.com": errors.New("go away"),
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	if caps := c.expectCmd(250, "EHLO mx.example.org"); !strings.Contains(caps, "\nDSN") {
+		t.Error("DSN is not advertised:", caps)
+	}
+
+	c.expectCmd(250, "MAIL FROM:<sender@example.org> RET=hdrs ENVID=QQ+2B1")
+	c.expectCmd(250, "RCPT TO:<rcpt1@EXAMPLE.com> NOTIFY=success,failure ORCPT=rfc822;rcpt1+2Balias@example.com")
+	c.expectCmd(250, "RCPT TO:<rcpt2@example.com> NOTIFY=NEVER")
+	c.expectCmd(250, "RCPT TO:<rcpt3@example.com>")
+	c.expectCmd(554, "RCPT TO:<rejected@example.com> NOTIFY=DELAY")
+	c.expectCmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err := w.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(250)
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	expected := module.DSNOpts{
+		Return: module.DSNReturnHeaders,
+		EnvID:  "QQ+1",
+		Rcpts: map[string]module.DSNRcptOpts{
+			"rcpt1@example.com": {
+				Notify:       []string{module.DSNNotifySuccess, module.DSNNotifyFailure},
+				OriginalRcpt: "rfc822;rcpt1+alias@example.com",
+			},
+			"rcpt2@example.com": {
+				Notify: []string{module.DSNNotifyNever},
+			},
+		},
+	}
+	if !reflect.DeepEqual(msg.MsgMeta.DSN, expected) {
+		t.Errorf("Wrong DSN parameters: %+v", msg.MsgMeta.DSN)
+	}
+	if !msg.MsgMeta.RcptDSN("rcpt3@example.com").ShouldNotify(module.DSNNotifyFailure) {
+		t.Error("Default NOTIFY is not used for rcpt3@example.com")
+	}
+	if msg.MsgMeta.RcptDSN("rcpt2@example.com").ShouldNotify(module.DSNNotifyFailure) {
+		t.Error("NOTIFY=NEVER is ignored for rcpt2@example.com")
+	}
+
+	// Parameters do not leak into the next transaction.
+	c.startTxn("", "rcpt1@example.com")
+	c.expectCmd(354, "DATA")
+	w = c.DotWriter()
+	if _, err := w.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(250)
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+	if dsn := tgt.Messages[1].MsgMeta.DSN; !reflect.DeepEqual(dsn, module.DSNOpts{}) {
+		t.Errorf("Unexpected DSN parameters: %+v", dsn)
+	}
+}
+
+func TestSMTPDelivery_DSN_Rejected(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> RET=BODY")
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> RET=FULL RET=HDRS")
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> ENVID=a+1")
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> ENVID=%s", strings.Repeat("a", 101))
+	c.expectCmd(250, "MAIL FROM:<sender@example.org>")
+	c.expectCmd(501, "RCPT TO:<rcpt@example.com> NOTIFY=NEVER,SUCCESS")
+	c.expectCmd(501, "RCPT TO:<rcpt@example.com> NOTIFY=SOMETIMES")
+	c.expectCmd(501, "RCPT TO:<rcpt@example.com> ORCPT=rcpt@example.com")
+	c.expectCmd(501, "RCPT TO:<rcpt@example.com> ORCPT=rfc822;")
+	c.expectCmd(501, "RCPT TO:<rcpt@example.com> ORCPT=rfc822;a+ZZ")
+}
+
+func TestSMTPDelivery_DSN_Disabled(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "dsn",
+			Args: []string{"false"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	if caps := c.expectCmd(250, "EHLO mx.example.org"); strings.Contains(caps, "DSN") {
+		t.Error("DSN is advertised:", caps)
+	}
+	c.expectCmd(504, "MAIL FROM:<sender@example.org> RET=FULL")
+}
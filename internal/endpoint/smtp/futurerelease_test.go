@@ -0,0 +1,138 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func futureReleaseEndpoint(t *testing.T, tgt module.DeliveryTarget) (*Endpoint, rawClient) {
+	endp := testEndpoint(t, "submission", &module.Dummy{}, tgt, nil, []config.Node{
+		{
+			Name: "insecure_auth",
+			Args: []string{"true"},
+		},
+		{
+			Name: "max_hold_time",
+			Args: []string{"2h"},
+		},
+	})
+
+	c := dialRaw(t)
+	caps := c.expectCmd(250, "EHLO mx.example.org")
+	if !strings.Contains(caps, "\nFUTURERELEASE 7200 ") {
+		t.Error("FUTURERELEASE is not advertised:", caps)
+	}
+	c.expectCmd(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00password")))
+	return endp, c
+}
+
+func (c rawClient) sendMsgOpts(mailArgs string) {
+	c.t.Helper()
+
+	c.startTxn(mailArgs, "rcpt@example.com")
+	c.expectCmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err := w.Write([]byte(testMsg)); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.expect(250)
+}
+
+func TestSMTPDelivery_FutureRelease(t *testing.T) {
+	tgt := testutils.Target{}
+	endp, c := futureReleaseEndpoint(t, &tgt)
+	defer endp.Close()
+	defer c.Close()
+
+	start := time.Now()
+	c.sendMsgOpts(" HOLDFOR=3600")
+	c.sendMsgOpts(" HOLDUNTIL=" + start.Add(90*time.Minute).UTC().Format(time.RFC3339))
+	c.sendMsgOpts(" BODY=8BITMIME")
+	c.sendMsgOpts(" HOLDUNTIL=2000-01-01T00:00:00Z")
+
+	if len(tgt.Messages) != 4 {
+		t.Fatal("Expected 4 messages, got", len(tgt.Messages))
+	}
+
+	checkRelease := func(i int, offset time.Duration) {
+		t.Helper()
+		deliverAfter := tgt.Messages[i].MsgMeta.DeliverAfter
+		if offset == 0 {
+			if !deliverAfter.IsZero() {
+				t.Errorf("Message %d: unexpected release time: %v", i, deliverAfter)
+			}
+			return
+		}
+		expected := start.Add(offset)
+		if deliverAfter.Before(expected.Add(-1*time.Second)) || deliverAfter.After(expected.Add(5*time.Second)) {
+			t.Errorf("Message %d: wrong release time: %v, expected %v", i, deliverAfter, expected)
+		}
+	}
+	checkRelease(0, time.Hour)
+	checkRelease(1, 90*time.Minute)
+	checkRelease(2, 0)
+	checkRelease(3, 0)
+}
+
+func TestSMTPDelivery_FutureRelease_Rejected(t *testing.T) {
+	tgt := testutils.Target{}
+	endp, c := futureReleaseEndpoint(t, &tgt)
+	defer endp.Close()
+	defer c.Close()
+
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> HOLDFOR=7201")
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> HOLDUNTIL=%s", time.Now().Add(3*time.Hour).UTC().Format(time.RFC3339))
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> HOLDFOR=10 HOLDUNTIL=%s", time.Now().UTC().Format(time.RFC3339))
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> HOLDFOR=soon")
+	c.expectCmd(501, "MAIL FROM:<sender@example.org> HOLDUNTIL=tomorrow")
+
+	// Rejected command does not affect the next one.
+	c.sendMsgOpts("")
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if deliverAfter := tgt.Messages[0].MsgMeta.DeliverAfter; !deliverAfter.IsZero() {
+		t.Error("Unexpected release time:", deliverAfter)
+	}
+}
+
+func TestSMTPDelivery_FutureRelease_NotSubmission(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	if caps := c.expectCmd(250, "EHLO mx.example.org"); strings.Contains(caps, "FUTURERELEASE") {
+		t.Error("FUTURERELEASE is advertised:", caps)
+	}
+	c.expectCmd(504, "MAIL FROM:<sender@example.org> HOLDFOR=10")
+}
@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type earlyTalkerAction int
+
+const (
+	earlyTalkerDrop earlyTalkerAction = iota
+	earlyTalkerFlag
+)
+
+func (a earlyTalkerAction) String() string {
+	switch a {
+	case earlyTalkerDrop:
+		return "drop"
+	case earlyTalkerFlag:
+		return "flag"
+	}
+	return "unknown"
+}
+
+func earlyTalkerActionDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument required")
+	}
+	switch node.Args[0] {
+	case "drop":
+		return earlyTalkerDrop, nil
+	case "flag":
+		return earlyTalkerFlag, nil
+	default:
+		return nil, config.NodeErr(node, "unknown action: %s", node.Args[0])
+	}
+}
+
+// greetingListener delays handing accepted connections to the SMTP server
+// (and thus the server greeting) by the configured amount of time and detects
+// clients that send data before the greeting ("early talkers").
+type greetingListener struct {
+	net.Listener
+	endp *Endpoint
+
+	ready     chan net.Conn
+	acceptErr chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newGreetingListener(l net.Listener, endp *Endpoint) *greetingListener {
+	gl := &greetingListener{
+		Listener:  l,
+		endp:      endp,
+		ready:     make(chan net.Conn),
+		acceptErr: make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	go gl.acceptLoop()
+	return gl
+}
+
+func (gl *greetingListener) acceptLoop() {
+	for {
+		conn, err := gl.Listener.Accept()
+		if err != nil {
+			gl.acceptErr <- err
+			return
+		}
+		go gl.delay(conn)
+	}
+}
+
+func (gl *greetingListener) exempt(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets are used by local clients.
+		return true
+	}
+	for _, ipNet := range gl.endp.greetingDelayExempt {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (gl *greetingListener) delay(conn net.Conn) {
+	if gl.exempt(conn.RemoteAddr()) {
+		gl.handOver(conn)
+		return
+	}
+
+	buf := make([]byte, 512)
+	if err := conn.SetReadDeadline(time.Now().Add(gl.endp.greetingDelay)); err != nil {
+		conn.Close()
+		return
+	}
+	n, err := conn.Read(buf)
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+	if n == 0 {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// Client waited for the greeting as it should.
+			gl.handOver(conn)
+			return
+		}
+		// Client disconnected or I/O error.
+		conn.Close()
+		return
+	}
+
+	earlyTalkers.WithLabelValues(gl.endp.name, gl.endp.earlyTalkerAction.String()).Inc()
+	gl.endp.Log.Msg("client sent data before greeting",
+		"src_ip", conn.RemoteAddr(), "action", gl.endp.earlyTalkerAction.String())
+
+	switch gl.endp.earlyTalkerAction {
+	case earlyTalkerDrop:
+		fmt.Fprintf(conn, "554 5.5.0 %s Protocol violation: data sent before greeting\r\n", gl.endp.serv.Domain)
+		conn.Close()
+	case earlyTalkerFlag:
+		connDataOf(conn.LocalAddr()).Set(earlyTalkerDataKey{}, true)
+		gl.handOver(&earlyTalkerConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(buf[:n]), conn),
+		})
+	}
+}
+
+func (gl *greetingListener) handOver(conn net.Conn) {
+	select {
+	case gl.ready <- conn:
+	case <-gl.done:
+		conn.Close()
+	}
+}
+
+func (gl *greetingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-gl.ready:
+		return conn, nil
+	case err := <-gl.acceptErr:
+		return nil, err
+	}
+}
+
+func (gl *greetingListener) Close() error {
+	gl.closeOnce.Do(func() {
+		close(gl.done)
+	})
+	return gl.Listener.Close()
+}
+
+// earlyTalkerConn replays data received before the greeting to the SMTP
+// server.
+type earlyTalkerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *earlyTalkerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// earlyTalkerDataKey is the per-connection data key for the flag set for
+// connections that sent data before the greeting.
+type earlyTalkerDataKey struct{}
+
+func isEarlyTalker(connData *module.ConnData) bool {
+	flagged, _ := connData.Get(earlyTalkerDataKey{}).(bool)
+	return flagged
+}
@@ -0,0 +1,314 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// errSlowData is returned by the DATA reader if the client does not keep up
+// with min_data_rate.
+var errSlowData = &exterrors.SMTPError{
+	Code:         421,
+	EnhancedCode: exterrors.EnhancedCode{4, 4, 2},
+	Message:      "Data transfer is too slow, closing connection",
+}
+
+// sessionGuard wraps client connections to enforce per-session limits
+// (max_errors, max_rcpt_errors, max_session_duration, min_data_rate).
+//
+// The guard is stored in the per-connection data (see conndata.go) so the
+// session can find it. Replies are written by go-smtp and can be encrypted, so to disconnect
+// the client after a reply, the guard closes the connection after the next
+// Write call.
+type sessionGuard struct {
+	net.Conn
+	endp  *Endpoint
+	start time.Time
+
+	lock            sync.Mutex
+	errors          int
+	closeAfterWrite bool
+	forceTimeout    bool
+
+	durationTimer *time.Timer
+	closeOnce     sync.Once
+}
+
+func (endp *Endpoint) guardEnabled() bool {
+	return endp.maxErrors > 0 || endp.maxRcptErrors > 0 ||
+		endp.maxSessionDuration > 0 || endp.minDataRate > 0
+}
+
+type guardDataKey struct{}
+
+// lookupGuard returns the guard for the connection or nil if session limits
+// are not enabled.
+func lookupGuard(connData *module.ConnData) *sessionGuard {
+	g, _ := connData.Get(guardDataKey{}).(*sessionGuard)
+	return g
+}
+
+type guardListener struct {
+	net.Listener
+	endp *Endpoint
+}
+
+func (gl guardListener) Accept() (net.Conn, error) {
+	conn, err := gl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &sessionGuard{
+		Conn:  conn,
+		endp:  gl.endp,
+		start: time.Now(),
+	}
+	if gl.endp.maxSessionDuration > 0 {
+		g.durationTimer = time.AfterFunc(gl.endp.maxSessionDuration, func() {
+			// Clients in the middle of a command are disconnected
+			// without a reply, others get 421 on the next command
+			// (see checkSessionDuration).
+			g.disconnect("session duration limit exceeded")
+			g.Conn.Close()
+		})
+	}
+	connDataOf(conn.LocalAddr()).Set(guardDataKey{}, g)
+	return g, nil
+}
+
+func (g *sessionGuard) Write(b []byte) (int, error) {
+	n, err := g.Conn.Write(b)
+
+	g.lock.Lock()
+	closeNow := g.closeAfterWrite
+	g.lock.Unlock()
+	if closeNow {
+		// go-smtp will notice on the next read and clean up the session.
+		g.Conn.Close()
+	}
+	return n, err
+}
+
+func (g *sessionGuard) SetDeadline(t time.Time) error {
+	if err := g.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return g.Conn.SetWriteDeadline(t)
+}
+
+func (g *sessionGuard) SetReadDeadline(t time.Time) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.forceTimeout {
+		// Keep blocked and future reads failing, go-smtp resets the
+		// deadline before reading each command.
+		t = time.Unix(1, 0)
+	}
+	return g.Conn.SetReadDeadline(t)
+}
+
+func (g *sessionGuard) Close() error {
+	g.closeOnce.Do(func() {
+		if g.durationTimer != nil {
+			g.durationTimer.Stop()
+		}
+	})
+	return g.Conn.Close()
+}
+
+// interruptRead makes all pending and future reads fail with a timeout.
+func (g *sessionGuard) interruptRead() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.forceTimeout = true
+	g.lock.Unlock()
+	g.SetReadDeadline(time.Time{})
+}
+
+// disconnect schedules the connection to be closed after the next reply and
+// logs the reason.
+func (g *sessionGuard) disconnect(reason string, fields ...interface{}) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	if g.closeAfterWrite {
+		g.lock.Unlock()
+		return
+	}
+	g.closeAfterWrite = true
+	errCount := g.errors
+	g.lock.Unlock()
+
+	guardDisconnects.WithLabelValues(g.endp.name, reason).Inc()
+	g.endp.Log.Msg("disconnecting client", append([]interface{}{
+		"reason", reason,
+		"src_ip", g.Conn.RemoteAddr(),
+		"errors", errCount,
+		"session_duration", time.Since(g.start).Round(time.Millisecond).String(),
+	}, fields...)...)
+}
+
+// countError accounts a failed command and returns true if max_errors is
+// exceeded.
+func (g *sessionGuard) countError() bool {
+	if g == nil {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.errors++
+	return g.endp.maxErrors > 0 && g.errors >= g.endp.maxErrors
+}
+
+func (g *sessionGuard) expired() bool {
+	if g == nil || g.endp.maxSessionDuration == 0 {
+		return false
+	}
+	return time.Since(g.start) >= g.endp.maxSessionDuration
+}
+
+// dataReader wraps the message body reader to enforce min_data_rate. The
+// returned function should be called when the body is read.
+func (g *sessionGuard) dataReader(r io.Reader) (io.Reader, func()) {
+	if g == nil || g.endp.minDataRate == 0 {
+		return r, func() {}
+	}
+
+	rr := &rateReader{r: r}
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	go g.watchDataRate(rr, stop)
+	return rr, func() {
+		stopOnce.Do(func() { close(stop) })
+	}
+}
+
+func (g *sessionGuard) watchDataRate(rr *rateReader, stop chan struct{}) {
+	start := time.Now()
+	grace := time.NewTimer(g.endp.minDataRateGrace)
+	defer grace.Stop()
+	select {
+	case <-grace.C:
+	case <-stop:
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		elapsed := time.Since(start)
+		received := atomic.LoadInt64(&rr.n)
+		if float64(received)/elapsed.Seconds() < float64(g.endp.minDataRate) {
+			atomic.StoreInt32(&rr.slow, 1)
+			g.disconnect("data transfer too slow",
+				"bytes", received, "elapsed", elapsed.Round(time.Millisecond).String())
+			g.interruptRead()
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+type rateReader struct {
+	r    io.Reader
+	n    int64
+	slow int32
+}
+
+func (rr *rateReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	atomic.AddInt64(&rr.n, int64(n))
+	if err != nil && atomic.LoadInt32(&rr.slow) == 1 {
+		return n, errSlowData
+	}
+	return n, err
+}
+
+// checkErrBudget accounts the error returned for a command and replaces it
+// with 421 if the session exceeded max_errors.
+func (s *Session) checkErrBudget(err error) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code == 421 {
+		// Already closing.
+		return err
+	}
+	if !s.guard.countError() {
+		return err
+	}
+	s.guard.disconnect("too many errors")
+	return &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many errors, closing connection",
+	}
+}
+
+// checkRcptErr accounts the error returned for RCPT and replaces it with
+// 421 if the transaction exceeded max_rcpt_errors or the session exceeded
+// max_errors.
+func (s *Session) checkRcptErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	s.rcptErrors++
+	if s.endp.maxRcptErrors > 0 && s.rcptErrors >= s.endp.maxRcptErrors {
+		s.guard.disconnect("too many failed recipients", "rcpt_errors", s.rcptErrors)
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many failed recipients, closing connection",
+		}
+	}
+	return s.checkErrBudget(err)
+}
+
+// checkSessionDuration returns an error if the session exceeded
+// max_session_duration.
+func (s *Session) checkSessionDuration() error {
+	if !s.guard.expired() {
+		return nil
+	}
+	s.guard.disconnect("session duration limit exceeded")
+	return &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Session time limit exceeded, closing connection",
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// expectClosed checks that the server closed the connection.
+func (c rawClient) expectClosed() {
+	c.t.Helper()
+
+	if line, err := c.ReadLine(); err == nil {
+		c.t.Fatalf("Expected connection to be closed, got %q", line)
+	}
+}
+
+func TestSMTPGuard_MaxErrors(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_errors",
+			Args: []string{"3"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	// REQUIRETLS is rejected on plaintext connections.
+	c.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c.expectCmd(421, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c.expectClosed()
+}
+
+func TestSMTPGuard_MaxRcptErrors(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"rcpt1@example.com": &exterrors.SMTPError{Code: 550, Message: "No such user"},
+			"rcpt2@example.com": &exterrors.SMTPError{Code: 550, Message: "No such user"},
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_rcpt_errors",
+			Args: []string{"2"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+
+	// Counter is reset for each transaction.
+	c.expectCmd(250, "MAIL FROM:<sender@example.org>")
+	c.expectCmd(550, "RCPT TO:<rcpt1@example.com>")
+	c.expectCmd(250, "RSET")
+	c.expectCmd(250, "MAIL FROM:<sender@example.org>")
+	c.expectCmd(550, "RCPT TO:<rcpt1@example.com>")
+	c.expectCmd(250, "RCPT TO:<rcpt3@example.com>")
+	c.expectCmd(421, "RCPT TO:<rcpt2@example.com>")
+	c.expectClosed()
+}
+
+func TestSMTPGuard_SessionDuration(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_session_duration",
+			Args: []string{"200ms"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	time.Sleep(300 * time.Millisecond)
+	c.expectClosed()
+}
+
+func TestSMTPGuard_MinDataRate(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "min_data_rate",
+			Args: []string{"1K"},
+		},
+		{
+			Name: "min_data_rate_grace",
+			Args: []string{"100ms"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.startTxn("", "rcpt@example.com")
+	c.expectCmd(354, "DATA")
+	if err := c.PrintfLine("From: <sender@example.org>"); err != nil {
+		t.Fatal(err)
+	}
+	// ... and then nothing.
+	c.expect(421)
+	c.expectClosed()
+
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPGuard_MinDataRate_Ok(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "min_data_rate",
+			Args: []string{"1K"},
+		},
+		{
+			Name: "min_data_rate_grace",
+			Args: []string{"100ms"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.startTxn("", "rcpt@example.com")
+	c.expectCmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err := w.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(250)
+
+	// Watchdog should be stopped after DATA.
+	time.Sleep(200 * time.Millisecond)
+	c.expectCmd(250, "NOOP")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPGuard_Disabled(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	if endp.guardEnabled() {
+		t.Fatal("Guard is enabled without limits")
+	}
+
+	var g *sessionGuard
+	if g.countError() || g.expired() {
+		t.Fatal("nil guard should be no-op")
+	}
+	r, stop := g.dataReader(nil)
+	stop()
+	if r != nil {
+		t.Fatal("nil guard should not wrap the reader")
+	}
+	if lookupGuard(nil) != nil {
+		t.Fatal("Guard returned for nil ConnData")
+	}
+}
+
+func TestSMTPGuard_PerConnection(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_errors",
+			Args: []string{"3"},
+		},
+	})
+	defer endp.Close()
+
+	c1 := dialRaw(t)
+	defer c1.Close()
+	c2 := dialRaw(t)
+	defer c2.Close()
+
+	// Errors are counted separately for each connection.
+	c1.expectCmd(250, "EHLO mx.example.org")
+	c2.expectCmd(250, "EHLO mx.example.org")
+	c1.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c2.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c1.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c2.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c1.expectCmd(421, "MAIL FROM:<sender@example.org> REQUIRETLS")
+	c1.expectClosed()
+	c2.expectCmd(250, "MAIL FROM:<sender@example.org>")
+}
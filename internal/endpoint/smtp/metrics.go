@@ -67,6 +67,24 @@ var (
 		},
 		[]string{"module"},
 	)
+	earlyTalkers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp",
+			Name:      "early_talkers",
+			Help:      "Clients that sent data before the server greeting",
+		},
+		[]string{"module", "action"},
+	)
+	guardDisconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp",
+			Name:      "session_limit_disconnects",
+			Help:      "Clients disconnected due to exceeded per-session limits",
+		},
+		[]string{"module", "reason"},
+	)
 	failedCmds = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "maddy",
@@ -83,5 +101,7 @@ func init() {
 	prometheus.MustRegister(completedSMTPTransactions)
 	prometheus.MustRegister(abortedSMTPTransactions)
 	prometheus.MustRegister(ratelimitDefers)
+	prometheus.MustRegister(earlyTalkers)
 	prometheus.MustRegister(failedCmds)
+	prometheus.MustRegister(guardDisconnects)
 }
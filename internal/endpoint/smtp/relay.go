@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// relayIdentity is the synthetic identity assigned to unauthenticated
+// clients from trusted networks (e.g. internal applications that can't use
+// SASL), see the relay_identity directive.
+//
+// Such sessions are treated as authenticated as the identity, but
+// module.ConnState.RelayIdentity is set to tell them apart.
+type relayIdentity struct {
+	identity string
+	nets     []net.IPNet
+}
+
+func (endp *Endpoint) addRelayIdentity(_ *config.Map, node config.Node) error {
+	if len(node.Args) < 2 {
+		return config.NodeErr(node, "usage: relay_identity <identity> <networks...>")
+	}
+	if len(node.Children) != 0 {
+		return config.NodeErr(node, "can't declare a block here")
+	}
+
+	identity := node.Args[0]
+	if strings.ContainsAny(identity, " \t\r\n") {
+		return config.NodeErr(node, "identity can't contain whitespace")
+	}
+	nets, err := config.ParseCIDRs(node.Args[1:])
+	if err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+
+	endp.relayIdentities = append(endp.relayIdentities, relayIdentity{
+		identity: identity,
+		nets:     nets,
+	})
+	return nil
+}
+
+// relayIdentityFor returns the synthetic identity for the client address or
+// an empty string if the address is not in any of the relay_identity
+// networks.
+func (endp *Endpoint) relayIdentityFor(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	for _, r := range endp.relayIdentities {
+		for _, ipNet := range r.nets {
+			if ipNet.Contains(tcpAddr.IP) {
+				return r.identity
+			}
+		}
+	}
+	return ""
+}
+
+// isRelayIdentity reports whether the username is one of the synthetic
+// identities. These are never accepted from the authentication providers
+// to make sure they can't be obtained by anything other than connecting from
+// the trusted network.
+func (endp *Endpoint) isRelayIdentity(username string) bool {
+	for _, r := range endp.relayIdentities {
+		if strings.EqualFold(r.identity, username) {
+			return true
+		}
+	}
+	return false
+}
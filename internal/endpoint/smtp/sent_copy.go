@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	nettextproto "net/textproto"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	specialuse "github.com/emersion/go-imap-specialuse"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// sentCopier saves copies of the submitted messages to the Sent mailbox of
+// the authenticated user.
+//
+// Many clients save the message to Sent using IMAP APPEND on their own,
+// usually after the SMTP transaction completes. To avoid duplicates, the copy
+// is saved only after the dedup window passes and only if there is no
+// message with the same Message-ID in the mailbox.
+type sentCopier struct {
+	store  module.Storage
+	window time.Duration
+	buffer func(io.Reader) (buffer.Buffer, error)
+	log    log.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSentCopier(store module.Storage, window time.Duration, buf func(io.Reader) (buffer.Buffer, error), l log.Logger) *sentCopier {
+	return &sentCopier{
+		store:  store,
+		window: window,
+		buffer: buf,
+		log:    l,
+		stop:   make(chan struct{}),
+	}
+}
+
+// schedule arranges the message to be saved to the Sent mailbox.
+//
+// header and body can be freed once the function returns. Errors are only
+// logged since the SMTP transaction is complete at this point.
+func (sc *sentCopier) schedule(username, msgID string, header textproto.Header, body buffer.Buffer) {
+	msg, err := sc.bufferMsg(header, body)
+	if err != nil {
+		sc.log.Error("failed to buffer the Sent copy", err, "username", username, "msg_id", msgID)
+		return
+	}
+	messageID := header.Get("Message-Id")
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer func() {
+			if err := msg.body.Remove(); err != nil {
+				sc.log.Error("failed to remove buffered Sent copy", err, "msg_id", msgID)
+			}
+		}()
+
+		// On shutdown, save the copy right away instead of losing it.
+		t := time.NewTimer(sc.window)
+		select {
+		case <-t.C:
+		case <-sc.stop:
+			t.Stop()
+		}
+
+		saved, err := sc.save(username, messageID, msg)
+		if err != nil {
+			sc.log.Error("failed to save the Sent copy", err, "username", username, "msg_id", msgID)
+			return
+		}
+		if !saved {
+			sc.log.DebugMsg("client saved the message to Sent itself, skipping", "username", username, "msg_id", msgID)
+			return
+		}
+		sc.log.DebugMsg("saved the Sent copy", "username", username, "msg_id", msgID)
+	}()
+}
+
+// sentMsg is the buffered Sent copy. The header is serialized separately so
+// the body storage can be shared with the delivery instead of copying it.
+type sentMsg struct {
+	header []byte
+	body   buffer.Buffer
+}
+
+func (sc *sentCopier) bufferMsg(header textproto.Header, body buffer.Buffer) (sentMsg, error) {
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return sentMsg{}, err
+	}
+
+	if rc, ok := body.(buffer.RefCounted); ok {
+		return sentMsg{header: hdrBuf.Bytes(), body: rc.Ref()}, nil
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return sentMsg{}, err
+	}
+	defer bodyR.Close()
+	bodyCopy, err := sc.buffer(bodyR)
+	if err != nil {
+		return sentMsg{}, err
+	}
+	return sentMsg{header: hdrBuf.Bytes(), body: bodyCopy}, nil
+}
+
+func (sc *sentCopier) save(username, messageID string, msg sentMsg) (bool, error) {
+	u, err := sc.store.GetIMAPAcct(username)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			sc.log.Error("logout failed", err, "username", username)
+		}
+	}()
+
+	mbox, err := sentMailbox(u)
+	if err != nil {
+		return false, err
+	}
+
+	if messageID != "" {
+		criteria := imap.NewSearchCriteria()
+		criteria.Header = nettextproto.MIMEHeader{"Message-Id": []string{messageID}}
+		ids, err := mbox.SearchMessages(true, criteria)
+		if err != nil {
+			return false, fmt.Errorf("search failed: %w", err)
+		}
+		if len(ids) != 0 {
+			return false, nil
+		}
+	}
+
+	bodyR, err := msg.body.Open()
+	if err != nil {
+		return false, err
+	}
+	defer bodyR.Close()
+
+	r := io.MultiReader(bytes.NewReader(msg.header), bodyR)
+	if err := mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), literal{r, len(msg.header) + msg.body.Len()}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sentMailbox returns the mailbox marked with the \Sent attribute, creating
+// the "Sent" mailbox if there is none.
+func sentMailbox(u imapbackend.User) (imapbackend.Mailbox, error) {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, mbox := range mboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range info.Attributes {
+			if attr == specialuse.Sent {
+				return mbox, nil
+			}
+		}
+	}
+
+	mbox, err := u.GetMailbox("Sent")
+	if err == nil {
+		return mbox, nil
+	}
+
+	// Most likely, the mailbox does not exist. If it is something else,
+	// creation will fail too.
+	if suu, ok := u.(interface {
+		CreateMailboxSpecial(name, specialUseAttr string) error
+	}); ok {
+		err = suu.CreateMailboxSpecial("Sent", specialuse.Sent)
+	} else {
+		err = u.CreateMailbox("Sent")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u.GetMailbox("Sent")
+}
+
+func (sc *sentCopier) close() {
+	close(sc.stop)
+	sc.wg.Wait()
+}
+
+type literal struct {
+	io.Reader
+	len int
+}
+
+func (l literal) Len() int {
+	return l.len
+}
@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// memStorage is a module.Storage using go-imap's in-memory backend that has
+// only one account, "username".
+type memStorage struct {
+	be *memory.Backend
+}
+
+func (ms memStorage) GetOrCreateIMAPAcct(username string) (imapbackend.User, error) {
+	return ms.GetIMAPAcct(username)
+}
+
+func (ms memStorage) GetIMAPAcct(username string) (imapbackend.User, error) {
+	return ms.be.Login(nil, username, "password")
+}
+
+func (ms memStorage) IMAPExtensions() []string {
+	return nil
+}
+
+func sentCopyEndpoint(t *testing.T, tgt module.DeliveryTarget, store module.Storage) *Endpoint {
+	t.Helper()
+
+	endp := testEndpoint(t, "submission", &module.Dummy{}, tgt, nil, nil)
+	endp.sentCopy = newSentCopier(store, 1*time.Minute, buffer.BufferInMemory, testutils.Logger(t, "submission/sent_copy"))
+	return endp
+}
+
+func submitAuthed(t *testing.T, msg string) {
+	t.Helper()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "username", "password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sentMessages(t *testing.T, store module.Storage) []*imap.Message {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	section := &imap.BodySectionName{Peek: true}
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags, section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestSentCopy(t *testing.T) {
+	tgt := testutils.Target{}
+	store := memStorage{be: memory.New()}
+	endp := sentCopyEndpoint(t, &tgt, store)
+
+	submitAuthed(t, testMsg)
+	// Flushes pending copies.
+	endp.Close()
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+
+	msgs := sentMessages(t, store)
+	if len(msgs) != 1 {
+		t.Fatal("Expected a message in Sent, got", len(msgs))
+	}
+	if len(msgs[0].Flags) != 1 || msgs[0].Flags[0] != imap.SeenFlag {
+		t.Error("Wrong flags:", msgs[0].Flags)
+	}
+	for _, literal := range msgs[0].Body {
+		blob, err := ioutil.ReadAll(literal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(blob, []byte("Subject: Hello there!\r\n")) || !bytes.HasSuffix(blob, []byte("\r\n\r\nfoobar\r\n")) {
+			t.Errorf("Wrong message contents: %q", blob)
+		}
+		// Header added by the pipeline should not be there.
+		if bytes.Contains(blob, []byte("Received:")) {
+			t.Errorf("Received field in the Sent copy: %q", blob)
+		}
+	}
+}
+
+func TestSentCopy_ClientAppended(t *testing.T) {
+	tgt := testutils.Target{}
+	store := memStorage{be: memory.New()}
+	endp := sentCopyEndpoint(t, &tgt, store)
+
+	msg := "Message-ID: <test@example.org>\r\n" + testMsg
+	submitAuthed(t, msg)
+
+	// Client saves the message itself after submission.
+	u, err := store.GetIMAPAcct("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Sent"); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	endp.Close()
+
+	if msgs := sentMessages(t, store); len(msgs) != 1 {
+		t.Fatal("Expected only one message in Sent, got", len(msgs))
+	}
+}
+
+type failingStorage struct {
+	memStorage
+}
+
+func (failingStorage) GetIMAPAcct(string) (imapbackend.User, error) {
+	return nil, errors.New("no")
+}
+
+func TestSentCopy_StorageFail(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := sentCopyEndpoint(t, &tgt, failingStorage{})
+
+	// Should not fail.
+	submitAuthed(t, testMsg)
+	endp.Close()
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if !strings.Contains(tgt.Messages[0].Header.Get("Subject"), "Hello there!") {
+		t.Error("Wrong message delivered")
+	}
+}
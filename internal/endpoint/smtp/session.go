@@ -29,6 +29,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -38,10 +39,15 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/sanitize"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
 )
 
 type Session struct {
 	endp *Endpoint
+	// Message pipeline as of the session start, it is not changed by
+	// reload.
+	pipeline *msgpipeline.MsgPipeline
 
 	// Specific for this session.
 	// sessionCtx is not used for cancellation or timeouts, only for tracing.
@@ -50,6 +56,13 @@ type Session struct {
 	connState        module.ConnState
 	repeatedMailErrs int
 	loggedRcptErrors int
+	transactions     int
+	// Failed RCPT commands in the current transaction.
+	rcptErrors int
+	// Set if the transaction is registered using endp.beginTransaction.
+	inTransaction bool
+	// nil if no per-session limits are configured.
+	guard *sessionGuard
 
 	// Specific for the currently handled message.
 	// msgCtx is not used for cancellation or timeouts, only for tracing.
@@ -64,6 +77,7 @@ type Session struct {
 	msgMeta     *module.MsgMetadata
 	delivery    module.Delivery
 	deliveryErr error
+	rcptDomains map[string]struct{}
 
 	log log.Logger
 }
@@ -75,9 +89,19 @@ func (s *Session) Reset() {
 	if s.delivery != nil {
 		s.abort(s.msgCtx)
 	}
+	// Reset is called after the reply for DATA is sent, so the transaction
+	// can be considered complete.
+	s.endTransaction()
 	s.endp.Log.DebugMsg("reset")
 }
 
+func (s *Session) endTransaction() {
+	if s.inTransaction {
+		s.inTransaction = false
+		s.endp.endTransaction()
+	}
+}
+
 func (s *Session) releaseLimits() {
 	_, domain, err := address.Split(s.mailFrom)
 	if err != nil {
@@ -107,6 +131,7 @@ func (s *Session) cleanSession() {
 	s.msgMeta = nil
 	s.delivery = nil
 	s.deliveryErr = nil
+	s.rcptDomains = nil
 	s.msgCtx = nil
 	s.msgTask.End()
 }
@@ -114,11 +139,25 @@ func (s *Session) cleanSession() {
 func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.MailOptions) (string, error) {
 	var err error
 	msgMeta := &module.MsgMetadata{
-		Conn:     &s.connState,
-		SMTPOpts: opts,
+		Conn:         &s.connState,
+		SMTPOpts:     opts,
+		DeliverAfter: opts.ReleaseTime,
+		DSN: module.DSNOpts{
+			Return: string(opts.Return),
+			EnvID:  opts.EnvelopeID,
+		},
 	}
+	s.endp.receivedOpts(msgMeta, &s.connState)
 
-	if s.connState.AuthUser != "" {
+	if s.connState.RelayIdentity {
+		s.log.Msg("incoming message",
+			"src_host", msgMeta.Conn.Hostname,
+			"src_ip", msgMeta.Conn.RemoteAddr.String(),
+			"sender", from,
+			"msg_id", msgMeta.ID,
+			"relay_identity", s.connState.AuthUser,
+		)
+	} else if s.connState.AuthUser != "" {
 		s.log.Msg("incoming message",
 			"src_host", msgMeta.Conn.Hostname,
 			"src_ip", msgMeta.Conn.RemoteAddr.String(),
@@ -137,13 +176,11 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
-	for _, ch := range from {
-		if ch > 128 && !opts.UTF8 {
-			return "", &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
-				Message:      "SMTPUTF8 is required for non-ASCII senders",
-			}
+	if !address.IsASCII(from) && !opts.UTF8 {
+		return "", &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
+			Message:      "SMTPUTF8 is required for non-ASCII senders",
 		}
 	}
 
@@ -188,7 +225,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 
 	startedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
 
-	delivery, err := s.endp.pipeline.Start(mailCtx, msgMeta, cleanFrom)
+	delivery, err := s.pipeline.Start(mailCtx, msgMeta, cleanFrom)
 	if err != nil {
 		s.msgCtx = nil
 		s.msgTask.End()
@@ -202,9 +239,58 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	return msgMeta.ID, nil
 }
 
-func (s *Session) Mail(from string, opts smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts smtp.MailOptions) (err error) {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
+	defer func() { err = s.checkErrBudget(err) }()
+
+	if err := s.checkSessionDuration(); err != nil {
+		return err
+	}
+
+	if s.connState.TLSPolicy == module.TLSPolicyRequired && !s.connState.TLS.HandshakeComplete {
+		s.log.Msg("MAIL rejected on a plaintext connection, tls_required is set", "src_ip", s.connState.RemoteAddr)
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Must issue a STARTTLS command first",
+		}
+	}
+
+	// RFC 8689 Section 4.1: REQUIRETLS is not advertised on unprotected
+	// sessions and it is meaningless to accept it there.
+	if opts.RequireTLS && !s.connState.TLS.HandshakeComplete {
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 10},
+			Message:      "REQUIRETLS can be used only over TLS",
+		}
+	}
+
+	if err := s.checkFQDN(from, true); err != nil {
+		return err
+	}
+
+	if s.endp.maxTransactions > 0 && s.transactions >= s.endp.maxTransactions {
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      "Too many transactions in this session, reconnect to continue",
+		}
+	}
+	// Previous transaction could be not completed if the client sent MAIL
+	// without RSET.
+	s.endTransaction()
+	if !s.endp.beginTransaction() {
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+			Message:      "Server is shutting down, try again later",
+		}
+	}
+	s.inTransaction = true
+	s.transactions++
+	s.rcptErrors = 0
 
 	if !s.endp.deferServerReject {
 		// Will initialize s.msgCtx.
@@ -213,6 +299,7 @@ func (s *Session) Mail(from string, opts smtp.MailOptions) error {
 			if err != context.DeadlineExceeded {
 				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
 			}
+			s.endTransaction()
 			return s.endp.wrapErr(msgID, !opts.UTF8, "MAIL", err)
 		}
 	}
@@ -224,43 +311,19 @@ func (s *Session) Mail(from string, opts smtp.MailOptions) error {
 	return nil
 }
 
-func (s *Session) fetchRDNSName(ctx context.Context) {
-	defer trace.StartRegion(ctx, "rDNS fetch").End()
+func (s *Session) Rcpt(to string, opts smtp.RcptOptions) (err error) {
+	s.msgLock.Lock()
+	defer s.msgLock.Unlock()
+	defer func() { err = s.checkRcptErr(err) }()
 
-	tcpAddr, ok := s.connState.RemoteAddr.(*net.TCPAddr)
-	if !ok {
-		s.connState.RDNSName.Set(nil, nil)
-		return
+	if err := s.checkSessionDuration(); err != nil {
+		return err
 	}
 
-	name, err := dns.LookupAddr(ctx, s.endp.resolver, tcpAddr.IP)
-	if err != nil {
-		dnsErr, ok := err.(*net.DNSError)
-		if ok && dnsErr.IsNotFound {
-			s.connState.RDNSName.Set(nil, nil)
-			return
-		}
-
-		reason, misc := exterrors.UnwrapDNSErr(err)
-		misc["reason"] = reason
-		if !strings.HasSuffix(reason, "canceled") {
-			// Often occurs when transaction completes before rDNS lookup and
-			// rDNS name was not actually needed. So do not log cancelation
-			// error if that's the case.
-
-			s.log.Error("rDNS error", exterrors.WithFields(err, misc), "src_ip", s.connState.RemoteAddr)
-		}
-		s.connState.RDNSName.Set(nil, err)
-		return
+	if err := s.checkFQDN(to, false); err != nil {
+		return err
 	}
 
-	s.connState.RDNSName.Set(name, nil)
-}
-
-func (s *Session) Rcpt(to string) error {
-	s.msgLock.Lock()
-	defer s.msgLock.Unlock()
-
 	// deferServerReject = true and this is the first RCPT TO command.
 	if s.delivery == nil {
 		// If we already attempted to initialize the delivery -
@@ -282,10 +345,15 @@ func (s *Session) Rcpt(to string) error {
 		}
 	}
 
+	rcptDomain, err := s.rcptDomain(to)
+	if err != nil {
+		return err
+	}
+
 	rcptCtx, rcptTask := trace.NewTask(s.msgCtx, "RCPT TO")
 	defer rcptTask.End()
 
-	if err := s.rcpt(rcptCtx, to); err != nil {
+	if err := s.rcpt(rcptCtx, to, opts); err != nil {
 		if s.loggedRcptErrors < s.endp.maxLoggedRcptErrors {
 			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID)
 			s.loggedRcptErrors++
@@ -295,11 +363,45 @@ func (s *Session) Rcpt(to string) error {
 		}
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
 	}
+	if rcptDomain != "" {
+		if s.rcptDomains == nil {
+			s.rcptDomains = make(map[string]struct{})
+		}
+		s.rcptDomains[rcptDomain] = struct{}{}
+	}
 	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID)
 	return nil
 }
 
-func (s *Session) rcpt(ctx context.Context, to string) error {
+// rcptDomain returns the normalized domain of the recipient for purposes of
+// max_rcpt_domains (RCPTDOMAINMAX) enforcement. Error is returned if the
+// recipient would exceed the limit.
+func (s *Session) rcptDomain(to string) (string, error) {
+	if s.endp.maxRcptDomains <= 0 {
+		return "", nil
+	}
+
+	_, domain, err := address.Split(to)
+	if err != nil {
+		// Malformed address, let rcpt report it.
+		return "", nil
+	}
+	domain, _ = dns.ForLookup(domain)
+
+	if _, ok := s.rcptDomains[domain]; ok {
+		return domain, nil
+	}
+	if len(s.rcptDomains) >= s.endp.maxRcptDomains {
+		return "", &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      fmt.Sprintf("Maximum limit of %d recipient domains reached", s.endp.maxRcptDomains),
+		}
+	}
+	return domain, nil
+}
+
+func (s *Session) rcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
 	if !address.IsASCII(to) && !s.opts.UTF8 {
@@ -318,7 +420,37 @@ func (s *Session) rcpt(ctx context.Context, to string) error {
 		}
 	}
 
-	return s.delivery.AddRcpt(ctx, cleanTo)
+	// DSN parameters should be known before AddRcpt since the recipient can
+	// be passed to the next hop immediately.
+	dsn := rcptDSNOpts(opts)
+	hasDSN := len(dsn.Notify) != 0 || dsn.OriginalRcpt != ""
+	if hasDSN {
+		if s.msgMeta.DSN.Rcpts == nil {
+			s.msgMeta.DSN.Rcpts = make(map[string]module.DSNRcptOpts)
+		}
+		s.msgMeta.DSN.Rcpts[cleanTo] = dsn
+	}
+
+	if err := s.delivery.AddRcpt(ctx, cleanTo); err != nil {
+		if hasDSN {
+			delete(s.msgMeta.DSN.Rcpts, cleanTo)
+		}
+		return err
+	}
+	return nil
+}
+
+// rcptDSNOpts converts DSN parameters of the RCPT command into the form
+// stored in the message metadata.
+func rcptDSNOpts(opts smtp.RcptOptions) module.DSNRcptOpts {
+	var dsn module.DSNRcptOpts
+	for _, n := range opts.Notify {
+		dsn.Notify = append(dsn.Notify, string(n))
+	}
+	if opts.OriginalRecipientType != "" {
+		dsn.OriginalRcpt = opts.OriginalRecipientType + ";" + opts.OriginalRecipient
+	}
+	return dsn
 }
 
 func (s *Session) Logout() error {
@@ -332,9 +464,15 @@ func (s *Session) Logout() error {
 			s.log.Msg("MAIL FROM repeated error a lot of times, possible dictonary attack", "count", s.repeatedMailErrs, "src_ip", s.connState.RemoteAddr)
 		}
 	}
+	s.endTransaction()
 	if s.cancelRDNS != nil {
 		s.cancelRDNS()
 	}
+	if s.connState.AuthUser != "" {
+		// STARTTLS ends the session, the client should authenticate again
+		// to use VRFY and EXPN with auth_only.
+		s.connState.Data.Delete(authUserDataKey{})
+	}
 	return nil
 }
 
@@ -352,25 +490,93 @@ func (s *Session) prepareBody(ctx context.Context, r io.Reader) (textproto.Heade
 		}
 	}
 
-	buf, err := s.endp.buffer(bufr)
+	var stream module.BodyStream
+	if sd, ok := s.delivery.(module.StreamingDelivery); ok {
+		stream, err = sd.StreamBody(ctx, header)
+		if err != nil {
+			return textproto.Header{}, nil, err
+		}
+	}
+	if stream == nil {
+		buf, err := s.endp.buffer(bufr)
+		if err != nil {
+			return textproto.Header{}, nil, fmt.Errorf("I/O error while writing buffer: %w", err)
+		}
+		return header, buf, nil
+	}
+
+	sr := &streamReader{r: bufr, stream: stream}
+	buf, err := s.endp.buffer(sr)
 	if err != nil {
+		stream.Abort(err)
+		if sr.rejectErr != nil {
+			return textproto.Header{}, nil, sr.rejectErr
+		}
 		return textproto.Header{}, nil, fmt.Errorf("I/O error while writing buffer: %w", err)
 	}
+	if err := stream.Close(); err != nil {
+		if err := buf.Remove(); err != nil {
+			s.log.Error("failed to remove buffered body", err)
+		}
+		return textproto.Header{}, nil, err
+	}
 
 	return header, buf, nil
 }
 
-func (s *Session) Data(r io.Reader) error {
+// streamReader passes the body to the BodyStream as it is read for
+// buffering.
+//
+// If the message is rejected by the stream, reading stops and the rejection
+// is saved in rejectErr.
+type streamReader struct {
+	r         io.Reader
+	stream    module.BodyStream
+	rejectErr error
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n != 0 {
+		if _, werr := sr.stream.Write(p[:n]); werr != nil {
+			sr.rejectErr = werr
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+func (s *Session) wrapDataErr(err error) error {
+	switch {
+	case errors.Is(err, smtp.ErrDataReset):
+		// The client sent RSET or disconnected in the middle of a BDAT
+		// transfer. That is a normal way to abort a transaction and not
+		// something worth an error log entry.
+		s.log.DebugMsg("BDAT transfer aborted", "msg_id", s.msgMeta.ID)
+	case errors.Is(err, errSlowData):
+		// Already logged by sessionGuard.
+	default:
+		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+	}
+	return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
+}
+
+// Data is called by go-smtp for both DATA and BDAT (CHUNKING). In the
+// latter case, r returns the contents of all chunks in order and the message
+// size limit is checked by go-smtp for each chunk before it is read, so an
+// oversized message is rejected without buffering it entirely.
+func (s *Session) Data(r io.Reader) (err error) {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
+	defer func() { err = s.checkErrBudget(err) }()
+
+	r, stopRateCheck := s.guard.dataReader(r)
+	defer stopRateCheck()
 
 	bodyCtx, bodyTask := trace.NewTask(s.msgCtx, "DATA")
 	defer bodyTask.End()
 
-	wrapErr := func(err error) error {
-		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
-	}
+	wrapErr := s.wrapDataErr
 
 	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
@@ -389,8 +595,12 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
-	if strings.EqualFold(header.Get("TLS-Required"), "No") {
-		s.msgMeta.TLSRequireOverride = true
+	s.checkTLSRequired(header)
+
+	// Pipeline may modify the header, keep the original for the Sent copy.
+	var sentHeader textproto.Header
+	if s.endp.sentCopy != nil && s.connState.AuthUser != "" && !s.connState.RelayIdentity {
+		sentHeader = header.Copy()
 	}
 
 	if err := s.delivery.Body(bodyCtx, header, buf); err != nil {
@@ -403,6 +613,10 @@ func (s *Session) Data(r io.Reader) error {
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
+	if s.endp.sentCopy != nil && s.connState.AuthUser != "" && !s.connState.RelayIdentity {
+		s.endp.sentCopy.schedule(s.connState.AuthUser, s.msgMeta.ID, sentHeader, buf)
+	}
+
 	return nil
 }
 
@@ -415,17 +629,18 @@ func (sw statusWrapper) SetStatus(rcpt string, err error) {
 	sw.sc.SetStatus(rcpt, sw.s.endp.wrapErr(sw.s.msgMeta.ID, !sw.s.opts.UTF8, "DATA", err))
 }
 
-func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
+func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) (err error) {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
+	defer func() { err = s.checkErrBudget(err) }()
+
+	r, stopRateCheck := s.guard.dataReader(r)
+	defer stopRateCheck()
 
 	bodyCtx, bodyTask := trace.NewTask(s.msgCtx, "DATA")
 	defer bodyTask.End()
 
-	wrapErr := func(err error) error {
-		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
-	}
+	wrapErr := s.wrapDataErr
 
 	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
@@ -440,9 +655,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		s.cleanSession()
 	}()
 
-	if strings.EqualFold(header.Get("TLS-Required"), "No") {
-		s.msgMeta.TLSRequireOverride = true
-	}
+	s.checkTLSRequired(header)
 
 	if err := s.checkRoutingLoops(header); err != nil {
 		return wrapErr(err)
@@ -461,6 +674,18 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 	return nil
 }
 
+// checkTLSRequired sets the TLSRequireOverride flag if the message contains
+// "TLS-Required: No" header field (RFC 8689 Section 5). The field is ignored
+// if REQUIRETLS is used for the message.
+func (s *Session) checkTLSRequired(header textproto.Header) {
+	if s.opts.RequireTLS {
+		return
+	}
+	if strings.EqualFold(strings.TrimSpace(header.Get("TLS-Required")), "No") {
+		s.msgMeta.TLSRequireOverride = true
+	}
+}
+
 func (s *Session) checkRoutingLoops(header textproto.Header) error {
 	// RFC 5321 Section 6.3:
 	// >Simple counting of the number of "Received:" header fields in a
@@ -528,6 +753,10 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 		res.Message = smtpErr.Message
 	}
 
+	// Message text may include values provided by the client or remote
+	// servers, make sure it can't be used to inject additional reply lines.
+	res.Message = sanitize.ReplyText(res.Message)
+
 	if msgId != "" {
 		res.Message += " (msg ID = " + msgId + ")"
 	}
@@ -543,7 +772,7 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 		b := strings.Builder{}
 		b.Grow(len(res.Message))
 		for _, ch := range res.Message {
-			if ch > 128 {
+			if ch >= utf8.RuneSelf {
 				b.WriteRune('?')
 			} else {
 				b.WriteRune(ch)
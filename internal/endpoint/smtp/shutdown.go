@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtp
+
+import (
+	"time"
+)
+
+// Graceful shutdown.
+//
+// When the endpoint is closed, listeners are closed first so no new
+// connections are accepted. Sessions that try to start a new transaction get
+// the 421 reply and running transactions are allowed to complete (including
+// sending the final reply to the client) before connections are closed. This
+// avoids duplicates caused by the client retrying the message that was
+// actually accepted. The waiting is limited by shutdown_timeout.
+
+// beginTransaction registers the transaction started by the session. It
+// returns false if the endpoint is being closed.
+func (endp *Endpoint) beginTransaction() bool {
+	endp.txnLock.Lock()
+	defer endp.txnLock.Unlock()
+
+	if endp.closing {
+		return false
+	}
+	endp.activeTxns++
+	return true
+}
+
+func (endp *Endpoint) endTransaction() {
+	endp.txnLock.Lock()
+	defer endp.txnLock.Unlock()
+
+	endp.activeTxns--
+	if endp.closing && endp.activeTxns == 0 {
+		close(endp.txnsDone)
+	}
+}
+
+// isClosing reports whether the endpoint is being closed.
+func (endp *Endpoint) isClosing() bool {
+	endp.txnLock.Lock()
+	defer endp.txnLock.Unlock()
+	return endp.closing
+}
+
+// drain prevents new transactions from being started and waits for running
+// ones to complete.
+func (endp *Endpoint) drain() {
+	endp.txnLock.Lock()
+	endp.closing = true
+	active := endp.activeTxns
+	if active == 0 {
+		close(endp.txnsDone)
+	}
+	endp.txnLock.Unlock()
+
+	if active != 0 {
+		endp.Log.Printf("waiting for %d transactions to complete", active)
+	}
+
+	var timeout <-chan time.Time
+	if endp.shutdownTimeout != 0 {
+		timer := time.NewTimer(endp.shutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-endp.txnsDone:
+	case <-timeout:
+		endp.txnLock.Lock()
+		active = endp.activeTxns
+		endp.txnLock.Unlock()
+		endp.Log.Printf("%d transactions are still in progress after %v, closing connections", active, endp.shutdownTimeout)
+	}
+}
@@ -19,15 +19,16 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/trace"
 	"strings"
 	"sync"
 	"time"
@@ -44,8 +45,10 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/connlimit"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
 	"golang.org/x/net/idna"
 )
 
@@ -55,10 +58,17 @@ type Endpoint struct {
 	name      string
 	addrs     []string
 	listeners []net.Listener
-	pipeline  *msgpipeline.MsgPipeline
 	resolver  dns.Resolver
 	limits    *limits.Group
 
+	// Message pipeline used for new connections, replaced on reload. See
+	// currentPipeline.
+	pipeline    *msgpipeline.MsgPipeline
+	pipelineLck sync.RWMutex
+	// Configuration directives other than the message pipeline ones, used
+	// to detect changes that require restart on reload.
+	ownCfg []config.Node
+
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
 	authAlwaysRequired  bool
@@ -68,8 +78,61 @@ type Endpoint struct {
 	maxLoggedRcptErrors int
 	maxReceived         int
 
+	// RFC 9422 limits, RCPTMAX is stored in serv.MaxRecipients.
+	maxTransactions int
+	maxRcptDomains  int
+
+	proxyProtocol *proxy_protocol.ProxyProtocol
+	connLimits    *connlimit.Limits
+
+	tlsRequired       bool
+	tlsRequiredExempt []net.IPNet
+
+	xclientTrusted []net.IPNet
+
+	// VRFY and EXPN handling, see vrfy.go.
+	vrfyPolicy  string
+	expnPolicy  string
+	expnAliases module.Table
+	cmdRate     cmdRate
+
+	relayIdentities []relayIdentity
+
+	// Received header field contents, see receivedOpts.
+	receivedHideClient string
+	receivedTLS        bool
+	receivedAuthUser   bool
+	receivedSkip       []net.IPNet
+
+	greetingDelay       time.Duration
+	greetingDelayExempt []net.IPNet
+	earlyTalkerAction   earlyTalkerAction
+
+	// Per-session limits, see guard.go.
+	maxErrors          int
+	maxRcptErrors      int
+	maxSessionDuration time.Duration
+	minDataRate        int
+	minDataRateGrace   time.Duration
+
+	// Submission (MSA) restrictions and header fixups, see submission.go.
+	requireFQDN  bool
+	senderTable  module.Table
+	addMessageID bool
+	addDate      bool
+	completeFrom bool
+
+	sentCopy *sentCopier
+
 	listenersWg sync.WaitGroup
 
+	// Transactions in progress, see shutdown.go.
+	shutdownTimeout time.Duration
+	txnLock         sync.Mutex
+	activeTxns      int
+	closing         bool
+	txnsDone        chan struct{}
+
 	Log log.Logger
 }
 
@@ -89,9 +152,11 @@ func New(modName string, addrs []string) (module.Module, error) {
 		lmtp:       modName == "lmtp",
 		resolver:   dns.DefaultResolver(),
 		buffer:     buffer.BufferInMemory,
+		txnsDone:   make(chan struct{}),
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:     log.Logger{Name: modName + "/sasl"},
+			Service: module.ServiceSMTP,
 		},
 	}
 	return endp, nil
@@ -117,11 +182,13 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		addresses = append(addresses, saddr)
 	}
 
-	if err := endp.setupListeners(addresses); err != nil {
-		for _, l := range endp.listeners {
-			l.Close()
+	if !config.CheckOnly {
+		if err := endp.setupListeners(addresses); err != nil {
+			for _, l := range endp.listeners {
+				l.Close()
+			}
+			return err
 		}
-		return err
 	}
 
 	allLocal := true
@@ -147,34 +214,17 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 func autoBufferMode(maxSize int, dir string) func(io.Reader) (buffer.Buffer, error) {
 	return func(r io.Reader) (buffer.Buffer, error) {
-		// First try to read up to N bytes.
-		initial := make([]byte, maxSize)
-		actualSize, err := io.ReadFull(r, initial)
-		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got EOF)")
-				return buffer.MemoryBuffer{Slice: initial[:actualSize]}, nil
-			}
-			if err == io.EOF {
-				// Special case: message with empty body.
-				return buffer.MemoryBuffer{}, nil
-			}
-			// Some I/O error happened, bail out.
-			return nil, err
-		}
-		if actualSize < maxSize {
-			// Ok, the message is smaller than N. Make a MemoryBuffer and
-			// handle it in RAM.
-			log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got short read)")
-			return buffer.MemoryBuffer{Slice: initial[:actualSize]}, nil
-		}
+		// SpillBuffer is reference-counted so targets that need the body
+		// after the delivery (e.g. sent copies) can share it.
+		return buffer.BufferSpill(r, maxSize, dir)
+	}
+}
 
-		log.Debugln("autobuffer: spilling the message to the FS")
-		// The message is big. Dump what we got to the disk and continue writing it there.
-		return buffer.BufferInFile(
-			io.MultiReader(bytes.NewReader(initial[:actualSize]), r),
-			dir)
+func makeBufferDir(path string) error {
+	if config.CheckOnly {
+		return nil
 	}
+	return os.MkdirAll(path, 0700)
 }
 
 func bufferModeDirective(m *config.Map, node config.Node) (interface{}, error) {
@@ -189,7 +239,7 @@ func bufferModeDirective(m *config.Map, node config.Node) (interface{}, error) {
 		return buffer.BufferInMemory, nil
 	case "fs":
 		path := filepath.Join(config.StateDirectory, "buffer")
-		if err := os.MkdirAll(path, 0700); err != nil {
+		if err := makeBufferDir(path); err != nil {
 			return nil, err
 		}
 		switch len(node.Args) {
@@ -205,7 +255,7 @@ func bufferModeDirective(m *config.Map, node config.Node) (interface{}, error) {
 		}
 	case "auto":
 		path := filepath.Join(config.StateDirectory, "buffer")
-		if err := os.MkdirAll(path, 0700); err != nil {
+		if err := makeBufferDir(path); err != nil {
 			return nil, err
 		}
 
@@ -233,33 +283,76 @@ func bufferModeDirective(m *config.Map, node config.Node) (interface{}, error) {
 
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		hostname string
-		err      error
-		ioDebug  bool
+		hostname       string
+		err            error
+		ioDebug        bool
+		sentCopyStore  module.Storage
+		sentCopyWindow time.Duration
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("auth_throttle", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetThrottle(m, node)
+	})
 	cfg.String("hostname", true, true, "", &hostname)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
 	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
 	cfg.Int("max_recipients", false, false, 20000, &endp.serv.MaxRecipients)
 	cfg.Int("max_received", false, false, 50, &endp.maxReceived)
+	cfg.Int("max_transactions", false, false, 0, &endp.maxTransactions)
+	cfg.Int("max_rcpt_domains", false, false, 0, &endp.maxRcptDomains)
+	cfg.Duration("greeting_delay", false, false, 0, &endp.greetingDelay)
+	cfg.Duration("shutdown_timeout", true, false, 30*time.Second, &endp.shutdownTimeout)
+	cfg.CIDRList("greeting_delay_exempt", false, false, []string{"127.0.0.0/8", "::1/128"}, &endp.greetingDelayExempt)
+	cfg.Custom("early_talker_action", false, false, func() (interface{}, error) {
+		return earlyTalkerDrop, nil
+	}, earlyTalkerActionDirective, &endp.earlyTalkerAction)
 	cfg.Custom("buffer", false, false, func() (interface{}, error) {
 		path := filepath.Join(config.StateDirectory, "buffer")
-		if err := os.MkdirAll(path, 0700); err != nil {
+		if err := makeBufferDir(path); err != nil {
 			return nil, err
 		}
 		return autoBufferMode(1*1024*1024 /* 1 MiB */, path), nil
 	}, bufferModeDirective, &endp.buffer)
 	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.serv.TLSConfig)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Custom("connection_limits", false, false, nil, connlimit.LimitsDirective, &endp.connLimits)
 	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
+	cfg.Bool("tls_required", false, false, &endp.tlsRequired)
+	cfg.CIDRList("tls_required_exempt", false, false, nil, &endp.tlsRequiredExempt)
+	// Addresses of submission clients are internal details of the sender
+	// organization and are not revealed by default.
+	defaultReceivedHide := receivedHideNever
+	if endp.submission {
+		defaultReceivedHide = receivedHideAlways
+	}
+	cfg.Enum("received_hide_client", false, false,
+		[]string{receivedHideNever, receivedHideAuthenticated, receivedHideAlways},
+		defaultReceivedHide, &endp.receivedHideClient)
+	cfg.Bool("received_tls", false, false, &endp.receivedTLS)
+	cfg.Bool("received_auth_user", false, false, &endp.receivedAuthUser)
+	cfg.CIDRList("received_skip", false, false, nil, &endp.receivedSkip)
+	cfg.CIDRList("xclient_trusted", false, false, nil, &endp.xclientTrusted)
+	cfg.Enum("vrfy", false, false, []string{cmdDisabled, cmdEnabled, cmdAuthOnly}, cmdDisabled, &endp.vrfyPolicy)
+	cfg.Enum("expn", false, false, []string{cmdDisabled, cmdEnabled, cmdAuthOnly}, cmdDisabled, &endp.expnPolicy)
+	cfg.Custom("expn_aliases", false, false, nil, modconfig.TableDirective, &endp.expnAliases)
+	cfg.Custom("vrfy_expn_rate", false, false, func() (interface{}, error) {
+		return cmdRate{burst: 5, period: 1 * time.Minute}, nil
+	}, cmdRateDirective, &endp.cmdRate)
+	cfg.Bool("dsn", false, !endp.lmtp, &endp.serv.EnableDSN)
+	cfg.Callback("relay_identity", endp.addRelayIdentity)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
 	cfg.Int("max_logged_rcpt_errors", false, false, 5, &endp.maxLoggedRcptErrors)
+	cfg.Int("max_errors", false, false, 0, &endp.maxErrors)
+	cfg.Int("max_rcpt_errors", false, false, 0, &endp.maxRcptErrors)
+	cfg.Duration("max_session_duration", false, false, 0, &endp.maxSessionDuration)
+	cfg.DataSize("min_data_rate", false, false, 0, &endp.minDataRate)
+	cfg.Duration("min_data_rate_grace", false, false, 30*time.Second, &endp.minDataRateGrace)
 	cfg.Custom("limits", false, false, func() (interface{}, error) {
 		return &limits.Group{}, nil
 	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
@@ -269,33 +362,64 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &endp.limits)
+	if endp.submission {
+		cfg.Bool("require_auth", false, true, &endp.authAlwaysRequired)
+		cfg.Bool("require_fqdn", false, true, &endp.requireFQDN)
+		cfg.Custom("sender_table", false, false, nil, modconfig.TableDirective, &endp.senderTable)
+		cfg.Bool("add_message_id", false, true, &endp.addMessageID)
+		cfg.Bool("add_date", false, true, &endp.addDate)
+		cfg.Bool("complete_from", false, true, &endp.completeFrom)
+		// FUTURERELEASE (RFC 4865) is handled by go-smtp, the queue
+		// enforces the release time, see MsgMetadata.DeliverAfter.
+		cfg.Duration("max_hold_time", false, false, 7*24*time.Hour, &endp.serv.MaxHoldTime)
+	}
+	cfg.Custom("sent_copy", false, false, nil, modconfig.StorageDirective, &sentCopyStore)
+	cfg.Duration("sent_copy_window", false, false, 1*time.Minute, &sentCopyWindow)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	if len(endp.xclientTrusted) != 0 {
+		endp.serv.XClientTrusted = endp.isXClientTrusted
+	}
+	if len(endp.tlsRequiredExempt) != 0 && !endp.tlsRequired {
+		return fmt.Errorf("%s: tls_required_exempt is used without tls_required", endp.name)
+	}
+	if endp.expnPolicy != cmdDisabled && endp.expnAliases == nil {
+		return fmt.Errorf("%s: expn_aliases is required to use EXPN", endp.name)
+	}
+	if endp.lmtp && (endp.vrfyPolicy != cmdDisabled || endp.expnPolicy != cmdDisabled) {
+		return fmt.Errorf("%s: VRFY and EXPN can't be enabled for LMTP", endp.name)
+	}
+	if endp.lmtp && endp.serv.EnableDSN {
+		return fmt.Errorf("%s: DSN can't be enabled for LMTP", endp.name)
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
 	if err != nil {
 		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", endp.name, err)
 	}
 
-	endp.pipeline, err = msgpipeline.New(cfg.Globals, unknown)
+	if sentCopyStore != nil {
+		if endp.lmtp {
+			return fmt.Errorf("%s: sent_copy can't be used with LMTP", endp.name)
+		}
+		endp.sentCopy = newSentCopier(sentCopyStore, sentCopyWindow, endp.buffer,
+			log.Logger{Name: endp.name + "/sent_copy", Debug: endp.Log.Debug})
+	}
+
+	endp.pipeline, err = endp.newPipeline(cfg.Globals, unknown)
 	if err != nil {
 		return err
 	}
-	endp.pipeline.Hostname = endp.serv.Domain
-	endp.pipeline.Resolver = endp.resolver
-	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
-	endp.pipeline.FirstPipeline = true
+	endp.ownCfg, _ = splitDirectives(cfg.Block.Children)
 
 	endp.serv.AuthDisabled = len(endp.saslAuth.SASLMechanisms()) == 0
-	if endp.submission {
-		endp.authAlwaysRequired = true
-		if len(endp.saslAuth.SASLMechanisms()) == 0 {
-			return fmt.Errorf("%s: auth. provider must be set for submission endpoint", endp.name)
-		}
+	if endp.authAlwaysRequired && len(endp.saslAuth.SASLMechanisms()) == 0 {
+		return fmt.Errorf("%s: auth. provider must be set if require_auth is used", endp.name)
 	}
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		// The code below lacks handling to set AuthPassword. Don't
@@ -303,19 +427,29 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		if mech == sasl.Plain {
 			continue
 		}
+		// AUTH is advertised only over TLS unless insecure_auth is used,
+		// there is no way to hide specific mechanisms.
+		if auth.IsBearerMech(mech) && (endp.serv.AllowInsecureAuth || endp.serv.TLSConfig == nil) {
+			endp.Log.Msg("bearer token authentication is disabled since authentication over unencrypted connections is allowed", "mech", mech)
+			continue
+		}
 
 		mech := mech
 
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
 			state := c.State()
-			if err := endp.pipeline.RunEarlyChecks(context.TODO(), &state); err != nil {
+			if err := endp.connPipeline(connDataOf(state.LocalAddr)).RunEarlyChecks(context.TODO(), &state); err != nil {
 				return auth.FailingSASLServ{Err: endp.wrapErr("", true, "AUTH", err)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, state.RemoteAddr, func(id string) error {
+			return saslServer{endp.saslAuth.CreateSASL(mech, state.RemoteAddr, func(id string) error {
+				if endp.isRelayIdentity(id) {
+					endp.Log.Msg("relay identity used for authentication", "username", id, "src_ip", state.RemoteAddr)
+					return auth.ErrInvalidCredentials
+				}
 				c.SetSession(endp.newSession(false, id, "", &state))
 				return nil
-			})
+			})}
 		})
 	}
 
@@ -327,6 +461,64 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	return nil
 }
 
+// splitDirectives separates directives handled by the endpoint itself from
+// the message pipeline configuration without processing them.
+func splitDirectives(block []config.Node) (own, pipeline []config.Node) {
+	for _, node := range block {
+		if msgpipeline.IsRootDirective(node.Name) {
+			pipeline = append(pipeline, node)
+			continue
+		}
+		own = append(own, node)
+	}
+	return own, pipeline
+}
+
+func (endp *Endpoint) newPipeline(globals map[string]interface{}, cfg []config.Node) (*msgpipeline.MsgPipeline, error) {
+	pipeline, err := msgpipeline.New(globals, cfg)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.Hostname = endp.serv.Domain
+	pipeline.Resolver = endp.resolver
+	pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
+	pipeline.FirstPipeline = true
+	return pipeline, nil
+}
+
+func (endp *Endpoint) currentPipeline() *msgpipeline.MsgPipeline {
+	endp.pipelineLck.RLock()
+	defer endp.pipelineLck.RUnlock()
+	return endp.pipeline
+}
+
+// Reload implements module.ReloadModule.
+//
+// Only the message pipeline (checks, modifiers, source and destination
+// rules) can be changed without the restart. Connections accepted before the
+// reload continue to use the old configuration.
+func (endp *Endpoint) Reload(cfg *config.Map) (func(), error) {
+	// Changed endpoint directives require the restart anyway, so the
+	// pipeline is not created in this case.
+	own, pipelineCfg := splitDirectives(cfg.Block.Children)
+	if !config.NodesEqual(endp.ownCfg, own) {
+		return nil, fmt.Errorf("%s: %w to directives other than the message pipeline", endp.name, module.ErrRestartRequired)
+	}
+
+	// Inline modules of the partially created pipeline are closed by
+	// msgpipeline.New on failure.
+	pipeline, err := endp.newPipeline(cfg.Globals, pipelineCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		endp.pipelineLck.Lock()
+		defer endp.pipelineLck.Unlock()
+		endp.pipeline = pipeline
+	}, nil
+}
+
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
 		var l net.Listener
@@ -337,11 +529,36 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		// PROXY protocol header is sent before the TLS handshake.
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
+		}
+
+		// Should go before other wrappers since they use the
+		// per-connection data.
+		l = connDataListener{Listener: l, endp: endp}
+
+		if endp.connLimits != nil {
+			reply := "421 4.7.0 %s\r\n"
+			if addr.IsTLS() {
+				reply = ""
+			}
+			l = connlimit.NewListener(l, endp.connLimits, reply, endp.Log)
+		}
+
+		if endp.guardEnabled() {
+			l = guardListener{Listener: l, endp: endp}
+		}
+
 		if addr.IsTLS() {
 			if endp.serv.TLSConfig == nil {
 				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
 			}
 			l = tls.NewListener(l, endp.serv.TLSConfig)
+		} else if endp.greetingDelay != 0 && !endp.submission && !endp.lmtp {
+			// Clients are expected to talk first with Implicit TLS, so the
+			// delay is not applicable.
+			l = newGreetingListener(l, endp)
 		}
 
 		endp.listeners = append(endp.listeners, l)
@@ -349,7 +566,8 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		endp.listenersWg.Add(1)
 		addr := addr
 		go func() {
-			if err := endp.serv.Serve(l); err != nil {
+			// Listeners are closed before the server on shutdown.
+			if err := endp.serv.Serve(l); err != nil && !endp.isClosing() {
 				endp.Log.Printf("failed to serve %s: %s", addr, err)
 			}
 			endp.listenersWg.Done()
@@ -365,16 +583,22 @@ func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password stri
 	}
 
 	// Executed before authentication and session initialization.
-	if err := endp.pipeline.RunEarlyChecks(context.TODO(), state); err != nil {
+	if err := endp.connPipeline(connDataOf(state.LocalAddr)).RunEarlyChecks(context.TODO(), state); err != nil {
 		return nil, endp.wrapErr("", true, "AUTH", err)
 	}
 
-	err := endp.saslAuth.AuthPlain(username, password)
+	canonical, err := endp.saslAuth.AuthPlainFrom(state.RemoteAddr, username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", state.RemoteAddr)
 
 		failedLogins.WithLabelValues(endp.name).Inc()
 
+		if errors.Is(err, auth.ErrTooManyFailures) {
+			if guard := lookupGuard(connDataOf(state.LocalAddr)); guard != nil {
+				guard.disconnect("too many authentication failures")
+			}
+			return nil, errTooManyAuthFailures
+		}
 		if exterrors.IsTemporary(err) {
 			return nil, &smtp.SMTPError{
 				Code:         454,
@@ -383,6 +607,15 @@ func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password stri
 			}
 		}
 
+		if guard := lookupGuard(connDataOf(state.LocalAddr)); guard.countError() {
+			guard.disconnect("too many errors")
+			return nil, &smtp.SMTPError{
+				Code:         421,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      "Too many errors, closing connection",
+			}
+		}
+
 		return nil, &smtp.SMTPError{
 			Code:         535,
 			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
@@ -390,16 +623,75 @@ func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password stri
 		}
 	}
 
-	return endp.newSession(false, username, password, state), nil
+	if endp.isRelayIdentity(canonical) {
+		endp.Log.Msg("relay identity used for authentication", "username", canonical, "src_ip", state.RemoteAddr)
+		return nil, &smtp.SMTPError{
+			Code:         535,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Invalid credentials",
+		}
+	}
+
+	return endp.newSession(false, canonical, password, state), nil
+}
+
+var errTooManyAuthFailures = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many authentication failures, try again later",
+}
+
+// saslServer converts errors returned by sasl.Server implementations
+// created using auth.SASLAuth into SMTP replies.
+type saslServer struct {
+	sasl.Server
+}
+
+func (s saslServer) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := s.Server.Next(response)
+	switch err {
+	case auth.ErrInvalidCredentials:
+		err = &smtp.SMTPError{
+			Code:         535,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Invalid credentials",
+		}
+	case auth.ErrTemporaryFailure:
+		err = &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Temporary authentication failure",
+		}
+	case auth.ErrTooManyFailures:
+		err = errTooManyAuthFailures
+	}
+	return challenge, done, err
 }
 
 func (endp *Endpoint) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if state.XClient != nil && state.XClient.Login != "" {
+		// Client was authenticated by the trusted upstream MTA.
+		if err := endp.connPipeline(connDataOf(state.LocalAddr)).RunEarlyChecks(context.TODO(), state); err != nil {
+			return nil, endp.wrapErr("", true, "MAIL", err)
+		}
+		return endp.newSession(false, state.XClient.Login, "", state), nil
+	}
+
+	if identity := endp.relayIdentityFor(state.RemoteAddr); identity != "" {
+		if err := endp.connPipeline(connDataOf(state.LocalAddr)).RunEarlyChecks(context.TODO(), state); err != nil {
+			return nil, endp.wrapErr("", true, "MAIL", err)
+		}
+		s := endp.newSession(false, identity, "", state).(*Session)
+		s.connState.RelayIdentity = true
+		return s, nil
+	}
+
 	if endp.authAlwaysRequired {
 		return nil, smtp.ErrAuthRequired
 	}
 
 	// Executed before authentication and session initialization.
-	if err := endp.pipeline.RunEarlyChecks(context.TODO(), state); err != nil {
+	if err := endp.connPipeline(connDataOf(state.LocalAddr)).RunEarlyChecks(context.TODO(), state); err != nil {
 		return nil, endp.wrapErr("", true, "MAIL", err)
 	}
 
@@ -408,41 +700,175 @@ func (endp *Endpoint) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session,
 
 func (endp *Endpoint) newSession(anonymous bool, username, password string, state *smtp.ConnectionState) smtp.Session {
 	s := &Session{
-		endp: endp,
-		log:  endp.Log,
-		connState: module.ConnState{
-			ConnectionState: *state,
-			AuthUser:        username,
-			AuthPassword:    password,
-		},
+		endp:       endp,
+		log:        endp.Log,
 		sessionCtx: context.Background(),
 	}
+	s.connState, s.cancelRDNS = endp.connState(s.sessionCtx, state, username, password)
+	s.pipeline = endp.connPipeline(s.connState.Data)
+	s.guard = lookupGuard(s.connState.Data)
+
+	if !anonymous && username != "" {
+		s.connState.Data.Set(authUserDataKey{}, username)
+	}
+
+	return s
+}
+
+// connState creates the client state passed to the message pipeline. The
+// rDNS lookup is started in background, the returned function cancels it
+// and is nil if the lookup is not started.
+func (endp *Endpoint) connState(ctx context.Context, state *smtp.ConnectionState, username, password string) (module.ConnState, context.CancelFunc) {
+	var xclient smtp.XClientAttrs
+	if state.XClient != nil {
+		xclient = *state.XClient
+	}
+
+	connData := connDataOf(state.LocalAddr)
+	if connData == nil {
+		connData = module.NewConnData()
+	}
+
+	connState := module.ConnState{
+		ConnectionState: *state,
+		AuthUser:        username,
+		AuthPassword:    password,
+		Data:            connData,
+	}
+
+	connState.EarlyTalker = isEarlyTalker(connData)
+
+	if endp.tlsRequired {
+		connState.TLSPolicy = endp.tlsPolicy(state)
+	}
 
 	if endp.serv.LMTP {
-		s.connState.Proto = "LMTP"
+		connState.Proto = "LMTP"
 	} else {
 		// Check if TLS connection state struct is poplated.
 		// If it is - we are ssing TLS.
 		if state.TLS.HandshakeComplete {
-			s.connState.Proto = "ESMTPS"
+			connState.Proto = "ESMTPS"
 		} else {
-			s.connState.Proto = "ESMTP"
+			connState.Proto = "ESMTP"
 		}
 	}
+	if xclient.Proto != "" {
+		connState.Proto = xclient.Proto
+	}
 
-	if endp.resolver != nil {
-		rdnsCtx, cancelRDNS := context.WithCancel(s.sessionCtx)
-		s.connState.RDNSName = future.New()
-		s.cancelRDNS = cancelRDNS
-		go s.fetchRDNSName(rdnsCtx)
+	var cancelRDNS context.CancelFunc
+	if xclient.NameSet {
+		connState.RDNSName = future.New()
+		if xclient.Name != "" {
+			connState.RDNSName.Set(xclient.Name, nil)
+		} else {
+			connState.RDNSName.Set(nil, nil)
+		}
+	} else if endp.resolver != nil {
+		var rdnsCtx context.Context
+		rdnsCtx, cancelRDNS = context.WithCancel(ctx)
+		connState.RDNSName = future.New()
+		go endp.fetchRDNSName(rdnsCtx, connState.RemoteAddr, connState.RDNSName)
 	}
 
-	return s
+	return connState, cancelRDNS
+}
+
+func (endp *Endpoint) fetchRDNSName(ctx context.Context, remoteAddr net.Addr, rdnsName *future.Future) {
+	defer trace.StartRegion(ctx, "rDNS fetch").End()
+
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		rdnsName.Set(nil, nil)
+		return
+	}
+
+	name, err := dns.LookupAddr(ctx, endp.resolver, tcpAddr.IP)
+	if err != nil {
+		dnsErr, ok := err.(*net.DNSError)
+		if ok && dnsErr.IsNotFound {
+			rdnsName.Set(nil, nil)
+			return
+		}
+
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		misc["reason"] = reason
+		if !strings.HasSuffix(reason, "canceled") {
+			// Often occurs when transaction completes before rDNS lookup and
+			// rDNS name was not actually needed. So do not log cancelation
+			// error if that's the case.
+
+			endp.Log.Error("rDNS error", exterrors.WithFields(err, misc), "src_ip", remoteAddr)
+		}
+		rdnsName.Set(nil, err)
+		return
+	}
+
+	rdnsName.Set(name, nil)
+}
+
+// tlsPolicy returns the TLS requirement decision for the connection.
+// Only plaintext connections from networks listed in tls_required_exempt
+// are exempt.
+func (endp *Endpoint) tlsPolicy(state *smtp.ConnectionState) string {
+	if state.TLS.HandshakeComplete {
+		return module.TLSPolicyRequired
+	}
+	tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets are used by local clients.
+		return module.TLSPolicyExempt
+	}
+	for _, ipNet := range endp.tlsRequiredExempt {
+		if ipNet.Contains(tcpAddr.IP) {
+			return module.TLSPolicyExempt
+		}
+	}
+	return module.TLSPolicyRequired
+}
+
+// Values of the received_hide_client directive.
+const (
+	receivedHideNever         = "never"
+	receivedHideAuthenticated = "authenticated"
+	receivedHideAlways        = "always"
+)
+
+// receivedOpts sets the MsgMetadata flags controlling the Received header
+// field added by the message pipeline for the message accepted over the
+// connection.
+func (endp *Endpoint) receivedOpts(msgMeta *module.MsgMetadata, state *module.ConnState) {
+	if tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr); ok {
+		for _, ipNet := range endp.receivedSkip {
+			if ipNet.Contains(tcpAddr.IP) {
+				msgMeta.DontAddReceived = true
+				return
+			}
+		}
+	}
+
+	switch endp.receivedHideClient {
+	case receivedHideAlways:
+		msgMeta.DontTraceSender = true
+	case receivedHideAuthenticated:
+		msgMeta.DontTraceSender = state.AuthUser != ""
+	}
+	msgMeta.TraceTLS = endp.receivedTLS
+	msgMeta.TraceAuthUser = endp.receivedAuthUser
 }
 
 func (endp *Endpoint) Close() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	endp.drain()
+
 	endp.serv.Close()
 	endp.listenersWg.Wait()
+	if endp.sentCopy != nil {
+		endp.sentCopy.close()
+	}
 	return nil
 }
 
@@ -19,7 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"errors"
 	"flag"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
@@ -35,6 +38,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/check/size"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -101,11 +105,16 @@ func testEndpoint(t *testing.T, modName string, authMod module.PlainAuth, tgt mo
 		Plain: []module.PlainAuth{authMod},
 	}
 
-	endp.pipeline = msgpipeline.Mock(tgt, checks)
-	endp.pipeline.Hostname = "mx.example.com"
-	endp.pipeline.Resolver = endp.resolver
-	endp.pipeline.FirstPipeline = true
-	endp.pipeline.Log = testutils.Logger(t, "smtp/pipeline")
+	pipeline := msgpipeline.Mock(tgt, checks)
+	pipeline.Hostname = "mx.example.com"
+	pipeline.Resolver = endp.resolver
+	pipeline.FirstPipeline = true
+	pipeline.Log = testutils.Logger(t, "smtp/pipeline")
+
+	// Listeners are running already.
+	endp.pipelineLck.Lock()
+	endp.pipeline = pipeline
+	endp.pipelineLck.Unlock()
 
 	return endp
 }
@@ -253,6 +262,53 @@ func TestSMTPDelivery_EarlyCheck_Fail(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_CheckFail_CRLF(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			ConnRes: module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:    550,
+					Message: "Sender <a\r\n250 2.0.0 OK\r\n@example.org> rejected",
+				},
+				Reject: true,
+			},
+		},
+	}, nil)
+	endp.deferServerReject = false
+	defer endp.Close()
+	defer testutils.WaitForConnsClose(t, endp.serv)
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Mail("sender@example.org", nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned")
+	}
+	if smtpErr.Code != 550 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+	if !strings.HasPrefix(smtpErr.Message, "Sender <a??250 2.0.0 OK??@example.org> rejected") {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+
+	// Make sure no additional replies were queued.
+	if err := cl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Noop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSMTPDeliver_CheckError(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
@@ -292,6 +348,52 @@ func TestSMTPDeliver_CheckError(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_StreamingCheck(t *testing.T) {
+	sizeCheck, err := size.New("check.size", "", nil, []string{"4K"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sizeCheck.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{sizeCheck.(module.Check)}, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, testMsg+strings.Repeat(strings.Repeat("A", 78)+"\r\n", 16*1024)); err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 552 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Message is delivered")
+	}
+}
+
 func TestSMTPDeliver_CheckError_Deferred(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
@@ -539,6 +641,78 @@ func TestSMTPDelivery_SubmissionAuthRequire(t *testing.T) {
 	}
 }
 
+type canonicalAuth struct{}
+
+func (canonicalAuth) AuthPlain(username, password string) error {
+	_, err := canonicalAuth{}.AuthPlainCanonical(username, password)
+	return err
+}
+
+func (canonicalAuth) AuthPlainCanonical(username, password string) (string, error) {
+	switch password {
+	case "password":
+		return strings.ToLower(username), nil
+	case "temp":
+		return "", exterrors.WithTemporary(errors.New("server unavailable"), true)
+	}
+	return "", module.ErrUnknownCredentials
+}
+
+func TestSMTPDelivery_AuthErrors(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", canonicalAuth{}, &tgt, nil, nil)
+	defer endp.Close()
+
+	for _, mech := range []string{"PLAIN", "LOGIN"} {
+		for password, code := range map[string]int{"wrong": 535, "temp": 454} {
+			cl, err := smtp.Dial("127.0.0.1:" + testPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var saslCl sasl.Client
+			if mech == "PLAIN" {
+				saslCl = sasl.NewPlainClient("", "user", password)
+			} else {
+				saslCl = sasl.NewLoginClient("user", password)
+			}
+
+			err = cl.Auth(saslCl)
+			smtpErr, ok := err.(*smtp.SMTPError)
+			if !ok || smtpErr.Code != code {
+				t.Errorf("%s with %s password: expected %d, got %v", mech, password, code, err)
+			}
+			cl.Close()
+		}
+	}
+}
+
+func TestSMTPDelivery_AuthCanonical(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", canonicalAuth{}, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewLoginClient("User", "password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitMsg(t, cl, "user@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if authUser := tgt.Messages[0].MsgMeta.Conn.AuthUser; authUser != "user" {
+		t.Error("Wrong AuthUser:", authUser)
+	}
+}
+
 func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
@@ -571,7 +745,7 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 		t.Error("Wrong AuthPassword:", msg.MsgMeta.Conn.AuthPassword)
 	}
 
-	receivedPrefix := `by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ` + msgID
+	receivedPrefix := `from unknown by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ` + msgID
 	if !strings.HasPrefix(msg.Header.Get("Received"), receivedPrefix) {
 		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
 	}
@@ -581,6 +755,156 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_Limits(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_transactions",
+			Args: []string{"2"},
+		},
+		{
+			Name: "max_rcpt_domains",
+			Args: []string{"1"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com", "rcpt@example.net"}, testMsg)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 452 {
+		t.Fatal("Wrong error for the RCPTDOMAINMAX violation:", err)
+	}
+	if err := cl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.net"}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.net"}, testMsg)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 421 {
+		t.Fatal("Wrong error for the MAILMAX violation:", err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func greetingDelayCfg(action string) []config.Node {
+	return []config.Node{
+		{
+			Name: "greeting_delay",
+			Args: []string{"200ms"},
+		},
+		{
+			Name: "greeting_delay_exempt",
+			Args: []string{"192.0.2.0/24"},
+		},
+		{
+			Name: "early_talker_action",
+			Args: []string{action},
+		},
+	}
+}
+
+func TestSMTPDelivery_GreetingDelay(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, greetingDelayCfg("drop"))
+	defer endp.Close()
+
+	start := time.Now()
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("Greeting is not delayed")
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if tgt.Messages[0].MsgMeta.Conn.EarlyTalker {
+		t.Error("Client is flagged as early talker")
+	}
+}
+
+func TestSMTPDelivery_EarlyTalker_Drop(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, greetingDelayCfg("drop"))
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "EHLO mx.example.org\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp), "554 ") {
+		t.Fatalf("Early talker is not rejected: %q", resp)
+	}
+}
+
+func TestSMTPDelivery_EarlyTalker_Flag(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, greetingDelayCfg("flag"))
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Pipeline the whole session without waiting for the greeting.
+	_, err = io.WriteString(conn, "EHLO mx.example.org\r\n"+
+		"MAIL FROM:<sender@example.org>\r\n"+
+		"RCPT TO:<rcpt@example.com>\r\n"+
+		"DATA\r\n"+
+		testMsg+
+		".\r\n"+
+		"QUIT\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if !tgt.Messages[0].MsgMeta.Conn.EarlyTalker {
+		t.Error("Client is not flagged as early talker")
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -593,3 +917,399 @@ func TestMain(m *testing.M) {
 	testPort = *remoteSmtpPort
 	os.Exit(m.Run())
 }
+
+func TestSMTPDelivery_GracefulShutdown(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	idleCl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idleCl.Close()
+	if err := idleCl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		endp.Close()
+		close(closed)
+	}()
+	for !endp.isClosing() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New transactions are rejected.
+	err = idleCl.Mail("sender@example.org", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 421 {
+		t.Fatal("Expected 421 for MAIL during shutdown, got", err)
+	}
+
+	select {
+	case <-closed:
+		t.Fatal("Endpoint is closed before the transaction is completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Running transaction is completed.
+	if err := cl.Rcpt("rcpt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Endpoint is not closed after the transaction is completed")
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_REQUIRETLS_NoTLS(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	caps := c.expectCmd(250, "EHLO mx.example.org")
+	if strings.Contains(caps, "REQUIRETLS") {
+		t.Fatal("REQUIRETLS is advertised without TLS:", caps)
+	}
+	c.expectCmd(530, "MAIL FROM:<sender@example.org> REQUIRETLS")
+}
+
+func TestSMTPDelivery_TLSRequiredNo(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, "TLS-Required: No\r\n"+testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if !tgt.Messages[0].MsgMeta.TLSRequireOverride {
+		t.Error("TLSRequireOverride is not set")
+	}
+}
+
+func TestSMTPDelivery_TLSRequiredPolicy(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "tls_required",
+			Args: []string{"yes"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(530, "MAIL FROM:<sender@example.org>")
+
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Expected no messages, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_TLSRequiredPolicy_Exempt(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "tls_required",
+			Args: []string{"yes"},
+		},
+		{
+			Name: "tls_required_exempt",
+			Args: []string{"127.0.0.0/8"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if policy := tgt.Messages[0].MsgMeta.Conn.TLSPolicy; policy != module.TLSPolicyExempt {
+		t.Errorf("Wrong TLS policy decision: %q", policy)
+	}
+}
+
+func TestSMTPDelivery_Received_HideAuthenticated(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "received_hide_client",
+			Args: []string{"authenticated"},
+		},
+		{
+			Name: "received_auth_user",
+			Args: []string{"yes"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// Not authenticated yet, client is traced.
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+
+	msg := tgt.Messages[0]
+	msgID := testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt@example.org"}, "")
+	receivedPrefix := `from mx.example.org (mx.example.org [127.0.0.1]) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ` + msgID
+	if !strings.HasPrefix(msg.Header.Get("Received"), receivedPrefix) {
+		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
+	}
+
+	msg = tgt.Messages[1]
+	msgID = testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt@example.org"}, "")
+	receivedPrefix = `from unknown (authenticated as user) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ` + msgID
+	if !strings.HasPrefix(msg.Header.Get("Received"), receivedPrefix) {
+		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
+	}
+}
+
+func TestSMTPDelivery_Received_Skip(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "received_skip",
+			Args: []string{"127.0.0.0/8"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if received := tgt.Messages[0].Header.Get("Received"); received != "" {
+		t.Error("Unexpected Received field:", received)
+	}
+}
+
+func TestSMTPDelivery_RelayIdentity(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "relay_identity",
+			Args: []string{"app-relay@internal", "192.0.2.0/24", "127.0.0.0/8"},
+		},
+		{
+			Name: "received_auth_user",
+			Args: []string{"yes"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// require_auth is satisfied without AUTH.
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	msgID := testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt@example.org"}, "")
+	if msg.MsgMeta.Conn.AuthUser != "app-relay@internal" {
+		t.Error("Wrong AuthUser:", msg.MsgMeta.Conn.AuthUser)
+	}
+	if !msg.MsgMeta.Conn.RelayIdentity {
+		t.Error("RelayIdentity is not set")
+	}
+	receivedPrefix := `from unknown (trusted relay app-relay@internal) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ` + msgID
+	if !strings.HasPrefix(msg.Header.Get("Received"), receivedPrefix) {
+		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
+	}
+}
+
+func TestSMTPDelivery_RelayIdentity_NoSASL(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "relay_identity",
+			Args: []string{"app-relay@internal", "192.0.2.0/24"},
+		},
+	})
+	defer endp.Close()
+
+	for _, saslCl := range []sasl.Client{
+		sasl.NewPlainClient("", "app-relay@internal", "password"),
+		sasl.NewLoginClient("App-Relay@internal", "password"),
+	} {
+		cl, err := smtp.Dial("127.0.0.1:" + testPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = cl.Auth(saslCl)
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok || smtpErr.Code != 535 {
+			t.Error("Expected 535, got", err)
+		}
+		cl.Close()
+	}
+
+	// Not in the relay network.
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Mail("sender@example.org", nil); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
+
+func TestSMTPReload(t *testing.T) {
+	endp := testEndpoint(t, "smtp", nil, nil, nil, nil)
+	defer endp.Close()
+
+	reload := func(hostname, target string) (func(), error) {
+		return endp.Reload(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "hostname", Args: []string{hostname}},
+				{Name: "tls", Args: []string{"off"}},
+				{Name: "deliver_to", Args: []string{target}},
+			},
+		}))
+	}
+
+	// The pipeline is not created if the restart is required, so the
+	// unknown module is not reported.
+	_, err := reload("mx2.example.com", "nonexistent")
+	if !errors.Is(err, module.ErrRestartRequired) {
+		t.Fatal("expected ErrRestartRequired, got", err)
+	}
+
+	if _, err := reload("mx.example.com", "nonexistent"); err == nil || errors.Is(err, module.ErrRestartRequired) {
+		t.Fatal("expected a pipeline configuration error, got", err)
+	}
+
+	apply, err := reload("mx.example.com", "dummy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := endp.currentPipeline()
+	apply()
+	if endp.currentPipeline() == old {
+		t.Error("pipeline is not replaced")
+	}
+}
+
+func TestSMTPDelivery_ConnCheckOncePerConn(t *testing.T) {
+	tgt := testutils.Target{}
+	check := testutils.Check{}
+	endp := testEndpoint(t, "smtp", &module.Dummy{}, &tgt, []module.Check{&check}, []config.Node{
+		{
+			Name: "insecure_auth",
+			Args: []string{"on"},
+		},
+	})
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	// AUTH replaces the session, the connection stays the same.
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closes the client connection.
+	endp.Close()
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected two messages, got", len(tgt.Messages))
+	}
+	if check.ConnOpenedCalls != 1 || check.ConnClosedCalls != 1 {
+		t.Errorf("ConnOpened/ConnClosed should be called once per connection, got %d/%d calls",
+			check.ConnOpenedCalls, check.ConnClosedCalls)
+	}
+}
@@ -22,11 +22,15 @@ import (
 	"errors"
 	"fmt"
 	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/google/uuid"
 )
 
@@ -43,9 +47,7 @@ var (
 )
 
 func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textproto.Header) error {
-	msgMeta.DontTraceSender = true
-
-	if header.Get("Message-ID") == "" {
+	if header.Get("Message-ID") == "" && s.endp.addMessageID {
 		msgId, err := msgIDField()
 		if err != nil {
 			return errors.New("Message-ID generation failed")
@@ -54,6 +56,11 @@ func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textpro
 		header.Set("Message-ID", "<"+msgId+"@"+s.endp.serv.Domain+">")
 	}
 
+	if header.Get("From") == "" && s.endp.completeFrom && msgMeta.OriginalFrom != "" {
+		s.log.Msg("adding missing From", "from", msgMeta.OriginalFrom)
+		header.Set("From", "<"+msgMeta.OriginalFrom+">")
+	}
+
 	if header.Get("From") == "" {
 		return &exterrors.SMTPError{
 			Code:         554,
@@ -126,12 +133,21 @@ func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textpro
 		}
 	}
 
+	if s.endp.senderTable != nil && s.connState.AuthUser != "" {
+		for _, addr := range addrs {
+			if err := s.checkFromAuthorized(addr.Address); err != nil {
+				return err
+			}
+		}
+	}
+
 	if dateHdr := header.Get("Date"); dateHdr != "" {
 		_, err := parseMessageDateTime(dateHdr)
 		if err != nil {
 			return &exterrors.SMTPError{
-				Code:    554,
-				Message: "Malformed Date header",
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+				Message:      "Malformed Date header",
 				Misc: map[string]interface{}{
 					"modifier": "submission_prepare",
 					"date":     dateHdr,
@@ -139,10 +155,80 @@ func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textpro
 				Err: err,
 			}
 		}
-	} else {
+	} else if s.endp.addDate {
 		s.log.Msg("adding missing Date header")
 		header.Set("Date", now().UTC().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	} else {
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Message does not contain a Date header field",
+			Misc: map[string]interface{}{
+				"modifier": "submission_prepare",
+			},
+		}
 	}
 
 	return nil
 }
+
+// checkFromAuthorized checks that the authenticated user is allowed to use
+// the address in the From header field according to the sender_table.
+func (s *Session) checkFromAuthorized(addr string) error {
+	ok, err := auth.SenderAuthorized(s.endp.senderTable, s.connState.AuthUser, addr)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         exterrors.SMTPCode(err, 451, 554),
+			EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 1}),
+			Message:      "Internal error during policy check",
+			Misc: map[string]interface{}{
+				"modifier": "submission_prepare",
+			},
+			Err: err,
+		}
+	}
+	if ok {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         554,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "You are not allowed to use this From address",
+		Misc: map[string]interface{}{
+			"modifier": "submission_prepare",
+			"username": s.connState.AuthUser,
+			"addr":     addr,
+		},
+	}
+}
+
+// checkFQDN checks that the address used in MAIL or RCPT is fully
+// qualified. MSA is not expected to accept local names from MUAs.
+func (s *Session) checkFQDN(addr string, sender bool) error {
+	if !s.endp.requireFQDN || addr == "" {
+		return nil
+	}
+
+	_, domain, err := address.Split(addr)
+	if err == nil && domain == "" {
+		// Unqualified postmaster is allowed by RFC 5321 as a recipient.
+		if !sender {
+			return nil
+		}
+	} else if err == nil && (strings.HasPrefix(domain, "[") || strings.Contains(strings.Trim(domain, "."), ".")) {
+		return nil
+	}
+
+	if sender {
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+			Message:      "Sender address must be fully qualified",
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Recipient address must be fully qualified",
+	}
+}
@@ -19,13 +19,19 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/testutils"
 )
 
 func init() {
@@ -163,3 +169,152 @@ func TestSubmissionPrepare(t *testing.T) {
 		"Date":       []string{"Thu, 1 Jan 1970 00:00:00 +0000"},
 	})
 }
+
+func enhancedCode(err error) exterrors.EnhancedCode {
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return exterrors.EnhancedCode{}
+	}
+	return smtpErr.EnhancedCode
+}
+
+func testSubmissionSession(t *testing.T, cfg []config.Node) (*Session, func()) {
+	t.Helper()
+
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &module.Dummy{}, nil, cfg)
+	cleanup := func() {
+		// Synchronize the endpoint initialization.
+		// Otherwise Close will race with Serve called by setupListeners.
+		cl, _ := smtp.Dial("127.0.0.1:" + testPort)
+		cl.Close()
+
+		endp.Close()
+	}
+
+	session, err := endp.Login(&smtp.ConnectionState{}, "u", "p")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return session.(*Session), cleanup
+}
+
+func TestSubmissionPrepare_CompleteFrom(t *testing.T) {
+	s, cleanup := testSubmissionSession(t, nil)
+	defer cleanup()
+
+	hdr := textproto.Header{}
+	if err := s.submissionPrepare(&module.MsgMetadata{OriginalFrom: "u@example.org"}, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if from := hdr.Get("From"); from != "<u@example.org>" {
+		t.Errorf("Wrong From: %q", from)
+	}
+}
+
+func TestSubmissionPrepare_FixupsDisabled(t *testing.T) {
+	s, cleanup := testSubmissionSession(t, []config.Node{
+		{Name: "complete_from", Args: []string{"no"}},
+		{Name: "add_date", Args: []string{"no"}},
+		{Name: "add_message_id", Args: []string{"no"}},
+	})
+	defer cleanup()
+
+	hdr := textproto.Header{}
+	err := s.submissionPrepare(&module.MsgMetadata{OriginalFrom: "u@example.org"}, &hdr)
+	if enhancedCode(err) != (exterrors.EnhancedCode{5, 6, 0}) {
+		t.Errorf("Expected 5.6.0 for missing From, got %v", err)
+	}
+
+	hdr.Set("From", "<u@example.org>")
+	err = s.submissionPrepare(&module.MsgMetadata{}, &hdr)
+	if enhancedCode(err) != (exterrors.EnhancedCode{5, 6, 0}) {
+		t.Errorf("Expected 5.6.0 for missing Date, got %v", err)
+	}
+
+	hdr.Set("Date", "Fri, 22 Nov 2019 20:51:31 +0800")
+	if err := s.submissionPrepare(&module.MsgMetadata{}, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Get("Message-Id") != "" {
+		t.Error("Message-Id is added with add_message_id off")
+	}
+}
+
+func TestSubmissionPrepare_SenderTable(t *testing.T) {
+	s, cleanup := testSubmissionSession(t, []config.Node{
+		{
+			Name: "sender_table",
+			Args: []string{"table.static"},
+			Children: []config.Node{
+				{Name: "entry", Args: []string{"u", "@example.org, u@example.com"}},
+			},
+		},
+	})
+	defer cleanup()
+
+	test := func(from string, allowed bool) {
+		t.Helper()
+
+		hdr := textproto.Header{}
+		hdr.Set("From", from)
+		hdr.Set("Sender", "<u@example.com>")
+		hdr.Set("Date", "Fri, 22 Nov 2019 20:51:31 +0800")
+		err := s.submissionPrepare(&module.MsgMetadata{}, &hdr)
+		if allowed {
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %v", from, err)
+			}
+			return
+		}
+		if enhancedCode(err) != (exterrors.EnhancedCode{5, 7, 1}) {
+			t.Errorf("Expected 5.7.1 for %s, got %v", from, err)
+		}
+	}
+
+	test("<anything@example.org>", true)
+	test("<u@example.com>", true)
+	test("<other@example.com>", false)
+	test("<u@example.org>, <other@example.com>", false)
+}
+
+func TestSubmission_RequireFQDN(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectErr := func(err error, code smtp.EnhancedCode) {
+		t.Helper()
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatalf("Expected SMTP error, got %v", err)
+		}
+		if smtpErr.Code != 553 || smtpErr.EnhancedCode != code {
+			t.Errorf("Expected 553 %v, got %d %v", code, smtpErr.Code, smtpErr.EnhancedCode)
+		}
+	}
+
+	expectErr(cl.Mail("sender", nil), smtp.EnhancedCode{5, 1, 7})
+	expectErr(cl.Mail("sender@localhost", nil), smtp.EnhancedCode{5, 1, 7})
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectErr(cl.Rcpt("rcpt"), smtp.EnhancedCode{5, 1, 3})
+	expectErr(cl.Rcpt("rcpt@localhost"), smtp.EnhancedCode{5, 1, 3})
+	if err := cl.Rcpt("postmaster"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("rcpt@[127.0.0.1]"); err != nil {
+		t.Fatal(err)
+	}
+}
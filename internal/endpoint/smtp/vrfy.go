@@ -0,0 +1,372 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+)
+
+// VRFY and EXPN commands (RFC 5321 Section 3.5).
+//
+// The commands are passed to the endpoint by go-smtp via the
+// smtp.VerifyBackend interface. VRFY runs the address through the recipient
+// checks and modifiers of the message pipeline, same as RCPT TO does, without
+// starting a session. EXPN looks up the address in the expn_aliases table.
+// Both are disabled by default since they make harvesting of valid addresses
+// easier.
+
+// Values of the vrfy and expn directives.
+const (
+	cmdDisabled = "disabled"
+	cmdEnabled  = "enabled"
+	cmdAuthOnly = "auth_only"
+)
+
+// authUserDataKey is the per-connection data key for the authenticated
+// username, set when the session is created.
+type authUserDataKey struct{}
+
+func cmdRateDirective(m *config.Map, node config.Node) (interface{}, error) {
+	rate := cmdRate{period: 1 * time.Minute}
+
+	switch len(node.Args) {
+	case 2:
+		var err error
+		rate.period, err = time.ParseDuration(node.Args[1])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		fallthrough
+	case 1:
+		var err error
+		rate.burst, err = strconv.Atoi(node.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+	case 0:
+		return nil, config.NodeErr(node, "at least burst size is needed")
+	default:
+		return nil, config.NodeErr(node, "too many arguments")
+	}
+	return rate, nil
+}
+
+// cmdRate is the per-connection limit for VRFY and EXPN commands.
+type cmdRate struct {
+	burst  int
+	period time.Duration
+}
+
+// cmdLimiter is the per-connection limiters.Rate for VRFY and EXPN. It is
+// created on first use and closed with the connection, see
+// connDataConn.Close.
+type cmdLimiter struct {
+	lock   sync.Mutex
+	rate   limiters.Rate
+	set    bool
+	closed bool
+}
+
+type cmdLimiterDataKey struct{}
+
+func (l *cmdLimiter) take(rate cmdRate) bool {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return false
+	}
+	if !l.set {
+		l.rate = limiters.NewRate(rate.burst, rate.period)
+		l.set = true
+	}
+	r := l.rate
+	l.lock.Unlock()
+
+	return r.TryTake()
+}
+
+// closeCmdLimiter stops the VRFY and EXPN limiter of the connection.
+func closeCmdLimiter(connData *module.ConnData) {
+	l, _ := connData.LoadOrStore(cmdLimiterDataKey{}, &cmdLimiter{closed: true})
+	limiter, ok := l.(*cmdLimiter)
+	if !ok {
+		return
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.set {
+		limiter.rate.Close()
+		limiter.set = false
+	}
+	limiter.closed = true
+}
+
+// authUser returns the username the client authenticated as, if any.
+func authUser(state *smtp.ConnectionState) string {
+	if user, ok := connDataOf(state.LocalAddr).Get(authUserDataKey{}).(string); ok {
+		return user
+	}
+	if state.XClient != nil {
+		return state.XClient.Login
+	}
+	return ""
+}
+
+// checkCmdPolicy checks whether the command can be used by the client.
+func (endp *Endpoint) checkCmdPolicy(state *smtp.ConnectionState, cmd, policy string) *smtp.SMTPError {
+	connData := connDataOf(state.LocalAddr)
+
+	if policy == cmdDisabled || (policy == cmdAuthOnly && authUser(state) == "") {
+		switch {
+		case cmd == "VRFY":
+			return &smtp.SMTPError{
+				Code:         252,
+				EnhancedCode: smtp.EnhancedCode{2, 5, 0},
+				Message:      "Cannot VRFY user, but will accept message",
+			}
+		case policy == cmdDisabled:
+			return &smtp.SMTPError{
+				Code:         502,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+				Message:      "EXPN command not implemented",
+			}
+		default:
+			return &smtp.SMTPError{
+				Code:         502,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+				Message:      "EXPN is not permitted",
+			}
+		}
+	}
+
+	if connData == nil {
+		return nil
+	}
+	l, _ := connData.LoadOrStore(cmdLimiterDataKey{}, &cmdLimiter{})
+	if !l.(*cmdLimiter).take(endp.cmdRate) {
+		endp.Log.Msg("too many VRFY/EXPN commands", "src_ip", state.RemoteAddr)
+		return countError(connData, &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Too many " + cmd + " commands, try again later",
+		})
+	}
+	return nil
+}
+
+// countError accounts the failed command for max_errors and replaces the
+// error with 421 if the limit is exceeded.
+func countError(connData *module.ConnData, err *smtp.SMTPError) *smtp.SMTPError {
+	guard := lookupGuard(connData)
+	if !guard.countError() {
+		return err
+	}
+	guard.disconnect("too many errors")
+	return &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many errors, closing connection",
+	}
+}
+
+// parseCmdAddr parses the VRFY or EXPN argument. Only mailbox addresses are
+// accepted, optionally enclosed in angle brackets and followed by the
+// SMTPUTF8 parameter (RFC 6531 Section 3.7.4.2).
+func parseCmdAddr(arg string) (addr string, utf8 bool, err *smtp.SMTPError) {
+	arg = strings.TrimSpace(arg)
+	if len(arg) > 9 && strings.EqualFold(arg[len(arg)-9:], " SMTPUTF8") {
+		utf8 = true
+		arg = strings.TrimSpace(arg[:len(arg)-9])
+	}
+	if strings.HasSuffix(arg, ">") {
+		if i := strings.LastIndexByte(arg, '<'); i != -1 {
+			arg = arg[i+1 : len(arg)-1]
+		}
+	}
+
+	if arg == "" || strings.ContainsAny(arg, " <>") {
+		return "", false, &smtp.SMTPError{
+			Code:         501,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+			Message:      "Malformed address",
+		}
+	}
+	if _, _, splitErr := address.Split(arg); splitErr != nil || !strings.Contains(arg, "@") {
+		return "", false, &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Fully qualified mailbox address is required",
+		}
+	}
+	if !address.IsASCII(arg) && !utf8 {
+		return "", false, &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+			Message:      "SMTPUTF8 is required for non-ASCII addresses",
+		}
+	}
+	return arg, utf8, nil
+}
+
+// Verify implements smtp.VerifyBackend.
+func (endp *Endpoint) Verify(state *smtp.ConnectionState, arg string) (string, error) {
+	if err := endp.checkCmdPolicy(state, "VRFY", endp.vrfyPolicy); err != nil {
+		return "", err
+	}
+
+	connData := connDataOf(state.LocalAddr)
+	addr, utf8, parseErr := parseCmdAddr(arg)
+	if parseErr != nil {
+		return "", countError(connData, parseErr)
+	}
+
+	connState, cancelRDNS := endp.connState(context.Background(), state, authUser(state), "")
+	if cancelRDNS != nil {
+		defer cancelRDNS()
+	}
+
+	msgID, err := endp.verifyRcpt(context.TODO(), &connState, addr)
+	if err != nil {
+		endp.Log.Error("VRFY error", err, "rcpt", addr, "msg_id", msgID)
+		var smtpErr *smtp.SMTPError
+		if !errors.As(endp.wrapErr(msgID, !utf8, "VRFY", err), &smtpErr) {
+			smtpErr = &smtp.SMTPError{Code: 451, Message: err.Error()}
+		}
+		if smtpErr.Code/100 == 5 {
+			smtpErr = countError(connData, smtpErr)
+		}
+		return "", smtpErr
+	}
+
+	endp.Log.Msg("VRFY ok", "rcpt", addr, "msg_id", msgID)
+	return addr, nil
+}
+
+// verifyRcpt runs the recipient through the message pipeline without
+// accepting any message. The returned string is the message ID used for
+// logging.
+func (endp *Endpoint) verifyRcpt(ctx context.Context, connState *module.ConnState, to string) (string, error) {
+	cleanTo, err := address.CleanDomain(to)
+	if err != nil {
+		return "", &exterrors.SMTPError{
+			Code:         501,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "Unable to normalize the recipient address",
+		}
+	}
+
+	msgMeta := &module.MsgMetadata{
+		Conn: connState,
+	}
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		return "", err
+	}
+
+	delivery, err := endp.connPipeline(connState.Data).Start(ctx, msgMeta, "")
+	if err != nil {
+		return msgMeta.ID, err
+	}
+	defer func() {
+		if err := delivery.Abort(ctx); err != nil {
+			endp.Log.Error("delivery abort failed", err, "msg_id", msgMeta.ID)
+		}
+	}()
+
+	return msgMeta.ID, delivery.AddRcpt(ctx, cleanTo)
+}
+
+// Expand implements smtp.VerifyBackend.
+func (endp *Endpoint) Expand(state *smtp.ConnectionState, arg string) ([]string, error) {
+	if err := endp.checkCmdPolicy(state, "EXPN", endp.expnPolicy); err != nil {
+		return nil, err
+	}
+
+	connData := connDataOf(state.LocalAddr)
+	addr, _, parseErr := parseCmdAddr(arg)
+	if parseErr != nil {
+		return nil, countError(connData, parseErr)
+	}
+
+	members, err := endp.expandAlias(addr)
+	if err != nil {
+		endp.Log.Error("EXPN lookup failed", err, "list", addr)
+		return nil, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error",
+		}
+	}
+	if len(members) == 0 {
+		return nil, countError(connData, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Not a mailing list",
+		})
+	}
+
+	endp.Log.Msg("EXPN", "list", addr, "src_ip", state.RemoteAddr, "members", len(members))
+	return members, nil
+}
+
+// expandAlias returns the addresses the alias is expanded to using the
+// expn_aliases table. No addresses are returned if there is no such alias.
+func (endp *Endpoint) expandAlias(addr string) ([]string, error) {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return nil, nil
+	}
+
+	var members []string
+	if multi, ok := endp.expnAliases.(module.MultiTable); ok {
+		members, err = multi.LookupMulti(key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		val, ok, err := endp.expnAliases.Lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			members = strings.Split(val, ",")
+		}
+	}
+
+	res := make([]string, 0, len(members))
+	for _, member := range members {
+		if member = strings.TrimSpace(member); member != "" {
+			res = append(res, member)
+		}
+	}
+	return res, nil
+}
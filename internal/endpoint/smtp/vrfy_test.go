@@ -0,0 +1,228 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func vrfyCfg(vrfy, expn string, extra ...config.Node) []config.Node {
+	return append([]config.Node{
+		{
+			Name: "vrfy",
+			Args: []string{vrfy},
+		},
+		{
+			Name: "expn",
+			Args: []string{expn},
+		},
+		{
+			Name: "expn_aliases",
+			Args: []string{"table.static"},
+			Children: []config.Node{
+				{
+					Name: "entry",
+					Args: []string{"list@example.com", "a@example.com,b@example.org"},
+				},
+			},
+		},
+	}, extra...)
+}
+
+func TestSMTP_VRFY_Disabled(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(252, "VRFY <rcpt@example.com>")
+	c.expectCmd(502, "EXPN <list@example.com>")
+}
+
+func TestSMTP_VRFY(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"unknown@example.com": &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			},
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, vrfyCfg("enabled", "disabled"))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	if msg := c.expectCmd(250, "VRFY <rcpt@example.com>"); msg != "2.1.5 <rcpt@example.com>" {
+		t.Error("Wrong VRFY reply:", msg)
+	}
+	c.expectCmd(250, "VRFY Rcpt <rcpt@EXAMPLE.com>")
+	if msg := c.expectCmd(550, "VRFY unknown@example.com"); !strings.Contains(msg, "No such user") {
+		t.Error("Wrong VRFY reply:", msg)
+	}
+	c.expectCmd(553, "VRFY rcpt")
+	c.expectCmd(553, "VRFY <рцпт@example.com>")
+	c.expectCmd(502, "EXPN <list@example.com>")
+
+	// Recipients are not accepted by VRFY.
+	c.sendMsg("rcpt@example.com")
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if rcpts := tgt.Messages[0].RcptTo; len(rcpts) != 1 || rcpts[0] != "rcpt@example.com" {
+		t.Error("Wrong recipients:", rcpts)
+	}
+}
+
+func TestSMTP_VRFY_InData(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, vrfyCfg("enabled", "disabled"))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.startTxn("", "rcpt@example.com")
+	c.expectCmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err := w.Write([]byte("Subject: test\r\n\r\nVRFY <rcpt@example.com>\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(250)
+	c.expectCmd(250, "VRFY <rcpt@example.com>")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if body := string(tgt.Messages[0].Body); !strings.Contains(body, "VRFY <rcpt@example.com>") {
+		t.Error("Message body is not preserved:", body)
+	}
+}
+
+func TestSMTP_VRFY_AuthOnly(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, vrfyCfg("auth_only", "auth_only",
+		config.Node{Name: "insecure_auth", Args: []string{"true"}}))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(252, "VRFY <rcpt@example.com>")
+	c.expectCmd(502, "EXPN <list@example.com>")
+
+	c.expectCmd(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00password")))
+	c.expectCmd(250, "VRFY <rcpt@example.com>")
+	msg := c.expectCmd(250, "EXPN <list@example.com>")
+	if msg != "2.1.5 <a@example.com>\n2.1.5 <b@example.org>" {
+		t.Errorf("Wrong EXPN reply: %q", msg)
+	}
+	c.expectCmd(550, "EXPN <rcpt@example.com>")
+}
+
+func TestSMTP_VRFY_RateLimit(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, vrfyCfg("enabled", "enabled",
+		config.Node{Name: "vrfy_expn_rate", Args: []string{"2", "1h"}}))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(250, "VRFY <rcpt@example.com>")
+	c.expectCmd(250, "EXPN <list@example.com>")
+	c.expectCmd(450, "VRFY <rcpt@example.com>")
+	c.expectCmd(450, "EXPN <list@example.com>")
+
+	// Limit is per-connection.
+	c2 := dialRaw(t)
+	defer c2.Close()
+	c2.expectCmd(250, "EHLO mx.example.org")
+	c2.expectCmd(250, "VRFY <rcpt@example.com>")
+}
+
+func TestSMTP_VRFY_MaxErrors(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"unknown@example.com": &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			},
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, vrfyCfg("enabled", "disabled",
+		config.Node{Name: "max_errors", Args: []string{"2"}}))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(550, "VRFY <unknown@example.com>")
+	c.expectCmd(421, "VRFY <unknown@example.com>")
+	c.expectClosed()
+}
+
+func TestSMTP_VRFY_Checks(t *testing.T) {
+	tgt := testutils.Target{}
+	check := testutils.Check{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{&check}, vrfyCfg("enabled", "disabled"))
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(250, "VRFY <rcpt@example.com>")
+	c.expectCmd(250, "VRFY <rcpt@example.com>")
+
+	// Closes the client connection.
+	endp.Close()
+
+	if check.RcptCalls != 2 {
+		t.Errorf("Expected 2 recipient checks, got %d", check.RcptCalls)
+	}
+	if check.UnclosedStates != 0 {
+		t.Errorf("%d check states are not closed", check.UnclosedStates)
+	}
+	if check.ConnOpenedCalls != 1 || check.ConnClosedCalls != 1 {
+		t.Errorf("ConnOpened/ConnClosed should be called once per connection, got %d/%d calls",
+			check.ConnOpenedCalls, check.ConnClosedCalls)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import "net"
+
+// XCLIENT extension (http://www.postfix.org/XCLIENT_README.html) lets
+// a trusted upstream MTA forward the identity of the original client.
+//
+// The command is handled by go-smtp, it is not accepted after the first MAIL
+// or AUTH command. The client address and HELO hostname are replaced in
+// smtp.ConnectionState, the rest of the identity is used by connState.
+
+func (endp *Endpoint) isXClientTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets are used by local clients.
+		return true
+	}
+	for _, ipNet := range endp.xclientTrusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func xclientCfg(trusted string) []config.Node {
+	return []config.Node{
+		{
+			Name: "xclient_trusted",
+			Args: []string{trusted},
+		},
+	}
+}
+
+func (c rawClient) sendMsg(rcpt string) {
+	c.t.Helper()
+
+	c.startTxn("", rcpt)
+	c.expectCmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err := w.Write([]byte(testMsg)); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.expect(250)
+}
+
+func TestSMTPDelivery_XCLIENT(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, xclientCfg("127.0.0.0/8"))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	caps := c.expectCmd(250, "EHLO mx.example.org")
+	if !strings.Contains(caps, "XCLIENT ADDR NAME PORT HELO LOGIN PROTO") {
+		t.Fatal("XCLIENT is not advertised:", caps)
+	}
+	c.expectCmd(220, "XCLIENT ADDR=192.0.2.1 PORT=2525 NAME=client.example.org HELO=client+2Dhelo.example.org PROTO=SMTP")
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.sendMsg("rcpt@example.com")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	msgID := testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt@example.com"}, "")
+
+	if addr := msg.MsgMeta.Conn.RemoteAddr.String(); addr != "192.0.2.1:2525" {
+		t.Error("Wrong RemoteAddr:", addr)
+	}
+	if msg.MsgMeta.Conn.Hostname != "client-helo.example.org" {
+		t.Error("Wrong Hostname:", msg.MsgMeta.Conn.Hostname)
+	}
+
+	receivedPrefix := `from client-helo.example.org (client.example.org [192.0.2.1]) by mx.example.com (envelope-sender <sender@example.org>) with SMTP id ` + msgID
+	if !strings.HasPrefix(msg.Header.Get("Received"), receivedPrefix) {
+		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
+	}
+
+	c.expectCmd(503, "XCLIENT ADDR=192.0.2.2")
+}
+
+func TestSMTPDelivery_XCLIENT_SameAddr(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, xclientCfg("127.0.0.0/8"))
+	defer endp.Close()
+
+	c1 := dialRaw(t)
+	defer c1.Close()
+	c2 := dialRaw(t)
+	defer c2.Close()
+
+	// Upstream MTA may forward several clients with the same address at
+	// once, each connection keeps its own identity.
+	c1.expectCmd(250, "EHLO mx.example.org")
+	c2.expectCmd(250, "EHLO mx.example.org")
+	c1.expectCmd(220, "XCLIENT ADDR=192.0.2.1 HELO=client1.example.org")
+	c2.expectCmd(220, "XCLIENT ADDR=192.0.2.1 HELO=client2.example.org")
+	c1.expectCmd(250, "EHLO mx.example.org")
+	c2.expectCmd(250, "EHLO mx.example.org")
+	c1.expectCmd(221, "QUIT")
+	c1.Close()
+	c2.sendMsg("rcpt@example.com")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if hostname := tgt.Messages[0].MsgMeta.Conn.Hostname; hostname != "client2.example.org" {
+		t.Error("Wrong Hostname:", hostname)
+	}
+}
+
+func TestSMTPDelivery_XCLIENT_Login(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, xclientCfg("127.0.0.0/8"))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.expectCmd(220, "XCLIENT LOGIN=user NAME=[UNAVAILABLE]")
+	c.expectCmd(250, "EHLO mx.example.org")
+	c.sendMsg("rcpt@example.com")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MsgMeta.Conn.AuthUser != "user" {
+		t.Error("Wrong AuthUser:", msg.MsgMeta.Conn.AuthUser)
+	}
+	if rdnsName, _ := msg.MsgMeta.Conn.RDNSName.Get(); rdnsName != nil {
+		t.Error("Unexpected rDNS name:", rdnsName)
+	}
+}
+
+func TestSMTPDelivery_XCLIENT_Untrusted(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, xclientCfg("192.0.2.0/24"))
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.Close()
+
+	caps := c.expectCmd(250, "EHLO mx.example.org")
+	if strings.Contains(caps, "XCLIENT") {
+		t.Fatal("XCLIENT is advertised to untrusted client:", caps)
+	}
+	c.expectCmd(550, "XCLIENT ADDR=192.0.2.1")
+	c.sendMsg("rcpt@example.com")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if ip := tgt.Messages[0].MsgMeta.Conn.RemoteAddr.(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("Remote address was substituted:", ip)
+	}
+}
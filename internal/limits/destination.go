@@ -0,0 +1,184 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package limits
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+)
+
+// DestLimits are the limits applied to deliveries to a single destination
+// (recipient domain or MX host).
+type DestLimits struct {
+	limiters.FIFOLimits
+
+	// Max amount of messages sent using a single connection, 0 means the
+	// module default.
+	ConnMessages int
+}
+
+// DestConfig is the configuration of per-destination limits, see
+// DestDirective.
+type DestConfig struct {
+	Default   DestLimits
+	Overrides map[string]DestLimits
+}
+
+// Limits returns the limits for the destination.
+//
+// The key is normalized using dns.ForLookup.
+func (dc DestConfig) Limits(key string) DestLimits {
+	key, _ = dns.ForLookup(key)
+	if l, ok := dc.Overrides[key]; ok {
+		return l
+	}
+	return dc.Default
+}
+
+// NewFIFO creates the KeyedFIFO enforcing the concurrency and rate limits.
+//
+// Keys passed to it should be normalized using dns.ForLookup.
+func (dc DestConfig) NewFIFO(clk clock.Clock) *limiters.KeyedFIFO {
+	overrides := make(map[string]limiters.FIFOLimits, len(dc.Overrides))
+	for k, l := range dc.Overrides {
+		overrides[k] = l.FIFOLimits
+	}
+	return limiters.NewKeyedFIFO(clk, dc.Default.FIFOLimits, overrides)
+}
+
+// DestDirective returns the config.Map callback parsing the per-destination
+// limits block:
+//
+//	concurrency 10
+//	rate 100 1m
+//	<overrideName> key1 key2 ... {
+//	    concurrency 2
+//	}
+//
+// Overrides start with the default values. If connLimit is set,
+// messages_per_conn directive is also accepted.
+func DestDirective(overrideName string, connLimit bool) func(*config.Map, config.Node) (interface{}, error) {
+	return func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 0 {
+			return nil, config.NodeErr(node, "expected a block with limits")
+		}
+
+		dc := DestConfig{
+			Overrides: map[string]DestLimits{},
+		}
+		var overrides []config.Node
+		for _, child := range node.Children {
+			if child.Name == overrideName {
+				overrides = append(overrides, child)
+				continue
+			}
+			if err := parseDestLimit(child, connLimit, &dc.Default); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, child := range overrides {
+			if len(child.Args) == 0 {
+				return nil, config.NodeErr(child, "at least one %s name is required", overrideName)
+			}
+			l := dc.Default
+			for _, limit := range child.Children {
+				if err := parseDestLimit(limit, connLimit, &l); err != nil {
+					return nil, err
+				}
+			}
+			for _, key := range child.Args {
+				key, err := dns.ForLookup(key)
+				if err != nil {
+					return nil, config.NodeErr(child, "%v", err)
+				}
+				if _, ok := dc.Overrides[key]; ok {
+					return nil, config.NodeErr(child, "duplicate limits for %s", key)
+				}
+				dc.Overrides[key] = l
+			}
+		}
+
+		return dc, nil
+	}
+}
+
+func parseDestLimit(node config.Node, connLimit bool, l *DestLimits) error {
+	switch node.Name {
+	case "concurrency":
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "max concurrency value is needed")
+		}
+		max, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		if max < 0 {
+			return config.NodeErr(node, "concurrency should not be negative")
+		}
+		l.Concurrency = max
+	case "rate":
+		period := 1 * time.Second
+		switch len(node.Args) {
+		case 2:
+			var err error
+			period, err = config.ParseDuration(node.Args[1])
+			if err != nil {
+				return config.NodeErr(node, "%v", err)
+			}
+			if period <= 0 {
+				return config.NodeErr(node, "period should be positive")
+			}
+		case 1:
+		default:
+			return config.NodeErr(node, "expected messages count and an optional period")
+		}
+		count, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		if count < 0 {
+			return config.NodeErr(node, "messages count should not be negative")
+		}
+		l.Rate = count
+		l.Period = period
+	case "messages_per_conn":
+		if !connLimit {
+			return config.NodeErr(node, "unknown limit: %s", node.Name)
+		}
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "max messages count is needed")
+		}
+		max, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		if max < 0 {
+			return config.NodeErr(node, "messages count should not be negative")
+		}
+		l.ConnMessages = max
+	default:
+		return config.NodeErr(node, "unknown limit: %s", node.Name)
+	}
+	return nil
+}
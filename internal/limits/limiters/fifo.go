@@ -0,0 +1,259 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package limiters
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+)
+
+// FIFOLimits are the limits enforced by KeyedFIFO for a single key.
+//
+// Zero values mean "no limit".
+type FIFOLimits struct {
+	// Max amount of concurrently held slots.
+	Concurrency int
+
+	// Max amount of slots taken in any Period interval.
+	Rate   int
+	Period time.Duration
+}
+
+// fifoSweepThreshold is the amount of keys KeyedFIFO tracks after which it
+// attempts to remove stale ones when a new key is added.
+const fifoSweepThreshold = 1024
+
+// KeyedFIFO implements the per-key concurrency and rate limiting with
+// requests waiting for the same key served in the FIFO order. Waiting requests
+// for one key do not block requests for other keys.
+//
+// Unlike BucketSet, the state for the key is dropped as soon as it is not
+// needed anymore (no slots taken, no waiting requests and no recent slots
+// counted against the rate limit).
+type KeyedFIFO struct {
+	clk       clock.Clock
+	def       FIFOLimits
+	overrides map[string]FIFOLimits
+
+	lock sync.Mutex
+	keys map[string]*fifoKey
+}
+
+type fifoKey struct {
+	limits  FIFOLimits
+	active  int
+	starts  []time.Time
+	waiters []chan struct{}
+
+	// Set if the timer is running to wake up waiting requests when the rate
+	// limit window moves.
+	wakeupPending bool
+}
+
+// NewKeyedFIFO creates the KeyedFIFO that applies def limits to all keys
+// except ones listed in overrides.
+func NewKeyedFIFO(clk clock.Clock, def FIFOLimits, overrides map[string]FIFOLimits) *KeyedFIFO {
+	return &KeyedFIFO{
+		clk:       clk,
+		def:       def,
+		overrides: overrides,
+		keys:      map[string]*fifoKey{},
+	}
+}
+
+// Limits returns the limits applied to the key.
+func (kf *KeyedFIFO) Limits(key string) FIFOLimits {
+	if l, ok := kf.overrides[key]; ok {
+		return l
+	}
+	return kf.def
+}
+
+// Take acquires the slot for the key, waiting if necessary. If ctx is
+// cancelled while waiting, the ctx.Err() is returned and the slot is not
+// acquired.
+func (kf *KeyedFIFO) Take(ctx context.Context, key string) error {
+	kf.lock.Lock()
+	k := kf.keys[key]
+	if k == nil {
+		if len(kf.keys) >= fifoSweepThreshold {
+			kf.sweep()
+		}
+		k = &fifoKey{limits: kf.Limits(key)}
+		kf.keys[key] = k
+	}
+	now := kf.clk.Now()
+	if len(k.waiters) == 0 && k.canStart(now) {
+		k.start(now)
+		kf.lock.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	k.waiters = append(k.waiters, ready)
+	kf.scheduleWakeup(key, k, now)
+	kf.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	kf.lock.Lock()
+	defer kf.lock.Unlock()
+	for i, w := range k.waiters {
+		if w == ready {
+			k.waiters = append(k.waiters[:i], k.waiters[i+1:]...)
+			kf.cleanup(key, k)
+			return ctx.Err()
+		}
+	}
+
+	// The slot was granted concurrently with the cancellation, give it back.
+	k.active--
+	kf.pump(key, k)
+	return ctx.Err()
+}
+
+// Release returns the slot taken for the key.
+func (kf *KeyedFIFO) Release(key string) {
+	kf.lock.Lock()
+	defer kf.lock.Unlock()
+
+	k := kf.keys[key]
+	if k == nil || k.active == 0 {
+		panic("limiters: mismatched Release call")
+	}
+	k.active--
+	kf.pump(key, k)
+}
+
+// Stats returns the amount of slots taken for the key and the amount of
+// requests waiting for it.
+func (kf *KeyedFIFO) Stats(key string) (active, waiting int) {
+	kf.lock.Lock()
+	defer kf.lock.Unlock()
+
+	k := kf.keys[key]
+	if k == nil {
+		return 0, 0
+	}
+	return k.active, len(k.waiters)
+}
+
+// pump grants slots to the waiting requests in the FIFO order while limits
+// permit it.
+//
+// kf.lock should be held.
+func (kf *KeyedFIFO) pump(key string, k *fifoKey) {
+	now := kf.clk.Now()
+	for len(k.waiters) != 0 && k.canStart(now) {
+		k.start(now)
+		close(k.waiters[0])
+		k.waiters = k.waiters[1:]
+	}
+	kf.scheduleWakeup(key, k, now)
+	kf.cleanup(key, k)
+}
+
+// scheduleWakeup starts the timer to call pump once the oldest slot counted
+// against the rate limit expires. It does nothing if requests are waiting only
+// due to the concurrency limit, Release will wake them up.
+//
+// kf.lock should be held.
+func (kf *KeyedFIFO) scheduleWakeup(key string, k *fifoKey, now time.Time) {
+	if len(k.waiters) == 0 || k.wakeupPending || !k.rateExceeded(now) {
+		return
+	}
+	k.wakeupPending = true
+	wait := k.starts[0].Add(k.limits.Period).Sub(now)
+	t := kf.clk.NewTimer(wait)
+	go func() {
+		<-t.C()
+
+		kf.lock.Lock()
+		defer kf.lock.Unlock()
+		k.wakeupPending = false
+		kf.pump(key, k)
+	}()
+}
+
+// cleanup removes the key state if it is not needed anymore.
+//
+// kf.lock should be held.
+func (kf *KeyedFIFO) cleanup(key string, k *fifoKey) {
+	if k.active != 0 || len(k.waiters) != 0 || k.wakeupPending {
+		return
+	}
+	k.expire(kf.clk.Now())
+	if len(k.starts) != 0 {
+		return
+	}
+	if kf.keys[key] == k {
+		delete(kf.keys, key)
+	}
+}
+
+// sweep removes state for all keys that are not needed anymore.
+//
+// kf.lock should be held.
+func (kf *KeyedFIFO) sweep() {
+	for key, k := range kf.keys {
+		kf.cleanup(key, k)
+	}
+}
+
+func (k *fifoKey) expire(now time.Time) {
+	if k.limits.Rate <= 0 {
+		k.starts = nil
+		return
+	}
+	i := 0
+	for ; i < len(k.starts); i++ {
+		if now.Sub(k.starts[i]) < k.limits.Period {
+			break
+		}
+	}
+	k.starts = k.starts[i:]
+}
+
+func (k *fifoKey) rateExceeded(now time.Time) bool {
+	if k.limits.Rate <= 0 {
+		return false
+	}
+	k.expire(now)
+	return len(k.starts) >= k.limits.Rate
+}
+
+func (k *fifoKey) canStart(now time.Time) bool {
+	if k.limits.Concurrency > 0 && k.active >= k.limits.Concurrency {
+		return false
+	}
+	return !k.rateExceeded(now)
+}
+
+func (k *fifoKey) start(now time.Time) {
+	k.active++
+	if k.limits.Rate > 0 {
+		k.starts = append(k.starts, now)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package limiters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+)
+
+func waitFor(t *testing.T, kf *KeyedFIFO, key string, active, waiting int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		a, w := kf.Stats(key)
+		if a == active && w == waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a, w := kf.Stats(key)
+	t.Fatalf("expected %d active, %d waiting for %s, got %d, %d", active, waiting, key, a, w)
+}
+
+func TestKeyedFIFO_Concurrency(t *testing.T) {
+	kf := NewKeyedFIFO(clock.Real, FIFOLimits{Concurrency: 1}, map[string]FIFOLimits{
+		"b.example": {Concurrency: 2},
+	})
+
+	if err := kf.Take(context.Background(), "a.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			if err := kf.Take(context.Background(), "a.example"); err != nil {
+				t.Error(err)
+			}
+			order <- i
+		}()
+		waitFor(t, kf, "a.example", 1, i+1)
+	}
+
+	// Other keys are not affected.
+	for i := 0; i < 2; i++ {
+		if err := kf.Take(context.Background(), "b.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, kf, "b.example", 2, 0)
+
+	for i := 0; i < 3; i++ {
+		kf.Release("a.example")
+		if got := <-order; got != i {
+			t.Fatalf("waiters served out of order: expected %d, got %d", i, got)
+		}
+	}
+	kf.Release("a.example")
+	kf.Release("b.example")
+	kf.Release("b.example")
+
+	if len(kf.keys) != 0 {
+		t.Fatal("state is not cleaned up:", kf.keys)
+	}
+}
+
+func TestKeyedFIFO_Rate(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	kf := NewKeyedFIFO(clk, FIFOLimits{Rate: 2, Period: time.Minute}, nil)
+
+	for i := 0; i < 2; i++ {
+		if err := kf.Take(context.Background(), "a.example"); err != nil {
+			t.Fatal(err)
+		}
+		kf.Release("a.example")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if err := kf.Take(context.Background(), "a.example"); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	waitFor(t, kf, "a.example", 0, 1)
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	<-done
+	kf.Release("a.example")
+}
+
+func TestKeyedFIFO_Cancel(t *testing.T) {
+	kf := NewKeyedFIFO(clock.Real, FIFOLimits{Concurrency: 1}, nil)
+	if err := kf.Take(context.Background(), "a.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := kf.Take(ctx, "a.example"); err == nil {
+		t.Fatal("Take succeeded over the limit")
+	}
+	waitFor(t, kf, "a.example", 1, 0)
+
+	kf.Release("a.example")
+	if len(kf.keys) != 0 {
+		t.Fatal("state is not cleaned up:", kf.keys)
+	}
+}
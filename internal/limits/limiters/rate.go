@@ -22,6 +22,8 @@ import (
 	"context"
 	"errors"
 	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
 )
 
 var (
@@ -44,6 +46,12 @@ type Rate struct {
 }
 
 func NewRate(burstSize int, interval time.Duration) Rate {
+	return NewRateClock(clock.Real, burstSize, interval)
+}
+
+// NewRateClock is similar to NewRate but uses the specified Clock to wait
+// for the refill interval.
+func NewRateClock(clk clock.Clock, burstSize int, interval time.Duration) Rate {
 	r := Rate{
 		bucket: make(chan struct{}, burstSize),
 		stop:   make(chan struct{}),
@@ -57,17 +65,17 @@ func NewRate(burstSize int, interval time.Duration) Rate {
 		r.bucket <- struct{}{}
 	}
 
-	go r.fill(burstSize, interval)
+	go r.fill(clk, burstSize, interval)
 	return r
 }
 
-func (r Rate) fill(burstSize int, interval time.Duration) {
-	t := time.NewTimer(interval)
+func (r Rate) fill(clk clock.Clock, burstSize int, interval time.Duration) {
+	t := clk.NewTimer(interval)
 	defer t.Stop()
 	for {
 		t.Reset(interval)
 		select {
-		case <-t.C:
+		case <-t.C():
 		case <-r.stop:
 			close(r.bucket)
 			return
@@ -95,6 +103,21 @@ func (r Rate) Take() bool {
 	return ok
 }
 
+// TryTake is similar to Take but returns false instead of blocking if the
+// rate limit is exceeded.
+func (r Rate) TryTake() bool {
+	if cap(r.bucket) == 0 {
+		return true
+	}
+
+	select {
+	case _, ok := <-r.bucket:
+		return ok
+	default:
+		return false
+	}
+}
+
 func (r Rate) TakeContext(ctx context.Context) error {
 	if cap(r.bucket) == 0 {
 		return nil
@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limiters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+)
+
+func TestRate_Refill(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	r := NewRateClock(clk, 2, time.Minute)
+	defer r.Close()
+
+	for i := 0; i < 2; i++ {
+		if !r.Take() {
+			t.Fatal("Take failed")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.TakeContext(ctx); err == nil {
+		t.Fatal("Take succeeded before refill")
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if !r.Take() {
+			t.Fatal("Take failed after refill")
+		}
+	}
+}
+
+func TestRate_TryTake(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	r := NewRateClock(clk, 2, time.Minute)
+	defer r.Close()
+
+	for i := 0; i < 2; i++ {
+		if !r.TryTake() {
+			t.Fatal("TryTake failed")
+		}
+	}
+	if r.TryTake() {
+		t.Fatal("TryTake succeeded before refill")
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+
+	// Refill is done asynchronously.
+	if !r.Take() {
+		t.Fatal("Take failed after refill")
+	}
+	if !r.TryTake() {
+		t.Fatal("TryTake failed after refill")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tenancy"
+)
+
+const aliasModName = "modify.alias"
+
+// alias implements the classic /etc/aliases behavior: recipient address is
+// replaced with one or more addresses from the table, the replacements are
+// expanded recursively.
+type alias struct {
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	table    module.Table
+	maxDepth int
+	tenants  tenancy.Policy
+}
+
+func NewAlias(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &alias{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: aliasModName},
+	}, nil
+}
+
+func (a *alias) Name() string {
+	return aliasModName
+}
+
+func (a *alias) InstanceName() string {
+	return a.instName
+}
+
+func (a *alias) Init(cfg *config.Map) error {
+	if len(a.inlineArgs) != 0 {
+		if err := modconfig.ModuleFromNode("table", a.inlineArgs, config.Node{}, cfg.Globals, &a.table); err != nil {
+			return err
+		}
+	}
+
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Custom("table", false, len(a.inlineArgs) == 0, nil, modconfig.TableDirective, &a.table)
+	cfg.Int("max_depth", false, false, 10, &a.maxDepth)
+	cfg.Custom("tenant_table", false, false, nil, modconfig.TableDirective, &a.tenants.Table)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if a.maxDepth < 1 {
+		return fmt.Errorf("%s: max_depth should be positive", aliasModName)
+	}
+	if a.tenants.Table != nil && !a.tenants.Listable() {
+		return fmt.Errorf("%s: tenant_table: table does not support listing of keys", aliasModName)
+	}
+	return nil
+}
+
+func (a *alias) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return a, nil
+}
+
+func (a *alias) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (a *alias) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	rcpts, err := a.expand(rcptTo, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(rcpts) != 1 || rcpts[0] != rcptTo {
+		a.log.DebugMsg("expanded", "rcpt", rcptTo, "result", rcpts)
+	}
+	return rcpts, nil
+}
+
+func (a *alias) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (a *alias) Close() error {
+	return nil
+}
+
+// lookup returns the list of replacements for the address.
+//
+// The whole address is looked up first, then the local-part is looked up
+// separately. The domain of the original address is added to replacements
+// without one.
+func (a *alias) lookup(addr string) ([]string, bool, error) {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed address: %v", err)
+	}
+
+	mbox, domain, err := address.Split(normAddr)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	vals, ok, err := a.lookupTable(normAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok && domain != "" {
+		vals, ok, err = a.lookupTable(mbox)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if !ok || domain == "" {
+		return vals, ok, nil
+	}
+	for i, val := range vals {
+		if !strings.Contains(val, "@") {
+			vals[i] = val + "@" + domain
+		}
+	}
+	return vals, true, nil
+}
+
+// lookupTable returns all values for the key. Multiple values can be
+// returned by tables implementing module.MultiTable or separated by commas.
+func (a *alias) lookupTable(key string) ([]string, bool, error) {
+	var raw []string
+	if mt, ok := a.table.(module.MultiTable); ok {
+		var err error
+		raw, err = mt.LookupMulti(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(raw) == 0 {
+			return nil, false, nil
+		}
+	} else {
+		val, ok, err := a.table.Lookup(key)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		raw = []string{val}
+	}
+
+	var vals []string
+	for _, r := range raw {
+		for _, val := range strings.Split(r, ",") {
+			val = strings.TrimSpace(val)
+			if val == "" {
+				continue
+			}
+			vals = append(vals, val)
+		}
+	}
+	return vals, true, nil
+}
+
+func (a *alias) expand(addr string, path []string) ([]string, error) {
+	targets, ok, err := a.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []string{addr}, nil
+	}
+	if len(path) >= a.maxDepth {
+		return nil, &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+			Message:      "Alias expansion depth limit exceeded",
+			Misc: map[string]interface{}{
+				"modifier": aliasModName,
+				"path":     path,
+			},
+		}
+	}
+	if len(targets) == 0 {
+		return nil, &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "Alias has no targets",
+			Misc: map[string]interface{}{
+				"modifier": aliasModName,
+				"rcpt":     addr,
+			},
+		}
+	}
+
+	normAddr, _ := address.ForLookup(addr)
+	path = append(path, normAddr)
+
+	var (
+		res  []string
+		seen = make(map[string]struct{}, len(targets))
+	)
+	for _, target := range targets {
+		if !address.Valid(target) {
+			return nil, fmt.Errorf("refusing to replace recipient with the invalid address %s", target)
+		}
+		normTarget, err := address.ForLookup(target)
+		if err != nil {
+			return nil, fmt.Errorf("refusing to replace recipient with the invalid address %s", target)
+		}
+
+		if a.tenants.Table != nil {
+			if err := checkTenant(a.tenants, aliasModName, addr, target); err != nil {
+				return nil, err
+			}
+		}
+
+		var expanded []string
+		switch {
+		case normTarget == normAddr:
+			// Alias includes the address itself (e.g. "bob: bob, bob@example.com"),
+			// deliver to it directly.
+			expanded = []string{target}
+		case inPath(path, normTarget):
+			return nil, &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+				Message:      "Alias expansion loop detected",
+				Misc: map[string]interface{}{
+					"modifier": aliasModName,
+					"path":     append(path, normTarget),
+				},
+			}
+		default:
+			expanded, err = a.expand(target, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, rcpt := range expanded {
+			normRcpt, _ := address.ForLookup(rcpt)
+			if _, ok := seen[normRcpt]; ok {
+				continue
+			}
+			seen[normRcpt] = struct{}{}
+			res = append(res, rcpt)
+		}
+	}
+	return res, nil
+}
+
+func inPath(path []string, addr string) bool {
+	for _, p := range path {
+		if p == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	module.Register(aliasModName, NewAlias)
+}
@@ -0,0 +1,193 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type multiTable map[string][]string
+
+func (m multiTable) Lookup(key string) (string, bool, error) {
+	vals, ok := m[key]
+	if !ok || len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func (m multiTable) LookupMulti(key string) ([]string, error) {
+	return m[key], nil
+}
+
+func testAlias(t *testing.T, tbl module.Table) *alias {
+	t.Helper()
+	return &alias{
+		table:    tbl,
+		maxDepth: 10,
+		log:      testutils.Logger(t, aliasModName),
+	}
+}
+
+func TestAlias(t *testing.T) {
+	a := testAlias(t, testutils.Table{M: map[string]string{
+		"postmaster":          "admin@example.org, backup@example.org",
+		"team@example.org":    "alice, bob@example.com",
+		"all@example.org":     "team@example.org, postmaster@example.org, admin@example.org",
+		"self@example.org":    "self@example.org, archive@example.org",
+		"nested1@example.org": "nested2@example.org",
+		"nested2@example.org": "nested3@example.org",
+		"nested3@example.org": "final@example.org",
+		"empty@example.org":   "",
+		"invalid@example.org": "not an address",
+	}})
+
+	test := func(addr string, expected []string, fail bool) {
+		t.Helper()
+		actual, err := a.RewriteRcpt(context.Background(), addr)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", addr, actual)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: want %v, got %v", addr, expected, actual)
+		}
+	}
+
+	test("unrelated@example.org", []string{"unrelated@example.org"}, false)
+	test("postmaster@example.org", []string{"admin@example.org", "backup@example.org"}, false)
+	test("Postmaster@example.org", []string{"admin@example.org", "backup@example.org"}, false)
+	test("postmaster", []string{"admin@example.org", "backup@example.org"}, false)
+	test("team@example.org", []string{"alice@example.org", "bob@example.com"}, false)
+	test("all@example.org", []string{"alice@example.org", "bob@example.com", "admin@example.org", "backup@example.org"}, false)
+	test("self@example.org", []string{"self@example.org", "archive@example.org"}, false)
+	test("nested1@example.org", []string{"final@example.org"}, false)
+	test("empty@example.org", nil, true)
+	test("invalid@example.org", nil, true)
+}
+
+func TestAlias_Loop(t *testing.T) {
+	a := testAlias(t, testutils.Table{M: map[string]string{
+		"a@example.org": "b@example.org",
+		"b@example.org": "c@example.org",
+		"c@example.org": "a@example.org",
+	}})
+
+	_, err := a.RewriteRcpt(context.Background(), "a@example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("expected SMTPError, got %v", err)
+	}
+	if smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 4, 6}) {
+		t.Errorf("wrong enhanced code: %v", smtpErr.EnhancedCode)
+	}
+}
+
+func TestAlias_DepthLimit(t *testing.T) {
+	a := testAlias(t, testutils.Table{M: map[string]string{
+		"a@example.org": "b@example.org",
+		"b@example.org": "c@example.org",
+		"c@example.org": "d@example.org",
+	}})
+
+	a.maxDepth = 3
+	rcpts, err := a.RewriteRcpt(context.Background(), "a@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rcpts, []string{"d@example.org"}) {
+		t.Errorf("wrong result: %v", rcpts)
+	}
+
+	a.maxDepth = 2
+	if _, err := a.RewriteRcpt(context.Background(), "a@example.org"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestAlias_MultiTable(t *testing.T) {
+	a := testAlias(t, multiTable{
+		"postmaster@example.org": {"admin@example.org", "backup@example.org, other@example.org"},
+	})
+
+	rcpts, err := a.RewriteRcpt(context.Background(), "postmaster@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"admin@example.org", "backup@example.org", "other@example.org"}
+	if !reflect.DeepEqual(rcpts, expected) {
+		t.Errorf("want %v, got %v", expected, rcpts)
+	}
+}
+
+func TestAlias_TenantTable(t *testing.T) {
+	mod, err := NewAlias(aliasModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*alias)
+	err = a.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "table",
+				Args: []string{"table.static"},
+				Children: []config.Node{
+					{Name: "entry", Args: []string{"sales@a.example", "alice@a.example, bob@b.example"}},
+					{Name: "entry", Args: []string{"team@a.example", "alice@a.example, ext@external.example"}},
+				},
+			},
+			{
+				Name: "tenant_table",
+				Args: []string{"table.static"},
+				Children: []config.Node{
+					{Name: "entry", Args: []string{"alice@a.example", "a.example"}},
+					{Name: "entry", Args: []string{"bob@b.example", "b.example"}},
+				},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.RewriteRcpt(context.Background(), "sales@a.example"); err == nil {
+		t.Error("expected cross-tenant expansion to be rejected")
+	}
+	rcpts, err := a.RewriteRcpt(context.Background(), "team@a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alice@a.example", "ext@external.example"}
+	if !reflect.DeepEqual(rcpts, expected) {
+		t.Errorf("want %v, got %v", expected, rcpts)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package attachments implements the modifier that removes dangerous
+// attachments from the message.
+package attachments
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.strip_attachments"
+
+const (
+	actionStrip      = "strip"
+	actionRename     = "rename"
+	actionQuarantine = "quarantine"
+)
+
+var defaultExtensions = []string{
+	"ade", "adp", "apk", "bat", "chm", "cmd", "com", "cpl", "dll", "exe",
+	"hta", "ins", "isp", "jar", "js", "jse", "lib", "lnk", "mde", "msc",
+	"msi", "msp", "mst", "pif", "ps1", "scr", "sct", "shb", "sys", "vb",
+	"vbe", "vbs", "vxd", "wsc", "wsf", "wsh",
+}
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	extensions        map[string]struct{}
+	maxAttachmentSize int
+	checkContent      bool
+	action            string
+	renameSuffix      string
+	maxSize           int
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var extensions []string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.StringList("extensions", false, false, defaultExtensions, &extensions)
+	cfg.DataSize("max_attachment_size", false, false, 0, &m.maxAttachmentSize)
+	cfg.Bool("check_content", false, true, &m.checkContent)
+	cfg.Enum("action", false, false,
+		[]string{actionStrip, actionRename, actionQuarantine}, actionStrip, &m.action)
+	cfg.String("rename_suffix", false, false, ".removed", &m.renameSuffix)
+	cfg.DataSize("max_size", false, false, 32*1024*1024, &m.maxSize)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	m.extensions = make(map[string]struct{}, len(extensions))
+	for _, ext := range extensions {
+		m.extensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = struct{}{}
+	}
+	return nil
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+// ReplaceBody implements module.BodyReplacingModifierState.
+func (s *state) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, modName+"/ReplaceBody").End()
+
+	if body.Len() > s.m.maxSize {
+		s.log.Msg("message is too big, not checking attachments", "size", body.Len())
+		return nil, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	blob, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Work on the copy so the header is not changed if nothing is removed.
+	hdrCopy := h.Copy()
+	newBody, verdicts := s.m.processEntity(&hdrCopy, blob, 0)
+	for _, v := range verdicts {
+		s.log.Msg("dangerous attachment", "filename", v.filename, "reason", v.reason, "action", s.m.action)
+	}
+	if len(verdicts) == 0 {
+		return nil, nil
+	}
+
+	if s.m.action == actionQuarantine {
+		s.msgMeta.Quarantine = true
+		return nil, nil
+	}
+	if newBody == nil {
+		return nil, nil
+	}
+
+	*h = hdrCopy
+	return buffer.MemoryBuffer{Slice: newBody}, nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,269 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testModifier(t *testing.T, children ...config.Node) *Modifier {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modName)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// processMsg runs the message through the modifier and returns the
+// resulting message. Body is nil if it is not changed.
+func processMsg(t *testing.T, m *Modifier, msgMeta *module.MsgMetadata, msg string) (textproto.Header, []byte) {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := buffer.MemoryBuffer{Slice: []byte(msg[strings.Index(msg, "\r\n\r\n")+4:])}
+
+	newBody, err := state.(module.BodyReplacingModifierState).ReplaceBody(context.Background(), &hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBody == nil {
+		return hdr, nil
+	}
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, blob
+}
+
+const textPart = "Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello!"
+
+const pdfPart = "Content-Type: application/pdf\r\n" +
+	"Content-Disposition:  attachment;\r\n" +
+	"  filename=\"report.pdf\"\r\n" +
+	"\r\n" +
+	"%PDF-1.4 ..."
+
+func multipartMsg(parts ...string) string {
+	msg := "From: <from@example.org>\r\n" +
+		"Content-Type: multipart/mixed; boundary=BBB\r\n" +
+		"\r\n" +
+		"This is a multi-part message.\r\n"
+	for _, part := range parts {
+		msg += "--BBB\r\n" + part + "\r\n"
+	}
+	return msg + "--BBB--\r\n" + "epilogue\r\n"
+}
+
+func TestStrip_Clean(t *testing.T) {
+	m := testModifier(t)
+	msgMeta := &module.MsgMetadata{}
+	_, body := processMsg(t, m, msgMeta, multipartMsg(textPart, pdfPart))
+	if body != nil {
+		t.Fatalf("body changed:\n%s", body)
+	}
+	if msgMeta.Quarantine {
+		t.Fatal("message quarantined")
+	}
+}
+
+func TestStrip_Extension(t *testing.T) {
+	m := testModifier(t)
+	exePart := "Content-Type: application/octet-stream; name=\"setup.EXE\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAAA"
+
+	_, body := processMsg(t, m, &module.MsgMetadata{}, multipartMsg(textPart, exePart, pdfPart))
+	if body == nil {
+		t.Fatal("body not changed")
+	}
+
+	notice := "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"\r\n" +
+		"The attachment \"setup.EXE\" was removed: file type .exe is not allowed."
+	want := multipartMsg(textPart, notice, pdfPart)
+	want = want[strings.Index(want, "\r\n\r\n")+4:]
+	// Untouched parts must be preserved byte-for-byte.
+	if string(body) != want {
+		t.Errorf("wrong body:\n%q\nwant:\n%q", body, want)
+	}
+}
+
+func TestStrip_ContentMismatch(t *testing.T) {
+	m := testModifier(t)
+	fakeImage := "Content-Type: image/png\r\n" +
+		"Content-Disposition: attachment; filename=\"cat.png\"\r\n" +
+		"\r\n" +
+		"%PDF-1.4 ..."
+	fakeDoc := "Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"invoice.doc\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"TVqQAAMAAAAEAAAA//8AALgAAAAAAAAAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\r\n"
+
+	_, body := processMsg(t, m, &module.MsgMetadata{}, multipartMsg(textPart, fakeImage, fakeDoc))
+	if body == nil {
+		t.Fatal("body not changed")
+	}
+	if !strings.Contains(string(body), "\"cat.png\" was removed: attachment content does not match its declared type") {
+		t.Errorf("cat.png is not removed:\n%s", body)
+	}
+	if !strings.Contains(string(body), "\"invoice.doc\" was removed: attachment contains executable code") {
+		t.Errorf("invoice.doc is not removed:\n%s", body)
+	}
+
+	m = testModifier(t, config.Node{Name: "check_content", Args: []string{"no"}})
+	_, body = processMsg(t, m, &module.MsgMetadata{}, multipartMsg(textPart, fakeImage, fakeDoc))
+	if body != nil {
+		t.Fatalf("body changed with check_content no:\n%s", body)
+	}
+}
+
+func TestStrip_Size(t *testing.T) {
+	m := testModifier(t, config.Node{Name: "max_attachment_size", Args: []string{"5b"}})
+	_, body := processMsg(t, m, &module.MsgMetadata{}, multipartMsg(textPart, pdfPart))
+	if !strings.Contains(string(body), "\"report.pdf\" was removed: attachment is too big") {
+		t.Errorf("report.pdf is not removed:\n%s", body)
+	}
+	if !strings.Contains(string(body), textPart) {
+		t.Errorf("text part is removed:\n%s", body)
+	}
+}
+
+func TestStrip_Nested(t *testing.T) {
+	m := testModifier(t)
+	attached := "Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: Fwd\r\n" +
+		"Content-Type: multipart/alternative; boundary=CCC\r\n" +
+		"\r\n" +
+		"--CCC\r\n" +
+		textPart + "\r\n" +
+		"--CCC\r\n" +
+		"Content-Type: text/javascript; name=a.js\r\n" +
+		"\r\n" +
+		"alert(1)\r\n" +
+		"--CCC--\r\n"
+
+	_, body := processMsg(t, m, &module.MsgMetadata{}, multipartMsg(textPart, attached))
+	if !strings.Contains(string(body), "\"a.js\" was removed") {
+		t.Errorf("a.js is not removed:\n%s", body)
+	}
+	if !strings.Contains(string(body), "Subject: Fwd\r\n") {
+		t.Errorf("attached message header is lost:\n%s", body)
+	}
+}
+
+func TestStrip_SinglePart(t *testing.T) {
+	m := testModifier(t)
+	msg := "From: <from@example.org>\r\n" +
+		"Content-Type: application/x-msdownload\r\n" +
+		"Content-Disposition: attachment; filename=virus.scr\r\n" +
+		"\r\n" +
+		"MZ..."
+
+	hdr, body := processMsg(t, m, &module.MsgMetadata{}, msg)
+	if body == nil {
+		t.Fatal("body not changed")
+	}
+	if hdr.Get("From") != "<from@example.org>" {
+		t.Error("From is lost")
+	}
+	if hdr.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("wrong Content-Type:", hdr.Get("Content-Type"))
+	}
+	if hdr.Get("Content-Disposition") != "inline" {
+		t.Error("wrong Content-Disposition:", hdr.Get("Content-Disposition"))
+	}
+}
+
+func TestStrip_Rename(t *testing.T) {
+	m := testModifier(t, config.Node{Name: "action", Args: []string{"rename"}})
+	jsPart := "Content-Type: application/javascript\r\n" +
+		"Content-Disposition: attachment; filename=\"run.js\"\r\n" +
+		"\r\n" +
+		"alert(1)"
+
+	_, body := processMsg(t, m, &module.MsgMetadata{}, multipartMsg(textPart, jsPart))
+	if !strings.Contains(string(body), "Content-Disposition: attachment; filename=run.js.removed\r\n") {
+		t.Errorf("run.js is not renamed:\n%s", body)
+	}
+	if !strings.Contains(string(body), "\r\n\r\nalert(1)\r\n--BBB--") {
+		t.Errorf("run.js content is changed:\n%s", body)
+	}
+}
+
+func TestStrip_Quarantine(t *testing.T) {
+	m := testModifier(t, config.Node{Name: "action", Args: []string{"quarantine"}})
+	jsPart := "Content-Type: application/javascript\r\n" +
+		"Content-Disposition: attachment; filename=\"run.js\"\r\n" +
+		"\r\n" +
+		"alert(1)"
+
+	msgMeta := &module.MsgMetadata{}
+	_, body := processMsg(t, m, msgMeta, multipartMsg(textPart, jsPart))
+	if body != nil {
+		t.Fatalf("body changed:\n%s", body)
+	}
+	if !msgMeta.Quarantine {
+		t.Fatal("message is not quarantined")
+	}
+}
+
+func TestSplitMultipart_Malformed(t *testing.T) {
+	_, ok := splitMultipart([]byte("--BBB\r\nContent-Type: text/plain\r\n\r\nHello"), "BBB")
+	if ok {
+		t.Fatal("missing closing delimiter is not detected")
+	}
+}
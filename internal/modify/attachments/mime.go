@@ -0,0 +1,333 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Max. nesting of multipart entities and attached messages that is
+// processed, deeper parts are left as is.
+const maxDepth = 16
+
+// span is the byte range of a part in the multipart body, including the part
+// header.
+type span struct {
+	start, end int
+}
+
+// splitMultipart returns the byte ranges of multipart body parts. Delimiter
+// lines and the line breaks preceding them are not included so the parts can
+// be replaced in place keeping the rest of the body (including the preamble
+// and epilogue) byte-for-byte.
+//
+// ok is false if the body is malformed (e.g. there is no closing delimiter).
+func splitMultipart(body []byte, boundary string) (parts []span, ok bool) {
+	delim := []byte("--" + boundary)
+
+	partStart := -1
+	for lineStart := 0; lineStart < len(body); {
+		lineEnd := bytes.IndexByte(body[lineStart:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(body)
+		} else {
+			lineEnd += lineStart + 1
+		}
+		line := body[lineStart:lineEnd]
+
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t\r\n")
+			closing := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || closing {
+				if partStart != -1 {
+					// Line break before the delimiter belongs to it.
+					end := lineStart
+					if end > partStart && body[end-1] == '\n' {
+						end--
+						if end > partStart && body[end-1] == '\r' {
+							end--
+						}
+					}
+					parts = append(parts, span{partStart, end})
+				}
+				if closing {
+					return parts, true
+				}
+				partStart = lineEnd
+			}
+		}
+		lineStart = lineEnd
+	}
+	return nil, false
+}
+
+// splitPart splits the raw part into the parsed header and the raw body.
+func splitPart(raw []byte) (textproto.Header, []byte, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	body, err := ioutil.ReadAll(br)
+	return hdr, body, err
+}
+
+// verdict is the result of the attachment check.
+type verdict struct {
+	filename string
+	reason   string
+}
+
+// filename returns the attachment file name, if any.
+func filename(hdr textproto.Header) string {
+	mhdr := message.Header{Header: hdr}
+	_, params, err := mhdr.ContentDisposition()
+	if err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	_, params, err = mhdr.ContentType()
+	if err == nil && params["name"] != "" {
+		return params["name"]
+	}
+	return ""
+}
+
+func isAttachment(hdr textproto.Header) bool {
+	disp, _, err := mime.ParseMediaType(hdr.Get("Content-Disposition"))
+	if err == nil && disp == "attachment" {
+		return true
+	}
+	return filename(hdr) != ""
+}
+
+func decodeBody(encoding string, raw []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(raw)), ""))
+	default:
+		return raw, nil
+	}
+}
+
+func isExecutable(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("MZ")) || bytes.HasPrefix(content, []byte("\x7fELF"))
+}
+
+// typeMismatch reports whether the sniffed content type contradicts the
+// declared one. Only types that are commonly used to disguise other content
+// are checked.
+func typeMismatch(declared string, content []byte) bool {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") {
+		// Unknown content, nothing to compare with.
+		return false
+	}
+	switch {
+	case strings.HasPrefix(declared, "image/"):
+		return !strings.HasPrefix(sniffed, "image/")
+	case declared == "application/pdf":
+		return sniffed != "application/pdf"
+	}
+	return false
+}
+
+// check checks the leaf part and returns the non-nil verdict if the part
+// should be removed.
+func (m *Modifier) check(hdr textproto.Header, body []byte) *verdict {
+	if !isAttachment(hdr) {
+		return nil
+	}
+	name := filename(hdr)
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if _, ok := m.extensions[ext]; ok && ext != "" {
+		return &verdict{filename: name, reason: "file type ." + ext + " is not allowed"}
+	}
+
+	content, err := decodeBody(hdr.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		content = body
+	}
+
+	if m.maxAttachmentSize > 0 && len(content) > m.maxAttachmentSize {
+		return &verdict{filename: name, reason: "attachment is too big"}
+	}
+
+	if m.checkContent {
+		if isExecutable(content) {
+			return &verdict{filename: name, reason: "attachment contains executable code"}
+		}
+		declared, _, _ := mime.ParseMediaType(hdr.Get("Content-Type"))
+		if typeMismatch(declared, content) {
+			return &verdict{filename: name, reason: "attachment content does not match its declared type"}
+		}
+	}
+
+	return nil
+}
+
+// processEntity checks the entity with the specified header and body and
+// removes or renames the dangerous attachments.
+//
+// If the entity is changed, the new body is returned (header is changed in
+// place). Otherwise, nil is returned and the header is not touched. All
+// verdicts are returned, even if the entity is not changed (quarantine
+// action).
+func (m *Modifier) processEntity(hdr *textproto.Header, body []byte, depth int) ([]byte, []verdict) {
+	if depth > maxDepth {
+		return nil, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		return m.processMultipart(body, params["boundary"], depth)
+	}
+
+	if err == nil && mediaType == "message/rfc822" {
+		switch strings.ToLower(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding"))) {
+		case "", "7bit", "8bit", "binary":
+			newMsg, verdicts := m.processRaw(body, depth+1)
+			return newMsg, verdicts
+		}
+	}
+
+	v := m.check(*hdr, body)
+	if v == nil {
+		return nil, nil
+	}
+	return m.apply(hdr, body, *v), []verdict{*v}
+}
+
+// processRaw processes the raw entity with the header.
+func (m *Modifier) processRaw(raw []byte, depth int) ([]byte, []verdict) {
+	hdr, body, err := splitPart(raw)
+	if err != nil {
+		// Leave malformed parts as is.
+		return nil, nil
+	}
+
+	newBody, verdicts := m.processEntity(&hdr, body, depth)
+	if newBody == nil {
+		return nil, verdicts
+	}
+
+	var out bytes.Buffer
+	if err := textproto.WriteHeader(&out, hdr); err != nil {
+		return nil, verdicts
+	}
+	out.Write(newBody)
+	return out.Bytes(), verdicts
+}
+
+func (m *Modifier) processMultipart(body []byte, boundary string, depth int) ([]byte, []verdict) {
+	parts, ok := splitMultipart(body, boundary)
+	if !ok {
+		return nil, nil
+	}
+
+	var (
+		out      bytes.Buffer
+		last     int
+		changed  bool
+		verdicts []verdict
+	)
+	for _, part := range parts {
+		newPart, partVerdicts := m.processRaw(body[part.start:part.end], depth+1)
+		verdicts = append(verdicts, partVerdicts...)
+		if newPart == nil {
+			continue
+		}
+		changed = true
+		out.Write(body[last:part.start])
+		out.Write(newPart)
+		last = part.end
+	}
+	if !changed {
+		return nil, verdicts
+	}
+	out.Write(body[last:])
+	return out.Bytes(), verdicts
+}
+
+// apply changes the removed part according to the configured action and
+// returns the new body. It returns nil if the part should be left as is.
+func (m *Modifier) apply(hdr *textproto.Header, body []byte, v verdict) []byte {
+	switch m.action {
+	case actionRename:
+		name := v.filename
+		if name == "" {
+			name = "attachment"
+		}
+		name += m.renameSuffix
+		hdr.Set("Content-Type", mime.FormatMediaType("application/octet-stream", map[string]string{"name": name}))
+		hdr.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		return body
+	case actionStrip:
+		notice := "The attachment was removed: " + v.reason + "."
+		if v.filename != "" {
+			notice = "The attachment \"" + v.filename + "\" was removed: " + v.reason + "."
+		}
+
+		// Keep the fields unrelated to the content (e.g. From for the
+		// top-level entity).
+		fields := hdr.Fields()
+		for fields.Next() {
+			if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+				fields.Del()
+			}
+		}
+
+		// Fields are added in reverse order since they are prepended.
+		if !isASCII(notice) {
+			var out bytes.Buffer
+			w := quotedprintable.NewWriter(&out)
+			w.Write([]byte(notice))
+			w.Close()
+			notice = out.String()
+			hdr.Add("Content-Transfer-Encoding", "quoted-printable")
+		}
+		hdr.Add("Content-Disposition", "inline")
+		hdr.Add("Content-Type", "text/plain; charset=utf-8")
+		return []byte(notice)
+	default:
+		return nil
+	}
+}
+
+func isASCII(s string) bool {
+	for _, chr := range s {
+		if chr > 127 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/batv"
+)
+
+// batvTag is a module that adds BATV tags to the MAIL FROM address of
+// outbound messages and removes valid tags from recipient addresses of
+// inbound bounces.
+//
+// Tags created by other servers are not valid for our keys so they are never
+// removed from recipient addresses.
+type batvTag struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	tagger *batv.Tagger
+	bypass []string
+	now    func() time.Time
+}
+
+func NewBATV(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &batvTag{
+		modName:  modName,
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		now:      time.Now,
+	}, nil
+}
+
+func (bt *batvTag) Init(cfg *config.Map) error {
+	var (
+		keysFile string
+		signKey  int
+		validity time.Duration
+	)
+	cfg.Bool("debug", true, false, &bt.log.Debug)
+	cfg.String("keys_file", false, true, "", &keysFile)
+	cfg.Int("sign_key", false, false, -1, &signKey)
+	cfg.Duration("validity", false, false, 7*24*time.Hour, &validity)
+	cfg.StringList("bypass", false, false, nil, &bt.bypass)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, pattern := range bt.bypass {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: malformed bypass pattern %s: %v", bt.modName, pattern, err)
+		}
+	}
+
+	var err error
+	bt.tagger, err = batv.NewTagger(keysFile, signKey, validity)
+	if err != nil {
+		return fmt.Errorf("%s: %w", bt.modName, err)
+	}
+	return nil
+}
+
+func (bt *batvTag) Name() string {
+	return bt.modName
+}
+
+func (bt *batvTag) InstanceName() string {
+	return bt.instName
+}
+
+func (bt *batvTag) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return bt, nil
+}
+
+// batvBypass reports whether the address matches any of the patterns.
+func batvBypass(patterns []string, addr string) bool {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, normAddr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (bt *batvTag) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if mailFrom == "" || batvBypass(bt.bypass, mailFrom) {
+		return mailFrom, nil
+	}
+
+	tagged, err := bt.tagger.Sign(mailFrom, bt.now())
+	if err != nil {
+		bt.log.Error("failed to sign sender address", err, "mail_from", mailFrom)
+		return mailFrom, nil
+	}
+	return tagged, nil
+}
+
+func (bt *batvTag) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if !batv.IsTagged(rcptTo) {
+		return []string{rcptTo}, nil
+	}
+
+	orig, err := bt.tagger.Verify(rcptTo, bt.now())
+	if err != nil {
+		bt.log.Debugf("not removing tag from %s: %v", rcptTo, err)
+		return []string{rcptTo}, nil
+	}
+	return []string{orig}, nil
+}
+
+func (bt *batvTag) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (bt *batvTag) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.batv", NewBATV)
+}
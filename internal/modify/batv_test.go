@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestBATV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-batv-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keysFile, []byte("0 secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewBATV("modify.batv", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*batvTag)
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "keys_file", Args: []string{keysFile}},
+			{Name: "bypass", Args: []string{"*-bounces+*@example.org"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagged, err := m.RewriteSender(context.Background(), "foo@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tagged, "prvs=0") || !strings.HasSuffix(tagged, "=foo@example.org") {
+		t.Fatal("Sender is not tagged:", tagged)
+	}
+
+	for _, addr := range []string{"", "list-bounces+foo=example.com@example.org"} {
+		res, err := m.RewriteSender(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != addr {
+			t.Errorf("%q should not be tagged, got %q", addr, res)
+		}
+	}
+
+	orig, err := m.RewriteRcpt(context.Background(), tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orig) != 1 || orig[0] != "foo@example.org" {
+		t.Error("Tag is not removed from the recipient:", orig)
+	}
+
+	// Tag created by other server, should be kept.
+	foreign := "prvs=0123abcdef=foo@example.com"
+	res, err := m.RewriteRcpt(context.Background(), foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != foreign {
+		t.Error("Foreign tag is removed:", res)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/text/unicode/norm"
+)
+
+const catchAllModName = "modify.catchall"
+
+// catchAll is a module that redirects messages for non-existent mailboxes to
+// the per-domain catch-all address.
+//
+// The original address is recorded in MsgMetadata.OriginalRcpts by the
+// message pipeline and is added to the message header for each catch-all
+// recipient.
+type catchAll struct {
+	instName string
+	log      log.Logger
+
+	mailboxes module.Table
+	// Domain -> catch-all address.
+	targets module.Table
+	// Normalized local-parts and addresses that are never redirected.
+	except     map[string]struct{}
+	origHeader string
+}
+
+func NewCatchAll(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", catchAllModName)
+	}
+	return &catchAll{
+		instName: instName,
+		log:      log.Logger{Name: catchAllModName},
+	}, nil
+}
+
+func (c *catchAll) Name() string {
+	return catchAllModName
+}
+
+func (c *catchAll) InstanceName() string {
+	return c.instName
+}
+
+func (c *catchAll) Init(cfg *config.Map) error {
+	var except []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("mailboxes", false, true, nil, modconfig.TableDirective, &c.mailboxes)
+	cfg.Custom("targets", false, true, nil, modconfig.TableDirective, &c.targets)
+	cfg.StringList("except", false, false, nil, &except)
+	cfg.String("original_header", false, false, "X-Original-To", &c.origHeader)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.except, err = parseExcept(except)
+	if err != nil {
+		return err
+	}
+
+	if c.origHeader != "" && !validFieldName(c.origHeader) {
+		return fmt.Errorf("%s: invalid header field name: %s", catchAllModName, c.origHeader)
+	}
+	return nil
+}
+
+func parseExcept(list []string) (map[string]struct{}, error) {
+	except := make(map[string]struct{}, len(list))
+	for _, addr := range list {
+		if !strings.Contains(addr, "@") {
+			// Local-part, matches any domain.
+			except[strings.ToLower(norm.NFC.String(addr))] = struct{}{}
+			continue
+		}
+		normAddr, err := address.ForLookup(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid except address: %s: %v", catchAllModName, addr, err)
+		}
+		except[normAddr] = struct{}{}
+	}
+	return except, nil
+}
+
+// redirect returns the catch-all address the message for rcptTo should be
+// delivered to. Empty string is returned if rcptTo should not be changed.
+func (c *catchAll) redirect(rcptTo string) (string, error) {
+	normAddr, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return "", nil
+	}
+	mbox, domain, err := address.Split(normAddr)
+	if err != nil || mbox == "" || domain == "" {
+		return "", nil
+	}
+
+	if _, ok := c.except[normAddr]; ok {
+		return "", nil
+	}
+	if _, ok := c.except[mbox]; ok {
+		return "", nil
+	}
+
+	_, exists, err := c.mailboxes.Lookup(normAddr)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", nil
+	}
+
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return "", nil
+	}
+	catchAllAddr, ok, err := c.targets.Lookup(normDomain)
+	if err != nil {
+		return "", err
+	}
+	if !ok || catchAllAddr == "" {
+		return "", nil
+	}
+
+	// Leave the recipient as is so it will be rejected as usual instead of
+	// creating a mail loop or silently losing messages.
+	normCatchAll, err := address.ForLookup(catchAllAddr)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid catch-all address for %s: %v", catchAllModName, normDomain, err)
+	}
+	_, exists, err = c.mailboxes.Lookup(normCatchAll)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		c.log.Msg("catch-all mailbox does not exist", "domain", normDomain, "catch_all", catchAllAddr)
+		return "", nil
+	}
+
+	return catchAllAddr, nil
+}
+
+type catchAllState struct {
+	c   *catchAll
+	log log.Logger
+
+	// Catch-all address -> original recipients.
+	caught map[string][]string
+}
+
+func (c *catchAll) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &catchAllState{
+		c:   c,
+		log: target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (cs *catchAllState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (cs *catchAllState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	catchAllAddr, err := cs.c.redirect(rcptTo)
+	if err != nil {
+		return nil, err
+	}
+	if catchAllAddr == "" {
+		return []string{rcptTo}, nil
+	}
+
+	cs.log.Debugf("redirected to catch-all: %s => %s", rcptTo, catchAllAddr)
+	if cs.caught == nil {
+		cs.caught = make(map[string][]string)
+	}
+	cs.caught[catchAllAddr] = append(cs.caught[catchAllAddr], rcptTo)
+	return []string{catchAllAddr}, nil
+}
+
+func (cs *catchAllState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+// RcptHeader implements module.RcptHeaderModifierState.
+func (cs *catchAllState) RcptHeader(ctx context.Context, rcptTo string, h *textproto.Header) error {
+	if cs.c.origHeader == "" {
+		return nil
+	}
+	for _, original := range cs.caught[rcptTo] {
+		h.Add(cs.c.origHeader, target.SanitizeForHeader(original))
+	}
+	return nil
+}
+
+func (cs *catchAllState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(catchAllModName, NewCatchAll)
+}
@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package modify
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCatchAll(t *testing.T, mailboxes module.Table, except ...string) *catchAll {
+	t.Helper()
+
+	exceptMap, err := parseExcept(except)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &catchAll{
+		log:       testutils.Logger(t, catchAllModName),
+		mailboxes: mailboxes,
+		targets: testutils.Table{M: map[string]string{
+			"example.org": "catchall@example.org",
+			"example.com": "nonexistent@example.com",
+		}},
+		except:     exceptMap,
+		origHeader: "X-Original-To",
+	}
+}
+
+var testMailboxes = testutils.Table{M: map[string]string{
+	"user@example.org":     "",
+	"catchall@example.org": "",
+}}
+
+func TestCatchAll(t *testing.T) {
+	c := testCatchAll(t, testMailboxes, "noreply", "blocked@example.org")
+
+	test := func(rcpt, expected string) {
+		t.Helper()
+		state, err := c.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcpts, err := state.RewriteRcpt(context.Background(), rcpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rcpts) != 1 || rcpts[0] != expected {
+			t.Errorf("%s: want %s, got %v", rcpt, expected, rcpts)
+		}
+	}
+
+	test("user@example.org", "user@example.org")
+	test("USER@example.org", "USER@example.org")
+	test("unknown@example.org", "catchall@example.org")
+	test("unknown@EXAMPLE.ORG", "catchall@example.org")
+	// Domain without a catch-all.
+	test("unknown@example.net", "unknown@example.net")
+	// Catch-all mailbox does not exist.
+	test("unknown@example.com", "unknown@example.com")
+	// Explicitly excluded addresses.
+	test("noreply@example.org", "noreply@example.org")
+	test("NoReply@example.org", "NoReply@example.org")
+	test("blocked@example.org", "blocked@example.org")
+	test("postmaster", "postmaster")
+}
+
+func TestCatchAll_LookupErr(t *testing.T) {
+	c := testCatchAll(t, testutils.Table{Err: errors.New("lookup failed")})
+
+	state, err := c.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteRcpt(context.Background(), "unknown@example.org"); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
+
+func TestCatchAll_OriginalHeader(t *testing.T) {
+	c := testCatchAll(t, testMailboxes)
+
+	state, err := c.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"user@example.org", "unknown1@example.org", "unknown2@example.org"} {
+		if _, err := state.RewriteRcpt(context.Background(), rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stamp := func(rcpt string) []string {
+		t.Helper()
+		h := textproto.Header{}
+		if err := state.(module.RcptHeaderModifierState).RcptHeader(context.Background(), rcpt, &h); err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for f := h.FieldsByKey("X-Original-To"); f.Next(); {
+			values = append(values, f.Value())
+		}
+		return values
+	}
+
+	if values := stamp("user@example.org"); len(values) != 0 {
+		t.Error("X-Original-To added for an existing mailbox:", values)
+	}
+	values := stamp("catchall@example.org")
+	// Fields are prepended.
+	expected := []string{"unknown2@example.org", "unknown1@example.org"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Wrong X-Original-To: want %v, got %v", expected, values)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+// ARCSealer implements the modify.arc module that adds ARC set (RFC 8617) to
+// the message.
+//
+// Sealing is done in SealBody so the seal covers changes done by all other
+// modifiers, including Authentication-Results field added by the message
+// pipeline.
+type ARCSealer struct {
+	instName string
+
+	domain         string
+	selector       string
+	signer         crypto.Signer
+	authServID     string
+	oversignHeader []string
+	signHeader     []string
+
+	resolver dns.Resolver
+	log      log.Logger
+}
+
+func NewARCSealer(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &ARCSealer{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: "modify.arc"},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		m.domain = inlineArgs[0]
+		m.selector = inlineArgs[1]
+	default:
+		return nil, errors.New("modify.arc: domain and selector are expected as inline arguments")
+	}
+
+	return m, nil
+}
+
+func (m *ARCSealer) Name() string {
+	return "modify.arc"
+}
+
+func (m *ARCSealer) InstanceName() string {
+	return m.instName
+}
+
+func (m *ARCSealer) Init(cfg *config.Map) error {
+	var (
+		keyPathTemplate string
+		newKeyAlgo      string
+		hostname        string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("domain", false, false, m.domain, &m.domain)
+	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
+	cfg.StringList("sign_fields", false, false, append(signDefault, "DKIM-Signature"), &m.signHeader)
+	cfg.String("authserv_id", false, false, "", &m.authServID)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.domain == "" {
+		return errors.New("modify.arc: domain is not specified")
+	}
+	if m.selector == "" {
+		return errors.New("modify.arc: selector is not specified")
+	}
+	if m.authServID == "" {
+		m.authServID = hostname
+	}
+	if m.authServID == "" {
+		return errors.New("modify.arc: authserv_id is not specified and hostname is not set")
+	}
+
+	signers, err := loadKeys(m.log, []string{m.domain}, m.selector, keyPathTemplate, newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	for _, signer := range signers {
+		m.signer = signer
+	}
+
+	// ARC header fields are not subject to EAI rules, use A-labels
+	// unconditionally.
+	m.domain, err = idna.ToASCII(m.domain)
+	if err != nil {
+		return fmt.Errorf("modify.arc: %w", err)
+	}
+	m.selector, err = idna.ToASCII(m.selector)
+	if err != nil {
+		return fmt.Errorf("modify.arc: %w", err)
+	}
+
+	return nil
+}
+
+type arcState struct {
+	m    *ARCSealer
+	meta *module.MsgMetadata
+	log  log.Logger
+}
+
+func (m *ARCSealer) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &arcState{
+		m:    m,
+		meta: msgMeta,
+		log:  target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *arcState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *arcState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *arcState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+// chainStatus returns the validation status of the existing ARC chain.
+//
+// The arc= result from Authentication-Results added by the message pipeline
+// (check.arc) is used if present, otherwise the chain is validated by the
+// sealer itself.
+func (s *arcState) chainStatus(ctx context.Context, h textproto.Header, body buffer.Buffer) (arc.Status, error) {
+	fields := h.FieldsByKey("Authentication-Results")
+	for fields.Next() {
+		id, results, err := authres.Parse(fields.Value())
+		if err != nil || !strings.EqualFold(id, s.m.authServID) {
+			continue
+		}
+		for _, res := range results {
+			res, ok := res.(*authres.GenericResult)
+			if !ok || res.Method != "arc" {
+				continue
+			}
+			switch status := arc.Status(res.Value); status {
+			case arc.StatusNone, arc.StatusPass, arc.StatusFail:
+				return status, nil
+			default:
+				return "", fmt.Errorf("unexpected arc=%s result", res.Value)
+			}
+		}
+		break
+	}
+
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer bodyRdr.Close()
+	res, err := arc.Verify(ctx, s.m.resolver, h, bodyRdr)
+	if err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+func (s *arcState) SealBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.arc/SealBody").End()
+
+	cv, err := s.chainStatus(ctx, *h, body)
+	if err != nil {
+		s.log.Error("unable to determine chain validation status, not sealing", err)
+		return nil
+	}
+
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+	defer bodyRdr.Close()
+
+	err = arc.Seal(h, bodyRdr, arc.SealOptions{
+		Domain:      s.m.domain,
+		Selector:    s.m.selector,
+		Signer:      s.m.signer,
+		AuthServID:  s.m.authServID,
+		ChainStatus: cv,
+		HeaderKeys:  fieldsToSign(h, s.m.oversignHeader, s.m.signHeader),
+	})
+	switch {
+	case errors.Is(err, arc.ErrChainFailed), errors.Is(err, arc.ErrTooManySets):
+		s.log.Msg("not sealing", "reason", err.Error())
+		return nil
+	case err != nil:
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+
+	s.log.DebugMsg("sealed", "cv", string(cv))
+	return nil
+}
+
+func (s *arcState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.arc", NewARCSealer)
+}
@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestSealer(t *testing.T, dir string, zones map[string]mockdns.Zone) *ARCSealer {
+	mod, err := NewARCSealer("", "test", nil, []string{"example.org", "arc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*ARCSealer)
+	m.log = testutils.Logger(t, m.Name())
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "key_path",
+				Args: []string{filepath.Join(dir, "{domain}.key")},
+			},
+			{
+				Name: "newkey_algo",
+				Args: []string{"ed25519"},
+			},
+			{
+				Name: "authserv_id",
+				Args: []string{"mx.example.org"},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := ioutil.ReadFile(filepath.Join(dir, "example.org.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones["arc._domainkey.example.org."] = mockdns.Zone{TXT: []string{string(record)}}
+	m.resolver = &mockdns.Resolver{Zones: zones}
+
+	return m
+}
+
+func sealTestMsg(t *testing.T, m *ARCSealer, hdr *textproto.Header, body []byte) {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if err := state.RewriteBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.(module.SealingModifierState).SealBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestHdr(t *testing.T, authRes string) (textproto.Header, []byte) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader("From: <foo@example.org>\r\nSubject: Hello\r\n\r\nHello!\r\n"))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authRes != "" {
+		hdr.Add("Authentication-Results", authRes)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, body
+}
+
+func verifyARCMsg(t *testing.T, zones map[string]mockdns.Zone, hdr textproto.Header, body []byte) arc.Result {
+	t.Helper()
+	res, err := arc.Verify(context.Background(), &mockdns.Resolver{Zones: zones}, hdr, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestARCSealer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-arc-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zones := map[string]mockdns.Zone{}
+	m := newTestSealer(t, dir, zones)
+
+	// check.arc result is used as the chain validation status.
+	hdr, body := readTestHdr(t, "mx.example.org; arc=none")
+	sealTestMsg(t, m, &hdr, body)
+	if !strings.HasPrefix(hdr.Get(arc.FieldAuthResults), "i=1; mx.example.org; arc=none") {
+		t.Errorf("wrong ARC-Authentication-Results: %s", hdr.Get(arc.FieldAuthResults))
+	}
+	res := verifyARCMsg(t, zones, hdr, body)
+	if res.Status != arc.StatusPass || res.Instances != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// No arc= result, the sealer validates the chain itself.
+	hdr.Del("Authentication-Results")
+	sealTestMsg(t, m, &hdr, body)
+	if !strings.Contains(hdr.Get(arc.FieldSeal), "cv=pass") {
+		t.Errorf("wrong ARC-Seal: %s", hdr.Get(arc.FieldSeal))
+	}
+	res = verifyARCMsg(t, zones, hdr, body)
+	if res.Status != arc.StatusPass || res.Instances != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// arc=fail reported by the check should be propagated.
+	hdr.Add("Authentication-Results", "mx.example.org; arc=fail")
+	sealTestMsg(t, m, &hdr, body)
+	if !strings.Contains(hdr.Get(arc.FieldSeal), "cv=fail") {
+		t.Errorf("wrong ARC-Seal: %s", hdr.Get(arc.FieldSeal))
+	}
+	res = verifyARCMsg(t, zones, hdr, body)
+	if res.Status != arc.StatusFail {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// Failed chain is not extended.
+	sealTestMsg(t, m, &hdr, body)
+	if n := hdr.FieldsByKey(arc.FieldSeal).Len(); n != 3 {
+		t.Fatalf("failed chain was extended, %d ARC-Seal fields", n)
+	}
+}
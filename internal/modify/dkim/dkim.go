@@ -22,23 +22,25 @@ import (
 	"context"
 	"crypto"
 	"errors"
-	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tenancy"
 	"golang.org/x/net/idna"
 )
 
@@ -108,6 +110,9 @@ type Modifier struct {
 	senderMatch    map[string]struct{}
 	multipleFromOk bool
 	signSubdomains bool
+	domainSource   string
+	signMismatched bool
+	tenants        tenancy.Policy
 
 	log log.Logger
 }
@@ -169,6 +174,10 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		[]string{"envelope", "auth_domain", "auth_user", "off"}, []string{"envelope", "auth"}, &senderMatch)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Enum("domain_source", false, false,
+		[]string{"envelope", "header"}, "envelope", &m.domainSource)
+	cfg.Bool("sign_mismatched", false, false, &m.signMismatched)
+	cfg.Custom("tenant_table", false, false, nil, modconfig.TableDirective, &m.tenants.Table)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -197,46 +206,26 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		panic("modify.dkim.Init: Hash function allowed by config matcher but not present in hashFuncs")
 	}
 
-	for _, domain := range m.domains {
-		if _, err := idna.ToASCII(domain); err != nil {
-			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
-		}
-
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
-
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
-		if err != nil {
-			return err
-		}
-
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
-		}
-
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
-		}
-		m.signers[normDomain] = signer
+	var err error
+	m.signers, err = loadKeys(m.log, m.domains, m.selector, keyPathTemplate, newKeyAlgo)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
+	return fieldsToSign(h, m.oversignHeader, m.signHeader)
+}
+
+func fieldsToSign(h *textproto.Header, oversignHeader, signHeader []string) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
 	seen := make(map[string]struct{})
 
-	res := make([]string, 0, len(m.oversignHeader)+len(m.signHeader))
-	for _, key := range m.oversignHeader {
+	res := make([]string, 0, len(oversignHeader)+len(signHeader))
+	for _, key := range oversignHeader {
 		if _, ok := seen[strings.ToLower(key)]; ok {
 			continue
 		}
@@ -249,7 +238,7 @@ func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 		// And once more to "oversign" it.
 		res = append(res, key)
 	}
-	for _, key := range m.signHeader {
+	for _, key := range signHeader {
 		if _, ok := seen[strings.ToLower(key)]; ok {
 			continue
 		}
@@ -283,24 +272,27 @@ func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, err
 	return mailFrom, nil
 }
 
-func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
-	return rcptTo, nil
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
 }
 
 func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
-	defer trace.StartRegion(ctx, "modify.dkim/RewriteBody").End()
+	return nil
+}
 
-	var domain string
-	if s.from != "" {
-		var err error
-		_, domain, err = address.Split(s.from)
-		if err != nil {
-			return err
-		}
+// SealBody implements module.SealingModifierState. Signing is done after
+// RewriteBody of all modifiers so the signature is not broken by modifiers
+// that change or remove header fields, regardless of their order in the
+// configuration.
+func (s *state) SealBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.dkim/SealBody").End()
+
+	domain, ok, err := s.senderDomain(h)
+	if err != nil {
+		return err
 	}
-	// Use first key for null return path (<>) and postmaster (<postmaster>)
-	if domain == "" {
-		domain = s.m.domains[0]
+	if !ok {
+		return nil
 	}
 	selector := s.m.selector
 
@@ -312,13 +304,27 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	}
 	normDomain, err := dns.ForLookup(domain)
 	if err != nil {
-		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
+		s.log.Error("unable to normalize sender domain", err, "domain", domain)
 		return nil
 	}
 	keySigner := s.m.signers[normDomain]
 	if keySigner == nil {
-		s.log.Msg("no key for domain", "domain", normDomain)
-		return nil
+		if !s.m.signMismatched {
+			s.log.Msg("no key for domain", "domain", normDomain)
+			return nil
+		}
+
+		s.log.DebugMsg("no key for domain, using the first one", "domain", normDomain)
+		domain = s.m.domains[0]
+		normDomain, err = dns.ForLookup(domain)
+		if err != nil {
+			return nil
+		}
+		keySigner = s.m.signers[normDomain]
+	}
+
+	if err := s.checkTenant(normDomain); err != nil {
+		return err
 	}
 
 	// If the message is non-EAI, we are not allowed to use domains in U-labels,
@@ -378,6 +384,67 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	return nil
 }
 
+// senderDomain returns the domain used to select the signing key. It is taken
+// either from the envelope sender or from the From header field, depending on
+// the domain_source directive.
+//
+// ok is false if the message should not be signed.
+func (s *state) senderDomain(h *textproto.Header) (domain string, ok bool, err error) {
+	if s.m.domainSource != "header" {
+		if s.from != "" {
+			_, domain, err = address.Split(s.from)
+			if err != nil {
+				return "", false, err
+			}
+		}
+		// Use first key for null return path (<>) and postmaster (<postmaster>)
+		if domain == "" {
+			domain = s.m.domains[0]
+		}
+		return domain, true, nil
+	}
+
+	mailHdr := mail.Header{Header: message.Header{Header: *h}}
+	from, err := mailHdr.AddressList("From")
+	if err != nil || len(from) == 0 {
+		s.log.Msg("missing or malformed From header field, not signing", "err", err)
+		return "", false, nil
+	}
+	if len(from) > 1 && !s.m.multipleFromOk {
+		s.log.Msg("multiple addresses in From header field, not signing")
+		return "", false, nil
+	}
+	_, domain, err = address.Split(from[0].Address)
+	if err != nil || domain == "" {
+		s.log.Msg("no domain in From header field, not signing", "from", from[0].Address)
+		return "", false, nil
+	}
+	return domain, true, nil
+}
+
+// checkTenant verifies that the authenticated user is entitled to use the
+// signing domain according to the tenant sending policy.
+func (s *state) checkTenant(domain string) error {
+	if s.m.tenants.Table == nil || s.meta.Conn == nil || s.meta.Conn.AuthUser == "" {
+		return nil
+	}
+	username := s.meta.Conn.AuthUser
+
+	ok, err := s.m.tenants.Allowed(username, domain)
+	if err != nil {
+		return exterrors.WithFields(tenancy.LookupError(err), map[string]interface{}{"modifier": "modify.dkim"})
+	}
+	if !ok {
+		s.log.Msg("refusing to sign for the domain", "username", username, "domain", domain)
+		return exterrors.WithFields(
+			tenancy.ViolationError("signing domain is not allowed for the account", map[string]interface{}{
+				"username": username,
+				"domain":   domain,
+			}), map[string]interface{}{"modifier": "modify.dkim"})
+	}
+	return nil
+}
+
 func (s state) Close() error {
 	return nil
 }
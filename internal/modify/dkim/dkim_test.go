@@ -34,6 +34,7 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -97,7 +98,7 @@ func signTestMsg(t *testing.T, m *Modifier, envelopeFrom string) (textproto.Head
 	if _, err := state.RewriteSender(context.Background(), envelopeFrom); err != nil {
 		panic(err)
 	}
-	err = state.RewriteBody(context.Background(), &testHdr, buffer.MemoryBuffer{Slice: body})
+	err = state.(module.SealingModifierState).SealBody(context.Background(), &testHdr, buffer.MemoryBuffer{Slice: body})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -250,3 +251,160 @@ func TestFieldsToSign(t *testing.T) {
 		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
 	}
 }
+
+func TestTenantPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestModifier(t, dir, "ed25519", []string{"a.maddy.test", "b.maddy.test"})
+	m.tenants.Table = testutils.Table{M: map[string]string{
+		"alice@a.maddy.test": "a.maddy.test",
+	}}
+
+	test := func(authUser, envelopeFrom string, expectErr bool) {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{AuthUser: authUser},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", "<"+envelopeFrom+">")
+		if _, err := state.RewriteSender(context.Background(), envelopeFrom); err != nil {
+			t.Fatal(err)
+		}
+		err = state.(module.SealingModifierState).SealBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")})
+		if (err != nil) != expectErr {
+			t.Errorf("%s as %s: want error=%v, got %v", authUser, envelopeFrom, expectErr, err)
+		}
+		if err != nil && hdr.Has("DKIM-Signature") {
+			t.Errorf("%s as %s: message is signed", authUser, envelopeFrom)
+		}
+	}
+
+	test("alice@a.maddy.test", "alice@a.maddy.test", false)
+	test("alice@a.maddy.test", "alice@A.MADDY.TEST", false)
+	test("alice@a.maddy.test", "bob@b.maddy.test", true)
+	// Null sender is signed using the first domain, a.maddy.test.
+	test("alice@a.maddy.test", "", false)
+	test("bob@b.maddy.test", "", true)
+	test("bob@b.maddy.test", "bob@b.maddy.test", true)
+	// Unauthenticated messages are not subject to the policy.
+	test("", "bob@b.maddy.test", false)
+}
+
+func signMsgFrom(t *testing.T, m *Modifier, envelopeFrom, headerFrom string) (textproto.Header, []byte) {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", headerFrom)
+	hdr.Add("Subject", "heya")
+	body := []byte("hello there\r\n")
+
+	if _, err := state.RewriteSender(context.Background(), envelopeFrom); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.(module.SealingModifierState).SealBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	return hdr, body
+}
+
+func TestDomainSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestModifier(t, dir, "ed25519", []string{"a.maddy.test", "b.maddy.test"})
+
+	hdr, body := signMsgFrom(t, m, "bounces@a.maddy.test", "<user@b.maddy.test>")
+	verifyTestMsg(t, dir, []string{"a.maddy.test"}, hdr, body)
+
+	m.domainSource = "header"
+	hdr, body = signMsgFrom(t, m, "bounces@a.maddy.test", "<user@b.maddy.test>")
+	verifyTestMsg(t, dir, []string{"b.maddy.test"}, hdr, body)
+
+	hdr, _ = signMsgFrom(t, m, "bounces@a.maddy.test", "<user@b.maddy.test>, <user@a.maddy.test>")
+	if hdr.Has("DKIM-Signature") {
+		t.Error("Message with multiple From addresses is signed")
+	}
+	m.multipleFromOk = true
+	hdr, body = signMsgFrom(t, m, "bounces@a.maddy.test", "<user@b.maddy.test>, <user@a.maddy.test>")
+	verifyTestMsg(t, dir, []string{"b.maddy.test"}, hdr, body)
+}
+
+func TestSignMismatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestModifier(t, dir, "ed25519", []string{"a.maddy.test"})
+
+	hdr, _ := signMsgFrom(t, m, "user@c.maddy.test", "<user@c.maddy.test>")
+	if hdr.Has("DKIM-Signature") {
+		t.Error("Message without configured key is signed")
+	}
+
+	m.signMismatched = true
+	hdr, body := signMsgFrom(t, m, "user@c.maddy.test", "<user@c.maddy.test>")
+	verifyTestMsg(t, dir, []string{"a.maddy.test"}, hdr, body)
+}
+
+func TestSignAfterHeaderChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	// Header modifier is specified after modify.dkim but the signature should
+	// still cover the changed header.
+	replace, err := modify.NewHeader("modify.replace_header", "", nil, []string{"Subject", "heya", "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replace.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	group := modify.Group{Modifiers: []module.Modifier{m, replace.(module.Modifier)}}
+
+	state, err := group.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("From", "<test@maddy.test>")
+	hdr.Add("Subject", "heya")
+	body := []byte("hello there\r\n")
+
+	if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.(module.SealingModifierState).SealBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	if subject := hdr.Get("Subject"); subject != "hello" {
+		t.Fatal("Subject is not changed:", subject)
+	}
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, body)
+}
@@ -32,13 +32,64 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"golang.org/x/net/idna"
 )
 
-func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
+// loadKeys loads or generates keys for all specified domains using
+// keyPathTemplate with {domain} and {selector} placeholders.
+//
+// Returned map is keyed by the domain name normalized using dns.ForLookup.
+func loadKeys(l log.Logger, domains []string, selector, keyPathTemplate, newKeyAlgo string) (map[string]crypto.Signer, error) {
+	signers := make(map[string]crypto.Signer, len(domains))
+	for _, domain := range domains {
+		if _, err := idna.ToASCII(domain); err != nil {
+			l.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
+		}
+
+		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", selector)
+		keyPath := keyValues.Replace(keyPathTemplate)
+
+		signer, newKey, err := loadOrGenerateKey(l, keyPath, newKeyAlgo)
+		if err != nil {
+			return nil, err
+		}
+
+		if newKey {
+			dnsPath := keyPath + ".dns"
+			if filepath.Ext(keyPath) == ".key" {
+				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+			}
+			l.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+				newKeyAlgo, keyPath, dnsPath, selector, domain)
+			if record, err := ioutil.ReadFile(dnsPath); err == nil {
+				l.Printf("%s._domainkey.%s TXT \"%s\"", selector, domain, record)
+			}
+		}
+
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return nil, fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+		}
+		signers[normDomain] = signer
+	}
+	return signers, nil
+}
+
+func loadOrGenerateKey(l log.Logger, keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
 	f, err := os.Open(keyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			pkey, err = m.generateAndWrite(keyPath, newKeyAlgo)
+			if config.CheckOnly {
+				l.Printf("%s does not exist, a new key will be generated on start", keyPath)
+				return nil, false, nil
+			}
+			pkey, err = generateAndWrite(l, keyPath, newKeyAlgo)
 			return pkey, true, err
 		}
 		return nil, false, err
@@ -92,12 +143,12 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 	}
 }
 
-func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer, error) {
+func generateAndWrite(l log.Logger, keyPath, newKeyAlgo string) (crypto.Signer, error) {
 	wrapErr := func(err error) error {
 		return fmt.Errorf("modify.dkim: generate %s: %w", keyPath, err)
 	}
 
-	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
+	l.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
 		pkey     crypto.Signer
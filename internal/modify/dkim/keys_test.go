@@ -41,7 +41,7 @@ func TestKeyLoad_new(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	signer, newKey, err := m.loadOrGenerateKey(filepath.Join(dir, "testkey.key"), "ed25519")
+	signer, newKey, err := loadOrGenerateKey(m.log, filepath.Join(dir, "testkey.key"), "ed25519")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,7 +95,7 @@ func TestKeyLoad_existing_pkcs8(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	signer, newKey, err := m.loadOrGenerateKey(filepath.Join(dir, "testkey.key"), "ed25519")
+	signer, newKey, err := loadOrGenerateKey(m.log, filepath.Join(dir, "testkey.key"), "ed25519")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -151,7 +151,7 @@ func TestKeyLoad_existing_pkcs1(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	signer, newKey, err := m.loadOrGenerateKey(filepath.Join(dir, "testkey.key"), "rsa2048")
+	signer, newKey, err := loadOrGenerateKey(m.log, filepath.Join(dir, "testkey.key"), "rsa2048")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const envelopeHeadersModName = "modify.envelope_headers"
+
+// envelopeHeaders is a module that adds Delivered-To, X-Original-To and
+// Return-Path header fields reflecting the message envelope for each
+// recipient.
+//
+// Since the values differ for each recipient, it implements
+// module.RcptHeaderModifierState and the message pipeline delivers the message
+// to each recipient separately.
+type envelopeHeaders struct {
+	instName string
+	log      log.Logger
+
+	deliveredTo bool
+	originalTo  bool
+	returnPath  bool
+	loopCheck   bool
+}
+
+func NewEnvelopeHeaders(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", envelopeHeadersModName)
+	}
+	return &envelopeHeaders{
+		instName: instName,
+		log:      log.Logger{Name: envelopeHeadersModName},
+	}, nil
+}
+
+func (e *envelopeHeaders) Name() string {
+	return envelopeHeadersModName
+}
+
+func (e *envelopeHeaders) InstanceName() string {
+	return e.instName
+}
+
+func (e *envelopeHeaders) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &e.log.Debug)
+	cfg.Bool("delivered_to", false, true, &e.deliveredTo)
+	cfg.Bool("original_to", false, true, &e.originalTo)
+	cfg.Bool("return_path", false, false, &e.returnPath)
+	cfg.Bool("loop_check", false, true, &e.loopCheck)
+	_, err := cfg.Process()
+	return err
+}
+
+type envelopeHeadersState struct {
+	e        *envelopeHeaders
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
+	mailFrom string
+}
+
+func (e *envelopeHeaders) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &envelopeHeadersState{
+		e:       e,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(e.log, msgMeta),
+	}, nil
+}
+
+func (es *envelopeHeadersState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	es.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (es *envelopeHeadersState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (es *envelopeHeadersState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+// sameAddr reports whether the Delivered-To field value refers to the
+// address.
+func sameAddr(fieldValue, addr string) bool {
+	fieldValue = strings.TrimSpace(fieldValue)
+	fieldValue = strings.TrimSuffix(strings.TrimPrefix(fieldValue, "<"), ">")
+
+	normField, err := address.ForLookup(fieldValue)
+	if err != nil {
+		return false
+	}
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	return normField == normAddr
+}
+
+func (es *envelopeHeadersState) RcptHeader(ctx context.Context, rcptTo string, h *textproto.Header) error {
+	if es.e.loopCheck {
+		fields := h.FieldsByKey("Delivered-To")
+		for fields.Next() {
+			if sameAddr(fields.Value(), rcptTo) {
+				es.log.Msg("mail loop detected", "rcpt", rcptTo)
+				return &exterrors.SMTPError{
+					Code:         554,
+					EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+					Message:      "Mail loop detected",
+					Misc: map[string]interface{}{
+						"modifier": envelopeHeadersModName,
+						"rcpt":     rcptTo,
+					},
+				}
+			}
+		}
+	}
+
+	// Fields are prepended, so the order is reversed: Return-Path is the
+	// topmost one.
+	if es.e.deliveredTo {
+		h.Add("Delivered-To", target.SanitizeForHeader(rcptTo))
+	}
+	if es.e.originalTo {
+		originalTo := rcptTo
+		if orig, ok := es.msgMeta.OriginalRcpts[rcptTo]; ok {
+			originalTo = orig
+		}
+		h.Add("X-Original-To", target.SanitizeForHeader(originalTo))
+	}
+	if es.e.returnPath {
+		h.Del("Return-Path")
+		h.Add("Return-Path", "<"+target.SanitizeForHeader(es.mailFrom)+">")
+	}
+	return nil
+}
+
+func (es *envelopeHeadersState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(envelopeHeadersModName, NewEnvelopeHeaders)
+}
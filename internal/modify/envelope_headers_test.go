@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testEnvelopeHeaders(t *testing.T, children ...config.Node) *envelopeHeaders {
+	t.Helper()
+
+	mod, err := NewEnvelopeHeaders(envelopeHeadersModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*envelopeHeaders)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func stampTestHeader(t *testing.T, m *envelopeHeaders, msgMeta *module.MsgMetadata, rcptTo string, h textproto.Header) (textproto.Header, error) {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteSender(context.Background(), "sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	err = state.(module.RcptHeaderModifierState).RcptHeader(context.Background(), rcptTo, &h)
+	return h, err
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	m := testEnvelopeHeaders(t, config.Node{Name: "return_path", Args: []string{"yes"}})
+
+	h := textproto.Header{}
+	h.Add("Return-Path", "<spoofed@example.org>")
+	h.Add("Delivered-To", "other@example.com")
+	h, err := stampTestHeader(t, m, &module.MsgMetadata{
+		OriginalRcpts: map[string]string{"rcpt@example.com": "alias@example.com"},
+	}, "rcpt@example.com", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []string
+	for f := h.Fields(); f.Next(); {
+		fields = append(fields, f.Key()+": "+f.Value())
+	}
+	expected := []string{
+		"Return-Path: <sender@example.org>",
+		"X-Original-To: alias@example.com",
+		"Delivered-To: rcpt@example.com",
+		"Delivered-To: other@example.com",
+	}
+	if len(fields) != len(expected) {
+		t.Fatalf("wrong header: %v", fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Errorf("wrong field %d: want %q, got %q", i, expected[i], fields[i])
+		}
+	}
+}
+
+func TestEnvelopeHeaders_Loop(t *testing.T) {
+	m := testEnvelopeHeaders(t)
+
+	h := textproto.Header{}
+	h.Add("Delivered-To", "<RCPT@example.com>")
+	_, err := stampTestHeader(t, m, &module.MsgMetadata{}, "rcpt@example.com", h)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	smtpErr, ok := err.(*exterrors.SMTPError)
+	if !ok || smtpErr.Code != 554 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 4, 6}) {
+		t.Errorf("wrong error: %#v", err)
+	}
+
+	m = testEnvelopeHeaders(t, config.Node{Name: "loop_check", Args: []string{"no"}})
+	if _, err := stampTestHeader(t, m, &module.MsgMetadata{}, "rcpt@example.com", h); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
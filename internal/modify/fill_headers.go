@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/google/uuid"
+	"golang.org/x/net/idna"
+)
+
+const fillHeadersModName = "modify.fill_headers"
+
+// fillHeaders is a module that adds the Message-ID, Date and, optionally,
+// From header fields if they are missing in messages submitted by
+// authenticated clients.
+//
+// Existing fields are never changed. Messages from unauthenticated sources
+// are passed as is so the module can be used in blocks shared with the
+// inbound mail.
+type fillHeaders struct {
+	instName string
+	log      log.Logger
+	clock    clock.Clock
+
+	hostname  string
+	messageID bool
+	date      bool
+	from      bool
+}
+
+func NewFillHeaders(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", fillHeadersModName)
+	}
+	return &fillHeaders{
+		instName: instName,
+		log:      log.Logger{Name: fillHeadersModName},
+		clock:    clock.Real,
+	}, nil
+}
+
+func (f *fillHeaders) Name() string {
+	return fillHeadersModName
+}
+
+func (f *fillHeaders) InstanceName() string {
+	return f.instName
+}
+
+func (f *fillHeaders) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.String("hostname", true, false, "", &f.hostname)
+	cfg.Bool("message_id", false, true, &f.messageID)
+	cfg.Bool("date", false, true, &f.date)
+	cfg.Bool("from", false, false, &f.from)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if f.messageID {
+		if f.hostname == "" {
+			return errors.New("modify.fill_headers: hostname is required to generate Message-ID")
+		}
+		var err error
+		f.hostname, err = idna.ToASCII(f.hostname)
+		if err != nil {
+			return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", fillHeadersModName, err)
+		}
+	}
+	return nil
+}
+
+type fillHeadersState struct {
+	f        *fillHeaders
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
+	mailFrom string
+}
+
+func (f *fillHeaders) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &fillHeadersState{
+		f:       f,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(f.log, msgMeta),
+	}, nil
+}
+
+func (fs *fillHeadersState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	fs.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (fs *fillHeadersState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+// identity returns the address of the authenticated user or an empty string
+// if it is not known.
+func (fs *fillHeadersState) identity() string {
+	if strings.Contains(fs.msgMeta.Conn.AuthUser, "@") {
+		return fs.msgMeta.Conn.AuthUser
+	}
+	// Usernames without a domain are common for local accounts, the envelope
+	// sender is the next best thing then since it was already authorized by
+	// the submission pipeline.
+	return fs.mailFrom
+}
+
+func (fs *fillHeadersState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if fs.msgMeta.Conn == nil || fs.msgMeta.Conn.AuthUser == "" {
+		return nil
+	}
+
+	if fs.f.messageID && !h.Has("Message-ID") {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("%s: Message-ID generation failed: %w", fillHeadersModName, err)
+		}
+		fs.log.DebugMsg("adding missing Message-ID")
+		h.Add("Message-ID", "<"+id.String()+"@"+fs.f.hostname+">")
+	}
+	if fs.f.date && !h.Has("Date") {
+		fs.log.DebugMsg("adding missing Date")
+		h.Add("Date", fs.f.clock.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+	if fs.f.from && !h.Has("From") {
+		if from := fs.identity(); from != "" {
+			fs.log.DebugMsg("adding missing From", "from", from)
+			h.Add("From", "<"+target.SanitizeForHeader(from)+">")
+		}
+	}
+	return nil
+}
+
+func (fs *fillHeadersState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(fillHeadersModName, NewFillHeaders)
+}
@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testFillHeaders(t *testing.T, children ...config.Node) *fillHeaders {
+	t.Helper()
+
+	mod, err := NewFillHeaders(fillHeadersModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*fillHeaders)
+	children = append(children, config.Node{Name: "hostname", Args: []string{"mx.example.org"}})
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	m.clock = clock.NewFake(time.Date(2020, 3, 4, 5, 6, 7, 0, time.FixedZone("", 3*60*60)))
+	return m
+}
+
+func fillTestHeader(t *testing.T, m *fillHeaders, authUser, mailFrom string, h textproto.Header) textproto.Header {
+	t.Helper()
+
+	msgMeta := &module.MsgMetadata{}
+	if authUser != "-" {
+		msgMeta.Conn = &module.ConnState{AuthUser: authUser}
+	}
+	state, err := m.ModStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteSender(context.Background(), mailFrom); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &h, nil); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestFillHeaders(t *testing.T) {
+	m := testFillHeaders(t)
+
+	h := fillTestHeader(t, m, "foxcpp@example.org", "foxcpp@example.org", textproto.Header{})
+	if !regexp.MustCompile(`^<[0-9a-f-]{36}@mx\.example\.org>$`).MatchString(h.Get("Message-ID")) {
+		t.Error("Wrong Message-ID:", h.Get("Message-ID"))
+	}
+	if date := h.Get("Date"); date != "Wed, 4 Mar 2020 05:06:07 +0300" {
+		t.Error("Wrong Date:", date)
+	}
+	if h.Has("From") {
+		t.Error("From should not be added by default")
+	}
+}
+
+func TestFillHeaders_Existing(t *testing.T) {
+	m := testFillHeaders(t, config.Node{Name: "from", Args: []string{"yes"}})
+
+	h := textproto.Header{}
+	h.Add("Message-Id", "<a@example.org>")
+	h.Add("Date", "Thu, 1 Jan 1970 00:00:00 +0000")
+	h.Add("From", "<b@example.org>")
+	h = fillTestHeader(t, m, "foxcpp@example.org", "foxcpp@example.org", h)
+
+	if h.Get("Message-ID") != "<a@example.org>" || h.Get("Date") != "Thu, 1 Jan 1970 00:00:00 +0000" ||
+		h.Get("From") != "<b@example.org>" {
+		t.Error("Existing fields were changed")
+	}
+	if h.Len() != 3 {
+		t.Error("Wrong amount of fields:", h.Len())
+	}
+}
+
+func TestFillHeaders_From(t *testing.T) {
+	m := testFillHeaders(t, config.Node{Name: "from", Args: []string{"yes"}})
+
+	h := fillTestHeader(t, m, "foxcpp@example.org", "other@example.org", textproto.Header{})
+	if from := h.Get("From"); from != "<foxcpp@example.org>" {
+		t.Error("Wrong From:", from)
+	}
+
+	h = fillTestHeader(t, m, "foxcpp", "foxcpp@example.org", textproto.Header{})
+	if from := h.Get("From"); from != "<foxcpp@example.org>" {
+		t.Error("Wrong From:", from)
+	}
+
+	h = fillTestHeader(t, m, "foxcpp", "", textproto.Header{})
+	if h.Has("From") {
+		t.Error("From should not be added without an address")
+	}
+}
+
+func TestFillHeaders_Unauthenticated(t *testing.T) {
+	m := testFillHeaders(t, config.Node{Name: "from", Args: []string{"yes"}})
+
+	for _, authUser := range []string{"-", ""} {
+		h := fillTestHeader(t, m, authUser, "foxcpp@example.org", textproto.Header{})
+		if h.Len() != 0 {
+			t.Errorf("Fields added for unauthenticated message (auth user %q)", authUser)
+		}
+	}
+}
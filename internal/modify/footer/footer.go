@@ -0,0 +1,205 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package footer implements the modifier that appends the text (e.g. legal
+// disclaimer) to the message body.
+package footer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.footer"
+
+type Modifier struct {
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	// Footer text with CRLF line endings.
+	text       string
+	html       string
+	skipSigned bool
+	maxSize    int
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) > 1 {
+		return nil, fmt.Errorf("%s: at most one argument is allowed", modName)
+	}
+	return &Modifier{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func readFooter(text, file string) (string, error) {
+	if file == "" {
+		return text, nil
+	}
+	if text != "" {
+		return "", errors.New("footer text and file can't be used together")
+	}
+	blob, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(blob), "\r\n"), nil
+}
+
+// textToHTML converts the plain text footer to HTML for use in text/html
+// parts if no HTML footer is specified.
+func textToHTML(text string) string {
+	lines := strings.Split(text, "\r\n")
+	for i, line := range lines {
+		lines[i] = html.EscapeString(line)
+	}
+	return "<div>" + strings.Join(lines, "<br>\r\n") + "</div>\r\n"
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var textFile, htmlFile string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("text", false, false, "", &m.text)
+	cfg.String("text_file", false, false, "", &textFile)
+	cfg.String("html", false, false, "", &m.html)
+	cfg.String("html_file", false, false, "", &htmlFile)
+	cfg.Bool("skip_signed", false, true, &m.skipSigned)
+	cfg.DataSize("max_size", false, false, 5*1024*1024, &m.maxSize)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(m.inlineArgs) == 1 {
+		if m.text != "" || textFile != "" {
+			return fmt.Errorf("%s: footer text is specified both in the argument and in the block", modName)
+		}
+		m.text = m.inlineArgs[0]
+	}
+
+	var err error
+	m.text, err = readFooter(m.text, textFile)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	m.html, err = readFooter(m.html, htmlFile)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	if m.text == "" && m.html == "" {
+		return fmt.Errorf("%s: footer text is not specified", modName)
+	}
+
+	m.text = toCRLF(m.text)
+	m.html = toCRLF(m.html)
+	if m.html == "" {
+		m.html = textToHTML(m.text)
+	}
+	return nil
+}
+
+func toCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+type state struct {
+	m   *Modifier
+	log log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+// ReplaceBody implements module.BodyReplacingModifierState.
+func (s *state) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, modName+"/ReplaceBody").End()
+
+	if body.Len() > s.m.maxSize {
+		s.log.Msg("message is too big, not adding footer", "size", body.Len())
+		return nil, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Work on the copy so a failure does not leave the header half-changed.
+	hdrCopy := h.Copy()
+	newBody, changed, err := s.m.processEntity(&hdrCopy, io.LimitReader(r, int64(s.m.maxSize)))
+	if err != nil {
+		// Not fatal, the message is still delivered without the footer.
+		s.log.Error("failed to add footer", err)
+		return nil, nil
+	}
+	if !changed {
+		s.log.Debugf("no suitable parts to add footer to")
+		return nil, nil
+	}
+
+	*h = hdrCopy
+	return buffer.MemoryBuffer{Slice: newBody}, nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,250 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package footer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testModifier(t *testing.T, children ...config.Node) *Modifier {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, []string{"Confidential – do not forward"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modName)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// processMsg runs the message through the modifier and returns the
+// resulting message. Body is nil if it is not changed.
+func processMsg(t *testing.T, m *Modifier, msg string) (textproto.Header, []byte) {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := buffer.MemoryBuffer{Slice: []byte(msg[strings.Index(msg, "\r\n\r\n")+4:])}
+
+	newBody, err := state.(module.BodyReplacingModifierState).ReplaceBody(context.Background(), &hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBody == nil {
+		return hdr, nil
+	}
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, blob
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// decodedParts parses the message and returns decoded text of all its
+// parts.
+func decodedParts(t *testing.T, hdr textproto.Header, body []byte) []string {
+	t.Helper()
+
+	ent, err := message.New(message.Header{Header: hdr}, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	var walk func(ent *message.Entity)
+	walk = func(ent *message.Entity) {
+		if mr := ent.MultipartReader(); mr != nil {
+			for {
+				p, err := mr.NextPart()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				walk(p)
+			}
+		}
+		blob, err := ioutil.ReadAll(ent.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(blob))
+	}
+	walk(ent)
+	return parts
+}
+
+func TestFooter_Text(t *testing.T) {
+	m := testModifier(t)
+	hdr, body := processMsg(t, m, crlf("Content-Type: text/plain\n\nHello"))
+	if body == nil {
+		t.Fatal("body is not changed")
+	}
+	if hdr.Get("Content-Transfer-Encoding") != "quoted-printable" {
+		t.Error("Wrong Content-Transfer-Encoding:", hdr.Get("Content-Transfer-Encoding"))
+	}
+	if hdr.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("Wrong Content-Type:", hdr.Get("Content-Type"))
+	}
+
+	parts := decodedParts(t, hdr, body)
+	if len(parts) != 1 || parts[0] != crlf("Hello\n\nConfidential – do not forward\n") {
+		t.Errorf("Wrong body: %q", parts)
+	}
+}
+
+func TestFooter_Charset(t *testing.T) {
+	m := testModifier(t)
+	hdr, body := processMsg(t, m, crlf("Content-Type: text/plain; charset=iso-8859-1\n"+
+		"Content-Transfer-Encoding: quoted-printable\n\nCaf=E9\n"))
+
+	if hdr.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("Wrong Content-Type:", hdr.Get("Content-Type"))
+	}
+	parts := decodedParts(t, hdr, body)
+	if len(parts) != 1 || parts[0] != crlf("Café\n\nConfidential – do not forward\n") {
+		t.Errorf("Wrong body: %q", parts)
+	}
+}
+
+func TestFooter_Alternative(t *testing.T) {
+	m := testModifier(t)
+	hdr, body := processMsg(t, m, crlf(`Content-Type: multipart/alternative; boundary=B
+
+--B
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: base64
+
+SGVsbG8=
+--B
+Content-Type: text/html; charset=utf-8
+
+<html><body><p>Hello</p></BODY></html>
+--B--
+`))
+
+	parts := decodedParts(t, hdr, body)
+	if len(parts) != 2 {
+		t.Fatalf("Wrong parts: %q", parts)
+	}
+	if parts[0] != crlf("Hello\n\nConfidential – do not forward\n") {
+		t.Errorf("Wrong text part: %q", parts[0])
+	}
+	if parts[1] != crlf("<html><body><p>Hello</p><div>Confidential – do not forward</div>\n</BODY></html>") {
+		t.Errorf("Wrong HTML part: %q", parts[1])
+	}
+}
+
+func TestFooter_Mixed(t *testing.T) {
+	m := testModifier(t, config.Node{Name: "html", Args: []string{"<p>Footer</p>"}})
+	hdr, body := processMsg(t, m, crlf(`Content-Type: multipart/mixed; boundary=B
+
+--B
+Content-Type: text/html
+
+<p>Hello</p>
+--B
+Content-Type: text/plain
+Content-Disposition: attachment; filename=a.txt
+
+Attachment
+--B--
+`))
+
+	parts := decodedParts(t, hdr, body)
+	if len(parts) != 2 {
+		t.Fatalf("Wrong parts: %q", parts)
+	}
+	if parts[0] != crlf("<p>Hello</p><p>Footer</p>") {
+		t.Errorf("Wrong HTML part: %q", parts[0])
+	}
+	if parts[1] != "Attachment" {
+		t.Errorf("Attachment is changed: %q", parts[1])
+	}
+}
+
+func TestFooter_Signed(t *testing.T) {
+	msg := crlf(`Content-Type: multipart/signed; boundary=B; protocol="application/pgp-signature"
+
+--B
+Content-Type: text/plain
+
+Hello
+--B
+Content-Type: application/pgp-signature
+
+SIG
+--B--
+`)
+
+	m := testModifier(t)
+	if _, body := processMsg(t, m, msg); body != nil {
+		t.Error("Signed message is changed")
+	}
+
+	m = testModifier(t, config.Node{Name: "skip_signed", Args: []string{"no"}})
+	hdr, body := processMsg(t, m, msg)
+	parts := decodedParts(t, hdr, body)
+	if len(parts) != 2 || parts[0] != crlf("Hello\n\nConfidential – do not forward\n") || parts[1] != "SIG" {
+		t.Errorf("Wrong parts: %q", parts)
+	}
+}
+
+func TestFooter_NoTextParts(t *testing.T) {
+	m := testModifier(t)
+	if _, body := processMsg(t, m, crlf("Content-Type: application/octet-stream\n\nAAAA")); body != nil {
+		t.Error("Non-text message is changed")
+	}
+	if _, body := processMsg(t, m, crlf("Content-Type: multipart/encrypted; boundary=B\n\n--B\n\nA\n--B--\n")); body != nil {
+		t.Error("Encrypted message is changed")
+	}
+}
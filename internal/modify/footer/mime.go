@@ -0,0 +1,285 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package footer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Max. line length allowed by RFC 5322 for 7bit/8bit content (excluding
+// CRLF). If changed part has longer lines, it is converted to
+// quoted-printable.
+const maxLineLen = 998
+
+// processEntity adds the footer to the entity body read from r.
+//
+// It returns the new body and whether the footer was added. If it was not,
+// the original body is returned. Header can be changed if the charset or the
+// transfer encoding has to be changed.
+func (m *Modifier) processEntity(h *textproto.Header, r io.Reader) ([]byte, bool, error) {
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		raw, err := ioutil.ReadAll(r)
+		return raw, false, err
+	}
+
+	switch mediaType {
+	case "multipart/encrypted", "application/pkcs7-mime", "application/x-pkcs7-mime":
+		// Nothing can be done without breaking the message.
+		raw, err := ioutil.ReadAll(r)
+		return raw, false, err
+	case "multipart/signed":
+		if m.skipSigned {
+			raw, err := ioutil.ReadAll(r)
+			return raw, false, err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		// All alternatives should contain the footer, for other multipart
+		// types only the first part is the message text, the rest are
+		// attachments, embedded images, signatures, etc.
+		return m.processMultipart(params["boundary"], r, mediaType == "multipart/alternative")
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return raw, false, nil
+	}
+	if disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && disp == "attachment" {
+		return raw, false, nil
+	}
+	if mediaType == "text/plain" && m.text == "" || mediaType == "text/html" && m.html == "" {
+		return raw, false, nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	decoded, err := decodeBody(encoding, raw)
+	if err != nil {
+		// Malformed encoding, leave the part as is.
+		return raw, false, nil
+	}
+
+	charset := strings.ToLower(params["charset"])
+	switch charset {
+	case "", "us-ascii", "utf-8":
+	default:
+		// Convert the text to UTF-8 so the footer can be added as is.
+		cr, err := message.CharsetReader(charset, bytes.NewReader(decoded))
+		if err != nil {
+			// Unknown charset, leave the part as is.
+			return raw, false, nil
+		}
+		decoded, err = ioutil.ReadAll(cr)
+		if err != nil {
+			return raw, false, nil
+		}
+		charset = "utf-8"
+	}
+
+	var content []byte
+	if mediaType == "text/html" {
+		content = appendHTML(decoded, m.html)
+	} else {
+		content = appendText(decoded, m.text)
+	}
+
+	if charset != "utf-8" && !isASCII(content) {
+		charset = "utf-8"
+	}
+	if charset != strings.ToLower(params["charset"]) {
+		params["charset"] = charset
+		h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+
+	switch encoding {
+	case "", "7bit":
+		if !isASCII(content) || hasLongLines(content) {
+			encoding = "quoted-printable"
+			h.Set("Content-Transfer-Encoding", encoding)
+		}
+	case "8bit", "binary":
+		if hasLongLines(content) {
+			encoding = "quoted-printable"
+			h.Set("Content-Transfer-Encoding", encoding)
+		}
+	}
+
+	encoded, err := encodeBody(encoding, content)
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, true, nil
+}
+
+func (m *Modifier) processMultipart(boundary string, r io.Reader, allParts bool) ([]byte, bool, error) {
+	var (
+		out     bytes.Buffer
+		changed bool
+		first   = true
+	)
+
+	mr := textproto.NewMultipartReader(r, boundary)
+	mw := textproto.NewMultipartWriter(&out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, false, err
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		partHdr := p.Header
+		var partBody []byte
+		if allParts || first {
+			var partChanged bool
+			partBody, partChanged, err = m.processEntity(&partHdr, p)
+			changed = changed || partChanged
+		} else {
+			partBody, err = ioutil.ReadAll(p)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		first = false
+
+		pw, err := mw.CreatePart(partHdr)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := pw.Write(partBody); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, false, err
+	}
+	return out.Bytes(), changed, nil
+}
+
+func appendText(content []byte, footer string) []byte {
+	res := make([]byte, 0, len(content)+len(footer)+6)
+	res = append(res, content...)
+	if len(res) != 0 && !bytes.HasSuffix(res, []byte("\n")) {
+		res = append(res, "\r\n"...)
+	}
+	res = append(res, "\r\n"...)
+	res = append(res, footer...)
+	res = append(res, "\r\n"...)
+	return res
+}
+
+// appendHTML inserts the footer before the closing body tag or at the end of
+// the document if there is none.
+func appendHTML(content []byte, footer string) []byte {
+	idx := bytes.LastIndex(bytes.ToLower(content), []byte("</body>"))
+	if idx == -1 {
+		idx = len(content)
+	}
+	res := make([]byte, 0, len(content)+len(footer))
+	res = append(res, content[:idx]...)
+	res = append(res, footer...)
+	res = append(res, content[idx:]...)
+	return res
+}
+
+func isASCII(content []byte) bool {
+	for _, b := range content {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeBody(encoding string, raw []byte) ([]byte, error) {
+	switch encoding {
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(raw)), ""))
+	default:
+		return raw, nil
+	}
+}
+
+func encodeBody(encoding string, content []byte) ([]byte, error) {
+	var out bytes.Buffer
+	switch encoding {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&out)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(content)
+		for len(encoded) > 76 {
+			out.WriteString(encoded[:76])
+			out.WriteString("\r\n")
+			encoded = encoded[76:]
+		}
+		out.WriteString(encoded)
+		out.WriteString("\r\n")
+	default:
+		out.Write(content)
+	}
+	return out.Bytes(), nil
+}
+
+func hasLongLines(content []byte) bool {
+	for len(content) != 0 {
+		end := bytes.IndexByte(content, '\n')
+		if end == -1 {
+			end = len(content)
+		}
+		if len(bytes.TrimSuffix(content[:end], []byte{'\r'})) > maxLineLen {
+			return true
+		}
+		if end == len(content) {
+			break
+		}
+		content = content[end+1:]
+	}
+	return false
+}
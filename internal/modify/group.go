@@ -20,6 +20,7 @@ package modify
 
 import (
 	"context"
+	"strings"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -33,22 +34,54 @@ type (
 	//
 	// It is also registered as a module under 'modifiers' name and acts as a
 	// module group.
+	//
+	// Modifiers are executed in the order they are listed in the
+	// configuration, modifiers of a referenced group are executed at the
+	// position of the reference.
 	Group struct {
 		instName  string
 		Modifiers []module.Modifier
+
+		// Set while Init is running, used to detect groups referencing
+		// themselves.
+		initializing bool
 	}
 
 	groupState struct {
 		states []module.ModifierState
 	}
+
+	// rcptHeaderGroupState is used instead of groupState if any of wrapped
+	// states implements module.RcptHeaderModifierState. The message pipeline
+	// splits deliveries per recipient for such states so it should not be
+	// implemented unconditionally.
+	rcptHeaderGroupState struct {
+		groupState
+	}
 )
 
 func (g *Group) Init(cfg *config.Map) error {
+	g.initializing = true
+	defer func() { g.initializing = false }()
+
 	for _, node := range cfg.Block.Children {
-		mod, err := modconfig.MsgModifier(cfg.Globals, append([]string{node.Name}, node.Args...), node)
+		args := append([]string{node.Name}, node.Args...)
+		// 'modifiers &name' is the same as '&name', it just reads better
+		// when the referenced block is a modifiers group.
+		if node.Name == "modifiers" && len(node.Args) == 1 && strings.HasPrefix(node.Args[0], "&") {
+			if node.Children != nil {
+				return config.NodeErr(node, "can't declare block here")
+			}
+			args = node.Args
+		}
+
+		mod, err := modconfig.MsgModifier(cfg.Globals, args, node)
 		if err != nil {
 			return err
 		}
+		if grp, ok := mod.(*Group); ok && grp.initializing {
+			return config.NodeErr(node, "modifiers group %s references itself", grp.instName)
+		}
 
 		g.Modifiers = append(g.Modifiers, mod)
 	}
@@ -77,6 +110,12 @@ func (g Group) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata)
 		}
 		gs.states = append(gs.states, state)
 	}
+
+	for _, state := range gs.states {
+		if _, ok := state.(module.RcptHeaderModifierState); ok {
+			return rcptHeaderGroupState{gs}, nil
+		}
+	}
 	return gs, nil
 }
 
@@ -91,15 +130,22 @@ func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string
 	return mailFrom, nil
 }
 
-func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
-	var err error
+func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	// Each modifier is applied to all addresses returned by the previous
+	// one.
+	rcpts := []string{rcptTo}
 	for _, state := range gs.states {
-		rcptTo, err = state.RewriteRcpt(ctx, rcptTo)
-		if err != nil {
-			return "", err
+		var newRcpts []string
+		for _, rcpt := range rcpts {
+			res, err := state.RewriteRcpt(ctx, rcpt)
+			if err != nil {
+				return nil, err
+			}
+			newRcpts = append(newRcpts, res...)
 		}
+		rcpts = newRcpts
 	}
-	return rcptTo, nil
+	return rcpts, nil
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -111,6 +157,58 @@ func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body
 	return nil
 }
 
+// SealBody implements module.SealingModifierState by calling SealBody for all
+// wrapped states that implement it.
+func (gs groupState) SealBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	for _, state := range gs.states {
+		sealer, ok := state.(module.SealingModifierState)
+		if !ok {
+			continue
+		}
+		if err := sealer.SealBody(ctx, h, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceBody implements module.BodyReplacingModifierState by calling
+// ReplaceBody for all wrapped states that implement it, each one sees the
+// body produced by the previous one.
+func (gs groupState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	var newBody buffer.Buffer
+	for _, state := range gs.states {
+		replacer, ok := state.(module.BodyReplacingModifierState)
+		if !ok {
+			continue
+		}
+		replaced, err := replacer.ReplaceBody(ctx, h, body)
+		if err != nil {
+			return nil, err
+		}
+		if replaced != nil {
+			newBody = replaced
+			body = replaced
+		}
+	}
+	return newBody, nil
+}
+
+// RcptHeader implements module.RcptHeaderModifierState by calling
+// RcptHeader for all wrapped states that implement it.
+func (gs rcptHeaderGroupState) RcptHeader(ctx context.Context, rcptTo string, h *textproto.Header) error {
+	for _, state := range gs.states {
+		stamper, ok := state.(module.RcptHeaderModifierState)
+		if !ok {
+			continue
+		}
+		if err := stamper.RcptHeader(ctx, rcptTo, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (gs groupState) Close() error {
 	// We still try close all state objects to minimize
 	// resource leaks when Close fails for one object..
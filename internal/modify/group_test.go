@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func registerGroup(name string, children ...config.Node) *Group {
+	g := &Group{instName: name}
+	module.RegisterInstance(g, config.NewMap(nil, config.Node{Children: children}))
+	return g
+}
+
+func TestGroup_Reference(t *testing.T) {
+	mod1 := &testutils.Modifier{InstName: "test_group_mod1"}
+	mod2 := &testutils.Modifier{InstName: "test_group_mod2"}
+	module.RegisterInstance(mod1, nil)
+	module.RegisterInstance(mod2, nil)
+	registerGroup("test_group_common",
+		config.Node{Name: "&test_group_mod1"},
+	)
+
+	g := &Group{}
+	err := g.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "modifiers", Args: []string{"&test_group_common"}},
+		{Name: "&test_group_mod2"},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.Modifiers) != 2 {
+		t.Fatalf("wrong amount of modifiers: %d", len(g.Modifiers))
+	}
+	common, ok := g.Modifiers[0].(*Group)
+	if !ok || common.InstanceName() != "test_group_common" {
+		t.Fatalf("referenced group is not the first one: %v", g.Modifiers[0])
+	}
+	if len(common.Modifiers) != 1 || common.Modifiers[0] != mod1 {
+		t.Fatalf("wrong referenced group contents: %v", common.Modifiers)
+	}
+	if g.Modifiers[1] != mod2 {
+		t.Fatalf("wrong second modifier: %v", g.Modifiers[1])
+	}
+}
+
+func TestGroup_UndefinedReference(t *testing.T) {
+	g := &Group{}
+	err := g.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "modifiers", Args: []string{"&test_group_missing"}, File: "maddy.conf", Line: 5},
+	}}))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "maddy.conf:5") {
+		t.Fatalf("error does not include the location: %v", err)
+	}
+}
+
+func TestGroup_Cycle(t *testing.T) {
+	registerGroup("test_group_a", config.Node{Name: "modifiers", Args: []string{"&test_group_b"}})
+	registerGroup("test_group_b", config.Node{Name: "modifiers", Args: []string{"&test_group_a"}})
+
+	if _, err := module.GetInstance("test_group_a"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
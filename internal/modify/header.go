@@ -0,0 +1,321 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// headerRule is a module that changes the message header using a single
+// rule.
+//
+// If created with modName = "modify.add_header", it adds the field.
+// If created with modName = "modify.delete_header", it removes all (or only
+// matching) instances of the field.
+// If created with modName = "modify.replace_header", it replaces the regexp
+// match in field values.
+//
+// Multiple rules are applied in the order they are specified in the modify
+// block.
+type headerRule struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	field     string
+	value     string
+	re        *regexp.Regexp
+	repl      string
+	firstOnly bool
+	ifPresent string
+	ifAbsent  string
+}
+
+func NewHeader(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &headerRule{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
+	}, nil
+}
+
+// parseSedExpr parses the replacement in the "/regexp/replacement/flags" form.
+// The only supported flag is 'i' (case-insensitive matching).
+func parseSedExpr(expr string) (pattern, repl string, err error) {
+	var (
+		parts   []string
+		current strings.Builder
+	)
+	for i := 1; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == '/':
+			current.WriteByte('/')
+			i++
+		case expr[i] == '/':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(expr[i])
+		}
+	}
+	parts = append(parts, current.String())
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("malformed replacement expression: %s", expr)
+	}
+
+	switch parts[2] {
+	case "":
+	case "i":
+		parts[0] = "(?i)" + parts[0]
+	default:
+		return "", "", fmt.Errorf("unknown replacement flags: %s", parts[2])
+	}
+	return parts[0], parts[1], nil
+}
+
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if ch <= ' ' || ch > '~' || ch == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func (hr *headerRule) Init(cfg *config.Map) error {
+	var instances string
+	cfg.Bool("debug", true, false, &hr.log.Debug)
+	cfg.Enum("instances", false, false, []string{"all", "first"}, "all", &instances)
+	cfg.String("if_present", false, false, "", &hr.ifPresent)
+	cfg.String("if_absent", false, false, "", &hr.ifAbsent)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	hr.firstOnly = instances == "first"
+
+	if len(hr.inlineArgs) == 0 {
+		return fmt.Errorf("%s: header field name is required", hr.modName)
+	}
+	hr.field = hr.inlineArgs[0]
+	for _, name := range []string{hr.field, hr.ifPresent, hr.ifAbsent} {
+		if name != "" && !validFieldName(name) {
+			return fmt.Errorf("%s: invalid header field name: %s", hr.modName, name)
+		}
+	}
+	args := hr.inlineArgs[1:]
+
+	var pattern string
+	switch hr.modName {
+	case "modify.add_header":
+		if len(args) != 1 {
+			return fmt.Errorf("%s: expected field name and value", hr.modName)
+		}
+		if strings.ContainsAny(args[0], "\r\n") {
+			return fmt.Errorf("%s: field value can't contain line breaks", hr.modName)
+		}
+		hr.value = args[0]
+		return nil
+	case "modify.delete_header":
+		switch len(args) {
+		case 0:
+			return nil
+		case 1:
+			pattern = args[0]
+		default:
+			return fmt.Errorf("%s: expected field name and optional regexp", hr.modName)
+		}
+	case "modify.replace_header":
+		switch {
+		case len(args) == 1 && strings.HasPrefix(args[0], "/"):
+			var err error
+			pattern, hr.repl, err = parseSedExpr(args[0])
+			if err != nil {
+				return fmt.Errorf("%s: %v", hr.modName, err)
+			}
+		case len(args) == 2:
+			pattern, hr.repl = args[0], args[1]
+		default:
+			return fmt.Errorf("%s: expected field name, regexp and replacement", hr.modName)
+		}
+		if strings.ContainsAny(hr.repl, "\r\n") {
+			return fmt.Errorf("%s: replacement can't contain line breaks", hr.modName)
+		}
+	default:
+		return fmt.Errorf("%s: unknown module name", hr.modName)
+	}
+
+	var err error
+	hr.re, err = regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("%s: %v", hr.modName, err)
+	}
+	return nil
+}
+
+func (hr *headerRule) Name() string {
+	return hr.modName
+}
+
+func (hr *headerRule) InstanceName() string {
+	return hr.instName
+}
+
+func (hr *headerRule) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return hr, nil
+}
+
+func (hr *headerRule) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (hr *headerRule) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+var headerWordDecoder = mime.WordDecoder{CharsetReader: message.CharsetReader}
+
+// decodeValue returns the field value with RFC 2047 encoded-words decoded.
+func decodeValue(raw string) string {
+	decoded, err := headerWordDecoder.DecodeHeader(raw)
+	if err != nil {
+		return raw
+	}
+	return decoded
+}
+
+// encodeValue encodes the value using RFC 2047 encoded-words if it contains
+// non-ASCII characters.
+func encodeValue(value string) string {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return mime.QEncoding.Encode("utf-8", value)
+		}
+	}
+	return value
+}
+
+type headerField struct {
+	key   string
+	value string
+	raw   []byte
+}
+
+// rebuildHeader applies fn to all instances of the field (or until the first
+// changed one if instances = first), preserving the order of fields. fn
+// returns the new value and false to remove the field.
+func (hr *headerRule) rebuildHeader(h *textproto.Header, fn func(value string) (string, bool)) {
+	var (
+		fields  []headerField
+		changed bool
+	)
+
+	fs := h.Fields()
+	for fs.Next() {
+		raw, err := fs.Raw()
+		if err != nil {
+			raw = nil
+		}
+		f := headerField{key: fs.Key(), value: fs.Value(), raw: raw}
+
+		if strings.EqualFold(f.key, hr.field) && !(hr.firstOnly && changed) {
+			newValue, keep := fn(f.value)
+			if newValue != f.value || !keep {
+				changed = true
+				if !keep {
+					continue
+				}
+				f.value = newValue
+				f.raw = nil
+			}
+		}
+		fields = append(fields, f)
+	}
+	if !changed {
+		return
+	}
+
+	// Add and AddRaw prepend the field, so add them in reverse order.
+	newHdr := textproto.Header{}
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].raw != nil {
+			newHdr.AddRaw(fields[i].raw)
+		} else {
+			newHdr.Add(fields[i].key, fields[i].value)
+		}
+	}
+	*h = newHdr
+}
+
+func (hr *headerRule) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if hr.ifPresent != "" && !h.Has(hr.ifPresent) {
+		return nil
+	}
+	if hr.ifAbsent != "" && h.Has(hr.ifAbsent) {
+		return nil
+	}
+
+	switch hr.modName {
+	case "modify.add_header":
+		h.Add(hr.field, hr.value)
+		hr.log.Debugf("added %s field", hr.field)
+	case "modify.delete_header":
+		hr.rebuildHeader(h, func(value string) (string, bool) {
+			if hr.re == nil {
+				return value, false
+			}
+			return value, !hr.re.MatchString(decodeValue(value))
+		})
+	case "modify.replace_header":
+		hr.rebuildHeader(h, func(value string) (string, bool) {
+			decoded := decodeValue(value)
+			if !hr.re.MatchString(decoded) {
+				return value, true
+			}
+			return encodeValue(hr.re.ReplaceAllString(decoded, hr.repl)), true
+		})
+	}
+	return nil
+}
+
+func (hr *headerRule) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.add_header", NewHeader)
+	module.Register("modify.delete_header", NewHeader)
+	module.Register("modify.replace_header", NewHeader)
+}
@@ -0,0 +1,184 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func testHeaderRule(t *testing.T, modName string, args []string, children ...config.Node) *headerRule {
+	t.Helper()
+
+	mod, err := NewHeader(modName, "", nil, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*headerRule)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func applyHeaderRules(t *testing.T, raw string, rules ...*headerRule) string {
+	t.Helper()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(raw + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range rules {
+		if err := rule.RewriteBody(context.Background(), &hdr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := textproto.WriteHeader(&out, hdr); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(out.String(), "\r\n")
+}
+
+func TestHeader_Rules(t *testing.T) {
+	rules := []*headerRule{
+		testHeaderRule(t, "modify.replace_header", []string{"Subject", `/\[SPAM\] ?//`}),
+		testHeaderRule(t, "modify.add_header", []string{"X-Processed-By", "maddy"}),
+		testHeaderRule(t, "modify.delete_header", []string{"X-Originating-IP"}),
+	}
+
+	out := applyHeaderRules(t, "Received: from a\r\n"+
+		"X-Originating-IP: 1.2.3.4\r\n"+
+		"Subject: [SPAM] hello\r\n"+
+		"X-Originating-IP: 5.6.7.8\r\n"+
+		"From: <foo@example.org>\r\n", rules...)
+	expected := "X-Processed-By: maddy\r\n" +
+		"Received: from a\r\n" +
+		"Subject: hello\r\n" +
+		"From: <foo@example.org>\r\n"
+	if out != expected {
+		t.Errorf("Wrong header:\n%q\nwant:\n%q", out, expected)
+	}
+}
+
+func TestHeader_Replace(t *testing.T) {
+	test := func(rule *headerRule, raw, expected string) {
+		t.Helper()
+		if out := applyHeaderRules(t, raw, rule); out != expected {
+			t.Errorf("%q: want %q, got %q", raw, expected, out)
+		}
+	}
+
+	groups := testHeaderRule(t, "modify.replace_header", []string{"X-Tag", `^(\w+)-(\w+)$`, "$2-$1"})
+	test(groups, "X-Tag: a-b\r\n", "X-Tag: b-a\r\n")
+	test(groups, "X-Tag: a-b-c\r\n", "X-Tag: a-b-c\r\n")
+
+	caseless := testHeaderRule(t, "modify.replace_header", []string{"Subject", `/\[spam\]/[ham]/i`})
+	test(caseless, "Subject: [SPAM] x\r\n", "Subject: [ham] x\r\n")
+
+	slash := testHeaderRule(t, "modify.replace_header", []string{"X-Path", `/a\/b/c/`})
+	test(slash, "X-Path: a/b\r\n", "X-Path: c\r\n")
+
+	// Encoded words are decoded before matching and the result is encoded
+	// again if it needs to be.
+	encoded := testHeaderRule(t, "modify.replace_header", []string{"Subject", `/\[SPAM\] //`})
+	test(encoded, "Subject: =?utf-8?q?=5BSPAM=5D_hello?=\r\n", "Subject: hello\r\n")
+	test(encoded, "Subject: =?utf-8?q?=5BSPAM=5D_=D0=BF=D1=80=D0=B8=D0=B2=D0=B5=D1=82?=\r\n",
+		"Subject: =?utf-8?q?=D0=BF=D1=80=D0=B8=D0=B2=D0=B5=D1=82?=\r\n")
+
+	all := testHeaderRule(t, "modify.replace_header", []string{"X-A", "x", "y"})
+	test(all, "X-A: x1\r\nX-B: x\r\nX-A: x2\r\n", "X-A: y1\r\nX-B: x\r\nX-A: y2\r\n")
+
+	first := testHeaderRule(t, "modify.replace_header", []string{"X-A", "x", "y"},
+		config.Node{Name: "instances", Args: []string{"first"}})
+	test(first, "X-A: a\r\nX-A: x1\r\nX-A: x2\r\n", "X-A: a\r\nX-A: y1\r\nX-A: x2\r\n")
+}
+
+func TestHeader_Delete(t *testing.T) {
+	test := func(rule *headerRule, raw, expected string) {
+		t.Helper()
+		if out := applyHeaderRules(t, raw, rule); out != expected {
+			t.Errorf("%q: want %q, got %q", raw, expected, out)
+		}
+	}
+
+	all := testHeaderRule(t, "modify.delete_header", []string{"Received"})
+	test(all, "Received: a\r\nSubject: x\r\nreceived: b\r\n", "Subject: x\r\n")
+
+	first := testHeaderRule(t, "modify.delete_header", []string{"Received"},
+		config.Node{Name: "instances", Args: []string{"first"}})
+	test(first, "Received: a\r\nReceived: b\r\n", "Received: b\r\n")
+
+	matching := testHeaderRule(t, "modify.delete_header", []string{"Received", "^from localhost"})
+	test(matching, "Received: from localhost\r\nReceived: from mx.example.org\r\n", "Received: from mx.example.org\r\n")
+
+	// Raw values of the untouched fields are preserved.
+	test(all, "Subject: x\r\n  folded\r\nReceived: a\r\n", "Subject: x\r\n  folded\r\n")
+}
+
+func TestHeader_Conditions(t *testing.T) {
+	ifAbsent := testHeaderRule(t, "modify.add_header", []string{"X-Processed-By", "maddy"},
+		config.Node{Name: "if_absent", Args: []string{"X-Processed-By"}})
+	if out := applyHeaderRules(t, "X-Processed-By: other\r\n", ifAbsent); out != "X-Processed-By: other\r\n" {
+		t.Error("Field added despite if_absent:", out)
+	}
+	if out := applyHeaderRules(t, "Subject: x\r\n", ifAbsent); out != "X-Processed-By: maddy\r\nSubject: x\r\n" {
+		t.Error("Field not added:", out)
+	}
+
+	ifPresent := testHeaderRule(t, "modify.delete_header", []string{"X-Mailer"},
+		config.Node{Name: "if_present", Args: []string{"X-Spam"}})
+	if out := applyHeaderRules(t, "X-Mailer: a\r\n", ifPresent); out != "X-Mailer: a\r\n" {
+		t.Error("Field removed despite if_present:", out)
+	}
+	if out := applyHeaderRules(t, "X-Spam: yes\r\nX-Mailer: a\r\n", ifPresent); out != "X-Spam: yes\r\n" {
+		t.Error("Field not removed:", out)
+	}
+}
+
+func TestHeader_InvalidConfig(t *testing.T) {
+	for _, c := range []struct {
+		modName string
+		args    []string
+	}{
+		{"modify.add_header", []string{"X-A"}},
+		{"modify.add_header", []string{"X A", "b"}},
+		{"modify.add_header", []string{"X-A", "b\r\nX-B: c"}},
+		{"modify.delete_header", []string{}},
+		{"modify.delete_header", []string{"X-A", "("}},
+		{"modify.replace_header", []string{"X-A", "/a/b"}},
+		{"modify.replace_header", []string{"X-A", "/a/b/g"}},
+		{"modify.replace_header", []string{"X-A", "a"}},
+	} {
+		mod, err := NewHeader(c.modName, "", nil, c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.(*headerRule).Init(config.NewMap(nil, config.Node{})); err == nil {
+			t.Errorf("%s %v: expected an error", c.modName, c.args)
+		}
+	}
+}
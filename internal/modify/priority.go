@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package modify
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// priority is a module that sets the delivery priority of the message
+// (MsgMetadata.Priority).
+type priority struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+
+	value int
+}
+
+func NewPriority(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &priority{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+	}, nil
+}
+
+func (p *priority) Init(cfg *config.Map) error {
+	var valueStr string
+	cfg.String("priority", false, len(p.inlineArgs) == 0, "", &valueStr)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	switch len(p.inlineArgs) {
+	case 0:
+	case 1:
+		valueStr = p.inlineArgs[0]
+	default:
+		return fmt.Errorf("%s: at most one argument is allowed", p.modName)
+	}
+
+	var err error
+	p.value, err = module.ParsePriority(valueStr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.modName, err)
+	}
+	return nil
+}
+
+func (p *priority) Name() string {
+	return p.modName
+}
+
+func (p *priority) InstanceName() string {
+	return p.instName
+}
+
+// ModStateForMsg sets the priority right away since delivery targets are
+// started before the message body is received.
+func (p *priority) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	msgMeta.Priority = p.value
+	return p, nil
+}
+
+func (p *priority) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (p *priority) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (p *priority) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (p *priority) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.priority", NewPriority)
+}
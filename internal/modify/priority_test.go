@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestPriority(t *testing.T) {
+	test := func(arg string, expected int, fail bool) {
+		t.Helper()
+
+		mod, err := NewPriority("modify.priority", "", nil, []string{arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mod.Init(config.NewMap(nil, config.Node{}))
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected failure", arg)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgMeta := &module.MsgMetadata{}
+		if _, err := mod.(*priority).ModStateForMsg(context.Background(), msgMeta); err != nil {
+			t.Fatal(err)
+		}
+		if msgMeta.Priority != expected {
+			t.Errorf("%s: want priority %d, got %d", arg, expected, msgMeta.Priority)
+		}
+	}
+
+	test("high", module.PriorityHigh, false)
+	test("bulk", module.PriorityBulk, false)
+	test("normal", 0, false)
+	test("-3", -3, false)
+	test("10", 0, true)
+	test("urgent", 0, true)
+}
@@ -21,6 +21,7 @@ package modify
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/emersion/go-message/textproto"
@@ -28,7 +29,9 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tenancy"
 )
 
 // replaceAddr is a simple module that replaces matching sender (or recipient) address
@@ -36,6 +39,9 @@ import (
 //
 // If created with modName = "modify.replace_sender", it will change sender address.
 // If created with modName = "modify.replace_rcpt", it will change recipient addresses.
+//
+// Multiple rules (tables or inline regexp pairs) can be defined in the
+// configuration block, they are evaluated in order.
 type replaceAddr struct {
 	modName    string
 	instName   string
@@ -43,7 +49,15 @@ type replaceAddr struct {
 
 	replaceSender bool
 	replaceRcpt   bool
-	table         module.Table
+	rules         []replaceRule
+
+	// If set, evaluation stops at the first matching rule. Otherwise,
+	// following rules are applied to the result.
+	stopOnMatch bool
+
+	// If set, recipient rewriting is not allowed to change the address
+	// into one that belongs to a different tenant.
+	tenants tenancy.Policy
 }
 
 func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -58,8 +72,101 @@ func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Mo
 	return &r, nil
 }
 
+// replaceRule is a single rewriting rule.
+type replaceRule struct {
+	table module.Table
+
+	// If set, only the whole address is looked up, local-part is not looked
+	// up separately.
+	fullOnly bool
+}
+
+// regexpRule is the table-like representation of the inline regexp rule.
+// The regexp should match the whole address.
+type regexpRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (rr regexpRule) Lookup(key string) (string, bool, error) {
+	matches := rr.re.FindStringSubmatchIndex(key)
+	if matches == nil {
+		return "", false, nil
+	}
+	return string(rr.re.ExpandString(nil, rr.replacement, key, matches)), true, nil
+}
+
 func (r *replaceAddr) Init(cfg *config.Map) error {
-	return modconfig.ModuleFromNode("table", r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	cfg.AllowUnknown()
+	cfg.Bool("stop_on_match", false, true, &r.stopOnMatch)
+	cfg.Callback("tenant_table", func(m *config.Map, node config.Node) error {
+		if !r.replaceRcpt {
+			return config.NodeErr(node, "tenant_table can be used only with %s", "modify.replace_rcpt")
+		}
+		if r.tenants.Table != nil {
+			return config.NodeErr(node, "duplicate directive: tenant_table")
+		}
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &r.tenants.Table); err != nil {
+			return err
+		}
+		if !r.tenants.Listable() {
+			return config.NodeErr(node, "tenant_table: table does not support listing of keys")
+		}
+		return nil
+	})
+	if len(r.inlineArgs) == 0 {
+		cfg.Callback("rewrite", func(m *config.Map, node config.Node) error {
+			if len(node.Args) != 2 || len(node.Children) != 0 {
+				return config.NodeErr(node, "expected two arguments: regexp and replacement")
+			}
+			re, err := regexp.Compile("^(?i:" + node.Args[0] + ")$")
+			if err != nil {
+				return config.NodeErr(node, "%v", err)
+			}
+			r.rules = append(r.rules, replaceRule{
+				table:    regexpRule{re: re, replacement: node.Args[1]},
+				fullOnly: true,
+			})
+			return nil
+		})
+		cfg.Callback("table", func(m *config.Map, node config.Node) error {
+			var tbl module.Table
+			if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+				return err
+			}
+			r.rules = append(r.rules, replaceRule{table: tbl})
+			return nil
+		})
+	}
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	if len(r.inlineArgs) == 0 {
+		if len(unknown) != 0 {
+			return config.NodeErr(unknown[0], "unexpected directive: %s", unknown[0].Name)
+		}
+		if len(r.rules) == 0 {
+			return fmt.Errorf("%s: at least one table or rewrite rule is required", r.modName)
+		}
+		return nil
+	}
+
+	// The rest of the block is the configuration of the inline table.
+	// Children are left nil if there is none, otherwise ModuleFromNode
+	// rejects references to existing tables (&name).
+	tableCfg := cfg.Block
+	tableCfg.Children = nil
+	if len(unknown) != 0 {
+		tableCfg.Children = unknown
+	}
+	var tbl module.Table
+	if err := modconfig.ModuleFromNode("table", r.inlineArgs, tableCfg, cfg.Globals, &tbl); err != nil {
+		return err
+	}
+	r.rules = []replaceRule{{table: tbl}}
+	return nil
 }
 
 func (r replaceAddr) Name() string {
@@ -81,11 +188,47 @@ func (r replaceAddr) RewriteSender(ctx context.Context, mailFrom string) (string
 	return mailFrom, nil
 }
 
-func (r replaceAddr) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
-	if r.replaceRcpt {
-		return r.rewrite(rcptTo)
+func (r replaceAddr) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if !r.replaceRcpt {
+		return []string{rcptTo}, nil
+	}
+
+	newRcpt, err := r.rewrite(rcptTo)
+	if err != nil {
+		return nil, err
+	}
+	if r.tenants.Table != nil && newRcpt != rcptTo {
+		if err := checkTenant(r.tenants, r.modName, rcptTo, newRcpt); err != nil {
+			return nil, err
+		}
 	}
-	return rcptTo, nil
+	return []string{newRcpt}, nil
+}
+
+// checkTenant verifies that rewriting does not expand the address of one
+// tenant into the address of another one.
+func checkTenant(tenants tenancy.Policy, modName, orig, replacement string) error {
+	_, origDomain, err := address.Split(orig)
+	if err != nil {
+		return nil
+	}
+	_, newDomain, err := address.Split(replacement)
+	if err != nil {
+		return nil
+	}
+
+	cross, err := tenants.CrossTenant(origDomain, newDomain)
+	if err != nil {
+		return exterrors.WithFields(tenancy.LookupError(err), map[string]interface{}{"modifier": modName})
+	}
+	if cross {
+		return exterrors.WithFields(
+			tenancy.ViolationError("recipient expands to an address of another tenant", map[string]interface{}{
+				"rcpt":        orig,
+				"replacement": replacement,
+			}), map[string]interface{}{"modifier": modName})
+	}
+	return nil
 }
 
 func (r replaceAddr) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -97,46 +240,66 @@ func (r replaceAddr) Close() error {
 }
 
 func (r replaceAddr) rewrite(val string) (string, error) {
+	for _, rule := range r.rules {
+		replacement, ok, err := rule.rewrite(val)
+		if err != nil {
+			return val, err
+		}
+		if !ok {
+			continue
+		}
+		val = replacement
+		if r.stopOnMatch {
+			break
+		}
+	}
+	return val, nil
+}
+
+func (rule replaceRule) rewrite(val string) (string, bool, error) {
 	normAddr, err := address.ForLookup(val)
 	if err != nil {
-		return val, fmt.Errorf("malformed address: %v", err)
+		return val, false, fmt.Errorf("malformed address: %v", err)
 	}
 
-	replacement, ok, err := r.table.Lookup(normAddr)
+	replacement, ok, err := rule.table.Lookup(normAddr)
 	if err != nil {
-		return val, err
+		return val, false, err
 	}
 	if ok {
 		if !address.Valid(replacement) {
-			return "", fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
+			return "", false, fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
 		}
-		return replacement, nil
+		return replacement, true, nil
+	}
+	if rule.fullOnly {
+		return val, false, nil
 	}
 
 	mbox, domain, err := address.Split(normAddr)
 	if err != nil {
 		// If we have malformed address here, something is really wrong, but let's
 		// ignore it silently then anyway.
-		return val, nil
+		return val, false, nil
 	}
 
 	// mbox is already normalized, since it is a part of address.ForLookup
 	// result.
-	replacement, ok, err = r.table.Lookup(mbox)
+	replacement, ok, err = rule.table.Lookup(mbox)
 	if err != nil {
-		return val, err
+		return val, false, err
 	}
 	if ok {
 		if strings.Contains(replacement, "@") && !strings.HasPrefix(replacement, `"`) && !strings.HasSuffix(replacement, `"`) {
 			if !address.Valid(replacement) {
-				return "", fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
+				return "", false, fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
 			}
-			return replacement, nil
+			return replacement, true, nil
 		}
-		return replacement + "@" + domain, nil
+		return replacement + "@" + domain, true, nil
 	}
 
-	return val, nil
+	return val, false, nil
 }
 
 func init() {
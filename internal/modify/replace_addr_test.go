@@ -23,6 +23,8 @@ import (
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/table"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -38,7 +40,7 @@ func testReplaceAddr(t *testing.T, modName string, rewriter func(*replaceAddr, c
 		if err := m.Init(config.NewMap(nil, config.Node{})); err != nil {
 			t.Fatal(err)
 		}
-		m.table = testutils.Table{M: aliases}
+		m.rules = []replaceRule{{table: testutils.Table{M: aliases}}}
 
 		var actual string
 		if modName == "modify.replace_sender" {
@@ -48,10 +50,15 @@ func testReplaceAddr(t *testing.T, modName string, rewriter func(*replaceAddr, c
 			}
 		}
 		if modName == "modify.replace_rcpt" {
-			actual, err = m.RewriteRcpt(context.Background(), addr)
+			var actualRcpts []string
+			actualRcpts, err = m.RewriteRcpt(context.Background(), addr)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if len(actualRcpts) != 1 {
+				t.Fatalf("want exactly one recipient, got %v", actualRcpts)
+			}
+			actual = actualRcpts[0]
 		}
 
 		if actual != expected {
@@ -99,5 +106,162 @@ func TestReplaceAddr_RewriteSender(t *testing.T) {
 }
 
 func TestReplaceAddr_RewriteRcpt(t *testing.T) {
-	testReplaceAddr(t, "modify.replace_rcpt", (*replaceAddr).RewriteRcpt)
+	testReplaceAddr(t, "modify.replace_rcpt", func(r *replaceAddr, ctx context.Context, rcptTo string) (string, error) {
+		rcpts, err := r.RewriteRcpt(ctx, rcptTo)
+		if err != nil {
+			return "", err
+		}
+		return rcpts[0], nil
+	})
+}
+
+func TestReplaceAddr_NamedTable(t *testing.T) {
+	tbl, err := table.NewStatic("table.static", "replace_addr_test_aliases", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module.RegisterInstance(tbl, config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "entry", Args: []string{"test@example.com", "test@example.org"}},
+		},
+	}))
+
+	mod, err := NewReplaceAddr("modify.replace_rcpt", "", nil, []string{"&replace_addr_test_aliases"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*replaceAddr)
+	if err := m.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+
+	rcpts, err := m.RewriteRcpt(context.Background(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rcpts) != 1 || rcpts[0] != "test@example.org" {
+		t.Errorf("want [test@example.org], got %v", rcpts)
+	}
+}
+
+func TestReplaceAddr_TenantTable(t *testing.T) {
+	mod, err := NewReplaceAddr("modify.replace_rcpt", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*replaceAddr)
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "tenant_table",
+				Args: []string{"table.static"},
+				Children: []config.Node{
+					{Name: "entry", Args: []string{"alice@a.example", "a.example shared.example"}},
+					{Name: "entry", Args: []string{"bob@b.example", "b.example shared.example"}},
+				},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.rules = []replaceRule{{table: testutils.Table{M: map[string]string{
+		"sales@a.example":     "alice@a.example",
+		"leak@a.example":      "bob@b.example",
+		"fwd@a.example":       "alice@external.example",
+		"team@shared.example": "bob@b.example",
+	}}}}
+
+	test := func(addr, expected string, fail bool) {
+		t.Helper()
+		actual, err := m.RewriteRcpt(context.Background(), addr)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", addr, actual)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		if len(actual) != 1 || actual[0] != expected {
+			t.Errorf("%s: want %s, got %v", addr, expected, actual)
+		}
+	}
+
+	test("sales@a.example", "alice@a.example", false)
+	test("SALES@A.EXAMPLE", "alice@a.example", false)
+	test("leak@a.example", "", true)
+	test("fwd@a.example", "alice@external.example", false)
+	test("team@shared.example", "bob@b.example", false)
+	test("unrelated@b.example", "unrelated@b.example", false)
+}
+
+func TestReplaceAddr_TenantTableSender(t *testing.T) {
+	mod, err := NewReplaceAddr("modify.replace_sender", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "tenant_table", Args: []string{"table.static"}},
+		},
+	}))
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestReplaceAddr_Rules(t *testing.T) {
+	rules := []config.Node{
+		{Name: "rewrite", Args: []string{"(.+)@old\\.example", "$1@new.example"}},
+		{
+			Name: "table", Args: []string{"table.static"},
+			Children: []config.Node{
+				{Name: "entry", Args: []string{"a@new.example", "b@new.example"}},
+				{Name: "entry", Args: []string{"c", "d"}},
+			},
+		},
+		{Name: "rewrite", Args: []string{"(.+)@new\\.example", "$1@newest.example"}},
+	}
+
+	test := func(stopOnMatch, addr, expected string) {
+		t.Helper()
+
+		mod, err := NewReplaceAddr("modify.replace_sender", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children := append([]config.Node{{Name: "stop_on_match", Args: []string{stopOnMatch}}}, rules...)
+		if err := mod.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := mod.(*replaceAddr).RewriteSender(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("%s (stop_on_match %s): want %s, got %s", addr, stopOnMatch, expected, actual)
+		}
+	}
+
+	test("yes", "a@OLD.example", "a@new.example")
+	test("yes", "a@new.example", "b@new.example")
+	test("yes", "c@example.org", "d@example.org")
+	test("yes", "x@new.example", "x@newest.example")
+	test("yes", "x@old.example.org", "x@old.example.org")
+	test("no", "a@old.example", "b@newest.example")
+	test("no", "c@old.example", "d@newest.example")
+	test("no", "c@example.org", "d@example.org")
+}
+
+func TestReplaceAddr_NoRules(t *testing.T) {
+	mod, err := NewReplaceAddr("modify.replace_rcpt", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err == nil {
+		t.Fatal("Expected an error")
+	}
 }
@@ -0,0 +1,199 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/srs"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// srsRewrite is a module that rewrites the MAIL FROM address of forwarded
+// messages using the Sender Rewriting Scheme and reverses the rewriting for
+// bounces sent to SRS addresses.
+//
+// Reversed addresses are marked in MsgMetadata.ForwardRcpts so the message
+// pipeline can route them to the remote server.
+type srsRewrite struct {
+	modName  string
+	instName string
+	log      log.Logger
+
+	rewriter *srs.Rewriter
+	exclude  map[string]struct{}
+	now      func() time.Time
+}
+
+func NewSRS(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &srsRewrite{
+		modName:  modName,
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		exclude:  map[string]struct{}{},
+		now:      time.Now,
+	}, nil
+}
+
+func (sr *srsRewrite) Init(cfg *config.Map) error {
+	var (
+		domain   string
+		keysFile string
+		maxAge   time.Duration
+		exclude  []string
+	)
+	cfg.Bool("debug", true, false, &sr.log.Debug)
+	cfg.String("domain", false, true, "", &domain)
+	cfg.String("keys_file", false, true, "", &keysFile)
+	cfg.Duration("max_age", false, false, 21*24*time.Hour, &maxAge)
+	cfg.StringList("exclude_domains", false, false, nil, &exclude)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, domain := range exclude {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("%s: invalid domain in exclude_domains: %s: %v", sr.modName, domain, err)
+		}
+		sr.exclude[normDomain] = struct{}{}
+	}
+
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return fmt.Errorf("%s: invalid domain: %v", sr.modName, err)
+	}
+	sr.rewriter, err = srs.NewRewriter(normDomain, keysFile, maxAge)
+	if err != nil {
+		return fmt.Errorf("%s: %w", sr.modName, err)
+	}
+	return nil
+}
+
+func (sr *srsRewrite) Name() string {
+	return sr.modName
+}
+
+func (sr *srsRewrite) InstanceName() string {
+	return sr.instName
+}
+
+type srsState struct {
+	sr      *srsRewrite
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (sr *srsRewrite) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &srsState{
+		sr:      sr,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(sr.log, msgMeta),
+	}, nil
+}
+
+func (s *srsState) excluded(addr string) bool {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	_, domain, err := address.Split(normAddr)
+	if err != nil {
+		return false
+	}
+	_, ok := s.sr.exclude[domain]
+	return ok
+}
+
+func (s *srsState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if mailFrom == "" || s.excluded(mailFrom) {
+		return mailFrom, nil
+	}
+
+	rewritten, err := s.sr.rewriter.Forward(mailFrom, s.sr.now())
+	if err != nil {
+		s.log.Error("failed to rewrite sender address", err, "mail_from", mailFrom)
+		return mailFrom, nil
+	}
+	if rewritten != mailFrom {
+		s.log.Debugf("sender rewritten: %s => %s", mailFrom, rewritten)
+	}
+	return rewritten, nil
+}
+
+func (s *srsState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if !srs.IsSRS(rcptTo) {
+		return []string{rcptTo}, nil
+	}
+
+	orig, err := s.sr.rewriter.Reverse(rcptTo, s.sr.now())
+	switch err {
+	case nil:
+	case srs.ErrNotSRS:
+		// SRS address of another forwarder.
+		return []string{rcptTo}, nil
+	default:
+		msg := "Invalid SRS address"
+		if err == srs.ErrExpired {
+			msg = "SRS address is expired"
+		}
+		return nil, &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      msg,
+			Err:          err,
+			Misc: map[string]interface{}{
+				"modifier": s.sr.modName,
+				"rcpt":     rcptTo,
+			},
+		}
+	}
+
+	s.log.Debugf("recipient unwrapped: %s => %s", rcptTo, orig)
+	if s.msgMeta.ForwardRcpts == nil {
+		s.msgMeta.ForwardRcpts = make(map[string]struct{})
+	}
+	s.msgMeta.ForwardRcpts[orig] = struct{}{}
+	return []string{orig}, nil
+}
+
+func (s *srsState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s *srsState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.srs", NewSRS)
+}
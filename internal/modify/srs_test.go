@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testSRS(t *testing.T) *srsRewrite {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "maddy-srs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	keysFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keysFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewSRS("modify.srs", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*srsRewrite)
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domain", Args: []string{"forwarder.example"}},
+			{Name: "keys_file", Args: []string{keysFile}},
+			{Name: "exclude_domains", Args: []string{"forwarder.example", "local.example"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSRS(t *testing.T) {
+	m := testSRS(t)
+	ctx := context.Background()
+
+	msgMeta := &module.MsgMetadata{}
+	state, err := m.ModStateForMsg(ctx, msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, err := state.RewriteSender(ctx, "foo@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "@forwarder.example") {
+		t.Fatal("Unexpected rewritten address:", rewritten)
+	}
+
+	for _, addr := range []string{"", "bar@local.example", "bar@LOCAL.example"} {
+		res, err := state.RewriteSender(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != addr {
+			t.Errorf("Excluded address %s was rewritten: %s", addr, res)
+		}
+	}
+
+	rcpts, err := state.RewriteRcpt(ctx, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rcpts) != 1 || rcpts[0] != "foo@example.org" {
+		t.Fatal("Wrong unwrapped address:", rcpts)
+	}
+	if _, ok := msgMeta.ForwardRcpts["foo@example.org"]; !ok {
+		t.Error("Unwrapped address is not marked for forwarding")
+	}
+
+	// Non-SRS addresses and SRS addresses of other forwarders are left as is.
+	for _, addr := range []string{"bar@forwarder.example", "SRS0=AAAA=AA=example.org=foo@other.example"} {
+		rcpts, err := state.RewriteRcpt(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rcpts) != 1 || rcpts[0] != addr {
+			t.Errorf("%s was rewritten: %v", addr, rcpts)
+		}
+	}
+	if len(msgMeta.ForwardRcpts) != 1 {
+		t.Error("Unexpected forward recipients:", msgMeta.ForwardRcpts)
+	}
+}
+
+func TestSRS_Invalid(t *testing.T) {
+	m := testSRS(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	state, err := m.ModStateForMsg(ctx, &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := state.RewriteSender(ctx, "foo@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.now = func() time.Time { return now.Add(30 * 24 * time.Hour) }
+	for _, addr := range []string{
+		rewritten,
+		strings.Replace(rewritten, "=foo@", "=bar@", 1),
+		"SRS0=foo@forwarder.example",
+	} {
+		_, err := state.RewriteRcpt(ctx, addr)
+		if err == nil {
+			t.Errorf("No error for %s", addr)
+			continue
+		}
+		if code := exterrors.Fields(err)["smtp_code"]; code != 550 {
+			t.Errorf("Wrong SMTP code for %s: %v", addr, code)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const subaddressModName = "modify.subaddress"
+
+// subaddress is a module that removes the subaddress (detail) part from the
+// recipient local-part, e.g. user+tag@example.org becomes user@example.org.
+//
+// The original address is still available to other modules via
+// MsgMetadata.OriginalRcpts populated by the message pipeline.
+type subaddress struct {
+	instName string
+	log      log.Logger
+
+	// Sorted by length, longest first, so "--" is preferred to "-".
+	delimiters []string
+	domains    map[string]struct{}
+	mailboxes  module.Table
+	origHeader string
+}
+
+func NewSubaddress(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &subaddress{
+		instName:   instName,
+		log:        log.Logger{Name: subaddressModName},
+		delimiters: inlineArgs,
+	}, nil
+}
+
+func (s *subaddress) Name() string {
+	return subaddressModName
+}
+
+func (s *subaddress) InstanceName() string {
+	return s.instName
+}
+
+func (s *subaddress) Init(cfg *config.Map) error {
+	var domains []string
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	cfg.StringList("delimiters", false, false, s.delimiters, &s.delimiters)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.Custom("mailboxes", false, false, nil, modconfig.TableDirective, &s.mailboxes)
+	cfg.String("original_header", false, false, "", &s.origHeader)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(s.delimiters) == 0 {
+		s.delimiters = []string{"+"}
+	}
+	for _, delim := range s.delimiters {
+		if delim == "" || strings.ContainsAny(delim, "@\" \t") {
+			return fmt.Errorf("%s: invalid delimiter: %q", subaddressModName, delim)
+		}
+	}
+	sort.SliceStable(s.delimiters, func(i, j int) bool {
+		return len(s.delimiters[i]) > len(s.delimiters[j])
+	})
+
+	if len(domains) != 0 {
+		s.domains = make(map[string]struct{}, len(domains))
+		for _, domain := range domains {
+			normDomain, err := dns.ForLookup(domain)
+			if err != nil {
+				return fmt.Errorf("%s: invalid domain: %s: %v", subaddressModName, domain, err)
+			}
+			s.domains[normDomain] = struct{}{}
+		}
+	}
+
+	if s.origHeader != "" && !validFieldName(s.origHeader) {
+		return fmt.Errorf("%s: invalid header field name: %s", subaddressModName, s.origHeader)
+	}
+	return nil
+}
+
+// split splits the local-part into the user and detail parts. ok is false if
+// the local-part has no detail.
+func (s *subaddress) split(mbox string) (user, detail string, ok bool) {
+	for i := 1; i < len(mbox); i++ {
+		for _, delim := range s.delimiters {
+			if strings.HasPrefix(mbox[i:], delim) {
+				return mbox[:i], mbox[i+len(delim):], true
+			}
+		}
+	}
+	return mbox, "", false
+}
+
+// strip returns the address without the detail part.
+func (s *subaddress) strip(rcptTo string) (string, error) {
+	mbox, domain, err := address.Split(rcptTo)
+	if err != nil || mbox == "" || domain == "" {
+		return rcptTo, nil
+	}
+	if strings.HasPrefix(mbox, `"`) {
+		// Quoted local-parts are not mangled.
+		return rcptTo, nil
+	}
+
+	if s.domains != nil {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return rcptTo, nil
+		}
+		if _, ok := s.domains[normDomain]; !ok {
+			return rcptTo, nil
+		}
+	}
+
+	user, _, ok := s.split(mbox)
+	if !ok {
+		return rcptTo, nil
+	}
+
+	if s.mailboxes != nil {
+		normAddr, err := address.ForLookup(rcptTo)
+		if err != nil {
+			return rcptTo, nil
+		}
+		_, exists, err := s.mailboxes.Lookup(normAddr)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			// Address with the delimiter is a real mailbox.
+			return rcptTo, nil
+		}
+	}
+
+	return user + "@" + domain, nil
+}
+
+type subaddressState struct {
+	s   *subaddress
+	log log.Logger
+
+	rcpts    int
+	stripped string
+}
+
+func (s *subaddress) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &subaddressState{
+		s:   s,
+		log: target.DeliveryLogger(s.log, msgMeta),
+	}, nil
+}
+
+func (ss *subaddressState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (ss *subaddressState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	ss.rcpts++
+
+	newRcpt, err := ss.s.strip(rcptTo)
+	if err != nil {
+		return nil, err
+	}
+	if newRcpt != rcptTo {
+		ss.log.Debugf("subaddress stripped: %s => %s", rcptTo, newRcpt)
+		ss.stripped = rcptTo
+	}
+	return []string{newRcpt}, nil
+}
+
+func (ss *subaddressState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	// The header is shared by all recipients of the message, adding the
+	// original address for messages with multiple recipients would disclose
+	// them to each other.
+	if ss.s.origHeader == "" || ss.rcpts != 1 || ss.stripped == "" {
+		return nil
+	}
+	h.Add(ss.s.origHeader, ss.stripped)
+	return nil
+}
+
+func (ss *subaddressState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(subaddressModName, NewSubaddress)
+}
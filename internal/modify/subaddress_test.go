@@ -0,0 +1,131 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testSubaddress(t *testing.T, args []string, mailboxes module.Table, children ...config.Node) *subaddress {
+	t.Helper()
+
+	mod, err := NewSubaddress(subaddressModName, "", nil, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*subaddress)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	m.mailboxes = mailboxes
+	return m
+}
+
+func TestSubaddress(t *testing.T) {
+	test := func(m *subaddress, rcpt, expected string) {
+		t.Helper()
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcpts, err := state.RewriteRcpt(context.Background(), rcpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rcpts) != 1 || rcpts[0] != expected {
+			t.Errorf("%s: want %s, got %v", rcpt, expected, rcpts)
+		}
+	}
+
+	plus := testSubaddress(t, nil, nil)
+	test(plus, "user+tag@example.org", "user@example.org")
+	test(plus, "user+tag+more@example.org", "user@example.org")
+	test(plus, "user+@example.org", "user@example.org")
+	test(plus, "user@example.org", "user@example.org")
+	test(plus, "+tag@example.org", "+tag@example.org")
+	test(plus, "user-tag@example.org", "user-tag@example.org")
+	test(plus, `"user+tag"@example.org`, `"user+tag"@example.org`)
+	test(plus, "postmaster", "postmaster")
+
+	multi := testSubaddress(t, []string{"+", "-", "--"}, nil)
+	test(multi, "user-tag@example.org", "user@example.org")
+	test(multi, "user--tag@example.org", "user@example.org")
+	test(multi, "user+tag-x@example.org", "user@example.org")
+
+	domains := testSubaddress(t, nil, nil, config.Node{Name: "domains", Args: []string{"example.org"}})
+	test(domains, "user+tag@EXAMPLE.org", "user@EXAMPLE.org")
+	test(domains, "user+tag@example.com", "user+tag@example.com")
+
+	mailboxes := testSubaddress(t, []string{"-"}, testutils.Table{M: map[string]string{
+		"no-reply@example.org": "",
+	}})
+	test(mailboxes, "no-reply@example.org", "no-reply@example.org")
+	test(mailboxes, "No-Reply@example.org", "No-Reply@example.org")
+	test(mailboxes, "user-tag@example.org", "user@example.org")
+}
+
+func TestSubaddress_LookupError(t *testing.T) {
+	m := testSubaddress(t, nil, testutils.Table{Err: errors.New("lookup failed")})
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteRcpt(context.Background(), "user+tag@example.org"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	// No lookup is done for addresses without the detail.
+	if _, err := state.RewriteRcpt(context.Background(), "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubaddress_Header(t *testing.T) {
+	m := testSubaddress(t, nil, nil, config.Node{Name: "original_header", Args: []string{"X-Original-To"}})
+
+	test := func(rcpts []string, expected string) {
+		t.Helper()
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range rcpts {
+			if _, err := state.RewriteRcpt(context.Background(), rcpt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hdr := textproto.Header{}
+		if err := state.RewriteBody(context.Background(), &hdr, nil); err != nil {
+			t.Fatal(err)
+		}
+		if actual := hdr.Get("X-Original-To"); actual != expected {
+			t.Errorf("%v: want %q, got %q", rcpts, expected, actual)
+		}
+	}
+
+	test([]string{"user+tag@example.org"}, "user+tag@example.org")
+	test([]string{"user@example.org"}, "")
+	test([]string{"user+tag@example.org", "other@example.org"}, "")
+}
@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// subjectTag is a module that adds the tag (e.g. "[TEAM]") to the message
+// Subject or strips it.
+//
+// Adding is idempotent: if the tag is already present anywhere in the
+// Subject (e.g. "Re: [TEAM] hello"), it is not added again. Tag detection
+// works on the decoded Subject value and ignores case and whitespace so
+// RFC 2047 encoding differences do not matter.
+type subjectTag struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+
+	tag   string
+	strip bool
+	re    *regexp.Regexp
+}
+
+func NewSubjectTag(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &subjectTag{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+	}, nil
+}
+
+// tagRegexp builds the regexp matching the tag with any whitespace between
+// its characters.
+func tagRegexp(tag string) *regexp.Regexp {
+	var parts []string
+	for _, ch := range tag {
+		if unicode.IsSpace(ch) {
+			continue
+		}
+		parts = append(parts, regexp.QuoteMeta(string(ch)))
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(parts, `\s*`))
+}
+
+func (st *subjectTag) Init(cfg *config.Map) error {
+	var mode string
+	cfg.String("tag", false, len(st.inlineArgs) == 0, "", &st.tag)
+	cfg.Enum("mode", false, false, []string{"add", "strip"}, "add", &mode)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	switch len(st.inlineArgs) {
+	case 0:
+	case 1:
+		st.tag = st.inlineArgs[0]
+	default:
+		return fmt.Errorf("%s: at most one argument is allowed", st.modName)
+	}
+
+	st.tag = strings.TrimSpace(st.tag)
+	if st.tag == "" {
+		return fmt.Errorf("%s: tag can't be empty", st.modName)
+	}
+	st.strip = mode == "strip"
+	st.re = tagRegexp(st.tag)
+	return nil
+}
+
+func (st *subjectTag) Name() string {
+	return st.modName
+}
+
+func (st *subjectTag) InstanceName() string {
+	return st.instName
+}
+
+func (st *subjectTag) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return st, nil
+}
+
+func (st *subjectTag) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (st *subjectTag) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+// rewrite returns the new Subject value. ok is false if the Subject should
+// be left as is.
+func (st *subjectTag) rewrite(subject string) (newSubject string, ok bool) {
+	if st.strip {
+		if !st.re.MatchString(subject) {
+			return subject, false
+		}
+		stripped := st.re.ReplaceAllString(subject, " ")
+		return strings.Join(strings.Fields(stripped), " "), true
+	}
+
+	if st.re.MatchString(subject) {
+		return subject, false
+	}
+	if subject == "" {
+		return st.tag, true
+	}
+	return st.tag + " " + subject, true
+}
+
+func (st *subjectTag) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	hdr := message.Header{Header: *h}
+
+	raw := h.Get("Subject")
+	subject, err := hdr.Text("Subject")
+	if err != nil {
+		// Unknown charset, try to match on the raw value anyway since the tag
+		// is usually ASCII.
+		subject = raw
+	}
+
+	newSubject, ok := st.rewrite(subject)
+	if !ok {
+		return nil
+	}
+	if err != nil && st.strip {
+		// Do not risk corrupting the value we can't decode.
+		return nil
+	}
+
+	hdr.SetText("Subject", newSubject)
+	*h = hdr.Header
+	return nil
+}
+
+func (st *subjectTag) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.subject_tag", NewSubjectTag)
+}
@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func testSubjectTag(t *testing.T, mode string) *subjectTag {
+	t.Helper()
+
+	mod, err := NewSubjectTag("modify.subject_tag", "", nil, []string{"[TEAM]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*subjectTag)
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "mode", Args: []string{mode}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func rewriteSubject(t *testing.T, m *subjectTag, rawSubject string) string {
+	t.Helper()
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", rawSubject)
+	if err := m.RewriteBody(context.Background(), &hdr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := (&message.Header{Header: hdr}).Text("Subject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subject
+}
+
+func TestSubjectTag_Add(t *testing.T) {
+	m := testSubjectTag(t, "add")
+	test := func(raw, expected string) {
+		t.Helper()
+		if actual := rewriteSubject(t, m, raw); actual != expected {
+			t.Errorf("%q: want %q, got %q", raw, expected, actual)
+		}
+	}
+
+	test("hello", "[TEAM] hello")
+	test("Re: hello", "[TEAM] Re: hello")
+	test("[TEAM] hello", "[TEAM] hello")
+	test("Re: [TEAM] hello", "Re: [TEAM] hello")
+	test("Re: [team]  hello", "Re: [team]  hello")
+	test("Re: [ TEAM ] hello", "Re: [ TEAM ] hello")
+	test("=?utf-8?q?=5BTEAM=5D_hello?=", "[TEAM] hello")
+	test("=?UTF-8?B?W1RFQU1dINC/0YDQuNCy0LXRgg==?=", "[TEAM] привет")
+	test("=?iso-8859-1?q?Re=3A_=5BTEAM=5D_caf=E9?=", "Re: [TEAM] café")
+	test("привет", "[TEAM] привет")
+}
+
+func TestSubjectTag_AddTwice(t *testing.T) {
+	m := testSubjectTag(t, "add")
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Re: привет")
+	for i := 0; i < 2; i++ {
+		if err := m.RewriteBody(context.Background(), &hdr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subject, err := (&message.Header{Header: hdr}).Text("Subject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "[TEAM] Re: привет" {
+		t.Errorf("wrong subject after double processing: %q", subject)
+	}
+}
+
+func TestSubjectTag_Strip(t *testing.T) {
+	m := testSubjectTag(t, "strip")
+	test := func(raw, expected string) {
+		t.Helper()
+		if actual := rewriteSubject(t, m, raw); actual != expected {
+			t.Errorf("%q: want %q, got %q", raw, expected, actual)
+		}
+	}
+
+	test("hello", "hello")
+	test("[TEAM] hello", "hello")
+	test("[TEAM] Re: [TEAM] hello", "Re: hello")
+	test("Re: [ team ] hello", "Re: hello")
+	test("=?utf-8?q?Re=3A_=5BTEAM=5D_=D0=BF=D1=80=D0=B8=D0=B2=D0=B5=D1=82?=", "Re: привет")
+}
@@ -0,0 +1,270 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package urlrewrite
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/net/html"
+)
+
+// Max. line length allowed by RFC 5322 for 7bit/8bit content (excluding
+// CRLF). If rewritten part has longer lines, it is converted to
+// quoted-printable.
+const maxLineLen = 998
+
+var textURLRe = regexp.MustCompile("(?i)\\bhttps?://[^\\s<>\"'`]+")
+
+// rewriteEntity rewrites URLs in the entity body read from r.
+//
+// It returns the new body and the amount of rewritten URLs. If no URLs are
+// rewritten, the original body is returned. Header can be changed if the
+// transfer encoding has to be changed.
+func (m *Modifier) rewriteEntity(h *textproto.Header, r io.Reader) ([]byte, int, error) {
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		raw, err := ioutil.ReadAll(r)
+		return raw, 0, err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		return m.rewriteMultipart(params["boundary"], r)
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return raw, 0, nil
+	}
+	if disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && disp == "attachment" {
+		return raw, 0, nil
+	}
+	// URLs can be found using byte-level matching only in ASCII-compatible
+	// charsets.
+	if charset := strings.ToLower(params["charset"]); strings.HasPrefix(charset, "utf-16") || strings.HasPrefix(charset, "utf-32") {
+		return raw, 0, nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	decoded, err := decodeBody(encoding, raw)
+	if err != nil {
+		// Malformed encoding, leave the part as is.
+		return raw, 0, nil
+	}
+
+	var (
+		rewritten []byte
+		count     int
+	)
+	if mediaType == "text/html" {
+		rewritten, count = m.rewriteHTML(decoded)
+	} else {
+		rewritten, count = m.rewriteText(decoded)
+	}
+	if count == 0 {
+		return raw, 0, nil
+	}
+
+	if (encoding == "" || encoding == "7bit" || encoding == "8bit") && hasLongLines(rewritten) {
+		encoding = "quoted-printable"
+		h.Set("Content-Transfer-Encoding", encoding)
+	}
+	encoded, err := encodeBody(encoding, rewritten)
+	if err != nil {
+		return nil, 0, err
+	}
+	return encoded, count, nil
+}
+
+func (m *Modifier) rewriteMultipart(boundary string, r io.Reader) ([]byte, int, error) {
+	var (
+		out   bytes.Buffer
+		total int
+	)
+
+	mr := textproto.NewMultipartReader(r, boundary)
+	mw := textproto.NewMultipartWriter(&out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		partHdr := p.Header
+		partBody, count, err := m.rewriteEntity(&partHdr, p)
+		if err != nil {
+			return nil, 0, err
+		}
+		total += count
+
+		pw, err := mw.CreatePart(partHdr)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := pw.Write(partBody); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, 0, err
+	}
+	return out.Bytes(), total, nil
+}
+
+func (m *Modifier) rewriteText(text []byte) ([]byte, int) {
+	count := 0
+	res := textURLRe.ReplaceAllFunc(text, func(match []byte) []byte {
+		// Trailing punctuation is most likely not a part of the URL.
+		trimmed := bytes.TrimRight(match, ".,;:!?)]}")
+		replacement, ok := m.rewriteURL(string(trimmed))
+		if !ok {
+			return match
+		}
+		count++
+		return append([]byte(replacement), match[len(trimmed):]...)
+	})
+	return res, count
+}
+
+// rewriteHTML rewrites URLs in href and src attributes. Everything else,
+// including visible text, is copied as is.
+func (m *Modifier) rewriteHTML(content []byte) ([]byte, int) {
+	var (
+		out   bytes.Buffer
+		count int
+	)
+
+	z := html.NewTokenizer(bytes.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return content, 0
+			}
+			break
+		}
+
+		// Token() modifies the underlying buffer (lowercases tag and attribute
+		// names), so copy the raw token first.
+		raw := append([]byte(nil), z.Raw()...)
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+
+		tok := z.Token()
+		changed := false
+		for i, attr := range tok.Attr {
+			if attr.Namespace != "" || (attr.Key != "href" && attr.Key != "src") {
+				continue
+			}
+			replacement, ok := m.rewriteURL(strings.TrimSpace(attr.Val))
+			if !ok {
+				continue
+			}
+			tok.Attr[i].Val = replacement
+			changed = true
+			count++
+		}
+		if changed {
+			out.WriteString(tok.String())
+		} else {
+			out.Write(raw)
+		}
+	}
+
+	return out.Bytes(), count
+}
+
+func decodeBody(encoding string, raw []byte) ([]byte, error) {
+	switch encoding {
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(raw)), ""))
+	default:
+		return raw, nil
+	}
+}
+
+func encodeBody(encoding string, content []byte) ([]byte, error) {
+	var out bytes.Buffer
+	switch encoding {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&out)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(content)
+		for len(encoded) > 76 {
+			out.WriteString(encoded[:76])
+			out.WriteString("\r\n")
+			encoded = encoded[76:]
+		}
+		out.WriteString(encoded)
+		out.WriteString("\r\n")
+	default:
+		out.Write(content)
+	}
+	return out.Bytes(), nil
+}
+
+func hasLongLines(content []byte) bool {
+	for len(content) != 0 {
+		end := bytes.IndexByte(content, '\n')
+		if end == -1 {
+			end = len(content)
+		}
+		if len(bytes.TrimSuffix(content[:end], []byte{'\r'})) > maxLineLen {
+			return true
+		}
+		if end == len(content) {
+			break
+		}
+		content = content[end+1:]
+	}
+	return false
+}
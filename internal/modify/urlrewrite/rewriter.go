@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package urlrewrite
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// URLRewriter is the interface implemented by URL rewriting schemes.
+type URLRewriter interface {
+	// RewriteURL returns the replacement for the URL. original is the URL as
+	// found in the message, parsed is its parsed version.
+	//
+	// ok is false if the URL should be left as is.
+	RewriteURL(original string, parsed *url.URL) (replacement string, ok bool)
+}
+
+// templateRewriter replaces URLs with the template, where the {url}
+// placeholder is replaced with query-escaped original URL and {url_base64}
+// with its base64url encoding (without padding).
+type templateRewriter struct {
+	template string
+	// Host of the redirector, URLs pointing to it are not rewritten to make
+	// rewriting idempotent.
+	host string
+}
+
+func newTemplateRewriter(template string) (*templateRewriter, error) {
+	if !strings.Contains(template, "{url}") && !strings.Contains(template, "{url_base64}") {
+		return nil, errors.New("template should contain {url} or {url_base64} placeholder")
+	}
+
+	// Placeholders are not valid in URLs, replace them to parse the rest.
+	u, err := url.Parse(strings.NewReplacer("{url}", "x", "{url_base64}", "x").Replace(template))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("template should be an absolute http or https URL")
+	}
+
+	return &templateRewriter{
+		template: template,
+		host:     strings.ToLower(u.Hostname()),
+	}, nil
+}
+
+func (tr *templateRewriter) RewriteURL(original string, parsed *url.URL) (string, bool) {
+	if strings.EqualFold(parsed.Hostname(), tr.host) {
+		return "", false
+	}
+
+	return strings.NewReplacer(
+		"{url}", url.QueryEscape(original),
+		"{url_base64}", base64.RawURLEncoding.EncodeToString([]byte(original)),
+	).Replace(tr.template), true
+}
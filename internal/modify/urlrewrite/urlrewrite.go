@@ -0,0 +1,265 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package urlrewrite implements the modifier that replaces URLs in the
+// message body with links to a scanning redirector.
+package urlrewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "modify.url_rewrite"
+
+	// NoteHeader is the header field added to messages that were not
+	// processed because of the size limit.
+	NoteHeader = "X-URL-Rewrite"
+)
+
+type Modifier struct {
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	rewriter     URLRewriter
+	localDomains map[string]struct{}
+	skipSenders  map[string]struct{}
+	allowDomains []string
+	maxSize      int
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) > 1 {
+		return nil, fmt.Errorf("%s: at most one argument is allowed", modName)
+	}
+	return &Modifier{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func domainSet(domains []string) (map[string]struct{}, error) {
+	res := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed domain %s: %v", modName, domain, err)
+		}
+		res[normDomain] = struct{}{}
+	}
+	return res, nil
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		template     string
+		localDomains []string
+		skipSenders  []string
+		err          error
+	)
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("template", false, len(m.inlineArgs) == 0, "", &template)
+	cfg.StringList("local_domains", false, true, nil, &localDomains)
+	cfg.StringList("skip_sender_domains", false, false, nil, &skipSenders)
+	cfg.StringList("allow_domains", false, false, nil, &m.allowDomains)
+	cfg.DataSize("max_size", false, false, 5*1024*1024, &m.maxSize)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(m.inlineArgs) == 1 {
+		template = m.inlineArgs[0]
+	}
+	m.rewriter, err = newTemplateRewriter(template)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+
+	m.localDomains, err = domainSet(localDomains)
+	if err != nil {
+		return err
+	}
+	m.skipSenders, err = domainSet(skipSenders)
+	if err != nil {
+		return err
+	}
+	for i, domain := range m.allowDomains {
+		m.allowDomains[i], err = dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("%s: malformed domain %s: %v", modName, domain, err)
+		}
+	}
+
+	return nil
+}
+
+// allowed reports whether the host matches or is a subdomain of a domain in
+// allow_domains.
+func (m *Modifier) allowed(host string) bool {
+	for _, domain := range m.allowDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Modifier) rewriteURL(original string) (string, bool) {
+	parsed, err := url.Parse(original)
+	if err != nil {
+		return "", false
+	}
+	if scheme := strings.ToLower(parsed.Scheme); scheme != "http" && scheme != "https" {
+		return "", false
+	}
+	if m.allowed(strings.ToLower(parsed.Hostname())) {
+		return "", false
+	}
+	return m.rewriter.RewriteURL(original, parsed)
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	// Reason to leave the message as is, empty if it should be processed.
+	skipReason string
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	s := &state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}
+	if msgMeta.Conn != nil && msgMeta.Conn.AuthUser != "" {
+		s.skipReason = "message is submitted by an authenticated user"
+	}
+	return s, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if s.skipReason != "" {
+		return mailFrom, nil
+	}
+
+	_, domain, err := address.Split(mailFrom)
+	if err != nil || domain == "" {
+		return mailFrom, nil
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return mailFrom, nil
+	}
+	if _, ok := s.m.skipSenders[domain]; ok {
+		s.skipReason = "sender domain is excluded"
+	}
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if s.skipReason != "" {
+		return []string{rcptTo}, nil
+	}
+
+	_, domain, err := address.Split(rcptTo)
+	if err != nil || domain == "" {
+		return []string{rcptTo}, nil
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return []string{rcptTo}, nil
+	}
+	// Never change messages that are relayed further, the content may
+	// be covered by DKIM signatures the final recipient will verify.
+	if _, ok := s.m.localDomains[domain]; !ok {
+		s.skipReason = "message has non-local recipients"
+	}
+	return []string{rcptTo}, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+// ReplaceBody implements module.BodyReplacingModifierState.
+func (s *state) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, modName+"/ReplaceBody").End()
+
+	if s.skipReason != "" {
+		s.log.Debugf("not rewriting URLs: %s", s.skipReason)
+		return nil, nil
+	}
+	if body.Len() > s.m.maxSize {
+		s.log.Msg("message is too big, not rewriting URLs", "size", body.Len())
+		h.Add(NoteHeader, "skipped; message size exceeds the limit")
+		return nil, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	newBody, count, err := s.m.rewriteEntity(h, io.LimitReader(r, int64(s.m.maxSize)))
+	if err != nil {
+		// Not fatal, the message is still delivered with original links.
+		s.log.Error("failed to rewrite URLs", err)
+		return nil, nil
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	s.log.Debugf("rewritten %d URLs", count)
+	return buffer.MemoryBuffer{Slice: newBody}, nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
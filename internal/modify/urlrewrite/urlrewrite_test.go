@@ -0,0 +1,235 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package urlrewrite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testModifier(t *testing.T, children ...config.Node) *Modifier {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, []string{"https://scan.example.net/?u={url}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modName)
+	children = append(children, config.Node{Name: "local_domains", Args: []string{"example.org"}})
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// rewriteMsg runs the message through the modifier and returns the
+// resulting header and body. Body is nil if it is not changed.
+func rewriteMsg(t *testing.T, m *Modifier, msgMeta *module.MsgMetadata, from, to, msg string) (textproto.Header, []byte) {
+	t.Helper()
+
+	if msgMeta == nil {
+		msgMeta = &module.MsgMetadata{}
+	}
+	state, err := m.ModStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if _, err := state.RewriteSender(context.Background(), from); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteRcpt(context.Background(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := buffer.MemoryBuffer{Slice: []byte(msg[strings.Index(msg, "\r\n\r\n")+4:])}
+
+	newBody, err := state.(module.BodyReplacingModifierState).ReplaceBody(context.Background(), &hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBody == nil {
+		return hdr, nil
+	}
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, blob
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func TestRewrite_Text(t *testing.T) {
+	m := testModifier(t)
+
+	_, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.org", crlf(`Content-Type: text/plain
+
+See https://evil.example.com/login?a=1&b=2, or <http://example.com/x>.
+Already safe: https://scan.example.net/?u=abc
+`))
+	expected := crlf(`See https://scan.example.net/?u=https%3A%2F%2Fevil.example.com%2Flogin%3Fa%3D1%26b%3D2, or <https://scan.example.net/?u=http%3A%2F%2Fexample.com%2Fx>.
+Already safe: https://scan.example.net/?u=abc
+`)
+	if string(body) != expected {
+		t.Errorf("Wrong body:\n%s\nExpected:\n%s", body, expected)
+	}
+}
+
+func TestRewrite_HTML(t *testing.T) {
+	m := testModifier(t)
+
+	_, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.org", crlf(`Content-Type: text/html
+
+<HTML><a HREF="https://evil.example.com/?a=1&amp;b=2" class=x>https://evil.example.com/</a>
+<img src='http://evil.example.com/i.png'><a href="mailto:x@example.com">m</a></HTML>
+`))
+	expected := crlf(`<HTML><a href="https://scan.example.net/?u=https%3A%2F%2Fevil.example.com%2F%3Fa%3D1%26b%3D2" class="x">https://evil.example.com/</a>
+<img src="https://scan.example.net/?u=http%3A%2F%2Fevil.example.com%2Fi.png"><a href="mailto:x@example.com">m</a></HTML>
+`)
+	if string(body) != expected {
+		t.Errorf("Wrong body:\n%s\nExpected:\n%s", body, expected)
+	}
+}
+
+func TestRewrite_MultipartEncoded(t *testing.T) {
+	m := testModifier(t)
+
+	_, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.org", crlf(`Content-Type: multipart/alternative; boundary=BOUNDARY
+
+--BOUNDARY
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Caf=C3=A9 https://evil.example.com/path
+--BOUNDARY
+Content-Type: text/html
+Content-Transfer-Encoding: base64
+
+PGEgaHJlZj0iaHR0cHM6Ly9ldmlsLmV4YW1wbGUuY29tLyI+eDwvYT4=
+--BOUNDARY
+Content-Type: text/plain
+Content-Disposition: attachment; filename=x.txt
+
+https://evil.example.com/attachment
+--BOUNDARY--
+`))
+	if body == nil {
+		t.Fatal("Body is not changed")
+	}
+
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), "BOUNDARY")
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		blob, _ := ioutil.ReadAll(p)
+		parts = append(parts, string(blob))
+	}
+	expected := []string{
+		"Caf=C3=A9 https://scan.example.net/?u=3Dhttps%3A%2F%2Fevil.example.com%2Fpa=\r\nth",
+		"PGEgaHJlZj0iaHR0cHM6Ly9zY2FuLmV4YW1wbGUubmV0Lz91PWh0dHBzJTNBJTJGJTJGZXZpbC5l\r\neGFtcGxlLmNvbSUyRiI+eDwvYT4=\r\n",
+		"https://evil.example.com/attachment",
+	}
+	if len(parts) != len(expected) {
+		t.Fatalf("Wrong amount of parts: %d", len(parts))
+	}
+	for i := range expected {
+		if parts[i] != expected[i] {
+			t.Errorf("Wrong part %d:\n%q\nExpected:\n%q", i, parts[i], expected[i])
+		}
+	}
+}
+
+func TestRewrite_LongLines(t *testing.T) {
+	m := testModifier(t)
+
+	line := "https://evil.example.com/" + strings.Repeat("a", 960)
+	hdr, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.org", "Content-Type: text/plain\r\n\r\n"+line+"\r\n")
+	if cte := hdr.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Fatal("Content-Transfer-Encoding is not changed:", cte)
+	}
+	for _, l := range strings.Split(string(body), "\r\n") {
+		if len(l) > 76 {
+			t.Fatal("Line is too long:", l)
+		}
+	}
+}
+
+func TestRewrite_Skip(t *testing.T) {
+	msg := crlf(`Content-Type: text/plain
+
+https://evil.example.com/
+https://docs.example.com/
+`)
+
+	m := testModifier(t,
+		config.Node{Name: "skip_sender_domains", Args: []string{"partner.example"}},
+		config.Node{Name: "allow_domains", Args: []string{"docs.example.com"}},
+		config.Node{Name: "max_size", Args: []string{"100B"}},
+	)
+
+	_, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.org", msg)
+	if !strings.Contains(string(body), "https://docs.example.com/") || strings.Contains(string(body), "https://evil") {
+		t.Errorf("Allowlisted URL is rewritten or other URL is not:\n%s", body)
+	}
+
+	if _, body := rewriteMsg(t, m, nil, "a@partner.example", "b@example.org", msg); body != nil {
+		t.Error("Message from excluded sender domain is changed")
+	}
+	if _, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.com", msg); body != nil {
+		t.Error("Message for non-local recipient is changed")
+	}
+	if _, body := rewriteMsg(t, m, &module.MsgMetadata{Conn: &module.ConnState{AuthUser: "a"}}, "a@example.com", "b@example.org", msg); body != nil {
+		t.Error("Submitted message is changed")
+	}
+
+	hdr, body := rewriteMsg(t, m, nil, "a@example.com", "b@example.org", msg+strings.Repeat("x", 100))
+	if body != nil {
+		t.Error("Too big message is changed")
+	}
+	if hdr.Get(NoteHeader) == "" {
+		t.Error("No note header for too big message")
+	}
+}
@@ -79,8 +79,8 @@ func TestMsgPipeline_BodyNonAtomic_ModifiedRcpt(t *testing.T) {
 				Modifiers: []module.Modifier{
 					testutils.Modifier{
 						InstName: "test_modifier",
-						RcptTo: map[string]string{
-							"tester@example.org": "tester-alias@example.org",
+						RcptTo: map[string][]string{
+							"tester@example.org": {"tester-alias@example.org"},
 						},
 					},
 				},
@@ -146,3 +146,81 @@ func TestMsgPipeline_BodyNonAtomic_ExpandAtomic(t *testing.T) {
 		t.Errorf("wrong error for tester@example.org: %v", err)
 	}
 }
+
+func TestMsgPipeline_BodyNonAtomic_RcptHeaderErr(t *testing.T) {
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					modifiers: modify.Group{
+						Modifiers: []module.Modifier{rcptHeaderModifier{
+							errs: map[string]error{"tester@example.org": errors.New("go away")},
+						}},
+					},
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	c := multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.org", []string{"tester@example.org", "tester2@example.org"})
+
+	if c["tester@example.org"] == nil {
+		t.Fatalf("no error for tester@example.org")
+	}
+	if c["tester2@example.org"] != nil {
+		t.Fatalf("unexpected error for tester2@example.org: %v", c["tester2@example.org"])
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	testutils.CheckMsg(t, &target.Messages[0], "sender@example.org", []string{"tester2@example.org"})
+}
+
+func TestMsgPipeline_BodyNonAtomic_DuplicateRcpt(t *testing.T) {
+	err := errors.New("go away")
+
+	target := testutils.Target{
+		PartialBodyErr: map[string]error{
+			"a@example.org": err,
+		},
+	}
+	mod := testutils.Modifier{
+		RcptTo: map[string][]string{
+			"tester@example.org":  {"a@example.org"},
+			"tester2@example.org": {"a@example.org"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	c := multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.org", []string{"tester@example.org", "tester2@example.org"})
+
+	for _, rcpt := range []string{"tester@example.org", "tester2@example.org"} {
+		if c[rcpt] == nil {
+			t.Fatalf("no error for %s", rcpt)
+		}
+	}
+	if c["a@example.org"] != nil {
+		t.Fatalf("status reported for the rewritten address")
+	}
+}
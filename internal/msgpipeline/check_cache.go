@@ -0,0 +1,146 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package msgpipeline
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	stageConnection = "connection"
+	stageSender     = "sender"
+)
+
+type checkCacheKey struct {
+	check module.Check
+	stage string
+}
+
+// checkCacheInput contains everything results of a cacheable check may
+// depend on. Entry is discarded if any of these change.
+type checkCacheInput struct {
+	remoteAddr string
+	helo       string
+	authUser   string
+	tls        bool
+	fromDomain string
+}
+
+type checkCacheEntry struct {
+	input checkCacheInput
+	res   module.CheckResult
+}
+
+// checkCache stores results of module.CacheableCheck checks for the duration
+// of the client connection.
+//
+// It is stored in module.ConnState.Data and shared by all pipelines
+// handling messages received over the connection.
+type checkCache struct {
+	lock    sync.Mutex
+	entries map[checkCacheKey]checkCacheEntry
+
+	hits   int64
+	misses int64
+}
+
+type checkCacheDataKey struct{}
+
+func connCheckCache(conn *module.ConnState) *checkCache {
+	if conn == nil || conn.Data == nil {
+		return nil
+	}
+	cacheI, _ := conn.Data.LoadOrStore(checkCacheDataKey{}, &checkCache{
+		entries: make(map[checkCacheKey]checkCacheEntry),
+	})
+	return cacheI.(*checkCache)
+}
+
+func cacheInput(conn *module.ConnState, mailFrom string) checkCacheInput {
+	input := checkCacheInput{
+		helo:     conn.Hostname,
+		authUser: conn.AuthUser,
+		tls:      conn.TLS.HandshakeComplete,
+	}
+	if conn.RemoteAddr != nil {
+		input.remoteAddr = conn.RemoteAddr.String()
+	}
+
+	_, domain, err := address.Split(mailFrom)
+	if err != nil {
+		// Should not happen since address is validated by the message
+		// source, use it as is to stay on the safe side.
+		domain = mailFrom
+	}
+	input.fromDomain, _ = dns.ForLookup(domain)
+	return input
+}
+
+func (c *checkCache) get(key checkCacheKey, input checkCacheInput) (module.CheckResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.input != input {
+		atomic.AddInt64(&c.misses, 1)
+		return module.CheckResult{}, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return entry.res, true
+}
+
+func (c *checkCache) put(key checkCacheKey, input checkCacheInput, res module.CheckResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Replaces the entry for previous inputs, if any.
+	c.entries[key] = checkCacheEntry{input: input, res: res}
+}
+
+func (c *checkCache) stats() (hits, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// cachedResult returns the cached result of the stage for the check or calls
+// run and caches its result.
+//
+// Caching is not done for checks not implementing module.CacheableCheck or
+// if the message source does not support connection-level data.
+func (cr *checkRunner) cachedResult(check module.Check, stage string, run func() module.CheckResult) module.CheckResult {
+	cacheable, ok := check.(module.CacheableCheck)
+	if !ok || !cacheable.CacheResults() || cr.cache == nil {
+		return run()
+	}
+
+	key := checkCacheKey{check: check, stage: stage}
+	input := cacheInput(cr.msgMeta.Conn, cr.mailFrom)
+	if res, ok := cr.cache.get(key, input); ok {
+		atomic.AddInt64(&cr.msgCacheHits, 1)
+		cr.log.Debugf("using cached %s result for %v (%p)", stage, objectName(check), check)
+		return res
+	}
+
+	res := run()
+	cr.cache.put(key, input, res)
+	return res
+}
@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"time"
+
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/module"
@@ -38,7 +40,35 @@ type CheckGroup struct {
 }
 
 func (cg *CheckGroup) Init(cfg *config.Map) error {
+	var (
+		timeout       time.Duration
+		timeoutAction = modconfig.FailAction{Reject: true}
+	)
+
 	for _, node := range cfg.Block.Children {
+		switch node.Name {
+		case "timeout":
+			if len(node.Args) != 1 || len(node.Children) != 0 {
+				return config.NodeErr(node, "expected exactly one argument")
+			}
+			var err error
+			timeout, err = time.ParseDuration(node.Args[0])
+			if err != nil {
+				return config.NodeErr(node, "%v", err)
+			}
+			if timeout < 0 {
+				return config.NodeErr(node, "timeout can't be negative")
+			}
+			continue
+		case "timeout_action":
+			action, err := modconfig.FailActionDirective(cfg, node)
+			if err != nil {
+				return err
+			}
+			timeoutAction = action.(modconfig.FailAction)
+			continue
+		}
+
 		chk, err := modconfig.MessageCheck(cfg.Globals, append([]string{node.Name}, node.Args...), node)
 		if err != nil {
 			return err
@@ -47,6 +77,16 @@ func (cg *CheckGroup) Init(cfg *config.Map) error {
 		cg.L = append(cg.L, chk)
 	}
 
+	if timeout != 0 {
+		for i, chk := range cg.L {
+			cg.L[i] = &limitedCheck{
+				Check:         chk,
+				timeout:       timeout,
+				timeoutAction: timeoutAction,
+			}
+		}
+	}
+
 	return nil
 }
 
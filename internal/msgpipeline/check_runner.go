@@ -21,6 +21,7 @@ package msgpipeline
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -29,6 +30,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/sanitize"
 	"github.com/foxcpp/maddy/internal/dmarc"
 )
 
@@ -51,8 +53,34 @@ type checkRunner struct {
 	log log.Logger
 
 	states map[module.Check]module.CheckState
+	// Reverse mapping for states, used to look up cached results.
+	stateChecks map[module.CheckState]module.Check
+
+	// Per-connection cache for results of module.CacheableCheck checks, nil
+	// if not supported by the message source.
+	cache        *checkCache
+	msgCacheHits int64
+
+	// Per-check limits set using the check block directives, see
+	// check_timeout.go.
+	limits       map[module.CheckState]*limitedCheck
+	timedOut     map[module.CheckState]chan struct{}
+	timedOutLock sync.Mutex
+
+	// Max. amount of checks to run in parallel for each stage, 0 means no
+	// limit.
+	parallelism int
+
+	// Results of checks that were given the body while it was received, see
+	// streaming.go.
+	streamedRes map[module.CheckState]module.CheckResult
 
 	mergedRes module.CheckResult
+
+	// Message spam score thresholds and contributions of individual checks,
+	// see score.go.
+	scoreCfg   scoreCfg
+	scoreParts []scorePart
 }
 
 func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver) *checkRunner {
@@ -63,6 +91,11 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		stateChecks:          make(map[module.CheckState]module.Check),
+		limits:               make(map[module.CheckState]*limitedCheck),
+		timedOut:             make(map[module.CheckState]chan struct{}),
+		streamedRes:          make(map[module.CheckState]module.CheckResult),
+		cache:                connCheckCache(msgMeta.Conn),
 	}
 }
 
@@ -77,8 +110,19 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	}
 
 	for _, check := range checks {
+		lc, _ := check.(*limitedCheck)
+		check := unwrapCheck(check)
+
+		if _, ok := newStatesMap[check]; ok {
+			// Duplicate, state is already in the list.
+			continue
+		}
+
 		state, ok := cr.states[check]
 		if ok {
+			if _, ok := cr.limits[state]; !ok && lc != nil {
+				cr.limits[state] = lc
+			}
 			states = append(states, state)
 			continue
 		}
@@ -92,6 +136,10 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+		cr.stateChecks[state] = check
+		if lc != nil {
+			cr.limits[state] = lc
+		}
 	}
 
 	if len(newStates) == 0 {
@@ -104,17 +152,19 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	// Done outside of check loop above to make sure we can run these for multiple
 	// checks in parallel.
 	if cr.mailFromReceived {
-		err := cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
-			res := s.CheckConnection(ctx)
-			return res
+		err := cr.runAndMergeResults(ctx, newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
+			return cr.cachedResult(cr.stateChecks[s], stageConnection, func() module.CheckResult {
+				return s.CheckConnection(ctx)
+			})
 		})
 		if err != nil {
 			closeStates()
 			return nil, err
 		}
-		err = cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
-			res := s.CheckSender(ctx, cr.mailFrom)
-			return res
+		err = cr.runAndMergeResults(ctx, newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
+			return cr.cachedResult(cr.stateChecks[s], stageSender, func() module.CheckResult {
+				return s.CheckSender(ctx, cr.mailFrom)
+			})
 		})
 		if err != nil {
 			closeStates()
@@ -125,7 +175,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	if len(cr.checkedRcpts) != 0 {
 		for _, rcpt := range cr.checkedRcpts {
 			rcpt := rcpt
-			err := cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+			err := cr.runAndMergeResults(ctx, states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 				// Avoid calling CheckRcpt for the same recipient for the same check
 				// multiple times, even if requested.
 				cr.checkedRcptsLock.Lock()
@@ -158,73 +208,74 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	return states, nil
 }
 
-func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
-	data := struct {
-		authResLock sync.Mutex
-		headerLock  sync.Mutex
-
-		quarantineErr    error
-		quarantineCheck  string
-		setQuarantineErr sync.Once
-
-		rejectErr    error
-		rejectCheck  string
-		setRejectErr sync.Once
-
-		wg sync.WaitGroup
-	}{}
+// runAndMergeResults calls runner for all states in parallel (limited by
+// cr.parallelism) and merges the results.
+//
+// Results are merged in the order of states, not in the order of completion,
+// so Authentication-Results and header fields are deterministic.
+func (cr *checkRunner) runAndMergeResults(ctx context.Context, states []module.CheckState, runner func(context.Context, module.CheckState) module.CheckResult) error {
+	var (
+		results = make([]module.CheckResult, len(states))
+		wg      sync.WaitGroup
+		sem     chan struct{}
+	)
+	if cr.parallelism > 0 {
+		sem = make(chan struct{}, cr.parallelism)
+	}
 
-	for _, state := range states {
-		state := state
-		data.wg.Add(1)
+	for i, state := range states {
+		i, state := i, state
+		wg.Add(1)
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		go func() {
-			subCheckRes := runner(state)
-
-			// We check the length because we don't want to take locks
-			// when it is not necessary.
-			if len(subCheckRes.AuthResult) != 0 {
-				data.authResLock.Lock()
-				cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, subCheckRes.AuthResult...)
-				data.authResLock.Unlock()
+			defer wg.Done()
+			results[i] = cr.runLimited(ctx, state, runner)
+			if sem != nil {
+				<-sem
 			}
-			if subCheckRes.Header.Len() != 0 {
-				data.headerLock.Lock()
-				for field := subCheckRes.Header.Fields(); field.Next(); {
-					formatted, err := field.Raw()
-					if err != nil {
-						cr.log.Error("malformed header field added by check", err)
-					}
-					cr.mergedRes.Header.AddRaw(formatted)
-				}
-				data.headerLock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	var (
+		quarantineErr error
+		rejectErr     error
+	)
+	for i, subCheckRes := range results {
+		cr.addScore(states[i], subCheckRes.Score)
+		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, subCheckRes.AuthResult...)
+		for field := subCheckRes.Header.Fields(); field.Next(); {
+			formatted, err := field.Raw()
+			if err != nil {
+				cr.log.Error("malformed header field added by check", err)
 			}
+			cr.mergedRes.Header.AddRaw(formatted)
+		}
 
-			if subCheckRes.Quarantine {
-				data.setQuarantineErr.Do(func() {
-					data.quarantineErr = subCheckRes.Reason
-				})
-			} else if subCheckRes.Reject {
-				data.setRejectErr.Do(func() {
-					data.rejectErr = subCheckRes.Reason
-				})
-			} else if subCheckRes.Reason != nil {
-				// 'action ignore' case. There is Reason, but action.Apply set
-				// both Reject and Quarantine to false. Log the reason for
-				// purposes of deployment testing.
-				cr.log.Error("no check action", subCheckRes.Reason)
+		if subCheckRes.Quarantine {
+			if quarantineErr == nil {
+				quarantineErr = subCheckRes.Reason
 			}
-
-			data.wg.Done()
-		}()
+		} else if subCheckRes.Reject {
+			if rejectErr == nil {
+				rejectErr = subCheckRes.Reason
+			}
+		} else if subCheckRes.Reason != nil {
+			// 'action ignore' case. There is Reason, but action.Apply set
+			// both Reject and Quarantine to false. Log the reason for
+			// purposes of deployment testing.
+			cr.log.Error("no check action", subCheckRes.Reason)
+		}
 	}
 
-	data.wg.Wait()
-	if data.rejectErr != nil {
-		return data.rejectErr
+	if rejectErr != nil {
+		return rejectErr
 	}
 
-	if data.quarantineErr != nil {
-		cr.log.Error("quarantined", data.quarantineErr)
+	if quarantineErr != nil {
+		cr.log.Error("quarantined", quarantineErr)
 		cr.mergedRes.Quarantine = true
 	}
 
@@ -246,7 +297,7 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 		return err
 	}
 
-	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	err = cr.runAndMergeResults(ctx, states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 		cr.checkedRcptsLock.Lock()
 		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
 			cr.checkedRcptsLock.Unlock()
@@ -277,13 +328,16 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	return cr.runAndMergeResults(ctx, states, func(ctx context.Context, s module.CheckState) module.CheckResult {
+		if res, ok := cr.streamedRes[s]; ok {
+			return res
+		}
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
 }
 
-func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
+func (cr *checkRunner) applyResults(hostname string, header *textproto.Header, rcpts []string) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
 	}
@@ -320,10 +374,14 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 		}
 	}
 
+	if err := cr.applyScore(header, rcpts); err != nil {
+		return err
+	}
+
 	// After results for all checks are checked, authRes will be populated with values
 	// we should put into Authentication-Results header.
 	if len(cr.mergedRes.AuthResult) != 0 {
-		header.Add("Authentication-Results", authres.Format(hostname, cr.mergedRes.AuthResult))
+		header.Add("Authentication-Results", sanitize.HeaderValue(authres.Format(hostname, cr.mergedRes.AuthResult)))
 	}
 
 	for field := cr.mergedRes.Header.Fields(); field.Next(); {
@@ -337,8 +395,27 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 }
 
 func (cr *checkRunner) close() {
+	if cr.cache != nil && cr.log.Debug {
+		hits, misses := cr.cache.stats()
+		cr.log.Debugf("check results cache: %d hits for message, %d hits, %d misses for connection",
+			atomic.LoadInt64(&cr.msgCacheHits), hits, misses)
+	}
+
 	cr.dmarcVerify.Close()
+
+	cr.timedOutLock.Lock()
+	defer cr.timedOutLock.Unlock()
 	for _, state := range cr.states {
+		if done, ok := cr.timedOut[state]; ok {
+			// The check is still running, close the state once it
+			// completes.
+			state := state
+			go func() {
+				<-done
+				state.Close()
+			}()
+			continue
+		}
 		state.Close()
 	}
 }
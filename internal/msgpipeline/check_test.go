@@ -19,7 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
 	"errors"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
@@ -446,3 +449,114 @@ func TestMsgPipeline_RcptCheck_Errors(t *testing.T) {
 			check_.UnclosedStates, sourceCheck.UnclosedStates, globalCheck.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_ConnChecks(t *testing.T) {
+	target := testutils.Target{}
+	check1, check2 := testutils.Check{}, testutils.Check{}
+	srcBlock := sourceBlock{
+		checks:  []module.Check{&check1, &check2},
+		perRcpt: map[string]*rcptBlock{},
+		defaultRcpt: &rcptBlock{
+			checks:  []module.Check{&check2},
+			targets: []module.DeliveryTarget{&target},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check1},
+			perSource: map[string]sourceBlock{
+				"example.org": srcBlock,
+				"example.com": srcBlock,
+			},
+			defaultSource: srcBlock,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	conn := &module.ConnState{Data: module.NewConnData()}
+	d.RunConnOpened(context.Background(), conn)
+	if check1.ConnOpenedCalls != 1 || check2.ConnOpenedCalls != 1 {
+		t.Fatalf("ConnOpened should be called once per check, got %d, %d",
+			check1.ConnOpenedCalls, check2.ConnOpenedCalls)
+	}
+
+	d.RunConnClosed(conn)
+	if check1.ConnClosedCalls != 1 || check2.ConnClosedCalls != 1 {
+		t.Fatalf("ConnClosed should be called once per check, got %d, %d",
+			check1.ConnClosedCalls, check2.ConnClosedCalls)
+	}
+}
+
+func TestMsgPipeline_CheckCache(t *testing.T) {
+	target := testutils.Target{}
+	check1 := testutils.Check{
+		Cacheable: true,
+		ConnRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.IPRevResult{Value: authres.ResultPass, IP: "1.2.3.4"},
+			},
+		},
+	}
+	check2 := testutils.Check{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check1, &check2},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				checks:  []module.Check{&check1},
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	conn := &module.ConnState{Data: module.NewConnData()}
+	conn.Hostname = "mx.example.org"
+	d.RunConnOpened(context.Background(), conn)
+	defer d.RunConnClosed(conn)
+
+	for i, from := range []string{"a@example.org", "b@EXAMPLE.org", "a@example.com"} {
+		from := from
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			testutils.DoTestDeliveryMeta(t, &d, from, []string{"rcpt@example.com"}, &module.MsgMetadata{
+				OriginalFrom: from,
+				Conn:         conn,
+			})
+		})
+	}
+
+	if check1.ConnCalls != 2 || check1.SenderCalls != 2 {
+		t.Errorf("cacheable check should be called once per MAIL FROM domain, got %d, %d",
+			check1.ConnCalls, check1.SenderCalls)
+	}
+	if check2.ConnCalls != 3 || check2.SenderCalls != 3 {
+		t.Errorf("non-cacheable check should be called for each message, got %d, %d",
+			check2.ConnCalls, check2.SenderCalls)
+	}
+	if len(target.Messages) != 3 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 3, len(target.Messages))
+	}
+	for i, msg := range target.Messages {
+		if !strings.Contains(msg.Header.Get("Authentication-Results"), "iprev=pass") {
+			t.Errorf("cached result is not used for message %d", i)
+		}
+	}
+
+	// Changing the connection parameters invalidates the cache.
+	conn.Hostname = "mx2.example.org"
+	testutils.DoTestDeliveryMeta(t, &d, "c@example.com", []string{"rcpt@example.com"}, &module.MsgMetadata{
+		OriginalFrom: "c@example.com",
+		Conn:         conn,
+	})
+	if check1.ConnCalls != 3 {
+		t.Errorf("cache should be invalidated on HELO change")
+	}
+
+	if check1.UnclosedStates != 0 || check2.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, counters: %d, %d",
+			check1.UnclosedStates, check2.UnclosedStates)
+	}
+}
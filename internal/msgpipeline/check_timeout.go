@@ -0,0 +1,121 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"time"
+
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// limitedCheck wraps the check to enforce the deadline configured for the
+// check block using the 'timeout' directive.
+//
+// checkRunner and other code that needs to look at the actual check object
+// (e.g. for optional interfaces) should use unwrapCheck.
+type limitedCheck struct {
+	module.Check
+	timeout       time.Duration
+	timeoutAction modconfig.FailAction
+}
+
+func unwrapCheck(check module.Check) module.Check {
+	if lc, ok := check.(*limitedCheck); ok {
+		return lc.Check
+	}
+	return check
+}
+
+// timeoutResult returns the result to use for the check that did not
+// complete in time.
+//
+// If the check implements module.FailActionCheck, its action is used,
+// otherwise the action configured using the timeout_action directive.
+func (lc *limitedCheck) timeoutResult() module.CheckResult {
+	res := module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Message check timed out, try again later",
+			CheckName:    objectName(lc.Check),
+			Err:          context.DeadlineExceeded,
+			Misc: map[string]interface{}{
+				"timeout": lc.timeout.String(),
+			},
+		},
+	}
+
+	if fac, ok := lc.Check.(module.FailActionCheck); ok {
+		return fac.ApplyFailAction(res)
+	}
+	return lc.timeoutAction.Apply(res)
+}
+
+// runLimited calls runner enforcing the check timeout, if any.
+//
+// If the timeout is exceeded, the check call continues to run in the
+// background and the state is marked as timed out. Further calls for it are
+// skipped and Close is deferred until the call completes.
+func (cr *checkRunner) runLimited(ctx context.Context, s module.CheckState, runner func(context.Context, module.CheckState) module.CheckResult) module.CheckResult {
+	cr.timedOutLock.Lock()
+	_, timedOut := cr.timedOut[s]
+	cr.timedOutLock.Unlock()
+	if timedOut {
+		return module.CheckResult{}
+	}
+
+	lc := cr.limits[s]
+	if lc == nil || lc.timeout == 0 {
+		return runner(ctx, s)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lc.timeout)
+	defer cancel()
+
+	resCh := make(chan module.CheckResult, 1)
+	done := make(chan struct{})
+	go func() {
+		resCh <- runner(ctx, s)
+		close(done)
+	}()
+
+	select {
+	case res := <-resCh:
+		return res
+	case <-ctx.Done():
+		// Prefer the result if it is available.
+		select {
+		case res := <-resCh:
+			return res
+		default:
+		}
+
+		cr.timedOutLock.Lock()
+		cr.timedOut[s] = done
+		cr.timedOutLock.Unlock()
+
+		res := lc.timeoutResult()
+		cr.log.Msg("check timed out", "check", objectName(lc.Check), "timeout", lc.timeout,
+			"reject", res.Reject, "quarantine", res.Quarantine)
+		return res
+	}
+}
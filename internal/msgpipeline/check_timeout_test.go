@@ -0,0 +1,258 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// slowCheck is the check that takes the specified amount of time to check
+// the message body. It ignores the context deadline, like a misbehaving check
+// would.
+type slowCheck struct {
+	name  string
+	delay time.Duration
+
+	// If not nil, the check implements module.FailActionCheck.
+	failAction *modconfig.FailAction
+
+	lock          sync.Mutex
+	running       int
+	maxRunning    int
+	closedStates  int
+	createdStates int
+}
+
+type slowCheckState struct {
+	c *slowCheck
+}
+
+type slowCheckFailAction struct {
+	*slowCheck
+}
+
+func (c *slowCheck) Name() string {
+	return "slow_check"
+}
+
+func (c *slowCheck) InstanceName() string {
+	return c.name
+}
+
+func (c *slowCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.createdStates++
+	return &slowCheckState{c: c}, nil
+}
+
+func (c slowCheckFailAction) ApplyFailAction(res module.CheckResult) module.CheckResult {
+	return c.failAction.Apply(res)
+}
+
+func (s *slowCheckState) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *slowCheckState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *slowCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *slowCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	s.c.lock.Lock()
+	s.c.running++
+	if s.c.running > s.c.maxRunning {
+		s.c.maxRunning = s.c.running
+	}
+	s.c.lock.Unlock()
+
+	time.Sleep(s.c.delay)
+
+	s.c.lock.Lock()
+	s.c.running--
+	s.c.lock.Unlock()
+
+	return module.CheckResult{
+		AuthResult: []authres.Result{
+			&authres.DKIMResult{Value: authres.ResultPass, Domain: s.c.name},
+		},
+	}
+}
+
+func (s *slowCheckState) Close() error {
+	s.c.lock.Lock()
+	defer s.c.lock.Unlock()
+	s.c.closedStates++
+	return nil
+}
+
+func (c *slowCheck) closed() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closedStates
+}
+
+func TestMsgPipeline_CheckTimeout(t *testing.T) {
+	target := testutils.Target{}
+	check := &slowCheck{name: "slow", delay: 500 * time.Millisecond}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{
+				&limitedCheck{
+					Check:         check,
+					timeout:       50 * time.Millisecond,
+					timeoutAction: modconfig.FailAction{Reject: true},
+				},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	start := time.Now()
+	_, err := testutils.DoTestDeliveryErr(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if time.Since(start) > 400*time.Millisecond {
+		t.Error("Timeout is not enforced")
+	}
+	if code := exterrors.Fields(err)["smtp_code"]; code != 451 {
+		t.Error("Wrong status code:", code)
+	}
+	if len(target.Messages) != 0 {
+		t.Fatal("Message is delivered")
+	}
+
+	// State is closed when the check completes.
+	if check.closed() != 0 {
+		t.Error("State is closed while the check is running")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if check.closed() != 1 {
+		t.Error("State is not closed after the check completes")
+	}
+}
+
+func TestMsgPipeline_CheckTimeout_CheckAction(t *testing.T) {
+	target := testutils.Target{}
+	check := slowCheckFailAction{&slowCheck{
+		name:       "slow",
+		delay:      200 * time.Millisecond,
+		failAction: &modconfig.FailAction{Quarantine: true},
+	}}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{
+				&limitedCheck{
+					Check:         check,
+					timeout:       20 * time.Millisecond,
+					timeoutAction: modconfig.FailAction{Reject: true},
+				},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+	if len(target.Messages) != 1 {
+		t.Fatal("Message is not delivered")
+	}
+	if !target.Messages[0].MsgMeta.Quarantine {
+		t.Error("Check fail action is not used")
+	}
+}
+
+func TestMsgPipeline_CheckParallelism(t *testing.T) {
+	for _, parallelism := range []int{0, 1} {
+		parallelism := parallelism
+		t.Run("parallelism="+strconv.Itoa(parallelism), func(t *testing.T) {
+			target := testutils.Target{}
+			// Slower checks first to verify that results are merged in the
+			// configuration order.
+			checks := []*slowCheck{
+				{name: "a.example.org", delay: 60 * time.Millisecond},
+				{name: "b.example.org", delay: 30 * time.Millisecond},
+				{name: "c.example.org", delay: 0},
+			}
+			d := MsgPipeline{
+				msgpipelineCfg: msgpipelineCfg{
+					globalChecks:     []module.Check{checks[0], checks[1], checks[2]},
+					checkParallelism: parallelism,
+					perSource:        map[string]sourceBlock{},
+					defaultSource: sourceBlock{
+						perRcpt: map[string]*rcptBlock{},
+						defaultRcpt: &rcptBlock{
+							targets: []module.DeliveryTarget{&target},
+						},
+					},
+				},
+				Hostname: "TEST-HOST",
+				Log:      testutils.Logger(t, "msgpipeline"),
+			}
+
+			start := time.Now()
+			testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+			elapsed := time.Since(start)
+
+			if parallelism == 1 && elapsed < 90*time.Millisecond {
+				t.Error("Checks are executed in parallel")
+			}
+
+			if len(target.Messages) != 1 {
+				t.Fatal("Message is not delivered")
+			}
+			authRes := target.Messages[0].Header.Get("Authentication-Results")
+			a, b, c := strings.Index(authRes, "a.example.org"), strings.Index(authRes, "b.example.org"), strings.Index(authRes, "c.example.org")
+			if a == -1 || b == -1 || c == -1 || !(a < b && b < c) {
+				t.Error("Results are not merged in the configuration order:", authRes)
+			}
+		})
+	}
+}
@@ -44,6 +44,34 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+
+	// Max. amount of checks to run in parallel for each stage, 0 means no
+	// limit.
+	checkParallelism int
+
+	scoreCfg scoreCfg
+}
+
+// Directives allowed at each level of the pipeline configuration, used for
+// suggestions in errors.
+var (
+	rcptDirectives   = []string{"check", "modify", "deliver_to", "reroute", "reject"}
+	sourceDirectives = append([]string{"destination_in", "destination", "default_destination", "forward_destination"},
+		rcptDirectives...)
+	rootDirectives = append([]string{"source_in", "source", "default_source", "dmarc", "check_parallelism",
+		"quarantine_score", "reject_score", "rcpt_quarantine_score"}, sourceDirectives...)
+)
+
+// IsRootDirective reports whether the directive is a part of the pipeline
+// configuration when used at the top level of the block (e.g. in the endpoint
+// configuration block).
+func IsRootDirective(name string) bool {
+	for _, dir := range rootDirectives {
+		if dir == name {
+			return true
+		}
+	}
+	return false
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -129,10 +157,39 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
-		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
+		case "check_parallelism":
+			if len(node.Args) != 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "expected exactly one argument")
+			}
+			var err error
+			cfg.checkParallelism, err = strconv.Atoi(node.Args[0])
+			if err != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "invalid integer: %v", err)
+			}
+			if cfg.checkParallelism < 0 {
+				return msgpipelineCfg{}, config.NodeErr(node, "check_parallelism can't be negative")
+			}
+		case "quarantine_score", "reject_score":
+			if len(node.Args) != 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "expected exactly one argument")
+			}
+			val, err := strconv.Atoi(node.Args[0])
+			if err != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "invalid integer: %v", err)
+			}
+			if node.Name == "quarantine_score" {
+				cfg.scoreCfg.quarantine = val
+			} else {
+				cfg.scoreCfg.reject = val
+			}
+		case "rcpt_quarantine_score":
+			if err := modconfig.ModuleFromNode("table", node.Args, node, globals, &cfg.scoreCfg.rcptQuarantine); err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "forward_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
-			return msgpipelineCfg{}, config.NodeErr(node, "unknown pipeline directive: %s", node.Name)
+			return msgpipelineCfg{}, config.UnknownDirectiveErr(node, rootDirectives)
 		}
 	}
 
@@ -227,10 +284,19 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 				return sourceBlock{}, config.NodeErr(node, "duplicate 'default_destination' block")
 			}
 			defaultRcptRaw = node.Children
+		case "forward_destination":
+			if src.forwardRcpt != nil {
+				return sourceBlock{}, config.NodeErr(node, "duplicate 'forward_destination' block")
+			}
+			rcptBlock, err := parseMsgPipelineRcptCfg(globals, node.Children)
+			if err != nil {
+				return sourceBlock{}, err
+			}
+			src.forwardRcpt = rcptBlock
 		case "deliver_to", "reroute", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
-			return sourceBlock{}, config.NodeErr(node, "unknown pipeline directive: %s", node.Name)
+			return sourceBlock{}, config.UnknownDirectiveErr(node, sourceDirectives)
 		}
 	}
 
@@ -309,7 +375,7 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 				return nil, err
 			}
 		default:
-			return nil, config.NodeErr(node, "invalid directive")
+			return nil, config.UnknownDirectiveErr(node, rcptDirectives)
 		}
 	}
 	return &rcpt, nil
@@ -22,9 +22,11 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	_ "github.com/foxcpp/maddy/internal/table"
 )
 
 func policyError(code int) error {
@@ -334,6 +336,69 @@ func TestMsgPipelineCfg_GlobalChecksMultiple(t *testing.T) {
 	}
 }
 
+func TestMsgPipelineCfg_CheckTimeout(t *testing.T) {
+	str := `
+		check_parallelism 2
+		check {
+			timeout 5s
+			timeout_action quarantine
+			test_check
+		}
+		default_destination {
+			reject 500
+		}
+	`
+
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+	parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+
+	if parsed.checkParallelism != 2 {
+		t.Errorf("wrong check_parallelism: %d", parsed.checkParallelism)
+	}
+	if len(parsed.globalChecks) != 1 {
+		t.Fatalf("wrong amount of test_check's in globalChecks: %d", len(parsed.globalChecks))
+	}
+	limited, ok := parsed.globalChecks[0].(*limitedCheck)
+	if !ok {
+		t.Fatalf("check is not wrapped: %T", parsed.globalChecks[0])
+	}
+	if limited.timeout != 5*time.Second {
+		t.Errorf("wrong timeout: %v", limited.timeout)
+	}
+	if !limited.timeoutAction.Quarantine {
+		t.Errorf("wrong timeout_action: %+v", limited.timeoutAction)
+	}
+}
+
+func TestMsgPipelineCfg_Score(t *testing.T) {
+	str := `
+		quarantine_score 5
+		reject_score 10
+		rcpt_quarantine_score static {
+			entry postmaster@example.org 100
+		}
+		default_destination {
+			reject 500
+		}
+	`
+
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+	parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+
+	if parsed.scoreCfg.quarantine != 5 || parsed.scoreCfg.reject != 10 {
+		t.Errorf("wrong thresholds: %+v", parsed.scoreCfg)
+	}
+	if parsed.scoreCfg.rcptQuarantine == nil {
+		t.Fatalf("missing rcpt_quarantine_score table")
+	}
+}
+
 func TestMsgPipelineCfg_SourceChecks(t *testing.T) {
 	str := `
 		source example.org {
@@ -439,3 +504,42 @@ func TestMsgPipelineCfg_RcptChecks_Multiple(t *testing.T) {
 		t.Fatalf("wrong amount of test_check's in rcpt checks: %d", len(parsed.defaultSource.perRcpt["example.org"].checks))
 	}
 }
+
+func TestMsgPipelineCfg_UnknownDirective(t *testing.T) {
+	test := func(str, expectedErr string) {
+		t.Helper()
+
+		cfg, _ := parser.Read(strings.NewReader(str), "literal")
+		_, err := parseMsgPipelineRootCfg(nil, cfg[0].Children)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if err.Error() != expectedErr {
+			t.Errorf("wrong error message\nwant: %s\ngot:  %s", expectedErr, err.Error())
+		}
+	}
+
+	test(`smtp tcp://0.0.0.0:25 {
+	destination example.org {
+		delivr_to dummy
+	}
+	default_destination {
+		reject
+	}
+}`, `literal:3: smtp tcp://0.0.0.0:25 > destination example.org: unknown directive: delivr_to, did you mean deliver_to?`)
+	test(`smtp tcp://0.0.0.0:25 {
+	source example.org {
+		destinaton example.org {
+			reject
+		}
+	}
+	default_source {
+		reject
+	}
+}`, `literal:3: smtp tcp://0.0.0.0:25 > source example.org: unknown directive: destinaton, did you mean destination?`)
+	test(`smtp tcp://0.0.0.0:25 {
+	defualt_source {
+		reject
+	}
+}`, `literal:2: smtp tcp://0.0.0.0:25: unknown directive: defualt_source, did you mean default_source?`)
+}
@@ -19,9 +19,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -234,9 +237,9 @@ func TestMsgPipeline_RcptModifier(t *testing.T) {
 	target := testutils.Target{}
 	mod := testutils.Modifier{
 		InstName: "test_modifier",
-		RcptTo: map[string]string{
-			"rcpt1@example.com": "rcpt1-alias@example.com",
-			"rcpt2@example.com": "rcpt2-alias@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-alias@example.com"},
+			"rcpt2@example.com": {"rcpt2-alias@example.com"},
 		},
 	}
 	d := MsgPipeline{
@@ -272,9 +275,9 @@ func TestMsgPipeline_RcptModifier_OriginalRcpt(t *testing.T) {
 	target := testutils.Target{}
 	mod := testutils.Modifier{
 		InstName: "test_modifier",
-		RcptTo: map[string]string{
-			"rcpt1@example.com": "rcpt1-alias@example.com",
-			"rcpt2@example.com": "rcpt2-alias@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-alias@example.com"},
+			"rcpt2@example.com": {"rcpt2-alias@example.com"},
 		},
 	}
 	d := MsgPipeline{
@@ -318,15 +321,15 @@ func TestMsgPipeline_RcptModifier_OriginalRcpt_Multiple(t *testing.T) {
 	target := testutils.Target{}
 	mod1, mod2 := testutils.Modifier{
 		InstName: "first_modifier",
-		RcptTo: map[string]string{
-			"rcpt1@example.com": "rcpt1-alias@example.com",
-			"rcpt2@example.com": "rcpt2-alias@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-alias@example.com"},
+			"rcpt2@example.com": {"rcpt2-alias@example.com"},
 		},
 	}, testutils.Modifier{
 		InstName: "second_modifier",
-		RcptTo: map[string]string{
-			"rcpt1-alias@example.com": "rcpt1-alias2@example.com",
-			"rcpt2@example.com":       "wtf@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1-alias@example.com": {"rcpt1-alias2@example.com"},
+			"rcpt2@example.com":       {"wtf@example.com"},
 		},
 	}
 	d := MsgPipeline{
@@ -369,19 +372,242 @@ func TestMsgPipeline_RcptModifier_OriginalRcpt_Multiple(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_RcptModifier_FanOut(t *testing.T) {
+	target := testutils.Target{}
+	mod1, mod2 := testutils.Modifier{
+		InstName: "first_modifier",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-a@example.com", "rcpt1-b@example.com"},
+		},
+	}, testutils.Modifier{
+		InstName: "second_modifier",
+		RcptTo: map[string][]string{
+			"rcpt1-b@example.com": {"rcpt1-c@example.com"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod1},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{
+					Modifiers: []module.Modifier{mod2},
+				},
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"rcpt1-a@example.com", "rcpt1-c@example.com", "rcpt2@example.com"})
+	for _, rcpt := range []string{"rcpt1-a@example.com", "rcpt1-c@example.com"} {
+		original := target.Messages[0].MsgMeta.OriginalRcpts[rcpt]
+		if original != "rcpt1@example.com" {
+			t.Errorf("wrong OriginalRcpts value for %s, want %s, got %s", rcpt, "rcpt1@example.com", original)
+		}
+	}
+
+	if mod1.UnclosedStates != 0 || mod2.UnclosedStates != 0 {
+		t.Fatalf("modifier state objects leak or double-closed, counter: %d, %d", mod1.UnclosedStates, mod2.UnclosedStates)
+	}
+}
+
+// deliverRcpts delivers the test message to the recipients accepted by the
+// pipeline and returns AddRcpt errors for the rejected ones.
+func deliverRcpts(t *testing.T, d *MsgPipeline, rcpts ...string) map[string]error {
+	t.Helper()
+
+	delivery, err := d.Start(context.Background(), &module.MsgMetadata{ID: "testing"}, "sender@example.com")
+	if err != nil {
+		t.Fatalf("unexpected Start err: %v", err)
+	}
+	errs := map[string]error{}
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(context.Background(), rcpt); err != nil {
+			errs[rcpt] = err
+		}
+	}
+	if err := delivery.Body(context.Background(), textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatalf("unexpected Body err: %v", err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected Commit err: %v", err)
+	}
+	return errs
+}
+
+func TestMsgPipeline_RcptModifier_FanOut_Reject(t *testing.T) {
+	target := testutils.Target{}
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-a@example.com", "rcpt1-b@example.com"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"rcpt1-b@example.com": {
+						rejectErr: errors.New("go away"),
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	errs := deliverRcpts(t, &d, "rcpt2@example.com", "rcpt1@example.com")
+	if errs["rcpt1@example.com"] == nil {
+		t.Fatal("expected error for rcpt1@example.com")
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	// rcpt1-a is routed to the target, but the expansion of rcpt1 as a whole
+	// is rejected.
+	testutils.CheckMsgID(t, &target.Messages[0], "sender@example.com", []string{"rcpt2@example.com"}, "testing")
+}
+
+func TestMsgPipeline_RcptModifier_FanOut_TargetReject(t *testing.T) {
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-a@example.com", "rcpt1-b@example.com"},
+		},
+	}
+
+	for _, rcpts := range [][]string{
+		// Delivery object is shared with the previous recipient.
+		{"rcpt2@example.com", "rcpt1@example.com", "rcpt3@example.com"},
+		// Delivery object is created for the rejected recipient.
+		{"rcpt1@example.com", "rcpt2@example.com", "rcpt3@example.com"},
+	} {
+		target := testutils.Target{
+			RcptErr: map[string]error{
+				"rcpt1-b@example.com": errors.New("go away"),
+			},
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalModifiers: modify.Group{
+					Modifiers: []module.Modifier{mod},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+
+		errs := deliverRcpts(t, &d, rcpts...)
+		if errs["rcpt1@example.com"] == nil {
+			t.Fatal("expected error for rcpt1@example.com")
+		}
+		if len(errs) != 1 {
+			t.Fatal("unexpected errors:", errs)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+		}
+		testutils.CheckMsgID(t, &target.Messages[0], "sender@example.com", []string{"rcpt2@example.com", "rcpt3@example.com"}, "testing")
+		if _, ok := target.Messages[0].MsgMeta.OriginalRcpts["rcpt1-a@example.com"]; ok {
+			t.Error("OriginalRcpts contains rejected recipient")
+		}
+	}
+}
+
+func TestMsgPipeline_RcptModifier_Duplicates(t *testing.T) {
+	target := testutils.Target{}
+	globalMod, sourceMod, rcptMod := testutils.Modifier{
+		InstName: "global_modifier",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"a@example.com", "b@example.com"},
+			"rcpt2@example.com": {"c@example.com"},
+		},
+	}, testutils.Modifier{
+		InstName: "source_modifier",
+		RcptTo: map[string][]string{
+			"b@example.com": {"a@example.com"},
+		},
+	}, testutils.Modifier{
+		InstName: "rcpt_modifier",
+		RcptTo: map[string][]string{
+			"c@example.com": {"a@example.com", "d@example.com"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{globalMod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{
+					Modifiers: []module.Modifier{sourceMod},
+				},
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					modifiers: modify.Group{
+						Modifiers: []module.Modifier{rcptMod},
+					},
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com", "a@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"a@example.com", "d@example.com"})
+	original := target.Messages[0].MsgMeta.OriginalRcpts
+	if original["a@example.com"] != "rcpt1@example.com" {
+		t.Errorf("wrong OriginalRcpts value for a@example.com: %s", original["a@example.com"])
+	}
+	if original["d@example.com"] != "rcpt2@example.com" {
+		t.Errorf("wrong OriginalRcpts value for d@example.com: %s", original["d@example.com"])
+	}
+}
+
 func TestMsgPipeline_RcptModifier_Multiple(t *testing.T) {
 	target := testutils.Target{}
 	mod1, mod2 := testutils.Modifier{
 		InstName: "first_modifier",
-		RcptTo: map[string]string{
-			"rcpt1@example.com": "rcpt1-alias@example.com",
-			"rcpt2@example.com": "rcpt2-alias@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-alias@example.com"},
+			"rcpt2@example.com": {"rcpt2-alias@example.com"},
 		},
 	}, testutils.Modifier{
 		InstName: "second_modifier",
-		RcptTo: map[string]string{
-			"rcpt1-alias@example.com": "rcpt1-alias2@example.com",
-			"rcpt2@example.com":       "wtf@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1-alias@example.com": {"rcpt1-alias2@example.com"},
+			"rcpt2@example.com":       {"wtf@example.com"},
 		},
 	}
 	d := MsgPipeline{
@@ -417,15 +643,15 @@ func TestMsgPipeline_RcptModifier_PreDispatch(t *testing.T) {
 	target := testutils.Target{}
 	mod1, mod2 := testutils.Modifier{
 		InstName: "first_modifier",
-		RcptTo: map[string]string{
-			"rcpt1@example.com": "rcpt1-alias@example.com",
-			"rcpt2@example.com": "rcpt2-alias@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1-alias@example.com"},
+			"rcpt2@example.com": {"rcpt2-alias@example.com"},
 		},
 	}, testutils.Modifier{
 		InstName: "second_modifier",
-		RcptTo: map[string]string{
-			"rcpt1-alias@example.com": "rcpt1-alias2@example.com",
-			"rcpt2@example.com":       "wtf@example.com",
+		RcptTo: map[string][]string{
+			"rcpt1-alias@example.com": {"rcpt1-alias2@example.com"},
+			"rcpt2@example.com":       {"wtf@example.com"},
 		},
 	}
 	d := MsgPipeline{
@@ -469,9 +695,9 @@ func TestMsgPipeline_RcptModifier_PostDispatch(t *testing.T) {
 	target := testutils.Target{}
 	mod := testutils.Modifier{
 		InstName: "test_modifier",
-		RcptTo: map[string]string{
-			"rcpt1@example.com": "rcpt1@example.org",
-			"rcpt2@example.com": "rcpt2@example.org",
+		RcptTo: map[string][]string{
+			"rcpt1@example.com": {"rcpt1@example.org"},
+			"rcpt2@example.com": {"rcpt2@example.org"},
 		},
 	}
 	d := MsgPipeline{
@@ -707,3 +933,290 @@ func TestMsgPipeline_RcptModifier_Errors(t *testing.T) {
 			mod.UnclosedStates, globalMod.UnclosedStates, sourceMod.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_SealingModifier(t *testing.T) {
+	target := testutils.Target{}
+	sealHdr := textproto.Header{}
+	sealHdr.Add("X-Sealed", "1")
+	globalMod := testutils.Modifier{
+		InstName: "global_modifier",
+		SealHdr:  sealHdr,
+	}
+	rcptHdr := textproto.Header{}
+	rcptHdr.Add("X-Rcpt", "1")
+	rcptMod := testutils.Modifier{
+		InstName: "rcpt_modifier",
+		AddHdr:   rcptHdr,
+	}
+
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource:       map[string]sourceBlock{},
+			globalModifiers: modify.Group{Modifiers: []module.Modifier{&globalMod}},
+			defaultSource: sourceBlock{
+				defaultRcpt: &rcptBlock{
+					modifiers: modify.Group{Modifiers: []module.Modifier{&rcptMod}},
+					targets:   []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	// Sealing modifier should run after all other modifiers, even
+	// per-destination ones, so its field should be the topmost one.
+	fields := target.Messages[0].Header.Fields()
+	if !fields.Next() || fields.Key() != "X-Sealed" {
+		t.Fatalf("sealing modifier field is not the topmost one: %v", fields.Key())
+	}
+	if !fields.Next() || fields.Key() != "X-Rcpt" {
+		t.Fatalf("per-destination modifier field is missing or misplaced: %v", fields.Key())
+	}
+}
+
+func TestMsgPipeline_RcptModifier_Order(t *testing.T) {
+	comTarget, orgTarget := testutils.Target{InstName: "com_target"}, testutils.Target{InstName: "org_target"}
+	comHdr, orgHdr := textproto.Header{}, textproto.Header{}
+	comHdr.Add("X-Order", "com")
+	orgHdr.Add("X-Order", "org")
+
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.com": {
+						modifiers: modify.Group{Modifiers: []module.Modifier{
+							&testutils.Modifier{InstName: "com_modifier", AddHdr: comHdr},
+						}},
+						targets: []module.DeliveryTarget{&comTarget},
+					},
+					"example.org": {
+						modifiers: modify.Group{Modifiers: []module.Modifier{
+							&testutils.Modifier{InstName: "org_modifier", AddHdr: orgHdr},
+						}},
+						targets: []module.DeliveryTarget{&orgTarget},
+					},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	// Repeat to make sure the order does not depend on the map iteration
+	// order.
+	for i := 0; i < 20; i++ {
+		comTarget.Messages, orgTarget.Messages = nil, nil
+		testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt@example.org", "rcpt@example.com"})
+
+		if len(comTarget.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(comTarget.Messages))
+		}
+		// Modifiers for the block matched first run first, so the field
+		// added last is the topmost one.
+		var order []string
+		for fields := comTarget.Messages[0].Header.FieldsByKey("X-Order"); fields.Next(); {
+			order = append(order, fields.Value())
+		}
+		if len(order) != 2 || order[0] != "com" || order[1] != "org" {
+			t.Fatalf("wrong modifiers order: %v", order)
+		}
+	}
+}
+
+func TestMsgPipeline_BodyReplacingModifier(t *testing.T) {
+	target := testutils.Target{}
+	globalMod := testutils.Modifier{
+		InstName: "global_modifier",
+		NewBody:  []byte("replaced body\r\n"),
+	}
+	hdr := textproto.Header{}
+	hdr.Add("X-Signed", "1")
+	sourceMod := testutils.Modifier{
+		InstName: "source_modifier",
+		AddHdr:   hdr,
+	}
+
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource:       map[string]sourceBlock{},
+			globalModifiers: modify.Group{Modifiers: []module.Modifier{&globalMod}},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{Modifiers: []module.Modifier{&sourceMod}},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if string(target.Messages[0].Body) != "replaced body\r\n" {
+		t.Fatalf("body is not replaced: %q", target.Messages[0].Body)
+	}
+	if target.Messages[0].Header.Get("X-Signed") != "1" {
+		t.Fatal("RewriteBody is not called for other modifiers")
+	}
+}
+
+func TestMsgPipeline_BodyReplacingModifier_PerRcpt(t *testing.T) {
+	target := testutils.Target{}
+	rcptMod := testutils.Modifier{
+		InstName: "rcpt_modifier",
+		NewBody:  []byte("replaced body\r\n"),
+	}
+
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				defaultRcpt: &rcptBlock{
+					modifiers: modify.Group{Modifiers: []module.Modifier{&rcptMod}},
+					targets:   []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(target.Messages) != 0 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 0, len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_RcptModifier_ForwardDestination(t *testing.T) {
+	local, forward := testutils.Target{InstName: "local"}, testutils.Target{InstName: "forward"}
+	mod := testutils.Modifier{
+		InstName: "unwrap_modifier",
+		RcptTo: map[string][]string{
+			"srs@example.com": {"origin@example.org"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{
+					Modifiers: []module.Modifier{mod},
+				},
+				perRcpt: map[string]*rcptBlock{
+					"example.com": {
+						targets: []module.DeliveryTarget{&local},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					rejectErr: errors.New("default destination used"),
+				},
+				forwardRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&forward},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	// Normally, ForwardRcpts is populated by the modifier itself.
+	testutils.DoTestDeliveryMeta(t, &d, "", []string{"srs@example.com", "rcpt@example.com"}, &module.MsgMetadata{
+		ForwardRcpts: map[string]struct{}{"origin@example.org": {}},
+	})
+
+	if len(local.Messages) != 1 || len(forward.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want 1 and 1, got %d and %d", len(local.Messages), len(forward.Messages))
+	}
+	testutils.CheckTestMessage(t, &local, 0, "", []string{"rcpt@example.com"})
+	testutils.CheckTestMessage(t, &forward, 0, "", []string{"origin@example.org"})
+}
+
+// rcptHeaderModifier adds the X-Rcpt field with the recipient address.
+type rcptHeaderModifier struct {
+	errs map[string]error
+}
+
+func (m rcptHeaderModifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return m, nil
+}
+
+func (m rcptHeaderModifier) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (m rcptHeaderModifier) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (m rcptHeaderModifier) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (m rcptHeaderModifier) RcptHeader(ctx context.Context, rcptTo string, h *textproto.Header) error {
+	if err := m.errs[rcptTo]; err != nil {
+		return err
+	}
+	h.Add("X-Rcpt", rcptTo)
+	return nil
+}
+
+func (m rcptHeaderModifier) Close() error {
+	return nil
+}
+
+func TestMsgPipeline_RcptHeader(t *testing.T) {
+	target, other := testutils.Target{}, testutils.Target{InstName: "other"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{&other},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					modifiers: modify.Group{
+						Modifiers: []module.Modifier{rcptHeaderModifier{}},
+					},
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com",
+		[]string{"rcpt1@example.com", "rcpt2@example.com", "rcpt3@example.org", "rcpt4@example.org"})
+
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+	for _, msg := range target.Messages {
+		if len(msg.RcptTo) != 1 {
+			t.Fatalf("wrong recipients: %v", msg.RcptTo)
+		}
+		if got := msg.Header.Get("X-Rcpt"); got != msg.RcptTo[0] {
+			t.Errorf("wrong X-Rcpt value for %s: %s", msg.RcptTo[0], got)
+		}
+	}
+
+	// Deliveries for other blocks are not affected.
+	if len(other.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(other.Messages))
+	}
+	testutils.CheckTestMessage(t, &other, 0, "sender@example.com", []string{"rcpt3@example.org", "rcpt4@example.org"})
+	if other.Messages[0].Header.Has("X-Rcpt") {
+		t.Error("X-Rcpt is added for other block")
+	}
+}
@@ -19,6 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
+	"sync/atomic"
+
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
@@ -27,7 +30,9 @@ import (
 type Module struct {
 	instName string
 	log      log.Logger
-	*MsgPipeline
+
+	// *MsgPipeline, replaced on reload.
+	pipeline atomic.Value
 }
 
 func NewModule(modName, instName string, aliases, inlineArgs []string) (module.Module, error) {
@@ -38,23 +43,50 @@ func NewModule(modName, instName string, aliases, inlineArgs []string) (module.M
 }
 
 func (m *Module) Init(cfg *config.Map) error {
+	p, err := m.readConfig(cfg)
+	if err != nil {
+		return err
+	}
+	m.pipeline.Store(p)
+	return nil
+}
+
+// Reload implements module.ReloadModule.
+//
+// Deliveries started before the reload are completed using the old
+// configuration.
+func (m *Module) Reload(cfg *config.Map) (func(), error) {
+	p, err := m.readConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		m.pipeline.Store(p)
+	}, nil
+}
+
+func (m *Module) readConfig(cfg *config.Map) (*MsgPipeline, error) {
 	var hostname string
+	logger := log.Logger{Name: m.log.Name}
 	cfg.String("hostname", true, true, "", &hostname)
-	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Bool("debug", true, false, &logger.Debug)
 	cfg.AllowUnknown()
 	other, err := cfg.Process()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	p, err := New(cfg.Globals, other)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	m.MsgPipeline = p
-	m.MsgPipeline.Log = m.log
+	p.Log = logger
 
-	return nil
+	return p, nil
+}
+
+func (m *Module) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return m.pipeline.Load().(*MsgPipeline).Start(ctx, msgMeta, mailFrom)
 }
 
 func (m *Module) Name() string {
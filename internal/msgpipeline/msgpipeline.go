@@ -20,12 +20,15 @@ package msgpipeline
 
 import (
 	"context"
+	"errors"
+	"sync"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -76,6 +79,7 @@ type sourceBlock struct {
 	rcptIn      []rcptIn
 	perRcpt     map[string]*rcptBlock
 	defaultRcpt *rcptBlock
+	forwardRcpt *rcptBlock
 }
 
 type rcptBlock struct {
@@ -86,11 +90,20 @@ type rcptBlock struct {
 }
 
 func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error) {
+	// Inline modules created for the partially parsed configuration are
+	// not used by anything.
+	scope := modconfig.BeginScope()
 	parsedCfg, err := parseMsgPipelineRootCfg(globals, cfg)
+	if err != nil {
+		scope.Discard()
+		return nil, err
+	}
+	scope.Keep()
+
 	return &MsgPipeline{
 		msgpipelineCfg: parsedCfg,
 		Resolver:       dns.DefaultResolver(),
-	}, err
+	}, nil
 }
 
 func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *smtp.ConnectionState) error {
@@ -99,7 +112,7 @@ func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *smtp.Connection
 	// TODO: See if there is some point in parallelization of this
 	// function.
 	for _, check := range d.globalChecks {
-		earlyCheck, ok := check.(module.EarlyCheck)
+		earlyCheck, ok := unwrapCheck(check).(module.EarlyCheck)
 		if !ok {
 			continue
 		}
@@ -111,6 +124,80 @@ func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *smtp.Connection
 	return eg.Wait()
 }
 
+// connChecks returns all checks used in the pipeline that implement
+// module.OptionalConnCheck. Each check instance is returned only once.
+func (d *MsgPipeline) connChecks() []module.OptionalConnCheck {
+	var (
+		res  []module.OptionalConnCheck
+		seen = make(map[module.Check]struct{})
+	)
+	add := func(checks []module.Check) {
+		for _, check := range checks {
+			check := unwrapCheck(check)
+			if _, ok := seen[check]; ok {
+				continue
+			}
+			seen[check] = struct{}{}
+
+			if connCheck, ok := check.(module.OptionalConnCheck); ok {
+				res = append(res, connCheck)
+			}
+		}
+	}
+	addRcpt := func(block *rcptBlock) {
+		if block != nil {
+			add(block.checks)
+		}
+	}
+	addSource := func(block sourceBlock) {
+		add(block.checks)
+		for _, rcptIn := range block.rcptIn {
+			addRcpt(rcptIn.block)
+		}
+		for _, rcptBlock := range block.perRcpt {
+			addRcpt(rcptBlock)
+		}
+		addRcpt(block.defaultRcpt)
+		addRcpt(block.forwardRcpt)
+	}
+
+	add(d.globalChecks)
+	for _, srcIn := range d.sourceIn {
+		addSource(srcIn.block)
+	}
+	for _, srcBlock := range d.perSource {
+		addSource(srcBlock)
+	}
+	addSource(d.defaultSource)
+
+	return res
+}
+
+// RunConnOpened calls ConnOpened for all checks implementing
+// module.OptionalConnCheck. It should be called by the message source once
+// the connection is accepted, before the first message is started.
+func (d *MsgPipeline) RunConnOpened(ctx context.Context, conn *module.ConnState) {
+	var wg sync.WaitGroup
+	for _, check := range d.connChecks() {
+		check := check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			check.ConnOpened(ctx, conn)
+		}()
+	}
+	wg.Wait()
+}
+
+// RunConnClosed calls ConnClosed for all checks implementing
+// module.OptionalConnCheck. It should be called by the message source after
+// all messages received over the connection are processed or aborted.
+func (d *MsgPipeline) RunConnClosed(conn *module.ConnState) {
+	for _, check := range d.connChecks() {
+		check.ConnClosed(conn)
+	}
+}
+
 // Start starts new message delivery, runs connection and sender checks, sender modifiers
 // and selects source block from config to use for handling.
 //
@@ -121,11 +208,14 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	dd := msgpipelineDelivery{
 		d:                  d,
 		rcptModifiersState: make(map[*rcptBlock]module.ModifierState),
-		deliveries:         make(map[module.DeliveryTarget]*delivery),
+		deliveries:         make(map[deliveryKey]*delivery),
+		rcptOriginals:      make(map[string][]string),
 		msgMeta:            msgMeta,
 		log:                target.DeliveryLogger(d.Log, msgMeta),
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
+	dd.checkRunner.parallelism = d.checkParallelism
+	dd.checkRunner.scoreCfg = d.scoreCfg
 	dd.checkRunner.doDMARC = d.doDMARC
 
 	if msgMeta.OriginalRcpts == nil {
@@ -256,8 +346,58 @@ func (dd *msgpipelineDelivery) srcBlockForAddr(mailFrom string) (sourceBlock, er
 
 type delivery struct {
 	module.Delivery
-	// Recipient addresses this delivery object is used for, original values (not modified by RewriteRcpt).
+	// Recipient addresses this delivery object is used for, as passed to
+	// AddRcpt.
 	recipients []string
+
+	// Set for deliveries started for a single recipient because some
+	// modifier adds per-recipient header fields.
+	rcptTo      string
+	rcptHeaders []module.RcptHeaderModifierState
+}
+
+// header returns the header to pass to the delivery, with the per-recipient
+// fields added if necessary.
+func (d *delivery) header(ctx context.Context, header textproto.Header) (textproto.Header, error) {
+	if len(d.rcptHeaders) == 0 {
+		return header, nil
+	}
+	header = header.Copy()
+	for _, state := range d.rcptHeaders {
+		if err := state.RcptHeader(ctx, d.rcptTo, &header); err != nil {
+			return textproto.Header{}, err
+		}
+	}
+	return header, nil
+}
+
+// failedDelivery replaces the delivery object that can't be used anymore,
+// e.g. because it failed to be restored by undoRcpts.
+type failedDelivery struct {
+	err error
+}
+
+func (fd failedDelivery) AddRcpt(context.Context, string) error {
+	return fd.err
+}
+
+func (fd failedDelivery) Body(context.Context, textproto.Header, buffer.Buffer) error {
+	return fd.err
+}
+
+func (fd failedDelivery) Abort(context.Context) error {
+	return nil
+}
+
+func (fd failedDelivery) Commit(context.Context) error {
+	return fd.err
+}
+
+// deliveryKey identifies the delivery object. rcpt is empty for deliveries
+// shared by multiple recipients.
+type deliveryKey struct {
+	tgt  module.DeliveryTarget
+	rcpt string
 }
 
 type msgpipelineDelivery struct {
@@ -266,15 +406,25 @@ type msgpipelineDelivery struct {
 	globalModifiersState module.ModifierState
 	sourceModifiersState module.ModifierState
 	rcptModifiersState   map[*rcptBlock]module.ModifierState
+	// Blocks from rcptModifiersState in the order they were first matched by
+	// recipients. Per-destination modifiers are executed in this order so it
+	// does not depend on the map iteration order.
+	rcptBlocks []*rcptBlock
 
 	log log.Logger
 
 	sourceAddr  string
 	sourceBlock sourceBlock
 
-	deliveries  map[module.DeliveryTarget]*delivery
+	deliveries  map[deliveryKey]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+
+	// Recipient addresses after rewriting, as passed to delivery targets.
+	finalRcpts []string
+	// Recipient address after rewriting -> original recipient addresses it
+	// was produced from.
+	rcptOriginals map[string][]string
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
@@ -287,19 +437,46 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 
 	originalTo := to
 
-	newTo, err := dd.globalModifiersState.RewriteRcpt(ctx, to)
+	globalTo, err := dd.globalModifiersState.RewriteRcpt(ctx, to)
 	if err != nil {
 		return err
 	}
-	dd.log.Debugln("global rcpt modifiers:", to, "=>", newTo)
-	to = newTo
-	newTo, err = dd.sourceModifiersState.RewriteRcpt(ctx, to)
-	if err != nil {
-		return err
+	dd.log.Debugln("global rcpt modifiers:", to, "=>", globalTo)
+
+	// Modifiers can replace the recipient with multiple addresses (e.g. alias
+	// expansion), each one is routed separately. All of them are resolved
+	// and checked before passing anything to the targets so a rejected
+	// expansion does not leave the other ones accepted.
+	var routes []rcptRoute
+	for _, to := range globalTo {
+		sourceTo, err := dd.sourceModifiersState.RewriteRcpt(ctx, to)
+		if err != nil {
+			return err
+		}
+		dd.log.Debugln("per-source rcpt modifiers:", to, "=>", sourceTo)
+
+		for _, to := range sourceTo {
+			blockRoutes, err := dd.routeRcpt(ctx, to)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, blockRoutes...)
+		}
 	}
-	dd.log.Debugln("per-source rcpt modifiers:", to, "=>", newTo)
-	to = newTo
 
+	return dd.deliverRcpts(ctx, originalTo, routes)
+}
+
+// rcptRoute is the recipient address after all rewriting and the
+// destination block it should be delivered to.
+type rcptRoute struct {
+	block *rcptBlock
+	to    string
+}
+
+// routeRcpt selects the destination block for the recipient rewritten by the
+// global and per-source modifiers, runs its checks and modifiers.
+func (dd *msgpipelineDelivery) routeRcpt(ctx context.Context, to string) ([]rcptRoute, error) {
 	wrapErr := func(err error) error {
 		return exterrors.WithFields(err, map[string]interface{}{
 			"effective_rcpt": to,
@@ -308,38 +485,100 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 
 	rcptBlock, err := dd.rcptBlockForAddr(to)
 	if err != nil {
-		return wrapErr(err)
+		return nil, wrapErr(err)
 	}
 
 	if rcptBlock.rejectErr != nil {
-		return wrapErr(rcptBlock.rejectErr)
+		return nil, wrapErr(rcptBlock.rejectErr)
 	}
 
 	if err := dd.checkRunner.checkRcpt(ctx, rcptBlock.checks, to); err != nil {
-		return wrapErr(err)
+		return nil, wrapErr(err)
 	}
 
 	rcptModifiersState, err := dd.getRcptModifiers(ctx, rcptBlock, to)
 	if err != nil {
-		return wrapErr(err)
+		return nil, wrapErr(err)
 	}
 
-	newTo, err = rcptModifiersState.RewriteRcpt(ctx, to)
+	newTo, err := rcptModifiersState.RewriteRcpt(ctx, to)
 	if err != nil {
 		rcptModifiersState.Close()
-		return wrapErr(err)
+		return nil, wrapErr(err)
 	}
 	dd.log.Debugln("per-rcpt modifiers:", to, "=>", newTo)
-	to = newTo
 
-	wrapErr = func(err error) error {
+	routes := make([]rcptRoute, 0, len(newTo))
+	for _, to := range newTo {
+		routes = append(routes, rcptRoute{block: rcptBlock, to: to})
+	}
+	return routes, nil
+}
+
+// deliverRcpts passes the resolved recipient addresses to the targets.
+//
+// Addresses that were already passed to the targets for this message (e.g.
+// when aliases of two recipients overlap) are skipped. If any target rejects
+// the address, all changes made for originalTo are reverted.
+func (dd *msgpipelineDelivery) deliverRcpts(ctx context.Context, originalTo string, routes []rcptRoute) error {
+	var (
+		// Amount of recipients each touched delivery had before this call.
+		prevRcpts = map[deliveryKey]int{}
+		added     []string
+		dups      []string
+	)
+	for _, route := range routes {
+		if _, ok := dd.rcptOriginals[route.to]; ok {
+			dd.log.Debugln("duplicate rcpt:", originalTo, "=>", route.to)
+			dups = append(dups, route.to)
+			continue
+		}
+
+		if err := dd.deliverRcpt(ctx, route.block, route.to, prevRcpts); err != nil {
+			dd.undoRcpts(ctx, prevRcpts)
+			for _, to := range added {
+				delete(dd.rcptOriginals, to)
+				delete(dd.msgMeta.OriginalRcpts, to)
+			}
+			dd.finalRcpts = dd.finalRcpts[:len(dd.finalRcpts)-len(added)]
+			return err
+		}
+
+		dd.rcptOriginals[route.to] = []string{originalTo}
+		if originalTo != route.to {
+			dd.msgMeta.OriginalRcpts[route.to] = originalTo
+		}
+		dd.finalRcpts = append(dd.finalRcpts, route.to)
+		added = append(added, route.to)
+	}
+
+	// Statuses for the address are reported for all recipients it was
+	// produced from.
+dupsLoop:
+	for _, to := range dups {
+		originals := dd.rcptOriginals[to]
+		for _, original := range originals {
+			if original == originalTo {
+				continue dupsLoop
+			}
+		}
+		dd.rcptOriginals[to] = append(originals, originalTo)
+	}
+
+	return nil
+}
+
+func (dd *msgpipelineDelivery) deliverRcpt(ctx context.Context, rcptBlock *rcptBlock, to string, prevRcpts map[deliveryKey]int) error {
+	wrapErr := func(err error) error {
 		return exterrors.WithFields(err, map[string]interface{}{
 			"effective_rcpt": to,
 		})
 	}
 
-	if originalTo != to {
-		dd.msgMeta.OriginalRcpts[to] = originalTo
+	rcptHeaders := dd.rcptHeaderStates(rcptBlock)
+	deliveryRcpt := ""
+	if len(rcptHeaders) != 0 {
+		deliveryRcpt = to
 	}
 
 	for _, tgt := range rcptBlock.targets {
@@ -352,20 +591,73 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 			wrapErr = func(err error) error { return err }
 		}
 
-		delivery, err := dd.getDelivery(ctx, tgt)
+		key := deliveryKey{tgt: tgt, rcpt: deliveryRcpt}
+		delivery, err := dd.getDelivery(ctx, key)
 		if err != nil {
 			return wrapErr(err)
 		}
+		delivery.rcptTo = deliveryRcpt
+		delivery.rcptHeaders = rcptHeaders
+		if _, ok := prevRcpts[key]; !ok {
+			prevRcpts[key] = len(delivery.recipients)
+		}
 
 		if err := delivery.AddRcpt(ctx, to); err != nil {
 			return wrapErr(err)
 		}
-		delivery.recipients = append(delivery.recipients, originalTo)
+		delivery.recipients = append(delivery.recipients, to)
 	}
 
 	return nil
 }
 
+// undoRcpts reverts the AddRcpt calls made after prevRcpts was recorded.
+//
+// Delivery targets provide no way to remove a recipient, so the delivery is
+// aborted and started again with the recipients it had before.
+func (dd *msgpipelineDelivery) undoRcpts(ctx context.Context, prevRcpts map[deliveryKey]int) {
+	for key, n := range prevRcpts {
+		old := dd.deliveries[key]
+		if n != 0 && len(old.recipients) == n {
+			continue
+		}
+
+		if err := old.Abort(ctx); err != nil {
+			dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", old.Delivery, err)
+		}
+		delete(dd.deliveries, key)
+		if n == 0 {
+			continue
+		}
+
+		restored, err := dd.getDelivery(ctx, key)
+		if err == nil {
+			restored.rcptTo = old.rcptTo
+			restored.rcptHeaders = old.rcptHeaders
+			for _, rcpt := range old.recipients[:n] {
+				if err = restored.AddRcpt(ctx, rcpt); err != nil {
+					break
+				}
+				restored.recipients = append(restored.recipients, rcpt)
+			}
+			if err != nil {
+				if err := restored.Abort(ctx); err != nil {
+					dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", restored.Delivery, err)
+				}
+			}
+		}
+		if err != nil {
+			// Recipients were already accepted, make sure the message is
+			// not silently lost for them.
+			dd.log.Error("failed to restore delivery", err, "target", objectName(key.tgt))
+			dd.deliveries[key] = &delivery{
+				Delivery:   failedDelivery{err: err},
+				recipients: old.recipients[:n],
+			}
+		}
+	}
+}
+
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
 		return err
@@ -373,13 +665,13 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
 		return err
 	}
-	for blk := range dd.rcptModifiersState {
+	for _, blk := range dd.rcptBlocks {
 		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
 			return err
 		}
 	}
 
-	if dd.d.FirstPipeline {
+	if dd.d.FirstPipeline && !dd.msgMeta.DontAddReceived {
 		// Add Received *after* checks to make sure they see the message literally
 		// how we received it BUT place it below any other field that might be
 		// added by applyResults (including Authentication-Results)
@@ -391,7 +683,18 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		header.Add("Received", received)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
+	if dd.d.FirstPipeline {
+		// Do not let the sender spoof the score.
+		header.Del(scoreHeader)
+		header.Del(scoreChecksHeader)
+	}
+
+	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header, dd.finalRcpts); err != nil {
+		return err
+	}
+
+	body, err := dd.replaceBody(ctx, &header, body)
+	if err != nil {
 		return err
 	}
 
@@ -403,13 +706,20 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
 		return err
 	}
-	for _, modifiers := range dd.rcptModifiersState {
+	for _, modifiers := range dd.rcptModifiers() {
 		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
 			return err
 		}
 	}
+	if err := dd.sealBody(ctx, &header, body); err != nil {
+		return err
+	}
 
 	for _, delivery := range dd.deliveries {
+		header, err := delivery.header(ctx, header)
+		if err != nil {
+			return err
+		}
 		if err := delivery.Body(ctx, header, body); err != nil {
 			return err
 		}
@@ -418,6 +728,81 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	return nil
 }
 
+// rcptHeaderStates returns modifier states that add per-recipient header
+// fields for recipients routed to the block.
+func (dd *msgpipelineDelivery) rcptHeaderStates(rcptBlock *rcptBlock) []module.RcptHeaderModifierState {
+	var states []module.RcptHeaderModifierState
+	for _, state := range []module.ModifierState{
+		dd.globalModifiersState, dd.sourceModifiersState, dd.rcptModifiersState[rcptBlock],
+	} {
+		if stamper, ok := state.(module.RcptHeaderModifierState); ok {
+			states = append(states, stamper)
+		}
+	}
+	return states
+}
+
+// replaceBody runs ReplaceBody for global and per-source modifiers
+// implementing module.BodyReplacingModifierState and returns the body to use
+// for further processing. It should be called before RewriteBody for any
+// modifier.
+func (dd *msgpipelineDelivery) replaceBody(ctx context.Context, header *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	for _, state := range []module.ModifierState{dd.globalModifiersState, dd.sourceModifiersState} {
+		replacer, ok := state.(module.BodyReplacingModifierState)
+		if !ok {
+			continue
+		}
+		newBody, err := replacer.ReplaceBody(ctx, header, body)
+		if err != nil {
+			return nil, err
+		}
+		if newBody != nil {
+			body = newBody
+		}
+	}
+
+	for _, state := range dd.rcptModifiers() {
+		replacer, ok := state.(module.BodyReplacingModifierState)
+		if !ok {
+			continue
+		}
+		// Give the modifier a copy so it can't change the shared header
+		// before failing.
+		hdrCopy := header.Copy()
+		newBody, err := replacer.ReplaceBody(ctx, &hdrCopy, body)
+		if err != nil {
+			return nil, err
+		}
+		if newBody != nil {
+			return nil, &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+				Message:      "Internal server error",
+				Err:          errors.New("msgpipeline: per-destination modifiers can't change the message body"),
+			}
+		}
+	}
+
+	return body, nil
+}
+
+// sealBody runs SealBody for all modifiers implementing
+// module.SealingModifierState. It should be called after RewriteBody for all
+// modifiers.
+func (dd *msgpipelineDelivery) sealBody(ctx context.Context, header *textproto.Header, body buffer.Buffer) error {
+	states := []module.ModifierState{dd.globalModifiersState, dd.sourceModifiersState}
+	for _, state := range append(states, dd.rcptModifiers()...) {
+		sealer, ok := state.(module.SealingModifierState)
+		if !ok {
+			continue
+		}
+		if err := sealer.SealBody(ctx, header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // statusCollector wraps StatusCollector and adds reverse translation
 // of recipients for all statuses.]
 //
@@ -427,23 +812,30 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 // collect-and-them-report approach since statuses should be reported
 // as soon as possible (that is required by LMTP).
 type statusCollector struct {
-	originalRcpts map[string]string
+	originalRcpts map[string][]string
 	wrapped       module.StatusCollector
 }
 
 func (sc statusCollector) SetStatus(rcptTo string, err error) {
-	original, ok := sc.originalRcpts[rcptTo]
-	if ok {
-		rcptTo = original
+	originals, ok := sc.originalRcpts[rcptTo]
+	if !ok {
+		sc.wrapped.SetStatus(rcptTo, err)
+		return
+	}
+	for _, original := range originals {
+		sc.wrapped.SetStatus(original, err)
 	}
-	sc.wrapped.SetStatus(rcptTo, err)
 }
 
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	sc := statusCollector{
+		originalRcpts: dd.rcptOriginals,
+		wrapped:       c,
+	}
 	setStatusAll := func(err error) {
 		for _, delivery := range dd.deliveries {
 			for _, rcpt := range delivery.recipients {
-				c.SetStatus(rcpt, err)
+				sc.SetStatus(rcpt, err)
 			}
 		}
 	}
@@ -457,6 +849,12 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		return
 	}
 
+	body, err := dd.replaceBody(ctx, &header, body)
+	if err != nil {
+		setStatusAll(err)
+		return
+	}
+
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
 	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
@@ -467,26 +865,40 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		setStatusAll(err)
 		return
 	}
-	for _, modifiers := range dd.rcptModifiersState {
+	for _, modifiers := range dd.rcptModifiers() {
 		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
 			setStatusAll(err)
 			return
 		}
 	}
+	if err := dd.sealBody(ctx, &header, body); err != nil {
+		setStatusAll(err)
+		return
+	}
+
+	for key, delivery := range dd.deliveries {
+		header, err := delivery.header(ctx, header)
+		if err != nil {
+			for _, rcpt := range delivery.recipients {
+				sc.SetStatus(rcpt, err)
+			}
+			// Body was not called, so there is nothing to commit.
+			if err := delivery.Abort(ctx); err != nil {
+				dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", delivery, err)
+			}
+			delete(dd.deliveries, key)
+			continue
+		}
 
-	for _, delivery := range dd.deliveries {
 		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
 		if ok {
-			partDelivery.BodyNonAtomic(ctx, statusCollector{
-				originalRcpts: dd.msgMeta.OriginalRcpts,
-				wrapped:       c,
-			}, header, body)
+			partDelivery.BodyNonAtomic(ctx, sc, header, body)
 			continue
 		}
 
 		if err := delivery.Body(ctx, header, body); err != nil {
 			for _, rcpt := range delivery.recipients {
-				c.SetStatus(rcpt, err)
+				sc.SetStatus(rcpt, err)
 			}
 		}
 	}
@@ -513,7 +925,7 @@ func (dd *msgpipelineDelivery) close() {
 	if dd.sourceModifiersState != nil {
 		dd.sourceModifiersState.Close()
 	}
-	for _, modifiers := range dd.rcptModifiersState {
+	for _, modifiers := range dd.rcptModifiers() {
 		modifiers.Close()
 	}
 }
@@ -543,6 +955,13 @@ func (dd *msgpipelineDelivery) rcptBlockForAddr(rcptTo string) (*rcptBlock, erro
 		}
 	}
 
+	if dd.sourceBlock.forwardRcpt != nil {
+		if _, ok := dd.msgMeta.ForwardRcpts[rcptTo]; ok {
+			dd.log.Debugf("recipient %s matched by forward rule", rcptTo)
+			return dd.sourceBlock.forwardRcpt, nil
+		}
+	}
+
 	for _, rcptIn := range dd.sourceBlock.rcptIn {
 		_, ok, err := rcptIn.t.Lookup(cleanRcpt)
 		if err != nil {
@@ -604,11 +1023,23 @@ func (dd *msgpipelineDelivery) getRcptModifiers(ctx context.Context, rcptBlock *
 	}
 
 	dd.rcptModifiersState[rcptBlock] = rcptModifiersState
+	dd.rcptBlocks = append(dd.rcptBlocks, rcptBlock)
 	return rcptModifiersState, nil
 }
 
-func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.DeliveryTarget) (*delivery, error) {
-	delivery_, ok := dd.deliveries[tgt]
+// rcptModifiers returns per-destination modifier states in the order
+// blocks were first matched.
+func (dd *msgpipelineDelivery) rcptModifiers() []module.ModifierState {
+	states := make([]module.ModifierState, 0, len(dd.rcptBlocks))
+	for _, blk := range dd.rcptBlocks {
+		states = append(states, dd.rcptModifiersState[blk])
+	}
+	return states
+}
+
+func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, key deliveryKey) (*delivery, error) {
+	tgt := key.tgt
+	delivery_, ok := dd.deliveries[key]
 	if ok {
 		return delivery_, nil
 	}
@@ -622,7 +1053,7 @@ func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.Deliv
 
 	dd.log.Debugf("tgt.Start(%s) ok, target = %s", dd.sourceAddr, objectName(tgt))
 
-	dd.deliveries[tgt] = delivery_
+	dd.deliveries[key] = delivery_
 	return delivery_, nil
 }
 
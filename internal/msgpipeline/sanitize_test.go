@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_CRLFInjection(t *testing.T) {
+	const (
+		sender   = "evil\r\nX-Injected: yes\r\n@example.org"
+		rcpt     = "rcpt\r\nX-Injected: yes\r\n@example.com"
+		badRcpt  = "bad\r\n250 OK\r\n@example.net"
+		heloName = "mx.example.org\r\nX-Injected: yes"
+	)
+
+	var records []string
+	tgt := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.SPFResult{
+					Value:  authres.ResultFail,
+					Reason: "reason\r\nX-Injected: yes",
+					From:   sender,
+					Helo:   heloName,
+				},
+			},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.com": {
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					rejectErr: &exterrors.SMTPError{
+						Code:         550,
+						EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+						Message:      "No such user: " + badRcpt,
+					},
+				},
+			},
+		},
+		Hostname:      "TEST-HOST",
+		FirstPipeline: true,
+		Log: log.Logger{
+			Out: log.FuncOutput(func(_ time.Time, _ bool, str string) {
+				records = append(records, str)
+			}, func() error { return nil }),
+			Name:  "msgpipeline",
+			Debug: true,
+		},
+	}
+
+	msgMeta := &module.MsgMetadata{
+		OriginalFrom: sender,
+		Conn: &module.ConnState{
+			Proto: "ESMTP",
+			ConnectionState: smtp.ConnectionState{
+				Hostname:   heloName,
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25},
+			},
+		},
+	}
+	_, err := testutils.DoTestDeliveryErrMeta(t, &d, sender, []string{rcpt, badRcpt}, msgMeta)
+	if err == nil {
+		t.Fatal("expected an error for the rejected recipient")
+	}
+	// Rejection text is included into the SMTP reply by the endpoint, make
+	// sure it is at least not modified on the way there.
+	if !strings.Contains(exterrors.Fields(err)["smtp_msg"].(string), "No such user") {
+		t.Fatal("unexpected error:", err)
+	}
+
+	_, err = testutils.DoTestDeliveryErrMeta(t, &d, sender, []string{rcpt}, msgMeta)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(tgt.Messages))
+	}
+	for field := tgt.Messages[0].Header.Fields(); field.Next(); {
+		if strings.EqualFold(field.Key(), "X-Injected") {
+			t.Error("injected header field present")
+		}
+		if strings.ContainsAny(field.Value(), "\r\n") {
+			t.Errorf("multi-line value in %s: %q", field.Key(), field.Value())
+		}
+	}
+
+	if len(records) == 0 {
+		t.Fatal("nothing was logged")
+	}
+	for _, rec := range records {
+		if strings.ContainsAny(rec, "\r\n") {
+			t.Errorf("multi-line log record: %q", rec)
+		}
+	}
+}
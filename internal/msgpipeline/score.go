@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	scoreHeader       = "X-Maddy-Score"
+	scoreChecksHeader = "X-Maddy-Checks"
+)
+
+// scoreCfg contains the pipeline thresholds for the message spam score
+// (sum of module.CheckResult.Score values). Zero threshold is disabled.
+type scoreCfg struct {
+	quarantine int
+	reject     int
+
+	// Per-recipient quarantine thresholds, looked up using the final
+	// recipient address and then its domain.
+	rcptQuarantine module.Table
+}
+
+type scorePart struct {
+	check string
+	score int
+}
+
+// addScore records the score reported by the check.
+//
+// It is called only from runAndMergeResults so the order of parts is
+// deterministic.
+func (cr *checkRunner) addScore(s module.CheckState, score int) {
+	if score == 0 {
+		return
+	}
+	cr.mergedRes.Score += score
+
+	name := objectName(cr.stateChecks[s])
+	for i := range cr.scoreParts {
+		if cr.scoreParts[i].check == name {
+			cr.scoreParts[i].score += score
+			return
+		}
+	}
+	cr.scoreParts = append(cr.scoreParts, scorePart{check: name, score: score})
+}
+
+func (cr *checkRunner) rcptQuarantineThres(rcpt string) int {
+	if cr.scoreCfg.rcptQuarantine == nil {
+		return cr.scoreCfg.quarantine
+	}
+
+	key, err := address.ForLookup(rcpt)
+	if err != nil {
+		return cr.scoreCfg.quarantine
+	}
+	keys := []string{key}
+	if _, domain, err := address.Split(key); err == nil && domain != "" {
+		keys = append(keys, domain)
+	}
+
+	for _, key := range keys {
+		val, ok, err := cr.scoreCfg.rcptQuarantine.Lookup(key)
+		if err != nil {
+			cr.log.Error("quarantine threshold lookup failed", err, "rcpt", rcpt)
+			return cr.scoreCfg.quarantine
+		}
+		if !ok {
+			continue
+		}
+		thres, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			cr.log.Error("malformed quarantine threshold", err, "rcpt", rcpt, "key", key)
+			return cr.scoreCfg.quarantine
+		}
+		return thres
+	}
+	return cr.scoreCfg.quarantine
+}
+
+// applyScore adds the score header fields and compares the score with
+// configured thresholds.
+//
+// rcpts is the list of final recipient addresses. If the quarantine
+// threshold is reached only for some of them, they are added to
+// msgMeta.QuarantineRcpts.
+func (cr *checkRunner) applyScore(header *textproto.Header, rcpts []string) error {
+	score := cr.mergedRes.Score
+
+	if len(cr.scoreParts) != 0 {
+		parts := make([]string, 0, len(cr.scoreParts))
+		for _, part := range cr.scoreParts {
+			parts = append(parts, part.check+"="+strconv.Itoa(part.score))
+		}
+		header.Add(scoreHeader, strconv.Itoa(score))
+		header.Add(scoreChecksHeader, strings.Join(parts, ", "))
+	}
+
+	if cr.scoreCfg.reject != 0 && score >= cr.scoreCfg.reject {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to high spam score",
+			CheckName:    "msgpipeline",
+			Misc: map[string]interface{}{
+				"score":  score,
+				"checks": header.Get(scoreChecksHeader),
+			},
+		}
+	}
+
+	if cr.msgMeta.Quarantine {
+		return nil
+	}
+
+	var quarantined []string
+	for _, rcpt := range rcpts {
+		thres := cr.rcptQuarantineThres(rcpt)
+		if thres != 0 && score >= thres {
+			quarantined = append(quarantined, rcpt)
+		}
+	}
+	switch {
+	case len(quarantined) == 0:
+	case len(quarantined) == len(rcpts):
+		cr.log.Msg("quarantined", "reason", "spam score", "score", score)
+		cr.msgMeta.Quarantine = true
+	default:
+		cr.log.Msg("quarantined for some recipients", "reason", "spam score", "score", score, "rcpts", quarantined)
+		if cr.msgMeta.QuarantineRcpts == nil {
+			cr.msgMeta.QuarantineRcpts = make(map[string]struct{}, len(quarantined))
+		}
+		for _, rcpt := range quarantined {
+			cr.msgMeta.QuarantineRcpts[rcpt] = struct{}{}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func scoreTestPipeline(t *testing.T, tgt module.DeliveryTarget, score scoreCfg, checks ...module.Check) *MsgPipeline {
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: checks,
+			scoreCfg:     score,
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{tgt},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+}
+
+func TestMsgPipeline_ScoreHeaders(t *testing.T) {
+	target := testutils.Target{}
+	d := scoreTestPipeline(t, &target, scoreCfg{},
+		&testutils.Check{InstName: "a", ConnRes: module.CheckResult{Score: 2}, BodyRes: module.CheckResult{Score: 1}},
+		&testutils.Check{InstName: "b"},
+		&testutils.Check{InstName: "c", SenderRes: module.CheckResult{Score: -1}},
+	)
+
+	testutils.DoTestDelivery(t, d, "whatever@whatever", []string{"whatever@whatever"})
+	if len(target.Messages) != 1 {
+		t.Fatal("Message is not delivered")
+	}
+	hdr := target.Messages[0].Header
+	if score := hdr.Get(scoreHeader); score != "2" {
+		t.Errorf("Wrong %s: %q", scoreHeader, score)
+	}
+	if checks := hdr.Get(scoreChecksHeader); checks != "test_check:a=3, test_check:c=-1" {
+		t.Errorf("Wrong %s: %q", scoreChecksHeader, checks)
+	}
+	if target.Messages[0].MsgMeta.Quarantine {
+		t.Error("Message is quarantined without thresholds")
+	}
+}
+
+func TestMsgPipeline_ScoreHeaders_Spoofed(t *testing.T) {
+	target := testutils.Target{}
+	d := scoreTestPipeline(t, &target, scoreCfg{},
+		&testutils.Check{InstName: "a", BodyRes: module.CheckResult{Score: 5}})
+	d.FirstPipeline = true
+
+	ctx := context.Background()
+	delivery, err := d.Start(ctx, &module.MsgMetadata{
+		ID:   "test",
+		Conn: &module.ConnState{Proto: "ESMTP"},
+	}, "whatever@whatever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "whatever@whatever"); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add(scoreHeader, "-100")
+	hdr.Add(scoreChecksHeader, "trusted=-100")
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(target.Messages) != 1 {
+		t.Fatal("Message is not delivered")
+	}
+	fields := target.Messages[0].Header.FieldsByKey(scoreHeader)
+	count := 0
+	for fields.Next() {
+		count++
+		if fields.Value() != "5" {
+			t.Error("Spoofed score is preserved:", fields.Value())
+		}
+	}
+	if count != 1 {
+		t.Error("Wrong amount of score fields:", count)
+	}
+}
+
+func TestMsgPipeline_ScoreThresholds(t *testing.T) {
+	test := func(score int, cfg scoreCfg, reject, quarantine bool) {
+		t.Helper()
+
+		target := testutils.Target{}
+		d := scoreTestPipeline(t, &target, cfg,
+			&testutils.Check{InstName: "a", BodyRes: module.CheckResult{Score: score}})
+
+		_, err := testutils.DoTestDeliveryErr(t, d, "whatever@whatever", []string{"whatever@whatever"})
+		if reject {
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if code := exterrors.Fields(err)["smtp_code"]; code != 550 {
+				t.Error("Wrong SMTP code:", code)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatal("Message is not delivered")
+		}
+		if target.Messages[0].MsgMeta.Quarantine != quarantine {
+			t.Errorf("score %d: want quarantine=%v", score, quarantine)
+		}
+	}
+
+	cfg := scoreCfg{quarantine: 5, reject: 10}
+	test(4, cfg, false, false)
+	test(5, cfg, false, true)
+	test(9, cfg, false, true)
+	test(10, cfg, true, false)
+	test(100, scoreCfg{quarantine: 5}, false, true)
+	test(100, scoreCfg{}, false, false)
+}
+
+func TestMsgPipeline_ScoreRcptThresholds(t *testing.T) {
+	target := testutils.Target{}
+	d := scoreTestPipeline(t, &target, scoreCfg{
+		quarantine: 10,
+		rcptQuarantine: testutils.Table{M: map[string]string{
+			"strict@example.org": "3",
+			"loose.example.org":  "100",
+			"broken@example.org": "aaa",
+		}},
+	}, &testutils.Check{InstName: "a", BodyRes: module.CheckResult{Score: 5}})
+
+	testutils.DoTestDelivery(t, d, "whatever@whatever", []string{
+		"strict@example.org",
+		"Strict@Example.ORG",
+		"default@example.org",
+		"broken@example.org",
+		"user@loose.example.org",
+	})
+	if len(target.Messages) != 1 {
+		t.Fatal("Message is not delivered")
+	}
+	meta := target.Messages[0].MsgMeta
+	if meta.Quarantine {
+		t.Fatal("Message is quarantined for all recipients")
+	}
+	for rcpt, expected := range map[string]bool{
+		"strict@example.org":     true,
+		"Strict@Example.ORG":     true,
+		"default@example.org":    false,
+		"broken@example.org":     false,
+		"user@loose.example.org": false,
+	} {
+		if meta.IsQuarantined(rcpt) != expected {
+			t.Errorf("%s: want quarantined=%v", rcpt, expected)
+		}
+	}
+
+	// All recipients are quarantined - the message-level flag is set.
+	target = testutils.Target{}
+	testutils.DoTestDelivery(t, d, "whatever@whatever", []string{"strict@example.org"})
+	if !target.Messages[0].MsgMeta.Quarantine {
+		t.Error("Message is not quarantined")
+	}
+}
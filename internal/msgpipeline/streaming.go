@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// errCheckDone is used to close the pipe for a check that returned before
+// reading the whole body so further writes for it are skipped.
+var errCheckDone = errors.New("msgpipeline: check does not need more data")
+
+// checkStream feeds the message body to module.StreamingCheckState
+// implementations while it is being received.
+//
+// Each check reads the body from its own pipe in a separate goroutine.
+// Results are saved in checkRunner.streamedRes on Close and are merged by
+// checkBody as usual so the outcome is the same as for the buffered body.
+type checkStream struct {
+	cr      *checkRunner
+	states  []module.CheckState
+	pipes   []*io.PipeWriter
+	active  []bool
+	done    []chan struct{}
+	results []module.CheckResult
+}
+
+// streamBody starts streaming the body to states.
+//
+// It returns nil if any of the states does not support streaming or has
+// a timeout configured. Timeouts are measured for the CheckBody call and
+// can't be meaningfully applied to the check that waits for a slow client.
+func (cr *checkRunner) streamBody(ctx context.Context, states []module.CheckState, header textproto.Header) *checkStream {
+	if len(states) == 0 {
+		return nil
+	}
+	for _, s := range states {
+		if _, ok := s.(module.StreamingCheckState); !ok {
+			return nil
+		}
+		if lc := cr.limits[s]; lc != nil && lc.timeout != 0 {
+			return nil
+		}
+	}
+
+	cs := &checkStream{
+		cr:      cr,
+		states:  states,
+		pipes:   make([]*io.PipeWriter, len(states)),
+		active:  make([]bool, len(states)),
+		done:    make([]chan struct{}, len(states)),
+		results: make([]module.CheckResult, len(states)),
+	}
+	for i, s := range states {
+		i, s := i, s.(module.StreamingCheckState)
+		pr, pw := io.Pipe()
+		cs.pipes[i] = pw
+		cs.active[i] = true
+		cs.done[i] = make(chan struct{})
+		go func() {
+			defer close(cs.done[i])
+			cs.results[i] = s.CheckBodyStream(ctx, header, pr)
+			pr.CloseWithError(errCheckDone)
+		}()
+	}
+	return cs
+}
+
+// Write passes p to all checks that are still reading the body.
+//
+// If a check completes and rejects the message, its Reason is returned.
+func (cs *checkStream) Write(p []byte) (int, error) {
+	for i, pw := range cs.pipes {
+		if !cs.active[i] {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			cs.active[i] = false
+			<-cs.done[i]
+			if cs.results[i].Reject {
+				return 0, cs.results[i].Reason
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close signals the end of the body to all checks and waits for their
+// results.
+func (cs *checkStream) Close() error {
+	for i, pw := range cs.pipes {
+		pw.Close()
+		<-cs.done[i]
+	}
+
+	var rejectErr error
+	for i, s := range cs.states {
+		cs.cr.streamedRes[s] = cs.results[i]
+		if cs.results[i].Reject && rejectErr == nil {
+			rejectErr = cs.results[i].Reason
+		}
+	}
+	return rejectErr
+}
+
+func (cs *checkStream) Abort(err error) {
+	for i, pw := range cs.pipes {
+		pw.CloseWithError(err)
+		<-cs.done[i]
+	}
+}
+
+// StreamBody implements module.StreamingDelivery.
+//
+// Streaming is used only if all body checks for the message support it,
+// otherwise nil BodyStream is returned and checks are executed on the
+// buffered body in Body.
+func (dd *msgpipelineDelivery) StreamBody(ctx context.Context, header textproto.Header) (module.BodyStream, error) {
+	checks := make([]module.Check, 0, len(dd.d.globalChecks)+len(dd.sourceBlock.checks))
+	checks = append(checks, dd.d.globalChecks...)
+	checks = append(checks, dd.sourceBlock.checks...)
+	for _, blk := range dd.rcptBlocks {
+		checks = append(checks, blk.checks...)
+	}
+
+	states, err := dd.checkRunner.checkStates(ctx, checks)
+	if err != nil {
+		return nil, err
+	}
+	// The same check may be used in multiple blocks, make sure it gets the
+	// body only once.
+	seen := make(map[module.CheckState]struct{}, len(states))
+	uniqStates := states[:0]
+	for _, s := range states {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		uniqStates = append(uniqStates, s)
+	}
+	states = uniqStates
+
+	cs := dd.checkRunner.streamBody(ctx, states, header)
+	if cs == nil {
+		return nil, nil
+	}
+
+	if dd.checkRunner.doDMARC && !dd.checkRunner.didDMARCFetch {
+		dd.checkRunner.dmarcVerify.FetchRecord(ctx, header)
+		dd.checkRunner.didDMARCFetch = true
+	}
+
+	dd.log.Debugf("streaming body to %d checks", len(states))
+	return cs, nil
+}
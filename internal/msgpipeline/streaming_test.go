@@ -0,0 +1,289 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// streamCheck rejects the message if the body contains the "REJECT"
+// string. It implements module.StreamingCheckState.
+type streamCheck struct {
+	lock       sync.Mutex
+	bodyCalls  int
+	streamed   int
+	openStates int
+}
+
+type streamCheckState struct {
+	c *streamCheck
+}
+
+func (c *streamCheck) Name() string {
+	return "stream_check"
+}
+
+func (c *streamCheck) InstanceName() string {
+	return "stream_check"
+}
+
+func (c *streamCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.openStates++
+	return &streamCheckState{c: c}, nil
+}
+
+func (s *streamCheckState) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *streamCheckState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *streamCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *streamCheckState) result(body []byte) module.CheckResult {
+	if !bytes.Contains(body, []byte("REJECT")) {
+		return module.CheckResult{}
+	}
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      "Rejected",
+		},
+	}
+}
+
+func (s *streamCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	s.c.lock.Lock()
+	s.c.bodyCalls++
+	s.c.lock.Unlock()
+
+	r, err := body.Open()
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		panic(err)
+	}
+	return s.result(blob)
+}
+
+func (s *streamCheckState) CheckBodyStream(ctx context.Context, header textproto.Header, body io.Reader) module.CheckResult {
+	s.c.lock.Lock()
+	s.c.streamed++
+	s.c.lock.Unlock()
+
+	var seen []byte
+	chunk := make([]byte, 4096)
+	for {
+		n, err := body.Read(chunk)
+		seen = append(seen, chunk[:n]...)
+		if res := s.result(seen); res.Reject {
+			return res
+		}
+		if err != nil {
+			return module.CheckResult{}
+		}
+	}
+}
+
+func (s *streamCheckState) Close() error {
+	s.c.lock.Lock()
+	defer s.c.lock.Unlock()
+	s.c.openStates--
+	return nil
+}
+
+func streamPipeline(t *testing.T, tgt module.DeliveryTarget, checks ...module.Check) *MsgPipeline {
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: checks,
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{tgt},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+}
+
+func startStream(t *testing.T, d *MsgPipeline) (module.Delivery, module.BodyStream) {
+	t.Helper()
+
+	delivery, err := d.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "rcpt@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	stream, err := delivery.(module.StreamingDelivery).StreamBody(context.Background(), hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivery, stream
+}
+
+func TestMsgPipeline_StreamBody(t *testing.T) {
+	tgt := testutils.Target{}
+	check := &streamCheck{}
+	d := streamPipeline(t, &tgt, check)
+
+	delivery, stream := startStream(t, d)
+	if stream == nil {
+		t.Fatal("streaming is not used")
+	}
+
+	body := strings.Repeat("Hello world!\r\n", 1000)
+	if _, err := io.Copy(stream, strings.NewReader(body)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	if err := delivery.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(tgt.Messages))
+	}
+	if check.streamed != 1 || check.bodyCalls != 0 {
+		t.Fatalf("wrong calls count: streamed %d, CheckBody %d", check.streamed, check.bodyCalls)
+	}
+	if check.openStates != 0 {
+		t.Fatalf("state objects leak or double-closed, alive counter: %v", check.openStates)
+	}
+}
+
+func TestMsgPipeline_StreamBody_Reject(t *testing.T) {
+	tgt := testutils.Target{}
+	check := &streamCheck{}
+	d := streamPipeline(t, &tgt, check)
+
+	delivery, stream := startStream(t, d)
+	if stream == nil {
+		t.Fatal("streaming is not used")
+	}
+
+	if _, err := stream.Write([]byte("Hello world!\r\n")); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// The check may need some time to see the data, keep writing until it
+	// does, like the message source would.
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		_, err = stream.Write([]byte("REJECT\r\n"))
+	}
+	if err == nil {
+		t.Fatal("message is not rejected")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	stream.Abort(err)
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if len(tgt.Messages) != 0 {
+		t.Fatalf("message is delivered")
+	}
+	if check.openStates != 0 {
+		t.Fatalf("state objects leak or double-closed, alive counter: %v", check.openStates)
+	}
+}
+
+func TestMsgPipeline_StreamBody_Unsupported(t *testing.T) {
+	tgt := testutils.Target{}
+	check := &streamCheck{}
+	d := streamPipeline(t, &tgt, check, &testutils.Check{})
+
+	delivery, stream := startStream(t, d)
+	if stream != nil {
+		t.Fatal("streaming is used with the non-streaming check")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	err := delivery.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("REJECT\r\n")})
+	if err == nil {
+		t.Fatal("message is not rejected")
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if check.streamed != 0 || check.bodyCalls != 1 {
+		t.Fatalf("wrong calls count: streamed %d, CheckBody %d", check.streamed, check.bodyCalls)
+	}
+}
+
+func TestMsgPipeline_StreamBody_Timeout(t *testing.T) {
+	tgt := testutils.Target{}
+	check := &streamCheck{}
+	d := streamPipeline(t, &tgt, &limitedCheck{Check: check, timeout: time.Second})
+
+	delivery, stream := startStream(t, d)
+	if stream != nil {
+		t.Fatal("streaming is used for the check with timeout")
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
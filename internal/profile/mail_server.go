@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package profile
+
+import (
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// mailServerTemplate is the configuration mail_server is expanded into. It
+// should be kept in sync with maddy.conf.
+const mailServerTemplate = `
+tls file /etc/maddy/certs/$(hostname)/fullchain.pem /etc/maddy/certs/$(hostname)/privkey.pem
+
+auth.pass_table local_authdb {
+    table sql_table {
+        driver sqlite3
+        dsn credentials.db
+        table_name passwords
+    }
+}
+
+storage.imapsql local_mailboxes {
+    driver sqlite3
+    dsn imapsql.db
+}
+
+hostname $(hostname)
+
+msgpipeline local_routing {
+    destination postmaster $(local_domains) {
+        modify {
+            replace_rcpt regexp "(.+)\+(.+)@(.+)" "$1@$3"
+            replace_rcpt file /etc/maddy/aliases
+        }
+
+        deliver_to &local_mailboxes
+    }
+
+    default_destination {
+        reject 550 5.1.1 "User doesn't exist"
+    }
+}
+
+smtp tcp://0.0.0.0:25 {
+    limits {
+        all rate 20 1s
+        all concurrency 10
+    }
+
+    dmarc yes
+    check {
+        require_mx_record
+        dkim
+        spf
+    }
+
+    source $(local_domains) {
+        reject 501 5.1.8 "Use Submission for outgoing SMTP"
+    }
+    default_source {
+        destination postmaster $(local_domains) {
+            deliver_to &local_routing
+        }
+        default_destination {
+            reject 550 5.1.1 "User doesn't exist"
+        }
+    }
+}
+
+submission tls://0.0.0.0:465 tcp://0.0.0.0:587 {
+    limits {
+        all rate 50 1s
+    }
+
+    auth &local_authdb
+
+    source $(local_domains) {
+        destination postmaster $(local_domains) {
+            deliver_to &local_routing
+        }
+        default_destination {
+            modify {
+                dkim $(primary_domain) $(local_domains) default
+            }
+            deliver_to &remote_queue
+        }
+    }
+    default_source {
+        reject 501 5.1.8 "Non-local sender domain"
+    }
+}
+
+target.remote outbound_delivery {
+    limits {
+        destination rate 20 1s
+        destination concurrency 10
+    }
+    mx_auth {
+        dane
+        mtasts {
+            cache fs
+            fs_dir mtasts_cache/
+        }
+        local_policy {
+            min_tls_level encrypted
+            min_mx_level none
+        }
+    }
+}
+
+target.queue remote_queue {
+    target &outbound_delivery
+
+    autogenerated_msg_domain $(primary_domain)
+    bounce {
+        destination postmaster $(local_domains) {
+            deliver_to &local_routing
+        }
+        default_destination {
+            reject 550 5.0.0 "Refusing to send DSNs to non-local addresses"
+        }
+    }
+}
+
+imap tls://0.0.0.0:993 tcp://0.0.0.0:143 {
+    auth &local_authdb
+    storage &local_mailboxes
+}
+`
+
+// mailServer expands the mail_server profile into the configuration of the
+// complete mail server: SMTP, Submission and IMAP endpoints, local delivery,
+// outbound queue and local storage with the user accounts.
+func mailServer(node config.Node) ([]config.Node, error) {
+	var (
+		primaryDomain string
+		localDomains  []string
+		hostname      string
+		tlsNode       *config.Node
+	)
+	cfg := config.NewMap(nil, node)
+	cfg.String("primary_domain", false, true, "", &primaryDomain)
+	cfg.StringList("local_domains", false, false, nil, &localDomains)
+	cfg.String("hostname", false, true, "", &hostname)
+	cfg.Callback("tls", func(_ *config.Map, node config.Node) error {
+		tlsNode = &node
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if len(localDomains) == 0 {
+		localDomains = []string{primaryDomain}
+	}
+
+	nodes, err := readTemplate(node, mailServerTemplate, map[string][]string{
+		"hostname":       {hostname},
+		"primary_domain": {primaryDomain},
+		"local_domains":  localDomains,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsNode != nil {
+		for i := range nodes {
+			if nodes[i].Name == "tls" {
+				nodes[i] = *tlsNode
+			}
+		}
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,153 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package profile implements configuration profiles: top-level directives
+// that are expanded into the complete standard configuration before it is
+// processed, e.g.:
+//
+//	mail_server {
+//	    primary_domain example.org
+//	    hostname mx.example.org
+//	}
+//
+// Profiles are a preprocessing stage, modules only see the expanded
+// configuration.
+package profile
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// profiles maps profile directive names to the functions that return the
+// configuration they are expanded into.
+var profiles = map[string]func(node config.Node) ([]config.Node, error){
+	"mail_server": mailServer,
+}
+
+// Names returns the names of all profile directives.
+func Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expand replaces the profile directives in the top-level configuration
+// with the configuration they stand for.
+//
+// Any generated block or global directive can be overridden by defining it
+// at the top level. Module blocks are matched by the instance name,
+// endpoints and global directives by the directive name.
+func Expand(cfg []config.Node) ([]config.Node, error) {
+	defined := make(map[string]bool, len(cfg))
+	for _, node := range cfg {
+		if profiles[node.Name] == nil {
+			defined[sectionKey(node)] = true
+		}
+	}
+
+	var (
+		res  = make([]config.Node, 0, len(cfg))
+		seen = make(map[string]bool)
+	)
+	for _, node := range cfg {
+		expand := profiles[node.Name]
+		if expand == nil {
+			res = append(res, node)
+			continue
+		}
+
+		if seen[node.Name] {
+			return nil, config.NodeErr(node, "duplicate profile directive: %s", node.Name)
+		}
+		seen[node.Name] = true
+
+		generated, err := expand(node)
+		if err != nil {
+			return nil, err
+		}
+		for _, section := range generated {
+			if defined[sectionKey(section)] {
+				continue
+			}
+			res = append(res, section)
+		}
+	}
+
+	return res, nil
+}
+
+// sectionKey returns the string that identifies the top-level block or
+// directive for the purposes of overriding generated configuration.
+func sectionKey(node config.Node) string {
+	switch {
+	case module.GetEndpoint(node.Name) != nil:
+		return "endpoint " + node.Name
+	case module.Get(node.Name) != nil:
+		if len(node.Args) == 0 {
+			return "block " + node.Name
+		}
+		return "block " + node.Args[0]
+	default:
+		return "global " + node.Name
+	}
+}
+
+// readTemplate reads the configuration template with the specified macros
+// defined. Generated nodes are reported at the location of the profile
+// directive.
+func readTemplate(profile config.Node, template string, macros map[string][]string) ([]config.Node, error) {
+	macroNodes := make([]config.Node, 0, len(macros))
+	for name, value := range macros {
+		macroNodes = append(macroNodes, config.Node{
+			Name: "$(" + name + ")",
+			Args: append([]string{"="}, value...),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := parser.Write(&buf, macroNodes); err != nil {
+		return nil, err
+	}
+
+	nodes, err := parser.Read(io.MultiReader(&buf, strings.NewReader(template)), profile.Name)
+	if err != nil {
+		return nil, config.NodeErr(profile, "%v", err)
+	}
+	setLocation(nodes, profile)
+	return nodes, nil
+}
+
+func setLocation(nodes []config.Node, profile config.Node) {
+	profilePath := append(profile.Path[:len(profile.Path):len(profile.Path)], profile.Header())
+	for i := range nodes {
+		nodes[i].File = profile.File
+		nodes[i].Line = profile.Line
+		nodes[i].Path = append(profilePath[:len(profilePath):len(profilePath)], nodes[i].Path...)
+		setLocation(nodes[i].Children, profile)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package profile
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
+)
+
+func expand(t *testing.T, str string) []config.Node {
+	t.Helper()
+
+	cfg, err := parser.Read(strings.NewReader(str), "literal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := Expand(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expanded
+}
+
+func findNode(nodes []config.Node, name string) *config.Node {
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return &nodes[i]
+		}
+	}
+	return nil
+}
+
+func TestMailServer_MaddyConf(t *testing.T) {
+	f, err := os.Open("../../maddy.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expected, err := parser.Read(f, "maddy.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expanded := expand(t, `mail_server {
+	primary_domain example.org
+	hostname example.org
+}`)
+	if !config.NodesEqual(expected, expanded) {
+		t.Error("mail_server expansion does not match maddy.conf")
+	}
+}
+
+func TestMailServer_Options(t *testing.T) {
+	expanded := expand(t, `mail_server {
+	primary_domain example.org
+	local_domains example.org example.com
+	hostname mx.example.org
+	tls {
+		loader acme
+	}
+}`)
+
+	hostname := findNode(expanded, "hostname")
+	if hostname == nil || len(hostname.Args) != 1 || hostname.Args[0] != "mx.example.org" {
+		t.Error("wrong hostname directive:", hostname)
+	}
+	tls := findNode(expanded, "tls")
+	if tls == nil || len(tls.Args) != 0 || len(tls.Children) != 1 || tls.Children[0].Name != "loader" {
+		t.Error("wrong tls directive:", tls)
+	}
+	smtp := findNode(expanded, "smtp")
+	if smtp == nil {
+		t.Fatal("no smtp endpoint")
+	}
+	source := findNode(smtp.Children, "source")
+	if source == nil || strings.Join(source.Args, " ") != "example.org example.com" {
+		t.Error("local_domains are not used:", source)
+	}
+
+	if smtp.File != "literal" || smtp.Line != 1 {
+		t.Errorf("wrong location of the generated block: %s:%d", smtp.File, smtp.Line)
+	}
+	err := config.NodeErr(source.Children[0], "message")
+	if err.Error() != `literal:1: mail_server > smtp tcp://0.0.0.0:25 > source example.org example.com: message` {
+		t.Error("wrong error for the generated node:", err)
+	}
+}
+
+func TestMailServer_Override(t *testing.T) {
+	expanded := expand(t, `hostname mx2.example.org
+mail_server {
+	primary_domain example.org
+	hostname mx.example.org
+}
+storage.imapsql local_mailboxes {
+	driver postgres
+	dsn "host=localhost"
+}
+imap tls://0.0.0.0:993 {
+	auth &local_authdb
+	storage &local_mailboxes
+}`)
+
+	counts := make(map[string]int)
+	for _, node := range expanded {
+		counts[node.Name]++
+	}
+	for _, name := range []string{"hostname", "storage.imapsql", "imap", "smtp", "submission"} {
+		if counts[name] != 1 {
+			t.Errorf("%d %s blocks after the expansion, expected 1", counts[name], name)
+		}
+	}
+
+	if hostname := findNode(expanded, "hostname"); hostname.Args[0] != "mx2.example.org" {
+		t.Error("hostname is not overridden:", hostname.Args)
+	}
+	storage := findNode(expanded, "storage.imapsql")
+	if storage.File != "literal" || storage.Line != 6 {
+		t.Errorf("storage is not overridden, defined at %s:%d", storage.File, storage.Line)
+	}
+	if imap := findNode(expanded, "imap"); len(imap.Args) != 1 {
+		t.Error("imap is not overridden:", imap.Args)
+	}
+}
+
+func TestMailServer_Errors(t *testing.T) {
+	test := func(str, expectedErr string) {
+		t.Helper()
+
+		cfg, err := parser.Read(strings.NewReader(str), "literal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Expand(cfg)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if err.Error() != expectedErr {
+			t.Errorf("wrong error message\nwant: %s\ngot:  %s", expectedErr, err.Error())
+		}
+	}
+
+	test(`mail_server {
+	hostname mx.example.org
+}`, `literal:1: mail_server: missing required directive: primary_domain`)
+	test(`mail_server {
+	primary_domain example.org
+	hostname mx.example.org
+	local_domain example.org
+}`, `literal:4: mail_server: unknown directive: local_domain, did you mean local_domains?`)
+	test(`mail_server {
+	primary_domain example.org
+	hostname mx.example.org
+}
+mail_server {
+	primary_domain example.com
+	hostname mx.example.com
+}`, `literal:5: duplicate profile directive: mail_server`)
+}
@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package proxy_protocol implements the server side of the PROXY protocol
+// (versions 1 and 2) used by load balancers such as HAProxy to pass the
+// address of the original client.
+//
+// See https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt.
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// errNoHeader is returned by readHeader if the connection does not
+	// start with the PROXY protocol header.
+	errNoHeader = errors.New("proxy_protocol: no header")
+)
+
+const (
+	// v1 header is at most 107 bytes including CRLF.
+	v1MaxLength = 107
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamTCP4 = 0x11
+	v2FamTCP6 = 0x21
+)
+
+// hasSignature reports whether b starts with the header of any supported
+// version.
+func hasSignature(b []byte) bool {
+	return bytes.HasPrefix(b, v1Prefix) || bytes.HasPrefix(b, v2Signature)
+}
+
+// readHeader reads the PROXY protocol header from r and returns the source
+// address it contains. nil address is returned if the header does not
+// contain the address (v1 UNKNOWN, v2 LOCAL or unsupported address family),
+// in this case the address of the connection should be used.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, v1Prefix) {
+		return readV1(r)
+	}
+
+	prefix, err = r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, errNoHeader
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, errors.New("proxy_protocol: v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy_protocol: malformed v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errors.New("proxy_protocol: malformed v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxy_protocol: unknown v1 protocol: %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("proxy_protocol: malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("proxy_protocol: malformed v1 source address: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol: malformed v1 source port: %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy_protocol: unsupported version: %d", verCmd>>4)
+	}
+
+	// Addresses are followed by TLVs we are not interested in, so the
+	// whole block is read to skip them.
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xF {
+	case v2CmdLocal:
+		// Health checks by the proxy itself.
+		return nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("proxy_protocol: unknown v2 command: %d", verCmd&0xF)
+	}
+
+	switch fam {
+	case v2FamTCP4:
+		if len(body) < 12 {
+			return nil, errors.New("proxy_protocol: truncated v2 address")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case v2FamTCP6:
+		if len(body) < 36 {
+			return nil, errors.New("proxy_protocol: truncated v2 address")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	default:
+		// UNSPEC, UDP and Unix sockets.
+		return nil, nil
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package proxy_protocol
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	v2 := func(verCmd, fam byte, body ...byte) string {
+		hdr := append([]byte(nil), v2Signature...)
+		hdr = append(hdr, verCmd, fam, byte(len(body)>>8), byte(len(body)))
+		return string(append(hdr, body...))
+	}
+
+	for _, c := range []struct {
+		name   string
+		header string
+		addr   string
+		fail   bool
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", addr: "192.0.2.1:56324"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", addr: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", header: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		{name: "v1 family mismatch", header: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 25\r\n", fail: true},
+		{name: "v1 missing CR", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", fail: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 123456 25\r\n", fail: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", fail: true},
+		{
+			name: "v2 TCP4",
+			header: v2(0x21, v2FamTCP4,
+				192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0, 25),
+			addr: "192.0.2.1:56324",
+		},
+		{
+			name: "v2 TCP6 with TLV",
+			header: v2(0x21, v2FamTCP6,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0xDC, 0x04, 0, 25,
+				0x04, 0, 1, 0),
+			addr: "[2001:db8::1]:56324",
+		},
+		{name: "v2 LOCAL", header: v2(0x20, 0x00)},
+		{name: "v2 truncated address", header: v2(0x21, v2FamTCP4, 192, 0, 2, 1), fail: true},
+		{name: "v2 bad version", header: v2(0x11, v2FamTCP4), fail: true},
+		{name: "no header", header: "EHLO mx.example.org\r\n", fail: true},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(c.header + "EHLO mx.example.org\r\n"))
+			addr, err := readHeader(r)
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error, got address", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.addr == "" {
+				if addr != nil {
+					t.Fatal("expected no address, got", addr)
+				}
+			} else if addr == nil || addr.String() != c.addr {
+				t.Fatalf("wrong address: want %s, got %v", c.addr, addr)
+			}
+
+			// Data after the header is preserved.
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != "EHLO mx.example.org\r\n" {
+				t.Fatalf("wrong data after the header: %q", rest)
+			}
+		})
+	}
+}
+
+func TestHasSignature(t *testing.T) {
+	if !hasSignature([]byte("PROXY TCP4 ")) || !hasSignature(v2Signature) {
+		t.Error("header is not detected")
+	}
+	if hasSignature([]byte("EHLO mx.example.org\r\n")) {
+		t.Error("false positive")
+	}
+}
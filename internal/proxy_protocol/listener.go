@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package proxy_protocol
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// ProxyProtocol is the configuration of the PROXY protocol support for
+// endpoint listeners.
+type ProxyProtocol struct {
+	// Networks the PROXY protocol header is accepted from.
+	trust []net.IPNet
+	// Drop connections from trusted networks that do not send the header.
+	require       bool
+	headerTimeout time.Duration
+}
+
+// ProxyProtocolDirective parses the proxy_protocol configuration directive:
+//
+//	proxy_protocol [trusted networks...] {
+//	    trust <networks...>
+//	    require <bool>
+//	    header_timeout <duration>
+//	}
+func ProxyProtocolDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	pp := &ProxyProtocol{}
+	var trust []string
+
+	cfg := config.NewMap(nil, node)
+	cfg.StringList("trust", false, false, nil, &trust)
+	cfg.Bool("require", false, true, &pp.require)
+	cfg.Duration("header_timeout", false, false, 5*time.Second, &pp.headerTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	trust = append(append([]string(nil), node.Args...), trust...)
+	if len(trust) == 0 {
+		return nil, config.NodeErr(node, "at least one trusted network is required")
+	}
+	var err error
+	pp.trust, err = config.ParseCIDRs(trust)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	if pp.headerTimeout == 0 {
+		return nil, config.NodeErr(node, "header_timeout should be positive")
+	}
+
+	return pp, nil
+}
+
+func (pp *ProxyProtocol) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets can be used only by local processes.
+		return true
+	}
+	for _, ipNet := range pp.trust {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener reads the PROXY protocol header from connections accepted from
+// trusted networks and hands them over with the remote address replaced by
+// the address of the original client.
+//
+// Headers are read in separate goroutines so slow clients do not block
+// accepting other connections.
+type listener struct {
+	net.Listener
+	pp  *ProxyProtocol
+	log log.Logger
+
+	ready     chan net.Conn
+	acceptErr chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener wraps the listener l to process the PROXY protocol header
+// according to the configuration.
+func NewListener(l net.Listener, pp *ProxyProtocol, logger log.Logger) net.Listener {
+	pl := &listener{
+		Listener:  l,
+		pp:        pp,
+		log:       logger,
+		ready:     make(chan net.Conn),
+		acceptErr: make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (pl *listener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			pl.acceptErr <- err
+			return
+		}
+		go pl.handle(conn)
+	}
+}
+
+func (pl *listener) handle(conn net.Conn) {
+	if !pl.pp.trusted(conn.RemoteAddr()) {
+		pl.handOver(&untrustedConn{Conn: conn, log: pl.log})
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(pl.pp.headerTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	r := bufio.NewReader(conn)
+	addr, err := readHeader(r)
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		var netErr net.Error
+		noHeader := errors.Is(err, errNoHeader) || (errors.As(err, &netErr) && netErr.Timeout())
+		if noHeader && !pl.pp.require {
+			// Direct connection from the trusted network, data read while
+			// looking for the header is replayed.
+			pl.handOver(&proxiedConn{Conn: conn, r: r})
+			return
+		}
+
+		pl.log.Error("dropping connection without valid PROXY protocol header", err, "src_ip", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	pl.handOver(&proxiedConn{Conn: conn, r: r, remoteAddr: addr})
+}
+
+func (pl *listener) handOver(conn net.Conn) {
+	select {
+	case pl.ready <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.ready:
+		return conn, nil
+	case err := <-pl.acceptErr:
+		return nil, err
+	}
+}
+
+func (pl *listener) Close() error {
+	pl.closeOnce.Do(func() {
+		close(pl.done)
+	})
+	return pl.Listener.Close()
+}
+
+// proxiedConn is the connection with the remote address taken from the PROXY
+// protocol header.
+type proxiedConn struct {
+	net.Conn
+	r *bufio.Reader
+	// nil if the address of the connection should be used.
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// untrustedConn is the connection from the network that is not trusted to
+// send the PROXY protocol header. The connection is dropped if the header is
+// received anyway.
+//
+// Since the server talks first in protocols we use, the header is checked
+// when the data is read instead of delaying the greeting.
+type untrustedConn struct {
+	net.Conn
+	log     log.Logger
+	checked bool
+}
+
+func (c *untrustedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.checked && n != 0 {
+		c.checked = true
+		if hasSignature(b[:n]) {
+			c.log.Msg("dropping connection with PROXY protocol header from untrusted source", "src_ip", c.Conn.RemoteAddr())
+			c.Conn.Close()
+			return 0, errors.New("proxy_protocol: header from untrusted source")
+		}
+	}
+	return n, err
+}
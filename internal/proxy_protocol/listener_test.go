@@ -0,0 +1,173 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package proxy_protocol
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testListener(t *testing.T, require bool, trust ...string) net.Listener {
+	t.Helper()
+
+	requireStr := "no"
+	if require {
+		requireStr = "yes"
+	}
+	pp, err := ProxyProtocolDirective(nil, config.Node{
+		Name: "proxy_protocol",
+		Args: trust,
+		Children: []config.Node{
+			{Name: "require", Args: []string{requireStr}},
+			{Name: "header_timeout", Args: []string{"200ms"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewListener(l, pp.(*ProxyProtocol), testutils.Logger(t, "proxy_protocol"))
+}
+
+func acceptTimeout(t *testing.T, l net.Listener, timeout time.Duration) net.Conn {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestListener_Trusted(t *testing.T) {
+	l := testListener(t, true, "127.0.0.0/8")
+	defer l.Close()
+
+	cl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if _, err := cl.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\nhello")); err != nil {
+		t.Fatal(err)
+	}
+	cl.(*net.TCPConn).CloseWrite()
+
+	conn := acceptTimeout(t, l, 5*time.Second)
+	if conn == nil {
+		t.Fatal("connection is not accepted")
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Fatal("wrong remote address:", conn.RemoteAddr())
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("wrong data after the header: %q", data)
+	}
+}
+
+func TestListener_TrustedNoHeader(t *testing.T) {
+	l := testListener(t, true, "127.0.0.1")
+	defer l.Close()
+
+	cl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if conn := acceptTimeout(t, l, time.Second); conn != nil {
+		conn.Close()
+		t.Fatal("connection without the header is accepted")
+	}
+	// Connection is closed by the listener.
+	cl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cl.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestListener_TrustedOptional(t *testing.T) {
+	l := testListener(t, false, "127.0.0.0/8")
+	defer l.Close()
+
+	cl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	conn := acceptTimeout(t, l, 5*time.Second)
+	if conn == nil {
+		t.Fatal("connection is not accepted")
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != cl.LocalAddr().String() {
+		t.Fatal("wrong remote address:", conn.RemoteAddr())
+	}
+}
+
+func TestListener_Untrusted(t *testing.T) {
+	l := testListener(t, true, "192.0.2.0/24")
+	defer l.Close()
+
+	cl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// Untrusted clients are handed over immediately.
+	conn := acceptTimeout(t, l, 5*time.Second)
+	if conn == nil {
+		t.Fatal("connection is not accepted")
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != cl.LocalAddr().String() {
+		t.Fatal("wrong remote address:", conn.RemoteAddr())
+	}
+
+	if _, err := cl.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Fatal("header from the untrusted source is accepted")
+	}
+}
@@ -0,0 +1,440 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  int64
+	line int
+}
+
+// ParseError is returned for syntax and semantic errors in the script.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (err ParseError) Error() string {
+	return fmt.Sprintf("sieve: line %d: %s", err.Line, err.Msg)
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return ParseError{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isIdentChar(ch byte, first bool) bool {
+	switch {
+	case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch == '_':
+		return true
+	case ch >= '0' && ch <= '9':
+		return !first
+	}
+	return false
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch {
+		case ch == '\n':
+			l.line++
+			l.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			l.pos++
+		case ch == '#':
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end == -1 {
+				l.pos = len(l.src)
+			} else {
+				l.pos += end
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end == -1 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	start := l.pos
+	ch := l.src[l.pos]
+	switch {
+	case strings.IndexByte("[](),;{}", ch) != -1:
+		l.pos++
+		return token{kind: tokPunct, text: string(ch), line: l.line}, nil
+	case ch == ':':
+		l.pos++
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos], l.pos == start+1) {
+			l.pos++
+		}
+		if l.pos == start+1 {
+			return token{}, l.errorf("empty tag")
+		}
+		return token{kind: tokTag, text: strings.ToLower(l.src[start+1 : l.pos]), line: l.line}, nil
+	case ch >= '0' && ch <= '9':
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		num, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, l.errorf("malformed number: %v", err)
+		}
+		if l.pos < len(l.src) {
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				num *= 1024
+				l.pos++
+			case 'M', 'm':
+				num *= 1024 * 1024
+				l.pos++
+			case 'G', 'g':
+				num *= 1024 * 1024 * 1024
+				l.pos++
+			}
+		}
+		return token{kind: tokNumber, num: num, line: l.line}, nil
+	case ch == '"':
+		return l.quotedString()
+	case isIdentChar(ch, true):
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos], false) {
+			l.pos++
+		}
+		ident := strings.ToLower(l.src[start:l.pos])
+		if ident == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multilineString()
+		}
+		return token{kind: tokIdent, text: ident, line: l.line}, nil
+	}
+	return token{}, l.errorf("unexpected character: %q", ch)
+}
+
+func (l *lexer) quotedString() (token, error) {
+	line := l.line
+	l.pos++ // opening quote
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch ch {
+		case '"':
+			l.pos++
+			return token{kind: tokString, text: crlf(b.String()), line: line}, nil
+		case '\\':
+			// Only \" and \\ are meaningful, other escapes are
+			// replaced with the character itself (RFC 5228 Section 2.4.2).
+			if l.pos+1 < len(l.src) {
+				l.pos++
+				ch = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(ch)
+		l.pos++
+	}
+	return token{}, ParseError{Line: line, Msg: "unterminated string"}
+}
+
+func (l *lexer) multilineString() (token, error) {
+	line := l.line
+
+	// Rest of the line after "text:" may contain only whitespace and a
+	// comment.
+	end := strings.IndexByte(l.src[l.pos:], '\n')
+	if end == -1 {
+		return token{}, l.errorf("unterminated multi-line string")
+	}
+	rest := strings.TrimSpace(l.src[l.pos : l.pos+end])
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return token{}, l.errorf("unexpected characters after text:")
+	}
+	l.pos += end + 1
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var lineText string
+		if end == -1 {
+			lineText = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			lineText = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+		}
+		l.line++
+		lineText = strings.TrimSuffix(lineText, "\r")
+
+		if lineText == "." {
+			return token{kind: tokString, text: crlf(b.String()), line: line}, nil
+		}
+		// Dot-stuffing.
+		lineText = strings.TrimPrefix(lineText, ".")
+		b.WriteString(lineText)
+		b.WriteString("\n")
+	}
+	return token{}, ParseError{Line: line, Msg: "unterminated multi-line string"}
+}
+
+// crlf normalizes line endings in the string to CRLF.
+func crlf(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// Generic syntax tree, see RFC 5228 Section 8.
+
+type argument struct {
+	tag  string
+	num  int64
+	strs []string
+	kind tokenKind // tokTag, tokNumber or tokString (string list)
+	line int
+}
+
+type testNode struct {
+	name  string
+	args  []argument
+	tests []testNode
+	line  int
+}
+
+type commandNode struct {
+	name  string
+	args  []argument
+	tests []testNode
+	block []commandNode
+	// hasBlock is true if the command is followed by a block, even empty
+	// one.
+	hasBlock bool
+	line     int
+}
+
+type parser struct {
+	l   lexer
+	tok token
+}
+
+func (p *parser) advance() error {
+	var err error
+	p.tok, err = p.l.next()
+	return err
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return ParseError{Line: p.tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q", s)
+	}
+	return p.advance()
+}
+
+func parseTree(src string) ([]commandNode, error) {
+	p := parser{l: lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return cmds, nil
+}
+
+func (p *parser) commands() ([]commandNode, error) {
+	var cmds []commandNode
+	for p.tok.kind == tokIdent {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (commandNode, error) {
+	cmd := commandNode{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return cmd, err
+	}
+
+	var err error
+	cmd.args, cmd.tests, err = p.arguments()
+	if err != nil {
+		return cmd, err
+	}
+
+	switch {
+	case p.isPunct(";"):
+		return cmd, p.advance()
+	case p.isPunct("{"):
+		if err := p.advance(); err != nil {
+			return cmd, err
+		}
+		cmd.hasBlock = true
+		cmd.block, err = p.commands()
+		if err != nil {
+			return cmd, err
+		}
+		return cmd, p.expectPunct("}")
+	default:
+		return cmd, p.errorf("expected ';' or block after %s", cmd.name)
+	}
+}
+
+// arguments parses arguments followed by an optional test or test list.
+func (p *parser) arguments() ([]argument, []testNode, error) {
+	var args []argument
+	for {
+		switch {
+		case p.tok.kind == tokTag:
+			args = append(args, argument{kind: tokTag, tag: p.tok.text, line: p.tok.line})
+		case p.tok.kind == tokNumber:
+			args = append(args, argument{kind: tokNumber, num: p.tok.num, line: p.tok.line})
+		case p.tok.kind == tokString:
+			args = append(args, argument{kind: tokString, strs: []string{p.tok.text}, line: p.tok.line})
+		case p.isPunct("["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, list)
+			continue
+		case p.tok.kind == tokIdent:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []testNode{test}, nil
+		case p.isPunct("("):
+			tests, err := p.testList()
+			return args, tests, err
+		default:
+			return args, nil, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() (argument, error) {
+	list := argument{kind: tokString, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return list, err
+	}
+	for {
+		if p.tok.kind != tokString {
+			return list, p.errorf("expected string in the list")
+		}
+		list.strs = append(list.strs, p.tok.text)
+		if err := p.advance(); err != nil {
+			return list, err
+		}
+		if p.isPunct("]") {
+			return list, p.advance()
+		}
+		if err := p.expectPunct(","); err != nil {
+			return list, err
+		}
+	}
+}
+
+func (p *parser) test() (testNode, error) {
+	test := testNode{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return test, err
+	}
+	var err error
+	test.args, test.tests, err = p.arguments()
+	return test, err
+}
+
+func (p *parser) testList() ([]testNode, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var tests []testNode
+	for {
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected test")
+		}
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.isPunct(")") {
+			return tests, p.advance()
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
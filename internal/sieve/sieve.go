@@ -0,0 +1,694 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements the subset of the Sieve mail filtering language
+// (RFC 5228) used for server-side filtering of delivered messages.
+//
+// Supported commands are require, if/elsif/else, keep, discard, stop,
+// fileinto (RFC 5228 Section 4.1) and redirect. Supported tests are header,
+// address, envelope, exists, size, allof, anyof, not, true and false.
+// Supported extensions are "fileinto", "envelope", "copy" (RFC 3894) and the
+// i;octet and i;ascii-casemap comparators.
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Message is the message the script is evaluated against.
+type Message struct {
+	// Envelope sender, empty for the null return-path.
+	From string
+	// Envelope recipient the script is evaluated for.
+	To string
+
+	Header textproto.Header
+	// Size of the message, including the header.
+	Size int
+}
+
+// Result is the list of actions to take for the message.
+type Result struct {
+	// Keep is true if the message should be stored in the default mailbox,
+	// either because of the explicit keep or because the implicit keep was
+	// not cancelled.
+	Keep bool
+	// Mailboxes to store the message in, in addition to the default one.
+	Fileinto []string
+	// Addresses to redirect the message to.
+	Redirect []string
+}
+
+// Discarded reports whether the message should not be delivered at all.
+func (r Result) Discarded() bool {
+	return !r.Keep && len(r.Fileinto) == 0 && len(r.Redirect) == 0
+}
+
+// ErrTooManyRedirects is returned by Execute if the script tries to redirect
+// the message to more than MaxRedirects addresses.
+var ErrTooManyRedirects = errors.New("sieve: too many redirects")
+
+var supportedExtensions = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"copy":                       true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Script is the parsed Sieve script.
+type Script struct {
+	cmds []command
+
+	// MaxRedirects is the maximum amount of redirect actions the script is
+	// allowed to execute for one message.
+	MaxRedirects int
+}
+
+// Parse parses the script text.
+//
+// ParseError is returned for malformed scripts and scripts using unsupported
+// commands, tests or extensions.
+func Parse(src string) (*Script, error) {
+	tree, err := parseTree(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler{required: map[string]bool{}}
+	cmds, err := c.commands(tree, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds, MaxRedirects: 4}, nil
+}
+
+// Execute evaluates the script for the message.
+func (s *Script) Execute(msg *Message) (Result, error) {
+	st := execState{
+		msg:          msg,
+		implicitKeep: true,
+		maxRedirects: s.MaxRedirects,
+	}
+	if _, err := st.run(s.cmds); err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Keep:     st.keep || st.implicitKeep,
+		Fileinto: st.fileinto,
+		Redirect: st.redirect,
+	}, nil
+}
+
+type (
+	command interface {
+		// exec runs the command, stop is true if the script execution should
+		// stop.
+		exec(st *execState) (stop bool, err error)
+	}
+
+	test interface {
+		eval(st *execState) bool
+	}
+
+	execState struct {
+		msg          *Message
+		implicitKeep bool
+		keep         bool
+		fileinto     []string
+		redirect     []string
+		maxRedirects int
+	}
+)
+
+func (st *execState) run(cmds []command) (bool, error) {
+	for _, cmd := range cmds {
+		stop, err := cmd.exec(st)
+		if err != nil || stop {
+			return stop, err
+		}
+	}
+	return false, nil
+}
+
+// Commands.
+
+type (
+	ifBranch struct {
+		test  test
+		block []command
+	}
+	ifCmd struct {
+		branches []ifBranch
+		// nil test is used for else branch.
+	}
+	keepCmd     struct{}
+	discardCmd  struct{}
+	stopCmd     struct{}
+	fileintoCmd struct {
+		mailbox string
+		copy    bool
+	}
+	redirectCmd struct {
+		addr string
+		copy bool
+	}
+)
+
+func (c ifCmd) exec(st *execState) (bool, error) {
+	for _, b := range c.branches {
+		if b.test == nil || b.test.eval(st) {
+			return st.run(b.block)
+		}
+	}
+	return false, nil
+}
+
+func (keepCmd) exec(st *execState) (bool, error) {
+	st.keep = true
+	return false, nil
+}
+
+func (discardCmd) exec(st *execState) (bool, error) {
+	st.implicitKeep = false
+	return false, nil
+}
+
+func (stopCmd) exec(st *execState) (bool, error) {
+	return true, nil
+}
+
+func (c fileintoCmd) exec(st *execState) (bool, error) {
+	if !c.copy {
+		st.implicitKeep = false
+	}
+	for _, mbox := range st.fileinto {
+		if mbox == c.mailbox {
+			return false, nil
+		}
+	}
+	st.fileinto = append(st.fileinto, c.mailbox)
+	return false, nil
+}
+
+func (c redirectCmd) exec(st *execState) (bool, error) {
+	if !c.copy {
+		st.implicitKeep = false
+	}
+	for _, addr := range st.redirect {
+		if strings.EqualFold(addr, c.addr) {
+			return false, nil
+		}
+	}
+	if len(st.redirect) >= st.maxRedirects {
+		return false, ErrTooManyRedirects
+	}
+	st.redirect = append(st.redirect, c.addr)
+	return false, nil
+}
+
+// Tests.
+
+type (
+	constTest bool
+	notTest   struct{ test test }
+	allofTest []test
+	anyofTest []test
+	sizeTest  struct {
+		over  bool
+		limit int64
+	}
+	existsTest []string
+	headerTest struct {
+		names []string
+		m     matcher
+	}
+	addressTest struct {
+		// Header fields or envelope parts ("from", "to").
+		names    []string
+		envelope bool
+		part     string
+		m        matcher
+	}
+)
+
+func (t constTest) eval(*execState) bool {
+	return bool(t)
+}
+
+func (t notTest) eval(st *execState) bool {
+	return !t.test.eval(st)
+}
+
+func (t allofTest) eval(st *execState) bool {
+	for _, test := range t {
+		if !test.eval(st) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t anyofTest) eval(st *execState) bool {
+	for _, test := range t {
+		if test.eval(st) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t sizeTest) eval(st *execState) bool {
+	if t.over {
+		return int64(st.msg.Size) > t.limit
+	}
+	return int64(st.msg.Size) < t.limit
+}
+
+func (t existsTest) eval(st *execState) bool {
+	for _, name := range t {
+		if !st.msg.Header.Has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: message.CharsetReader}
+
+func headerValues(h textproto.Header, name string) []string {
+	var vals []string
+	fields := h.FieldsByKey(name)
+	for fields.Next() {
+		val, err := wordDecoder.DecodeHeader(fields.Value())
+		if err != nil {
+			val = fields.Value()
+		}
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+func (t headerTest) eval(st *execState) bool {
+	for _, name := range t.names {
+		for _, val := range headerValues(st.msg.Header, name) {
+			if t.m.match(val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addressPart(addr, part string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch part {
+	case "localpart":
+		if at == -1 {
+			return addr
+		}
+		return addr[:at]
+	case "domain":
+		if at == -1 {
+			return ""
+		}
+		return addr[at+1:]
+	default:
+		return addr
+	}
+}
+
+func (t addressTest) eval(st *execState) bool {
+	var addrs []string
+	for _, name := range t.names {
+		if t.envelope {
+			switch name {
+			case "from":
+				addrs = append(addrs, st.msg.From)
+			case "to":
+				addrs = append(addrs, st.msg.To)
+			}
+			continue
+		}
+
+		for _, val := range headerValues(st.msg.Header, name) {
+			list, err := mail.ParseAddressList(val)
+			if err != nil {
+				// Compare the whole value as is, it is better than
+				// ignoring it completely.
+				addrs = append(addrs, strings.TrimSpace(val))
+				continue
+			}
+			for _, addr := range list {
+				addrs = append(addrs, addr.Address)
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		if t.m.match(addressPart(addr, t.part)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matcher implements match types and comparators (RFC 5228 Section 2.7).
+type matcher struct {
+	matchType string // "is", "contains" or "matches"
+	octet     bool
+	keys      []string
+	patterns  []*regexp.Regexp
+}
+
+func (m matcher) match(val string) bool {
+	for i, key := range m.keys {
+		switch m.matchType {
+		case "is":
+			if m.octet && val == key || !m.octet && strings.EqualFold(val, key) {
+				return true
+			}
+		case "contains":
+			if m.octet && strings.Contains(val, key) ||
+				!m.octet && strings.Contains(strings.ToLower(val), strings.ToLower(key)) {
+				return true
+			}
+		case "matches":
+			if m.patterns[i].MatchString(val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globRegexp converts the :matches pattern into the regular expression.
+func globRegexp(pattern string, octet bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	if octet {
+		b.WriteString(`(?s)^`)
+	} else {
+		b.WriteString(`(?is)^`)
+	}
+	escaped := false
+	for _, ch := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '*':
+			b.WriteString(`.*`)
+		case ch == '?':
+			b.WriteString(`.`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.Compile(b.String())
+}
+
+// Compilation of the syntax tree into commands.
+
+type compiler struct {
+	required map[string]bool
+}
+
+func errAt(line int, format string, args ...interface{}) error {
+	return ParseError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) commands(nodes []commandNode, topLevel bool) ([]command, error) {
+	var (
+		cmds           []command
+		lastIf         *ifCmd
+		requireAllowed = topLevel
+	)
+	for _, node := range nodes {
+		if node.name != "require" {
+			requireAllowed = false
+		}
+		if node.name != "elsif" && node.name != "else" {
+			lastIf = nil
+		}
+
+		switch node.name {
+		case "require":
+			if !requireAllowed {
+				return nil, errAt(node.line, "require is allowed only at the beginning of the script")
+			}
+			if len(node.args) != 1 || node.args[0].kind != tokString || node.tests != nil || node.hasBlock {
+				return nil, errAt(node.line, "require: expected a string list")
+			}
+			for _, ext := range node.args[0].strs {
+				if !supportedExtensions[ext] {
+					return nil, errAt(node.line, "unsupported extension: %s", ext)
+				}
+				c.required[ext] = true
+			}
+		case "if", "elsif":
+			if node.name == "elsif" && lastIf == nil {
+				return nil, errAt(node.line, "elsif without if")
+			}
+			if len(node.args) != 0 || len(node.tests) != 1 || !node.hasBlock {
+				return nil, errAt(node.line, "%s: expected a test and a block", node.name)
+			}
+			t, err := c.test(node.tests[0])
+			if err != nil {
+				return nil, err
+			}
+			block, err := c.commands(node.block, false)
+			if err != nil {
+				return nil, err
+			}
+			if node.name == "if" {
+				cmds = append(cmds, &ifCmd{})
+				lastIf = cmds[len(cmds)-1].(*ifCmd)
+			}
+			lastIf.branches = append(lastIf.branches, ifBranch{test: t, block: block})
+		case "else":
+			if lastIf == nil {
+				return nil, errAt(node.line, "else without if")
+			}
+			if len(node.args) != 0 || node.tests != nil || !node.hasBlock {
+				return nil, errAt(node.line, "else: expected a block")
+			}
+			block, err := c.commands(node.block, false)
+			if err != nil {
+				return nil, err
+			}
+			lastIf.branches = append(lastIf.branches, ifBranch{block: block})
+			lastIf = nil
+		case "keep", "discard", "stop":
+			if len(node.args) != 0 || node.tests != nil || node.hasBlock {
+				return nil, errAt(node.line, "%s: no arguments expected", node.name)
+			}
+			switch node.name {
+			case "keep":
+				cmds = append(cmds, keepCmd{})
+			case "discard":
+				cmds = append(cmds, discardCmd{})
+			case "stop":
+				cmds = append(cmds, stopCmd{})
+			}
+		case "fileinto", "redirect":
+			if node.name == "fileinto" && !c.required["fileinto"] {
+				return nil, errAt(node.line, "fileinto used without require")
+			}
+			if node.tests != nil || node.hasBlock {
+				return nil, errAt(node.line, "%s: unexpected test or block", node.name)
+			}
+			copyFlag := false
+			var arg *argument
+			for i, a := range node.args {
+				switch {
+				case a.kind == tokTag && a.tag == "copy":
+					if !c.required["copy"] {
+						return nil, errAt(a.line, ":copy used without require")
+					}
+					copyFlag = true
+				case a.kind == tokString && len(a.strs) == 1 && arg == nil:
+					arg = &node.args[i]
+				default:
+					return nil, errAt(a.line, "%s: unexpected argument", node.name)
+				}
+			}
+			if arg == nil {
+				return nil, errAt(node.line, "%s: expected a string", node.name)
+			}
+			if node.name == "fileinto" {
+				cmds = append(cmds, fileintoCmd{mailbox: arg.strs[0], copy: copyFlag})
+				continue
+			}
+			addr, err := mail.ParseAddress(arg.strs[0])
+			if err != nil {
+				return nil, errAt(node.line, "redirect: malformed address: %v", err)
+			}
+			cmds = append(cmds, redirectCmd{addr: addr.Address, copy: copyFlag})
+		default:
+			return nil, errAt(node.line, "unsupported command: %s", node.name)
+		}
+	}
+	return cmds, nil
+}
+
+func (c *compiler) test(node testNode) (test, error) {
+	switch node.name {
+	case "true", "false":
+		if len(node.args) != 0 || node.tests != nil {
+			return nil, errAt(node.line, "%s: no arguments expected", node.name)
+		}
+		return constTest(node.name == "true"), nil
+	case "not":
+		if len(node.args) != 0 || len(node.tests) != 1 {
+			return nil, errAt(node.line, "not: expected a single test")
+		}
+		t, err := c.test(node.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return notTest{test: t}, nil
+	case "allof", "anyof":
+		if len(node.args) != 0 || len(node.tests) == 0 {
+			return nil, errAt(node.line, "%s: expected a test list", node.name)
+		}
+		tests := make([]test, 0, len(node.tests))
+		for _, tn := range node.tests {
+			t, err := c.test(tn)
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, t)
+		}
+		if node.name == "allof" {
+			return allofTest(tests), nil
+		}
+		return anyofTest(tests), nil
+	case "size":
+		if node.tests != nil || len(node.args) != 2 ||
+			node.args[0].kind != tokTag || node.args[1].kind != tokNumber ||
+			(node.args[0].tag != "over" && node.args[0].tag != "under") {
+			return nil, errAt(node.line, "size: expected :over or :under and a number")
+		}
+		return sizeTest{over: node.args[0].tag == "over", limit: node.args[1].num}, nil
+	case "exists":
+		if node.tests != nil || len(node.args) != 1 || node.args[0].kind != tokString {
+			return nil, errAt(node.line, "exists: expected a string list")
+		}
+		return existsTest(node.args[0].strs), nil
+	case "header", "address", "envelope":
+		return c.matchTest(node)
+	default:
+		return nil, errAt(node.line, "unsupported test: %s", node.name)
+	}
+}
+
+// matchTest compiles header, address and envelope tests which share the
+// argument syntax.
+func (c *compiler) matchTest(node testNode) (test, error) {
+	if node.name == "envelope" && !c.required["envelope"] {
+		return nil, errAt(node.line, "envelope used without require")
+	}
+	if node.tests != nil {
+		return nil, errAt(node.line, "%s: unexpected test", node.name)
+	}
+
+	var (
+		m       = matcher{matchType: "is"}
+		part    = "all"
+		strs    [][]string
+		args    = node.args
+		seenCmp bool
+	)
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a.kind == tokString {
+			strs = append(strs, a.strs)
+			continue
+		}
+		if a.kind != tokTag || len(strs) != 0 {
+			return nil, errAt(a.line, "%s: unexpected argument", node.name)
+		}
+		switch a.tag {
+		case "is", "contains", "matches":
+			m.matchType = a.tag
+		case "all", "localpart", "domain":
+			if node.name == "header" {
+				return nil, errAt(a.line, "header: address part is not allowed")
+			}
+			part = a.tag
+		case "comparator":
+			if seenCmp || i+1 >= len(args) || args[i+1].kind != tokString || len(args[i+1].strs) != 1 {
+				return nil, errAt(a.line, "%s: malformed comparator", node.name)
+			}
+			seenCmp = true
+			i++
+			switch args[i].strs[0] {
+			case "i;octet":
+				m.octet = true
+			case "i;ascii-casemap":
+			default:
+				return nil, errAt(a.line, "unsupported comparator: %s", args[i].strs[0])
+			}
+		default:
+			return nil, errAt(a.line, "%s: unsupported tag :%s", node.name, a.tag)
+		}
+	}
+	if len(strs) != 2 {
+		return nil, errAt(node.line, "%s: expected two string lists", node.name)
+	}
+
+	m.keys = strs[1]
+	if m.matchType == "matches" {
+		for _, key := range m.keys {
+			re, err := globRegexp(key, m.octet)
+			if err != nil {
+				return nil, errAt(node.line, "%s: malformed pattern: %v", node.name, err)
+			}
+			m.patterns = append(m.patterns, re)
+		}
+	}
+
+	switch node.name {
+	case "header":
+		return headerTest{names: strs[0], m: m}, nil
+	case "envelope":
+		for _, name := range strs[0] {
+			if name = strings.ToLower(name); name != "from" && name != "to" {
+				return nil, errAt(node.line, "envelope: unsupported envelope part: %s", name)
+			}
+		}
+		names := make([]string, len(strs[0]))
+		for i, name := range strs[0] {
+			names[i] = strings.ToLower(name)
+		}
+		return addressTest{names: names, envelope: true, part: part, m: m}, nil
+	default:
+		return addressTest{names: strs[0], part: part, m: m}, nil
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testMsg(t *testing.T, hdr string) *Message {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{
+		From:   "sender@example.org",
+		To:     "rcpt@example.com",
+		Header: h,
+		Size:   2048,
+	}
+}
+
+const testHeader = "From: Sender <sender@example.org>\r\n" +
+	"To: a@example.com, B <b@example.net>\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?= [list] weekly\r\n" +
+	"List-Id: <list.example.org>\r\n"
+
+func TestExecute(t *testing.T) {
+	test := func(name, script string, expected Result) {
+		t.Run(name, func(t *testing.T) {
+			s, err := Parse(script)
+			if err != nil {
+				t.Fatal("Parse:", err)
+			}
+			res, err := s.Execute(testMsg(t, testHeader))
+			if err != nil {
+				t.Fatal("Execute:", err)
+			}
+			if !reflect.DeepEqual(res, expected) {
+				t.Errorf("wrong result\nwant %+v\ngot  %+v", expected, res)
+			}
+		})
+	}
+
+	test("empty", ``, Result{Keep: true})
+	test("discard", `discard;`, Result{})
+	test("keep after discard", `discard; keep;`, Result{Keep: true})
+	test("fileinto", `require "fileinto"; fileinto "Lists";`,
+		Result{Fileinto: []string{"Lists"}})
+	test("fileinto :copy", `require ["fileinto", "copy"]; fileinto :copy "Lists";`,
+		Result{Keep: true, Fileinto: []string{"Lists"}})
+	test("fileinto dedup", `require "fileinto"; fileinto "A"; fileinto "A";`,
+		Result{Fileinto: []string{"A"}})
+	test("redirect", `redirect "other@example.org";`,
+		Result{Redirect: []string{"other@example.org"}})
+	test("stop", `stop; discard;`, Result{Keep: true})
+
+	test("header :contains", `
+		require "fileinto";
+		if header :contains "subject" "[LIST]" {
+			fileinto "Lists";
+		}`, Result{Fileinto: []string{"Lists"}})
+	test("header decoded", `if header :matches "Subject" "café*" { discard; }`, Result{})
+	test("header :is octet", `
+		if header :comparator "i;octet" :is "List-Id" "<LIST.example.org>" {
+			discard;
+		}`, Result{Keep: true})
+	test("header missing", `if header :is "X-Missing" "" { discard; }`, Result{Keep: true})
+	test("address :domain", `
+		if address :domain :is "to" "example.net" {
+			discard;
+		}`, Result{})
+	test("address :localpart", `
+		if address :localpart "from" "SENDER" {
+			discard;
+		}`, Result{})
+	test("envelope", `
+		require "envelope";
+		if envelope :domain "to" "example.com" {
+			discard;
+		}`, Result{})
+	test("size", `
+		if size :over 1K { discard; }
+		`, Result{})
+	test("size under", `
+		if size :under 1K { discard; }
+		`, Result{Keep: true})
+	test("elsif else", `
+		require "fileinto";
+		if exists "X-Spam" {
+			fileinto "Junk";
+		} elsif anyof(false, not exists "List-Id") {
+			fileinto "A";
+		} else {
+			fileinto "B";
+		}`, Result{Fileinto: []string{"B"}})
+	test("allof", `if allof(exists ["From", "To"], true) { discard; }`, Result{})
+	test("matches escape", `if header :matches "subject" "*\\[list\\]*" { discard; }`, Result{})
+	test("multiline", `
+		if not header :is "List-Id" text:
+<list.example.org>
+.
+		{ discard; }`, Result{})
+}
+
+func TestExecute_TooManyRedirects(t *testing.T) {
+	s, err := Parse(`redirect "a@example.org"; redirect "b@example.org";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxRedirects = 1
+	if _, err := s.Execute(testMsg(t, testHeader)); err != ErrTooManyRedirects {
+		t.Fatal("expected ErrTooManyRedirects, got", err)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, script := range []string{
+		`keep`,
+		`fileinto "A";`,
+		`require "vacation";`,
+		`keep; require "fileinto";`,
+		`if true { keep; `,
+		`else { keep; }`,
+		`if header :regex "a" "b" { keep; }`,
+		`if envelope "to" "a" { keep; }`,
+		`if size 10 { keep; }`,
+		`redirect "not an address";`,
+		`vacation "text";`,
+		`if header :comparator "i;unicode-casemap" "a" "b" { keep; }`,
+		`"unterminated`,
+	} {
+		_, err := Parse(script)
+		if err == nil {
+			t.Errorf("expected error for %q", script)
+			continue
+		}
+		if _, ok := err.(ParseError); !ok {
+			t.Errorf("expected ParseError for %q, got %T", script, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package smtpconn
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// scriptedServer accepts a single connection, accepts all commands and
+// sends the received command lines to the returned channel when the
+// connection is closed.
+//
+// It is used instead of testutils.SMTPServer since go-smtp does not support
+// the DSN extension.
+func scriptedServer(t *testing.T, addr string, caps ...string) (net.Listener, <-chan []string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linesCh := make(chan []string, 1)
+	go func() {
+		var lines []string
+		defer func() { linesCh <- lines }()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) {
+			if _, err := conn.Write([]byte(s + "\r\n")); err != nil {
+				t.Error(err)
+			}
+		}
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO":
+				reply("250-localhost")
+				for _, ext := range caps {
+					reply("250-" + ext)
+				}
+				reply("250 8BITMIME")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return l, linesCh
+}
+
+func TestDSNForwarding(t *testing.T) {
+	check := func(caps []string, expected []string) {
+		t.Helper()
+
+		l, linesCh := scriptedServer(t, "127.0.0.1:"+testPort, caps...)
+		defer l.Close()
+
+		c := New()
+		c.Log = testutils.Logger(t, "smtpconn")
+		if _, err := c.Connect(context.Background(), config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   testPort,
+		}, false, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		err := c.Mail(context.Background(), "test@example.org", smtp.MailOptions{}, module.DSNOpts{
+			Return: module.DSNReturnHeaders,
+			EnvID:  "QQ 1+=",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Rcpt(context.Background(), "rcpt1@example.invalid", module.DSNRcptOpts{
+			Notify:       []string{module.DSNNotifySuccess, module.DSNNotifyFailure},
+			OriginalRcpt: "rfc822;rcpt1+alias@example.invalid",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcptErrs, err := c.RcptPipelined(context.Background(), []string{"rcpt2@example.invalid", "rcpt3@example.invalid"},
+			[]module.DSNRcptOpts{{Notify: []string{module.DSNNotifyNever}}, {}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, err := range rcptErrs {
+			if err != nil {
+				t.Errorf("Recipient %d: %v", i, err)
+			}
+		}
+		c.Close()
+
+		lines := <-linesCh
+		var got []string
+		for _, line := range lines {
+			if strings.HasPrefix(line, "MAIL") || strings.HasPrefix(line, "RCPT") {
+				got = append(got, line)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Wrong commands sent:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+		}
+	}
+
+	check([]string{"DSN", "PIPELINING"}, []string{
+		"MAIL FROM:<test@example.org> BODY=8BITMIME RET=HDRS ENVID=QQ+201+2B+3D",
+		"RCPT TO:<rcpt1@example.invalid> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;rcpt1+2Balias@example.invalid",
+		"RCPT TO:<rcpt2@example.invalid> NOTIFY=NEVER",
+		"RCPT TO:<rcpt3@example.invalid>",
+	})
+	check([]string{"DSN"}, []string{
+		"MAIL FROM:<test@example.org> BODY=8BITMIME RET=HDRS ENVID=QQ+201+2B+3D",
+		"RCPT TO:<rcpt1@example.invalid> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;rcpt1+2Balias@example.invalid",
+		"RCPT TO:<rcpt2@example.invalid> NOTIFY=NEVER",
+		"RCPT TO:<rcpt3@example.invalid>",
+	})
+	// Parameters are not sent if DSN is not supported.
+	check(nil, []string{
+		"MAIL FROM:<test@example.org> BODY=8BITMIME",
+		"RCPT TO:<rcpt1@example.invalid>",
+		"RCPT TO:<rcpt2@example.invalid>",
+		"RCPT TO:<rcpt3@example.invalid>",
+	})
+}
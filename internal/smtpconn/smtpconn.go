@@ -25,15 +25,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // - Wrapping of returned errors using the exterrors package.
 // - SMTPUTF8/IDNA support.
 // - TLS support mode (don't use, attempt, require).
+// - LIMITS (RFC 9422) parsing.
 package smtpconn
 
 import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	nettextproto "net/textproto"
 	"runtime/trace"
+	"strconv"
+	"strings"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -41,6 +46,7 @@ import (
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
 )
 
 // The C object represents the SMTP connection and is a wrapper around
@@ -67,8 +73,14 @@ type C struct {
 	AddrInSMTPMsg bool
 
 	serverName string
+	remoteAddr string
+	localAddr  string
 	cl         *smtp.Client
 	rcpts      []string
+
+	// SMTPUTF8 was requested for the current transaction but is not
+	// supported by the server.
+	utf8Downgraded bool
 }
 
 // New creates the new instance of the C object, populating the required fields
@@ -81,7 +93,11 @@ func New() *C {
 	}
 }
 
-func (c *C) wrapClientErr(err error, serverName string) error {
+// wrapClientErr converts the error returned by go-smtp into
+// exterrors.SMTPError. phase is the stage of the SMTP session the error
+// happened at (connect, mail, rcpt, data), it is included in the error fields
+// together with the exact server response (if any) for diagnostic purposes.
+func (c *C) wrapClientErr(err error, serverName, phase string) error {
 	if err == nil {
 		return nil
 	}
@@ -103,20 +119,27 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 			c.Log.Msg("SMTP code 552 rewritten to 452 per RFC 5321 Section 4.5.3.1.10")
 		}
 
+		misc := map[string]interface{}{
+			"remote_server":   serverName,
+			"smtp_phase":      phase,
+			"remote_response": fmt.Sprintf("%d %d.%d.%d %s", err.Code, err.EnhancedCode[0], err.EnhancedCode[1], err.EnhancedCode[2], err.Message),
+		}
+		if c.remoteAddr != "" {
+			misc["remote_addr"] = c.remoteAddr
+		}
 		return &exterrors.SMTPError{
 			Code:         err.Code,
 			EnhancedCode: exterrors.EnhancedCode(err.EnhancedCode),
 			Message:      msg,
-			Misc: map[string]interface{}{
-				"remote_server": serverName,
-			},
-			Err: err,
+			Misc:         misc,
+			Err:          err,
 		}
 	case *net.OpError:
 		if _, ok := err.Err.(*net.DNSError); ok {
 			reason, misc := exterrors.UnwrapDNSErr(err)
 			misc["remote_server"] = err.Addr
 			misc["io_op"] = err.Op
+			misc["smtp_phase"] = phase
 			return &exterrors.SMTPError{
 				Code:         exterrors.SMTPCode(err, 450, 550),
 				EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 4, 4}),
@@ -132,13 +155,16 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 			Message:      "Network I/O error",
 			Err:          err,
 			Misc: map[string]interface{}{
-				"remote_addr": err.Addr,
-				"io_op":       err.Op,
+				"remote_server": serverName,
+				"remote_addr":   err.Addr,
+				"io_op":         err.Op,
+				"smtp_phase":    phase,
 			},
 		}
 	default:
 		return exterrors.WithFields(err, map[string]interface{}{
 			"remote_server": serverName,
+			"smtp_phase":    phase,
 		})
 	}
 }
@@ -148,7 +174,7 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 func (c *C) Connect(ctx context.Context, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, err error) {
 	didTLS, cl, err := c.attemptConnect(ctx, false, endp, starttls, tlsConfig)
 	if err != nil {
-		return false, c.wrapClientErr(err, endp.Host)
+		return false, c.wrapClientErr(err, endp.Host, "connect")
 	}
 
 	c.serverName = endp.Host
@@ -161,7 +187,7 @@ func (c *C) Connect(ctx context.Context, endp config.Endpoint, starttls bool, tl
 func (c *C) ConnectLMTP(ctx context.Context, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, err error) {
 	didTLS, cl, err := c.attemptConnect(ctx, true, endp, starttls, tlsConfig)
 	if err != nil {
-		return false, c.wrapClientErr(err, endp.Host)
+		return false, c.wrapClientErr(err, endp.Host, "connect")
 	}
 
 	c.serverName = endp.Host
@@ -192,6 +218,12 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 	if err != nil {
 		return false, nil, err
 	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		c.remoteAddr = addr.String()
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		c.localAddr = addr.String()
+	}
 
 	if endp.IsTLS() {
 		cfg := tlsConfig.Clone()
@@ -246,7 +278,11 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 // SMTPUTF8 is forwarded if supported by the remote server, if it is not
 // supported - attempt will be done to convert addresses to the ASCII form, if
 // this is not possible, the corresponding method (Mail or Rcpt) will fail.
-func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error {
+//
+// RET and ENVID parameters from dsn are forwarded if the remote server
+// supports the DSN extension (RFC 3461). Recipient parameters are passed to
+// Rcpt.
+func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions, dsn module.DSNOpts) error {
 	defer trace.StartRegion(ctx, "smtpconn/MAIL FROM").End()
 
 	outOpts := smtp.MailOptions{
@@ -262,10 +298,12 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 
 	// There is no way we can accept a message with non-ASCII addresses without SMTPUTF8
 	// this is enforced by endpoint/smtp.
+	c.utf8Downgraded = false
 	if opts.UTF8 {
 		if ok, _ := c.cl.Extension("SMTPUTF8"); ok {
 			outOpts.UTF8 = true
 		} else {
+			c.utf8Downgraded = true
 			var err error
 			from, err = address.ToASCII(from)
 			if err != nil {
@@ -282,40 +320,201 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 		}
 	}
 
-	if err := c.cl.Mail(from, &outOpts); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+	// go-smtp fails with a generic error in this case, report it in a way
+	// that makes sense for the DSN. The error is temporary since the
+	// destination may start supporting REQUIRETLS before the message
+	// expires.
+	if outOpts.RequireTLS {
+		if ok, _ := c.cl.Extension("REQUIRETLS"); !ok {
+			return &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 30},
+				Message:      "REQUIRETLS is not supported by the server",
+				Misc: map[string]interface{}{
+					"remote_server": c.serverName,
+				},
+			}
+		}
+	}
+
+	if err := c.mail(from, outOpts, c.dsnMailParams(dsn)); err != nil {
+		return c.wrapClientErr(err, c.serverName, "mail")
 	}
+	c.rcpts = nil
 
 	c.Log.DebugMsg("connected", "remote_server", c.serverName)
 	return nil
 }
 
-// Rcpts returns the list of recipients that were accepted by the remote server.
+// mail sends the MAIL FROM command with additional parameters that are not
+// supported by go-smtp.
+func (c *C) mail(from string, opts smtp.MailOptions, params string) error {
+	if params == "" {
+		return c.cl.Mail(from, &opts)
+	}
+
+	// Parameters known to go-smtp are added the same way as by
+	// smtp.Client.Mail. Support for REQUIRETLS and SMTPUTF8 is checked by
+	// Mail.
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.cl.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.cl.Extension("SIZE"); ok && opts.Size != 0 {
+		cmd += " SIZE=" + strconv.Itoa(opts.Size)
+	}
+	if opts.RequireTLS {
+		cmd += " REQUIRETLS"
+	}
+	if opts.UTF8 {
+		cmd += " SMTPUTF8"
+	}
+
+	id, err := c.cl.Text.Cmd(cmd+"%s", from, params)
+	if err != nil {
+		return err
+	}
+	c.cl.Text.StartResponse(id)
+	defer c.cl.Text.EndResponse(id)
+	return c.readResponse(250)
+}
+
+// dsnMailParams returns the DSN parameters to add to the MAIL FROM command.
+func (c *C) dsnMailParams(dsn module.DSNOpts) string {
+	if ok, _ := c.cl.Extension("DSN"); !ok {
+		return ""
+	}
+
+	var params string
+	if dsn.Return != "" {
+		params += " RET=" + dsn.Return
+	}
+	if dsn.EnvID != "" {
+		params += " ENVID=" + encodeXtext(dsn.EnvID)
+	}
+	return params
+}
+
+// dsnRcptParams returns the DSN parameters to add to the RCPT TO command.
+func (c *C) dsnRcptParams(dsn module.DSNRcptOpts) string {
+	if ok, _ := c.cl.Extension("DSN"); !ok {
+		return ""
+	}
+
+	var params string
+	if len(dsn.Notify) != 0 {
+		params += " NOTIFY=" + strings.Join(dsn.Notify, ",")
+	}
+	if dsn.OriginalRcpt != "" {
+		// addr-type is not encoded.
+		parts := strings.SplitN(dsn.OriginalRcpt, ";", 2)
+		if len(parts) == 2 {
+			params += " ORCPT=" + parts[0] + ";" + encodeXtext(parts[1])
+		}
+	}
+	return params
+}
+
+// encodeXtext encodes the string using the xtext encoding defined in RFC 3461
+// Section 4.
+func encodeXtext(s string) string {
+	b := strings.Builder{}
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+// Rcpts returns the list of recipients that were accepted by the remote server
+// in the current transaction.
 func (c *C) Rcpts() []string {
 	return c.rcpts
 }
 
+// Limits contains the limits advertised by the server using the LIMITS
+// extension (RFC 9422). Zero values mean there is no limit.
+type Limits struct {
+	// Max. amount of recipients per transaction (RCPTMAX).
+	RcptMax int
+	// Max. amount of transactions per connection (MAILMAX).
+	MailMax int
+	// Max. amount of distinct recipient domains per transaction
+	// (RCPTDOMAINMAX).
+	RcptDomainMax int
+}
+
+// Limits returns the limits advertised by the server.
+//
+// Malformed and unknown limits are ignored as required by RFC 9422.
+func (c *C) Limits() Limits {
+	var l Limits
+	if c.cl == nil {
+		return l
+	}
+	ok, params := c.cl.Extension("LIMITS")
+	if !ok {
+		return l
+	}
+
+	for _, param := range strings.Fields(params) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		val, err := strconv.Atoi(parts[1])
+		if err != nil || val <= 0 {
+			continue
+		}
+		switch strings.ToUpper(parts[0]) {
+		case "RCPTMAX":
+			l.RcptMax = val
+		case "MAILMAX":
+			l.MailMax = val
+		case "RCPTDOMAINMAX":
+			l.RcptDomainMax = val
+		}
+	}
+	return l
+}
+
 func (c *C) ServerName() string {
 	return c.serverName
 }
 
+// RemoteAddr returns the network address of the server, as reported by the
+// connection returned by Dialer.
+func (c *C) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// LocalAddr returns the local network address of the connection, as reported
+// by the connection returned by Dialer.
+func (c *C) LocalAddr() string {
+	return c.localAddr
+}
+
 func (c *C) Client() *smtp.Client {
 	return c.cl
 }
 
-// Rcpt sends the RCPT TO command to the remote server.
-//
-// If the address is non-ASCII and cannot be converted to ASCII and the remote
-// server does not support SMTPUTF8, error will be returned.
-func (c *C) Rcpt(ctx context.Context, to string) error {
-	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
-
+// rcptAddr converts the recipient address to the form that can be sent to
+// the server.
+func (c *C) rcptAddr(to string) (string, error) {
 	// If necessary, the extension flag is enabled in Start.
 	if ok, _ := c.cl.Extension("SMTPUTF8"); !address.IsASCII(to) && !ok {
 		var err error
 		to, err = address.ToASCII(to)
 		if err != nil {
-			return &exterrors.SMTPError{
+			return "", &exterrors.SMTPError{
 				Code:         553,
 				EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
 				Message:      "SMTPUTF8 is unsupported, cannot convert recipient address",
@@ -326,9 +525,51 @@ func (c *C) Rcpt(ctx context.Context, to string) error {
 			}
 		}
 	}
+	return to, nil
+}
 
-	if err := c.cl.Rcpt(to); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+// checkDowngrade checks whether the message can be sent without SMTPUTF8 if
+// it is not supported by the server. Envelope addresses are converted by
+// Mail and Rcpt, here only the header is checked.
+func (c *C) checkDowngrade(hdr textproto.Header) error {
+	if !c.utf8Downgraded {
+		return nil
+	}
+
+	for f := hdr.Fields(); f.Next(); {
+		if address.IsASCII(f.Value()) {
+			continue
+		}
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 9},
+			Message:      "SMTPUTF8 is unsupported, cannot transmit non-ASCII header fields",
+			Misc: map[string]interface{}{
+				"remote_server": c.serverName,
+				"field":         f.Key(),
+			},
+		}
+	}
+	return nil
+}
+
+// Rcpt sends the RCPT TO command to the remote server.
+//
+// If the address is non-ASCII and cannot be converted to ASCII and the remote
+// server does not support SMTPUTF8, error will be returned.
+//
+// NOTIFY and ORCPT parameters from dsn are forwarded if the remote server
+// supports the DSN extension (RFC 3461).
+func (c *C) Rcpt(ctx context.Context, to string, dsn module.DSNRcptOpts) error {
+	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
+
+	to, err := c.rcptAddr(to)
+	if err != nil {
+		return err
+	}
+
+	if err := c.rcpt(to, c.dsnRcptParams(dsn)); err != nil {
+		return c.wrapClientErr(err, c.serverName, "rcpt")
 	}
 
 	c.rcpts = append(c.rcpts, to)
@@ -336,52 +577,222 @@ func (c *C) Rcpt(ctx context.Context, to string) error {
 	return nil
 }
 
+// rcpt sends the RCPT TO command with additional parameters that are not
+// supported by go-smtp.
+func (c *C) rcpt(to, params string) error {
+	if params == "" {
+		return c.cl.Rcpt(to)
+	}
+
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	id, err := c.cl.Text.Cmd("RCPT TO:<%s>%s", to, params)
+	if err != nil {
+		return err
+	}
+	c.cl.Text.StartResponse(id)
+	defer c.cl.Text.EndResponse(id)
+	return c.readResponse(25)
+}
+
+// toSMTPErr converts the negative server reply into smtp.SMTPError, parsing
+// the enhanced status code if it is present.
+func toSMTPErr(protoErr *nettextproto.Error) *smtp.SMTPError {
+	smtpErr := &smtp.SMTPError{
+		Code:    protoErr.Code,
+		Message: protoErr.Msg,
+	}
+
+	parts := strings.SplitN(protoErr.Msg, " ", 2)
+	if len(parts) != 2 {
+		return smtpErr
+	}
+	enchCode, err := parseEnhancedCode(parts[0])
+	if err != nil {
+		return smtpErr
+	}
+	smtpErr.EnhancedCode = enchCode
+	smtpErr.Message = parts[1]
+	return smtpErr
+}
+
+func parseEnhancedCode(s string) (smtp.EnhancedCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, errors.New("wrong amount of enhanced code parts")
+	}
+
+	code := smtp.EnhancedCode{}
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return code, err
+		}
+		code[i] = num
+	}
+	return code, nil
+}
+
+// readResponse reads the server reply and converts negative replies into
+// smtp.SMTPError.
+func (c *C) readResponse(expectCode int) error {
+	_, _, err := c.cl.Text.ReadResponse(expectCode)
+	if protoErr, ok := err.(*nettextproto.Error); ok {
+		return toSMTPErr(protoErr)
+	}
+	return err
+}
+
+// RcptPipelined sends RCPT TO commands for all recipients at once without
+// waiting for replies if the server supports PIPELINING (RFC 2920). Otherwise,
+// commands are sent one by one.
+//
+// dsn contains the DSN parameters for the corresponding recipients in to, it
+// can be nil.
+//
+// Returned slice contains the error for each recipient (nil if it is
+// accepted). err is returned if the connection is broken and can't be used
+// anymore.
+func (c *C) RcptPipelined(ctx context.Context, to []string, dsn []module.DSNRcptOpts) (rcptErrs []error, err error) {
+	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
+
+	rcptErrs = make([]error, len(to))
+	rcptDSN := func(i int) module.DSNRcptOpts {
+		if dsn == nil {
+			return module.DSNRcptOpts{}
+		}
+		return dsn[i]
+	}
+
+	if ok, _ := c.cl.Extension("PIPELINING"); !ok {
+		for i, rcpt := range to {
+			rcptErrs[i] = c.Rcpt(ctx, rcpt, rcptDSN(i))
+		}
+		return rcptErrs, nil
+	}
+
+	var (
+		sent []int
+		ids  []uint
+		addr = make([]string, len(to))
+	)
+	for i, rcpt := range to {
+		addr[i], rcptErrs[i] = c.rcptAddr(rcpt)
+		if rcptErrs[i] != nil {
+			continue
+		}
+		if strings.ContainsAny(addr[i], "\r\n") {
+			rcptErrs[i] = c.wrapClientErr(errors.New("smtp: A line must not contain CR or LF"), c.serverName, "rcpt")
+			continue
+		}
+
+		id, err := c.cl.Text.Cmd("RCPT TO:<%s>%s", addr[i], c.dsnRcptParams(rcptDSN(i)))
+		if err != nil {
+			return nil, c.wrapClientErr(err, c.serverName, "rcpt")
+		}
+		sent = append(sent, i)
+		ids = append(ids, id)
+	}
+
+	for j, i := range sent {
+		c.cl.Text.StartResponse(ids[j])
+		err := c.readResponse(25)
+		c.cl.Text.EndResponse(ids[j])
+		if err != nil {
+			if _, ok := err.(*smtp.SMTPError); !ok {
+				return nil, c.wrapClientErr(err, c.serverName, "rcpt")
+			}
+			rcptErrs[i] = c.wrapClientErr(err, c.serverName, "rcpt")
+			continue
+		}
+		c.rcpts = append(c.rcpts, addr[i])
+	}
+
+	return rcptErrs, nil
+}
+
 // Data sends the DATA command to the remote server and then sends the message header
 // and body.
 //
 // If the Data command fails, the connection may be in a unclean state (e.g. in
 // the middle of message data stream). It is not safe to continue using it.
+//
+// If SMTPUTF8 was used for the transaction but is not supported by the
+// server, messages with non-ASCII header fields are rejected since they
+// can't be converted without invalidating signatures.
 func (c *C) Data(ctx context.Context, hdr textproto.Header, body io.Reader) error {
 	defer trace.StartRegion(ctx, "smtpconn/DATA").End()
 
+	if err := c.checkDowngrade(hdr); err != nil {
+		return err
+	}
+
 	wc, err := c.cl.Data()
 	if err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
 
 	if err := textproto.WriteHeader(wc, hdr); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
 
 	if _, err := io.Copy(wc, body); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
 
 	if err := wc.Close(); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
 
 	return nil
 }
 
+// LMTPData is the LMTP version of the Data method. statusCb is called for
+// each recipient returned by Rcpts in the same order with the reply received
+// for it.
 func (c *C) LMTPData(ctx context.Context, hdr textproto.Header, body io.Reader, statusCb func(string, *smtp.SMTPError)) error {
 	defer trace.StartRegion(ctx, "smtpconn/LMTPDATA").End()
 
-	wc, err := c.cl.LMTPData(statusCb)
+	if err := c.checkDowngrade(hdr); err != nil {
+		return err
+	}
+
+	// go-smtp Client is not used here since it does not know about
+	// recipients added using RcptPipelined.
+	id, err := c.cl.Text.Cmd("DATA")
+	if err != nil {
+		return c.wrapClientErr(err, c.serverName, "data")
+	}
+	c.cl.Text.StartResponse(id)
+	err = c.readResponse(354)
+	c.cl.Text.EndResponse(id)
 	if err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
 
+	wc := c.cl.Text.DotWriter()
 	if err := textproto.WriteHeader(wc, hdr); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
-
 	if _, err := io.Copy(wc, body); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
 	}
-
 	if err := wc.Close(); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+		return c.wrapClientErr(err, c.serverName, "data")
+	}
+
+	for _, rcpt := range c.rcpts {
+		err := c.readResponse(250)
+		if err != nil {
+			smtpErr, ok := err.(*smtp.SMTPError)
+			if !ok {
+				return c.wrapClientErr(err, c.serverName, "data")
+			}
+			statusCb(rcpt, smtpErr)
+			continue
+		}
+		statusCb(rcpt, nil)
 	}
 
 	return nil
@@ -399,7 +810,7 @@ func (c *C) Noop() error {
 // connection.
 func (c *C) Close() error {
 	if err := c.cl.Quit(); err != nil {
-		c.Log.Error("QUIT error", c.wrapClientErr(err, c.serverName))
+		c.Log.Error("QUIT error", c.wrapClientErr(err, c.serverName, "quit"))
 		return c.cl.Close()
 	}
 
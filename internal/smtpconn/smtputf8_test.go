@@ -27,17 +27,18 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
 func doTestDelivery(t *testing.T, conn *C, from string, to []string, opts smtp.MailOptions) error {
 	t.Helper()
 
-	if err := conn.Mail(context.Background(), from, opts); err != nil {
+	if err := conn.Mail(context.Background(), from, opts, module.DSNOpts{}); err != nil {
 		return err
 	}
 	for _, rcpt := range to {
-		if err := conn.Rcpt(context.Background(), rcpt); err != nil {
+		if err := conn.Rcpt(context.Background(), rcpt, module.DSNRcptOpts{}); err != nil {
 			return err
 		}
 	}
@@ -167,3 +168,58 @@ func TestSMTPUTF8(t *testing.T) {
 		expectUTF8:   true,
 	})
 }
+
+func TestSMTPUTF8_Header(t *testing.T) {
+	check := func(subject string, expectErr bool) {
+		t.Helper()
+
+		be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+		defer srv.Close()
+		defer testutils.CheckSMTPConnLeak(t, srv)
+
+		c := New()
+		c.Log = testutils.Logger(t, "target.smtp")
+		if _, err := c.Connect(context.Background(), config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   testPort,
+		}, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err := c.Mail(context.Background(), "test@тест.example.org", smtp.MailOptions{UTF8: true}, module.DSNOpts{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt(context.Background(), "test@example.invalid", module.DSNRcptOpts{}); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := textproto.Header{}
+		hdr.Add("Subject", subject)
+		err := c.Data(context.Background(), hdr, strings.NewReader("foobar\n"))
+		if expectErr {
+			testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 6, 9},
+				"SMTPUTF8 is unsupported, cannot transmit non-ASCII header fields")
+			if len(be.Messages) != 0 {
+				t.Error("Message is sent")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(be.Messages) != 1 {
+			t.Fatal("Expected a message, got", len(be.Messages))
+		}
+		if be.Messages[0].From != "test@xn--e1aybc.example.org" {
+			t.Error("Wrong MAIL FROM:", be.Messages[0].From)
+		}
+		if be.Messages[0].Opts.UTF8 {
+			t.Error("SMTPUTF8 is used")
+		}
+	}
+
+	check("Hello", false)
+	check("Привет", true)
+}
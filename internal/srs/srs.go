@@ -0,0 +1,274 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package srs implements the Sender Rewriting Scheme as used by libsrs2 and
+// postsrsd.
+//
+// Rewritten addresses have the following format:
+//
+//	SRS0=HHHH=TT=orig-domain=orig-local-part@srs-domain
+//	SRS1=HHHH=first-srs-domain==HHHH=TT=orig-domain=orig-local-part@srs-domain
+//
+// Where HHHH is the first 4 characters of base64-encoded HMAC-SHA1 of the
+// rest of the address and TT is the day number (days since Unix epoch) modulo
+// 1024 encoded using base32. SRS1 form is used when the address is already
+// rewritten by another forwarder, it is not timestamped since the embedded
+// SRS0 address is.
+package srs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const (
+	srs0Prefix = "SRS0="
+	srs1Prefix = "SRS1="
+
+	hashLen = 4
+
+	timeBase32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timeSlots  = 1024
+)
+
+var (
+	ErrNotSRS    = errors.New("srs: address is not rewritten")
+	ErrMalformed = errors.New("srs: malformed address")
+	ErrExpired   = errors.New("srs: address expired")
+	ErrSignature = errors.New("srs: hash mismatch")
+)
+
+// Rewriter creates and reverses SRS addresses.
+type Rewriter struct {
+	// Domain is used for all rewritten addresses.
+	Domain string
+
+	// Keys are the secrets used to compute the hash. First key is used for
+	// new addresses, all keys are accepted when the address is reversed.
+	// This allows to rotate keys by adding the new key in front of the list
+	// and removing the old one once all addresses created using it expire.
+	Keys [][]byte
+
+	// MaxAge is the amount of time the SRS0 address is considered valid for.
+	// It is rounded up to whole days and must be less than 1024 days.
+	MaxAge time.Duration
+}
+
+// LoadKeys reads keys from the file.
+//
+// Each non-empty line that does not start with '#' is used as a secret, the
+// first one is used for new addresses.
+func LoadKeys(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, []byte(line))
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("srs: no keys in %s", path)
+	}
+	return keys, nil
+}
+
+// NewRewriter loads keys from keysFile and checks the configuration for
+// validity.
+func NewRewriter(domain, keysFile string, maxAge time.Duration) (*Rewriter, error) {
+	if domain == "" {
+		return nil, errors.New("srs: domain is not set")
+	}
+
+	keys, err := LoadKeys(keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxAge <= 0 || maxAge >= timeSlots*24*time.Hour {
+		return nil, errors.New("srs: max age should be between 1 and 1023 days")
+	}
+
+	return &Rewriter{
+		Domain: strings.ToLower(domain),
+		Keys:   keys,
+		MaxAge: maxAge,
+	}, nil
+}
+
+func (r *Rewriter) maxAgeDays() int {
+	days := int((r.MaxAge + 24*time.Hour - 1) / (24 * time.Hour))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+func timestamp(now time.Time) string {
+	day := int(now.Unix()/(24*60*60)) % timeSlots
+	return string([]byte{timeBase32[day>>5], timeBase32[day&31]})
+}
+
+func hash(key []byte, parts ...string) string {
+	mac := hmac.New(sha1.New, key)
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLen]
+}
+
+func (r *Rewriter) checkHash(h string, parts ...string) error {
+	for _, key := range r.Keys {
+		if hmac.Equal([]byte(strings.ToLower(h)), []byte(strings.ToLower(hash(key, parts...)))) {
+			return nil
+		}
+	}
+	return ErrSignature
+}
+
+func (r *Rewriter) checkTimestamp(ts string, now time.Time) error {
+	if len(ts) != 2 {
+		return ErrMalformed
+	}
+	ts = strings.ToUpper(ts)
+	hi := strings.IndexByte(timeBase32, ts[0])
+	lo := strings.IndexByte(timeBase32, ts[1])
+	if hi == -1 || lo == -1 {
+		return ErrMalformed
+	}
+
+	// Day numbers wrap around every 1024 days, so compare the distance
+	// between them instead of the values.
+	today := int(now.Unix()/(24*60*60)) % timeSlots
+	age := (today - (hi<<5 | lo) + timeSlots) % timeSlots
+	if age > r.maxAgeDays() {
+		return ErrExpired
+	}
+	return nil
+}
+
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// IsSRS reports whether the local part of the address has the SRS form. It
+// does not verify the address.
+func IsSRS(addr string) bool {
+	return hasPrefix(addr, srs0Prefix) || hasPrefix(addr, srs1Prefix)
+}
+
+// Forward returns the rewritten version of addr. Null address and addresses
+// already in the rewriter domain are returned unchanged.
+func (r *Rewriter) Forward(addr string, now time.Time) (string, error) {
+	if addr == "" {
+		return addr, nil
+	}
+
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if mbox == "" || domain == "" || strings.HasPrefix(mbox, `"`) {
+		// Quoted local-parts and special addresses (e.g. postmaster) are
+		// left as is.
+		return addr, nil
+	}
+	if strings.EqualFold(domain, r.Domain) {
+		return addr, nil
+	}
+
+	key := r.Keys[0]
+	switch {
+	case hasPrefix(mbox, srs0Prefix):
+		// Address was rewritten by the previous forwarder, wrap it into SRS1
+		// so bounces are sent to it directly.
+		user := mbox[len(srs0Prefix)-1:]
+		return srs1Prefix + hash(key, domain, user) + "=" + domain + "=" + user + "@" + r.Domain, nil
+	case hasPrefix(mbox, srs1Prefix):
+		// Keep the first forwarder domain, just update the hash.
+		parts := strings.SplitN(mbox[len(srs1Prefix):], "=", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "=") {
+			break
+		}
+		user := parts[2]
+		return srs1Prefix + hash(key, parts[1], user) + "=" + parts[1] + "=" + user + "@" + r.Domain, nil
+	}
+
+	ts := timestamp(now)
+	return srs0Prefix + hash(key, ts, domain, mbox) + "=" + ts + "=" + domain + "=" + mbox + "@" + r.Domain, nil
+}
+
+// Reverse verifies the rewritten address and returns the address it was
+// created from.
+//
+// For SRS1 addresses, the result is the SRS0 address of the first forwarder.
+func (r *Rewriter) Reverse(addr string, now time.Time) (string, error) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return addr, ErrMalformed
+	}
+	if !strings.EqualFold(domain, r.Domain) {
+		return addr, ErrNotSRS
+	}
+
+	switch {
+	case hasPrefix(mbox, srs0Prefix):
+		parts := strings.SplitN(mbox[len(srs0Prefix):], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return addr, ErrMalformed
+		}
+		if err := r.checkHash(parts[0], parts[1], parts[2], parts[3]); err != nil {
+			return addr, err
+		}
+		if err := r.checkTimestamp(parts[1], now); err != nil {
+			return addr, err
+		}
+		return parts[3] + "@" + parts[2], nil
+	case hasPrefix(mbox, srs1Prefix):
+		parts := strings.SplitN(mbox[len(srs1Prefix):], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || !strings.HasPrefix(parts[2], "=") {
+			return addr, ErrMalformed
+		}
+		user := parts[2]
+		if err := r.checkHash(parts[0], parts[1], user); err != nil {
+			return addr, err
+		}
+		return "SRS0" + user + "@" + parts[1], nil
+	default:
+		return addr, ErrNotSRS
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package srs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRewriter() *Rewriter {
+	return &Rewriter{
+		Domain: "forwarder.example",
+		Keys: [][]byte{
+			[]byte("new-secret"),
+			[]byte("old-secret"),
+		},
+		MaxAge: 21 * 24 * time.Hour,
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	r := testRewriter()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	fwd, err := r.Forward("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fwd, "SRS0=") || !strings.HasSuffix(fwd, "=example.org=foo@forwarder.example") {
+		t.Fatal("Unexpected rewritten address:", fwd)
+	}
+
+	orig, err := r.Reverse(fwd, now.Add(20*24*time.Hour))
+	if err != nil {
+		t.Fatal("Reverse:", err)
+	}
+	if orig != "foo@example.org" {
+		t.Fatal("Wrong original address:", orig)
+	}
+
+	// Case-folding by remote MTAs should not break the hash.
+	if _, err := r.Reverse(strings.ToLower(fwd), now); err != nil {
+		t.Fatal("Reverse (lowercase):", err)
+	}
+
+	if _, err := r.Reverse(fwd, now.Add(23*24*time.Hour)); err != ErrExpired {
+		t.Fatal("Expected ErrExpired, got", err)
+	}
+
+	forged := strings.Replace(fwd, "=foo@", "=bar@", 1)
+	if _, err := r.Reverse(forged, now); err != ErrSignature {
+		t.Fatal("Expected ErrSignature, got", err)
+	}
+
+	if _, err := r.Reverse("foo@forwarder.example", now); err != ErrNotSRS {
+		t.Fatal("Expected ErrNotSRS, got", err)
+	}
+	if _, err := r.Reverse(fwd[:len(fwd)-len("forwarder.example")]+"example.net", now); err != ErrNotSRS {
+		t.Fatal("Expected ErrNotSRS for foreign domain, got", err)
+	}
+	if _, err := r.Reverse("SRS0=xx=foo@forwarder.example", now); err != ErrMalformed {
+		t.Fatal("Expected ErrMalformed, got", err)
+	}
+
+	if again, _ := r.Forward(fwd, now); again != fwd {
+		t.Fatal("Address in the rewriter domain was rewritten again:", again)
+	}
+	if null, _ := r.Forward("", now); null != "" {
+		t.Fatal("Null address was rewritten:", null)
+	}
+}
+
+func TestRewriter_SRS1(t *testing.T) {
+	first := testRewriter()
+	first.Domain = "first.example"
+	first.Keys = [][]byte{[]byte("first-secret")}
+	second := testRewriter()
+	third := testRewriter()
+	third.Domain = "third.example"
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	srs0, err := first.Forward("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs1, err := second.Forward(srs0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=first.example==") {
+		t.Fatal("Unexpected SRS1 address:", srs1)
+	}
+
+	// Next forwarder keeps the first forwarder domain.
+	srs1Again, err := third.Forward(srs1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(srs1Again, "@third.example") || !strings.Contains(srs1Again, "=first.example==") {
+		t.Fatal("Unexpected SRS1 address:", srs1Again)
+	}
+
+	back, err := third.Reverse(srs1Again, now)
+	if err != nil {
+		t.Fatal("Reverse (third):", err)
+	}
+	if back != srs0 {
+		t.Fatal("Reverse (third) did not return SRS0 address:", back, srs0)
+	}
+	back, err = second.Reverse(srs1, now)
+	if err != nil {
+		t.Fatal("Reverse (second):", err)
+	}
+	if back != srs0 {
+		t.Fatal("Reverse (second) did not return SRS0 address:", back, srs0)
+	}
+
+	orig, err := first.Reverse(back, now)
+	if err != nil {
+		t.Fatal("Reverse (first):", err)
+	}
+	if orig != "foo@example.org" {
+		t.Fatal("Wrong original address:", orig)
+	}
+}
+
+func TestRewriter_KeyRotation(t *testing.T) {
+	r := testRewriter()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	r.Keys = [][]byte{[]byte("old-secret")}
+	oldFwd, err := r.Forward("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Keys = [][]byte{[]byte("new-secret"), []byte("old-secret")}
+	if _, err := r.Reverse(oldFwd, now); err != nil {
+		t.Fatal("Address created using the old key is not accepted:", err)
+	}
+
+	r.Keys = r.Keys[:1]
+	if _, err := r.Reverse(oldFwd, now); err != ErrSignature {
+		t.Fatal("Expected ErrSignature, got", err)
+	}
+}
+
+func TestRewriter_DayWraparound(t *testing.T) {
+	r := testRewriter()
+	// Day 1023, timestamp wraps to 0 on the next day.
+	now := time.Unix(1023*24*60*60, 0)
+
+	fwd, err := r.Forward("foo@example.org", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fwd, "=77=") {
+		t.Fatal("Unexpected timestamp:", fwd)
+	}
+	if _, err := r.Reverse(fwd, now.Add(5*24*time.Hour)); err != nil {
+		t.Fatal("Reverse:", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-srs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte("# comment\nsecret0\n\nsecret1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[0]) != "secret0" || string(keys[1]) != "secret1" {
+		t.Fatal("Wrong keys:", keys)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("# only comment\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeys(path); err == nil {
+		t.Error("No error for empty file")
+	}
+}
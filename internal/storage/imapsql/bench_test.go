@@ -52,9 +52,14 @@ func createTestDB(tb testing.TB, compAlgo string) *Storage {
 	if err != nil {
 		tb.Fatal(err)
 	}
-	return &Storage{
-		Back: db,
+	store := &Storage{
+		Back:   db,
+		driver: testDB,
 	}
+	if err := store.initQuota(); err != nil {
+		tb.Fatal(err)
+	}
+	return store
 }
 
 func BenchmarkStorage_Delivery(b *testing.B) {
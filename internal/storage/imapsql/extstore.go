@@ -0,0 +1,664 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var compressionTime = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "storage",
+		Name:      "compression_seconds",
+		Help:      "CPU time spent compressing message bodies",
+	},
+	[]string{"module"},
+)
+
+var compressionBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "storage",
+		Name:      "compression_bytes",
+		Help:      "Size of compressed message bodies before (in) and after (out) compression",
+	},
+	[]string{"module", "stage"},
+)
+
+// Layouts of the message store, see fsstore_layout directive.
+const (
+	layoutPlain  = "plain"
+	layoutHashed = "hashed"
+)
+
+// Bodies stored using the hashed layout start with blobMagic followed by
+// SHA-256 of the body as it was written by go-imap-sql (before
+// compression). Such files are hard links to the file in the blobs
+// directory named after the hash, so identical bodies are stored only once
+// and the link count tells whether the blob is still used.
+//
+// Files without the header are stored using the plain layout. Both layouts
+// can be present in the same directory and are read transparently.
+const (
+	blobMagic     = "\x00MZB"
+	blobHeaderLen = len(blobMagic) + sha256.Size
+)
+
+const (
+	blobsDir = "blobs"
+	tmpDir   = "tmp"
+)
+
+var (
+	errNotWritable = errors.New("imapsql: message blob is opened for reading")
+	errNotReadable = errors.New("imapsql: message blob is opened for writing")
+	errChecksum    = errors.New("imapsql: message body checksum mismatch, the file is damaged")
+)
+
+// extStore is the imapsql.ExternalStore implementation that keeps message
+// bodies in the filesystem directory, like imapsql.FSStore.
+//
+// Bodies are compressed using buffer.Compression. Unlike compression
+// implemented by go-imap-sql itself, it allows to skip compression for small
+// messages. Blobs are decompressed based on their header so messages stored
+// before compression was enabled (or compressed by go-imap-sql) are read
+// correctly.
+type extStore struct {
+	root     string
+	c        buffer.Compression
+	hashed   bool
+	instName string
+}
+
+func newExtStore(root string, c buffer.Compression, hashed bool, instName string) (*extStore, error) {
+	if hashed && !hardLinks {
+		return nil, errors.New("hashed layout is not supported on this platform")
+	}
+	if err := os.MkdirAll(filepath.Join(root, tmpDir), os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &extStore{
+		root:     root,
+		c:        c,
+		hashed:   hashed,
+		instName: instName,
+	}, nil
+}
+
+func (s *extStore) keyPath(key string) string {
+	return filepath.Join(s.root, key)
+}
+
+func (s *extStore) blobPath(sum []byte) string {
+	name := hex.EncodeToString(sum)
+	return filepath.Join(s.root, blobsDir, name[0:2], name[2:4], name)
+}
+
+func (s *extStore) tempFile(key string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(s.root, tmpDir), key+"-")
+}
+
+type blobWriter struct {
+	s   *extStore
+	key string
+	f   *os.File
+	cw  *buffer.CompressWriter
+	w   io.Writer
+
+	// Hash of the written data, nil for the plain layout.
+	h hash.Hash
+
+	finished bool
+	done     bool
+}
+
+func (s *extStore) newWriter(f *os.File, key string, hashed bool) (*blobWriter, error) {
+	b := &blobWriter{s: s, key: key, f: f, w: f}
+	if hashed {
+		// Placeholder for the header, it is written once the hash is known.
+		if _, err := f.Write(make([]byte, blobHeaderLen)); err != nil {
+			return nil, err
+		}
+		b.h = sha256.New()
+	}
+	if s.c.Enabled() {
+		b.cw = s.c.NewWriter(f)
+		b.w = b.cw
+	}
+	return b, nil
+}
+
+func (s *extStore) Create(key string) (imapsql.ExtStoreObj, error) {
+	// Plain layout bodies are written in place since go-imap-sql may write
+	// the remaining data after Sync (when it compresses them itself). For the
+	// hashed layout, the key is not known before the whole body is written.
+	var (
+		f   *os.File
+		err error
+	)
+	if s.hashed {
+		f, err = s.tempFile(key)
+	} else {
+		f, err = os.Create(s.keyPath(key))
+	}
+	if err != nil {
+		return nil, imapsql.ExternalError{Key: key, Err: err}
+	}
+
+	b, err := s.newWriter(f, key, s.hashed)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, imapsql.ExternalError{Key: key, Err: err}
+	}
+	return b, nil
+}
+
+func (b *blobWriter) Read([]byte) (int, error) {
+	return 0, errNotReadable
+}
+
+func (b *blobWriter) Write(p []byte) (int, error) {
+	if b.done {
+		return 0, errors.New("imapsql: write to committed message blob")
+	}
+	if b.h != nil {
+		b.h.Write(p)
+	}
+	return b.w.Write(p)
+}
+
+// finish flushes the compressed data.
+func (b *blobWriter) finish() error {
+	if b.cw == nil || b.finished {
+		return nil
+	}
+	b.finished = true
+
+	if err := b.cw.Close(); err != nil {
+		return err
+	}
+	if b.cw.Compressed() {
+		in, out, elapsed := b.cw.Stats()
+		compressionTime.WithLabelValues(b.s.instName).Add(elapsed.Seconds())
+		compressionBytes.WithLabelValues(b.s.instName, "in").Add(float64(in))
+		compressionBytes.WithLabelValues(b.s.instName, "out").Add(float64(out))
+	}
+	return nil
+}
+
+// commit stores the blob written using the hashed layout under its key.
+func (b *blobWriter) commit() error {
+	if err := b.finish(); err != nil {
+		return err
+	}
+
+	sum := b.h.Sum(nil)
+	hdr := make([]byte, 0, blobHeaderLen)
+	hdr = append(hdr, blobMagic...)
+	hdr = append(hdr, sum...)
+	if _, err := b.f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	if err := b.f.Sync(); err != nil {
+		return err
+	}
+	if err := b.f.Close(); err != nil {
+		return err
+	}
+	return b.s.link(b.f.Name(), sum, b.key)
+}
+
+// Sync is called by go-imap-sql once the body is written.
+func (b *blobWriter) Sync() error {
+	if b.h == nil {
+		if err := b.finish(); err != nil {
+			return err
+		}
+		return b.f.Sync()
+	}
+
+	if b.done {
+		return nil
+	}
+	b.done = true
+	if err := b.commit(); err != nil {
+		b.f.Close()
+		os.Remove(b.f.Name())
+		return imapsql.ExternalError{Key: b.key, Err: err}
+	}
+	return nil
+}
+
+// Close closes the blob. Blobs written using the hashed layout are discarded
+// if Sync was not called.
+func (b *blobWriter) Close() error {
+	if b.h == nil {
+		if err := b.finish(); err != nil {
+			b.f.Close()
+			return err
+		}
+		return b.f.Close()
+	}
+
+	if b.done {
+		return nil
+	}
+	b.done = true
+	b.f.Close()
+	return os.Remove(b.f.Name())
+}
+
+// link moves the blob from the temporary file tmp to the blobs directory,
+// unless the identical blob is already there, and links it to the key.
+//
+// Concurrent Delete or collect may remove the found blob before it is linked,
+// in this case the blob is stored again. If the blob is removed after it is
+// linked, the key file keeps the only copy of the data so nothing is lost,
+// the body is just not shared with later messages.
+func (s *extStore) link(tmp string, sum []byte, key string) error {
+	defer os.Remove(tmp)
+
+	blob := s.blobPath(sum)
+	if err := os.MkdirAll(filepath.Dir(blob), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	// Link is created in the temporary directory first so the existing key
+	// file is replaced atomically during migration.
+	keyLink := tmp + ".lnk"
+	for i := 0; i < 3; i++ {
+		if err := os.Link(tmp, blob); err != nil && !os.IsExist(err) {
+			return err
+		}
+		err := os.Link(blob, keyLink)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(keyLink, s.keyPath(key))
+	}
+
+	// Give up on sharing the blob.
+	return os.Rename(tmp, s.keyPath(key))
+}
+
+// readHeader reads the hashed layout header and returns the hash of the
+// body. For the plain layout, nil is returned and f is positioned back at
+// its start.
+func readHeader(f *os.File) ([]byte, error) {
+	hdr := make([]byte, blobHeaderLen)
+	_, err := io.ReadFull(f, hdr)
+	if err == nil && string(hdr[:len(blobMagic)]) == blobMagic {
+		return hdr[len(blobMagic):], nil
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return nil, err
+}
+
+// blobReader returns the decompressed body and verifies its hash once it is
+// read completely.
+type blobReader struct {
+	io.ReadCloser
+	f *os.File
+
+	sum []byte
+	h   hash.Hash
+}
+
+func openBlob(f *os.File) (*blobReader, error) {
+	sum, err := readHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := buffer.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+
+	br := &blobReader{ReadCloser: rc, f: f}
+	if sum != nil {
+		br.sum = sum
+		br.h = sha256.New()
+	}
+	return br, nil
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.h != nil {
+		b.h.Write(p[:n])
+		if err == io.EOF && !bytes.Equal(b.h.Sum(nil), b.sum) {
+			return n, errChecksum
+		}
+	}
+	return n, err
+}
+
+func (b *blobReader) Write([]byte) (int, error) {
+	return 0, errNotWritable
+}
+
+func (b *blobReader) Sync() error {
+	return errNotWritable
+}
+
+func (b *blobReader) Close() error {
+	b.ReadCloser.Close()
+	return b.f.Close()
+}
+
+func (s *extStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	f, err := os.Open(s.keyPath(key))
+	if err != nil {
+		return nil, imapsql.ExternalError{
+			Key:         key,
+			Err:         err,
+			NonExistent: os.IsNotExist(err),
+		}
+	}
+	br, err := openBlob(f)
+	if err != nil {
+		f.Close()
+		return nil, imapsql.ExternalError{Key: key, Err: err}
+	}
+	return br, nil
+}
+
+func (s *extStore) Delete(keys []string) error {
+	for _, key := range keys {
+		if err := s.delete(key); err != nil {
+			return imapsql.ExternalError{Key: key, Err: err}
+		}
+	}
+	return nil
+}
+
+func (s *extStore) delete(key string) error {
+	path := s.keyPath(key)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sum, err := readHeader(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if sum == nil {
+		return nil
+	}
+	return s.release(s.blobPath(sum))
+}
+
+// release removes the blob if it is not linked to any key.
+func (s *extStore) release(blob string) error {
+	info, err := os.Lstat(blob)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if links, ok := linkCount(info); !ok || links > 1 {
+		return nil
+	}
+	if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// keys returns keys of all stored bodies.
+func (s *extStore) keys() ([]string, error) {
+	dir, err := os.Open(s.root)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := names[:0]
+	for _, name := range names {
+		if name == blobsDir || name == tmpDir {
+			continue
+		}
+		keys = append(keys, name)
+	}
+	return keys, nil
+}
+
+// collect removes blobs not linked to any key and temporary files older
+// than tmpAge. Normally, blobs are removed once the last message using them
+// is deleted, but they may be left behind if the server is stopped in the
+// middle of that.
+func (s *extStore) collect(tmpAge time.Duration) (int, error) {
+	removed := 0
+	err := filepath.Walk(filepath.Join(s.root, blobsDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if links, ok := linkCount(info); !ok || links > 1 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	tmp, err := ioutil.ReadDir(filepath.Join(s.root, tmpDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return removed, nil
+		}
+		return removed, err
+	}
+	for _, info := range tmp {
+		if time.Since(info.ModTime()) < tmpAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.root, tmpDir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// verify reads all stored bodies and calls bad for the ones that can't be
+// read or have the wrong hash. It returns the amount of checked bodies.
+func (s *extStore) verify(bad func(key string, err error)) (int, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		obj, err := s.Open(key)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, obj)
+			obj.Close()
+		}
+		if err != nil {
+			bad(key, err)
+		}
+	}
+	return len(keys), nil
+}
+
+// migrate converts all stored bodies to the hashed or plain layout. Bodies
+// are compressed using the current settings. It returns the amount of
+// converted bodies.
+func (s *extStore) migrate(hashed bool) (int, error) {
+	if hashed && !hardLinks {
+		return 0, errors.New("hashed layout is not supported on this platform")
+	}
+
+	keys, err := s.keys()
+	if err != nil {
+		return 0, err
+	}
+	converted := 0
+	for _, key := range keys {
+		ok, err := s.convert(key, hashed)
+		if err != nil {
+			return converted, fmt.Errorf("%s: %w", key, err)
+		}
+		if ok {
+			converted++
+		}
+	}
+	return converted, nil
+}
+
+func (s *extStore) convert(key string, hashed bool) (bool, error) {
+	f, err := os.Open(s.keyPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Deleted concurrently.
+			return false, nil
+		}
+		return false, err
+	}
+	sum, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	if (sum != nil) == hashed {
+		f.Close()
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return false, err
+	}
+	r, err := openBlob(f)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	defer r.Close()
+
+	// Key files of the hashed layout are links to the shared blob, they
+	// should never be written in place.
+	tmp, err := s.tempFile(key)
+	if err != nil {
+		return false, err
+	}
+	w, err := s.newWriter(tmp, key, hashed)
+	if err == nil {
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return false, err
+	}
+
+	if hashed {
+		// Replaces the key file.
+		return true, w.Sync()
+	}
+
+	if err := w.Sync(); err != nil {
+		w.Close()
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), s.keyPath(key)); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, s.release(s.blobPath(sum))
+}
+
+// Temporary files younger than that may belong to messages being stored.
+const tmpMaxAge = 24 * time.Hour
+
+func (store *Storage) CollectBlobs() (int, error) {
+	return store.extStore.collect(tmpMaxAge)
+}
+
+func (store *Storage) VerifyBlobs(bad func(key string, err error)) (int, error) {
+	return store.extStore.verify(bad)
+}
+
+func (store *Storage) MigrateBlobs(layout string) (int, error) {
+	switch layout {
+	case layoutPlain:
+		return store.extStore.migrate(false)
+	case layoutHashed:
+		if store.Back.Opts.CompressAlgo == "lz4" {
+			return 0, errors.New("imapsql: lz4 compression can't be used with hashed layout")
+		}
+		return store.extStore.migrate(true)
+	default:
+		return 0, fmt.Errorf("imapsql: unknown layout: %s", layout)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(compressionTime)
+	prometheus.MustRegister(compressionBytes)
+}
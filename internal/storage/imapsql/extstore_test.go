@@ -0,0 +1,390 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func mboxBodies(t *testing.T, store *Storage, acct, mboxName string) []string {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(mboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section, err := imap.ParseBodySectionName("BODY.PEEK[TEXT]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	var res []string
+	for msg := range ch {
+		for _, literal := range msg.Body {
+			blob, err := ioutil.ReadAll(literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, string(blob))
+		}
+	}
+	return res
+}
+
+func testExtStorage(t *testing.T, c buffer.Compression, hashed bool) (*Storage, string) {
+	t.Helper()
+
+	dir := testutils.Dir(t)
+	msgsDir := filepath.Join(dir, "messages")
+	extStore, err := newExtStore(msgsDir, c, hashed, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := imapsql.New("sqlite3", filepath.Join(dir, "test.db"), extStore, imapsql.Opts{
+		LazyUpdatesInit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &Storage{
+		Back:     db,
+		extStore: extStore,
+		Log:      testutils.Logger(t, "imapsql"),
+		driver:   "sqlite3",
+	}
+	if err := store.initQuota(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	return store, msgsDir
+}
+
+func deliverBodies(t *testing.T, store *Storage, bodies ...string) {
+	t.Helper()
+
+	for _, body := range bodies {
+		ctx := context.Background()
+		delivery, err := store.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.AddRcpt(ctx, "test@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "Hello")
+		if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkBodies(t *testing.T, store *Storage, bodies ...string) {
+	t.Helper()
+
+	got := mboxBodies(t, store, "test@example.org", "INBOX")
+	if len(got) != len(bodies) {
+		t.Fatalf("wrong amount of messages: %d", len(got))
+	}
+	for i := range bodies {
+		if got[i] != bodies[i] {
+			t.Errorf("message %d is corrupted: %q", i, got[i])
+		}
+	}
+}
+
+// storedFiles returns the contents of files in dir, excluding directories.
+func storedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		blob, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, string(blob))
+	}
+	return res
+}
+
+func countBlobs(t *testing.T, msgsDir string) int {
+	t.Helper()
+
+	count := 0
+	err := filepath.Walk(filepath.Join(msgsDir, blobsDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func expungeAll(t *testing.T, store *Storage) {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressStore(t *testing.T) {
+	store, msgsDir := testExtStorage(t, buffer.Compression{Algo: "zstd", MinSize: 1024}, false)
+
+	// The small message is stored as is, just like messages stored without
+	// compression enabled.
+	bodies := []string{
+		"small\r\n",
+		strings.Repeat("This message is big enough to be compressed.\r\n", 100),
+	}
+	deliverBodies(t, store, bodies...)
+	checkBodies(t, store, bodies...)
+
+	files := storedFiles(t, msgsDir)
+	compressed := 0
+	for _, blob := range files {
+		if strings.HasPrefix(blob, "\x00MZC") {
+			compressed++
+		}
+	}
+	if compressed != 1 {
+		t.Fatalf("wrong amount of compressed blobs: %d of %d", compressed, len(files))
+	}
+}
+
+func TestExtStore_Hashed(t *testing.T) {
+	store, msgsDir := testExtStorage(t, buffer.Compression{Algo: "zstd", MinSize: 1024}, true)
+
+	big := strings.Repeat("This message is big enough to be compressed.\r\n", 100)
+	bodies := []string{"small\r\n", big, big}
+	deliverBodies(t, store, bodies...)
+	checkBodies(t, store, bodies...)
+
+	// Each message has its own key but identical bodies share the blob.
+	files := storedFiles(t, msgsDir)
+	if len(files) != 3 {
+		t.Fatalf("wrong amount of keys: %d", len(files))
+	}
+	for _, blob := range files {
+		if !strings.HasPrefix(blob, blobMagic) {
+			t.Fatalf("key without hashed layout header: %q", blob)
+		}
+	}
+	if n := countBlobs(t, msgsDir); n != 2 {
+		t.Fatalf("wrong amount of blobs: %d", n)
+	}
+	if left := storedFiles(t, filepath.Join(msgsDir, tmpDir)); len(left) != 0 {
+		t.Fatalf("temporary files are left: %d", len(left))
+	}
+
+	expungeAll(t, store)
+	if files := storedFiles(t, msgsDir); len(files) != 0 {
+		t.Fatalf("keys are not removed: %d", len(files))
+	}
+	if n := countBlobs(t, msgsDir); n != 0 {
+		t.Fatalf("blobs are not removed: %d", n)
+	}
+}
+
+func TestExtStore_Checksum(t *testing.T) {
+	store, msgsDir := testExtStorage(t, buffer.Compression{}, true)
+	deliverBodies(t, store, "Hello!\r\n")
+
+	// Damage the body, the key file shares it with the blob.
+	files, err := ioutil.ReadDir(msgsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		key = f.Name()
+		path := filepath.Join(msgsDir, key)
+		blob, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob[len(blob)-3] = 'X'
+		if err := ioutil.WriteFile(path, blob, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	obj, err := store.extStore.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if _, err := ioutil.ReadAll(obj); err != errChecksum {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var damaged []string
+	checked, err := store.VerifyBlobs(func(key string, err error) {
+		damaged = append(damaged, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 1 || len(damaged) != 1 {
+		t.Fatalf("wrong verification result: %d checked, %v damaged", checked, damaged)
+	}
+}
+
+func TestExtStore_Migrate(t *testing.T) {
+	store, msgsDir := testExtStorage(t, buffer.Compression{Algo: "gzip", MinSize: 1024}, false)
+
+	big := strings.Repeat("This message is big enough to be compressed.\r\n", 100)
+	bodies := []string{"small\r\n", big, big}
+	deliverBodies(t, store, bodies...)
+
+	converted, err := store.MigrateBlobs(layoutHashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != 3 {
+		t.Fatal("wrong amount of converted bodies:", converted)
+	}
+	if n := countBlobs(t, msgsDir); n != 2 {
+		t.Fatalf("wrong amount of blobs: %d", n)
+	}
+	checkBodies(t, store, bodies...)
+
+	// Converted bodies are skipped.
+	converted, err = store.MigrateBlobs(layoutHashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != 0 {
+		t.Fatal("wrong amount of converted bodies:", converted)
+	}
+
+	converted, err = store.MigrateBlobs(layoutPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != 3 {
+		t.Fatal("wrong amount of converted bodies:", converted)
+	}
+	if n := countBlobs(t, msgsDir); n != 0 {
+		t.Fatalf("blobs are not removed: %d", n)
+	}
+	for _, blob := range storedFiles(t, msgsDir) {
+		if strings.HasPrefix(blob, blobMagic) {
+			t.Fatal("body is not converted")
+		}
+	}
+	checkBodies(t, store, bodies...)
+}
+
+func TestExtStore_Collect(t *testing.T) {
+	store, msgsDir := testExtStorage(t, buffer.Compression{}, true)
+	deliverBodies(t, store, "Hello!\r\n")
+
+	// Simulate the blob left behind if the server is stopped after the key is
+	// removed.
+	unused := store.extStore.blobPath(make([]byte, 32))
+	if err := os.MkdirAll(filepath.Dir(unused), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(unused, []byte("unused"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(msgsDir, tmpDir, "stale")
+	if err := ioutil.WriteFile(stale, []byte("unused"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * tmpMaxAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.CollectBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatal("wrong amount of removed files:", removed)
+	}
+	if n := countBlobs(t, msgsDir); n != 1 {
+		t.Fatalf("wrong amount of blobs: %d", n)
+	}
+	checkBodies(t, store, "Hello!\r\n")
+}
@@ -23,11 +23,16 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // - module.StorageBackend
 // - module.PlainAuth
 // - module.DeliveryTarget
+// - module.PartialDelivery
+// - module.QuotaStorage
+// - module.RetentionStorage
 package imapsql
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -36,6 +41,8 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -45,6 +52,7 @@ import (
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/clock"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
@@ -61,10 +69,27 @@ import (
 
 type Storage struct {
 	Back     *imapsql.Backend
+	extStore *extStore
 	instName string
 	Log      log.Logger
 
-	junkMbox string
+	junkMbox         string
+	quarantineToJunk bool
+	// Special-use mailboxes created for new accounts, attribute -> name.
+	specialMboxes map[string]string
+
+	defaultQuotaBytes int
+	defaultQuotaMsgs  int
+
+	// Mailbox name -> maximum age of messages.
+	retention         map[string]time.Duration
+	retentionInterval time.Duration
+	retentionBatch    int
+	retentionStop     chan struct{}
+	retentionDone     chan struct{}
+	// Time source for the retention runs, clock.Real unless replaced by
+	// tests.
+	clock clock.Clock
 
 	driver string
 	dsn    []string
@@ -74,17 +99,24 @@ type Storage struct {
 	updates     <-chan backend.Update
 	updPipe     updatepipe.P
 	updPushStop chan struct{}
+	updLck      sync.Mutex
+	updSubs     []chan backend.Update
 
 	filters module.IMAPFilter
 }
 
+// spamFlagHeader is added to quarantined messages so MUAs and filters can
+// recognize them even if they are not stored in the Junk mailbox.
+const spamFlagHeader = "X-Spam-Flag"
+
 type delivery struct {
 	store    *Storage
 	msgMeta  *module.MsgMetadata
 	d        imapsql.Delivery
 	mailFrom string
 
-	addedRcpts map[string]struct{}
+	// Account name -> recipient address as passed to AddRcpt.
+	addedRcpts map[string]string
 }
 
 func (d *delivery) String() string {
@@ -110,11 +142,27 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 		return nil
 	}
 
+	if err := d.store.checkQuota(accountName, int64(d.msgMeta.SMTPOpts.Size)); err != nil {
+		return err
+	}
+
+	if err := d.addRcpt(accountName, rcptTo); err != nil {
+		return err
+	}
+
+	d.addedRcpts[accountName] = rcptTo
+	return nil
+}
+
+func (d *delivery) addRcpt(accountName, rcptTo string) error {
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
 	userHeader := textproto.Header{}
 	userHeader.Add("Delivered-To", accountName)
+	if !d.msgMeta.Quarantine && d.msgMeta.IsQuarantined(rcptTo) {
+		userHeader.Add(spamFlagHeader, "YES")
+	}
 
 	if err := d.d.AddRcpt(accountName, userHeader); err != nil {
 		if err == imapsql.ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
@@ -137,16 +185,154 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 		}
 		return err
 	}
-
-	d.addedRcpts[accountName] = struct{}{}
 	return nil
 }
 
+// messageSize returns the size of the message as it will be stored.
+func messageSize(header textproto.Header, body buffer.Buffer) (int64, error) {
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return 0, err
+	}
+	return int64(hdrBlob.Len() + body.Len()), nil
+}
+
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
-	if !d.msgMeta.Quarantine && d.store.filters != nil {
-		for rcpt := range d.addedRcpts {
+	header = header.Copy()
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+
+	// Check quota again using the actual message size.
+	size, err := messageSize(header, body)
+	if err != nil {
+		return err
+	}
+	for accountName := range d.addedRcpts {
+		if err := d.store.checkQuota(accountName, size); err != nil {
+			return err
+		}
+	}
+
+	if d.hasQuarantinedRcpts() {
+		var firstErr error
+		d.restart(statusFunc(func(_ string, err error) {
+			if firstErr == nil {
+				firstErr = err
+			}
+		}))
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+
+	return d.body(header, body)
+}
+
+type statusFunc func(rcptTo string, err error)
+
+func (f statusFunc) SetStatus(rcptTo string, err error) {
+	f(rcptTo, err)
+}
+
+// hasQuarantinedRcpts reports whether the message is quarantined only for
+// some recipients.
+func (d *delivery) hasQuarantinedRcpts() bool {
+	if d.msgMeta.Quarantine {
+		return false
+	}
+	for _, rcptTo := range d.addedRcpts {
+		if d.msgMeta.IsQuarantined(rcptTo) {
+			return true
+		}
+	}
+	return false
+}
+
+// restart starts the delivery over with the current set of recipients.
+//
+// go-imap-sql does not allow to remove recipients from the delivery or
+// change per-recipient header fields after AddRcpt. Recipients that can't be
+// added again are reported using sc and removed.
+func (d *delivery) restart(sc module.StatusCollector) {
+	if err := d.d.Abort(); err != nil {
+		d.store.Log.Error("delivery.Abort failed", err)
+	}
+	d.d = d.store.Back.NewDelivery()
+	for accountName, rcptTo := range d.addedRcpts {
+		if err := d.addRcpt(accountName, rcptTo); err != nil {
+			sc.SetStatus(rcptTo, err)
+			delete(d.addedRcpts, accountName)
+		}
+	}
+}
+
+// BodyNonAtomic implements module.PartialDelivery.
+//
+// Recipients that can't receive the message because of the quota are
+// excluded from the delivery, the message is stored for remaining ones.
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "sql/BodyNonAtomic").End()
+
+	header = header.Copy()
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+
+	size, err := messageSize(header, body)
+	if err != nil {
+		for _, rcptTo := range d.addedRcpts {
+			sc.SetStatus(rcptTo, err)
+		}
+		return
+	}
+
+	overQuota := false
+	for accountName, rcptTo := range d.addedRcpts {
+		if err := d.store.checkQuota(accountName, size); err != nil {
+			sc.SetStatus(rcptTo, err)
+			delete(d.addedRcpts, accountName)
+			overQuota = true
+		}
+	}
+
+	if overQuota || d.hasQuarantinedRcpts() {
+		d.restart(sc)
+	}
+
+	if len(d.addedRcpts) == 0 {
+		return
+	}
+
+	err = d.body(header, body)
+	for _, rcptTo := range d.addedRcpts {
+		sc.SetStatus(rcptTo, err)
+	}
+}
+
+func (d *delivery) body(header textproto.Header, body buffer.Buffer) error {
+	if d.msgMeta.Quarantine {
+		header.Add(spamFlagHeader, "YES")
+	}
+
+	if !d.msgMeta.Quarantine || !d.store.quarantineToJunk {
+		for rcpt, rcptTo := range d.addedRcpts {
+			if d.msgMeta.IsQuarantined(rcptTo) && d.store.quarantineToJunk {
+				// Quarantined only for some recipients. Unlike SpecialMailbox,
+				// UserMailbox falls back to INBOX if the mailbox does not
+				// exist so create it first.
+				if err := d.store.createJunkMbox(rcpt); err != nil {
+					d.store.Log.Error("failed to create Junk mailbox", err, "rcpt", rcpt)
+				}
+				d.d.UserMailbox(rcpt, d.store.junkMbox, nil)
+				continue
+			}
+			if folder, ok := d.msgMeta.RcptFolders[rcptTo]; ok {
+				d.d.UserMailbox(rcpt, folder, nil)
+				continue
+			}
+			if d.store.filters == nil {
+				continue
+			}
+
 			folder, flags, err := d.store.filters.IMAPFilter(rcpt, d.msgMeta, header, body)
 			if err != nil {
 				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
@@ -156,7 +342,7 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 		}
 	}
 
-	if d.msgMeta.Quarantine {
+	if d.msgMeta.Quarantine && d.store.quarantineToJunk {
 		if err := d.d.SpecialMailbox(specialuse.Junk, d.store.junkMbox); err != nil {
 			if _, ok := err.(imapsql.SerializationError); ok {
 				return &exterrors.SMTPError{
@@ -171,8 +357,6 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 		}
 	}
 
-	header = header.Copy()
-	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
 	err := d.d.BodyParsed(header, body.Len(), body)
 	if _, ok := err.(imapsql.SerializationError); ok {
 		return &exterrors.SMTPError{
@@ -206,7 +390,7 @@ func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		msgMeta:    msgMeta,
 		mailFrom:   mailFrom,
 		d:          store.Back.NewDelivery(),
-		addedRcpts: map[string]struct{}{},
+		addedRcpts: map[string]string{},
 	}, nil
 }
 
@@ -223,6 +407,7 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 		instName: instName,
 		Log:      log.Logger{Name: "imapsql"},
 		resolver: dns.DefaultResolver(),
+		clock:    clock.Real,
 	}
 	if len(inlineArgs) != 0 {
 		if len(inlineArgs) == 1 {
@@ -240,8 +425,15 @@ func (store *Storage) Init(cfg *config.Map) error {
 		driver          string
 		dsn             []string
 		fsstoreLocation string
+		fsstoreLayout   string
 		appendlimitVal  = -1
 		compression     []string
+		compressMinSize int
+
+		quarantineAction     string
+		createSpecialMboxes  bool
+		sentMbox, trashMbox  string
+		draftsMbox, archMbox string
 	)
 
 	opts := imapsql.Opts{
@@ -259,13 +451,28 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 		return node.Args[0], nil
 	}, &fsstoreLocation)
+	cfg.Enum("fsstore_layout", false, false, []string{layoutPlain, layoutHashed}, layoutPlain, &fsstoreLayout)
 	cfg.StringList("compression", false, false, []string{"off"}, &compression)
+	cfg.DataSize("compression_min_size", false, false, 4096, &compressMinSize)
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
 	cfg.Bool("debug", true, false, &store.Log.Debug)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("sqlite3_exclusive_lock", false, false, &opts.ExclusiveLock)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.Enum("quarantine_action", false, false, []string{"junk", "flag"}, "junk", &quarantineAction)
+	cfg.Bool("create_special_mailboxes", false, true, &createSpecialMboxes)
+	cfg.String("sent_mailbox", false, false, "Sent", &sentMbox)
+	cfg.String("trash_mailbox", false, false, "Trash", &trashMbox)
+	cfg.String("drafts_mailbox", false, false, "Drafts", &draftsMbox)
+	cfg.String("archive_mailbox", false, false, "Archive", &archMbox)
+	cfg.DataSize("default_quota", false, false, 0, &store.defaultQuotaBytes)
+	cfg.Int("default_quota_messages", false, false, 0, &store.defaultQuotaMsgs)
+	cfg.Custom("retention", false, false, func() (interface{}, error) {
+		return map[string]time.Duration{}, nil
+	}, retentionDirective, &store.retention)
+	cfg.Duration("retention_interval", false, false, 1*time.Hour, &store.retentionInterval)
+	cfg.Int("retention_batch", false, false, 500, &store.retentionBatch)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -281,6 +488,28 @@ func (store *Storage) Init(cfg *config.Map) error {
 	if dsn == nil {
 		return errors.New("imapsql: dsn is required")
 	}
+	if store.retentionInterval <= 0 {
+		return errors.New("imapsql: retention_interval should be positive")
+	}
+	if store.retentionBatch <= 0 {
+		return errors.New("imapsql: retention_batch should be positive")
+	}
+
+	store.quarantineToJunk = quarantineAction == "junk"
+	if createSpecialMboxes {
+		store.specialMboxes = make(map[string]string, 5)
+		for attr, name := range map[string]string{
+			specialuse.Junk:    store.junkMbox,
+			specialuse.Sent:    sentMbox,
+			specialuse.Trash:   trashMbox,
+			specialuse.Drafts:  draftsMbox,
+			specialuse.Archive: archMbox,
+		} {
+			if name != "" {
+				store.specialMboxes[attr] = name
+			}
+		}
+	}
 	if driver == "" {
 		return errors.New("imapsql: driver is required")
 	}
@@ -302,46 +531,77 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	dsnStr := strings.Join(dsn, " ")
 
+	var c buffer.Compression
+	if len(compression) != 0 && compression[0] == "lz4" {
+		// Compression implemented by go-imap-sql, there is no lz4
+		// support in buffer.Compression.
+		opts.CompressAlgo = compression[0]
+		if len(compression) == 2 {
+			opts.CompressAlgoParams = compression[1]
+			if _, err := strconv.Atoi(compression[1]); err != nil {
+				return errors.New("imapsql: first argument for lz4 is compression level")
+			}
+		}
+		if len(compression) > 2 {
+			return errors.New("imapsql: expected at most 2 arguments")
+		}
+		if fsstoreLayout == layoutHashed {
+			return errors.New("imapsql: lz4 compression can't be used with hashed fsstore_layout")
+		}
+	} else {
+		c, err = buffer.ParseCompression(compression)
+		if err != nil {
+			return fmt.Errorf("imapsql: compression: %v", err)
+		}
+		c.MinSize = compressMinSize
+	}
+
+	if config.CheckOnly {
+		if fsstoreLayout == layoutHashed && !hardLinks {
+			return errors.New("imapsql: hashed layout is not supported on this platform")
+		}
+		// sql.Open does not connect to the database, it only makes sure the
+		// driver is known.
+		db, err := sql.Open(driver, dsnStr)
+		if err != nil {
+			return fmt.Errorf("imapsql: %v", err)
+		}
+		return db.Close()
+	}
+
 	if err := os.MkdirAll(fsstoreLocation, os.ModeDir|os.ModePerm); err != nil {
 		return err
 	}
-	extStore := &imapsql.FSStore{Root: fsstoreLocation}
 
-	if len(compression) != 0 {
-		switch compression[0] {
-		case "zstd", "lz4":
-			opts.CompressAlgo = compression[0]
-			if len(compression) == 2 {
-				opts.CompressAlgoParams = compression[1]
-				if _, err := strconv.Atoi(compression[1]); err != nil {
-					return errors.New("imapsql: first argument for lz4 and zstd is compression level")
-				}
-			}
-			if len(compression) > 2 {
-				return errors.New("imapsql: expected at most 2 arguments")
-			}
-		case "off":
-			if len(compression) > 1 {
-				return errors.New("imapsql: expected at most 1 arguments")
-			}
-		default:
-			return errors.New("imapsql: unknown compression algorithm")
-		}
+	store.extStore, err = newExtStore(fsstoreLocation, c, fsstoreLayout == layoutHashed, store.instName)
+	if err != nil {
+		return fmt.Errorf("imapsql: %v", err)
 	}
 
-	store.Back, err = imapsql.New(driver, dsnStr, extStore, opts)
+	store.Back, err = imapsql.New(driver, dsnStr, store.extStore, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
 	}
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
+	if err := store.initQuota(); err != nil {
+		return fmt.Errorf("imapsql: %s", err)
+	}
+	if err := store.initRetention(); err != nil {
+		return fmt.Errorf("imapsql: %s", err)
+	}
+
 	store.driver = driver
 	store.dsn = dsn
 
 	store.Back.EnableChildrenExt()
 	store.Back.EnableSpecialUseExt()
 
+	store.retentionStop = make(chan struct{})
+	store.retentionDone = make(chan struct{})
+	go store.retentionLoop()
+
 	return nil
 }
 
@@ -420,22 +680,13 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT", "QUOTA"}
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
 	return store.Back.CreateMessageLimit()
 }
 
-func (store *Storage) Updates() <-chan backend.Update {
-	if store.updates != nil {
-		return store.updates
-	}
-
-	store.updates = store.Back.Updates()
-	return store.updates
-}
-
 func (store *Storage) EnableChildrenExt() bool {
 	return store.Back.EnableChildrenExt()
 }
@@ -472,7 +723,19 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	_, err = store.Back.GetUser(accountName)
+	created := err == imapsql.ErrUserDoesntExists
+
+	u, err := store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		if err := store.createSpecialMboxes(accountName); err != nil {
+			store.Log.Error("failed to create special-use mailboxes", err, "username", accountName)
+		}
+	}
+	return u, nil
 }
 
 func (store *Storage) Lookup(key string) (string, bool, error) {
@@ -496,6 +759,11 @@ func (store *Storage) Lookup(key string) (string, bool, error) {
 }
 
 func (store *Storage) Close() error {
+	if store.retentionStop != nil {
+		close(store.retentionStop)
+		<-store.retentionDone
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -0,0 +1,228 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	specialuse "github.com/emersion/go-imap-specialuse"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testStorage(t *testing.T, accts ...string) *Storage {
+	dir := testutils.Dir(t)
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := imapsql.New("sqlite3", filepath.Join(dir, "test.db"), &imapsql.FSStore{Root: filepath.Join(dir, "messages")}, imapsql.Opts{
+		LazyUpdatesInit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.EnableSpecialUseExt()
+
+	store := &Storage{
+		Back:             db,
+		Log:              testutils.Logger(t, "imapsql"),
+		driver:           "sqlite3",
+		junkMbox:         "Junk",
+		quarantineToJunk: true,
+		retentionBatch:   500,
+		clock:            clock.Real,
+	}
+	if err := store.initQuota(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initRetention(); err != nil {
+		t.Fatal(err)
+	}
+	for _, acct := range accts {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+type statusCollector map[string]error
+
+func (sc statusCollector) SetStatus(rcptTo string, err error) {
+	sc[rcptTo] = err
+}
+
+// mboxHeaders returns header sections of messages stored in the mailbox.
+func mboxHeaders(t *testing.T, store *Storage, acct, mboxName string) []string {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(mboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section, err := imap.ParseBodySectionName("BODY.PEEK[HEADER]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	var res []string
+	for msg := range ch {
+		for _, literal := range msg.Body {
+			blob, err := ioutil.ReadAll(literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, string(blob))
+		}
+	}
+	return res
+}
+
+func TestCreateSpecialMboxes(t *testing.T) {
+	store := testStorage(t)
+	store.specialMboxes = map[string]string{
+		specialuse.Junk:  "Spam",
+		specialuse.Trash: "Trash",
+	}
+
+	if err := store.CreateIMAPAcct("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetOrCreateIMAPAcct("user2@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, acct := range []string{"user@example.org", "user2@example.org"} {
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mboxes, err := u.ListMailboxes(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		attrs := map[string][]string{}
+		for _, mbox := range mboxes {
+			info, err := mbox.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs[info.Name] = info.Attributes
+		}
+		if len(attrs) != 3 {
+			t.Errorf("Wrong mailboxes for %s: %v", acct, attrs)
+		}
+		if !hasAttr(attrs["Spam"], specialuse.Junk) || !hasAttr(attrs["Trash"], specialuse.Trash) {
+			t.Errorf("Missing special-use attributes for %s: %v", acct, attrs)
+		}
+	}
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestQuarantine(t *testing.T) {
+	store := testStorage(t, "rcpt1@example.org", "rcpt2@example.org")
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"rcpt1@example.org"}, &module.MsgMetadata{
+		Quarantine: true,
+	})
+
+	hdrs := mboxHeaders(t, store, "rcpt1@example.org", "Junk")
+	if len(hdrs) != 1 {
+		t.Fatal("Expected one message in Junk, got", len(hdrs))
+	}
+	if !strings.Contains(hdrs[0], "X-Spam-Flag: YES\r\n") {
+		t.Errorf("Missing X-Spam-Flag: %q", hdrs[0])
+	}
+	if len(mboxHeaders(t, store, "rcpt1@example.org", "INBOX")) != 0 {
+		t.Error("Quarantined message is delivered to INBOX")
+	}
+}
+
+func TestQuarantine_Rcpt(t *testing.T) {
+	store := testStorage(t, "rcpt1@example.org", "rcpt2@example.org")
+
+	sc := statusCollector{}
+	msgMeta := &module.MsgMetadata{
+		QuarantineRcpts: map[string]struct{}{
+			"rcpt1@example.org": {},
+		},
+	}
+	// Second delivery uses the existing Junk mailbox.
+	for i := 0; i < 2; i++ {
+		testutils.DoTestDeliveryNonAtomicMeta(t, sc, store, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"}, msgMeta)
+		for rcpt, err := range sc {
+			if err != nil {
+				t.Fatal("Unexpected error for", rcpt, err)
+			}
+		}
+	}
+
+	hdrs := mboxHeaders(t, store, "rcpt1@example.org", "Junk")
+	if len(hdrs) != 2 || !strings.Contains(hdrs[0], "X-Spam-Flag: YES\r\n") {
+		t.Errorf("Wrong Junk contents for rcpt1: %q", hdrs)
+	}
+
+	hdrs = mboxHeaders(t, store, "rcpt2@example.org", "INBOX")
+	if len(hdrs) != 2 || strings.Contains(hdrs[0], "X-Spam-Flag") {
+		t.Errorf("Wrong INBOX contents for rcpt2: %q", hdrs)
+	}
+}
+
+func TestQuarantine_Flag(t *testing.T) {
+	store := testStorage(t, "rcpt1@example.org")
+	store.quarantineToJunk = false
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"rcpt1@example.org"}, &module.MsgMetadata{
+		Quarantine: true,
+	})
+
+	hdrs := mboxHeaders(t, store, "rcpt1@example.org", "INBOX")
+	if len(hdrs) != 1 || !strings.Contains(hdrs[0], "X-Spam-Flag: YES\r\n") {
+		t.Errorf("Wrong INBOX contents: %q", hdrs)
+	}
+}
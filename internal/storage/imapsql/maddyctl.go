@@ -19,7 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
+	specialuse "github.com/emersion/go-imap-specialuse"
 	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
 )
 
 // These methods wrap corresponding go-imap-sql methods, but also apply
@@ -35,7 +37,45 @@ func (store *Storage) CreateIMAPAcct(username string) error {
 		return err
 	}
 
-	return store.Back.CreateUser(accountName)
+	if err := store.Back.CreateUser(accountName); err != nil {
+		return err
+	}
+	return store.createSpecialMboxes(accountName)
+}
+
+func (store *Storage) createJunkMbox(accountName string) error {
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	if _, err := u.GetMailbox(store.junkMbox); err == nil {
+		return nil
+	}
+	err = u.(*imapsql.User).CreateMailboxSpecial(store.junkMbox, specialuse.Junk)
+	if err != nil && err != backend.ErrMailboxAlreadyExists {
+		return err
+	}
+	return nil
+}
+
+// createSpecialMboxes creates mailboxes with SPECIAL-USE attributes (RFC 6154)
+// for the new account.
+func (store *Storage) createSpecialMboxes(accountName string) error {
+	if len(store.specialMboxes) == 0 {
+		return nil
+	}
+
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	suu := u.(*imapsql.User)
+	for attr, name := range store.specialMboxes {
+		if err := suu.CreateMailboxSpecial(name, attr); err != nil && err != backend.ErrMailboxAlreadyExists {
+			return err
+		}
+	}
+	return nil
 }
 
 func (store *Storage) DeleteIMAPAcct(username string) error {
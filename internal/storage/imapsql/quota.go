@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// rebind converts ? placeholders into the form used by the DB driver.
+func (store *Storage) rebind(query string) string {
+	if store.driver != "postgres" {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (store *Storage) initQuota() error {
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_quotas (
+			username VARCHAR(255) NOT NULL PRIMARY KEY,
+			max_bytes BIGINT DEFAULT NULL,
+			max_msgs BIGINT DEFAULT NULL
+		)`)
+	return err
+}
+
+func nullLimit(val int64) sql.NullInt64 {
+	if val < 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: val, Valid: true}
+}
+
+func (store *Storage) SetQuota(username string, maxBytes, maxMsgs int64) error {
+	accountName, err := prepareUsername(username)
+	if err != nil {
+		return err
+	}
+	accountName = strings.ToLower(accountName)
+
+	if maxBytes < 0 && maxMsgs < 0 {
+		_, err := store.Back.DB.Exec(store.rebind(`DELETE FROM maddy_quotas WHERE username = ?`), accountName)
+		return err
+	}
+
+	res, err := store.Back.DB.Exec(store.rebind(`UPDATE maddy_quotas SET max_bytes = ?, max_msgs = ? WHERE username = ?`),
+		nullLimit(maxBytes), nullLimit(maxMsgs), accountName)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 0 {
+		return nil
+	}
+
+	_, err = store.Back.DB.Exec(store.rebind(`INSERT INTO maddy_quotas (username, max_bytes, max_msgs) VALUES (?, ?, ?)`),
+		accountName, nullLimit(maxBytes), nullLimit(maxMsgs))
+	return err
+}
+
+func (store *Storage) GetQuota(username string) (module.Quota, error) {
+	accountName, err := prepareUsername(username)
+	if err != nil {
+		return module.Quota{}, err
+	}
+	return store.quota(strings.ToLower(accountName))
+}
+
+// quota returns the quota for the account name normalized using
+// prepareUsername.
+func (store *Storage) quota(accountName string) (module.Quota, error) {
+	q := module.Quota{
+		MaxBytes: int64(store.defaultQuotaBytes),
+		MaxMsgs:  int64(store.defaultQuotaMsgs),
+	}
+
+	var maxBytes, maxMsgs sql.NullInt64
+	err := store.Back.DB.QueryRow(store.rebind(`SELECT max_bytes, max_msgs FROM maddy_quotas WHERE username = ?`), accountName).
+		Scan(&maxBytes, &maxMsgs)
+	if err != nil && err != sql.ErrNoRows {
+		return module.Quota{}, err
+	}
+	if maxBytes.Valid {
+		q.MaxBytes = maxBytes.Int64
+	}
+	if maxMsgs.Valid {
+		q.MaxMsgs = maxMsgs.Int64
+	}
+
+	err = store.Back.DB.QueryRow(store.rebind(`
+		SELECT COALESCE(SUM(msgs.bodyLen), 0), COUNT(*)
+		FROM msgs
+		INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+		INNER JOIN users ON mboxes.uid = users.id
+		WHERE users.username = ?`), accountName).Scan(&q.UsedBytes, &q.UsedMsgs)
+	if err != nil {
+		return module.Quota{}, err
+	}
+
+	return q, nil
+}
+
+// exceeds reports whether adding the message of the specified size would
+// exceed the quota.
+func exceeds(q module.Quota, size int64) bool {
+	// Size is not known, but the message can't be empty.
+	if size < 1 {
+		size = 1
+	}
+	if q.MaxBytes != 0 && q.UsedBytes+size > q.MaxBytes {
+		return true
+	}
+	if q.MaxMsgs != 0 && q.UsedMsgs+1 > q.MaxMsgs {
+		return true
+	}
+	return false
+}
+
+// checkQuota returns an error if the message of the specified size can't be
+// stored for the account because of quota. size can be zero if it is not
+// known yet.
+func (store *Storage) checkQuota(accountName string, size int64) error {
+	q, err := store.quota(accountName)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during quota check",
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+	if !exceeds(q, size) {
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 2, 2},
+		Message:      "Mailbox is full",
+		TargetName:   "imapsql",
+		Misc: map[string]interface{}{
+			"rcpt":       accountName,
+			"used_bytes": q.UsedBytes,
+			"max_bytes":  q.MaxBytes,
+			"used_msgs":  q.UsedMsgs,
+			"max_msgs":   q.MaxMsgs,
+			"size":       size,
+		},
+	}
+}
@@ -0,0 +1,97 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func checkQuotaErr(t *testing.T, err error) {
+	t.Helper()
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("Not SMTPError: %v", err)
+	}
+	if smtpErr.Code != 552 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 2, 2}) {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	store := testStorage(t, "full@example.org", "ok@example.org")
+	if err := store.SetQuota("full@example.org", -1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"full@example.org"})
+
+	q, err := store.GetQuota("FULL@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.UsedMsgs != 1 || q.MaxMsgs != 1 || q.UsedBytes == 0 || q.MaxBytes != 0 {
+		t.Fatalf("Wrong quota: %+v", q)
+	}
+
+	// Rejected at RCPT TO since the mailbox is full.
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"full@example.org"})
+	checkQuotaErr(t, err)
+
+	// Reset to the default (no limit).
+	if err := store.SetQuota("full@example.org", -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"full@example.org"})
+}
+
+func TestQuota_BodySize(t *testing.T) {
+	store := testStorage(t, "full@example.org", "ok@example.org")
+	store.defaultQuotaBytes = 30
+
+	// Mailbox is not full at RCPT TO, but the message does not fit.
+	sc := statusCollector{}
+	if err := store.SetQuota("ok@example.org", 100000, -1); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDeliveryNonAtomic(t, sc, store, "sender@example.org", []string{"full@example.org", "ok@example.org"})
+
+	checkQuotaErr(t, sc["full@example.org"])
+	if err := sc["ok@example.org"]; err != nil {
+		t.Fatal("Unexpected error for ok@:", err)
+	}
+
+	for acct, msgs := range map[string]int64{"full@example.org": 0, "ok@example.org": 1} {
+		q, err := store.GetQuota(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.UsedMsgs != msgs {
+			t.Errorf("Wrong amount of messages for %s: %d", acct, q.UsedMsgs)
+		}
+	}
+}
+
+var _ module.QuotaStorage = &Storage{}
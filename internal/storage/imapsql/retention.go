@@ -0,0 +1,300 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package imapsql
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func (store *Storage) initRetention() error {
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_retention (
+			username VARCHAR(255) NOT NULL,
+			mailbox VARCHAR(255) NOT NULL,
+			max_age BIGINT NOT NULL,
+			PRIMARY KEY(username, mailbox)
+		)`)
+	return err
+}
+
+func retentionDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "expected a block with rules")
+	}
+	rules := make(map[string]time.Duration, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 || len(child.Children) != 0 {
+			return nil, config.NodeErr(child, "expected the mailbox name and period")
+		}
+		if _, ok := rules[child.Name]; ok {
+			return nil, config.NodeErr(child, "duplicate rule for mailbox %s", child.Name)
+		}
+		period, err := config.ParseDuration(child.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		if period <= 0 {
+			return nil, config.NodeErr(child, "period should be positive")
+		}
+		rules[child.Name] = period
+	}
+	return rules, nil
+}
+
+func (store *Storage) SetRetention(username, mailbox string, period time.Duration) error {
+	accountName, err := prepareUsername(username)
+	if err != nil {
+		return err
+	}
+	accountName = strings.ToLower(accountName)
+
+	if period < 0 {
+		_, err := store.Back.DB.Exec(store.rebind(`DELETE FROM maddy_retention WHERE username = ? AND mailbox = ?`),
+			accountName, mailbox)
+		return err
+	}
+
+	res, err := store.Back.DB.Exec(store.rebind(`UPDATE maddy_retention SET max_age = ? WHERE username = ? AND mailbox = ?`),
+		int64(period/time.Second), accountName, mailbox)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 0 {
+		return nil
+	}
+
+	_, err = store.Back.DB.Exec(store.rebind(`INSERT INTO maddy_retention (username, mailbox, max_age) VALUES (?, ?, ?)`),
+		accountName, mailbox, int64(period/time.Second))
+	return err
+}
+
+func (store *Storage) GetRetention(username string) (map[string]time.Duration, error) {
+	accountName, err := prepareUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	return store.retentionRules(strings.ToLower(accountName))
+}
+
+// retentionRules returns the global rules with per-account overrides
+// applied. Zero period means the removal is disabled for the mailbox.
+func (store *Storage) retentionRules(accountName string) (map[string]time.Duration, error) {
+	rules := make(map[string]time.Duration, len(store.retention))
+	for mbox, period := range store.retention {
+		rules[mbox] = period
+	}
+
+	rows, err := store.Back.DB.Query(store.rebind(`SELECT mailbox, max_age FROM maddy_retention WHERE username = ?`), accountName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			mbox   string
+			maxAge int64
+		)
+		if err := rows.Scan(&mbox, &maxAge); err != nil {
+			return nil, err
+		}
+		rules[mbox] = time.Duration(maxAge) * time.Second
+	}
+	return rules, rows.Err()
+}
+
+// retentionAccounts returns the list of accounts the retention rules should
+// be checked for.
+func (store *Storage) retentionAccounts() ([]string, error) {
+	if len(store.retention) != 0 {
+		return store.Back.ListUsers()
+	}
+
+	// Only per-account rules are defined.
+	rows, err := store.Back.DB.Query(`SELECT DISTINCT username FROM maddy_retention WHERE max_age != 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var accts []string
+	for rows.Next() {
+		var acct string
+		if err := rows.Scan(&acct); err != nil {
+			return nil, err
+		}
+		accts = append(accts, acct)
+	}
+	return accts, rows.Err()
+}
+
+func (store *Storage) retentionLoop() {
+	defer close(store.retentionDone)
+
+	t := store.clock.NewTimer(store.retentionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+			store.runRetention(store.clock.Now())
+			t.Reset(store.retentionInterval)
+		case <-store.retentionStop:
+			return
+		}
+	}
+}
+
+func (store *Storage) runRetention(now time.Time) {
+	start := store.clock.Now()
+	removed, err := store.expireMessages(now)
+	if err != nil {
+		store.Log.Error("message retention run failed", err, "removed", removed)
+		return
+	}
+	store.Log.Msg("message retention run finished", "removed", removed, "took", store.clock.Now().Sub(start).String())
+}
+
+// expireMessages removes messages that are older than the retention period
+// of their mailbox and returns the amount of removed messages.
+func (store *Storage) expireMessages(now time.Time) (int, error) {
+	accts, err := store.retentionAccounts()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, acct := range accts {
+		rules, err := store.retentionRules(acct)
+		if err != nil {
+			return removed, err
+		}
+
+		mboxes := make([]string, 0, len(rules))
+		for mbox := range rules {
+			mboxes = append(mboxes, mbox)
+		}
+		sort.Strings(mboxes)
+
+		for _, mbox := range mboxes {
+			if rules[mbox] == 0 {
+				continue
+			}
+			n, err := store.expireMailbox(acct, mbox, now.Add(-rules[mbox]))
+			removed += n
+			if err != nil {
+				return removed, fmt.Errorf("%s/%s: %w", acct, mbox, err)
+			}
+			if n != 0 {
+				store.Log.DebugMsg("removed expired messages", "username", acct, "mailbox", mbox, "count", n)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// expireMailbox removes messages stored before the cutoff time.
+//
+// Messages are removed in batches of retentionBatch messages using separate
+// transactions to avoid locking the tables for a long time. Removal is done
+// via go-imap-sql so connected IMAP clients get EXPUNGE updates.
+func (store *Storage) expireMailbox(accountName, mboxName string, cutoff time.Time) (int, error) {
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		if err == imapsql.ErrUserDoesntExists {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			store.Log.Error("logout failed", err, "username", accountName)
+		}
+	}()
+
+	mbox, err := u.GetMailbox(mboxName)
+	if err != nil {
+		if err == backend.ErrNoSuchMailbox {
+			return 0, nil
+		}
+		return 0, err
+	}
+	sqlMbox, ok := mbox.(*imapsql.Mailbox)
+	if !ok {
+		return 0, fmt.Errorf("unexpected mailbox type: %T", mbox)
+	}
+
+	removed := 0
+	for {
+		uids, err := store.expiredUIDs(accountName, mboxName, cutoff)
+		if err != nil {
+			return removed, err
+		}
+		if len(uids) == 0 {
+			return removed, nil
+		}
+
+		seq := &imap.SeqSet{}
+		for _, uid := range uids {
+			seq.AddNum(uid)
+		}
+		if err := sqlMbox.DelMessages(true, seq); err != nil {
+			return removed, err
+		}
+		removed += len(uids)
+
+		if len(uids) < store.retentionBatch {
+			return removed, nil
+		}
+	}
+}
+
+func (store *Storage) expiredUIDs(accountName, mboxName string, cutoff time.Time) ([]uint32, error) {
+	rows, err := store.Back.DB.Query(store.rebind(`
+		SELECT msgs.msgId
+		FROM msgs
+		INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+		INNER JOIN users ON mboxes.uid = users.id
+		WHERE users.username = ? AND mboxes.name = ? AND msgs.date < ?
+		ORDER BY msgs.msgId
+		LIMIT ?`), accountName, mboxName, cutoff.Unix(), store.retentionBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uids := make([]uint32, 0, store.retentionBatch)
+	for rows.Next() {
+		var uid sql.NullInt64
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uint32(uid.Int64))
+	}
+	return uids, rows.Err()
+}
@@ -0,0 +1,196 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package imapsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// backdateMessages changes the stored date of all messages in the mailbox.
+func backdateMessages(t *testing.T, store *Storage, acct, mboxName string, date time.Time) {
+	t.Helper()
+	_, err := store.Back.DB.Exec(`
+		UPDATE msgs SET date = ? WHERE mboxId = (
+			SELECT mboxes.id FROM mboxes
+			INNER JOIN users ON mboxes.uid = users.id
+			WHERE users.username = ? AND mboxes.name = ?
+		)`, date.Unix(), acct, mboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	store := testStorage(t, "test@example.org", "keep@example.org")
+	store.retention = map[string]time.Duration{"INBOX": 30 * 24 * time.Hour}
+	store.retentionBatch = 2
+
+	for i := 0; i < 3; i++ {
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org", "keep@example.org"})
+	}
+	backdateMessages(t, store, "test@example.org", "INBOX", time.Now().Add(-31*24*time.Hour))
+	backdateMessages(t, store, "keep@example.org", "INBOX", time.Now().Add(-31*24*time.Hour))
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	if err := store.SetRetention("keep@example.org", "INBOX", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.expireMessages(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Fatal("Wrong amount of removed messages:", removed)
+	}
+	if hdrs := mboxHeaders(t, store, "test@example.org", "INBOX"); len(hdrs) != 1 {
+		t.Fatal("Wrong amount of remaining messages:", len(hdrs))
+	}
+	if hdrs := mboxHeaders(t, store, "keep@example.org", "INBOX"); len(hdrs) != 3 {
+		t.Fatal("Messages removed despite the override:", len(hdrs))
+	}
+
+	// Reset to the global rule.
+	if err := store.SetRetention("keep@example.org", "INBOX", -1); err != nil {
+		t.Fatal(err)
+	}
+	removed, err = store.expireMessages(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Fatal("Wrong amount of removed messages:", removed)
+	}
+}
+
+func TestRetention_AccountOnly(t *testing.T) {
+	store := testStorage(t, "test@example.org", "other@example.org")
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org", "other@example.org"})
+	backdateMessages(t, store, "test@example.org", "INBOX", time.Now().Add(-2*time.Hour))
+	backdateMessages(t, store, "other@example.org", "INBOX", time.Now().Add(-2*time.Hour))
+
+	if err := store.SetRetention("TEST@example.org", "INBOX", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Rule for a mailbox that does not exist should be ignored.
+	if err := store.SetRetention("test@example.org", "Trash", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := store.GetRetention("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules["INBOX"] != time.Hour || rules["Trash"] != time.Hour {
+		t.Fatal("Wrong rules:", rules)
+	}
+
+	removed, err := store.expireMessages(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatal("Wrong amount of removed messages:", removed)
+	}
+	if hdrs := mboxHeaders(t, store, "other@example.org", "INBOX"); len(hdrs) != 1 {
+		t.Fatal("Message removed for account without rules")
+	}
+}
+
+func TestRetention_Updates(t *testing.T) {
+	store := testStorage(t, "test@example.org")
+	store.retention = map[string]time.Duration{"INBOX": time.Hour}
+	upds := store.Back.Updates()
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	backdateMessages(t, store, "test@example.org", "INBOX", time.Now().Add(-2*time.Hour))
+
+	// Drain updates generated by the delivery.
+	for len(upds) != 0 {
+		<-upds
+	}
+
+	if _, err := store.expireMessages(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	expunges := 0
+	for len(upds) != 0 {
+		upd := <-upds
+		if upd, ok := upd.(*backend.ExpungeUpdate); ok {
+			if upd.Username() != "test@example.org" || upd.Mailbox() != "INBOX" {
+				t.Error("Wrong update:", upd.Username(), upd.Mailbox())
+			}
+			expunges++
+		}
+	}
+	if expunges != 2 {
+		t.Fatal("Wrong amount of EXPUNGE updates:", expunges)
+	}
+}
+
+func TestRetention_Loop(t *testing.T) {
+	store := testStorage(t, "test@example.org")
+	store.retention = map[string]time.Duration{"INBOX": time.Hour}
+	store.retentionInterval = time.Hour
+
+	start := time.Unix(1600000000, 0)
+	clk := clock.NewFake(start)
+	store.clock = clk
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	backdateMessages(t, store, "test@example.org", "INBOX", start)
+
+	store.retentionStop = make(chan struct{})
+	store.retentionDone = make(chan struct{})
+	go store.retentionLoop()
+	defer func() {
+		close(store.retentionStop)
+		<-store.retentionDone
+	}()
+
+	// The timer is stopped while the run is in progress, so waiting for it
+	// to be armed again means the run is finished.
+	clk.BlockUntil(1)
+	clk.Advance(59 * time.Minute)
+	if hdrs := mboxHeaders(t, store, "test@example.org", "INBOX"); len(hdrs) != 1 {
+		t.Fatal("Message removed before the first run")
+	}
+
+	// First run: the message is exactly one hour old, not expired yet.
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if hdrs := mboxHeaders(t, store, "test@example.org", "INBOX"); len(hdrs) != 1 {
+		t.Fatal("Message removed before it expired")
+	}
+
+	clk.Advance(time.Hour)
+	clk.BlockUntil(1)
+	if hdrs := mboxHeaders(t, store, "test@example.org", "INBOX"); len(hdrs) != 0 {
+		t.Fatal("Expired message was not removed:", len(hdrs))
+	}
+}
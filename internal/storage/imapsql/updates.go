@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package imapsql
+
+import (
+	"github.com/emersion/go-imap/backend"
+)
+
+// Updates returns a new channel that receives all IMAP updates generated by
+// the storage.
+//
+// Each call creates a separate subscription, this allows multiple IMAP
+// endpoints to share the storage instance and still see all updates,
+// including ones caused by message delivery through the same instance.
+// Callers should call Updates only once and reuse the returned channel.
+func (store *Storage) Updates() <-chan backend.Update {
+	store.updLck.Lock()
+	defer store.updLck.Unlock()
+
+	if store.updates == nil {
+		store.updates = store.Back.Updates()
+	}
+	if store.updSubs == nil {
+		go store.dispatchUpdates(store.updates)
+	}
+
+	sub := make(chan backend.Update, 20)
+	store.updSubs = append(store.updSubs, sub)
+	return sub
+}
+
+func (store *Storage) dispatchUpdates(src <-chan backend.Update) {
+	for upd := range src {
+		store.updLck.Lock()
+		subs := store.updSubs
+		store.updLck.Unlock()
+
+		// Avoid copying in the common case of a single IMAP endpoint.
+		if len(subs) == 1 {
+			subs[0] <- upd
+			continue
+		}
+
+		for _, sub := range subs {
+			sub <- cloneUpdate(upd)
+		}
+	}
+
+	store.updLck.Lock()
+	defer store.updLck.Unlock()
+	for _, sub := range store.updSubs {
+		close(sub)
+	}
+}
+
+// cloneUpdate returns a copy of the update with a separate Done channel since
+// each consumer closes it once the update is sent to its clients.
+func cloneUpdate(upd backend.Update) backend.Update {
+	base := backend.NewUpdate(upd.Username(), upd.Mailbox())
+	switch upd := upd.(type) {
+	case *backend.StatusUpdate:
+		return &backend.StatusUpdate{Update: base, StatusResp: upd.StatusResp}
+	case *backend.MailboxUpdate:
+		return &backend.MailboxUpdate{Update: base, MailboxStatus: upd.MailboxStatus}
+	case *backend.MailboxInfoUpdate:
+		return &backend.MailboxInfoUpdate{Update: base, MailboxInfo: upd.MailboxInfo}
+	case *backend.MessageUpdate:
+		return &backend.MessageUpdate{Update: base, Message: upd.Message}
+	case *backend.ExpungeUpdate:
+		return &backend.ExpungeUpdate{Update: base, SeqNum: upd.SeqNum}
+	default:
+		return upd
+	}
+}
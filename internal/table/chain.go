@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Chain is a table that looks up the key in multiple tables in order and
+// returns the first found value.
+type Chain struct {
+	modName  string
+	instName string
+
+	steps []module.Table
+}
+
+func NewChain(modName, instName string, _, _ []string) (module.Module, error) {
+	return &Chain{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (c *Chain) Init(cfg *config.Map) error {
+	cfg.Callback("step", func(m *config.Map, node config.Node) error {
+		var tbl module.Table
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return err
+		}
+
+		c.steps = append(c.steps, tbl)
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(c.steps) == 0 {
+		return config.NodeErr(cfg.Block, "at least one step is required")
+	}
+	return nil
+}
+
+func (c *Chain) Name() string {
+	return c.modName
+}
+
+func (c *Chain) InstanceName() string {
+	return c.instName
+}
+
+// Lookup implements module.Table.
+//
+// The lookup error in any step is returned as is, the next steps are not
+// tried since the key could be present in the failed table.
+func (c *Chain) Lookup(key string) (string, bool, error) {
+	for _, step := range c.steps {
+		val, ok, err := step.Lookup(key)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			return val, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// LookupMulti implements module.MultiTable.
+//
+// Values from the first step that contains the key are returned.
+func (c *Chain) LookupMulti(key string) ([]string, error) {
+	for _, step := range c.steps {
+		if multi, ok := step.(module.MultiTable); ok {
+			vals, err := multi.LookupMulti(key)
+			if err != nil {
+				return nil, err
+			}
+			if len(vals) != 0 {
+				return vals, nil
+			}
+			continue
+		}
+
+		val, ok, err := step.Lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return []string{val}, nil
+		}
+	}
+	return nil, nil
+}
+
+func init() {
+	module.Register("table.chain", NewChain)
+}
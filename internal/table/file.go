@@ -39,12 +39,16 @@ type File struct {
 	instName string
 	file     string
 
-	m      map[string]string
-	mLck   sync.RWMutex
-	mStamp time.Time
+	caseInsensitive bool
+
+	m    map[string]string
+	mLck sync.RWMutex
+	// Modification time of the loaded file, zero if it does not exist.
+	modTime time.Time
 
 	stopReloader chan struct{}
 	forceReload  chan struct{}
+	stopWatch    func() error
 
 	log log.Logger
 }
@@ -59,6 +63,8 @@ func NewFile(_, instName string, _, inlineArgs []string) (module.Module, error)
 	}
 
 	switch len(inlineArgs) {
+	case 0:
+		// Path is specified using the 'file' directive.
 	case 1:
 		m.file = inlineArgs[0]
 	default:
@@ -79,6 +85,7 @@ func (f *File) InstanceName() string {
 func (f *File) Init(cfg *config.Map) error {
 	var file string
 	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.Bool("case_insensitive", false, false, &f.caseInsensitive)
 	cfg.String("file", false, false, "", &file)
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -90,15 +97,26 @@ func (f *File) Init(cfg *config.Map) error {
 		}
 		f.file = file
 	}
+	if f.file == "" {
+		return fmt.Errorf("%s: file path is not specified", FileModName)
+	}
 
-	if err := readFile(f.file, f.m); err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-		f.log.Printf("ignoring non-existent file: %s", f.file)
+	if err := f.reload(); err != nil {
+		return err
 	}
 
-	go f.reloader()
+	if config.CheckOnly {
+		return nil
+	}
+
+	changes := make(chan struct{}, 1)
+	stopWatch, err := watchFile(f.file, changes)
+	if err != nil {
+		f.log.Debugf("cannot watch file, relying on periodic checks: %v", err)
+	}
+	f.stopWatch = stopWatch
+
+	go f.reloader(changes)
 	hooks.AddHook(hooks.EventReload, func() {
 		f.forceReload <- struct{}{}
 	})
@@ -108,7 +126,7 @@ func (f *File) Init(cfg *config.Map) error {
 
 var reloadInterval = 15 * time.Second
 
-func (f *File) reloader() {
+func (f *File) reloader(changes <-chan struct{}) {
 	defer func() {
 		if err := recover(); err != nil {
 			stack := debug.Stack()
@@ -116,26 +134,19 @@ func (f *File) reloader() {
 		}
 	}()
 
+	// File changes are usually detected using watchFile, periodic checks
+	// are used in case it is not available on this platform or misses a
+	// change (e.g. the directory is replaced).
 	t := time.NewTicker(reloadInterval)
+	defer t.Stop()
 
 	for {
 		select {
 		case <-t.C:
-			var latestStamp time.Time
-			info, err := os.Stat(f.file)
-			if err != nil {
-				if os.IsNotExist(err) {
-					f.mLck.Lock()
-					f.m = map[string]string{}
-					f.mStamp = time.Now()
-					f.mLck.Unlock()
-					continue
-				}
-				f.log.Printf("%v", err)
-			}
-			if info.ModTime().After(latestStamp) {
-				latestStamp = info.ModTime()
+			if !f.fileChanged() {
+				continue
 			}
+		case <-changes:
 		case <-f.forceReload:
 		case <-f.stopReloader:
 			f.stopReloader <- struct{}{}
@@ -143,26 +154,76 @@ func (f *File) reloader() {
 		}
 
 		f.log.Debugf("reloading")
+		if err := f.reload(); err != nil {
+			f.log.Println(err)
+		}
+	}
+}
 
-		newm := make(map[string]string, len(f.m)+5)
-		if err := readFile(f.file, newm); err != nil {
-			if os.IsNotExist(err) {
-				f.log.Printf("ignoring non-existent file: %s", f.file)
-				continue
-			}
-
+// fileChanged reports whether modification time of the file differs from the
+// one of the loaded file.
+func (f *File) fileChanged() bool {
+	var modTime time.Time
+	info, err := os.Stat(f.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
 			f.log.Println(err)
-			continue
+			return false
+		}
+	} else {
+		modTime = info.ModTime()
+	}
+
+	f.mLck.RLock()
+	defer f.mLck.RUnlock()
+	return !modTime.Equal(f.modTime)
+}
+
+// reload reads the file and replaces the table contents. If the file does
+// not exist, the table becomes empty. If the file contains syntax errors, the
+// table is not changed.
+func (f *File) reload() error {
+	var modTime time.Time
+	newm := make(map[string]string, len(f.m)+5)
+
+	info, err := os.Stat(f.file)
+	if err == nil {
+		modTime = info.ModTime()
+		err = readFile(f.file, newm)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// Remember the modification time so periodic checks do not
+			// report the same error again until the file is fixed.
+			f.mLck.Lock()
+			f.modTime = modTime
+			f.mLck.Unlock()
+			return err
 		}
+		f.log.Printf("ignoring non-existent file: %s", f.file)
+	}
 
-		f.mLck.Lock()
-		f.m = newm
-		f.mStamp = time.Now()
-		f.mLck.Unlock()
+	if f.caseInsensitive {
+		folded := make(map[string]string, len(newm))
+		for k, v := range newm {
+			folded[strings.ToLower(k)] = v
+		}
+		newm = folded
 	}
+
+	f.mLck.Lock()
+	f.m = newm
+	f.modTime = modTime
+	f.mLck.Unlock()
+	return nil
 }
 
 func (f *File) Close() error {
+	if f.stopWatch != nil {
+		if err := f.stopWatch(); err != nil {
+			return err
+		}
+	}
 	f.stopReloader <- struct{}{}
 	<-f.stopReloader
 	return nil
@@ -219,10 +280,25 @@ func (f *File) Lookup(val string) (string, bool, error) {
 	usedFile := f.m
 	f.mLck.RUnlock()
 
+	if f.caseInsensitive {
+		val = strings.ToLower(val)
+	}
 	newVal, ok := usedFile[val]
 	return newVal, ok, nil
 }
 
+func (f *File) Keys() ([]string, error) {
+	f.mLck.RLock()
+	usedFile := f.m
+	f.mLck.RUnlock()
+
+	keys := make([]string, 0, len(usedFile))
+	for k := range usedFile {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
 func init() {
 	module.RegisterDeprecated("file", "table.file", NewFile)
 	module.Register(FileModName, NewFile)
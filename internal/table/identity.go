@@ -44,7 +44,7 @@ func (s *Identity) Name() string {
 }
 
 func (s *Identity) InstanceName() string {
-	return s.modName
+	return s.instName
 }
 
 func (s *Identity) Lookup(key string) (string, bool, error) {
@@ -92,7 +92,7 @@ func (r *Regexp) Name() string {
 }
 
 func (r *Regexp) InstanceName() string {
-	return r.modName
+	return r.instName
 }
 
 func (r *Regexp) Lookup(key string) (string, bool, error) {
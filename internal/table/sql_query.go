@@ -32,6 +32,8 @@ type SQL struct {
 	modName  string
 	instName string
 
+	caseInsensitive bool
+
 	db     *sql.DB
 	lookup *sql.Stmt
 	add    *sql.Stmt
@@ -72,6 +74,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 
 	cfg.String("lookup", false, true, "", &lookupQuery)
+	cfg.Bool("case_insensitive", false, false, &s.caseInsensitive)
 
 	cfg.String("add", false, false, "", &addQuery)
 	cfg.String("list", false, false, "", &listQuery)
@@ -85,6 +88,9 @@ func (s *SQL) Init(cfg *config.Map) error {
 	if err != nil {
 		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
 	}
+	if config.CheckOnly {
+		return db.Close()
+	}
 	s.db = db
 
 	for _, init := range initQueries {
@@ -130,9 +136,16 @@ func (s *SQL) Close() error {
 	return s.db.Close()
 }
 
+func (s *SQL) key(k string) string {
+	if s.caseInsensitive {
+		return strings.ToLower(k)
+	}
+	return k
+}
+
 func (s *SQL) Lookup(val string) (string, bool, error) {
 	var repl string
-	row := s.lookup.QueryRow(val)
+	row := s.lookup.QueryRow(s.key(val))
 	if err := row.Scan(&repl); err != nil {
 		if err == sql.ErrNoRows {
 			return "", false, nil
@@ -142,6 +155,26 @@ func (s *SQL) Lookup(val string) (string, bool, error) {
 	return repl, true, nil
 }
 
+func (s *SQL) LookupMulti(val string) ([]string, error) {
+	rows, err := s.lookup.Query(s.key(val))
+	if err != nil {
+		return nil, fmt.Errorf("%s: lookup %s: %w", s.modName, val, err)
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var repl string
+		if err := rows.Scan(&repl); err != nil {
+			return nil, fmt.Errorf("%s: lookup %s: %w", s.modName, val, err)
+		}
+		res = append(res, repl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: lookup %s: %w", s.modName, val, err)
+	}
+	return res, nil
+}
+
 func (s *SQL) Keys() ([]string, error) {
 	if s.list == nil {
 		return nil, fmt.Errorf("%s: table is not mutable (no 'list' query)", s.modName)
@@ -168,7 +201,7 @@ func (s *SQL) RemoveKey(k string) error {
 		return fmt.Errorf("%s: table is not mutable (no 'del' query)", s.modName)
 	}
 
-	_, err := s.del.Exec(sql.Named("key", k))
+	_, err := s.del.Exec(sql.Named("key", s.key(k)))
 	if err != nil {
 		return fmt.Errorf("%s: del %s: %w", s.modName, k, err)
 	}
@@ -183,8 +216,8 @@ func (s *SQL) SetKey(k, v string) error {
 		return fmt.Errorf("%s: table is not mutable (no 'add' query)", s.modName)
 	}
 
-	if _, err := s.add.Exec(sql.Named("key", k), sql.Named("value", v)); err != nil {
-		if _, err := s.set.Exec(sql.Named("key", k), sql.Named("value", v)); err != nil {
+	if _, err := s.add.Exec(sql.Named("key", s.key(k)), sql.Named("value", v)); err != nil {
+		if _, err := s.set.Exec(sql.Named("key", s.key(k)), sql.Named("value", v)); err != nil {
 			return fmt.Errorf("%s: add %s: %w", s.modName, k, err)
 		}
 		return nil
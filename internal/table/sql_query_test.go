@@ -82,3 +82,88 @@ func TestSQL(t *testing.T) {
 	check("user2", "", false, false)
 	check("user3", "", false, true)
 }
+
+func TestSQL_LookupMulti(t *testing.T) {
+	path := testutils.Dir(t)
+	mod, err := NewSQL("sql_table", "", nil, nil)
+	if err != nil {
+		t.Fatal("Module create failed:", err)
+	}
+	tbl := mod.(*SQL)
+	err = tbl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "driver",
+				Args: []string{"sqlite3"},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(path, "test.db")},
+			},
+			{
+				Name: "init",
+				Args: []string{
+					"CREATE TABLE testTbl (key TEXT, value TEXT)",
+					"INSERT INTO testTbl VALUES ('postmaster', 'admin@example.org')",
+					"INSERT INTO testTbl VALUES ('postmaster', 'backup@example.org')",
+				},
+			},
+			{
+				Name: "lookup",
+				Args: []string{"SELECT value FROM testTbl WHERE key = $key ORDER BY value"},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+
+	res, err := tbl.LookupMulti("postmaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0] != "admin@example.org" || res[1] != "backup@example.org" {
+		t.Errorf("Result mismatch: %v", res)
+	}
+
+	res, err = tbl.LookupMulti("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("Unexpected result for missing key: %v", res)
+	}
+}
+
+func TestSQL_Common(t *testing.T) {
+	for _, c := range []struct {
+		caseInsensitive string
+		lookup          string
+	}{
+		{"no", "SELECT value FROM testTbl WHERE key = $1"},
+		// Lookup key is converted to lower case by the module, so the query
+		// needs to do the same for stored keys.
+		{"yes", "SELECT value FROM testTbl WHERE lower(key) = $1"},
+	} {
+		c := c
+		t.Run("case_insensitive "+c.caseInsensitive, func(t *testing.T) {
+			tbl := initTable(t, NewSQL, nil, `
+				driver sqlite3
+				dsn `+filepath.Join(testutils.Dir(t), "test.db")+`
+				init "CREATE TABLE testTbl (key TEXT PRIMARY KEY, value TEXT)" \
+					"INSERT INTO testTbl VALUES ('user1', 'value1')" \
+					"INSERT INTO testTbl VALUES ('User2', 'value2')"
+				lookup "`+c.lookup+`"
+				case_insensitive `+c.caseInsensitive)
+			testTable(t, tbl, c.caseInsensitive == "yes")
+
+			// Lookup failure should not look like a missing key.
+			if _, err := tbl.(*SQL).db.Exec("DROP TABLE testTbl"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := tbl.Lookup("user1"); err == nil {
+				t.Error("expected lookup error for a dropped table")
+			}
+		})
+	}
+}
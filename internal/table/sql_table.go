@@ -122,6 +122,10 @@ func (s *SQLTable) Lookup(val string) (string, bool, error) {
 	return s.wrapped.Lookup(val)
 }
 
+func (s *SQLTable) LookupMulti(val string) ([]string, error) {
+	return s.wrapped.LookupMulti(val)
+}
+
 func (s *SQLTable) Keys() ([]string, error) {
 	return s.wrapped.Keys()
 }
@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package table
 
 import (
+	"strings"
+
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
 )
@@ -27,7 +29,8 @@ type Static struct {
 	modName  string
 	instName string
 
-	m map[string]string
+	caseInsensitive bool
+	m               map[string]string
 }
 
 func NewStatic(modName, instName string, _, _ []string) (module.Module, error) {
@@ -39,15 +42,32 @@ func NewStatic(modName, instName string, _, _ []string) (module.Module, error) {
 }
 
 func (s *Static) Init(cfg *config.Map) error {
+	var entries []config.Node
+	cfg.Bool("case_insensitive", false, false, &s.caseInsensitive)
 	cfg.Callback("entry", func(m *config.Map, node config.Node) error {
 		if len(node.Args) != 2 {
 			return config.NodeErr(node, "expected exactly two arguments")
 		}
-		s.m[node.Args[0]] = node.Args[1]
+		entries = append(entries, node)
 		return nil
 	})
-	_, err := cfg.Process()
-	return err
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	// Entries are added after Process to make case_insensitive work
+	// regardless of the directives order.
+	for _, node := range entries {
+		s.m[s.key(node.Args[0])] = node.Args[1]
+	}
+	return nil
+}
+
+func (s *Static) key(k string) string {
+	if s.caseInsensitive {
+		return strings.ToLower(k)
+	}
+	return k
 }
 
 func (s *Static) Name() string {
@@ -55,14 +75,22 @@ func (s *Static) Name() string {
 }
 
 func (s *Static) InstanceName() string {
-	return s.modName
+	return s.instName
 }
 
 func (s *Static) Lookup(key string) (string, bool, error) {
-	val, ok := s.m[key]
+	val, ok := s.m[s.key(key)]
 	return val, ok, nil
 }
 
+func (s *Static) Keys() ([]string, error) {
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
 func init() {
 	module.RegisterDeprecated("static", "table.static", NewStatic)
 	module.Register("table.static", NewStatic)
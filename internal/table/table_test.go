@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// initTable creates and initializes the table module using configuration
+// block contents in cfg.
+func initTable(t *testing.T, newMod module.FuncNewModule, inlineArgs []string, cfg string) module.Table {
+	t.Helper()
+
+	nodes, err := parser.Read(strings.NewReader("table {\n"+cfg+"\n}"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := newMod("table.test", "", nil, inlineArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, nodes[0])); err != nil {
+		t.Fatal(err)
+	}
+	if closer, ok := mod.(io.Closer); ok {
+		t.Cleanup(func() {
+			closer.Close()
+		})
+	}
+	return mod.(module.Table)
+}
+
+// testTable checks the behavior common to all table modules. The table
+// should contain the following entries:
+//
+//	user1: value1
+//	User2: value2
+//
+// If caseInsensitive is true, the table is expected to be configured to
+// ignore case of keys.
+func testTable(t *testing.T, tbl module.Table, caseInsensitive bool) {
+	t.Helper()
+
+	check := func(key, expectedVal string, expectedOk bool) {
+		t.Helper()
+
+		val, ok, err := tbl.Lookup(key)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", key, err)
+			return
+		}
+		if ok != expectedOk {
+			t.Errorf("%s: want ok = %v, got %v", key, expectedOk, ok)
+		}
+		if val != expectedVal {
+			t.Errorf("%s: want %q, got %q", key, expectedVal, val)
+		}
+	}
+
+	check("user1", "value1", true)
+	check("missing", "", false)
+	check("", "", false)
+	if caseInsensitive {
+		check("User2", "value2", true)
+		check("user2", "value2", true)
+		check("USER1", "value1", true)
+	} else {
+		check("User2", "value2", true)
+		check("user2", "", false)
+		check("USER1", "", false)
+	}
+}
+
+func TestTables(t *testing.T) {
+	for _, caseInsensitive := range []string{"no", "yes"} {
+		caseInsensitive := caseInsensitive
+		t.Run("case_insensitive "+caseInsensitive, func(t *testing.T) {
+			t.Run("static", func(t *testing.T) {
+				tbl := initTable(t, NewStatic, nil, `
+					case_insensitive `+caseInsensitive+`
+					entry user1 value1
+					entry User2 value2`)
+				testTable(t, tbl, caseInsensitive == "yes")
+			})
+			t.Run("file", func(t *testing.T) {
+				path := filepath.Join(testutils.Dir(t), "table")
+				if err := ioutil.WriteFile(path, []byte("user1: value1\nUser2: value2\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				tbl := initTable(t, NewFile, nil, `
+					file `+path+`
+					case_insensitive `+caseInsensitive)
+				testTable(t, tbl, caseInsensitive == "yes")
+			})
+			t.Run("chain", func(t *testing.T) {
+				tbl := initTable(t, NewChain, nil, `
+					step table.static {
+						case_insensitive `+caseInsensitive+`
+						entry user1 value1
+					}
+					step table.static {
+						case_insensitive `+caseInsensitive+`
+						entry user1 shadowed
+						entry User2 value2
+					}`)
+				testTable(t, tbl, caseInsensitive == "yes")
+			})
+		})
+	}
+}
+
+func TestChain_Error(t *testing.T) {
+	lookupErr := errors.New("lookup failed")
+	chain := &Chain{
+		steps: []module.Table{
+			testutils.Table{M: map[string]string{"user1": "value1"}},
+			testutils.Table{M: map[string]string{}, Err: lookupErr},
+			testutils.Table{M: map[string]string{"user2": "value2"}},
+		},
+	}
+
+	// Found before the failing step.
+	val, ok, err := chain.Lookup("user1")
+	if err != nil || !ok || val != "value1" {
+		t.Errorf("user1: want value1, true, nil, got %v, %v, %v", val, ok, err)
+	}
+
+	// The error is not treated as a missing key, next steps are not tried.
+	_, ok, err = chain.Lookup("user2")
+	if !errors.Is(err, lookupErr) {
+		t.Errorf("user2: want lookup error, got %v", err)
+	}
+	if ok {
+		t.Error("user2: want ok = false")
+	}
+	if _, err := chain.LookupMulti("user2"); !errors.Is(err, lookupErr) {
+		t.Errorf("user2: want lookup error from LookupMulti, got %v", err)
+	}
+}
+
+func TestChain_LookupMulti(t *testing.T) {
+	tbl := initTable(t, NewChain, nil, `
+		step table.static {
+			entry user1 value1
+		}
+		step table.static {
+			entry user2 value2
+		}`)
+
+	vals, err := tbl.(module.MultiTable).LookupMulti("user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || vals[0] != "value2" {
+		t.Errorf("want [value2], got %v", vals)
+	}
+	vals, err = tbl.(module.MultiTable).LookupMulti("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 0 {
+		t.Errorf("want no values, got %v", vals)
+	}
+}
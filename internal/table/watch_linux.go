@@ -0,0 +1,91 @@
+//+build linux
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchFile starts watching for changes of the file at path using inotify.
+// A value is sent to changes (without blocking) each time the file is
+// written, created, replaced or removed. Watching stops when the returned
+// function is called.
+//
+// The directory containing the file is watched instead of the file itself so
+// files replaced using rename (as most editors do) are handled too.
+func watchFile(path string, changes chan<- struct{}) (stop func() error, err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, name := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// Non-blocking descriptor is managed by the runtime poller, so Read does
+	// not block the OS thread and Close interrupts it.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	go func() {
+		buf := make([]byte, 16*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+
+			changed := false
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + unix.SizeofInotifyEvent
+				nameEnd := nameStart + int(ev.Len)
+				if nameEnd > n {
+					break
+				}
+				if strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00") == name {
+					changed = true
+				}
+				offset = nameEnd
+			}
+
+			if changed {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return f.Close, nil
+}
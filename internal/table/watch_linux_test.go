@@ -0,0 +1,103 @@
+//+build linux
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := testutils.Dir(t)
+	path := filepath.Join(dir, "table")
+
+	changes := make(chan struct{}, 1)
+	stop, err := watchFile(path, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	expectChange := func() {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change notification")
+		}
+
+		// Single operation can generate multiple events (e.g. create and
+		// write), drain notifications for them.
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-changes:
+		default:
+		}
+	}
+	expectNoChange := func() {
+		t.Helper()
+		select {
+		case <-changes:
+			t.Error("unexpected change notification")
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+
+	// Other files in the same directory are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("a: b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange()
+
+	if err := ioutil.WriteFile(path, []byte("a: b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectChange()
+
+	// Replacing the file using rename.
+	if err := ioutil.WriteFile(path+".new", []byte("a: c"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange()
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	expectChange()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expectChange()
+
+	// No notifications after stop.
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("a: d"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange()
+}
@@ -0,0 +1,555 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package maildir implements the delivery target that stores messages in
+// per-user Maildir++ directories.
+//
+// Implemented interfaces:
+// - module.DeliveryTarget
+// - module.PartialDelivery
+package maildir
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/utf7"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.maildir"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	pathTemplate string
+	junkFolder   string
+	autoCreate   bool
+	fileMode     os.FileMode
+	dirMode      os.FileMode
+	// Owner of created files and directories, -1 if it should not be
+	// changed.
+	uid, gid int
+
+	// Hostname used in the names of message files.
+	hostname string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		uid:      -1,
+		gid:      -1,
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		t.pathTemplate = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: at most one argument is allowed", modName)
+	}
+	return t, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: malformed file mode: %v", modName, err)
+	}
+	if mode&^0o777 != 0 {
+		return 0, fmt.Errorf("%s: only permission bits are allowed in the file mode", modName)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupOwner parses the owner directive value: user name or UID with
+// optional group name or GID separated by a colon.
+func lookupOwner(value string) (uid, gid int, err error) {
+	parts := strings.SplitN(value, ":", 2)
+
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		u, err = user.LookupId(parts[0])
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("non-numeric UID: %s", u.Uid)
+	}
+
+	gidStr := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			g, err = user.LookupGroupId(parts[1])
+			if err != nil {
+				return -1, -1, err
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return -1, -1, fmt.Errorf("non-numeric GID: %s", gidStr)
+	}
+	return uid, gid, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var fileMode, dirMode, owner string
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("hostname", true, false, "", &t.hostname)
+	cfg.String("path", false, false, t.pathTemplate, &t.pathTemplate)
+	cfg.String("junk_folder", false, false, "Junk", &t.junkFolder)
+	cfg.Bool("autocreate", false, true, &t.autoCreate)
+	cfg.String("file_mode", false, false, "0600", &fileMode)
+	cfg.String("dir_mode", false, false, "0700", &dirMode)
+	cfg.String("owner", false, false, "", &owner)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.pathTemplate == "" {
+		return fmt.Errorf("%s: path is required", modName)
+	}
+	if !strings.Contains(t.pathTemplate, "{user}") && !strings.Contains(t.pathTemplate, "{address}") {
+		return fmt.Errorf("%s: path should contain {user} or {address} placeholder", modName)
+	}
+
+	var err error
+	t.fileMode, err = parseMode(fileMode)
+	if err != nil {
+		return err
+	}
+	t.dirMode, err = parseMode(dirMode)
+	if err != nil {
+		return err
+	}
+
+	if owner != "" {
+		t.uid, t.gid, err = lookupOwner(owner)
+		if err != nil {
+			return fmt.Errorf("%s: owner: %v", modName, err)
+		}
+	}
+
+	if t.hostname == "" {
+		t.hostname, err = os.Hostname()
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+	}
+	// Characters that have special meaning in Maildir file names.
+	t.hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(t.hostname)
+
+	return nil
+}
+
+// safePathElem reports whether the value can be used as a single path
+// element without pointing outside of the intended directory.
+func safePathElem(s string) bool {
+	return s != "" && !strings.HasPrefix(s, ".") && !strings.ContainsAny(s, "/\\\x00")
+}
+
+// maildirPath returns the Maildir root directory for the recipient.
+func (t *Target) maildirPath(rcptTo string) (string, error) {
+	addr, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return "", err
+	}
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if !safePathElem(mbox) || (domain != "" && !safePathElem(domain)) {
+		return "", errors.New("address can't be used as a path element")
+	}
+
+	return strings.NewReplacer(
+		"{user}", mbox,
+		"{domain}", domain,
+		"{address}", addr,
+	).Replace(t.pathTemplate), nil
+}
+
+// folderDir returns the directory for the folder in the Maildir++ layout.
+// INBOX is stored in the Maildir root and other folders are stored in the
+// subdirectories with the name prefixed by a dot and hierarchy levels
+// separated by dots.
+func folderDir(root, folder string) (string, error) {
+	if folder == "" || strings.EqualFold(folder, "INBOX") {
+		return root, nil
+	}
+
+	parts := strings.Split(folder, "/")
+	for i, part := range parts {
+		if part == "" || strings.ContainsAny(part, ".\\\x00") {
+			return "", fmt.Errorf("folder name can't be used with Maildir++: %s", folder)
+		}
+		enc, err := utf7.Encoding.NewEncoder().String(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = enc
+	}
+
+	return filepath.Join(root, "."+strings.Join(parts, ".")), nil
+}
+
+func (t *Target) chown(path string) error {
+	if t.uid == -1 {
+		return nil
+	}
+	return os.Chown(path, t.uid, t.gid)
+}
+
+// mkdir creates the directory and its missing parents, all created
+// directories get the configured ownership.
+func (t *Target) mkdir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := t.mkdir(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, t.dirMode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return t.chown(dir)
+}
+
+// ensureMaildir creates the Maildir directory structure if it does not
+// exist.
+func (t *Target) ensureMaildir(dir string, folder bool) error {
+	if _, err := os.Stat(filepath.Join(dir, "new")); err == nil {
+		return nil
+	}
+
+	for _, d := range []string{filepath.Join(dir, "tmp"), filepath.Join(dir, "new"), filepath.Join(dir, "cur")} {
+		if err := t.mkdir(d); err != nil {
+			return err
+		}
+	}
+
+	if folder {
+		// Marker file used by Maildir++ to distinguish folders.
+		marker := filepath.Join(dir, "maildirfolder")
+		f, err := os.OpenFile(marker, os.O_WRONLY|os.O_CREATE, t.fileMode)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := t.chown(marker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var deliveryCounter uint64
+
+// uniqueName generates the unique message file name as described in
+// https://cr.yp.to/proto/maildir.html.
+func (t *Target) uniqueName() string {
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&deliveryCounter, 1), t.hostname)
+}
+
+type rcptMsg struct {
+	rcptTo string
+	root   string
+
+	// Set after the message is written to tmp/.
+	tmpPath string
+	newPath string
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+
+	rcpts []*rcptMsg
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	root, err := d.t.maildirPath(rcptTo)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         501,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+			Message:      "Malformed recipient address",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+
+	for _, r := range d.rcpts {
+		if r.root == root {
+			return nil
+		}
+	}
+
+	if !d.t.autoCreate {
+		if _, err := os.Stat(root); err != nil {
+			if os.IsNotExist(err) {
+				return &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+					Message:      "User does not exist",
+					TargetName:   modName,
+					Err:          err,
+				}
+			}
+			return storeErr(err)
+		}
+	}
+
+	d.rcpts = append(d.rcpts, &rcptMsg{rcptTo: rcptTo, root: root})
+	return nil
+}
+
+func storeErr(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Failed to store the message",
+		TargetName:   modName,
+		Err:          err,
+	}
+}
+
+func (d *delivery) folder(rcptTo string) string {
+	if d.msgMeta.IsQuarantined(rcptTo) {
+		return d.t.junkFolder
+	}
+	return d.msgMeta.RcptFolders[rcptTo]
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// write saves the message into the tmp/ directory of the recipient Maildir.
+// Message is moved into new/ on Commit.
+func (d *delivery) write(r *rcptMsg, header textproto.Header, body buffer.Buffer) error {
+	dir, err := folderDir(r.root, d.folder(r.rcptTo))
+	if err != nil {
+		d.log.Error("cannot use the folder, delivering to INBOX", err, "rcpt", r.rcptTo)
+		dir = r.root
+	}
+	if err := d.t.ensureMaildir(r.root, false); err != nil {
+		return storeErr(err)
+	}
+	if dir != r.root {
+		if err := d.t.ensureMaildir(dir, true); err != nil {
+			return storeErr(err)
+		}
+	}
+
+	name := d.t.uniqueName()
+	tmpPath := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, d.t.fileMode)
+	if err != nil {
+		return storeErr(err)
+	}
+	size, err := writeMsg(f, r.rcptTo, d.mailFrom, header, body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = d.t.chown(tmpPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return storeErr(err)
+	}
+
+	r.tmpPath = tmpPath
+	r.newPath = filepath.Join(dir, "new", name+",S="+strconv.FormatInt(size, 10))
+	return nil
+}
+
+// writeMsg writes the message with delivery headers added to the file.
+//
+// The body is written directly to the file without buffering, so if it is
+// stored in a file too (see buffer.FileBacked), the kernel can copy it
+// without passing the data through the user space.
+func writeMsg(f *os.File, rcptTo, mailFrom string, header textproto.Header, body buffer.Buffer) (int64, error) {
+	cw := &countingWriter{w: f}
+	bw := bufio.NewWriter(cw)
+
+	header = header.Copy()
+	header.Add("Delivered-To", target.SanitizeForHeader(rcptTo))
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(mailFrom)+">")
+	if err := textproto.WriteHeader(bw, header); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+
+	r, err := openBody(body)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return 0, err
+	}
+	return cw.n + n, nil
+}
+
+// openBody opens the file storing the body directly, if there is one.
+func openBody(body buffer.Buffer) (io.ReadCloser, error) {
+	if fb, ok := body.(buffer.FileBacked); ok {
+		if path, ok := fb.FilePath(); ok {
+			return os.Open(path)
+		}
+	}
+	return body.Open()
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "maildir/Body").End()
+
+	for _, r := range d.rcpts {
+		if err := d.write(r, header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BodyNonAtomic implements module.PartialDelivery.
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "maildir/BodyNonAtomic").End()
+
+	for _, r := range d.rcpts {
+		sc.SetStatus(r.rcptTo, d.write(r, header, body))
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	for _, r := range d.rcpts {
+		if r.tmpPath == "" {
+			continue
+		}
+		if err := os.Remove(r.tmpPath); err != nil {
+			d.log.Error("failed to remove the temporary file", err, "rcpt", r.rcptTo)
+		}
+	}
+	return nil
+}
+
+// syncDir makes sure the directory entries (e.g. renamed files) reached the
+// disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	defer trace.StartRegion(ctx, "maildir/Commit").End()
+
+	var firstErr error
+	for _, r := range d.rcpts {
+		if r.tmpPath == "" {
+			continue
+		}
+
+		err := os.Rename(r.tmpPath, r.newPath)
+		if err == nil {
+			err = syncDir(filepath.Dir(r.newPath))
+		}
+		if err != nil {
+			d.log.Error("failed to move the message into new/", err, "rcpt", r.rcptTo)
+			if firstErr == nil {
+				firstErr = storeErr(err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,225 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, dir string) *Target {
+	return &Target{
+		log:          testutils.Logger(t, modName),
+		pathTemplate: filepath.Join(dir, "{domain}", "{user}", "Maildir"),
+		junkFolder:   "Junk",
+		autoCreate:   true,
+		fileMode:     0o600,
+		dirMode:      0o700,
+		uid:          -1,
+		gid:          -1,
+		hostname:     "mx.example.org",
+	}
+}
+
+// readNew returns contents of files in the new/ directory.
+func readNew(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ",S="+strconv.FormatInt(f.Size(), 10)) {
+			t.Errorf("Wrong size in the file name: %s (%d)", f.Name(), f.Size())
+		}
+		blob, err := ioutil.ReadFile(filepath.Join(dir, "new", f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, string(blob))
+	}
+
+	tmpFiles, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Errorf("Files left in tmp/: %v", tmpFiles)
+	}
+	return res
+}
+
+func TestMaildir(t *testing.T) {
+	dir := testutils.Dir(t)
+	tgt := testTarget(t, dir)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "RCPT2@example.org", "rcpt2@example.org"})
+
+	for _, user := range []string{"rcpt1", "rcpt2"} {
+		msgs := readNew(t, filepath.Join(dir, "example.org", user, "Maildir"))
+		if len(msgs) != 1 {
+			t.Fatalf("Expected 1 message for %s, got %d", user, len(msgs))
+		}
+		if !strings.HasSuffix(msgs[0], "A: 1\r\nB: 2\r\n\r\nfoobar\r\n") {
+			t.Errorf("Wrong message for %s: %q", user, msgs[0])
+		}
+		if !strings.HasPrefix(msgs[0], "Return-Path: <sender@example.org>\r\n") {
+			t.Errorf("Missing Return-Path for %s: %q", user, msgs[0])
+		}
+	}
+}
+
+func TestMaildir_FileBody(t *testing.T) {
+	dir := testutils.Dir(t)
+	tgt := testTarget(t, dir)
+
+	bodyPath := filepath.Join(dir, "body")
+	if err := ioutil.WriteFile(bodyPath, []byte("foobar\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	body := buffer.FileBuffer{Path: bodyPath}
+
+	var hdr textproto.Header
+	hdr.Add("A", "1")
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"rcpt1@example.org", "rcpt2@example.org"} {
+		if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := delivery.Body(ctx, hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"rcpt1", "rcpt2"} {
+		msgs := readNew(t, filepath.Join(dir, "example.org", user, "Maildir"))
+		if len(msgs) != 1 || !strings.HasSuffix(msgs[0], "A: 1\r\n\r\nfoobar\r\n") {
+			t.Errorf("Wrong messages for %s: %q", user, msgs)
+		}
+	}
+
+	// The body file is owned by the caller.
+	blob, err := ioutil.ReadFile(bodyPath)
+	if err != nil {
+		t.Fatal("Body file is removed:", err)
+	}
+	if string(blob) != "foobar\r\n" {
+		t.Fatal("Body file is modified:", string(blob))
+	}
+}
+
+func TestMaildir_Folders(t *testing.T) {
+	dir := testutils.Dir(t)
+	tgt := testTarget(t, dir)
+
+	testutils.DoTestDeliveryMeta(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"}, &module.MsgMetadata{
+		RcptFolders: map[string]string{
+			"rcpt1@example.org": "Lists/Почта",
+		},
+		QuarantineRcpts: map[string]struct{}{
+			"rcpt2@example.org": {},
+		},
+	})
+
+	folder := filepath.Join(dir, "example.org", "rcpt1", "Maildir", ".Lists.&BB8EPgRHBEIEMA-")
+	if len(readNew(t, folder)) != 1 {
+		t.Error("Expected message in the folder")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "maildirfolder")); err != nil {
+		t.Error("maildirfolder is not created:", err)
+	}
+	if len(readNew(t, filepath.Join(dir, "example.org", "rcpt2", "Maildir", ".Junk"))) != 1 {
+		t.Error("Expected message in Junk")
+	}
+}
+
+type statusCollector map[string]error
+
+func (sc statusCollector) SetStatus(rcptTo string, err error) {
+	sc[rcptTo] = err
+}
+
+func TestMaildir_PartialFailure(t *testing.T) {
+	dir := testutils.Dir(t)
+	tgt := testTarget(t, dir)
+
+	// Maildir can't be created since there is a file in place of the user
+	// directory.
+	if err := os.MkdirAll(filepath.Join(dir, "example.org"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "example.org", "broken"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, sc, tgt, "sender@example.org", []string{"broken@example.org", "rcpt@example.org"})
+
+	if !exterrors.IsTemporary(sc["broken@example.org"]) {
+		t.Error("Expected temporary error for broken@, got", sc["broken@example.org"])
+	}
+	if err := sc["rcpt@example.org"]; err != nil {
+		t.Fatal("Unexpected error for rcpt@:", err)
+	}
+	if len(readNew(t, filepath.Join(dir, "example.org", "rcpt", "Maildir"))) != 1 {
+		t.Error("Expected message for rcpt@")
+	}
+}
+
+func TestMaildir_NoAutoCreate(t *testing.T) {
+	dir := testutils.Dir(t)
+	tgt := testTarget(t, dir)
+	tgt.autoCreate = false
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.org", []string{"rcpt@example.org"})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatal("Expected 550 error, got", err)
+	}
+}
+
+func TestMaildir_PathTraversal(t *testing.T) {
+	tgt := testTarget(t, "/nonexistent")
+
+	for _, addr := range []string{"../etc@example.org", "user@../..", "a/b@example.org", ".hidden@example.org"} {
+		if _, err := tgt.maildirPath(addr); err == nil {
+			t.Errorf("Address %s is accepted", addr)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package pipe implements the delivery target that passes the message to an
+// external command for each recipient, similarly to the procmail-style MDAs.
+//
+// Implemented interfaces:
+// - module.DeliveryTarget
+// - module.PartialDelivery
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime/trace"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.pipe"
+
+// Exit codes defined in sysexits.h that have special meaning for the
+// delivery status.
+const (
+	exNoUser   = 67
+	exTempFail = 75
+	exNoPerm   = 77
+)
+
+var placeholderRe = regexp.MustCompile(`{[a-zA-Z0-9_]+?}`)
+
+// placeholders lists the names of values passed to the command. They are
+// available both as argument placeholders ({name}) and environment variables
+// (MADDY_NAME).
+var placeholders = []string{
+	"auth_user",
+	"source_ip",
+	"msg_id",
+	"sender",
+	"rcpt",
+	"rcpt_local",
+	"rcpt_domain",
+	"original_rcpt",
+}
+
+// maxStderr is the maximum amount of command stderr output that is kept for
+// logging and the delivery status.
+const maxStderr = 4096
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	cmd     string
+	cmdArgs []string
+	timeout time.Duration
+
+	// Semaphore limiting the amount of concurrently running commands, nil if
+	// there is no limit.
+	sem chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) == 0 {
+		return nil, fmt.Errorf("%s: at least one argument is required (command name)", modName)
+	}
+
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		cmd:      inlineArgs[0],
+		cmdArgs:  inlineArgs[1:],
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	// Check whether the inline argument command is usable.
+	if _, err := exec.LookPath(t.cmd); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	var maxConcurrency int
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Duration("timeout", false, false, 5*time.Minute, &t.timeout)
+	cfg.Int("max_concurrency", false, false, 10, &maxConcurrency)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if maxConcurrency > 0 {
+		t.sem = make(chan struct{}, maxConcurrency)
+	}
+
+	return nil
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+
+	rcpts []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	for _, rcpt := range d.rcpts {
+		if rcpt == rcptTo {
+			return nil
+		}
+	}
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) placeholderValue(name, rcpt string) string {
+	switch name {
+	case "auth_user":
+		if d.msgMeta.Conn == nil {
+			return ""
+		}
+		return d.msgMeta.Conn.AuthUser
+	case "source_ip":
+		if d.msgMeta.Conn == nil {
+			return ""
+		}
+		tcpAddr, _ := d.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+		if tcpAddr == nil {
+			return ""
+		}
+		return tcpAddr.IP.String()
+	case "msg_id":
+		return d.msgMeta.ID
+	case "sender":
+		return d.mailFrom
+	case "rcpt":
+		return rcpt
+	case "rcpt_local":
+		mbox, _, err := address.Split(rcpt)
+		if err != nil {
+			return ""
+		}
+		return mbox
+	case "rcpt_domain":
+		_, domain, err := address.Split(rcpt)
+		if err != nil {
+			return ""
+		}
+		return domain
+	case "original_rcpt":
+		if orig, ok := d.msgMeta.OriginalRcpts[rcpt]; ok {
+			return orig
+		}
+		return rcpt
+	}
+	return ""
+}
+
+func (d *delivery) expandCommand(rcpt string) (string, []string) {
+	expArgs := make([]string, len(d.t.cmdArgs))
+
+	for i, arg := range d.t.cmdArgs {
+		expArgs[i] = placeholderRe.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			for _, known := range placeholders {
+				if name == known {
+					return d.placeholderValue(name, rcpt)
+				}
+			}
+			return placeholder
+		})
+	}
+
+	return d.t.cmd, expArgs
+}
+
+// env returns the environment for the command: maddy environment plus
+// MADDY_* variables with the same values as placeholders.
+func (d *delivery) env(rcpt string) []string {
+	env := os.Environ()
+	for _, name := range placeholders {
+		env = append(env, "MADDY_"+strings.ToUpper(name)+"="+d.placeholderValue(name, rcpt))
+	}
+	return env
+}
+
+// tailBuffer is io.Writer that keeps only last max bytes written to it.
+type tailBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (tb *tailBuffer) Write(b []byte) (int, error) {
+	tb.buf = append(tb.buf, b...)
+	if len(tb.buf) > tb.max {
+		tb.truncated = true
+		tb.buf = tb.buf[len(tb.buf)-tb.max:]
+	}
+	return len(b), nil
+}
+
+// lastLine returns the last non-empty line of the output, it is used in the
+// delivery status reported to the sender.
+func (tb *tailBuffer) lastLine() string {
+	lines := strings.Split(strings.TrimSpace(string(tb.buf)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func (d *delivery) logStderr(stderr *tailBuffer, cmdLine string) {
+	if len(stderr.buf) == 0 {
+		return
+	}
+	if stderr.truncated {
+		d.log.Msg("command stderr is truncated", "cmd", cmdLine, "max_size", maxStderr)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(stderr.buf), "\n"), "\n") {
+		d.log.Msg("command stderr", "cmd", cmdLine, "line", line)
+	}
+}
+
+func internalErr(err error, reason, cmdLine string) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error",
+		TargetName:   modName,
+		Err:          err,
+		Reason:       reason,
+		Misc: map[string]interface{}{
+			"cmd": cmdLine,
+		},
+	}
+}
+
+// exitCodeErr converts the command exit code into the delivery status according
+// to the conventions used by local delivery agents (sysexits.h).
+func exitCodeErr(exitCode int, stderr *tailBuffer, cmdLine string) error {
+	msg := stderr.lastLine()
+	if msg == "" {
+		msg = fmt.Sprintf("Local delivery failed with exit code %d", exitCode)
+	}
+
+	smtpErr := &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 0},
+		Message:      msg,
+		TargetName:   modName,
+		Misc: map[string]interface{}{
+			"cmd":       cmdLine,
+			"exit_code": exitCode,
+		},
+	}
+	switch exitCode {
+	case exTempFail:
+		smtpErr.Code = 451
+		smtpErr.EnhancedCode = exterrors.EnhancedCode{4, 3, 0}
+	case exNoUser:
+		smtpErr.EnhancedCode = exterrors.EnhancedCode{5, 1, 1}
+	case exNoPerm:
+		smtpErr.EnhancedCode = exterrors.EnhancedCode{5, 7, 1}
+	}
+	return smtpErr
+}
+
+func (d *delivery) run(ctx context.Context, rcpt string, header textproto.Header, body buffer.Buffer) error {
+	cmdName, args := d.expandCommand(rcpt)
+	cmd := exec.Command(cmdName, args...)
+	cmdLine := cmd.String()
+
+	if d.t.sem != nil {
+		select {
+		case d.t.sem <- struct{}{}:
+			defer func() { <-d.t.sem }()
+		case <-ctx.Done():
+			return internalErr(ctx.Err(), "", cmdLine)
+		}
+	}
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return internalErr(err, "", cmdLine)
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return internalErr(err, "", cmdLine)
+	}
+	defer bodyR.Close()
+
+	cmd.Env = d.env(rcpt)
+	cmd.Stdin = io.MultiReader(&hdrBuf, bodyR)
+	stderr := &tailBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	setProcGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return internalErr(err, "", cmdLine)
+	}
+
+	var (
+		timedOut int32
+		timer    *time.Timer
+	)
+	if d.t.timeout != 0 {
+		timer = time.AfterFunc(d.t.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			if err := killProcGroup(cmd); err != nil {
+				d.log.Error("failed to kill process", err, "cmd", cmdLine)
+			}
+		})
+	}
+
+	err = cmd.Wait()
+	if timer != nil {
+		timer.Stop()
+	}
+	d.logStderr(stderr, cmdLine)
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return internalErr(err, "command timed out", cmdLine)
+	}
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return internalErr(err, "", cmdLine)
+	}
+	if exitErr.ExitCode() == -1 {
+		// Killed by a signal.
+		return internalErr(err, "command terminated by signal", cmdLine)
+	}
+	return exitCodeErr(exitErr.ExitCode(), stderr, cmdLine)
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	// Messages already passed to the command can't be taken back so there is
+	// no point in stopping at the first failure.
+	var firstErr error
+	for _, rcpt := range d.rcpts {
+		if err := d.run(ctx, rcpt, header, body); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// BodyNonAtomic implements module.PartialDelivery.
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "pipe/BodyNonAtomic").End()
+
+	for _, rcpt := range d.rcpts {
+		sc.SetStatus(rcpt, d.run(ctx, rcpt, header, body))
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,115 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pipe
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, script string) *Target {
+	return &Target{
+		log:     testutils.Logger(t, modName),
+		cmd:     "/bin/sh",
+		cmdArgs: []string{"-c", script, "sh", "{rcpt}", "{sender}"},
+		timeout: 5 * time.Second,
+	}
+}
+
+type statusCollector map[string]error
+
+func (sc statusCollector) SetStatus(rcptTo string, err error) {
+	sc[rcptTo] = err
+}
+
+func TestPipe(t *testing.T) {
+	dir := testutils.Dir(t)
+	tgt := testTarget(t, `cat > "`+dir+`/$1"; echo "$2 $MADDY_RCPT_LOCAL $MADDY_RCPT_DOMAIN" >> "`+dir+`/$1"`)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	for _, rcpt := range []string{"rcpt1@example.org", "rcpt2@example.org"} {
+		blob, err := ioutil.ReadFile(filepath.Join(dir, rcpt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(blob), "A: 1\r\nB: 2\r\n\r\nfoobar\r\n") {
+			t.Errorf("Wrong message passed to the command for %s: %q", rcpt, blob)
+		}
+		local := strings.Split(rcpt, "@")[0]
+		if !strings.HasSuffix(string(blob), "sender@example.org "+local+" example.org\n") {
+			t.Errorf("Wrong arguments or environment for %s: %q", rcpt, blob)
+		}
+	}
+}
+
+func TestPipe_ExitCodes(t *testing.T) {
+	tgt := testTarget(t, `case "$1" in
+		temp*) echo "mailbox is locked" >&2; exit 75;;
+		nouser*) echo "some noise" >&2; echo "no such user" >&2; exit 67;;
+		*) exit 0;;
+	esac`)
+
+	sc := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, sc, tgt, "sender@example.org", []string{
+		"ok@example.org", "temp@example.org", "nouser@example.org",
+	})
+
+	if err := sc["ok@example.org"]; err != nil {
+		t.Error("Unexpected error for ok@:", err)
+	}
+
+	checkErr := func(rcpt string, code int, enchCode exterrors.EnhancedCode, msg string) {
+		t.Helper()
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(sc[rcpt], &smtpErr) {
+			t.Fatalf("Not SMTPError for %s: %v", rcpt, sc[rcpt])
+		}
+		if smtpErr.Code != code || smtpErr.EnhancedCode != enchCode {
+			t.Errorf("Wrong code for %s: %d %v", rcpt, smtpErr.Code, smtpErr.EnhancedCode)
+		}
+		if smtpErr.Message != msg {
+			t.Errorf("Wrong message for %s: %s", rcpt, smtpErr.Message)
+		}
+	}
+	checkErr("temp@example.org", 451, exterrors.EnhancedCode{4, 3, 0}, "mailbox is locked")
+	checkErr("nouser@example.org", 550, exterrors.EnhancedCode{5, 1, 1}, "no such user")
+}
+
+func TestPipe_Timeout(t *testing.T) {
+	// Background process keeps stderr open, it should be killed too.
+	tgt := testTarget(t, `sleep 10 & sleep 10`)
+	tgt.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.org", []string{"rcpt@example.org"})
+	if !exterrors.IsTemporary(err) {
+		t.Error("Timed out command should cause a temporary error, got", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Process group is not killed on timeout")
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// controlFile is the name of the file in the queue directory that
+	// contains the pending ControlRequest.
+	controlFile = "control.json"
+
+	// controlResultFile is the name of the file in the queue directory that
+	// contains the ControlResult for the last processed request.
+	controlResultFile = "control_result.json"
+)
+
+// Actions for ControlRequest.
+const (
+	// Remove entries from the queue without generating any notifications.
+	ControlDelete = "delete"
+	// Put entries on hold, they are not delivered until released.
+	ControlHold = "hold"
+	// Release held entries, they are scheduled for immediate delivery.
+	ControlRelease = "release"
+	// Change the time entries are not delivered before to
+	// ControlRequest.DeliverAfter, zero value removes the restriction.
+	ControlDefer = "defer"
+)
+
+// ErrControlPending is returned by RequestControl if there is another request
+// that is not processed yet.
+var ErrControlPending = errors.New("queue: another control request is pending")
+
+// ControlRequest asks the running queue to delete, hold, release or defer
+// the selected entries.
+//
+// Entries are selected by ID, sender or recipient address. If multiple
+// criteria are specified, the entry should match all of them.
+type ControlRequest struct {
+	Action string
+
+	IDs    []string `json:",omitempty"`
+	Sender string   `json:",omitempty"`
+	Rcpt   string   `json:",omitempty"`
+
+	// New release time for ControlDefer, capped by max_hold_time.
+	DeliverAfter time.Time
+
+	Requested time.Time
+}
+
+// ControlResult is the outcome of the ControlRequest processing.
+type ControlResult struct {
+	// Requested is the value of ControlRequest.Requested this result is for.
+	Requested time.Time
+	Processed time.Time
+
+	// IDs of entries the action was applied to.
+	Affected []string
+
+	// Amount of matching entries that were not changed because they are being
+	// delivered right now or are not in the needed state (e.g. released
+	// entries that are not held).
+	Skipped int
+}
+
+// RequestControl saves the ControlRequest to the queue directory. It will be
+// processed by the running queue or on the next start.
+func RequestControl(location string, req ControlRequest) (ControlRequest, error) {
+	switch req.Action {
+	case ControlDelete, ControlHold, ControlRelease, ControlDefer:
+	default:
+		return ControlRequest{}, errors.New("queue: unknown control action: " + req.Action)
+	}
+	if len(req.IDs) == 0 && req.Sender == "" && req.Rcpt == "" {
+		return ControlRequest{}, errors.New("queue: no entries selected")
+	}
+	for _, id := range req.IDs {
+		if err := checkID(id); err != nil {
+			return ControlRequest{}, err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(location, controlFile)); err == nil {
+		return ControlRequest{}, ErrControlPending
+	}
+
+	req.Requested = time.Now()
+	return req, writeJSONFile(filepath.Join(location, controlFile), req)
+}
+
+// ReadControlResult reads the result of the last processed ControlRequest.
+// If there is no result saved, zero ControlResult is returned.
+func ReadControlResult(location string) (ControlResult, error) {
+	f, err := os.Open(filepath.Join(location, controlResultFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ControlResult{}, nil
+		}
+		return ControlResult{}, err
+	}
+	defer f.Close()
+
+	var res ControlResult
+	if err := json.NewDecoder(f).Decode(&res); err != nil {
+		return ControlResult{}, err
+	}
+	return res, nil
+}
+
+func (req ControlRequest) matches(meta *QueueMetadata) bool {
+	if len(req.IDs) != 0 {
+		found := false
+		for _, id := range req.IDs {
+			if id == meta.MsgMeta.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if req.Sender != "" && !strings.EqualFold(req.Sender, meta.From) {
+		return false
+	}
+	if req.Rcpt != "" {
+		found := false
+		for _, rcpt := range meta.To {
+			if strings.EqualFold(req.Rcpt, rcpt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// processControl checks for the pending ControlRequest and executes it.
+func (q *Queue) processControl() error {
+	reqPath := filepath.Join(q.location, controlFile)
+	f, err := os.Open(reqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var req ControlRequest
+	err = json.NewDecoder(f).Decode(&req)
+	f.Close()
+	if err != nil {
+		q.Log.Error("malformed control request, removing", err)
+		return os.Remove(reqPath)
+	}
+
+	res := q.control(req)
+	q.Log.Msg("processed control request", "action", req.Action,
+		"affected", res.Affected, "skipped", res.Skipped)
+
+	if err := writeJSONFile(filepath.Join(q.location, controlResultFile), res); err != nil {
+		return err
+	}
+	return os.Remove(reqPath)
+}
+
+// control applies the action from req to the matching entries.
+//
+// Only entries waiting in the time wheel, held due to the delivery pause or
+// held by the administrator are changed, entries being delivered right now
+// are not touched. Entries held due to the pause stay held if they are
+// deferred. Since the delivery is always started by removing the entry
+// from the time wheel, this makes control safe to run while delivery is in
+// progress.
+func (q *Queue) control(req ControlRequest) ControlResult {
+	res := ControlResult{
+		Requested: req.Requested,
+		Affected:  []string{},
+	}
+	defer func() {
+		sort.Strings(res.Affected)
+		res.Processed = q.clock.Now()
+	}()
+
+	list, err := List(q.location)
+	if err != nil {
+		q.Log.Error("failed to list queue entries", err)
+		return res
+	}
+
+	selected := make(map[string]*QueueMetadata, len(list))
+	for _, meta := range list {
+		if req.matches(meta) {
+			selected[meta.MsgMeta.ID] = meta
+		}
+	}
+
+	if req.Action == ControlRelease {
+		for id, meta := range selected {
+			if !meta.Held {
+				res.Skipped++
+				continue
+			}
+			meta.Held = false
+			meta.NextAttempt = time.Time{}
+			if err := q.updateMetadataOnDisk(meta); err != nil {
+				q.Log.Error("failed to update meta-data", err, "msg_id", id)
+				res.Skipped++
+				continue
+			}
+			q.wheel.Add(q.clock.Now(), queueSlot{ID: id})
+			res.Affected = append(res.Affected, id)
+		}
+		return res
+	}
+
+	// Take entries that are not being delivered out of the scheduling.
+	var ids []string
+	scheduled := make(map[string]bool)
+	for _, v := range q.wheel.Remove(func(value interface{}) bool {
+		_, ok := selected[value.(queueSlot).ID]
+		return ok
+	}) {
+		id := v.(queueSlot).ID
+		ids = append(ids, id)
+		scheduled[id] = true
+	}
+	q.pauseLock.Lock()
+	for id := range selected {
+		if _, ok := q.held[id]; ok {
+			if req.Action != ControlDefer {
+				delete(q.held, id)
+			}
+			ids = append(ids, id)
+		}
+	}
+	queueHeld.WithLabelValues(q.name).Set(float64(len(q.held)))
+	q.pauseLock.Unlock()
+	for id, meta := range selected {
+		if meta.Held {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		// Meta-data could be changed by the delivery attempt finished after
+		// List call.
+		meta, err := Read(q.location, id)
+		if err != nil {
+			q.Log.Error("failed to read meta-data", err, "msg_id", id)
+			continue
+		}
+
+		switch req.Action {
+		case ControlDelete:
+			q.removeFromDisk(meta.MsgMeta)
+		case ControlHold:
+			if !meta.Held {
+				meta.Held = true
+				if err := q.updateMetadataOnDisk(meta); err != nil {
+					// Should not happen normally, but do not lose the entry.
+					q.Log.Error("failed to update meta-data", err, "msg_id", id)
+					q.wheel.Add(q.clock.Now(), queueSlot{ID: id})
+					continue
+				}
+			}
+		case ControlDefer:
+			meta.DeliverAfter = q.holdUntil(req.DeliverAfter)
+			if scheduled[id] {
+				meta.NextAttempt = meta.DeliverAfter
+				if meta.NextAttempt.IsZero() {
+					meta.NextAttempt = q.clock.Now()
+				}
+			}
+			err := q.updateMetadataOnDisk(meta)
+			if scheduled[id] {
+				q.wheel.Add(meta.NextAttempt, queueSlot{ID: id})
+			}
+			if err != nil {
+				q.Log.Error("failed to update meta-data", err, "msg_id", id)
+				continue
+			}
+		}
+		res.Affected = append(res.Affected, id)
+	}
+	res.Skipped = len(selected) - len(res.Affected)
+	return res
+}
@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func doControl(t *testing.T, q *Queue, req ControlRequest) ControlResult {
+	t.Helper()
+	req, err := RequestControl(q.location, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RequestControl(q.location, req); err != ErrControlPending {
+		t.Fatal("expected ErrControlPending for the second request, got", err)
+	}
+	if err := q.processControl(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadControlResult(q.location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Requested.Equal(req.Requested) {
+		t.Fatalf("result is for the wrong request: %v != %v", res.Requested, req.Requested)
+	}
+	return res
+}
+
+func TestQueueControl_HoldRelease(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	if err := storeTestMsg(q, "msg1"); err != nil {
+		t.Fatal(err)
+	}
+	q.wheel.Add(time.Now().Add(time.Hour), queueSlot{ID: "msg1"})
+
+	res := doControl(t, q, ControlRequest{Action: ControlHold, IDs: []string{"msg1"}})
+	if !reflect.DeepEqual(res.Affected, []string{"msg1"}) || res.Skipped != 0 {
+		t.Fatalf("wrong hold result: %+v", res)
+	}
+	meta, err := Read(q.location, "msg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Held {
+		t.Fatal("Held flag is not saved")
+	}
+	if n := q.wheel.Reschedule(time.Now(), func(interface{}) bool { return true }); n != 0 {
+		t.Fatal("held message is still scheduled")
+	}
+
+	// Held messages are not loaded on start.
+	q2 := newTestQueueDir(t, &dt, q.location)
+	if n := q2.wheel.Reschedule(time.Now(), func(interface{}) bool { return true }); n != 0 {
+		t.Fatal("held message is scheduled after restart")
+	}
+	q2.Close()
+
+	res = doControl(t, q, ControlRequest{Action: ControlRelease, Sender: "TESTER@example.com"})
+	if !reflect.DeepEqual(res.Affected, []string{"msg1"}) || res.Skipped != 0 {
+		t.Fatalf("wrong release result: %+v", res)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	res = doControl(t, q, ControlRequest{Action: ControlRelease, IDs: []string{"msg1"}})
+	if len(res.Affected) != 0 {
+		t.Fatalf("delivered message is affected: %+v", res)
+	}
+}
+
+func TestQueueControl_Delete(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	for _, id := range []string{"msg1", "msg2"} {
+		if err := storeTestMsg(q, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.wheel.Add(time.Now().Add(time.Hour), queueSlot{ID: "msg1"})
+	q.wheel.Add(time.Now().Add(time.Hour), queueSlot{ID: "msg2"})
+
+	res := doControl(t, q, ControlRequest{Action: ControlHold, IDs: []string{"msg2"}})
+	if !reflect.DeepEqual(res.Affected, []string{"msg2"}) {
+		t.Fatalf("wrong hold result: %+v", res)
+	}
+
+	// Both scheduled and held messages are deleted.
+	res = doControl(t, q, ControlRequest{Action: ControlDelete, Rcpt: "tester1@EXAMPLE.org"})
+	if !reflect.DeepEqual(res.Affected, []string{"msg1", "msg2"}) || res.Skipped != 0 {
+		t.Fatalf("wrong delete result: %+v", res)
+	}
+	for _, id := range []string{"msg1", "msg2"} {
+		for _, ext := range []string{".meta", ".header", ".body"} {
+			if _, err := os.Stat(filepath.Join(q.location, id+ext)); !os.IsNotExist(err) {
+				t.Errorf("%s%s is not removed: %v", id, ext, err)
+			}
+		}
+	}
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("deleted message is delivered: %v", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQueueControl_Defer(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.maxHoldTime = 24 * time.Hour
+	defer cleanQueue(t, q)
+
+	if err := storeTestMsg(q, "msg1"); err != nil {
+		t.Fatal(err)
+	}
+	q.wheel.Add(time.Now().Add(time.Hour), queueSlot{ID: "msg1"})
+
+	deliverAfter := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	res := doControl(t, q, ControlRequest{Action: ControlDefer, IDs: []string{"msg1"}, DeliverAfter: deliverAfter})
+	if !reflect.DeepEqual(res.Affected, []string{"msg1"}) || res.Skipped != 0 {
+		t.Fatalf("wrong defer result: %+v", res)
+	}
+	meta, err := Read(q.location, "msg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.DeliverAfter.Equal(deliverAfter) || !meta.NextAttempt.Equal(deliverAfter) {
+		t.Fatalf("wrong release time saved: %v, next attempt %v", meta.DeliverAfter, meta.NextAttempt)
+	}
+
+	// Flush does not bypass the restriction.
+	if n := q.wheel.Reschedule(time.Now(), func(interface{}) bool { return true }); n != 1 {
+		t.Fatal("deferred message is not scheduled")
+	}
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("deferred message is delivered: %v", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res = doControl(t, q, ControlRequest{Action: ControlDefer, Sender: "tester@example.com"})
+	if !reflect.DeepEqual(res.Affected, []string{"msg1"}) || res.Skipped != 0 {
+		t.Fatalf("wrong defer result: %+v", res)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+}
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"sort"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/limits"
+)
+
+// Per-destination limits.
+//
+// Before a delivery attempt is started, the slot is taken for each recipient
+// domain of the message. If the concurrency or rate limit for the domain is
+// reached, the delivery waits for the slot in the FIFO order per domain. The
+// waiting does not count as a delivery attempt and does not occupy the
+// max_parallelism slot, so deliveries to other domains are not blocked.
+//
+// Slots for multiple domains are taken in the sorted order to prevent
+// deadlocks.
+
+func destDomains(rcpts []string) []string {
+	set := make(map[string]struct{}, len(rcpts))
+	for _, rcpt := range rcpts {
+		_, domain, err := address.Split(rcpt)
+		if err != nil || domain == "" {
+			continue
+		}
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			continue
+		}
+		set[domain] = struct{}{}
+	}
+
+	domains := make([]string, 0, len(set))
+	for domain := range set {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// takeDestinations takes the delivery slots for all domains, waiting if
+// necessary. It fails only if the queue is being closed.
+func (q *Queue) takeDestinations(id string, domains []string) error {
+	if q.destLimits == nil {
+		return nil
+	}
+
+	for i, domain := range domains {
+		if active, waiting := q.destLimits.Stats(domain); waiting != 0 || !q.destAvailable(domain, active) {
+			q.Log.Debugf("waiting for the delivery slot for %s (%s, active=%d, waiting=%d)", id, domain, active, waiting)
+		}
+
+		queueLimitWaiting.WithLabelValues(q.name).Inc()
+		err := q.destLimits.Take(q.destCtx, domain)
+		queueLimitWaiting.WithLabelValues(q.name).Dec()
+		if err != nil {
+			q.releaseDestinations(domains[:i])
+			return err
+		}
+
+		active, waiting := q.destLimits.Stats(domain)
+		q.Log.Debugf("delivery slot acquired for %s (%s, active=%d, waiting=%d)", id, domain, active, waiting)
+	}
+	return nil
+}
+
+func (q *Queue) destAvailable(domain string, active int) bool {
+	l := q.destLimitCfg.Limits(domain)
+	return l.Concurrency == 0 || active < l.Concurrency
+}
+
+func (q *Queue) releaseDestinations(domains []string) {
+	if q.destLimits == nil {
+		return
+	}
+	for _, domain := range domains {
+		q.destLimits.Release(domain)
+	}
+}
+
+func destLimitsDefault() (interface{}, error) {
+	return limits.DestConfig{}, nil
+}
+
+var destLimitsDirective = limits.DestDirective("domain", false)
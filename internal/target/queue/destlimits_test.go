@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDestDomains(t *testing.T) {
+	domains := destDomains([]string{"a@EXAMPLE.org", "b@example.org", "c@example.com", "postmaster"})
+	if want := []string{"example.com", "example.org"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("destDomains = %v, want %v", domains, want)
+	}
+}
+
+func waitDestWaiting(t *testing.T, q *Queue, domain string, waiting int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, w := q.destLimits.Stats(domain); w == waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d deliveries waiting for %s", waiting, domain)
+}
+
+func TestQueueDelivery_DestinationLimit(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.destLimits = limiters.NewKeyedFIFO(clock.Real, limiters.FIFOLimits{}, map[string]limiters.FIFOLimits{
+		"example.org": {Concurrency: 1},
+	})
+
+	// Occupy the only slot for example.org.
+	if err := q.destLimits.Take(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	waitDestWaiting(t, q, "example.org", 1)
+
+	// Deliveries to other domains are not blocked.
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.com"})
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if msg.RcptTo[0] != "tester1@example.com" {
+		t.Fatal("unexpected delivery:", msg.RcptTo)
+	}
+
+	q.destLimits.Release("example.org")
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if msg.RcptTo[0] != "tester1@example.org" {
+		t.Fatal("unexpected delivery:", msg.RcptTo)
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_DestinationLimitClose(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.destLimits = limiters.NewKeyedFIFO(clock.Real, limiters.FIFOLimits{Concurrency: 1}, nil)
+
+	if err := q.destLimits.Take(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	waitDestWaiting(t, q, "example.org", 1)
+
+	// Close should not wait for the slot, the message is kept for the next
+	// start.
+	q.Close()
+	checkQueueDir(t, q, []string{id})
+}
@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Diagnostic is the structured information about a failed delivery attempt.
+//
+// It is saved in the queue entry meta-data to make it possible to answer
+// "why is this message still queued?" without repeating lookups by hand.
+// Fields are populated from the fields of the error returned by the delivery
+// target, so some of them may be empty.
+type Diagnostic struct {
+	Time time.Time
+
+	// MX hostnames resolved for the recipient domain.
+	MXCandidates []string `json:",omitempty"`
+
+	// Hostname and network address of the server that was tried last.
+	RemoteServer string `json:",omitempty"`
+	RemoteAddr   string `json:",omitempty"`
+
+	// Phase of the delivery the error happened at: dns, policy, connect,
+	// mail, rcpt or data.
+	Phase string `json:",omitempty"`
+
+	// Response of the remote server as it was received.
+	RemoteResponse string `json:",omitempty"`
+
+	// Textual description of the local error (e.g. resolver or network
+	// error).
+	Reason string `json:",omitempty"`
+
+	// Error that was reported for the recipient.
+	Error *smtp.SMTPError
+}
+
+func newDiagnostic(now time.Time, err error) Diagnostic {
+	fields := exterrors.Fields(err)
+	diag := Diagnostic{
+		Time:  now,
+		Error: toSMTPErr(err),
+	}
+
+	if mxs, ok := fields["mx_candidates"].([]string); ok {
+		diag.MXCandidates = append([]string(nil), mxs...)
+	}
+	if v, ok := fields["remote_server"]; ok && v != nil {
+		diag.RemoteServer = fmt.Sprint(v)
+	}
+	if v, ok := fields["remote_addr"]; ok && v != nil {
+		diag.RemoteAddr = fmt.Sprint(v)
+	}
+	if v, ok := fields["smtp_phase"].(string); ok {
+		diag.Phase = v
+	}
+	if v, ok := fields["remote_response"].(string); ok {
+		diag.RemoteResponse = v
+	}
+	if v, ok := fields["reason"].(string); ok && v != diag.RemoteResponse {
+		diag.Reason = v
+	}
+
+	return diag
+}
+
+// Summary returns the single-line human-readable description of the
+// attempt.
+func (d Diagnostic) Summary() string {
+	var sb strings.Builder
+	sb.WriteString(d.Time.UTC().Format(time.RFC3339))
+	if d.Phase != "" {
+		sb.WriteString(" ")
+		sb.WriteString(d.Phase)
+	}
+	if d.RemoteServer != "" {
+		sb.WriteString(" ")
+		sb.WriteString(d.RemoteServer)
+		if d.RemoteAddr != "" {
+			sb.WriteString(" (")
+			sb.WriteString(d.RemoteAddr)
+			sb.WriteString(")")
+		}
+	}
+	sb.WriteString(": ")
+	switch {
+	case d.RemoteResponse != "":
+		sb.WriteString(d.RemoteResponse)
+	case d.Error != nil:
+		fmt.Fprintf(&sb, "%d %d.%d.%d %s", d.Error.Code,
+			d.Error.EnhancedCode[0], d.Error.EnhancedCode[1], d.Error.EnhancedCode[2],
+			d.Error.Message)
+		if d.Reason != "" && d.Reason != d.Error.Message {
+			sb.WriteString(" (")
+			sb.WriteString(d.Reason)
+			sb.WriteString(")")
+		}
+	default:
+		sb.WriteString(d.Reason)
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(sb.String(), "\n", " "), "\r", " ")
+}
+
+// addDiagnostic saves the diagnostic for the failed attempt to deliver to
+// rcpt, keeping only maxDiagnostics latest ones.
+func (q *Queue) addDiagnostic(meta *QueueMetadata, rcpt string, err error) {
+	if q.maxDiagnostics <= 0 {
+		return
+	}
+	if meta.Diagnostics == nil {
+		meta.Diagnostics = make(map[string][]Diagnostic)
+	}
+
+	diags := append(meta.Diagnostics[rcpt], newDiagnostic(q.clock.Now(), err))
+	if len(diags) > q.maxDiagnostics {
+		diags = append([]Diagnostic(nil), diags[len(diags)-q.maxDiagnostics:]...)
+	}
+	meta.Diagnostics[rcpt] = diags
+}
+
+// Read reads meta-data for the message with the specified ID from the queue
+// directory.
+//
+// It is meant for use by management utilities.
+func Read(location, id string) (*QueueMetadata, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+
+	meta, err := readMetaFile(filepath.Join(location, id+".meta"))
+	if err != nil {
+		return nil, err
+	}
+	if meta.MsgMeta.ID == "" {
+		meta.MsgMeta.ID = id
+	}
+	return meta, nil
+}
+
+// ReadHeader reads the header of the message with the specified ID from the
+// queue directory as it is stored on disk.
+//
+// It is meant for use by management utilities.
+func ReadHeader(location, id string) ([]byte, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(location, id+".header"))
+}
+
+// Size returns the size of the message with the specified ID (header and
+// body) stored in the queue directory.
+//
+// It is meant for use by management utilities.
+func Size(location, id string) (int64, error) {
+	if err := checkID(id); err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, ext := range []string{".header", ".body"} {
+		info, err := os.Stat(filepath.Join(location, id+ext))
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+func checkID(id string) error {
+	if strings.ContainsAny(id, `/\`) || id == "" || id == "." || id == ".." {
+		return fmt.Errorf("queue: malformed message ID: %s", id)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func remoteErr(code int, msg string) error {
+	return exterrors.WithFields(&exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: exterrors.EnhancedCode{code / 100, 0, 0},
+		Message:      "mx.example.org said: " + msg,
+		Misc: map[string]interface{}{
+			"remote_server":   "mx.example.org",
+			"remote_addr":     "192.0.2.1:25",
+			"smtp_phase":      "rcpt",
+			"remote_response": msg,
+		},
+	}, map[string]interface{}{
+		"mx_candidates": []string{"mx.example.org", "mx2.example.org"},
+	})
+}
+
+func TestNewDiagnostic(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	diag := newDiagnostic(now, remoteErr(450, "450 4.2.0 Mailbox busy"))
+	if !reflect.DeepEqual(diag.MXCandidates, []string{"mx.example.org", "mx2.example.org"}) {
+		t.Error("Wrong MXCandidates:", diag.MXCandidates)
+	}
+	if diag.RemoteServer != "mx.example.org" || diag.RemoteAddr != "192.0.2.1:25" || diag.Phase != "rcpt" {
+		t.Errorf("Wrong server info: %+v", diag)
+	}
+	if diag.Error == nil || diag.Error.Code != 450 {
+		t.Errorf("Wrong error: %+v", diag.Error)
+	}
+	if summary := diag.Summary(); summary != "2020-01-01T00:00:00Z rcpt mx.example.org (192.0.2.1:25): 450 4.2.0 Mailbox busy" {
+		t.Error("Wrong summary:", summary)
+	}
+
+	diag = newDiagnostic(now, &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 4},
+		Message:      "MX lookup error",
+		Reason:       "server misbehaving",
+		Misc: map[string]interface{}{
+			"smtp_phase": "dns",
+		},
+	})
+	if summary := diag.Summary(); summary != "2020-01-01T00:00:00Z dns: 451 4.4.4 MX lookup error (server misbehaving)" {
+		t.Error("Wrong summary:", summary)
+	}
+}
+
+func TestQueueDelivery_Diagnostics(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": remoteErr(450, "450 4.2.0 Attempt 1")},
+			{"tester1@example.org": remoteErr(450, "450 4.2.0 Attempt 2")},
+			{"tester1@example.org": remoteErr(450, "450 4.2.0 Attempt 3")},
+			{"tester1@example.org": remoteErr(550, "550 5.1.1 No such user")},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxDiagnostics = 2
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	for i := 0; i < 4; i++ {
+		readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	}
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+
+	body := string(msg.Body)
+	if strings.Contains(body, "Attempt 1") || strings.Contains(body, "Attempt 2") {
+		t.Error("DSN includes diagnostics beyond the limit")
+	}
+	if !strings.Contains(body, "rcpt mx.example.org (192.0.2.1:25): 450 4.2.0 Attempt 3") {
+		t.Error("DSN does not include the previous attempt")
+	}
+	if !strings.Contains(body, "rcpt mx.example.org (192.0.2.1:25): 550 5.1.1 No such user") {
+		t.Error("DSN does not include the last attempt")
+	}
+	if !strings.Contains(body, "Remote-Mta: dns; mx.example.org") {
+		t.Error("DSN does not include Remote-MTA")
+	}
+}
+
+func TestQueueDelivery_DiagnosticsSaved(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": remoteErr(450, "450 4.2.0 Mailbox busy")},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Wait for the meta-data update after the failed attempt.
+	var list []*QueueMetadata
+	for i := 0; i < 50; i++ {
+		var err error
+		list, err = List(q.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) == 1 && len(list[0].Diagnostics) != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Wrong amount of queued messages: %d", len(list))
+	}
+
+	meta, err := Read(q.location, list[0].MsgMeta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := meta.Diagnostics["tester1@example.org"]
+	if len(diags) != 1 {
+		t.Fatalf("Wrong diagnostics: %+v", meta.Diagnostics)
+	}
+	if diags[0].RemoteResponse != "450 4.2.0 Mailbox busy" || diags[0].Phase != "rcpt" {
+		t.Errorf("Wrong diagnostic: %+v", diags[0])
+	}
+
+	if _, err := Read(q.location, "../etc"); err == nil {
+		t.Error("Expected an error for malformed ID")
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Durability modes for the queue persistence layer, see the durability
+// directive.
+const (
+	// DurabilityStrict makes each message fsync'ed individually before it is
+	// acknowledged.
+	DurabilityStrict = "strict"
+
+	// DurabilityGrouped batches fsyncs for messages accepted while the
+	// previous batch is being synced and acknowledges them together.
+	DurabilityGrouped = "grouped"
+
+	// DurabilityRelaxed disables fsync completely, messages accepted shortly
+	// before a power loss or kernel crash may be lost.
+	DurabilityRelaxed = "relaxed"
+)
+
+// commitGroup is a set of files that are synced together.
+type commitGroup struct {
+	files   []*os.File
+	started bool
+	done    chan struct{}
+	// Sync results for each file in files, set before done is closed.
+	errs []error
+}
+
+// err returns the error for the caller that added files[start:end] to the
+// group.
+//
+// If its own files are synced successfully but some other file in the group
+// is not, the error is still returned since it is not known which data
+// actually reached the disk.
+func (g *commitGroup) err(start, end int) error {
+	for _, err := range g.errs[start:end] {
+		if err != nil {
+			return err
+		}
+	}
+	for i, err := range g.errs {
+		if err != nil {
+			return fmt.Errorf("sync failed for %s in the same group: %w", g.files[i].Name(), err)
+		}
+	}
+	return nil
+}
+
+// groupCommitter implements the group commit: files passed to Sync while
+// another group is being flushed are collected into the next group and
+// synced together, the result is reported to all callers at once.
+//
+// If no flush is in progress, the group is flushed immediately so the idle
+// queue does not pay the additional latency. Otherwise the group is flushed
+// once the previous flush completes or the window expires, whichever happens
+// first.
+type groupCommitter struct {
+	window time.Duration
+
+	// Function used to sync all files of the group, replaced by tests to
+	// inject failures. It returns the result for each file.
+	sync func(files []*os.File) []error
+
+	lock     sync.Mutex
+	pending  *commitGroup
+	flushing int
+}
+
+func newGroupCommitter(window time.Duration) *groupCommitter {
+	return &groupCommitter{
+		window: window,
+		sync:   syncGroup,
+	}
+}
+
+// Sync blocks until the files are synced as part of the current group.
+//
+// If any file in the group fails to sync, an error is returned to all
+// callers in the group, see commitGroup.err.
+func (gc *groupCommitter) Sync(files ...*os.File) error {
+	gc.lock.Lock()
+	g := gc.pending
+	if g == nil {
+		g = &commitGroup{done: make(chan struct{})}
+		gc.pending = g
+		if gc.flushing != 0 {
+			time.AfterFunc(gc.window, func() {
+				gc.lock.Lock()
+				gc.startFlush(g)
+				gc.lock.Unlock()
+			})
+		}
+	}
+	start := len(g.files)
+	g.files = append(g.files, files...)
+	end := len(g.files)
+	if gc.flushing == 0 {
+		gc.startFlush(g)
+	}
+	gc.lock.Unlock()
+
+	<-g.done
+	return g.err(start, end)
+}
+
+// startFlush should be called with gc.lock held.
+func (gc *groupCommitter) startFlush(g *commitGroup) {
+	if g.started {
+		return
+	}
+	g.started = true
+	if gc.pending == g {
+		gc.pending = nil
+	}
+	gc.flushing++
+	go gc.flush(g)
+}
+
+func (gc *groupCommitter) flush(g *commitGroup) {
+	g.errs = gc.sync(g.files)
+	close(g.done)
+
+	gc.lock.Lock()
+	gc.flushing--
+	if gc.flushing == 0 && gc.pending != nil {
+		gc.startFlush(gc.pending)
+	}
+	gc.lock.Unlock()
+}
+
+// syncGroup fsyncs all files concurrently so the filesystem has a chance to
+// commit them together.
+func syncGroup(files []*os.File) []error {
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f *os.File) {
+			defer wg.Done()
+			errs[i] = f.Sync()
+		}(i, f)
+	}
+	wg.Wait()
+	return errs
+}
+
+// syncFiles makes sure the written files contents reached the disk according
+// to the configured durability mode.
+func (q *Queue) syncFiles(files ...*os.File) error {
+	switch q.durability {
+	case DurabilityRelaxed:
+		return nil
+	case DurabilityGrouped:
+		return q.committer.Sync(files...)
+	default:
+		for _, f := range files {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func syncError(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Failed to save the message, try again later",
+		TargetName:   "queue",
+		Err:          err,
+	}
+}
@@ -0,0 +1,511 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// storeTestMsg saves the message into the queue the same way Commit does but
+// without scheduling it for delivery.
+func storeTestMsg(q *Queue, id string) error {
+	ctx := context.Background()
+	delivery, err := q.Start(ctx, &module.MsgMetadata{ID: id, OriginalFrom: "tester@example.com"}, "tester@example.com")
+	if err != nil {
+		return err
+	}
+	if err := delivery.AddRcpt(ctx, "tester1@example.org"); err != nil {
+		return err
+	}
+	hdr := textproto.Header{}
+	hdr.Add("A", "1")
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.(*queueDelivery).persist()
+}
+
+func storeTestMsgs(q *Queue, count int) ([]string, []error) {
+	var (
+		wg   sync.WaitGroup
+		ids  = make([]string, count)
+		errs = make([]error, count)
+	)
+	for i := 0; i < count; i++ {
+		ids[i] = fmt.Sprintf("msg%d", i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = storeTestMsg(q, ids[i])
+		}(i)
+	}
+	wg.Wait()
+	return ids, errs
+}
+
+func TestGroupCommitter(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	var (
+		lck    sync.Mutex
+		synced = map[string]bool{}
+	)
+	gc := newGroupCommitter(50 * time.Millisecond)
+	gc.sync = func(files []*os.File) []error {
+		lck.Lock()
+		defer lck.Unlock()
+		errs := make([]error, len(files))
+		for i, f := range files {
+			synced[filepath.Base(f.Name())] = true
+			if filepath.Base(f.Name()) == "bad" {
+				errs[i] = errors.New("I/O error")
+			}
+		}
+		return errs
+	}
+
+	open := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// Pretend another flush is in progress so all callers join the same
+	// group that is flushed once the window expires.
+	gc.lock.Lock()
+	gc.flushing++
+	gc.lock.Unlock()
+
+	// Same group, a single failure fails all callers.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i, name := range []string{"a", "b", "bad"} {
+		f := open(name)
+		defer f.Close()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = gc.Sync(f)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("Sync %d: expected an error", i)
+			continue
+		}
+		// The caller whose file failed gets its own error, others get the
+		// error that refers to it.
+		if i == 2 && err.Error() != "I/O error" {
+			t.Errorf("Sync %d: wrong error: %v", i, err)
+		}
+		if i != 2 && !strings.Contains(err.Error(), "bad") {
+			t.Errorf("Sync %d: wrong error: %v", i, err)
+		}
+	}
+	if !synced["a"] || !synced["b"] || !synced["bad"] {
+		t.Error("Not all files are synced:", synced)
+	}
+
+	gc.lock.Lock()
+	gc.flushing--
+	gc.lock.Unlock()
+
+	// Next group is not affected by the failure.
+	f := open("c")
+	defer f.Close()
+	if err := gc.Sync(f); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestSyncGroup(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	files := make([]*os.File, 3)
+	for i := range files {
+		f, err := os.Create(filepath.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte("foobar")); err != nil {
+			t.Fatal(err)
+		}
+		files[i] = f
+	}
+	// Sync on a closed file fails, error should be reported only for it.
+	files[1].Close()
+
+	errs := syncGroup(files)
+	if len(errs) != len(files) {
+		t.Fatal("Wrong amount of results:", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Error("Unexpected errors:", errs)
+	}
+	if errs[1] == nil {
+		t.Error("Expected an error for the closed file")
+	}
+}
+
+func TestGroupCommitter_Pipelined(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	var (
+		lck     sync.Mutex
+		groups  [][]string
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	// Window is large so the second group is flushed only after the first
+	// one completes.
+	gc := newGroupCommitter(time.Hour)
+	gc.sync = func(files []*os.File) []error {
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, filepath.Base(f.Name()))
+		}
+		lck.Lock()
+		groups = append(groups, names)
+		first := len(groups) == 1
+		lck.Unlock()
+
+		if first {
+			close(started)
+			<-release
+		}
+		return make([]error, len(files))
+	}
+
+	open := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// Idle committer flushes the group immediately.
+	var wg sync.WaitGroup
+	a := open("a")
+	defer a.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := gc.Sync(a); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-started
+
+	// Files passed while the flush is in progress are collected into the next
+	// group.
+	for _, name := range []string{"b", "c"} {
+		f := open(name)
+		defer f.Close()
+		wg.Add(1)
+		go func(f *os.File) {
+			defer wg.Done()
+			if err := gc.Sync(f); err != nil {
+				t.Error(err)
+			}
+		}(f)
+	}
+	for {
+		gc.lock.Lock()
+		queued := 0
+		if gc.pending != nil {
+			queued = len(gc.pending.files)
+		}
+		gc.lock.Unlock()
+		if queued == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if len(groups) != 2 || len(groups[0]) != 1 || len(groups[1]) != 2 {
+		t.Fatal("Wrong groups:", groups)
+	}
+}
+
+func TestQueueDelivery_GroupedSyncFailure(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.durability = DurabilityGrouped
+	q.committer = newGroupCommitter(50 * time.Millisecond)
+
+	// Only one file fails to sync, but it is not known whether the data
+	// for other messages in the group is persisted correctly.
+	q.committer.sync = func(files []*os.File) []error {
+		errs := make([]error, len(files))
+		for i, f := range files {
+			if filepath.Base(f.Name()) == "msg1.body" {
+				errs[i] = errors.New("I/O error")
+			}
+		}
+		return errs
+	}
+	// Pretend another flush is in progress so all messages join the same
+	// group.
+	q.committer.flushing++
+
+	_, errs := storeTestMsgs(q, 5)
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("msg%d: expected an error", i)
+			continue
+		}
+		if code := exterrors.Fields(err)["smtp_code"]; code != 451 {
+			t.Errorf("msg%d: expected 451, got %v", i, code)
+		}
+	}
+
+	// Partially written messages should be removed.
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_GroupedCrash(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.durability = DurabilityGrouped
+	q.committer = newGroupCommitter(20 * time.Millisecond)
+
+	ids, errs := storeTestMsgs(q, 5)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("msg%d: %v", i, err)
+		}
+	}
+
+	// Simulate the crash: messages are acknowledged but are not scheduled for
+	// delivery by the queue that stored them. Another instance should pick
+	// all of them from the disk.
+	checkQueueDir(t, q, ids)
+	q.Close()
+
+	q2 := newTestQueueDir(t, &dt, q.location)
+	defer cleanQueue(t, q2)
+
+	delivered := map[string]bool{}
+	for range ids {
+		msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+		delivered[msg.MsgMeta.ID[:4]] = true
+	}
+	for _, id := range ids {
+		if !delivered[id] {
+			t.Errorf("%s is not delivered after restart", id)
+		}
+	}
+}
+
+func TestQueueDelivery_UncommittedDiscarded(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+
+	// Simulate the crash between Body and Commit, the message is not
+	// acknowledged and the client is going to send it again.
+	ctx := context.Background()
+	delivery, err := q.Start(ctx, &module.MsgMetadata{ID: "uncommitted"}, "tester@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "tester1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(ctx, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q2 := newTestQueueDir(t, &dt, q.location)
+	q2.Close()
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("uncommitted message delivered: %v", msg.MsgMeta.ID)
+	default:
+	}
+	checkQueueDir(t, q2, []string{})
+}
+
+func TestQueueDelivery_BrokenMeta(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+
+	ids, errs := storeTestMsgs(q, 2)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("msg%d: %v", i, err)
+		}
+	}
+	q.Close()
+
+	// Truncated meta-data file, e.g. due to the disk corruption.
+	if err := ioutil.WriteFile(filepath.Join(q.location, "msg0.meta"), []byte(`{"MsgMeta": {`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	q2 := newTestQueueDir(t, &dt, q.location)
+	defer cleanQueue(t, q2)
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if msg.MsgMeta.ID[:4] != "msg1" {
+		t.Fatalf("wrong message delivered: %s", msg.MsgMeta.ID)
+	}
+
+	// Entry is preserved for manual recovery.
+	if _, err := os.Stat(filepath.Join(q.location, "msg0.meta_broken")); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{".header", ".body"} {
+		if _, err := os.Stat(filepath.Join(q.location, ids[0]+suffix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueDelivery_NextAttemptPreserved(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+
+	if err := storeTestMsg(q, "delayed"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	meta, err := readMetaFile(filepath.Join(q.location, "delayed.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.NextAttempt = time.Now().Add(time.Hour)
+	if err := q.updateMetadataOnDisk(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	q2 := newTestQueueDir(t, &dt, q.location)
+	defer cleanQueue(t, q2)
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("message delivered before the scheduled time: %v", msg.MsgMeta.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+	checkQueueDir(t, q2, []string{"delayed"})
+}
+
+func benchmarkQueueStore(b *testing.B, durability string) {
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mod, _ := NewQueue("", "queue", nil, nil)
+	q := mod.(*Queue)
+	q.location = dir
+	q.durability = durability
+	if durability == DurabilityGrouped {
+		q.committer = newGroupCommitter(20 * time.Millisecond)
+	}
+
+	body := buffer.MemoryBuffer{Slice: make([]byte, 4096)}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Benchmark")
+
+	var (
+		lck sync.Mutex
+		n   int
+	)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lck.Lock()
+			n++
+			id := fmt.Sprintf("bench%d", n)
+			lck.Unlock()
+
+			meta := &QueueMetadata{
+				MsgMeta: &module.MsgMetadata{ID: id},
+				From:    "tester@example.com",
+				To:      []string{"tester1@example.org"},
+			}
+			_, metaName, err := q.storeNewMessage(meta, hdr, body)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if err := q.commitMetadata(id, metaName); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// Run with -bench QueueStore to see the difference between durability modes.
+// On rotational disks, strict mode is limited to tens of messages per second.
+//
+// Use a fixed iteration count (e.g. -benchtime 5000x) to compare the modes,
+// otherwise each of them works with a queue directory of a different size.
+func BenchmarkQueueStore_Strict(b *testing.B) {
+	benchmarkQueueStore(b, DurabilityStrict)
+}
+
+func BenchmarkQueueStore_Grouped(b *testing.B) {
+	benchmarkQueueStore(b, DurabilityGrouped)
+}
+
+func BenchmarkQueueStore_Relaxed(b *testing.B) {
+	benchmarkQueueStore(b, DurabilityRelaxed)
+}
@@ -30,6 +30,72 @@ var queuedMsgs = prometheus.NewGaugeVec(
 	[]string{"module", "location"},
 )
 
+var queuePaused = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "paused",
+		Help:      "Whether all deliveries are paused (1) or not (0)",
+	},
+	[]string{"module"},
+)
+
+var queuePausedDomains = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "paused_domains",
+		Help:      "Amount of recipient domains deliveries are paused for",
+	},
+	[]string{"module"},
+)
+
+var queueHeld = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "held",
+		Help:      "Amount of messages held due to the delivery pause",
+	},
+	[]string{"module"},
+)
+
+var queueLimitWaiting = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "limit_waiting",
+		Help:      "Amount of deliveries waiting for per-destination limits",
+	},
+	[]string{"module"},
+)
+
+var queueCompressionTime = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "compression_seconds",
+		Help:      "CPU time spent compressing message bodies",
+	},
+	[]string{"module"},
+)
+
+var queueCompressionBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "compression_bytes",
+		Help:      "Size of compressed message bodies before (in) and after (out) compression",
+	},
+	[]string{"module", "stage"},
+)
+
 func init() {
 	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(queuePaused)
+	prometheus.MustRegister(queuePausedDomains)
+	prometheus.MustRegister(queueHeld)
+	prometheus.MustRegister(queueLimitWaiting)
+	prometheus.MustRegister(queueCompressionTime)
+	prometheus.MustRegister(queueCompressionBytes)
 }
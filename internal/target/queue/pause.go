@@ -0,0 +1,372 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// pauseFile is the name of the file in the queue directory that contains the
+// serialized PauseState.
+const pauseFile = "pause.json"
+
+// pausePollInterval is the interval between checks for the pause state
+// changes made by maddyctl.
+var pausePollInterval = 5 * time.Second
+
+// PauseState describes which deliveries are held in the queue.
+//
+// It is stored in the queue directory so it is preserved across restarts and
+// can be changed by maddyctl while the server is running.
+type PauseState struct {
+	// Global is set if all deliveries are paused.
+	Global      bool      `json:",omitempty"`
+	GlobalSince time.Time `json:",omitempty"`
+
+	// Paused recipient domains (in the dns.ForLookup form) and the time they
+	// were paused at.
+	Domains map[string]time.Time `json:",omitempty"`
+}
+
+// Paused reports whether any deliveries are paused.
+func (ps PauseState) Paused() bool {
+	return ps.Global || len(ps.Domains) != 0
+}
+
+// IsPaused reports whether delivery to the specified recipient is paused.
+func (ps PauseState) IsPaused(rcpt string) bool {
+	if ps.Global {
+		return true
+	}
+	if len(ps.Domains) == 0 {
+		return false
+	}
+
+	_, domain, err := address.Split(rcpt)
+	if err != nil || domain == "" {
+		return false
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return false
+	}
+	_, ok := ps.Domains[domain]
+	return ok
+}
+
+// DomainList returns the list of paused domains, sorted.
+func (ps PauseState) DomainList() []string {
+	list := make([]string, 0, len(ps.Domains))
+	for domain := range ps.Domains {
+		list = append(list, domain)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// ReadPauseState reads the pause state for the queue stored in the
+// specified directory. If there is no state saved, zero PauseState is
+// returned.
+func ReadPauseState(location string) (PauseState, error) {
+	f, err := os.Open(filepath.Join(location, pauseFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return PauseState{}, nil
+		}
+		return PauseState{}, err
+	}
+	defer f.Close()
+
+	var ps PauseState
+	if err := json.NewDecoder(f).Decode(&ps); err != nil {
+		return PauseState{}, err
+	}
+	return ps, nil
+}
+
+// WritePauseState atomically replaces the pause state stored in the
+// specified directory.
+func WritePauseState(location string, ps PauseState) error {
+	statePath := filepath.Join(location, pauseFile)
+
+	if !ps.Paused() {
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return writeJSONFile(statePath, ps)
+}
+
+// writeJSONFile atomically replaces the file contents with the JSON
+// representation of v.
+func writeJSONFile(path string, v interface{}) error {
+	var (
+		file *os.File
+		err  error
+	)
+	if runtime.GOOS == "windows" {
+		file, err = os.Create(path)
+	} else {
+		file, err = os.Create(path + ".new")
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(v); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Rename(path+".new", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pause pauses deliveries to the specified domain or all deliveries if
+// domain is empty.
+func Pause(location, domain string) error {
+	ps, err := ReadPauseState(location)
+	if err != nil {
+		return err
+	}
+
+	if domain == "" {
+		if !ps.Global {
+			ps.Global = true
+			ps.GlobalSince = time.Now()
+		}
+		return WritePauseState(location, ps)
+	}
+
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return err
+	}
+	if ps.Domains == nil {
+		ps.Domains = make(map[string]time.Time)
+	}
+	if _, ok := ps.Domains[domain]; !ok {
+		ps.Domains[domain] = time.Now()
+	}
+	return WritePauseState(location, ps)
+}
+
+// Resume resumes deliveries to the specified domain or lifts the global
+// pause if domain is empty.
+//
+// Note that resuming the global pause does not resume paused domains.
+func Resume(location, domain string) error {
+	ps, err := ReadPauseState(location)
+	if err != nil {
+		return err
+	}
+
+	if domain == "" {
+		if !ps.Global {
+			return errors.New("queue: delivery is not paused globally")
+		}
+		ps.Global = false
+		ps.GlobalSince = time.Time{}
+		return WritePauseState(location, ps)
+	}
+
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return err
+	}
+	if _, ok := ps.Domains[domain]; !ok {
+		return errors.New("queue: delivery to " + domain + " is not paused")
+	}
+	delete(ps.Domains, domain)
+	return WritePauseState(location, ps)
+}
+
+// splitHeld splits the recipients list into ones that can be delivered now
+// and ones that are held due to the pause.
+func (q *Queue) splitHeld(rcpts []string) (active, held []string) {
+	q.pauseLock.Lock()
+	defer q.pauseLock.Unlock()
+
+	if !q.pause.Paused() {
+		return rcpts, nil
+	}
+
+	for _, rcpt := range rcpts {
+		if q.pause.IsPaused(rcpt) {
+			held = append(held, rcpt)
+		} else {
+			active = append(active, rcpt)
+		}
+	}
+	return active, held
+}
+
+// hold marks the message as held, it will be not delivered until the pause is
+// lifted. If the pause was lifted already, the delivery is rescheduled
+// immediately.
+func (q *Queue) hold(id string, rcpts []string) {
+	q.pauseLock.Lock()
+	stillHeld := false
+	for _, rcpt := range rcpts {
+		if q.pause.IsPaused(rcpt) {
+			stillHeld = true
+			break
+		}
+	}
+	if stillHeld {
+		q.held[id] = rcpts
+		queueHeld.WithLabelValues(q.name).Set(float64(len(q.held)))
+	}
+	q.pauseLock.Unlock()
+
+	if !stillHeld {
+		q.wheel.Add(q.clock.Now(), queueSlot{ID: id})
+	}
+}
+
+// loadPauseState reads the pause state from disk if it was changed since the
+// last call and releases messages that are no longer held.
+func (q *Queue) loadPauseState() error {
+	info, err := os.Stat(filepath.Join(q.location, pauseFile))
+	var mtime time.Time
+	switch {
+	case err == nil:
+		mtime = info.ModTime()
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+
+	q.pauseLock.Lock()
+	if mtime.Equal(q.pauseMtime) {
+		q.pauseLock.Unlock()
+		return nil
+	}
+
+	ps, err := ReadPauseState(q.location)
+	if err != nil {
+		q.pauseLock.Unlock()
+		return err
+	}
+	q.pause = ps
+	q.pauseMtime = mtime
+
+	var released []string
+	for id, rcpts := range q.held {
+		stillHeld := false
+		for _, rcpt := range rcpts {
+			if ps.IsPaused(rcpt) {
+				stillHeld = true
+				break
+			}
+		}
+		if !stillHeld {
+			released = append(released, id)
+			delete(q.held, id)
+		}
+	}
+	q.updatePauseMetrics()
+	q.pauseLock.Unlock()
+
+	switch {
+	case ps.Global:
+		q.Log.Msg("delivery is paused globally", "since", ps.GlobalSince)
+	case len(ps.Domains) != 0:
+		q.Log.Msg("delivery is paused", "domains", ps.DomainList())
+	default:
+		q.Log.Msg("delivery is not paused")
+	}
+
+	if len(released) != 0 {
+		q.release(released)
+	}
+	return nil
+}
+
+// release schedules delivery for the previously held messages.
+//
+// To avoid overloading the remote side with the delivery attempts after
+// a long pause, attempts are spread in time according to the resume_rate.
+func (q *Queue) release(ids []string) {
+	sort.Strings(ids)
+
+	var step time.Duration
+	if q.resumeRate > 0 {
+		step = time.Minute / time.Duration(q.resumeRate)
+	}
+
+	q.Log.Msg("releasing held messages", "count", len(ids), "over", step*time.Duration(len(ids)))
+
+	now := q.clock.Now()
+	for i, id := range ids {
+		q.wheel.Add(now.Add(step*time.Duration(i)), queueSlot{ID: id})
+	}
+}
+
+func (q *Queue) updatePauseMetrics() {
+	if q.pause.Global {
+		queuePaused.WithLabelValues(q.name).Set(1)
+	} else {
+		queuePaused.WithLabelValues(q.name).Set(0)
+	}
+	queuePausedDomains.WithLabelValues(q.name).Set(float64(len(q.pause.Domains)))
+	queueHeld.WithLabelValues(q.name).Set(float64(len(q.held)))
+}
+
+func (q *Queue) watchPauseState() {
+	defer q.pauseWatcherWg.Done()
+
+	t := time.NewTicker(pausePollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := q.loadPauseState(); err != nil {
+				q.Log.Error("failed to load pause state", err)
+			}
+			if err := q.processReroute(); err != nil {
+				q.Log.Error("failed to process reroute request", err)
+			}
+			if err := q.processControl(); err != nil {
+				q.Log.Error("failed to process control request", err)
+			}
+		case <-q.pauseStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestPauseState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ps, err := ReadPauseState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Paused() {
+		t.Fatal("paused without state file")
+	}
+
+	if err := Pause(dir, "EXAMPLE.org"); err != nil {
+		t.Fatal(err)
+	}
+	ps, err = ReadPauseState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ps.IsPaused("test@example.org") || !ps.IsPaused("test@Example.Org") {
+		t.Error("delivery to paused domain is not paused")
+	}
+	if ps.IsPaused("test@example.com") || ps.IsPaused("postmaster") {
+		t.Error("delivery to not paused domain is paused")
+	}
+
+	if err := Pause(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	ps, err = ReadPauseState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ps.IsPaused("test@example.com") {
+		t.Error("global pause is ignored")
+	}
+
+	if err := Resume(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(dir, ""); err == nil {
+		t.Error("no error for repeated resume")
+	}
+	if err := Resume(dir, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// State file should be removed once nothing is paused.
+	if _, err := os.Stat(dir + "/" + pauseFile); !os.IsNotExist(err) {
+		t.Error("pause state file is not removed:", err)
+	}
+}
+
+func TestQueueDelivery_Pause(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	if err := Pause(q.location, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.loadPauseState(); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.com"})
+
+	// Recipients in not paused domains are delivered as usual.
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.com"}, "")
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("message delivered to paused domain: %v", msg.RcptTo)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Make sure held state survives restart.
+	q.Close()
+	checkQueueDir(t, q, []string{deliveryID, "pause"})
+	q = newTestQueueDir(t, &dt, q.location)
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("message delivered to paused domain after restart: %v", msg.RcptTo)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Change should be picked up by the watcher.
+	if err := Resume(q.location, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_PauseGlobal(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	if err := Pause(q.location, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.loadPauseState(); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.com"})
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("message delivered while paused: %v", msg.RcptTo)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	list, err := List(q.location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].MsgMeta.ID != deliveryID {
+		t.Fatalf("unexpected queue listing: %+v", list)
+	}
+
+	if err := Resume(q.location, ""); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org", "tester2@example.com"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
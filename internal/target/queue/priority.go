@@ -0,0 +1,187 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// prioritySemaphore restricts the amount of deliveries attempted in
+// parallel. When a slot is freed, it is given to the waiting delivery with
+// the highest effective priority, deliveries with the same effective
+// priority are started in the FIFO order.
+//
+// To prevent starvation of low-priority deliveries, the effective priority is
+// increased by one for each aging interval the delivery is waiting.
+type prioritySemaphore struct {
+	clk   clock.Clock
+	aging time.Duration
+
+	lock    sync.Mutex
+	free    int
+	waiters []*prioWaiter
+	closed  bool
+}
+
+type prioWaiter struct {
+	priority int
+	since    time.Time
+	ready    chan struct{}
+	ok       bool
+}
+
+func newPrioritySemaphore(clk clock.Clock, max int, aging time.Duration) *prioritySemaphore {
+	return &prioritySemaphore{
+		clk:   clk,
+		aging: aging,
+		free:  max,
+	}
+}
+
+func (ps *prioritySemaphore) effective(w *prioWaiter, now time.Time) int {
+	if ps.aging <= 0 {
+		return w.priority
+	}
+	return w.priority + int(now.Sub(w.since)/ps.aging)
+}
+
+// acquire takes the slot, waiting if necessary. It returns false without
+// taking the slot if the semaphore is closed.
+func (ps *prioritySemaphore) acquire(priority int) bool {
+	ps.lock.Lock()
+	if ps.closed {
+		ps.lock.Unlock()
+		return false
+	}
+	if ps.free > 0 && len(ps.waiters) == 0 {
+		ps.free--
+		ps.lock.Unlock()
+		return true
+	}
+
+	w := &prioWaiter{
+		priority: priority,
+		since:    ps.clk.Now(),
+		ready:    make(chan struct{}),
+	}
+	ps.waiters = append(ps.waiters, w)
+	ps.lock.Unlock()
+
+	<-w.ready
+	return w.ok
+}
+
+// release frees the slot and passes it to the next waiting delivery, if any.
+func (ps *prioritySemaphore) release() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if len(ps.waiters) == 0 {
+		ps.free++
+		return
+	}
+
+	now := ps.clk.Now()
+	best := 0
+	bestPrio := ps.effective(ps.waiters[0], now)
+	// waiters are sorted by the arrival time, so the first one wins on ties.
+	for i, w := range ps.waiters[1:] {
+		if prio := ps.effective(w, now); prio > bestPrio {
+			best, bestPrio = i+1, prio
+		}
+	}
+
+	w := ps.waiters[best]
+	ps.waiters = append(ps.waiters[:best], ps.waiters[best+1:]...)
+	w.ok = true
+	close(w.ready)
+}
+
+// close makes all waiting and further acquire calls fail. Slots that are
+// already taken should still be released.
+func (ps *prioritySemaphore) close() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.closed = true
+	for _, w := range ps.waiters {
+		close(w.ready)
+	}
+	ps.waiters = nil
+}
+
+// waiting returns the amount of deliveries waiting for the slot.
+func (ps *prioritySemaphore) waiting() int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return len(ps.waiters)
+}
+
+// sizePriority is the priority assigned to messages of at least Size bytes.
+type sizePriority struct {
+	Size     int
+	Priority int
+}
+
+// sizePriorityFor returns the priority for the message of the specified size
+// using size_priority thresholds. ok is false if no threshold matches.
+func (q *Queue) sizePriorityFor(size int) (priority int, ok bool) {
+	// Thresholds are sorted in the ascending order of size.
+	for i := len(q.sizePriorities) - 1; i >= 0; i-- {
+		if size >= q.sizePriorities[i].Size {
+			return q.sizePriorities[i].Priority, true
+		}
+	}
+	return 0, false
+}
+
+func sizePriorityDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "expected a block with thresholds")
+	}
+	thresholds := make([]sizePriority, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "expected size and priority")
+		}
+		size, err := config.ParseDataSize(child.Name)
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		priority, err := module.ParsePriority(child.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		thresholds = append(thresholds, sizePriority{Size: size, Priority: priority})
+	}
+	sort.Slice(thresholds, func(i, j int) bool {
+		return thresholds[i].Size < thresholds[j].Size
+	})
+	for i := 1; i < len(thresholds); i++ {
+		if thresholds[i].Size == thresholds[i-1].Size {
+			return nil, config.NodeErr(node, "duplicate threshold: %d", thresholds[i].Size)
+		}
+	}
+	return thresholds, nil
+}
@@ -0,0 +1,145 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func waitSemaphoreWaiting(t *testing.T, ps *prioritySemaphore, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if ps.waiting() == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d waiting deliveries, got %d", count, ps.waiting())
+}
+
+func checkSemaphoreOrder(t *testing.T, ps *prioritySemaphore, started <-chan int, expected []int) {
+	t.Helper()
+	for _, want := range expected {
+		ps.release()
+		if got := <-started; got != want {
+			t.Fatalf("wrong delivery started: want %d, got %d", want, got)
+		}
+	}
+	ps.release()
+}
+
+func TestPrioritySemaphore(t *testing.T) {
+	ps := newPrioritySemaphore(clock.Real, 1, 0)
+	ps.acquire(0)
+
+	started := make(chan int)
+	for i, priority := range []int{0, 5, -5, 5} {
+		i, priority := i, priority
+		go func() {
+			ps.acquire(priority)
+			started <- i
+		}()
+		waitSemaphoreWaiting(t, ps, i+1)
+	}
+
+	// Higher priority first, FIFO for the same priority.
+	checkSemaphoreOrder(t, ps, started, []int{1, 3, 0, 2})
+}
+
+func TestPrioritySemaphore_Close(t *testing.T) {
+	ps := newPrioritySemaphore(clock.Real, 1, 0)
+	if !ps.acquire(0) {
+		t.Fatal("acquire failed")
+	}
+
+	res := make(chan bool)
+	go func() {
+		res <- ps.acquire(0)
+	}()
+	waitSemaphoreWaiting(t, ps, 1)
+
+	ps.close()
+	if <-res {
+		t.Fatal("waiting acquire succeeded after close")
+	}
+	if ps.acquire(0) {
+		t.Fatal("acquire succeeded after close")
+	}
+	ps.release()
+}
+
+func TestPrioritySemaphore_Aging(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	ps := newPrioritySemaphore(clk, 1, time.Minute)
+	ps.acquire(0)
+
+	started := make(chan int)
+	go func() {
+		ps.acquire(-5)
+		started <- 0
+	}()
+	waitSemaphoreWaiting(t, ps, 1)
+
+	clk.Advance(10 * time.Minute)
+
+	go func() {
+		ps.acquire(3)
+		started <- 1
+	}()
+	waitSemaphoreWaiting(t, ps, 2)
+
+	// -5 + 10 minutes of waiting > 3.
+	checkSemaphoreOrder(t, ps, started, []int{0, 1})
+}
+
+func TestSizePriority(t *testing.T) {
+	v, err := sizePriorityDirective(nil, config.Node{
+		Children: []config.Node{
+			{Name: "10M", Args: []string{"bulk"}},
+			{Name: "0", Args: []string{"1"}},
+			{Name: "1M", Args: []string{"-2"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := Queue{sizePriorities: v.([]sizePriority)}
+
+	for _, c := range []struct {
+		size     int
+		priority int
+	}{
+		{100, 1},
+		{1024 * 1024, -2},
+		{5 * 1024 * 1024, -2},
+		{20 * 1024 * 1024, -5},
+	} {
+		if priority, ok := q.sizePriorityFor(c.size); !ok || priority != c.priority {
+			t.Errorf("sizePriorityFor(%d) = %d, %v; want %d", c.size, priority, ok, c.priority)
+		}
+	}
+
+	if _, ok := (&Queue{}).sizePriorityFor(100); ok {
+		t.Error("priority is assigned without thresholds")
+	}
+}
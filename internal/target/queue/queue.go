@@ -64,12 +64,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"runtime/trace"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -78,12 +78,15 @@ import (
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/clock"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/target"
 )
@@ -126,14 +129,50 @@ type Queue struct {
 	autogenMsgDomain string
 	wheel            *TimeWheel
 
+	// Time source for the retry scheduling, clock.Real unless replaced
+	// by tests.
+	clock clock.Clock
+
 	dsnPipeline module.DeliveryTarget
 
 	// Retry delay is calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
+	// unless retryIntervals or retryClasses are set, see retry.go.
 
 	initialRetryTime time.Duration
 	retryTimeScale   float64
+	maxRetryInterval time.Duration
+	retryIntervals   []time.Duration
+	retryClasses     map[string][]time.Duration
 	maxTries         int
+	maxLifetime      time.Duration
+	maxHoldTime      time.Duration
+
+	// Max time Close waits for deliveries in progress to complete, 0 means
+	// no limit.
+	shutdownTimeout time.Duration
+
+	// Include the original message in DSNs in full if it is not bigger than
+	// that, 0 means only the header is always included.
+	bounceFullMsgMaxSize int
+
+	// Send the delayed delivery warning if the message is not delivered
+	// after that time, 0 disables warnings. If delayWarningLocal is set,
+	// warnings are sent only for messages with LocalSender set.
+	delayWarning      time.Duration
+	delayWarningLocal bool
+
+	// Amount of the latest delivery attempt diagnostics to keep for each
+	// recipient, see diag.go.
+	maxDiagnostics int
+
+	// Persistence settings, see durability.go.
+	durability string
+	committer  *groupCommitter
+
+	// Compression settings for stored message bodies. Bodies are read
+	// correctly regardless of it.
+	compression buffer.Compression
 
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
@@ -151,9 +190,32 @@ type Queue struct {
 	Target module.DeliveryTarget
 
 	deliveryWg sync.WaitGroup
-	// Buffered channel used to restrict count of deliveries attempted
-	// in parallel.
-	deliverySemaphore chan struct{}
+	// Used to restrict count of deliveries attempted in parallel, see
+	// priority.go.
+	deliverySemaphore *prioritySemaphore
+	priorityAging     time.Duration
+
+	// Priority for messages with normal priority based on their size,
+	// sorted by size.
+	sizePriorities []sizePriority
+
+	// Per-destination domain limits, see destlimits.go. destLimits is nil
+	// if no limits are configured. destCtx is cancelled on Close to stop
+	// waiting for the delivery slots.
+	destLimitCfg  limits.DestConfig
+	destLimits    *limiters.KeyedFIFO
+	destCtx       context.Context
+	destCtxCancel context.CancelFunc
+
+	// Delivery pause state, see pause.go.
+	pauseLock      sync.Mutex
+	pause          PauseState
+	pauseMtime     time.Time
+	held           map[string][]string
+	resumeRate     int
+	pauseStop      chan struct{}
+	pauseStopOnce  sync.Once
+	pauseWatcherWg sync.WaitGroup
 }
 
 type QueueMetadata struct {
@@ -175,8 +237,36 @@ type QueueMetadata struct {
 	// Amount of times delivery *already tried*.
 	TriesCount map[string]int
 
+	// Diagnostics for the latest failed delivery attempts, per recipient.
+	Diagnostics map[string][]Diagnostic `json:",omitempty"`
+
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Time of the next scheduled delivery attempt. It is zero for held
+	// messages and for entries written by older versions, in this case the
+	// time is calculated from LastAttempt and TriesCount.
+	NextAttempt time.Time
+
+	// Recipients from To that are retried together, see retrygroups.go. If
+	// it is empty, all recipients are tried on the next attempt.
+	RetryGroups []RetryGroup `json:",omitempty"`
+
+	// Set if the message was submitted by an authenticated user or generated
+	// locally, used to decide whether delayed delivery warnings are sent.
+	LocalSender bool `json:",omitempty"`
+
+	// Set once the delayed delivery warning is sent.
+	DelayWarningSent bool `json:",omitempty"`
+
+	// Set if the message is put on hold by the administrator, such
+	// messages are not delivered until released, see control.go.
+	Held bool `json:",omitempty"`
+
+	// The message should not be delivered before that time. It is
+	// initialized from MsgMeta.DeliverAfter capped by max_hold_time and can
+	// be changed using ControlDefer.
+	DeliverAfter time.Time
 }
 
 type queueSlot struct {
@@ -195,6 +285,10 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
+		maxDiagnostics:   5,
+		priorityAging:    1 * time.Minute,
+		durability:       DurabilityStrict,
+		clock:            clock.Real,
 		Log:              log.Logger{Name: "queue"},
 	}
 	switch len(inlineArgs) {
@@ -209,14 +303,47 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
+	var (
+		maxParallelism      int
+		groupWindow         time.Duration
+		delayWarningSenders string
+	)
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
+	cfg.Duration("max_lifetime", false, false, 0, &q.maxLifetime)
+	cfg.Duration("max_hold_time", false, false, 7*24*time.Hour, &q.maxHoldTime)
+	cfg.Duration("shutdown_timeout", true, false, 30*time.Second, &q.shutdownTimeout)
+	cfg.Duration("retry_initial_interval", false, false, q.initialRetryTime, &q.initialRetryTime)
+	cfg.Float("retry_multiplier", false, false, q.retryTimeScale, &q.retryTimeScale)
+	cfg.Duration("retry_max_interval", false, false, 0, &q.maxRetryInterval)
+	cfg.Custom("retry_intervals", false, false, nil, retryIntervalsDirective, &q.retryIntervals)
+	cfg.Custom("retry_classes", false, false, nil, retryClassesDirective, &q.retryClasses)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
+	cfg.Duration("priority_aging", false, false, q.priorityAging, &q.priorityAging)
+	cfg.Custom("size_priority", false, false, nil, sizePriorityDirective, &q.sizePriorities)
+	cfg.Custom("destination_limits", false, false, destLimitsDefault, destLimitsDirective, &q.destLimitCfg)
+	cfg.Int("max_diagnostics", false, false, q.maxDiagnostics, &q.maxDiagnostics)
+	cfg.Enum("durability", false, false,
+		[]string{DurabilityStrict, DurabilityGrouped, DurabilityRelaxed}, q.durability, &q.durability)
+	cfg.Duration("group_commit_window", false, false, 20*time.Millisecond, &groupWindow)
+	cfg.Custom("compression", false, false, func() (interface{}, error) {
+		return buffer.Compression{}, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		c, err := buffer.ParseCompression(node.Args)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return c, nil
+	}, &q.compression)
+	cfg.DataSize("compression_min_size", false, false, 4096, &q.compression.MinSize)
 	cfg.String("location", false, false, q.location, &q.location)
+	cfg.Int("resume_rate", false, false, 60, &q.resumeRate)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
 	cfg.String("hostname", true, true, "", &q.hostname)
 	cfg.String("autogenerated_msg_domain", true, false, "", &q.autogenMsgDomain)
+	cfg.DataSize("bounce_full_message_max_size", false, false, 0, &q.bounceFullMsgMaxSize)
+	cfg.Duration("delay_warning", false, false, 4*time.Hour, &q.delayWarning)
+	cfg.Enum("delay_warning_senders", false, false, []string{"all", "local"}, "all", &delayWarningSenders)
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
@@ -224,6 +351,28 @@ func (q *Queue) Init(cfg *config.Map) error {
 		return err
 	}
 
+	q.delayWarningLocal = delayWarningSenders == "local"
+
+	if q.maxTries <= 0 {
+		return errors.New("queue: max_tries should be positive")
+	}
+	if q.initialRetryTime <= 0 {
+		return errors.New("queue: retry_initial_interval should be positive")
+	}
+	if q.retryTimeScale < 1 {
+		return errors.New("queue: retry_multiplier should be at least 1")
+	}
+	if q.priorityAging < 0 {
+		return errors.New("queue: priority_aging should not be negative")
+	}
+
+	if q.durability == DurabilityGrouped {
+		if groupWindow <= 0 {
+			return errors.New("queue: group_commit_window should be positive")
+		}
+		q.committer = newGroupCommitter(groupWindow)
+	}
+
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
 			return errors.New("queue: autogenerated_msg_domain is required if bounce {} is specified")
@@ -232,11 +381,11 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
 	}
-	if q.location == "" && q.name == "" {
-		return errors.New("queue: need explicit location directive or inline argument if defined inline")
+	if err := q.defaultLocation(); err != nil {
+		return err
 	}
-	if q.location == "" {
-		q.location = filepath.Join(config.StateDirectory, q.name)
+	if config.CheckOnly {
+		return nil
 	}
 
 	// TODO: Check location write permissions.
@@ -247,23 +396,97 @@ func (q *Queue) Init(cfg *config.Map) error {
 	return q.start(maxParallelism)
 }
 
+func (q *Queue) defaultLocation() error {
+	if q.location == "" && q.name == "" {
+		return errors.New("queue: need explicit location directive or inline argument if defined inline")
+	}
+	if q.location == "" {
+		q.location = filepath.Join(config.StateDirectory, q.name)
+	}
+	return nil
+}
+
+// ReadLocation processes the module configuration to determine the queue
+// directory without initializing the queue itself.
+//
+// It is meant for use by management utilities that work with the queue
+// directory directly.
+func (q *Queue) ReadLocation(cfg *config.Map) (string, error) {
+	cfg.String("location", false, false, q.location, &q.location)
+	cfg.AllowUnknown()
+	if _, err := cfg.Process(); err != nil {
+		return "", err
+	}
+	if err := q.defaultLocation(); err != nil {
+		return "", err
+	}
+	return q.location, nil
+}
+
 func (q *Queue) start(maxParallelism int) error {
-	q.wheel = NewTimeWheel(q.dispatch)
-	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.wheel = NewTimeWheel(q.clock, q.dispatch)
+	q.deliverySemaphore = newPrioritySemaphore(q.clock, maxParallelism, q.priorityAging)
+	q.destCtx, q.destCtxCancel = context.WithCancel(context.Background())
+	if q.destLimitCfg.Default != (limits.DestLimits{}) || len(q.destLimitCfg.Overrides) != 0 {
+		q.destLimits = q.destLimitCfg.NewFIFO(q.clock)
+	}
+	q.held = make(map[string][]string)
+	q.pauseStop = make(chan struct{})
+
+	if err := q.loadPauseState(); err != nil {
+		return err
+	}
 
 	if err := q.readDiskQueue(); err != nil {
 		return err
 	}
 
+	// Entries are loaded from disk with the retry delay preserved, so process
+	// reroute and control requests made while the server was not running.
+	if err := q.processReroute(); err != nil {
+		q.Log.Error("failed to process reroute request", err)
+	}
+	if err := q.processControl(); err != nil {
+		q.Log.Error("failed to process control request", err)
+	}
+
+	q.pauseWatcherWg.Add(1)
+	go q.watchPauseState()
+
 	q.Log.Debugf("delivery target: %T", q.Target)
 
 	return nil
 }
 
 func (q *Queue) Close() error {
+	q.pauseStopOnce.Do(func() {
+		close(q.pauseStop)
+	})
+	q.pauseWatcherWg.Wait()
 	q.wheel.Close()
-	q.deliveryWg.Wait()
-
+	// Messages waiting for the delivery slots are left on disk and
+	// will be picked up on the next start.
+	q.destCtxCancel()
+	q.deliverySemaphore.close()
+
+	// Let deliveries in progress finish to avoid duplicates caused by
+	// transactions interrupted after the remote server got the message.
+	done := make(chan struct{})
+	go func() {
+		q.deliveryWg.Wait()
+		close(done)
+	}()
+	if q.shutdownTimeout == 0 {
+		<-done
+		return nil
+	}
+	timer := time.NewTimer(q.shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		q.Log.Printf("deliveries are still in progress after %v, not waiting for them", q.shutdownTimeout)
+	}
 	return nil
 }
 
@@ -289,10 +512,7 @@ func (q *Queue) dispatch(value TimeSlot) {
 
 	q.deliveryWg.Add(1)
 	go func() {
-		q.Log.Debugln("waiting on delivery semaphore for", slot.ID)
-		q.deliverySemaphore <- struct{}{}
 		defer func() {
-			<-q.deliverySemaphore
 			q.deliveryWg.Done()
 
 			if dontRecover {
@@ -306,7 +526,6 @@ func (q *Queue) dispatch(value TimeSlot) {
 			}
 		}()
 
-		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
 		var (
 			meta *QueueMetadata
 			hdr  textproto.Header
@@ -328,7 +547,41 @@ func (q *Queue) dispatch(value TimeSlot) {
 			body = slot.Body
 		}
 
-		q.tryDelivery(meta, hdr, body)
+		if meta.DeliverAfter.After(q.clock.Now()) {
+			// Entry is rescheduled by flush or pause release, or the
+			// release time is changed using maddyctl.
+			q.Log.Debugln("delivery is deferred until", meta.DeliverAfter, "for", slot.ID)
+			q.wheel.Add(meta.DeliverAfter, queueSlot{ID: slot.ID})
+			return
+		}
+
+		active, held := q.splitHeld(meta.To)
+		if len(active) == 0 {
+			target.DeliveryLogger(q.Log, meta.MsgMeta).Msg("delivery paused, message held", "rcpts", held)
+			q.hold(slot.ID, held)
+			return
+		}
+		meta.To = active
+		waiting := q.splitDue(meta)
+
+		domains := destDomains(meta.To)
+		if err := q.takeDestinations(slot.ID, domains); err != nil {
+			q.Log.Debugln("delivery interrupted while waiting for the slot for", slot.ID)
+			return
+		}
+		defer q.releaseDestinations(domains)
+
+		q.Log.Debugln("waiting on delivery semaphore for", slot.ID, "priority", meta.MsgMeta.Priority)
+		if !q.deliverySemaphore.acquire(meta.MsgMeta.Priority) {
+			// The message is left on disk and will be picked up on the next
+			// start.
+			q.Log.Debugln("delivery interrupted while waiting on delivery semaphore for", slot.ID)
+			return
+		}
+		defer q.deliverySemaphore.release()
+		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
+
+		q.tryDelivery(meta, hdr, body, held, waiting)
 	}()
 }
 
@@ -353,9 +606,11 @@ func toSMTPErr(err error) *smtp.SMTPError {
 	if ok {
 		res.Code = ctxCode
 	}
-	ctxEnchCode, ok := ctxInfo["smtp_enchcode"].(smtp.EnhancedCode)
-	if ok {
+	switch ctxEnchCode := ctxInfo["smtp_enchcode"].(type) {
+	case smtp.EnhancedCode:
 		res.EnhancedCode = ctxEnchCode
+	case exterrors.EnhancedCode:
+		res.EnhancedCode = smtp.EnhancedCode(ctxEnchCode)
 	}
 	ctxMsg, ok := ctxInfo["smtp_msg"].(string)
 	if ok {
@@ -372,15 +627,21 @@ func toSMTPErr(err error) *smtp.SMTPError {
 	return res
 }
 
-func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) {
+// tryDelivery attempts delivery to recipients in meta.To and schedules the
+// next attempt if needed. heldRcpts are recipients delivery to which is
+// paused, they are preserved in the metadata for later.
+// tryDelivery attempts to deliver the message to recipients in meta.To.
+// heldRcpts are recipients the delivery is paused for and waiting are retry
+// groups that are not due yet, both are kept in the queue as is.
+func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, heldRcpts []string, waiting []RetryGroup) {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 
 	partialErr := q.deliver(meta, header, body)
 	dl.Debugf("errors: %v", partialErr.Errs)
 
-	// While iterating the list of recipients we also pick the smallest tries count
-	// and use it to calculate the delay for the next attempt.
-	smallestTriesCount := 999999
+	// Recipients to retry are grouped to be tried together, see
+	// retrygroups.go.
+	grouper := newRetryGrouper(q.clock.Now(), waiting)
 
 	if meta.TriesCount == nil {
 		meta.TriesCount = make(map[string]int)
@@ -391,62 +652,89 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	// and recipients DSN will be generated for.
 	newRcpts := make([]string, 0, len(partialErr.Errs))
 	failedRcpts := make([]string, 0, len(partialErr.Errs))
+	deliveredRcpts := make([]string, 0, len(meta.To))
 	for _, rcpt := range meta.To {
 		rcptErr, ok := partialErr.Errs[rcpt]
 		if !ok {
 			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			delete(meta.Diagnostics, rcpt)
+			deliveredRcpts = append(deliveredRcpts, rcpt)
 			continue
 		}
 
 		// Save last error (either temporary or permanent) for reporting in the DSN.
 		dl.Error("delivery attempt failed", rcptErr, "rcpt", rcpt)
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
+		q.addDiagnostic(meta, rcpt, rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
-		if !temporary || meta.TriesCount[rcpt]+1 == q.maxTries {
-			delete(meta.TriesCount, rcpt)
+		switch {
+		case !temporary:
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
-			failedRcpts = append(failedRcpts, rcpt)
+		case meta.TriesCount[rcpt]+1 == q.maxTries:
+			dl.Msg("not delivered, max_tries reached", "rcpt", rcpt)
+		case q.expired(meta):
+			dl.Msg("not delivered, max_lifetime exceeded", "rcpt", rcpt)
+		default:
+			// Temporary error, increase tries counter and requeue.
+			meta.TriesCount[rcpt]++
+			newRcpts = append(newRcpts, rcpt)
+			grouper.add(retryGroupKey(rcpt, rcptErr), rcpt, q.retryDelay(rcptErr, meta.TriesCount[rcpt]))
 			continue
 		}
 
-		// Temporary error, increase tries counter and requeue.
-		meta.TriesCount[rcpt]++
-		newRcpts = append(newRcpts, rcpt)
+		delete(meta.TriesCount, rcpt)
+		failedRcpts = append(failedRcpts, rcpt)
+	}
 
-		// See smallestTriesCount comment.
-		if count := meta.TriesCount[rcpt]; count < smallestTriesCount {
-			smallestTriesCount = count
-		}
+	// Success DSNs are generated only if requested using NOTIFY=SUCCESS.
+	if len(deliveredRcpts) != 0 {
+		q.emitDSN(meta, header, nil, deliveredRcpts, dsn.ActionDelivered)
 	}
 
 	// Generate DSN for recipients that failed permanently this time.
 	if len(failedRcpts) != 0 {
-		q.emitDSN(meta, header, failedRcpts)
+		q.emitDSN(meta, header, body, failedRcpts, dsn.ActionFailed)
+		for _, rcpt := range failedRcpts {
+			delete(meta.Diagnostics, rcpt)
+		}
 	}
 	// No recipients to try, either all failed or all succeeded.
-	if len(newRcpts) == 0 {
+	if len(grouper.groups) == 0 && len(heldRcpts) == 0 {
 		q.removeFromDisk(meta.MsgMeta)
 		return
 	}
 
+	if len(newRcpts) != 0 && q.shouldWarnDelay(meta) {
+		q.emitDSN(meta, header, nil, newRcpts, dsn.ActionDelayed)
+		meta.DelayWarningSent = true
+	}
+
 	meta.To = newRcpts
-	meta.LastAttempt = time.Now()
+	for _, grp := range waiting {
+		meta.To = append(meta.To, grp.Rcpts...)
+	}
+	meta.To = append(meta.To, heldRcpts...)
+	meta.LastAttempt = q.clock.Now()
+	meta.RetryGroups = grouper.groups
+	nextTryTime := grouper.nextAttempt()
+	meta.NextAttempt = nextTryTime
 
 	if err := q.updateMetadataOnDisk(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
-	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	if len(grouper.groups) == 0 {
+		dl.Msg("delivery paused, message held", "rcpts", heldRcpts)
+		q.hold(meta.MsgMeta.ID, heldRcpts)
+		return
+	}
+
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
-		"next_try_delay", time.Until(nextTryTime),
-		"rcpts", meta.To)
+		"next_try_delay", nextTryTime.Sub(q.clock.Now()),
+		"rcpts", meta.To,
+		"retry_groups", len(meta.RetryGroups))
 
 	q.wheel.Add(nextTryTime, queueSlot{
 		ID: meta.MsgMeta.ID,
@@ -467,7 +755,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	}
 
 	msgMeta := meta.MsgMeta.DeepCopy()
-	msgMeta.ID = msgMeta.ID + "-" + strconv.FormatInt(time.Now().Unix(), 16)
+	msgMeta.ID = msgMeta.ID + "-" + strconv.FormatInt(q.clock.Now().Unix(), 16)
 	dl.Debugf("using message ID = %s", msgMeta.ID)
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
@@ -557,6 +845,10 @@ type queueDelivery struct {
 
 	header textproto.Header
 	body   buffer.Buffer
+
+	// Name of the meta-data file written by Body, it is put in place by
+	// Commit.
+	metaName string
 }
 
 func (qd *queueDelivery) AddRcpt(ctx context.Context, rcptTo string) error {
@@ -567,15 +859,22 @@ func (qd *queueDelivery) AddRcpt(ctx context.Context, rcptTo string) error {
 func (qd *queueDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "queue/Body").End()
 
+	if qd.meta.MsgMeta.Priority == 0 {
+		if priority, ok := qd.q.sizePriorityFor(body.Len()); ok {
+			qd.meta.MsgMeta.Priority = priority
+		}
+	}
+
 	// Body buffer initially passed to us may not be valid after "delivery" to queue completes.
 	// storeNewMessage returns a new buffer object created from message blob stored on disk.
-	storedBody, err := qd.q.storeNewMessage(qd.meta, header, body)
+	storedBody, metaName, err := qd.q.storeNewMessage(qd.meta, header, body)
 	if err != nil {
 		return err
 	}
 
 	qd.body = storedBody
 	qd.header = header
+	qd.metaName = metaName
 	return nil
 }
 
@@ -583,7 +882,27 @@ func (qd *queueDelivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "queue/Abort").End()
 
 	if qd.body != nil {
-		qd.q.removeFromDisk(qd.meta.MsgMeta)
+		qd.q.removeMessageFiles(qd.meta.MsgMeta, qd.metaName)
+	}
+	return nil
+}
+
+// persist puts the meta-data file written by Body in place, making the
+// message visible to the queue after restart.
+//
+// If the server is killed before that, the message is not acknowledged to
+// the client, so it is going to be sent again. Files of such messages are
+// removed on start-up instead of being delivered, avoiding duplicates.
+func (qd *queueDelivery) persist() error {
+	id := qd.meta.MsgMeta.ID
+	if err := qd.q.commitMetadata(id, qd.metaName); err != nil {
+		// Rename may succeed even if the directory sync failed.
+		metaName := qd.metaName
+		if _, statErr := os.Stat(filepath.Join(qd.q.location, id+".meta")); statErr == nil {
+			metaName = id + ".meta"
+		}
+		qd.q.removeMessageFiles(qd.meta.MsgMeta, metaName)
+		return err
 	}
 	return nil
 }
@@ -595,12 +914,21 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
-		ID:   qd.meta.MsgMeta.ID,
-		Meta: qd.meta,
-		Hdr:  &qd.header,
-		Body: qd.body,
-	})
+	if err := qd.persist(); err != nil {
+		return err
+	}
+
+	if !qd.meta.DeliverAfter.IsZero() {
+		// Do not keep the message in memory until it is released.
+		qd.q.wheel.Add(qd.meta.DeliverAfter, queueSlot{ID: qd.meta.MsgMeta.ID})
+	} else {
+		qd.q.wheel.Add(time.Time{}, queueSlot{
+			ID:   qd.meta.MsgMeta.ID,
+			Meta: qd.meta,
+			Hdr:  &qd.header,
+			Body: qd.body,
+		})
+	}
 	qd.meta = nil
 	qd.body = nil
 	return nil
@@ -611,13 +939,25 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 		MsgMeta:      msgMeta,
 		From:         mailFrom,
 		RcptErrs:     map[string]*smtp.SMTPError{},
-		FirstAttempt: time.Now(),
-		LastAttempt:  time.Now(),
+		FirstAttempt: q.clock.Now(),
+		LastAttempt:  q.clock.Now(),
+		NextAttempt:  q.clock.Now(),
+		LocalSender:  msgMeta.Conn == nil || msgMeta.Conn.AuthUser != "",
+		DeliverAfter: q.holdUntil(msgMeta.DeliverAfter),
+	}
+	if !meta.DeliverAfter.IsZero() {
+		meta.NextAttempt = meta.DeliverAfter
 	}
 	return &queueDelivery{q: q, meta: meta}, nil
 }
 
 func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
+	q.removeMessageFiles(msgMeta, msgMeta.ID+".meta")
+}
+
+// removeMessageFiles removes the message files from the queue directory
+// using metaName as the name of the meta-data file.
+func (q *Queue) removeMessageFiles(msgMeta *module.MsgMetadata, metaName string) {
 	id := msgMeta.ID
 	dl := target.DeliveryLogger(q.Log, msgMeta)
 
@@ -632,7 +972,7 @@ func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
 	if err := os.Remove(bodyPath); err != nil {
 		dl.Error("failed to remove body from disk", err)
 	}
-	metaPath := filepath.Join(q.location, id+".meta")
+	metaPath := filepath.Join(q.location, metaName)
 	if err := os.Remove(metaPath); err != nil {
 		dl.Error("failed to remove meta-data from disk", err)
 	}
@@ -645,9 +985,9 @@ func (q *Queue) readDiskQueue() error {
 		return err
 	}
 
-	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
+	q.removeOrphans(dirInfo)
 
-	loadedCount := 0
+	loadedCount, brokenCount := 0, 0
 	for _, entry := range dirInfo {
 		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
 		// This allows us to properly detect dangling body files.
@@ -658,7 +998,12 @@ func (q *Queue) readDiskQueue() error {
 
 		meta, err := q.readMessageMeta(id)
 		if err != nil {
-			q.Log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
+			// Do not refuse to start because of a single damaged entry, but
+			// make sure it is not silently left in the queue. Header and
+			// body are preserved for manual recovery.
+			q.Log.Error("unreadable queue entry, skipping it and marking as broken", err, "msg_id", id)
+			q.discardBroken(id)
+			brokenCount++
 			continue
 		}
 
@@ -686,21 +1031,27 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
+		if meta.Held {
+			q.Log.Debugf("message is on hold (msg ID = %s)", id)
+			continue
+		}
+
+		nextTryTime := meta.NextAttempt
+		if nextTryTime.IsZero() {
+			smallestTriesCount := 999999
+			for _, count := range meta.TriesCount {
+				if smallestTriesCount > count {
+					smallestTriesCount = count
+				}
 			}
+			nextTryTime = meta.LastAttempt.Add(q.retryDelay(nil, smallestTriesCount))
 		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
 
-		if time.Until(nextTryTime) < q.postInitDelay {
-			nextTryTime = time.Now().Add(q.postInitDelay)
+		if nextTryTime.Sub(q.clock.Now()) < q.postInitDelay {
+			nextTryTime = q.clock.Now().Add(q.postInitDelay)
 		}
 
-		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
+		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, nextTryTime.Sub(q.clock.Now()), nextTryTime)
 		q.wheel.Add(nextTryTime, queueSlot{
 			ID: id,
 		})
@@ -710,103 +1061,273 @@ func (q *Queue) readDiskQueue() error {
 	if loadedCount != 0 {
 		q.Log.Printf("loaded %d saved queue entries", loadedCount)
 	}
+	if brokenCount != 0 {
+		q.Log.Printf("%d queue entries are broken and will not be delivered, see .meta_broken files in %s", brokenCount, q.location)
+	}
 
 	return nil
 }
 
-func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+// removeOrphans removes files left by messages that were not committed to
+// the queue: uncommitted meta-data files and header and body files without
+// the corresponding meta-data.
+func (q *Queue) removeOrphans(dirInfo []os.FileInfo) {
+	ids := make(map[string]struct{}, len(dirInfo)/3)
+	for _, entry := range dirInfo {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".meta"):
+			ids[strings.TrimSuffix(name, ".meta")] = struct{}{}
+		case strings.HasSuffix(name, ".meta_broken"):
+			ids[strings.TrimSuffix(name, ".meta_broken")] = struct{}{}
+		}
+	}
+
+	for _, entry := range dirInfo {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, ".meta.new"):
+			q.tryRemoveDanglingFile(name)
+		case strings.HasSuffix(name, ".header"), strings.HasSuffix(name, ".body"):
+			if _, ok := ids[strings.TrimSuffix(name, filepath.Ext(name))]; !ok {
+				q.tryRemoveDanglingFile(name)
+			}
+		}
+	}
+}
+
+// storeNewMessage writes the message files and the meta-data into the queue
+// directory and makes sure they reached the disk.
+//
+// The meta-data file is not put in place, this is done by the commitMetadata
+// call using the returned file name once the message is committed.
+func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, string, error) {
 	id := meta.MsgMeta.ID
 
 	headerPath := filepath.Join(q.location, id+".header")
 	headerFile, err := os.Create(headerPath)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer headerFile.Close()
 
 	if err := textproto.WriteHeader(headerFile, header); err != nil {
 		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
+		return nil, "", err
 	}
 
-	bodyReader, err := body.Open()
+	bodyPath := filepath.Join(q.location, id+".body")
+	var (
+		bodyFile *os.File
+		stored   buffer.Buffer
+	)
+	if q.compression.Enabled() && body.Len() >= q.compression.MinSize {
+		bodyFile, err = q.writeCompressedBody(body, bodyPath)
+		stored = buffer.CompressedFileBuffer{Path: bodyPath, Size: body.Len()}
+	} else {
+		bodyFile, err = q.writeBody(body, bodyPath)
+		stored = buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}
+	}
 	if err != nil {
 		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
+		return nil, "", err
 	}
-	defer bodyReader.Close()
+	defer bodyFile.Close()
 
-	bodyPath := filepath.Join(q.location, id+".body")
-	bodyFile, err := os.Create(bodyPath)
+	metaFile, metaName, err := q.writeMetadata(meta)
 	if err != nil {
-		return nil, err
+		q.tryRemoveDanglingFile(id + ".body")
+		q.tryRemoveDanglingFile(id + ".header")
+		return nil, "", err
 	}
-	defer bodyFile.Close()
+	defer metaFile.Close()
 
-	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
+	// All files are synced at once so they can be committed in the same group
+	// in the grouped durability mode.
+	if err := q.syncFiles(headerFile, bodyFile, metaFile); err != nil {
+		// Some of the writes may have landed, but the client will retry
+		// the message so remove them to not deliver it twice.
+		q.tryRemoveDanglingFile(metaName)
 		q.tryRemoveDanglingFile(id + ".body")
 		q.tryRemoveDanglingFile(id + ".header")
+		return nil, "", syncError(err)
+	}
+
+	return stored, metaName, nil
+}
+
+// writeBody stores the message body at the specified path and returns the
+// opened file so it can be synced. The file is removed on failure.
+//
+// If the body is already stored in a file (see buffer.FileBacked), it is
+// hard-linked instead of copying it.
+func (q *Queue) writeBody(body buffer.Buffer, path string) (*os.File, error) {
+	err := buffer.Link(body, path)
+	if err == nil {
+		f, err := os.Open(path)
+		if err != nil {
+			os.Remove(path)
+		}
+		return f, err
+	}
+	if !errors.Is(err, buffer.ErrNotFile) {
+		q.Log.DebugMsg("failed to link the body, copying", "path", path, "reason", err)
+	}
+
+	bodyReader, err := body.Open()
+	if err != nil {
 		return nil, err
 	}
+	defer bodyReader.Close()
 
-	if err := q.updateMetadataOnDisk(meta); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
+	bodyFile, err := os.Create(path)
+	if err != nil {
 		return nil, err
 	}
+	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
+		bodyFile.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return bodyFile, nil
+}
 
-	if err := headerFile.Sync(); err != nil {
+// writeCompressedBody is similar to writeBody but compresses the body
+// according to the compression directive.
+func (q *Queue) writeCompressedBody(body buffer.Buffer, path string) (*os.File, error) {
+	bodyReader, err := body.Open()
+	if err != nil {
 		return nil, err
 	}
+	defer bodyReader.Close()
 
-	if err := bodyFile.Sync(); err != nil {
+	bodyFile, err := os.Create(path)
+	if err != nil {
 		return nil, err
 	}
+	cw := q.compression.NewWriter(bodyFile)
+	_, err = io.Copy(cw, bodyReader)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		bodyFile.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	in, out, elapsed := cw.Stats()
+	queueCompressionTime.WithLabelValues(q.name).Add(elapsed.Seconds())
+	queueCompressionBytes.WithLabelValues(q.name, "in").Add(float64(in))
+	queueCompressionBytes.WithLabelValues(q.name, "out").Add(float64(out))
+	q.Log.DebugMsg("compressed body", "path", path, "size", in, "compressed_size", out, "elapsed", elapsed)
 
-	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+	return bodyFile, nil
 }
 
 func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
-	metaPath := filepath.Join(q.location, meta.MsgMeta.ID+".meta")
-
-	var file *os.File
-	var err error
-	if runtime.GOOS == "windows" {
-		file, err = os.Create(metaPath)
-		if err != nil {
-			return err
-		}
-	} else {
-		file, err = os.Create(metaPath + ".new")
-		if err != nil {
-			return err
-		}
+	file, name, err := q.writeMetadata(meta)
+	if err != nil {
+		return err
 	}
 	defer file.Close()
 
+	if err := q.syncFiles(file); err != nil {
+		return err
+	}
+
+	return q.commitMetadata(meta.MsgMeta.ID, name)
+}
+
+// writeMetadata serializes the meta-data into the new file in the queue
+// directory. The file is not synced and should be put in place using
+// commitMetadata after that.
+//
+// Returned name is the file name relative to the queue directory.
+func (q *Queue) writeMetadata(meta *QueueMetadata) (*os.File, string, error) {
+	name := meta.MsgMeta.ID + ".meta"
+	if runtime.GOOS != "windows" {
+		name += ".new"
+	}
+
+	file, err := os.Create(filepath.Join(q.location, name))
+	if err != nil {
+		return nil, "", err
+	}
+
 	metaCopy := *meta
 	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
 	metaCopy.MsgMeta.Conn = nil
 
 	if err := json.NewEncoder(file).Encode(metaCopy); err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	return file, name, nil
+}
+
+// commitMetadata atomically replaces the meta-data file for the message with
+// the file written by writeMetadata and makes sure the change reached the disk.
+func (q *Queue) commitMetadata(id, name string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if err := os.Rename(filepath.Join(q.location, name), filepath.Join(q.location, id+".meta")); err != nil {
 		return err
 	}
 
-	if err := file.Sync(); err != nil {
+	dir, err := os.Open(q.location)
+	if err != nil {
 		return err
 	}
+	defer dir.Close()
+	if err := q.syncFiles(dir); err != nil {
+		return syncError(err)
+	}
+	return nil
+}
+
+func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
+	return readMetaFile(filepath.Join(q.location, id+".meta"))
+}
+
+// List reads meta-data for all messages stored in the queue directory.
+//
+// It is meant for use by management utilities, the list is sorted by the
+// message arrival time.
+func List(location string) ([]*QueueMetadata, error) {
+	dirInfo, err := ioutil.ReadDir(location)
+	if err != nil {
+		return nil, err
+	}
 
-	if runtime.GOOS != "windows" {
-		if err := os.Rename(metaPath+".new", metaPath); err != nil {
-			return err
+	var list []*QueueMetadata
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+
+		meta, err := readMetaFile(filepath.Join(location, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if meta.MsgMeta.ID == "" {
+			meta.MsgMeta.ID = strings.TrimSuffix(entry.Name(), ".meta")
 		}
+		list = append(list, meta)
 	}
 
-	return nil
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FirstAttempt.Before(list[j].FirstAttempt)
+	})
+	return list, nil
 }
 
-func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
-	metaPath := filepath.Join(q.location, id+".meta")
+func readMetaFile(metaPath string) (*QueueMetadata, error) {
 	file, err := os.Open(metaPath)
 	if err != nil {
 		return nil, err
@@ -849,14 +1370,13 @@ func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer
 	}
 
 	bodyPath := filepath.Join(q.location, id+".body")
-	_, err = os.Stat(bodyPath)
+	body, err := buffer.OpenFile(bodyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			q.tryRemoveDanglingFile(id + ".meta")
 		}
 		return nil, textproto.Header{}, nil, nil
 	}
-	body := buffer.FileBuffer{Path: bodyPath}
 
 	headerPath := filepath.Join(q.location, id+".header")
 	headerFile, err := os.Open(headerPath)
@@ -885,14 +1405,49 @@ func (q *Queue) Name() string {
 	return "queue"
 }
 
-func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
+// shouldWarnDelay checks whether the delayed delivery warning should be sent
+// for the message that is going to be retried.
+func (q *Queue) shouldWarnDelay(meta *QueueMetadata) bool {
+	if q.delayWarning == 0 || meta.DelayWarningSent {
+		return false
+	}
+	if q.delayWarningLocal && !meta.LocalSender {
+		return false
+	}
+	return q.clock.Now().Sub(releaseTime(meta)) >= q.delayWarning
+}
+
+// emitDSN sends the DSN with the specified action for the listed recipients
+// to the message sender.
+func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, rcpts []string, action dsn.Action) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
 		return
 	}
 
-	// Null return-path, used in DSNs.
-	if meta.MsgMeta.OriginalFrom == "" {
+	// Respect the NOTIFY parameter (RFC 3461).
+	event := module.DSNNotifyFailure
+	switch action {
+	case dsn.ActionDelayed:
+		event = module.DSNNotifyDelay
+	case dsn.ActionDelivered:
+		event = module.DSNNotifySuccess
+	}
+	notifyRcpts := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		if meta.MsgMeta.RcptDSN(rcpt).ShouldNotify(event) {
+			notifyRcpts = append(notifyRcpts, rcpt)
+		}
+	}
+	if len(notifyRcpts) == 0 {
+		return
+	}
+	rcpts = notifyRcpts
+
+	// Null return-path, used in DSNs. Never bounce these to avoid loops
+	// (RFC 5321 Section 4.5.5).
+	if meta.From == "" || meta.MsgMeta.OriginalFrom == "" {
+		target.DeliveryLogger(q.Log, meta.MsgMeta).Msg("not generating DSN for a message with null sender")
 		return
 	}
 
@@ -908,52 +1463,97 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		To:    meta.MsgMeta.OriginalFrom,
 	}
 	mtaInfo := dsn.ReportingMTAInfo{
-		ReportingMTA:    q.hostname,
-		XSender:         meta.From,
-		XMessageID:      meta.MsgMeta.ID,
-		ArrivalDate:     meta.FirstAttempt,
-		LastAttemptDate: meta.LastAttempt,
+		OriginalEnvelopeID: meta.MsgMeta.DSN.EnvID,
+		ReportingMTA:       q.hostname,
+		XSender:            meta.From,
+		XMessageID:         meta.MsgMeta.ID,
+		ArrivalDate:        meta.FirstAttempt,
+		LastAttemptDate:    meta.LastAttempt,
 	}
 	if !meta.MsgMeta.DontTraceSender && meta.MsgMeta.Conn != nil {
 		mtaInfo.ReceivedFromMTA = meta.MsgMeta.Conn.Hostname
 	}
 
 	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
-	for _, rcpt := range failedRcpts {
+	for _, rcpt := range rcpts {
 		rcptErr := meta.RcptErrs[rcpt]
 		// rcptErr is stored in RcptErrs using the effective recipient address,
 		// not the original one.
 
+		info := dsn.RecipientInfo{
+			OriginalRecipient: meta.MsgMeta.RcptDSN(rcpt).OriginalRcpt,
+			FinalRecipient:    rcpt,
+			Action:            action,
+		}
+		if action == dsn.ActionDelivered {
+			info.Status = smtp.EnhancedCode{2, 0, 0}
+		} else {
+			info.Status = rcptErr.EnhancedCode
+			info.DiagnosticCode = rcptErr
+		}
+		if action == dsn.ActionDelayed && q.maxLifetime != 0 {
+			info.WillRetryUntil = releaseTime(meta).Add(q.maxLifetime)
+		}
+		diags := meta.Diagnostics[rcpt]
+		if len(diags) != 0 {
+			info.RemoteMTA = diags[len(diags)-1].RemoteServer
+		}
+		for _, diag := range diags {
+			info.Details = append(info.Details, diag.Summary())
+		}
+
 		originalRcpt := meta.MsgMeta.OriginalRcpts[rcpt]
 		if originalRcpt != "" {
-			rcpt = originalRcpt
+			info.FinalRecipient = originalRcpt
 		}
 
-		rcptInfo = append(rcptInfo, dsn.RecipientInfo{
-			FinalRecipient: rcpt,
-			Action:         dsn.ActionFailed,
-			Status:         rcptErr.EnhancedCode,
-			DiagnosticCode: rcptErr,
-		})
+		rcptInfo = append(rcptInfo, info)
 	}
 
 	var dsnBodyBlob bytes.Buffer
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+
+	// Full message is returned if requested by the sender using RET=FULL,
+	// but the size limit still applies if it is set.
+	includeFull := q.bounceFullMsgMaxSize > 0
+	switch meta.MsgMeta.DSN.Return {
+	case module.DSNReturnFull:
+		includeFull = true
+	case module.DSNReturnHeaders:
+		includeFull = false
+	}
+
+	var failedBody io.Reader
+	if body != nil && includeFull {
+		var hdrBlob bytes.Buffer
+		if err := textproto.WriteHeader(&hdrBlob, header); err == nil &&
+			(q.bounceFullMsgMaxSize == 0 || hdrBlob.Len()+body.Len() <= q.bounceFullMsgMaxSize) {
+			bodyReader, err := body.Open()
+			if err != nil {
+				dl.Error("failed to open body for DSN, including only the header", err)
+			} else {
+				defer bodyReader.Close()
+				failedBody = bodyReader
+			}
+		}
+	}
+
+	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, failedBody, &dsnBodyBlob)
 	if err != nil {
-		dl.Error("failed to generate fail DSN", err)
+		dl.Error("failed to generate DSN", err, "action", action)
 		return
 	}
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
 
 	dsnMeta := &module.MsgMetadata{
-		ID: dsnID,
+		ID:       dsnID,
+		Priority: module.PriorityHigh,
 		SMTPOpts: smtp.MailOptions{
 			UTF8:       meta.MsgMeta.SMTPOpts.UTF8,
 			RequireTLS: meta.MsgMeta.SMTPOpts.RequireTLS,
 		},
 	}
-	dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	dl.Msg("generated DSN", "dsn_id", dsnID, "action", action)
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
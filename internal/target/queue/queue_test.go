@@ -34,10 +34,12 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/clock"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // newTestQueue returns properly initialized Queue object usable for testing.
@@ -63,8 +65,15 @@ func cleanQueue(t *testing.T, q *Queue) {
 }
 
 func newTestQueueDir(t *testing.T, target module.DeliveryTarget, dir string) *Queue {
+	return newTestQueueClock(t, target, dir, clock.Real)
+}
+
+// newTestQueueClock is similar to newTestQueueDir but also allows to replace
+// the time source used by the queue, e.g. with clock.Fake.
+func newTestQueueClock(t *testing.T, target module.DeliveryTarget, dir string, clk clock.Clock) *Queue {
 	mod, _ := NewQueue("", "queue", nil, nil)
 	q := mod.(*Queue)
+	q.clock = clk
 	q.initialRetryTime = 0
 	q.retryTimeScale = 1
 	q.postInitDelay = 0
@@ -259,6 +268,96 @@ func TestQueueDelivery(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_LinkedBody(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	bufDir := testutils.Dir(t)
+	body, err := buffer.BufferSpill(strings.NewReader("foobar\r\n"), 0, bufDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufPath, ok := body.FilePath()
+	if !ok {
+		t.Fatal("Body is not stored in a file")
+	}
+
+	ctx := context.Background()
+	delivery, err := q.Start(ctx, &module.MsgMetadata{ID: "linked", OriginalFrom: "tester@example.com"}, "tester@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "tester1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	var hdr textproto.Header
+	hdr.Add("A", "1")
+	if err := delivery.Body(ctx, hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	bufInfo, err := os.Stat(bufPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueInfo, err := os.Stat(filepath.Join(q.location, "linked.body"))
+	if err == nil && !os.SameFile(bufInfo, queueInfo) {
+		t.Error("Body is copied instead of linking")
+	}
+
+	// The caller owns the buffer and removes it once Body returns.
+	if err := body.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	q.Close()
+	if string(msg.Body) != "foobar\r\n" {
+		t.Fatalf("Wrong body: %q", msg.Body)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_Compressed(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.compression = buffer.Compression{Algo: "zstd", MinSize: 1}
+	compressedBefore := promtestutil.ToFloat64(queueCompressionBytes.WithLabelValues(q.name, "in"))
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	// The first attempt uses the body that was just stored, the second one
+	// reads it from the disk.
+	for _, ch := range []chan testutils.Msg{dt.aborted, dt.committed} {
+		msg := readMsgChanTimeout(t, ch, 5*time.Second)
+		if string(msg.Body) != "foobar\r\n" {
+			t.Fatalf("Wrong body: %q", msg.Body)
+		}
+	}
+
+	if in := promtestutil.ToFloat64(queueCompressionBytes.WithLabelValues(q.name, "in")) - compressedBefore; in != 8 {
+		t.Fatal("Wrong compressed bytes count:", in)
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
 func TestQueueDelivery_PermanentFail_NonPartial(t *testing.T) {
 	t.Parallel()
 
@@ -333,6 +432,62 @@ func TestQueueDelivery_TemporaryFail(t *testing.T) {
 	defer checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_RetrySchedule(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := newTestQueueClock(t, &dt, dir, clk)
+	q.initialRetryTime = 15 * time.Minute
+	q.retryTimeScale = 2
+	defer cleanQueue(t, q)
+
+	expectNoAttempt := func() {
+		t.Helper()
+		select {
+		case <-dt.aborted:
+			t.Fatal("Unexpected delivery attempt")
+		case <-dt.committed:
+			t.Fatal("Unexpected delivery attempt")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	// First attempt is done immediately.
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Second attempt - after 15 minutes.
+	clk.BlockUntil(1)
+	clk.Advance(15*time.Minute - time.Second)
+	expectNoAttempt()
+	clk.Advance(time.Second)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Third attempt - after 15 * 2 minutes.
+	clk.BlockUntil(1)
+	clk.Advance(30*time.Minute - time.Second)
+	expectNoAttempt()
+	clk.Advance(time.Second)
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
 func TestQueueDelivery_TemporaryFail_Partial(t *testing.T) {
 	t.Parallel()
 
@@ -556,7 +711,6 @@ func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	}
 
 	t.Run("NoMeta", func(t *testing.T) {
-		t.Skip("Not implemented")
 		test(t, ".meta")
 	})
 	t.Run("NoBody", func(t *testing.T) {
@@ -671,6 +825,242 @@ func TestQueueDSN(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_FullMessage(t *testing.T) {
+	t.Parallel()
+
+	test := func(t *testing.T, maxSize int, expectFull bool) {
+		dsnTarget := unreliableTarget{
+			committed: make(chan testutils.Msg, 10),
+			aborted:   make(chan testutils.Msg, 10),
+		}
+		dt := unreliableTarget{
+			rcptFailures: []map[string]error{
+				{
+					"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+				},
+			},
+			committed: make(chan testutils.Msg, 10),
+			aborted:   make(chan testutils.Msg, 10),
+		}
+		q := newTestQueue(t, &dt)
+		q.hostname = "mx.example.org"
+		q.autogenMsgDomain = "example.org"
+		q.dsnPipeline = &dsnTarget
+		q.bounceFullMsgMaxSize = maxSize
+		defer cleanQueue(t, q)
+
+		testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+		readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+		// DSN is generated for the partial failure.
+		msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+		body := string(msg.Body)
+		if !strings.Contains(body, "Final-Recipient: rfc822; tester1@example.org") {
+			t.Error("No Final-Recipient for the failed recipient in DSN")
+		}
+		if strings.Contains(body, "tester2@example.org") {
+			t.Error("Delivered recipient is included in DSN")
+		}
+		if full := strings.Contains(body, "Content-Type: message/rfc822\r\n"); full != expectFull {
+			t.Errorf("Full message included: %v, expected %v", full, expectFull)
+		}
+		if full := strings.Contains(body, "foobar"); full != expectFull {
+			t.Errorf("Message body included: %v, expected %v", full, expectFull)
+		}
+	}
+
+	t.Run("Fits", func(t *testing.T) {
+		test(t, 64*1024, true)
+	})
+	t.Run("TooBig", func(t *testing.T) {
+		test(t, 4, false)
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		test(t, 0, false)
+	})
+}
+
+func TestQueueDSN_DelayWarning(t *testing.T) {
+	t.Parallel()
+
+	tempErr := exterrors.WithTemporary(errors.New("go away"), true)
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		bodyFailures: []error{tempErr, tempErr, tempErr, tempErr},
+		committed:    make(chan testutils.Msg, 10),
+		aborted:      make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := newTestQueueClock(t, &dt, dir, clk)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.initialRetryTime = 45 * time.Minute
+	q.delayWarning = time.Hour
+	defer cleanQueue(t, q)
+
+	expectNoDSN := func() {
+		t.Helper()
+		select {
+		case msg := <-dsnTarget.committed:
+			t.Fatalf("Unexpected DSN: %s", msg.Body)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	expectNoDSN()
+
+	// 45 minutes in queue.
+	clk.BlockUntil(1)
+	clk.Advance(45 * time.Minute)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	expectNoDSN()
+
+	// 90 minutes in queue, warning is sent.
+	clk.BlockUntil(1)
+	clk.Advance(45 * time.Minute)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	if !strings.Contains(string(msg.Body), "Action: delayed") {
+		t.Fatalf("Not a delay warning: %s", msg.Body)
+	}
+
+	// Only one warning is sent.
+	clk.BlockUntil(1)
+	clk.Advance(45 * time.Minute)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	expectNoDSN()
+}
+
+func TestQueue_ShouldWarnDelay(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := &Queue{
+		clock:        clock.NewFake(now),
+		delayWarning: time.Hour,
+	}
+	meta := &QueueMetadata{FirstAttempt: now.Add(-2 * time.Hour)}
+
+	if !q.shouldWarnDelay(meta) {
+		t.Error("Warning is not sent")
+	}
+	q.delayWarningLocal = true
+	if q.shouldWarnDelay(meta) {
+		t.Error("Warning is sent for non-local sender")
+	}
+	meta.LocalSender = true
+	if !q.shouldWarnDelay(meta) {
+		t.Error("Warning is not sent for local sender")
+	}
+	meta.DelayWarningSent = true
+	if q.shouldWarnDelay(meta) {
+		t.Error("Warning is sent twice")
+	}
+	meta.DelayWarningSent = false
+	meta.FirstAttempt = now.Add(-time.Minute)
+	if q.shouldWarnDelay(meta) {
+		t.Error("Warning is sent too early")
+	}
+	q.delayWarning = 0
+	meta.FirstAttempt = now.Add(-24 * time.Hour)
+	if q.shouldWarnDelay(meta) {
+		t.Error("Warning is sent while disabled")
+	}
+}
+
+func TestQueueDSN_Notify(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"never@example.org":  exterrors.WithTemporary(errors.New("go away"), false),
+				"failed@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com",
+		[]string{"never@example.org", "failed@example.org", "success@example.org", "default@example.org"},
+		&module.MsgMetadata{
+			OriginalFrom: "tester@example.com",
+			DSN: module.DSNOpts{
+				Return: module.DSNReturnFull,
+				EnvID:  "QQ314159",
+				Rcpts: map[string]module.DSNRcptOpts{
+					"never@example.org": {Notify: []string{module.DSNNotifyNever}},
+					"failed@example.org": {
+						Notify:       []string{module.DSNNotifyFailure},
+						OriginalRcpt: "rfc822;failed@example.org",
+					},
+					"success@example.org": {Notify: []string{module.DSNNotifySuccess}},
+				},
+			},
+		})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	dsns := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+		body := string(msg.Body)
+		switch {
+		case strings.Contains(body, "Action: delivered"):
+			dsns["success"] = body
+		case strings.Contains(body, "Action: failed"):
+			dsns["failed"] = body
+		default:
+			t.Fatalf("Unexpected DSN: %s", body)
+		}
+	}
+	select {
+	case msg := <-dsnTarget.committed:
+		t.Fatalf("Unexpected DSN: %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	success := dsns["success"]
+	if !strings.Contains(success, "Final-Recipient: rfc822; success@example.org") ||
+		strings.Contains(success, "default@example.org") {
+		t.Errorf("Wrong recipients in success DSN: %s", success)
+	}
+	failed := dsns["failed"]
+	for _, field := range []string{
+		"Original-Envelope-Id: QQ314159",
+		"Original-Recipient: rfc822;failed@example.org",
+		"Final-Recipient: rfc822; failed@example.org",
+		"Content-Type: message/rfc822\r\n",
+	} {
+		if !strings.Contains(failed, field) {
+			t.Errorf("No %s in failure DSN: %s", field, failed)
+		}
+	}
+	if strings.Contains(failed, "never@example.org") {
+		t.Errorf("DSN is generated despite NOTIFY=NEVER: %s", failed)
+	}
+}
+
 func TestQueueDSN_FromEmptyAddr(t *testing.T) {
 	t.Parallel()
 
@@ -831,4 +1221,5 @@ func TestQueueDSN_RcptRewrite(t *testing.T) {
 
 func init() {
 	dontRecover = true
+	pausePollInterval = 50 * time.Millisecond
 }
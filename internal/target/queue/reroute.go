@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+const (
+	// rerouteFile is the name of the file in the queue directory that
+	// contains the pending RerouteRequest.
+	rerouteFile = "reroute.json"
+
+	// rerouteResultFile is the name of the file in the queue directory that
+	// contains the RerouteResult for the last processed request.
+	rerouteResultFile = "reroute_result.json"
+)
+
+// RerouteRequest asks the running queue to retry the selected entries
+// immediately.
+//
+// The queue does not store next-hop information (MX records, routing
+// decisions, relay credentials) in the entries metadata, it is determined by
+// the delivery target on each attempt using the current configuration. So
+// the only thing needed to make the queue pick up configuration changes is to
+// reset the retry delay.
+type RerouteRequest struct {
+	// Recipient domain (in the dns.ForLookup form) to select entries by. If
+	// empty, all entries are selected.
+	Domain string `json:",omitempty"`
+
+	Requested time.Time
+}
+
+// RerouteResult is the outcome of the RerouteRequest processing.
+type RerouteResult struct {
+	// Requested is the value of RerouteRequest.Requested this result is for.
+	Requested time.Time
+	Processed time.Time
+
+	// Amount of entries scheduled for immediate delivery.
+	Rescheduled int
+
+	// Amount of matching entries that were not rescheduled because they are
+	// being delivered right now or held due to the delivery pause.
+	Skipped int
+}
+
+// RequestReroute saves the RerouteRequest to the queue directory. It will be
+// processed by the running queue or on the next start.
+//
+// If domain is empty, all entries are selected.
+func RequestReroute(location, domain string) (RerouteRequest, error) {
+	req := RerouteRequest{
+		Requested: time.Now(),
+	}
+	if domain != "" {
+		var err error
+		req.Domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return RerouteRequest{}, err
+		}
+	}
+
+	return req, writeJSONFile(filepath.Join(location, rerouteFile), req)
+}
+
+// ReadRerouteResult reads the result of the last processed RerouteRequest.
+// If there is no result saved, zero RerouteResult is returned.
+func ReadRerouteResult(location string) (RerouteResult, error) {
+	f, err := os.Open(filepath.Join(location, rerouteResultFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return RerouteResult{}, nil
+		}
+		return RerouteResult{}, err
+	}
+	defer f.Close()
+
+	var res RerouteResult
+	if err := json.NewDecoder(f).Decode(&res); err != nil {
+		return RerouteResult{}, err
+	}
+	return res, nil
+}
+
+func (req RerouteRequest) matches(rcpts []string) bool {
+	if req.Domain == "" {
+		return true
+	}
+	for _, rcpt := range rcpts {
+		_, domain, err := address.Split(rcpt)
+		if err != nil || domain == "" {
+			continue
+		}
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			continue
+		}
+		if domain == req.Domain {
+			return true
+		}
+	}
+	return false
+}
+
+// processReroute checks for the pending RerouteRequest and executes it.
+func (q *Queue) processReroute() error {
+	reqPath := filepath.Join(q.location, rerouteFile)
+	f, err := os.Open(reqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var req RerouteRequest
+	err = json.NewDecoder(f).Decode(&req)
+	f.Close()
+	if err != nil {
+		q.Log.Error("malformed reroute request, removing", err)
+		return os.Remove(reqPath)
+	}
+
+	res := q.reroute(req)
+	q.Log.Msg("rerouted queued messages", "domain", req.Domain,
+		"rescheduled", res.Rescheduled, "skipped", res.Skipped)
+
+	if err := writeJSONFile(filepath.Join(q.location, rerouteResultFile), res); err != nil {
+		return err
+	}
+	return os.Remove(reqPath)
+}
+
+// reroute schedules entries matching req for immediate delivery.
+//
+// Entries are rescheduled only if they are waiting in the time wheel, entries
+// being delivered right now are not touched. Since the delivery is always
+// started by removing the entry from the time wheel, this makes reroute safe
+// to run while delivery is in progress.
+func (q *Queue) reroute(req RerouteRequest) RerouteResult {
+	res := RerouteResult{
+		Requested: req.Requested,
+	}
+
+	list, err := List(q.location)
+	if err != nil {
+		q.Log.Error("failed to list queue entries", err)
+		res.Processed = q.clock.Now()
+		return res
+	}
+
+	selected := make(map[string]struct{}, len(list))
+	for _, meta := range list {
+		if !req.matches(meta.To) {
+			continue
+		}
+		active, _ := q.splitHeld(meta.To)
+		if len(active) == 0 {
+			res.Skipped++
+			continue
+		}
+		selected[meta.MsgMeta.ID] = struct{}{}
+	}
+
+	res.Rescheduled = q.wheel.Reschedule(q.clock.Now(), func(value interface{}) bool {
+		_, ok := selected[value.(queueSlot).ID]
+		return ok
+	})
+	res.Skipped += len(selected) - res.Rescheduled
+	res.Processed = q.clock.Now()
+	return res
+}
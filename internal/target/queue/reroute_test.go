@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueDelivery_Reroute(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.initialRetryTime = time.Hour
+
+	// Subtests are used to get different message IDs.
+	for _, rcpt := range []string{"tester1@example.org", "tester1@example.com"} {
+		t.Run(rcpt, func(t *testing.T) {
+			testutils.DoTestDelivery(t, q, "tester@example.com", []string{rcpt})
+			readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+		})
+	}
+
+	// Entry is added back to the time wheel after the delivery attempt is
+	// completed, so retry until it is there.
+	var res RerouteResult
+	for i := 0; i < 100; i++ {
+		req, err := RequestReroute(q.location, "EXAMPLE.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.processReroute(); err != nil {
+			t.Fatal(err)
+		}
+		res, err = ReadRerouteResult(q.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Requested.Equal(req.Requested) {
+			t.Fatalf("result is for the wrong request: %v != %v", res.Requested, req.Requested)
+		}
+		if res.Rescheduled != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res.Rescheduled != 1 {
+		t.Fatalf("wrong amount of rescheduled entries: %d", res.Rescheduled)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("not selected entry was retried: %v", msg.RcptTo)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
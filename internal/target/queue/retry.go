@@ -0,0 +1,182 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"errors"
+	"math"
+	"net"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Error classes that can have a separate retry schedule, see the
+// retry_classes directive.
+const (
+	// RetryClassDNS is used for DNS lookup failures.
+	RetryClassDNS = "dns"
+
+	// RetryClassConnect is used for network errors, e.g. connection refused
+	// or timed out.
+	RetryClassConnect = "connect"
+
+	// RetryClassRemote is used for temporary errors reported by the remote
+	// server, e.g. greylisting.
+	RetryClassRemote = "remote"
+)
+
+// retryClass returns the class of the delivery error used to select the
+// retry schedule.
+//
+// Empty string is returned if the error does not belong to any known class.
+func retryClass(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	fields := exterrors.Fields(err)
+	if _, ok := fields["remote_response"]; ok {
+		return RetryClassRemote
+	}
+	phase, _ := fields["smtp_phase"].(string)
+	var dnsErr *net.DNSError
+	if phase == "dns" || errors.As(err, &dnsErr) {
+		return RetryClassDNS
+	}
+	if phase == "connect" {
+		return RetryClassConnect
+	}
+	return ""
+}
+
+// pickInterval returns the interval to use after the triesCount attempts.
+// The last interval is used for all further attempts.
+func pickInterval(intervals []time.Duration, triesCount int) time.Duration {
+	if triesCount < 1 {
+		triesCount = 1
+	}
+	if triesCount > len(intervals) {
+		return intervals[len(intervals)-1]
+	}
+	return intervals[triesCount-1]
+}
+
+// retryDelay returns the delay before the next attempt to deliver to the
+// recipient after triesCount failed attempts. rcptErr is the error
+// returned by the last attempt, it can be nil if it is not known.
+func (q *Queue) retryDelay(rcptErr error, triesCount int) time.Duration {
+	if intervals, ok := q.retryClasses[retryClass(rcptErr)]; ok {
+		return pickInterval(intervals, triesCount)
+	}
+	if len(q.retryIntervals) != 0 {
+		return pickInterval(q.retryIntervals, triesCount)
+	}
+
+	// Delay between retries grows exponentally, the formula is:
+	// initialRetryTime * retryTimeScale ^ (triesCount - 1)
+	scaleFactor := math.Pow(q.retryTimeScale, float64(triesCount-1))
+	delay := time.Duration(float64(q.initialRetryTime) * scaleFactor)
+	if q.maxRetryInterval != 0 && delay > q.maxRetryInterval {
+		delay = q.maxRetryInterval
+	}
+	return delay
+}
+
+// expired checks whether the message is in the queue for longer than
+// max_lifetime allows.
+func (q *Queue) expired(meta *QueueMetadata) bool {
+	if q.maxLifetime == 0 {
+		return false
+	}
+	return q.clock.Now().Sub(releaseTime(meta)) >= q.maxLifetime
+}
+
+// releaseTime returns the time the message became eligible for delivery.
+// Deferred messages are not considered to be delayed while they wait for the
+// release so max_lifetime and delay_warning are counted from it.
+func releaseTime(meta *QueueMetadata) time.Time {
+	if meta.DeliverAfter.After(meta.FirstAttempt) {
+		return meta.DeliverAfter
+	}
+	return meta.FirstAttempt
+}
+
+// holdUntil returns the release time for the message requested to be
+// delivered at t, capped by max_hold_time. Zero value is returned if the
+// message should be delivered immediately.
+func (q *Queue) holdUntil(t time.Time) time.Time {
+	now := q.clock.Now()
+	if q.maxHoldTime == 0 || !t.After(now) {
+		return time.Time{}
+	}
+	if limit := now.Add(q.maxHoldTime); t.After(limit) {
+		return limit
+	}
+	return t
+}
+
+func parseIntervals(args []string) ([]time.Duration, error) {
+	if len(args) == 0 {
+		return nil, errors.New("at least one interval is required")
+	}
+	intervals := make([]time.Duration, 0, len(args))
+	for _, arg := range args {
+		interval, err := config.ParseDuration(arg)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("intervals should be positive")
+		}
+		intervals = append(intervals, interval)
+	}
+	return intervals, nil
+}
+
+func retryIntervalsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	intervals, err := parseIntervals(node.Args)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	return intervals, nil
+}
+
+func retryClassesDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "expected a block with schedules")
+	}
+	classes := make(map[string][]time.Duration, len(node.Children))
+	for _, child := range node.Children {
+		switch child.Name {
+		case RetryClassDNS, RetryClassConnect, RetryClassRemote:
+		default:
+			return nil, config.NodeErr(child, "unknown error class: %s", child.Name)
+		}
+		if _, ok := classes[child.Name]; ok {
+			return nil, config.NodeErr(child, "duplicate schedule for %s", child.Name)
+		}
+		intervals, err := parseIntervals(child.Args)
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		classes[child.Name] = intervals
+	}
+	return classes, nil
+}
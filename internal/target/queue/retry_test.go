@@ -0,0 +1,243 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRetryClass(t *testing.T) {
+	for _, c := range []struct {
+		err   error
+		class string
+	}{
+		{nil, ""},
+		{errors.New("whatever"), ""},
+		{&exterrors.SMTPError{
+			Code: 451,
+			Misc: map[string]interface{}{"smtp_phase": "dns"},
+		}, RetryClassDNS},
+		{exterrors.WithTemporary(&net.DNSError{Err: "server misbehaving", IsTemporary: true}, true), RetryClassDNS},
+		{&exterrors.SMTPError{
+			Code: 450,
+			Misc: map[string]interface{}{"smtp_phase": "connect"},
+		}, RetryClassConnect},
+		{&exterrors.SMTPError{
+			Code: 450,
+			Misc: map[string]interface{}{
+				"smtp_phase":      "rcpt",
+				"remote_response": "450 4.2.0 Greylisted, try again later",
+			},
+		}, RetryClassRemote},
+	} {
+		if class := retryClass(c.err); class != c.class {
+			t.Errorf("retryClass(%v) = %q, want %q", c.err, class, c.class)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	q := &Queue{
+		initialRetryTime: 10 * time.Minute,
+		retryTimeScale:   2,
+		maxRetryInterval: time.Hour,
+	}
+	dnsErr := &exterrors.SMTPError{
+		Code: 451,
+		Misc: map[string]interface{}{"smtp_phase": "dns"},
+	}
+
+	check := func(err error, tries int, expected time.Duration) {
+		t.Helper()
+		if delay := q.retryDelay(err, tries); delay != expected {
+			t.Errorf("retryDelay(%v, %d) = %v, want %v", err, tries, delay, expected)
+		}
+	}
+
+	check(nil, 1, 10*time.Minute)
+	check(nil, 2, 20*time.Minute)
+	check(nil, 3, 40*time.Minute)
+	check(nil, 4, time.Hour)
+	check(dnsErr, 3, 40*time.Minute)
+
+	q.retryIntervals = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+	check(nil, 1, time.Minute)
+	check(nil, 3, time.Hour)
+	check(nil, 10, time.Hour)
+
+	q.retryClasses = map[string][]time.Duration{
+		RetryClassDNS: {30 * time.Second, 2 * time.Minute},
+	}
+	check(dnsErr, 1, 30*time.Second)
+	check(dnsErr, 5, 2*time.Minute)
+	check(errors.New("not DNS"), 2, 5*time.Minute)
+}
+
+func TestQueueDelivery_RetryIntervals(t *testing.T) {
+	t.Parallel()
+
+	dnsErr := exterrors.WithTemporary(&exterrors.SMTPError{
+		Code: 451,
+		Misc: map[string]interface{}{"smtp_phase": "dns"},
+	}, true)
+	dt := unreliableTarget{
+		bodyFailures: []error{dnsErr, dnsErr},
+		aborted:      make(chan testutils.Msg, 10),
+		committed:    make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := newTestQueueClock(t, &dt, dir, clk)
+	q.initialRetryTime = 15 * time.Minute
+	q.retryIntervals = []time.Duration{10 * time.Minute}
+	q.retryClasses = map[string][]time.Duration{
+		RetryClassDNS: {time.Minute, 3 * time.Minute},
+	}
+	defer cleanQueue(t, q)
+
+	expectNoAttempt := func() {
+		t.Helper()
+		select {
+		case <-dt.aborted:
+			t.Fatal("Unexpected delivery attempt")
+		case <-dt.committed:
+			t.Fatal("Unexpected delivery attempt")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// DNS error schedule is used instead of the default one.
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute - time.Second)
+	expectNoAttempt()
+	clk.Advance(time.Second)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	clk.BlockUntil(1)
+	clk.Advance(3*time.Minute - time.Second)
+	expectNoAttempt()
+	clk.Advance(time.Second)
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+}
+
+func TestQueueDelivery_MaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := newTestQueueClock(t, &dt, dir, clk)
+	q.initialRetryTime = 15 * time.Minute
+	q.maxLifetime = 10 * time.Minute
+	defer cleanQueue(t, q)
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	clk.BlockUntil(1)
+	checkQueueDir(t, q, []string{deliveryID})
+
+	// Second attempt fails and the message is in the queue for longer than
+	// max_lifetime, so no more attempts are made.
+	clk.Advance(15 * time.Minute)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_DeliverAfter(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	q := newTestQueueClock(t, &dt, dir, clk)
+	q.initialRetryTime = 15 * time.Minute
+	q.maxLifetime = 10 * time.Minute
+	q.maxHoldTime = 7 * 24 * time.Hour
+	defer cleanQueue(t, q)
+
+	deliveryID := testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		DeliverAfter: start.Add(30 * 24 * time.Hour),
+	})
+	clk.BlockUntil(1)
+	checkQueueDir(t, q, []string{deliveryID})
+
+	meta, err := Read(q.location, deliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(q.maxHoldTime); !meta.DeliverAfter.Equal(want) {
+		t.Fatalf("release time is not capped: want %v, got %v", want, meta.DeliverAfter)
+	}
+
+	clk.Advance(7*24*time.Hour - time.Minute)
+	select {
+	case <-dt.aborted:
+		t.Fatal("deferred message is delivered too early")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The first attempt fails, but max_lifetime is counted from the release
+	// time so the message is retried.
+	clk.Advance(time.Minute)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	clk.BlockUntil(1)
+	clk.Advance(15 * time.Minute)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Retry groups.
+//
+// Recipients that failed temporarily are grouped by the destination host
+// (recipient domain if the host is not known) and the response they got.
+// Recipients in a group are retried together at the earliest time any of
+// them is due, so the message is sent in a single transaction per host
+// instead of being re-sent to the same host for each recipient schedule.
+// Recipients that got different responses from the same server are put into
+// separate groups since they are likely to need different retry schedules.
+//
+// On each attempt only recipients from the due groups are tried, other groups
+// are kept as is.
+
+// RetryGroup is a set of recipients of the message that are retried
+// together.
+type RetryGroup struct {
+	// Destination host and the response recipients got on the last attempt.
+	Key string
+
+	Rcpts       []string
+	NextAttempt time.Time
+}
+
+func retryGroupKey(rcpt string, rcptErr error) string {
+	host, _ := exterrors.Fields(rcptErr)["remote_server"].(string)
+	if host == "" {
+		_, domain, err := address.Split(rcpt)
+		if err == nil {
+			host = domain
+		}
+	}
+	host, err := dns.ForLookup(host)
+	if err != nil {
+		host = strings.ToLower(host)
+	}
+
+	smtpErr := toSMTPErr(rcptErr)
+	return fmt.Sprintf("%s %d %d.%d.%d", host, smtpErr.Code,
+		smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+}
+
+// retryGrouper collects recipients that should be retried into groups.
+type retryGrouper struct {
+	now    time.Time
+	groups []RetryGroup
+	index  map[string]int
+}
+
+// newRetryGrouper creates the retryGrouper that merges recipients into
+// waiting groups with the same key.
+func newRetryGrouper(now time.Time, waiting []RetryGroup) *retryGrouper {
+	g := &retryGrouper{
+		now:    now,
+		groups: append([]RetryGroup(nil), waiting...),
+		index:  make(map[string]int, len(waiting)),
+	}
+	for i, grp := range waiting {
+		g.index[grp.Key] = i
+	}
+	return g
+}
+
+// add puts rcpt into the group for the key, the group is retried after
+// delay unless another recipient in it is retried earlier.
+func (g *retryGrouper) add(key, rcpt string, delay time.Duration) {
+	next := g.now.Add(delay)
+
+	i, ok := g.index[key]
+	if !ok {
+		i = len(g.groups)
+		g.index[key] = i
+		g.groups = append(g.groups, RetryGroup{Key: key, NextAttempt: next})
+	}
+	grp := &g.groups[i]
+	grp.Rcpts = append(grp.Rcpts, rcpt)
+	if next.Before(grp.NextAttempt) {
+		grp.NextAttempt = next
+	}
+}
+
+// nextAttempt returns the time the earliest group should be retried at.
+func (g *retryGrouper) nextAttempt() time.Time {
+	var next time.Time
+	for _, grp := range g.groups {
+		if next.IsZero() || grp.NextAttempt.Before(next) {
+			next = grp.NextAttempt
+		}
+	}
+	return next
+}
+
+// splitDue leaves in meta.To only recipients that should be tried now and
+// returns retry groups for other recipients.
+//
+// If no group is due, the delivery was requested explicitly (e.g. by queue
+// flush), in this case all recipients are tried. Recipients that are not in
+// any group (e.g. ones released after the delivery pause) are always tried.
+func (q *Queue) splitDue(meta *QueueMetadata) []RetryGroup {
+	groups := meta.RetryGroups
+	meta.RetryGroups = nil
+	if len(groups) == 0 {
+		return nil
+	}
+
+	active := make(map[string]bool, len(meta.To))
+	for _, rcpt := range meta.To {
+		active[rcpt] = true
+	}
+
+	now := q.clock.Now()
+	var waiting []RetryGroup
+	waitingRcpts := make(map[string]bool)
+	anyDue := false
+	for _, grp := range groups {
+		if !grp.NextAttempt.After(now) {
+			anyDue = true
+			continue
+		}
+
+		// Held recipients are moved out of the group and will be tried once
+		// the delivery is resumed.
+		rcpts := make([]string, 0, len(grp.Rcpts))
+		for _, rcpt := range grp.Rcpts {
+			if active[rcpt] {
+				rcpts = append(rcpts, rcpt)
+				waitingRcpts[rcpt] = true
+			}
+		}
+		if len(rcpts) != 0 {
+			grp.Rcpts = rcpts
+			waiting = append(waiting, grp)
+		}
+	}
+	if !anyDue {
+		return nil
+	}
+
+	due := make([]string, 0, len(meta.To))
+	for _, rcpt := range meta.To {
+		if !waitingRcpts[rcpt] {
+			due = append(due, rcpt)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	meta.To = due
+	return waiting
+}
@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func remoteRcptErr(server string, code int, enchCode exterrors.EnhancedCode) error {
+	return &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      "Try again later",
+		Misc: map[string]interface{}{
+			"remote_server":   server,
+			"remote_response": "try again later",
+		},
+	}
+}
+
+func TestRetryGroupKey(t *testing.T) {
+	mxErr := remoteRcptErr("MX.example.org.", 452, exterrors.EnhancedCode{4, 2, 2})
+
+	if retryGroupKey("a@example.org", mxErr) != retryGroupKey("b@example.net", mxErr) {
+		t.Error("recipients with the same server and response are in different groups")
+	}
+	if retryGroupKey("a@example.org", mxErr) == retryGroupKey("a@example.org",
+		remoteRcptErr("mx.example.org", 451, exterrors.EnhancedCode{4, 3, 0})) {
+		t.Error("recipients with different responses are in the same group")
+	}
+
+	localErr := exterrors.WithTemporary(errors.New("no route to host"), true)
+	if retryGroupKey("a@example.org", localErr) == retryGroupKey("a@example.com", localErr) {
+		t.Error("recipients in different domains are in the same group")
+	}
+	if retryGroupKey("a@example.org", localErr) != retryGroupKey("b@EXAMPLE.org", localErr) {
+		t.Error("recipients in the same domain are in different groups")
+	}
+}
+
+func TestQueueDelivery_RetryGroups(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"a1@example.org": remoteRcptErr("mx.example.org", 452, exterrors.EnhancedCode{4, 2, 2}),
+				"a2@example.org": remoteRcptErr("mx.example.org", 452, exterrors.EnhancedCode{4, 2, 2}),
+				"b@example.com": exterrors.WithFields(exterrors.WithTemporary(errors.New("connection refused"), true),
+					map[string]interface{}{"smtp_phase": "connect"}),
+			},
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := newTestQueueClock(t, &dt, dir, clk)
+	q.retryClasses = map[string][]time.Duration{
+		RetryClassRemote:  {time.Hour},
+		RetryClassConnect: {10 * time.Minute},
+	}
+	defer cleanQueue(t, q)
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com",
+		[]string{"a1@example.org", "b@example.com", "a2@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	clk.BlockUntil(1)
+
+	meta, err := Read(q.location, deliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.RetryGroups) != 2 {
+		t.Fatalf("expected 2 retry groups, got %+v", meta.RetryGroups)
+	}
+
+	// Only the recipient with the shorter retry interval is tried.
+	clk.Advance(10 * time.Minute)
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"b@example.com"}) {
+		t.Fatalf("wrong recipients tried: %v", msg.RcptTo)
+	}
+	clk.BlockUntil(1)
+
+	// Recipients at the same host are tried using a single transaction.
+	clk.Advance(50 * time.Minute)
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"a1@example.org", "a2@example.org"}) {
+		t.Fatalf("wrong recipients tried: %v", msg.RcptTo)
+	}
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("unexpected delivery: %v", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
@@ -23,6 +23,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
 )
 
 type TimeSlot struct {
@@ -39,11 +41,13 @@ type TimeWheel struct {
 	updateNotify chan time.Time
 	stopNotify   chan struct{}
 
+	clock    clock.Clock
 	dispatch func(TimeSlot)
 }
 
-func NewTimeWheel(dispatch func(TimeSlot)) *TimeWheel {
+func NewTimeWheel(clk clock.Clock, dispatch func(TimeSlot)) *TimeWheel {
 	tw := &TimeWheel{
+		clock:        clk,
 		slots:        list.New(),
 		stopNotify:   make(chan struct{}),
 		updateNotify: make(chan time.Time),
@@ -70,6 +74,56 @@ func (tw *TimeWheel) Add(target time.Time, value interface{}) {
 	tw.updateNotify <- target
 }
 
+// Reschedule changes the time of all slots with values for which match
+// returns true. It returns the amount of changed slots.
+//
+// Slots that are already dispatched are not affected.
+func (tw *TimeWheel) Reschedule(target time.Time, match func(value interface{}) bool) int {
+	if atomic.LoadUint32(&tw.stopped) == 1 {
+		return 0
+	}
+
+	changed := 0
+	tw.slotsLock.Lock()
+	for e := tw.slots.Front(); e != nil; e = e.Next() {
+		slot := e.Value.(TimeSlot)
+		if !match(slot.Value) {
+			continue
+		}
+		e.Value = TimeSlot{Time: target, Value: slot.Value}
+		changed++
+	}
+	tw.slotsLock.Unlock()
+
+	if changed != 0 {
+		tw.updateNotify <- target
+	}
+	return changed
+}
+
+// Remove removes all slots with values for which match returns true. It
+// returns the removed values.
+//
+// Slots that are already dispatched are not affected.
+func (tw *TimeWheel) Remove(match func(value interface{}) bool) []interface{} {
+	var removed []interface{}
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+	for e := tw.slots.Front(); e != nil; {
+		next := e.Next()
+		slot := e.Value.(TimeSlot)
+		if match(slot.Value) {
+			// tick may be waiting for this element, clear the value so
+			// it will know that it is gone.
+			e.Value = TimeSlot{}
+			tw.slots.Remove(e)
+			removed = append(removed, slot.Value)
+		}
+		e = next
+	}
+	return removed
+}
+
 func (tw *TimeWheel) Close() {
 	atomic.StoreUint32(&tw.stopped, 1)
 
@@ -88,7 +142,7 @@ func (tw *TimeWheel) Close() {
 
 func (tw *TimeWheel) tick() {
 	for {
-		now := time.Now()
+		now := tw.clock.Now()
 		// Look for list element closest to now.
 		tw.slotsLock.Lock()
 		var closestSlot TimeSlot
@@ -101,7 +155,8 @@ func (tw *TimeWheel) tick() {
 			}
 		}
 		tw.slotsLock.Unlock()
-		// Only this goroutine removes elements from TimeWheel so we can be safe using closestSlot.
+		// Elements can be removed concurrently using Remove, it is checked
+		// once the timer fires.
 
 		// Queue is empty. Just wait until update.
 		if closestEl == nil {
@@ -114,17 +169,23 @@ func (tw *TimeWheel) tick() {
 			}
 		}
 
-		timer := time.NewTimer(closestSlot.Time.Sub(now))
+		timer := tw.clock.NewTimer(closestSlot.Time.Sub(now))
 
 	selectloop:
 		for {
 			select {
-			case <-timer.C:
+			case <-timer.C():
 				tw.slotsLock.Lock()
+				slot := closestEl.Value.(TimeSlot)
 				tw.slots.Remove(closestEl)
 				tw.slotsLock.Unlock()
 
-				tw.dispatch(closestSlot)
+				// Removed while we were waiting for it.
+				if slot.Value == nil {
+					break selectloop
+				}
+
+				tw.dispatch(slot)
 
 				break selectloop
 			case newTarget := <-tw.updateNotify:
@@ -21,6 +21,8 @@ package queue
 import (
 	"testing"
 	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
 )
 
 func TestTimeWheelAdd(t *testing.T) {
@@ -28,7 +30,7 @@ func TestTimeWheelAdd(t *testing.T) {
 
 	called := make(chan TimeSlot)
 
-	w := NewTimeWheel(func(slot TimeSlot) {
+	w := NewTimeWheel(clock.Real, func(slot TimeSlot) {
 		called <- slot
 	})
 	defer w.Close()
@@ -46,7 +48,7 @@ func TestTimeWheelAdd_Ordering(t *testing.T) {
 
 	called := make(chan TimeSlot)
 
-	w := NewTimeWheel(func(slot TimeSlot) {
+	w := NewTimeWheel(clock.Real, func(slot TimeSlot) {
 		called <- slot
 	})
 	defer w.Close()
@@ -69,7 +71,7 @@ func TestTimeWheelAdd_Restart(t *testing.T) {
 
 	called := make(chan TimeSlot)
 
-	w := NewTimeWheel(func(slot TimeSlot) {
+	w := NewTimeWheel(clock.Real, func(slot TimeSlot) {
 		called <- slot
 	})
 	defer w.Close()
@@ -92,7 +94,7 @@ func TestTimeWheelAdd_MissingGotoBug(t *testing.T) {
 
 	called := make(chan TimeSlot)
 
-	w := NewTimeWheel(func(slot TimeSlot) {
+	w := NewTimeWheel(clock.Real, func(slot TimeSlot) {
 		called <- slot
 	})
 	defer w.Close()
@@ -111,7 +113,7 @@ func TestTimeWheelAdd_EmptyUpdWait(t *testing.T) {
 
 	called := make(chan TimeSlot)
 
-	w := NewTimeWheel(func(slot TimeSlot) {
+	w := NewTimeWheel(clock.Real, func(slot TimeSlot) {
 		called <- slot
 	})
 	defer w.Close()
@@ -125,3 +127,76 @@ func TestTimeWheelAdd_EmptyUpdWait(t *testing.T) {
 		t.Errorf("Wrong slot value: %v", slot.Value)
 	}
 }
+
+func TestTimeWheelAdd_FakeClock(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Now())
+	called := make(chan TimeSlot)
+
+	w := NewTimeWheel(clk, func(slot TimeSlot) {
+		called <- slot
+	})
+	defer w.Close()
+
+	w.Add(clk.Now().Add(2*time.Hour), 1)
+	w.Add(clk.Now().Add(1*time.Hour), 2)
+
+	clk.BlockUntil(1)
+	clk.Advance(30 * time.Minute)
+	select {
+	case slot := <-called:
+		t.Fatalf("Slot dispatched too early: %v", slot.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(30 * time.Minute)
+	slot := <-called
+	if val, _ := slot.Value.(int); val != 2 {
+		t.Errorf("Wrong first slot value: %v", slot.Value)
+	}
+
+	clk.Advance(time.Hour)
+	slot = <-called
+	if val, _ := slot.Value.(int); val != 1 {
+		t.Errorf("Wrong second slot value: %v", slot.Value)
+	}
+}
+
+func TestTimeWheelRemove(t *testing.T) {
+	t.Parallel()
+
+	clk := clock.NewFake(time.Now())
+	called := make(chan TimeSlot)
+
+	w := NewTimeWheel(clk, func(slot TimeSlot) {
+		called <- slot
+	})
+	defer w.Close()
+
+	w.Add(clk.Now().Add(2*time.Hour), 1)
+	w.Add(clk.Now().Add(1*time.Hour), 2)
+
+	// Wait for tick to start waiting for slot 2 and then remove it.
+	clk.BlockUntil(1)
+	removed := w.Remove(func(value interface{}) bool {
+		return value.(int) == 2
+	})
+	if len(removed) != 1 || removed[0].(int) != 2 {
+		t.Fatalf("Wrong removed values: %v", removed)
+	}
+
+	clk.Advance(time.Hour)
+	clk.BlockUntil(1)
+	select {
+	case slot := <-called:
+		t.Fatalf("Removed slot dispatched: %v", slot.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Hour)
+	slot := <-called
+	if val, _ := slot.Value.(int); val != 1 {
+		t.Errorf("Wrong slot value: %v", slot.Value)
+	}
+}
@@ -20,6 +20,7 @@ package target
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"strings"
@@ -28,10 +29,47 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/sanitize"
 )
 
+// SanitizeForHeader removes characters that can be used to inject additional
+// header fields. See sanitize.HeaderValue.
 func SanitizeForHeader(raw string) string {
-	return strings.Replace(raw, "\n", "", -1)
+	return sanitize.HeaderValue(raw)
+}
+
+// hiddenSenderDomain is used in the "from" clause of the Received header
+// instead of the client hostname if MsgMetadata.DontTraceSender is set.
+// RFC 5321 requires the clause to be present.
+const hiddenSenderDomain = "unknown"
+
+var now = time.Now
+
+// commentValue removes characters that can't be used in a header
+// comment without escaping.
+func commentValue(raw string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '(', ')', '\\':
+			return -1
+		}
+		return r
+	}, SanitizeForHeader(raw))
+}
+
+func tlsVersionName(ver uint16) string {
+	switch ver {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return "unknown"
+	}
 }
 
 func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostname, mailFrom string) (string, error) {
@@ -45,13 +83,17 @@ func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostn
 	// the entire value in most cases.
 	builder.Grow(256 + len(msgMeta.Conn.Hostname))
 
-	if !msgMeta.DontTraceSender && (strings.Contains(msgMeta.Conn.Proto, "SMTP") ||
-		strings.Contains(msgMeta.Conn.Proto, "LMTP")) {
+	isSMTP := strings.Contains(msgMeta.Conn.Proto, "SMTP") || strings.Contains(msgMeta.Conn.Proto, "LMTP")
+
+	if isSMTP && msgMeta.DontTraceSender {
+		builder.WriteString("from ")
+		builder.WriteString(hiddenSenderDomain)
+	} else if isSMTP {
 		// INTERNATIONALIZATION: See RFC 6531 Section 3.7.3.
 		hostname, err := dns.SelectIDNA(msgMeta.SMTPOpts.UTF8, msgMeta.Conn.Hostname)
 		if err == nil {
 			builder.WriteString("from ")
-			builder.WriteString(hostname)
+			builder.WriteString(SanitizeForHeader(hostname))
 		}
 
 		if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
@@ -62,7 +104,7 @@ func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostn
 					// INTERNATIONALIZATION: See RFC 6531 Section 3.7.3.
 					encoded, err := dns.SelectIDNA(msgMeta.SMTPOpts.UTF8, rdnsName.(string))
 					if err == nil {
-						builder.WriteString(encoded)
+						builder.WriteString(SanitizeForHeader(encoded))
 						builder.WriteRune(' ')
 					}
 				}
@@ -73,6 +115,18 @@ func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostn
 		}
 	}
 
+	// Non-ASCII usernames can't be used in a header without SMTPUTF8.
+	if msgMeta.TraceAuthUser && msgMeta.Conn.AuthUser != "" &&
+		(msgMeta.SMTPOpts.UTF8 || address.IsASCII(msgMeta.Conn.AuthUser)) {
+		if msgMeta.Conn.RelayIdentity {
+			builder.WriteString(" (trusted relay ")
+		} else {
+			builder.WriteString(" (authenticated as ")
+		}
+		builder.WriteString(commentValue(msgMeta.Conn.AuthUser))
+		builder.WriteString(")")
+	}
+
 	if ourHostname != "" {
 		ourHostname, err := dns.SelectIDNA(msgMeta.SMTPOpts.UTF8, ourHostname)
 		if err == nil {
@@ -98,10 +152,22 @@ func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostn
 		}
 		builder.WriteString(msgMeta.Conn.Proto)
 	}
+	if msgMeta.TraceTLS && msgMeta.Conn.TLS.HandshakeComplete {
+		builder.WriteString(" (using ")
+		builder.WriteString(tlsVersionName(msgMeta.Conn.TLS.Version))
+		builder.WriteString(" with cipher ")
+		builder.WriteString(tls.CipherSuiteName(msgMeta.Conn.TLS.CipherSuite))
+		builder.WriteString(")")
+	}
+	if msgMeta.Conn.TLSPolicy != "" {
+		builder.WriteString(" (TLS policy: ")
+		builder.WriteString(msgMeta.Conn.TLSPolicy)
+		builder.WriteString(")")
+	}
 	builder.WriteString(" id ")
 	builder.WriteString(msgMeta.ID)
 	builder.WriteString("; ")
-	builder.WriteString(time.Now().Format(time.RFC1123Z))
+	builder.WriteString(now().Format(time.RFC1123Z))
 
 	return strings.TrimSpace(builder.String()), nil
 }
@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package target
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestGenerateReceived(t *testing.T) {
+	now = func() time.Time {
+		return time.Date(2020, 7, 24, 11, 39, 25, 0, time.UTC)
+	}
+	defer func() {
+		now = time.Now
+	}()
+
+	rdns := future.New()
+	rdns.Set("client.example.org", nil)
+
+	conn := func(tlsVer uint16) *module.ConnState {
+		state := &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				Hostname:   "laptop.example.org",
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 4444},
+			},
+			Proto:    "ESMTP",
+			RDNSName: rdns,
+			AuthUser: "user@example.org",
+		}
+		if tlsVer != 0 {
+			state.Proto = "ESMTPS"
+			state.TLS = tls.ConnectionState{
+				HandshakeComplete: true,
+				Version:           tlsVer,
+				CipherSuite:       tls.TLS_AES_128_GCM_SHA256,
+			}
+		}
+		return state
+	}
+
+	test := func(msgMeta *module.MsgMetadata, expected string) {
+		t.Helper()
+		msgMeta.ID = "ID"
+		received, err := GenerateReceived(context.Background(), msgMeta, "mx.example.com", "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received != expected {
+			t.Errorf("Wrong Received field:\nwant: %s\ngot:  %s", expected, received)
+		}
+	}
+
+	test(&module.MsgMetadata{
+		Conn: conn(0),
+	}, "from laptop.example.org (client.example.org [10.0.0.5]) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+	test(&module.MsgMetadata{
+		Conn:            conn(0),
+		DontTraceSender: true,
+	}, "from unknown by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+	test(&module.MsgMetadata{
+		Conn:          conn(0),
+		TraceAuthUser: true,
+	}, "from laptop.example.org (client.example.org [10.0.0.5]) (authenticated as user@example.org) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+	test(&module.MsgMetadata{
+		Conn:            conn(tls.VersionTLS13),
+		DontTraceSender: true,
+		TraceAuthUser:   true,
+		TraceTLS:        true,
+	}, "from unknown (authenticated as user@example.org) by mx.example.com (envelope-sender <sender@example.org>) with ESMTPS (using TLSv1.3 with cipher TLS_AES_128_GCM_SHA256) id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+	test(&module.MsgMetadata{
+		Conn:     conn(tls.VersionTLS12),
+		TraceTLS: true,
+	}, "from laptop.example.org (client.example.org [10.0.0.5]) by mx.example.com (envelope-sender <sender@example.org>) with ESMTPS (using TLSv1.2 with cipher TLS_AES_128_GCM_SHA256) id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+	// TraceTLS is a no-op for plaintext sessions.
+	test(&module.MsgMetadata{
+		Conn:     conn(0),
+		TraceTLS: true,
+	}, "from laptop.example.org (client.example.org [10.0.0.5]) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+
+	// Comment delimiters are removed from the username.
+	state := conn(0)
+	state.AuthUser = "us(er)\\"
+	test(&module.MsgMetadata{
+		Conn:            state,
+		DontTraceSender: true,
+		TraceAuthUser:   true,
+	}, "from unknown (authenticated as user) by mx.example.com (envelope-sender <sender@example.org>) with ESMTP id ID; Fri, 24 Jul 2020 11:39:25 +0000")
+}
@@ -43,27 +43,78 @@ type mxConn struct {
 	// Errors occurred previously on this connection.
 	errored bool
 
+	// Normalized MX hostname the mx_limits slot is taken for, empty if no
+	// slot is held.
+	mxSlot string
+
 	reuseLimit int
 
 	// Amount of times connection was used for an SMTP transaction.
 	transactions int
 
+	// Amount of RCPT TO commands sent in the current transaction.
+	rcptCmds int
+
 	// MX/TLS security level established for this connection.
 	mxLevel  module.MXLevel
 	tlsLevel module.TLSLevel
+
+	// TLS level of the connection itself, before it is raised by
+	// policies. Used to check policies for other domains.
+	connTLSLevel module.TLSLevel
+	tlsErr       error
+
+	// Other domains recipients of the current transaction belong to, see
+	// sharedConnection.
+	sharedDomains []string
+
+	// MX hostnames resolved for the domain, included in errors for
+	// diagnostic purposes.
+	mxCandidates []string
 }
 
 func (c *mxConn) Usable() bool {
 	if c.C == nil || c.transactions > c.reuseLimit || c.C.Client() == nil {
 		return false
 	}
+	if c.mailLimitReached() {
+		return false
+	}
 	return c.C.Client().Reset() == nil
 }
 
+// mailLimitReached reports whether the server-advertised MAILMAX limit
+// (RFC 9422) does not permit more transactions on the connection.
+func (c *mxConn) mailLimitReached() bool {
+	if c.C == nil {
+		return true
+	}
+	mailMax := c.Limits().MailMax
+	return mailMax != 0 && c.transactions >= mailMax
+}
+
+// rcptLimitReached reports whether the server-advertised RCPTMAX limit
+// (RFC 9422) does not permit more recipients in the current transaction.
+func (c *mxConn) rcptLimitReached() bool {
+	rcptMax := c.Limits().RcptMax
+	return rcptMax != 0 && c.rcptCmds >= rcptMax
+}
+
 func (c *mxConn) Close() error {
 	return c.C.Close()
 }
 
+// diagErr annotates the error returned for the connection with the list of
+// MX candidates.
+func (c *mxConn) diagErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return exterrors.WithFields(err, map[string]interface{}{
+		"mx_candidates": c.mxCandidates,
+	})
+}
+
 func isVerifyError(err error) bool {
 	_, ok := err.(x509.UnknownAuthorityError)
 	if ok {
@@ -146,27 +197,68 @@ retry:
 	return tlsLevel, tlsErr, nil
 }
 
-func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX) error {
+// checkMX checks whether the MX can be used for the domain according to
+// the security policies and returns the established MX security level.
+func (rd *remoteDelivery) checkMX(ctx context.Context, domain, host string, dnssecOk bool) (module.MXLevel, error) {
 	mxLevel := module.MXNone
-
-	connCtx, cancel := context.WithCancel(ctx)
-	// Cancel async policy lookups if rd.connect fails.
-	defer cancel()
-
 	for _, p := range rd.policies {
-		policyLevel, err := p.CheckMX(connCtx, mxLevel, conn.domain, record.Host, conn.dnssecOk)
+		policyLevel, err := p.CheckMX(ctx, mxLevel, domain, host, dnssecOk)
 		if err != nil {
-			return err
+			return module.MXNone, exterrors.WithFields(err, map[string]interface{}{
+				"remote_server": host,
+				"smtp_phase":    "policy",
+			})
 		}
 		if policyLevel > mxLevel {
 			mxLevel = policyLevel
 		}
 
-		p.PrepareConn(ctx, record.Host)
+		p.PrepareConn(ctx, host)
+	}
+	return mxLevel, nil
+}
+
+// checkConn checks whether the established connection can be used for the
+// domain according to the security policies and returns the resulting TLS
+// security level.
+func (rd *remoteDelivery) checkConn(ctx context.Context, conn *mxConn, mxLevel module.MXLevel, domain, host string) (module.TLSLevel, error) {
+	tlsLevel := conn.connTLSLevel
+	tlsState, _ := conn.Client().TLSConnectionState()
+	for _, p := range rd.policies {
+		policyLevel, err := p.CheckConn(ctx, mxLevel, tlsLevel, domain, host, tlsState)
+		if err != nil {
+			return module.TLSNone, exterrors.WithFields(err, map[string]interface{}{
+				"tls_err":       conn.tlsErr,
+				"remote_server": host,
+				"remote_addr":   conn.RemoteAddr(),
+				"smtp_phase":    "policy",
+			})
+		}
+		if policyLevel > tlsLevel {
+			tlsLevel = policyLevel
+		}
+	}
+	return tlsLevel, nil
+}
+
+func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX) error {
+	connCtx, cancel := context.WithCancel(ctx)
+	// Cancel async policy lookups if rd.connect fails.
+	defer cancel()
+
+	mxLevel, err := rd.checkMX(connCtx, conn.domain, record.Host, conn.dnssecOk)
+	if err != nil {
+		rd.reportTLS(connCtx, conn.domain, record.Host, nil, err)
+		return err
+	}
+
+	if err := rd.takeMX(ctx, conn, record.Host); err != nil {
+		return err
 	}
 
-	tlsLevel, tlsErr, err := rd.connect(connCtx, *conn, record.Host, rd.rt.tlsConfig)
+	conn.connTLSLevel, conn.tlsErr, err = rd.connect(connCtx, *conn, record.Host, rd.rt.tlsConfig)
 	if err != nil {
+		rd.releaseMX(conn)
 		return err
 	}
 
@@ -174,17 +266,12 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	//
 	// Note: All policy errors are marked as temporary to give the local admin
 	// chance to troubleshoot them without losing messages.
-
-	tlsState, _ := conn.Client().TLSConnectionState()
-	for _, p := range rd.policies {
-		policyLevel, err := p.CheckConn(connCtx, mxLevel, tlsLevel, conn.domain, record.Host, tlsState)
-		if err != nil {
-			conn.Close()
-			return exterrors.WithFields(err, map[string]interface{}{"tls_err": tlsErr})
-		}
-		if policyLevel > tlsLevel {
-			tlsLevel = policyLevel
-		}
+	tlsLevel, err := rd.checkConn(connCtx, conn, mxLevel, conn.domain, record.Host)
+	rd.reportTLS(connCtx, conn.domain, record.Host, conn, err)
+	if err != nil {
+		conn.Close()
+		rd.releaseMX(conn)
+		return err
 	}
 
 	conn.mxLevel = mxLevel
@@ -196,9 +283,98 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	return nil
 }
 
-func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string) (*smtpconn.C, error) {
-	if c, ok := rd.connections[domain]; ok {
-		return c.C, nil
+// sharedConnection returns the connection used in the delivery for another
+// domain if it is established with the most preferred MX of the specified
+// domain. This way recipients in different domains hosted on the same server
+// are sent in a single transaction.
+//
+// Security policies are checked for the domain as if the connection was
+// established for it, the connection is not shared if they fail.
+// PrepareDomain should be called for policies before calling it.
+func (rd *remoteDelivery) sharedConnection(ctx context.Context, domain string, mx mxRecords) *mxConn {
+	host := mx.records[0].Host
+	for _, conn := range rd.allConns() {
+		if conn.errored || conn.C.Client() == nil || !dns.Equal(conn.ServerName(), host) {
+			continue
+		}
+		if conn.rcptLimitReached() {
+			continue
+		}
+		if domainMax := conn.Limits().RcptDomainMax; domainMax != 0 && len(conn.sharedDomains)+1 >= domainMax {
+			continue
+		}
+
+		mxLevel, err := rd.checkMX(ctx, domain, host, mx.dnssecOk)
+		if err != nil {
+			rd.Log.Error("cannot share connection", err, "remote_server", host, "domain", domain)
+			return nil
+		}
+		tlsLevel, err := rd.checkConn(ctx, conn, mxLevel, domain, host)
+		rd.reportTLS(ctx, domain, host, conn, err)
+		if err != nil {
+			rd.Log.Error("cannot share connection", err, "remote_server", host, "domain", domain)
+			return nil
+		}
+		if rd.msgMeta.SMTPOpts.RequireTLS && (tlsLevel < module.TLSAuthenticated || mxLevel < module.MX_MTASTS) {
+			return nil
+		}
+
+		// The connection is as secure as the weakest domain using it.
+		if mxLevel < conn.mxLevel {
+			conn.mxLevel = mxLevel
+		}
+		if tlsLevel < conn.tlsLevel {
+			conn.tlsLevel = tlsLevel
+		}
+		return conn
+	}
+	return nil
+}
+
+// connectionForDomain returns the connection with the started transaction
+// that can be used to add a recipient in the specified domain.
+//
+// If the server limits the amount of recipients per transaction, recipients
+// are split into multiple transactions, each using a separate connection.
+func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string) (*mxConn, error) {
+	if conns := rd.connections[domain]; len(conns) != 0 {
+		c := conns[len(conns)-1]
+		if !c.rcptLimitReached() {
+			return c, nil
+		}
+		rd.Log.DebugMsg("recipients limit reached, starting new transaction",
+			"domain", domain, "remote_server", c.ServerName(), "rcpt_max", c.Limits().RcptMax)
+	}
+
+	// Look up MX records early if other domains are already handled by the
+	// delivery so the connection to the same server can be shared.
+	var mx *mxRecords
+	if len(rd.connections) != 0 {
+		for _, p := range rd.policies {
+			p.PrepareDomain(ctx, domain)
+		}
+		region := trace.StartRegion(ctx, "remote/LookupMX")
+		dnssecOk, records, err := rd.lookupMX(ctx, domain)
+		region.End()
+		if err != nil {
+			return nil, err
+		}
+		mx = &mxRecords{dnssecOk: dnssecOk, records: records}
+
+		if conn := rd.sharedConnection(ctx, domain, *mx); conn != nil {
+			region := trace.StartRegion(ctx, "remote/limits.TakeDest")
+			err := rd.rt.limits.TakeDest(ctx, domain)
+			region.End()
+			if err != nil {
+				return nil, err
+			}
+
+			rd.Log.DebugMsg("sharing connection", "domain", domain, "remote_server", conn.ServerName(),
+				"shared_with", conn.domain)
+			conn.sharedDomains = append(conn.sharedDomains, domain)
+			rd.connections[domain] = append(rd.connections[domain], conn)
+			return conn, nil
+		}
 	}
 
 	pooledConn, err := rd.rt.pool.Get(ctx, domain)
@@ -213,9 +389,13 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	if pooledConn != nil && !rd.msgMeta.SMTPOpts.RequireTLS {
 		conn = pooledConn.(*mxConn)
 		rd.Log.Msg("reusing cached connection", "domain", domain, "transactions_counter", conn.transactions)
+		if err := rd.takeMX(ctx, conn, conn.ServerName()); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	} else {
 		rd.Log.DebugMsg("opening new connection", "domain", domain, "cache_ignored", pooledConn != nil)
-		conn, err = rd.newConn(ctx, domain)
+		conn, err = rd.newConn(ctx, domain, mx)
 		if err != nil {
 			return nil, err
 		}
@@ -224,6 +404,7 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	if rd.msgMeta.SMTPOpts.RequireTLS {
 		if conn.tlsLevel < module.TLSAuthenticated {
 			conn.Close()
+			rd.releaseMX(conn)
 			return nil, &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 30},
@@ -235,6 +416,7 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		}
 		if conn.mxLevel < module.MX_MTASTS {
 			conn.Close()
+			rd.releaseMX(conn)
 			return nil, &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 30},
@@ -249,6 +431,8 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	region := trace.StartRegion(ctx, "remote/limits.TakeDest")
 	if err := rd.rt.limits.TakeDest(ctx, domain); err != nil {
 		region.End()
+		conn.Close()
+		rd.releaseMX(conn)
 		return nil, err
 	}
 	region.End()
@@ -261,20 +445,71 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	// each other. Therefore it is enough to enforce strict security only on
 	// the path to the MX even if it does not support the REQUIRETLS to propagate
 	// this requirement further.
+	//
+	// The flag is dropped only for this connection, other domains should still
+	// get the full REQUIRETLS treatment.
+	opts := rd.msgMeta.SMTPOpts
 	if ok, _ := conn.Client().Extension("REQUIRETLS"); rd.rt.relaxedREQUIRETLS && !ok {
-		rd.msgMeta.SMTPOpts.RequireTLS = false
+		opts.RequireTLS = false
 	}
 
-	if err := conn.Mail(ctx, rd.mailFrom, rd.msgMeta.SMTPOpts); err != nil {
+	if err := conn.Mail(ctx, rd.mailFrom, opts, rd.msgMeta.DSN); err != nil {
 		conn.Close()
-		return nil, err
+		rd.releaseMX(conn)
+		rd.rt.limits.ReleaseDest(domain)
+		return nil, conn.diagErr(err)
+	}
+	conn.rcptCmds = 0
+
+	rd.connections[domain] = append(rd.connections[domain], conn)
+	return conn, nil
+}
+
+// takeMX acquires the mx_limits slot for the MX host the connection is used
+// for, waiting if necessary, and applies the per-host connection reuse limit.
+func (rd *remoteDelivery) takeMX(ctx context.Context, conn *mxConn, host string) error {
+	if rd.rt.mxLimits == nil {
+		return nil
+	}
+
+	key, _ := dns.ForLookup(host)
+	region := trace.StartRegion(ctx, "remote/limits.TakeMX")
+	defer region.End()
+	if active, waiting := rd.rt.mxLimits.Stats(key); waiting != 0 {
+		rd.Log.DebugMsg("waiting for MX slot", "remote_server", host, "active", active, "waiting", waiting)
 	}
+	if err := rd.rt.mxLimits.Take(ctx, key); err != nil {
+		return err
+	}
+	conn.mxSlot = key
 
-	rd.connections[domain] = conn
-	return conn.C, nil
+	if l := rd.rt.mxLimitCfg.Limits(key).ConnMessages; l != 0 {
+		conn.reuseLimit = l - 1
+	}
+	return nil
 }
 
-func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn, error) {
+// releaseMX returns the mx_limits slot held for the connection, if any.
+func (rd *remoteDelivery) releaseMX(conn *mxConn) {
+	if conn.mxSlot == "" {
+		return
+	}
+	rd.rt.mxLimits.Release(conn.mxSlot)
+	conn.mxSlot = ""
+}
+
+// mxRecords is the result of the MX lookup for the domain.
+type mxRecords struct {
+	dnssecOk bool
+	records  []*net.MX
+}
+
+// newConn establishes the connection to the MX of the domain trying
+// MXs in the order of preference.
+//
+// If mx is not nil, the MX lookup (and PrepareDomain for policies) is assumed
+// to be done already.
+func (rd *remoteDelivery) newConn(ctx context.Context, domain string, mx *mxRecords) (*mxConn, error) {
 	conn := mxConn{
 		reuseLimit: rd.rt.connReuseLimit,
 		C:          smtpconn.New(),
@@ -286,33 +521,31 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	conn.Hostname = rd.rt.hostname
 	conn.AddrInSMTPMsg = true
 
-	for _, p := range rd.policies {
-		p.PrepareDomain(ctx, domain)
-	}
+	if mx == nil {
+		for _, p := range rd.policies {
+			p.PrepareDomain(ctx, domain)
+		}
 
-	region := trace.StartRegion(ctx, "remote/LookupMX")
-	dnssecOk, records, err := rd.lookupMX(ctx, domain)
-	region.End()
-	if err != nil {
-		return nil, err
+		region := trace.StartRegion(ctx, "remote/LookupMX")
+		dnssecOk, records, err := rd.lookupMX(ctx, domain)
+		region.End()
+		if err != nil {
+			return nil, err
+		}
+		mx = &mxRecords{dnssecOk: dnssecOk, records: records}
 	}
-	conn.dnssecOk = dnssecOk
+	conn.dnssecOk = mx.dnssecOk
+	records := mx.records
 
 	var lastErr error
-	region = trace.StartRegion(ctx, "remote/Connect+TLS")
+	// Errors for each MX, reported to the sender to help with
+	// troubleshooting.
+	mxErrs := make(map[string]string, len(records))
+	region := trace.StartRegion(ctx, "remote/Connect+TLS")
 	for _, record := range records {
-		if record.Host == "." {
-			return nil, &exterrors.SMTPError{
-				Code:         556,
-				EnhancedCode: exterrors.EnhancedCode{5, 1, 10},
-				Message:      "Domain does not accept email (null MX)",
-			}
-		}
-
 		if err := rd.attemptMX(ctx, &conn, record); err != nil {
-			if len(records) != 0 {
-				rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
-			}
+			rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
+			mxErrs[record.Host] = err.Error()
 			lastErr = err
 			continue
 		}
@@ -320,6 +553,11 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	}
 	region.End()
 
+	conn.mxCandidates = make([]string, 0, len(records))
+	for _, record := range records {
+		conn.mxCandidates = append(conn.mxCandidates, record.Host)
+	}
+
 	// Stil not connected? Bail out.
 	if conn.Client() == nil {
 		return nil, &exterrors.SMTPError{
@@ -329,7 +567,9 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 			TargetName:   "remote",
 			Err:          lastErr,
 			Misc: map[string]interface{}{
-				"domain": domain,
+				"domain":        domain,
+				"mx_candidates": conn.mxCandidates,
+				"mx_errors":     mxErrs,
 			},
 		}
 	}
@@ -337,6 +577,12 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	return &conn, nil
 }
 
+// lookupMX returns MX records for the domain sorted in the order of
+// preference.
+//
+// If there are no MX records, the domain itself is returned as the
+// only MX (RFC 5321 Section 5.1). If the domain has a null MX (RFC 7505),
+// an error is returned.
 func (rd *remoteDelivery) lookupMX(ctx context.Context, domain string) (dnssecOk bool, records []*net.MX, err error) {
 	if rd.rt.extResolver != nil {
 		dnssecOk, records, err = rd.rt.extResolver.AuthLookupMX(context.Background(), domain)
@@ -345,6 +591,8 @@ func (rd *remoteDelivery) lookupMX(ctx context.Context, domain string) (dnssecOk
 	}
 	if err != nil {
 		reason, misc := exterrors.UnwrapDNSErr(err)
+		misc["domain"] = domain
+		misc["smtp_phase"] = "dns"
 		return false, nil, &exterrors.SMTPError{
 			Code:         exterrors.SMTPCode(err, 451, 554),
 			EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 4, 4}),
@@ -356,7 +604,32 @@ func (rd *remoteDelivery) lookupMX(ctx context.Context, domain string) (dnssecOk
 		}
 	}
 
-	sort.Slice(records, func(i, j int) bool {
+	// Null MX should be the only record, but if it is not - it is
+	// ignored in favor of other records.
+	usable := make([]*net.MX, 0, len(records))
+	nullMX := false
+	for _, record := range records {
+		if record.Host == "." {
+			nullMX = true
+			continue
+		}
+		usable = append(usable, record)
+	}
+	records = usable
+	if nullMX && len(records) == 0 {
+		return false, nil, &exterrors.SMTPError{
+			Code:         556,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 10},
+			Message:      "Domain does not accept email (null MX)",
+			TargetName:   "remote",
+			Misc: map[string]interface{}{
+				"domain": domain,
+			},
+		}
+	}
+
+	// Stable sort keeps the DNS order for records with the same preference.
+	sort.SliceStable(records, func(i, j int) bool {
 		return records[i].Pref < records[j].Pref
 	})
 
@@ -25,6 +25,7 @@ import (
 	"net"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/go-mockdns"
@@ -201,6 +202,117 @@ func TestRemoteDelivery_AuthMX_MTASTS_NoTLS(t *testing.T) {
 	}
 }
 
+func TestRemoteDelivery_MTASTS_Enforce_NoTLS(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	mtastsGet := func(ctx context.Context, domain string) (*mtasts.Policy, error) {
+		return &mtasts.Policy{
+			Mode: mtasts.ModeEnforce,
+			MX:   []string{"mx.example.invalid"},
+		}, nil
+	}
+
+	// No local policy, MTA-STS alone should prevent plaintext delivery.
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, mtastsGet),
+	})
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+
+	if be1.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued for server failing authentication")
+	}
+}
+
+func TestRemoteDelivery_MTASTS_Testing_NoTLS(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	mtastsGet := func(ctx context.Context, domain string) (*mtasts.Policy, error) {
+		return &mtasts.Policy{
+			Mode: mtasts.ModeTesting,
+			MX:   []string{"mx.example.invalid"},
+		}, nil
+	}
+
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, mtastsGet),
+	})
+	defer tgt.Close()
+
+	// Violations of testing policy are only logged.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be1.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+}
+
+func TestMTASTSPolicy_ExpiredEnforced(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"_mta-sts.example.invalid.": {
+			TXT: []string{"v=STSv1; id=2"},
+		},
+		"_mta-sts.example2.invalid.": {
+			Err: &net.DNSError{Err: "no such host", IsNotFound: true},
+		},
+	}
+
+	p := testSTSPolicy(t, zones, nil)
+	defer p.Close()
+	p.cache.Resolver = &mockdns.Resolver{Zones: zones}
+	p.cache.DownloadPolicy = func(domain string) (*mtasts.Policy, error) {
+		return nil, errors.New("policy host is down")
+	}
+
+	expired := &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MaxAge: 3600,
+		MX:     []string{"mx.example.invalid"},
+	}
+	for _, domain := range []string{"example.invalid", "example2.invalid"} {
+		if err := p.cache.Store.Store(domain, "1", time.Now().Add(-48*time.Hour), expired); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Policy is still advertised but can't be fetched, keep enforcing it.
+	policy, err := p.get(context.Background(), "example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Mode != mtasts.ModeEnforce {
+		t.Fatal("Wrong policy mode:", policy.Mode)
+	}
+
+	// Policy record is removed, so the policy is no longer used.
+	if _, err := p.get(context.Background(), "example2.invalid"); !mtasts.IsNoPolicy(err) {
+		t.Fatal("Expected ErrNoPolicy, got", err)
+	}
+}
+
 func TestRemoteDelivery_AuthMX_MTASTS_RequirePKIX(t *testing.T) {
 	_, be1, srv1 := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
 	defer srv1.Close()
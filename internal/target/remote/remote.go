@@ -36,6 +36,7 @@ import (
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/clock"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
@@ -44,8 +45,10 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
 	"golang.org/x/net/idna"
 )
 
@@ -71,10 +74,15 @@ type Target struct {
 	limits            *limits.Group
 	allowSecOverride  bool
 	relaxedREQUIRETLS bool
+	tlsrpt            tlsReporter
 
 	pool           *pool.P
 	connReuseLimit int
 
+	// Per-MX-host limits, mxLimits is nil if none are configured.
+	mxLimitCfg limits.DestConfig
+	mxLimits   *limiters.KeyedFIFO
+
 	Log log.Logger
 }
 
@@ -127,9 +135,19 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &rt.limits)
+	cfg.Custom("tls_reporting", false, false, nil, func(cfg *config.Map, n config.Node) (interface{}, error) {
+		var r *tlsrpt.Reporter
+		if err := modconfig.ModuleFromNode("", n.Args, n, cfg.Globals, &r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}, &rt.tlsrpt)
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
+	cfg.Custom("mx_limits", false, false, func() (interface{}, error) {
+		return limits.DestConfig{}, nil
+	}, limits.DestDirective("host", true), &rt.mxLimitCfg)
 
 	poolCfg := pool.Config{
 		MaxKeys:             20000,
@@ -144,6 +162,9 @@ func (rt *Target) Init(cfg *config.Map) error {
 		return err
 	}
 	rt.pool = pool.New(poolCfg)
+	if rt.mxLimitCfg.Default != (limits.DestLimits{}) || len(rt.mxLimitCfg.Overrides) != 0 {
+		rt.mxLimits = rt.mxLimitCfg.NewFIFO(clock.Real)
+	}
 
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	rt.hostname, err = idna.ToASCII(rt.hostname)
@@ -184,8 +205,10 @@ type remoteDelivery struct {
 	msgMeta  *module.MsgMetadata
 	Log      log.Logger
 
-	recipients  []string
-	connections map[string]*mxConn
+	recipients []string
+	// Connections used for the delivery, there can be multiple connections
+	// per domain if the server limits amount of recipients per transaction.
+	connections map[string][]*mxConn
 
 	policies []module.DeliveryMXAuthPolicy
 }
@@ -245,7 +268,7 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 		mailFrom:    mailFrom,
 		msgMeta:     msgMeta,
 		Log:         target.DeliveryLogger(rt.Log, msgMeta),
-		connections: map[string]*mxConn{},
+		connections: map[string][]*mxConn{},
 		policies:    policies,
 	}, nil
 }
@@ -292,8 +315,9 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string) error {
 		return err
 	}
 
-	if err := conn.Rcpt(ctx, to); err != nil {
-		return moduleError(err)
+	conn.rcptCmds++
+	if err := conn.Rcpt(ctx, to, rd.msgMeta.RcptDSN(to)); err != nil {
+		return moduleError(conn.diagErr(err))
 	}
 
 	rd.recipients = append(rd.recipients, to)
@@ -384,9 +408,13 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 
 	var wg sync.WaitGroup
 
-	for i, conn := range rd.connections {
-		i := i
+	for _, conn := range rd.allConns() {
 		conn := conn
+
+		if rd.failQuarantined(c, conn.Rcpts()) {
+			continue
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -400,17 +428,70 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 			}
 			defer bodyR.Close()
 
-			err = conn.Data(ctx, header, bodyR)
+			err = conn.diagErr(conn.Data(ctx, header, bodyR))
 			for _, rcpt := range conn.Rcpts() {
 				c.SetStatus(rcpt, err)
 			}
-			rd.connections[i].errored = err != nil
+			conn.errored = err != nil
 		}()
 	}
 
 	wg.Wait()
 }
 
+// failQuarantined sets the status for recipients of the connection if the
+// message is quarantined for any of them. Since the transaction can't be
+// sent only for a subset of recipients, remaining ones get a temporary error
+// and will be retried by the queue.
+func (rd *remoteDelivery) failQuarantined(c module.StatusCollector, rcpts []string) bool {
+	quarantined := false
+	for _, rcpt := range rcpts {
+		if rd.msgMeta.IsQuarantined(rcpt) {
+			quarantined = true
+			break
+		}
+	}
+	if !quarantined {
+		return false
+	}
+
+	for _, rcpt := range rcpts {
+		if rd.msgMeta.IsQuarantined(rcpt) {
+			c.SetStatus(rcpt, &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+				Message:      "Refusing to deliver quarantined message",
+				TargetName:   "remote",
+			})
+			continue
+		}
+		c.SetStatus(rcpt, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Message is quarantined for another recipient, try again later",
+			TargetName:   "remote",
+		})
+	}
+	return true
+}
+
+// allConns returns all connections used by the delivery, connections shared
+// by multiple domains are returned once.
+func (rd *remoteDelivery) allConns() []*mxConn {
+	var conns []*mxConn
+	seen := make(map[*mxConn]struct{})
+	for _, domainConns := range rd.connections {
+		for _, conn := range domainConns {
+			if _, ok := seen[conn]; ok {
+				continue
+			}
+			seen[conn] = struct{}{}
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
 func (rd *remoteDelivery) Abort(ctx context.Context) error {
 	return rd.Close()
 }
@@ -422,11 +503,17 @@ func (rd *remoteDelivery) Commit(ctx context.Context) error {
 }
 
 func (rd *remoteDelivery) Close() error {
-	for _, conn := range rd.connections {
+	for _, conn := range rd.allConns() {
+		rd.releaseMX(conn)
 		rd.rt.limits.ReleaseDest(conn.domain)
+		for _, domain := range conn.sharedDomains {
+			rd.rt.limits.ReleaseDest(domain)
+		}
+		conn.sharedDomains = nil
 		conn.transactions++
 
-		if conn.C == nil || conn.transactions > rd.rt.connReuseLimit || conn.C.Client() == nil || conn.errored {
+		if conn.C == nil || conn.transactions > conn.reuseLimit || conn.C.Client() == nil || conn.errored ||
+			conn.mailLimitReached() {
 			rd.Log.Debugf("disconnected from %s (errored=%v,transactions=%v,disconnected before=%v)",
 				conn.ServerName(), conn.errored, conn.transactions, conn.C.Client() == nil)
 			conn.Close()
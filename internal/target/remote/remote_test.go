@@ -19,12 +19,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package remote
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"flag"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -34,11 +37,13 @@ import (
 	"github.com/foxcpp/go-mockdns"
 	"github.com/foxcpp/go-mtasts"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/clock"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -1052,3 +1057,310 @@ func TestRemoteDelivery_ConnReuse(t *testing.T) {
 		t.Fatal("Only one session should be used, found", be.SourceEndpoints)
 	}
 }
+
+func TestRemoteDelivery_MXLimits(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.mxLimitCfg = limits.DestConfig{
+		Overrides: map[string]limits.DestLimits{
+			"mx.example.invalid": {
+				FIFOLimits:   limiters.FIFOLimits{Concurrency: 1},
+				ConnMessages: 1,
+			},
+		},
+	}
+	tgt.mxLimits = tgt.mxLimitCfg.NewFIFO(clock.Real)
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example.invalid"})
+
+	if len(be.SourceEndpoints) != 2 {
+		t.Fatal("Connection should not be reused with messages_per_conn 1, found", be.SourceEndpoints)
+	}
+	if active, waiting := tgt.mxLimits.Stats("mx.example.invalid"); active != 0 || waiting != 0 {
+		t.Fatal("MX slots are not released:", active, waiting)
+	}
+}
+
+// limitsConn injects the LIMITS keyword into the EHLO response since go-smtp
+// server does not support advertising it.
+type limitsConn struct {
+	net.Conn
+	keyword string
+}
+
+func (c limitsConn) Write(b []byte) (int, error) {
+	patched := bytes.Replace(b, []byte("250-PIPELINING\r\n"),
+		[]byte("250-PIPELINING\r\n250-"+c.keyword+"\r\n"), 1)
+	if _, err := c.Conn.Write(patched); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type limitsListener struct {
+	net.Listener
+	keyword string
+}
+
+func (l limitsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return limitsConn{Conn: conn, keyword: l.keyword}, nil
+}
+
+func smtpServerLimits(t *testing.T, addr, limits string) (*testutils.SMTPBackend, *smtp.Server) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := new(testutils.SMTPBackend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	go func() {
+		if err := s.Serve(limitsListener{Listener: l, keyword: "LIMITS " + limits}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// See testutils.SMTPServer.
+	testConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn.Close()
+
+	return be, s
+}
+
+func TestRemoteDelivery_RcptMax(t *testing.T) {
+	be, srv := smtpServerLimits(t, "127.0.0.1:"+smtpPort, "RCPTMAX=2 UNKNOWN=1")
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+
+	rcpts := []string{
+		"test1@example.invalid",
+		"test2@example.invalid",
+		"test3@example.invalid",
+		"test4@example.invalid",
+		"test5@example.invalid",
+	}
+	testutils.DoTestDelivery(t, tgt, "test@example.com", rcpts)
+
+	if len(be.Messages) != 3 {
+		t.Fatalf("recipients should be split into 3 transactions, got %d", len(be.Messages))
+	}
+	var delivered []string
+	for _, msg := range be.Messages {
+		if len(msg.To) > 2 {
+			t.Errorf("RCPTMAX is not respected, transaction has %d recipients", len(msg.To))
+		}
+		delivered = append(delivered, msg.To...)
+	}
+	sort.Strings(delivered)
+	if !reflect.DeepEqual(delivered, rcpts) {
+		t.Errorf("wrong recipients delivered: %v", delivered)
+	}
+}
+
+func TestRemoteDelivery_MailMax(t *testing.T) {
+	be, srv := smtpServerLimits(t, "127.0.0.1:"+smtpPort, "MAILMAX=1")
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.connReuseLimit = 5
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example.invalid"})
+
+	if be.SessionCounter != 2 {
+		t.Fatal("Connection should not be reused after MAILMAX transactions, sessions:", be.SessionCounter)
+	}
+}
+
+func TestRemoteDelivery_SharedMX(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"example2.invalid.": {
+			MX: []net.MX{{Host: "MX.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+	if be.SessionCounter != 1 {
+		t.Fatal("Connection should be shared by domains with the same MX, sessions:", be.SessionCounter)
+	}
+}
+
+func TestRemoteDelivery_SharedMX_RcptDomainMax(t *testing.T) {
+	be, srv := smtpServerLimits(t, "127.0.0.1:"+smtpPort, "RCPTDOMAINMAX=1")
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"example2.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+
+	if len(be.Messages) != 2 {
+		t.Fatalf("domains should be split into 2 transactions, got %d", len(be.Messages))
+	}
+}
+
+func TestRemoteDelivery_SharedMX_NotPreferred(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+smtpPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		// Shared MX is only a backup for example2.invalid, the preferred one
+		// should be used.
+		"example2.invalid.": {
+			MX: []net.MX{
+				{Host: "mx.example.invalid.", Pref: 20},
+				{Host: "mx.example2.invalid.", Pref: 10},
+			},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"mx.example2.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+
+	be1.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	be2.CheckMsg(t, 0, "test@example.com", []string{"test@example2.invalid"})
+}
+
+func TestRemoteDelivery_NullMX_Mixed(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: ".", Pref: 0},
+				{Host: "mx.example.invalid.", Pref: 10},
+			},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+}
+
+func TestRemoteDelivery_AllMXDown_Errors(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: "mx1.example.invalid.", Pref: 20},
+				{Host: "mx2.example.invalid.", Pref: 10},
+			},
+		},
+		"mx1.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"mx2.example.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+
+	delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test..."}, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delivery.Abort(context.Background())
+
+	err = delivery.AddRcpt(context.Background(), "test@example.invalid")
+	smtpErr, ok := err.(*exterrors.SMTPError)
+	if !ok {
+		t.Fatalf("Not SMTPError: %T %v", err, err)
+	}
+	mxErrs, _ := smtpErr.Misc["mx_errors"].(map[string]string)
+	if len(mxErrs) != 2 || mxErrs["mx1.example.invalid."] == "" || mxErrs["mx2.example.invalid."] == "" {
+		t.Fatalf("Errors are not reported for each MX: %v", smtpErr.Misc["mx_errors"])
+	}
+}
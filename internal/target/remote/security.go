@@ -23,6 +23,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/foxcpp/go-mtasts"
@@ -80,6 +81,9 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if config.CheckOnly {
+		return nil
+	}
 
 	switch storeType {
 	case "fs":
@@ -93,11 +97,53 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 		panic("mtasts policy init: unknown cache type")
 	}
 	c.cache.Resolver = dns.DefaultResolver()
-	c.mtastsGet = c.cache.Get
+	c.mtastsGet = c.get
 
 	return nil
 }
 
+// get returns the MTA-STS policy for the domain using the cache.
+//
+// If the policy can't be fetched and there is no valid cached policy, the
+// domain is considered to have no policy. However, if the domain still
+// advertises a policy and it was previously seen in enforce mode, the expired
+// policy is used instead so a failure of the policy host (or an attacker
+// blocking it) can't downgrade delivery to plaintext (RFC 8461 Section 10.3).
+func (c *mtastsPolicy) get(ctx context.Context, domain string) (*mtasts.Policy, error) {
+	policy, err := c.cache.Get(ctx, domain)
+	if err == nil {
+		return policy, nil
+	}
+
+	_, _, cached, loadErr := c.cache.Store.Load(domain)
+	if loadErr != nil || cached.Mode != mtasts.ModeEnforce {
+		return nil, err
+	}
+	// Domain removed the policy record, so it no longer wants it to be
+	// enforced.
+	if mtasts.IsNoPolicy(err) && !c.advertised(ctx, domain) {
+		return nil, err
+	}
+
+	c.log.Msg("failed to fetch MTA-STS policy, using expired enforced policy", "domain", domain, "reason", err.Error())
+	return cached, nil
+}
+
+// advertised reports whether the domain has the MTA-STS TXT record.
+func (c *mtastsPolicy) advertised(ctx context.Context, domain string) bool {
+	records, err := c.cache.Resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return false
+	}
+	found := 0
+	for _, rec := range records {
+		if strings.HasPrefix(rec, "v=STSv1") {
+			found++
+		}
+	}
+	return found == 1
+}
+
 // StartUpdater starts a goroutine to update MTA-STS cache periodically until
 // Close is called.
 //
@@ -149,6 +195,7 @@ func (c *mtastsPolicy) Close() error {
 }
 
 func (c *mtastsDelivery) PrepareDomain(ctx context.Context, domain string) {
+	c.domain = domain
 	c.policyFut = future.New()
 	go func() {
 		c.policyFut.Set(c.c.mtastsGet(ctx, domain))
@@ -165,6 +212,10 @@ func (c *mtastsDelivery) CheckMX(ctx context.Context, mxLevel module.MXLevel, do
 	}
 	policy := policyI.(*mtasts.Policy)
 
+	if policy.Mode == mtasts.ModeNone {
+		return module.MXNone, nil
+	}
+
 	if !policy.Match(mx) {
 		if policy.Mode == mtasts.ModeEnforce {
 			return module.MXNone, &exterrors.SMTPError{
@@ -187,7 +238,18 @@ func (c *mtastsDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel,
 	}
 	policy := policyI.(*mtasts.Policy)
 
-	if policy.Mode != mtasts.ModeEnforce {
+	switch policy.Mode {
+	case mtasts.ModeEnforce:
+	case mtasts.ModeTesting:
+		// Violations are only reported, see RFC 8461 Section 5.
+		if !tlsState.HandshakeComplete {
+			c.log.Msg("TLS is unavailable but required by non-enforced MTA-STS policy", "mx", mx, "domain", domain)
+		} else if tlsState.VerifiedChains == nil {
+			c.log.Msg("TLS certificate is not trusted but authentication is required by non-enforced MTA-STS policy",
+				"mx", mx, "domain", domain)
+		}
+		return module.TLSNone, nil
+	default:
 		return module.TLSNone, nil
 	}
 
@@ -343,6 +405,7 @@ type (
 	}
 	daneDelivery struct {
 		c       *danePolicy
+		mx      string
 		tlsaFut *future.Future
 	}
 )
@@ -464,6 +527,7 @@ func (c *daneDelivery) PrepareConn(ctx context.Context, mx string) {
 		return
 	}
 
+	c.mx = mx
 	c.tlsaFut = future.New()
 
 	go func() {
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+)
+
+// tlsReporter is the interface of tlsrpt.Reporter used to record results of
+// TLS sessions.
+type tlsReporter interface {
+	Record(res tlsrpt.Result)
+}
+
+// reportingPolicy is implemented by delivery policies that correspond to
+// policy types defined by RFC 8460.
+type reportingPolicy interface {
+	// ReportedPolicy returns the policy in effect for the domain and MX, ok is
+	// false if there is none. mxOk is false if the MX is not permitted by the
+	// policy.
+	ReportedPolicy(ctx context.Context, domain, mx string) (p tlsrpt.Policy, mxOk, ok bool)
+}
+
+func (c *mtastsDelivery) ReportedPolicy(ctx context.Context, domain, mx string) (tlsrpt.Policy, bool, bool) {
+	if c.policyFut == nil || c.domain != domain {
+		return tlsrpt.Policy{}, false, false
+	}
+	policyI, err := c.policyFut.GetContext(ctx)
+	if err != nil {
+		return tlsrpt.Policy{}, false, false
+	}
+	policy := policyI.(*mtasts.Policy)
+	if policy.Mode == mtasts.ModeNone {
+		return tlsrpt.Policy{}, false, false
+	}
+
+	policyString := []string{"version: STSv1", "mode: " + string(policy.Mode)}
+	for _, mx := range policy.MX {
+		policyString = append(policyString, "mx: "+mx)
+	}
+	policyString = append(policyString, "max_age: "+strconv.Itoa(policy.MaxAge))
+
+	return tlsrpt.Policy{
+		Type:   tlsrpt.PolicySTS,
+		String: policyString,
+		Domain: domain,
+		MXHost: policy.MX,
+	}, policy.Match(mx), true
+}
+
+func (c *daneDelivery) ReportedPolicy(ctx context.Context, domain, mx string) (tlsrpt.Policy, bool, bool) {
+	if c.tlsaFut == nil || c.mx != mx {
+		return tlsrpt.Policy{}, false, false
+	}
+	recsI, err := c.tlsaFut.GetContext(ctx)
+	if err != nil {
+		return tlsrpt.Policy{}, false, false
+	}
+	recs := recsI.([]dns.TLSA)
+	if len(recs) == 0 {
+		return tlsrpt.Policy{}, false, false
+	}
+
+	policyString := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		policyString = append(policyString, strconv.Itoa(int(rec.Usage))+" "+
+			strconv.Itoa(int(rec.Selector))+" "+strconv.Itoa(int(rec.MatchingType))+" "+rec.Certificate)
+	}
+	return tlsrpt.Policy{
+		Type:   tlsrpt.PolicyTLSA,
+		String: policyString,
+		Domain: domain,
+		MXHost: []string{mx},
+	}, true, true
+}
+
+// reportedPolicy returns the policy applied to the delivery for TLS
+// reporting. DANE takes precedence over MTA-STS as required by RFC 8461.
+func (rd *remoteDelivery) reportedPolicy(ctx context.Context, domain, mx string) (tlsrpt.Policy, bool) {
+	var (
+		sts     tlsrpt.Policy
+		stsMXOk bool
+		hasSTS  bool
+	)
+	for _, p := range rd.policies {
+		rp, ok := p.(reportingPolicy)
+		if !ok {
+			continue
+		}
+		policy, mxOk, ok := rp.ReportedPolicy(ctx, domain, mx)
+		if !ok {
+			continue
+		}
+		if policy.Type == tlsrpt.PolicyTLSA {
+			return policy, mxOk
+		}
+		sts, stsMXOk, hasSTS = policy, mxOk, true
+	}
+	if hasSTS {
+		return sts, stsMXOk
+	}
+	return tlsrpt.Policy{Type: tlsrpt.PolicyNoPolicyFound, Domain: domain}, true
+}
+
+// certResultType returns the result type corresponding to the certificate
+// verification error.
+func certResultType(err error) string {
+	var (
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		unknownErr x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.As(err, &hostErr):
+		return tlsrpt.ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return tlsrpt.ResultCertificateExpired
+	case errors.As(err, &unknownErr):
+		return tlsrpt.ResultCertificateNotTrusted
+	default:
+		return tlsrpt.ResultValidationFailure
+	}
+}
+
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// reportTLS records the result of the delivery attempt to the MX for TLS
+// reporting.
+//
+// conn is nil if the MX was rejected by policies before connecting,
+// policyErr is the error returned by checkMX or checkConn, if any.
+func (rd *remoteDelivery) reportTLS(ctx context.Context, domain, mx string, conn *mxConn, policyErr error) {
+	if rd.rt.tlsrpt == nil {
+		return
+	}
+
+	policy, mxOk := rd.reportedPolicy(ctx, domain, mx)
+	res := tlsrpt.Result{
+		Policy:              policy,
+		ReceivingMXHostname: mx,
+	}
+	if conn != nil {
+		res.SendingMTAIP = addrIP(conn.LocalAddr())
+		res.ReceivingIP = addrIP(conn.RemoteAddr())
+	}
+
+	switch {
+	case !mxOk:
+		res.ResultType = tlsrpt.ResultValidationFailure
+		res.FailureReason = "MX is not listed in the policy"
+	case conn == nil:
+		// Rejected by policies not related to TLS, there is no session to
+		// report.
+		return
+	case conn.connTLSLevel == module.TLSNone:
+		if conn.tlsErr != nil {
+			res.ResultType = tlsrpt.ResultValidationFailure
+			res.FailureReason = conn.tlsErr.Error()
+		} else {
+			res.ResultType = tlsrpt.ResultSTARTTLSNotSupported
+		}
+	case policy.Type == tlsrpt.PolicyTLSA && policyErr != nil:
+		res.ResultType = tlsrpt.ResultTLSAInvalid
+		res.FailureReason = policyErr.Error()
+	case policy.Type == tlsrpt.PolicySTS && conn.connTLSLevel != module.TLSAuthenticated:
+		res.ResultType = certResultType(conn.tlsErr)
+		if conn.tlsErr != nil {
+			res.FailureReason = conn.tlsErr.Error()
+		}
+	}
+
+	rd.rt.tlsrpt.Record(res)
+}
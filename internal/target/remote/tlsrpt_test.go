@@ -0,0 +1,177 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+)
+
+type testReporter struct {
+	lock    sync.Mutex
+	results []tlsrpt.Result
+}
+
+func (r *testReporter) Record(res tlsrpt.Result) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results = append(r.results, res)
+}
+
+func (r *testReporter) single(t *testing.T) tlsrpt.Result {
+	t.Helper()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.results) != 1 {
+		t.Fatalf("Expected 1 result, got %d: %+v", len(r.results), r.results)
+	}
+	return r.results[0]
+}
+
+func tlsrptZones() map[string]mockdns.Zone {
+	return map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+}
+
+func stsGetter(mode mtasts.Mode, mx string) func(context.Context, string) (*mtasts.Policy, error) {
+	return func(ctx context.Context, domain string) (*mtasts.Policy, error) {
+		return &mtasts.Policy{Mode: mode, MX: []string{mx}, MaxAge: 86400}, nil
+	}
+}
+
+func TestRemoteDelivery_TLSRPT_Success(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := tlsrptZones()
+
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, stsGetter(mtasts.ModeEnforce, "mx.example.invalid")),
+	})
+	tgt.tlsConfig = clientCfg
+	rep := &testReporter{}
+	tgt.tlsrpt = rep
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	res := rep.single(t)
+	if res.ResultType != "" {
+		t.Error("Unexpected failure:", res.ResultType, res.FailureReason)
+	}
+	if res.Policy.Type != tlsrpt.PolicySTS || res.Policy.Domain != "example.invalid" {
+		t.Error("Wrong policy:", res.Policy)
+	}
+	if len(res.Policy.String) != 4 || res.Policy.String[1] != "mode: enforce" {
+		t.Error("Wrong policy string:", res.Policy.String)
+	}
+	if res.ReceivingIP != "127.0.0.1" || res.SendingMTAIP != "127.0.0.1" {
+		t.Error("Wrong IPs:", res.ReceivingIP, res.SendingMTAIP)
+	}
+}
+
+func TestRemoteDelivery_TLSRPT_Testing_NoTLS(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := tlsrptZones()
+
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, stsGetter(mtasts.ModeTesting, "mx.example.invalid")),
+	})
+	rep := &testReporter{}
+	tgt.tlsrpt = rep
+	defer tgt.Close()
+
+	// Failure is reported but the message is still delivered.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	res := rep.single(t)
+	if res.ResultType != tlsrpt.ResultSTARTTLSNotSupported {
+		t.Error("Wrong result type:", res.ResultType)
+	}
+	if res.ReceivingMXHostname != "mx.example.invalid." {
+		t.Error("Wrong MX hostname:", res.ReceivingMXHostname)
+	}
+}
+
+func TestRemoteDelivery_TLSRPT_Enforce_MXMismatch(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := tlsrptZones()
+
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, stsGetter(mtasts.ModeEnforce, "mx2.example.invalid")),
+	})
+	rep := &testReporter{}
+	tgt.tlsrpt = rep
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if be.SessionCounter != 0 {
+		t.Fatal("Connection established to the MX not permitted by the policy")
+	}
+
+	res := rep.single(t)
+	if res.ResultType != tlsrpt.ResultValidationFailure {
+		t.Error("Wrong result type:", res.ResultType)
+	}
+	if len(res.Policy.MXHost) != 1 || res.Policy.MXHost[0] != "mx2.example.invalid" {
+		t.Error("Wrong policy MX:", res.Policy.MXHost)
+	}
+}
+
+func TestRemoteDelivery_TLSRPT_NoPolicy(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	tgt := testTarget(t, tlsrptZones(), nil, nil)
+	rep := &testReporter{}
+	tgt.tlsrpt = rep
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	res := rep.single(t)
+	if res.Policy.Type != tlsrpt.PolicyNoPolicyFound || res.ResultType != tlsrpt.ResultSTARTTLSNotSupported {
+		t.Error("Wrong result:", res.Policy.Type, res.ResultType)
+	}
+}
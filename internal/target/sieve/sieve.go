@@ -0,0 +1,357 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements the delivery target that applies per-recipient
+// Sieve scripts before passing the message to the storage.
+//
+// Implemented interfaces:
+// - module.DeliveryTarget
+package sieve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	sievelang "github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.sieve"
+
+type Target struct {
+	instName string
+
+	deliverTo    module.DeliveryTarget
+	redirectTo   module.DeliveryTarget
+	scriptsDir   string
+	scriptsTable module.Table
+	maxRedirects int
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("sieve: inline arguments are not used")
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &t.deliverTo)
+	cfg.Custom("redirect_to", false, false, nil, modconfig.DeliveryDirective, &t.redirectTo)
+	cfg.String("scripts_dir", false, false, "", &t.scriptsDir)
+	cfg.Custom("scripts_table", false, false, nil, modconfig.TableDirective, &t.scriptsTable)
+	cfg.Int("max_redirects", false, false, 4, &t.maxRedirects)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.scriptsDir == "" && t.scriptsTable == nil {
+		return errors.New("sieve: scripts_dir or scripts_table is required")
+	}
+	if t.scriptsDir != "" && t.scriptsTable != nil {
+		return errors.New("sieve: scripts_dir and scripts_table can't be used together")
+	}
+	if t.maxRedirects < 0 {
+		return errors.New("sieve: max_redirects can't be negative")
+	}
+
+	return nil
+}
+
+// loadScript returns the script text for the recipient. Empty string is
+// returned if the recipient has no script.
+func (t *Target) loadScript(rcptTo string) (string, error) {
+	if t.scriptsTable != nil {
+		script, ok, err := t.scriptsTable.Lookup(rcptTo)
+		if err != nil || !ok {
+			return "", err
+		}
+		return script, nil
+	}
+
+	// Do not let the address to point outside of scripts_dir.
+	if rcptTo == "" || strings.ContainsAny(rcptTo, `/\`) || strings.HasPrefix(rcptTo, ".") {
+		return "", nil
+	}
+	script, err := ioutil.ReadFile(filepath.Join(t.scriptsDir, rcptTo+".sieve"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(script), nil
+}
+
+type rcptDelivery struct {
+	rcptTo   string
+	msgMeta  *module.MsgMetadata
+	delivery module.Delivery
+
+	// Set if the delivery was aborted because the script discarded the
+	// message.
+	discarded bool
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+
+	rcpts []*rcptDelivery
+	// Deliveries started in Body (additional folders and redirects), they are
+	// committed or aborted together with the per-recipient ones.
+	extra []module.Delivery
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+	}, nil
+}
+
+// startInner starts the delivery for a single recipient with a separate copy
+// of the message metadata so the recipient folder can be set independently.
+func (d *delivery) startInner(ctx context.Context, rcptTo, folder string) (*rcptDelivery, error) {
+	msgMeta := d.msgMeta.DeepCopy()
+	msgMeta.RcptFolders = make(map[string]string, 1)
+	if folder != "" {
+		msgMeta.RcptFolders[rcptTo] = folder
+	}
+
+	inner, err := d.t.deliverTo.Start(ctx, msgMeta, d.mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	if err := inner.AddRcpt(ctx, rcptTo); err != nil {
+		if err := inner.Abort(ctx); err != nil {
+			d.log.Error("delivery.Abort failed", err, "rcpt", rcptTo)
+		}
+		return nil, err
+	}
+	return &rcptDelivery{rcptTo: rcptTo, msgMeta: msgMeta, delivery: inner}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	defer trace.StartRegion(ctx, "sieve/AddRcpt").End()
+
+	for _, rd := range d.rcpts {
+		if rd.rcptTo == rcptTo {
+			return nil
+		}
+	}
+
+	rd, err := d.startInner(ctx, rcptTo, "")
+	if err != nil {
+		return err
+	}
+	d.rcpts = append(d.rcpts, rd)
+	return nil
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	cw.n += len(b)
+	return len(b), nil
+}
+
+// execute runs the recipient script. Script errors are never reported to the
+// sender, the message is delivered to the default mailbox instead.
+func (d *delivery) execute(rcptTo string, header textproto.Header, size int) sievelang.Result {
+	keep := sievelang.Result{Keep: true}
+
+	src, err := d.t.loadScript(rcptTo)
+	if err != nil {
+		d.log.Error("failed to load script, using implicit keep", err, "rcpt", rcptTo)
+		return keep
+	}
+	if src == "" {
+		return keep
+	}
+
+	script, err := sievelang.Parse(src)
+	if err != nil {
+		d.log.Error("malformed script, using implicit keep", err, "rcpt", rcptTo)
+		return keep
+	}
+	script.MaxRedirects = d.t.maxRedirects
+
+	res, err := script.Execute(&sievelang.Message{
+		From:   d.mailFrom,
+		To:     rcptTo,
+		Header: header,
+		Size:   size,
+	})
+	if err != nil {
+		d.log.Error("script failed, using implicit keep", err, "rcpt", rcptTo)
+		return keep
+	}
+	if len(res.Redirect) != 0 && d.t.redirectTo == nil {
+		d.log.Msg("redirect is not configured, using implicit keep", "rcpt", rcptTo, "redirect", res.Redirect)
+		res.Redirect = nil
+		res.Keep = true
+	}
+	return res
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "sieve/Body").End()
+
+	cw := countingWriter{}
+	if err := textproto.WriteHeader(&cw, header); err != nil {
+		return err
+	}
+	size := cw.n + body.Len()
+
+	for _, rd := range d.rcpts {
+		res := d.execute(rd.rcptTo, header, size)
+		d.log.DebugMsg("script executed", "rcpt", rd.rcptTo,
+			"keep", res.Keep, "fileinto", res.Fileinto, "redirect", res.Redirect)
+
+		if len(res.Redirect) != 0 {
+			if err := d.redirect(ctx, res.Redirect, header, body); err != nil {
+				return err
+			}
+		}
+
+		folders := res.Fileinto
+		if !res.Keep {
+			if len(folders) == 0 {
+				// Discarded or redirected only.
+				if res.Discarded() {
+					d.log.Msg("message discarded by script", "rcpt", rd.rcptTo)
+				}
+				if err := rd.delivery.Abort(ctx); err != nil {
+					d.log.Error("delivery.Abort failed", err, "rcpt", rd.rcptTo)
+				}
+				rd.discarded = true
+				continue
+			}
+			// Reuse the already started delivery for the first folder.
+			rd.msgMeta.RcptFolders[rd.rcptTo] = folders[0]
+			folders = folders[1:]
+		}
+
+		if err := rd.delivery.Body(ctx, header, body); err != nil {
+			return err
+		}
+
+		for _, folder := range folders {
+			extra, err := d.startInner(ctx, rd.rcptTo, folder)
+			if err != nil {
+				return err
+			}
+			d.extra = append(d.extra, extra.delivery)
+			if err := extra.delivery.Body(ctx, header, body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *delivery) redirect(ctx context.Context, addrs []string, header textproto.Header, body buffer.Buffer) error {
+	msgMeta := d.msgMeta.DeepCopy()
+	msgMeta.OriginalRcpts = nil
+	msgMeta.RcptFolders = nil
+
+	redir, err := d.t.redirectTo.Start(ctx, msgMeta, d.mailFrom)
+	if err != nil {
+		return fmt.Errorf("sieve: redirect: %w", err)
+	}
+	d.extra = append(d.extra, redir)
+
+	for _, addr := range addrs {
+		if err := redir.AddRcpt(ctx, addr); err != nil {
+			return fmt.Errorf("sieve: redirect: %w", err)
+		}
+	}
+	if err := redir.Body(ctx, header, body); err != nil {
+		return fmt.Errorf("sieve: redirect: %w", err)
+	}
+	return nil
+}
+
+func (d *delivery) deliveries() []module.Delivery {
+	all := make([]module.Delivery, 0, len(d.rcpts)+len(d.extra))
+	for _, rd := range d.rcpts {
+		if !rd.discarded {
+			all = append(all, rd.delivery)
+		}
+	}
+	return append(all, d.extra...)
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	var lastErr error
+	for _, inner := range d.deliveries() {
+		if err := inner.Abort(ctx); err != nil {
+			d.log.Error("delivery.Abort failed", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	var lastErr error
+	for _, inner := range d.deliveries() {
+		if err := inner.Commit(ctx); err != nil {
+			d.log.Error("delivery.Commit failed", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, scripts map[string]string) (*Target, *testutils.Target, *testutils.Target) {
+	t.Helper()
+	storage := &testutils.Target{}
+	redirect := &testutils.Target{}
+	return &Target{
+		deliverTo:    storage,
+		redirectTo:   redirect,
+		scriptsTable: testutils.Table{M: scripts},
+		maxRedirects: 4,
+		log:          testutils.Logger(t, modName),
+	}, storage, redirect
+}
+
+func checkFolder(t *testing.T, msg testutils.Msg, rcpt, folder string) {
+	t.Helper()
+	if got := msg.MsgMeta.RcptFolders[rcpt]; got != folder {
+		t.Errorf("wrong folder for %s: want %q, got %q", rcpt, folder, got)
+	}
+}
+
+func TestSieve_NoScript(t *testing.T) {
+	tgt, storage, _ := testTarget(t, nil)
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org", "b@example.org"})
+
+	if len(storage.Messages) != 2 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+	testutils.CheckTestMessage(t, storage, 0, "sender@example.org", []string{"a@example.org"})
+	testutils.CheckTestMessage(t, storage, 1, "sender@example.org", []string{"b@example.org"})
+	checkFolder(t, storage.Messages[0], "a@example.org", "")
+}
+
+func TestSieve_Fileinto(t *testing.T) {
+	tgt, storage, _ := testTarget(t, map[string]string{
+		"a@example.org": `require "fileinto";
+			if header :is "A" "1" { fileinto "Filtered"; }`,
+		"b@example.org": `require ["fileinto", "copy"];
+			fileinto :copy "Copy";`,
+	})
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org", "b@example.org"})
+
+	if len(storage.Messages) != 3 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+	testutils.CheckTestMessage(t, storage, 0, "sender@example.org", []string{"a@example.org"})
+	checkFolder(t, storage.Messages[0], "a@example.org", "Filtered")
+	testutils.CheckTestMessage(t, storage, 1, "sender@example.org", []string{"b@example.org"})
+	checkFolder(t, storage.Messages[1], "b@example.org", "")
+	testutils.CheckTestMessage(t, storage, 2, "sender@example.org", []string{"b@example.org"})
+	checkFolder(t, storage.Messages[2], "b@example.org", "Copy")
+}
+
+func TestSieve_Discard(t *testing.T) {
+	tgt, storage, _ := testTarget(t, map[string]string{
+		"a@example.org": `discard;`,
+	})
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org", "b@example.org"})
+
+	if len(storage.Messages) != 1 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+	testutils.CheckTestMessage(t, storage, 0, "sender@example.org", []string{"b@example.org"})
+}
+
+func TestSieve_Redirect(t *testing.T) {
+	tgt, storage, redirect := testTarget(t, map[string]string{
+		"a@example.org": `redirect "c@example.com";`,
+	})
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org"})
+
+	if len(storage.Messages) != 0 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+	if len(redirect.Messages) != 1 {
+		t.Fatal("wrong amount of messages redirected:", len(redirect.Messages))
+	}
+	testutils.CheckTestMessage(t, redirect, 0, "sender@example.org", []string{"c@example.com"})
+}
+
+func TestSieve_RedirectNotConfigured(t *testing.T) {
+	tgt, storage, _ := testTarget(t, map[string]string{
+		"a@example.org": `redirect "c@example.com";`,
+	})
+	tgt.redirectTo = nil
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org"})
+
+	if len(storage.Messages) != 1 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+}
+
+func TestSieve_BrokenScript(t *testing.T) {
+	tgt, storage, redirect := testTarget(t, map[string]string{
+		"a@example.org": `discard`,
+		"b@example.org": `redirect "c@example.com"; redirect "d@example.com";`,
+	})
+	tgt.maxRedirects = 1
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org", "b@example.org"})
+
+	if len(storage.Messages) != 2 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+	if len(redirect.Messages) != 0 {
+		t.Fatal("wrong amount of messages redirected:", len(redirect.Messages))
+	}
+}
+
+func TestSieve_ScriptsDir(t *testing.T) {
+	dir := testutils.Dir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a@example.org.sieve"), []byte("discard;"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt, storage, _ := testTarget(t, nil)
+	tgt.scriptsTable = nil
+	tgt.scriptsDir = dir
+	testutils.DoTestDelivery(t, tgt, "sender@example.org", []string{"a@example.org", "../b@example.org"})
+
+	if len(storage.Messages) != 1 {
+		t.Fatal("wrong amount of messages stored:", len(storage.Messages))
+	}
+	testutils.CheckTestMessage(t, storage, 0, "sender@example.org", []string{"../b@example.org"})
+}
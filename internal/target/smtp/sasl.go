@@ -64,6 +64,13 @@ func saslAuthDirective(m *config.Map, node config.Node) (interface{}, error) {
 		return func(*module.MsgMetadata) (sasl.Client, error) {
 			return sasl.NewPlainClient("", node.Args[1], node.Args[2]), nil
 		}, nil
+	case "login":
+		if len(node.Args) != 3 {
+			return nil, config.NodeErr(node, "two additional arguments are required (username, password)")
+		}
+		return func(*module.MsgMetadata) (sasl.Client, error) {
+			return sasl.NewLoginClient(node.Args[1], node.Args[2]), nil
+		}, nil
 	case "external":
 		if len(node.Args) > 1 {
 			return nil, config.NodeErr(node, "no additional arguments required")
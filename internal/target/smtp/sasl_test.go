@@ -21,6 +21,7 @@ package smtp_downstream
 import (
 	"testing"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
@@ -66,6 +67,46 @@ func TestSASL_Plain(t *testing.T) {
 	}
 }
 
+func TestSASL_Login(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, func(srv *smtp.Server) {
+		srv.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+			return sasl.NewLoginServer(func(username, password string) error {
+				state := conn.State()
+				session, err := srv.Backend.Login(&state, username, password)
+				if err != nil {
+					return err
+				}
+				conn.SetSession(session)
+				return nil
+			})
+		})
+	})
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory: testSaslFactory(t, "login", "test", "testpass"),
+		log:         testutils.Logger(t, "target.smtp"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].AuthUser != "test" {
+		t.Errorf("Wrong AuthUser: %v", be.Messages[0].AuthUser)
+	}
+	if be.Messages[0].AuthPass != "testpass" {
+		t.Errorf("Wrong AuthPass: %v", be.Messages[0].AuthPass)
+	}
+}
+
 func TestSASL_Plain_AuthFail(t *testing.T) {
 	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
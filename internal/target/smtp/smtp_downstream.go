@@ -24,15 +24,18 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 //
 // Interfaces implemented:
 // - module.DeliveryTarget
+// - module.PartialDelivery
 package smtp_downstream
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"runtime/trace"
+	"strconv"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -59,6 +62,8 @@ type Downstream struct {
 	endpoints       []config.Endpoint
 	saslFactory     saslClientFactory
 	tlsConfig       tls.Config
+	maxRcpts        int
+	pipelining      bool
 
 	log log.Logger
 }
@@ -84,7 +89,11 @@ func NewDownstream(modName, instName string, _, inlineArgs []string) (module.Mod
 }
 
 func (u *Downstream) Init(cfg *config.Map) error {
-	var targetsArg []string
+	var (
+		targetsArg []string
+		security   string
+		tlsVerify  bool
+	)
 	cfg.Bool("debug", true, false, &u.log.Debug)
 	cfg.Bool("require_tls", false, false, &u.requireTLS)
 	cfg.Bool("attempt_starttls", false, !u.lmtp, &u.attemptStartTLS)
@@ -96,11 +105,20 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &u.tlsConfig)
+	cfg.Enum("security", false, false, []string{"starttls", "tls", "plaintext"}, "", &security)
+	cfg.Bool("tls_verify", false, true, &tlsVerify)
+	cfg.Int("max_rcpts", false, false, 0, &u.maxRcpts)
+	cfg.Bool("pipelining", false, false, &u.pipelining)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	u.tlsConfig.InsecureSkipVerify = !tlsVerify
+	if u.maxRcpts < 0 {
+		return fmt.Errorf("%s: max_rcpts can't be negative", u.modName)
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	var err error
 	u.hostname, err = idna.ToASCII(u.hostname)
@@ -122,6 +140,30 @@ func (u *Downstream) Init(cfg *config.Map) error {
 		return fmt.Errorf("%s: at least one target endpoint is required", u.modName)
 	}
 
+	// security overrides attempt_starttls and require_tls and also the
+	// endpoint scheme.
+	switch security {
+	case "starttls":
+		u.attemptStartTLS = true
+		u.requireTLS = true
+	case "tls":
+		for i, endp := range u.endpoints {
+			if endp.Scheme == "tcp" {
+				u.endpoints[i].Scheme = "tls"
+				u.endpoints[i].Original = ""
+			}
+		}
+		u.requireTLS = true
+	case "plaintext":
+		for _, endp := range u.endpoints {
+			if endp.IsTLS() {
+				return fmt.Errorf("%s: security plaintext can't be used with TLS endpoint %v", u.modName, endp)
+			}
+		}
+		u.attemptStartTLS = false
+		u.requireTLS = false
+	}
+
 	return nil
 }
 
@@ -139,14 +181,27 @@ type delivery struct {
 
 	msgMeta  *module.MsgMetadata
 	mailFrom string
-	rcpts    []string
 
+	// Transactions used for the delivery, recipients are added to the last
+	// one. New transaction is started once the recipients limit is reached.
+	txns []*transaction
+
+	// Recipients queued to be sent at once if pipelining is enabled.
+	pending []string
+	// Recipients rejected by the server when pipelining is enabled, in
+	// order they were added.
+	rejected []rejectedRcpt
+}
+
+type transaction struct {
 	conn *smtpconn.C
+	// Recipients accepted by the server, as passed to AddRcpt.
+	rcpts []string
 }
 
-// lmtpDelivery implements module.PartialDelivery
-type lmtpDelivery struct {
-	*delivery
+type rejectedRcpt struct {
+	rcpt string
+	err  error
 }
 
 func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
@@ -158,23 +213,49 @@ func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mai
 		msgMeta:  msgMeta,
 		mailFrom: mailFrom,
 	}
-	if err := d.connect(ctx); err != nil {
+	if _, err := d.newTransaction(ctx); err != nil {
 		return nil, err
 	}
+	return d, nil
+}
 
-	if err := d.conn.Mail(ctx, mailFrom, msgMeta.SMTPOpts); err != nil {
-		d.conn.Close()
+// newTransaction opens a new connection and starts the transaction using it.
+func (d *delivery) newTransaction(ctx context.Context) (*transaction, error) {
+	conn, err := d.connect(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	if u.lmtp {
-		return &lmtpDelivery{delivery: d}, nil
+	if d.msgMeta.SMTPOpts.Size != 0 {
+		if err := checkSize(d.u.modName, conn, int(d.msgMeta.SMTPOpts.Size)); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
-	return d, nil
+	opts := d.msgMeta.SMTPOpts
+	if opts.RequireTLS {
+		if d.u.lmtp {
+			// LMTP is used for the final delivery, there is no next hop to
+			// enforce REQUIRETLS for.
+			opts.RequireTLS = false
+		} else if err := d.checkREQUIRETLS(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := conn.Mail(ctx, d.mailFrom, opts, d.msgMeta.DSN); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t := &transaction{conn: conn}
+	d.txns = append(d.txns, t)
+	return t, nil
 }
 
-func (d *delivery) connect(ctx context.Context) error {
+func (d *delivery) connect(ctx context.Context) (*smtpconn.C, error) {
 	// TODO: Review possibility of connection pooling here.
 	var lastErr error
 
@@ -213,88 +294,276 @@ func (d *delivery) connect(ctx context.Context) error {
 		break
 	}
 	if lastErr != nil {
-		return d.u.moduleError(lastErr)
+		return nil, d.u.moduleError(lastErr)
 	}
 
 	if d.u.saslFactory != nil {
 		saslClient, err := d.u.saslFactory(d.msgMeta)
 		if err != nil {
 			conn.Close()
-			return err
+			return nil, err
 		}
 
 		if err := conn.Client().Auth(saslClient); err != nil {
 			conn.Close()
-			return err
+			return nil, err
 		}
 	}
 
-	d.conn = conn
+	return conn, nil
+}
+
+// checkREQUIRETLS checks whether the connection is secure enough to relay
+// a message with REQUIRETLS (RFC 8689). Support for the extension itself
+// is checked by smtpconn.
+//
+// The error is temporary so the message will be retried if the downstream
+// server configuration is fixed and bounced eventually otherwise.
+func (d *delivery) checkREQUIRETLS(conn *smtpconn.C) error {
+	if _, ok := conn.Client().TLSConnectionState(); ok && !d.u.tlsConfig.InsecureSkipVerify {
+		return nil
+	}
+	return d.u.moduleError(&exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 30},
+		Message:      "TLS is not used or unauthenticated but required (REQUIRETLS)",
+		Misc: map[string]interface{}{
+			"downstream_server": conn.ServerName(),
+		},
+	})
+}
+
+// rcptLimit returns the max. amount of recipients in the transaction, zero
+// means no limit.
+func (d *delivery) rcptLimit(t *transaction) int {
+	limit := d.u.maxRcpts
+	if serverMax := t.conn.Limits().RcptMax; serverMax != 0 && (limit == 0 || serverMax < limit) {
+		limit = serverMax
+	}
+	return limit
+}
 
-	return nil
+// currentTransaction returns the transaction that has space for at least one
+// more recipient, starting a new one if necessary.
+func (d *delivery) currentTransaction(ctx context.Context) (*transaction, error) {
+	t := d.txns[len(d.txns)-1]
+	if limit := d.rcptLimit(t); limit != 0 && len(t.rcpts) >= limit {
+		d.log.DebugMsg("recipients limit reached, starting a new transaction", "limit", limit)
+		return d.newTransaction(ctx)
+	}
+	return t, nil
 }
 
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
-	err := d.conn.Rcpt(ctx, rcptTo)
+	if d.u.pipelining {
+		d.pending = append(d.pending, rcptTo)
+		return nil
+	}
 
+	t, err := d.currentTransaction(ctx)
 	if err != nil {
+		return err
+	}
+
+	if err := t.conn.Rcpt(ctx, rcptTo, d.msgMeta.RcptDSN(rcptTo)); err != nil {
 		return d.u.moduleError(err)
 	}
 
-	d.rcpts = append(d.rcpts, rcptTo)
+	t.rcpts = append(t.rcpts, rcptTo)
 	return nil
 }
 
-func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
-	r, err := body.Open()
-	if err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"target": d.u.modName})
+// flushRcpts sends queued recipients using pipelining.
+func (d *delivery) flushRcpts(ctx context.Context) {
+	for len(d.pending) != 0 {
+		t, err := d.currentTransaction(ctx)
+		if err != nil {
+			for _, rcpt := range d.pending {
+				d.rejected = append(d.rejected, rejectedRcpt{rcpt, err})
+			}
+			d.pending = nil
+			return
+		}
+
+		batch := d.pending
+		if limit := d.rcptLimit(t); limit != 0 && len(batch) > limit-len(t.rcpts) {
+			batch = batch[:limit-len(t.rcpts)]
+		}
+		d.pending = d.pending[len(batch):]
+
+		dsn := make([]module.DSNRcptOpts, len(batch))
+		for i, rcpt := range batch {
+			dsn[i] = d.msgMeta.RcptDSN(rcpt)
+		}
+		rcptErrs, err := t.conn.RcptPipelined(ctx, batch, dsn)
+		if err != nil {
+			// Connection is broken, there is no point in sending anything
+			// else.
+			for _, rcpt := range append(batch, d.pending...) {
+				d.rejected = append(d.rejected, rejectedRcpt{rcpt, d.u.moduleError(err)})
+			}
+			d.pending = nil
+			return
+		}
+		for i, rcpt := range batch {
+			if rcptErrs[i] != nil {
+				d.rejected = append(d.rejected, rejectedRcpt{rcpt, d.u.moduleError(rcptErrs[i])})
+				continue
+			}
+			t.rcpts = append(t.rcpts, rcpt)
+		}
 	}
+}
 
-	defer r.Close()
-	return d.u.moduleError(d.conn.Data(ctx, header, r))
+// checkSize checks the message size against the limit advertised by the
+// server using the SIZE extension (RFC 1870).
+func checkSize(modName string, conn *smtpconn.C, size int) error {
+	ok, param := conn.Client().Extension("SIZE")
+	if !ok || param == "" {
+		return nil
+	}
+	maxSize, err := strconv.Atoi(param)
+	if err != nil || maxSize <= 0 {
+		return nil
+	}
+	if size <= maxSize {
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+		Message:      "Message is too big for the downstream server",
+		TargetName:   modName,
+		Misc: map[string]interface{}{
+			"downstream_server": conn.ServerName(),
+			"size":              size,
+			"max_size":          maxSize,
+		},
+	}
+}
+
+func (d *delivery) checkBodySize(t *transaction, header textproto.Header, body buffer.Buffer) error {
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return d.u.moduleError(err)
+	}
+	return checkSize(d.u.modName, t.conn, hdrBlob.Len()+body.Len())
 }
 
-func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+// data sends the message using the transaction. statusCb is called for each
+// recipient in the transaction.
+func (d *delivery) data(ctx context.Context, t *transaction, header textproto.Header, body buffer.Buffer, statusCb func(rcpt string, err error)) {
+	setAll := func(err error) {
+		for _, rcpt := range t.rcpts {
+			statusCb(rcpt, err)
+		}
+	}
+
+	if err := d.checkBodySize(t, header, body); err != nil {
+		setAll(err)
+		return
+	}
+
 	r, err := body.Open()
 	if err != nil {
-		modErr := d.u.moduleError(err)
-		for _, rcpt := range d.rcpts {
-			sc.SetStatus(rcpt, modErr)
-		}
+		setAll(d.u.moduleError(err))
+		return
 	}
 	defer r.Close()
 
+	if !d.u.lmtp {
+		setAll(d.u.moduleError(t.conn.Data(ctx, header, r)))
+		return
+	}
+
+	// Statuses are reported in the order recipients were accepted. Use
+	// addresses as passed to AddRcpt, not as sent to the server (they may be
+	// converted to A-labels).
 	rcptIndx := 0
-	err = d.conn.LMTPData(ctx, header, r, func(rcpt string, err *smtp.SMTPError) {
-		if err == nil {
-			sc.SetStatus(rcpt, nil)
-		} else {
-			sc.SetStatus(rcpt, &exterrors.SMTPError{
-				Code:         err.Code,
-				EnhancedCode: exterrors.EnhancedCode(err.EnhancedCode),
-				Message:      err.Message,
-				TargetName:   d.u.modName,
-				Err:          err,
-			})
+	err = t.conn.LMTPData(ctx, header, r, func(_ string, err *smtp.SMTPError) {
+		if rcptIndx >= len(t.rcpts) {
+			return
 		}
+		rcpt := t.rcpts[rcptIndx]
 		rcptIndx++
+		if err == nil {
+			statusCb(rcpt, nil)
+			return
+		}
+		statusCb(rcpt, &exterrors.SMTPError{
+			Code:         err.Code,
+			EnhancedCode: exterrors.EnhancedCode(err.EnhancedCode),
+			Message:      err.Message,
+			TargetName:   d.u.modName,
+			Err:          err,
+		})
 	})
 	if err != nil {
 		modErr := d.u.moduleError(err)
-		for _, rcpt := range d.rcpts[rcptIndx:] {
-			sc.SetStatus(rcpt, modErr)
+		for _, rcpt := range t.rcpts[rcptIndx:] {
+			statusCb(rcpt, modErr)
+		}
+	}
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	d.flushRcpts(ctx)
+	if len(d.rejected) != 0 {
+		return d.rejected[0].err
+	}
+
+	for _, t := range d.txns {
+		if len(t.rcpts) == 0 {
+			continue
+		}
+
+		var firstErr error
+		d.data(ctx, t, header, body, func(_ string, err error) {
+			if firstErr == nil {
+				firstErr = err
+			}
+		})
+		if firstErr != nil {
+			return firstErr
 		}
 	}
+	return nil
+}
+
+// BodyNonAtomic implements module.PartialDelivery.
+//
+// Recipients rejected by the server when pipelining is used and per-recipient
+// LMTP replies are reported individually.
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	d.flushRcpts(ctx)
+	for _, rej := range d.rejected {
+		sc.SetStatus(rej.rcpt, rej.err)
+	}
+
+	for _, t := range d.txns {
+		if len(t.rcpts) == 0 {
+			continue
+		}
+		d.data(ctx, t, header, body, sc.SetStatus)
+	}
 }
 
 func (d *delivery) Abort(ctx context.Context) error {
-	d.conn.Close()
+	for _, t := range d.txns {
+		t.conn.Close()
+	}
 	return nil
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
-	return d.conn.Close()
+	var lastErr error
+	for _, t := range d.txns {
+		if err := t.conn.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
 func init() {
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp_downstream
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"math/rand"
@@ -30,6 +31,7 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -121,6 +123,108 @@ func (sc *statusCollector) SetStatus(rcptTo string, err error) {
 	(*sc)[rcptTo] = err
 }
 
+func TestDownstreamDelivery_MaxRcpts(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		maxRcpts: 2,
+		log:      testutils.Logger(t, "target.smtp"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{
+		"rcpt1@example.invalid", "rcpt2@example.invalid", "rcpt3@example.invalid",
+	})
+	if len(be.Messages) != 2 {
+		t.Fatal("Expected two transactions, got", len(be.Messages))
+	}
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.invalid", []string{"rcpt3@example.invalid"})
+}
+
+func TestDownstreamDelivery_LMTP_Pipelining(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, func(srv *smtp.Server) {
+		srv.LMTP = true
+	})
+	be.RcptErr = map[string]error{
+		"rcpt2@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+	be.LMTPDataErr = []error{
+		nil,
+		&smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+			Message:      "Mailbox full",
+		},
+	}
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		modName:    "target.lmtp",
+		lmtp:       true,
+		pipelining: true,
+		maxRcpts:   2,
+		log:        testutils.Logger(t, "target.lmtp"),
+	}
+
+	sc := make(statusCollector)
+
+	testutils.DoTestDeliveryNonAtomic(t, &sc, mod, "test@example.invalid", []string{
+		"rcpt1@example.invalid", "rcpt2@example.invalid", "rcpt3@example.invalid", "rcpt4@example.invalid",
+	})
+
+	// rcpt2 is rejected so rcpt3 takes its place in the first transaction.
+	if len(be.Messages) != 2 {
+		t.Fatal("Expected two transactions, got", len(be.Messages))
+	}
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt3@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.invalid", []string{"rcpt4@example.invalid"})
+
+	if len(sc) != 4 {
+		t.Fatal("Four statuses should be set, got", len(sc))
+	}
+	checkCode := func(rcpt string, code int) {
+		t.Helper()
+		var rcptErr *exterrors.SMTPError
+		if !errors.As(sc[rcpt], &rcptErr) {
+			t.Fatalf("Not SMTPError for %s: %T", rcpt, sc[rcpt])
+		}
+		if rcptErr.Code != code {
+			t.Fatalf("Wrong SMTP code for %s: %d", rcpt, rcptErr.Code)
+		}
+	}
+	if err := sc["rcpt1@example.invalid"]; err != nil {
+		t.Fatal("Unexpected error for rcpt1:", err)
+	}
+	checkCode("rcpt2@example.invalid", 550)
+	checkCode("rcpt3@example.invalid", 452)
+	if err := sc["rcpt4@example.invalid"]; err != nil {
+		t.Fatal("Unexpected error for rcpt4:", err)
+	}
+}
+
 func TestDownstreamDelivery_Fallback(t *testing.T) {
 	be, srv := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
 	defer srv.Close()
@@ -301,6 +405,144 @@ func TestDownstreamDelivery_RequireTLS_Fail(t *testing.T) {
 	}
 }
 
+func TestDownstreamDelivery_REQUIRETLS(t *testing.T) {
+	check := func(t *testing.T, tlsSrv, requireTLSExt bool, expectErr string) {
+		t.Helper()
+
+		var (
+			clientCfg *tls.Config
+			be        *testutils.SMTPBackend
+			srv       *smtp.Server
+		)
+		if tlsSrv {
+			clientCfg, be, srv = testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+		} else {
+			be, srv = testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+			clientCfg = &tls.Config{}
+		}
+		srv.EnableREQUIRETLS = requireTLSExt
+		defer srv.Close()
+		defer testutils.CheckSMTPConnLeak(t, srv)
+
+		mod := &Downstream{
+			hostname: "mx.example.invalid",
+			endpoints: []config.Endpoint{
+				{
+					Scheme: "tcp",
+					Host:   "127.0.0.1",
+					Port:   testPort,
+				},
+			},
+			tlsConfig:       *clientCfg.Clone(),
+			attemptStartTLS: true,
+			log:             testutils.Logger(t, "target.smtp"),
+		}
+
+		meta := &module.MsgMetadata{
+			SMTPOpts: smtp.MailOptions{RequireTLS: true},
+		}
+		if expectErr == "" {
+			testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, meta)
+			be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+			if !be.Messages[0].Opts.RequireTLS {
+				t.Error("REQUIRETLS is not used")
+			}
+			return
+		}
+
+		_, err := testutils.DoTestDeliveryErrMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, meta)
+		testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 7, 30}, expectErr)
+		if be.MailFromCounter != 0 {
+			t.Error("MAIL FROM is sent")
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		check(t, true, true, "")
+	})
+	t.Run("no TLS", func(t *testing.T) {
+		check(t, false, true, "TLS is not used or unauthenticated but required (REQUIRETLS)")
+	})
+	t.Run("no extension", func(t *testing.T) {
+		check(t, true, false, "REQUIRETLS is not supported by the server")
+	})
+}
+
+func TestDownstreamDelivery_SizeLimit(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, func(srv *smtp.Server) {
+		srv.MaxMessageBytes = 16
+	})
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "target.smtp"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("Not SMTPError: %T", err)
+	}
+	if smtpErr.Code != 552 {
+		t.Error("Wrong SMTP code:", smtpErr.Code)
+	}
+	if smtpErr.Misc["max_size"] != 16 {
+		t.Error("Limit is not checked before sending the message:", smtpErr.Misc)
+	}
+	if len(be.Messages) != 0 {
+		t.Error("DATA issued for the message exceeding SIZE limit")
+	}
+}
+
+func TestDownstreamDelivery_Security(t *testing.T) {
+	for _, mode := range []string{"starttls", "tls", "plaintext"} {
+		mod, err := NewDownstream("target.smtp", "", nil, []string{"tcp://127.0.0.1:" + testPort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "hostname", Args: []string{"mx.example.invalid"}},
+				{Name: "security", Args: []string{mode}},
+				{Name: "tls_verify", Args: []string{"no"}},
+			},
+		})); err != nil {
+			t.Fatal(mode, err)
+		}
+		tgt := mod.(*Downstream)
+
+		if !tgt.tlsConfig.InsecureSkipVerify {
+			t.Error(mode, "tls_verify no is ignored")
+		}
+		switch mode {
+		case "starttls":
+			if !tgt.attemptStartTLS || !tgt.requireTLS || tgt.endpoints[0].IsTLS() {
+				t.Error("Wrong settings for starttls")
+			}
+		case "tls":
+			if !tgt.endpoints[0].IsTLS() || !tgt.requireTLS {
+				t.Error("Wrong settings for tls")
+			}
+		case "plaintext":
+			if tgt.attemptStartTLS || tgt.requireTLS || tgt.endpoints[0].IsTLS() {
+				t.Error("Wrong settings for plaintext")
+			}
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -0,0 +1,205 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tenancy implements the mapping between accounts and sender domains
+// they are entitled to use.
+//
+// The mapping is stored in a module.Table, keys are account names and values
+// are lists of domains separated by commas or spaces, e.g.
+//
+//	alice@tenant-a.example: tenant-a.example, tenant-a.example.net
+//
+// Accounts without an entry are not allowed to use any domain.
+package tenancy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// PolicyName is included in error messages and log records to make it clear
+// which policy caused the rejection.
+const PolicyName = "tenant sending policy"
+
+var ErrNotListable = errors.New("tenancy: table does not support listing of keys")
+
+// Policy provides access to the tenancy mapping stored in the table.
+type Policy struct {
+	Table module.Table
+}
+
+type listableTable interface {
+	Keys() ([]string, error)
+}
+
+// Listable reports whether the underlying table supports enumeration of
+// accounts, which is required for Owners and SameTenant.
+func (p Policy) Listable() bool {
+	_, ok := p.Table.(listableTable)
+	return ok
+}
+
+// SplitDomains parses the table value into the list of normalized domains.
+// Malformed entries are skipped.
+func SplitDomains(val string) []string {
+	fields := strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	domains := make([]string, 0, len(fields))
+	for _, f := range fields {
+		norm, err := dns.ForLookup(strings.TrimPrefix(f, "@"))
+		if err != nil || norm == "" {
+			continue
+		}
+		domains = append(domains, norm)
+	}
+	return domains
+}
+
+// Domains returns the list of normalized domains the account is entitled to
+// use. ok is false if the account has no entry in the mapping.
+func (p Policy) Domains(account string) (domains []string, ok bool, err error) {
+	val, ok, err := p.Table.Lookup(account)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	return SplitDomains(val), true, nil
+}
+
+// Allowed checks whether the account is entitled to use the domain.
+func (p Policy) Allowed(account, domain string) (bool, error) {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return false, nil
+	}
+
+	domains, _, err := p.Domains(account)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range domains {
+		if d == normDomain {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Owners returns the list of accounts entitled to use the domain.
+func (p Policy) Owners(domain string) ([]string, error) {
+	lt, ok := p.Table.(listableTable)
+	if !ok {
+		return nil, ErrNotListable
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return nil, nil
+	}
+
+	accounts, err := lt.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var owners []string
+	for _, acct := range accounts {
+		domains, _, err := p.Domains(acct)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range domains {
+			if d == normDomain {
+				owners = append(owners, acct)
+				break
+			}
+		}
+	}
+	return owners, nil
+}
+
+// CrossTenant reports whether domains a and b are owned by different
+// tenants, that is, both have owners and no account is entitled to use
+// both of them.
+//
+// Domains not present in the mapping are not owned by any tenant.
+func (p Policy) CrossTenant(a, b string) (bool, error) {
+	normA, err := dns.ForLookup(a)
+	if err != nil {
+		return false, nil
+	}
+	normB, err := dns.ForLookup(b)
+	if err != nil {
+		return false, nil
+	}
+	if normA == normB {
+		return false, nil
+	}
+
+	ownersA, err := p.Owners(normA)
+	if err != nil {
+		return false, err
+	}
+	ownersB, err := p.Owners(normB)
+	if err != nil {
+		return false, err
+	}
+	if len(ownersA) == 0 || len(ownersB) == 0 {
+		return false, nil
+	}
+	for _, oa := range ownersA {
+		for _, ob := range ownersB {
+			if oa == ob {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// ViolationError returns the error that should be reported to the client if
+// the policy is violated.
+//
+// what describes the violation and is included in the error message, e.g.
+// "sender domain is not allowed for the account".
+func ViolationError(what string, fields map[string]interface{}) *exterrors.SMTPError {
+	misc := map[string]interface{}{"policy": "tenant"}
+	for k, v := range fields {
+		misc[k] = v
+	}
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Rejected by " + PolicyName + ": " + what,
+		Misc:         misc,
+	}
+}
+
+// LookupError wraps the error returned by the table so it is reported to
+// the client as a temporary failure.
+func LookupError(err error) *exterrors.SMTPError {
+	return &exterrors.SMTPError{
+		Code:         exterrors.SMTPCode(err, 451, 554),
+		EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 1}),
+		Message:      "Internal error during policy check",
+		Err:          err,
+		Misc:         map[string]interface{}{"policy": "tenant"},
+	}
+}
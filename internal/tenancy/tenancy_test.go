@@ -0,0 +1,121 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tenancy
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testPolicy() Policy {
+	return Policy{Table: testutils.Table{M: map[string]string{
+		"alice@a.example": "a.example, @a.example.net",
+		"admin@a.example": "a.example a.example.net shared.example",
+		"bob@b.example":   "B.EXAMPLE,shared.example",
+		"carol@c.example": "c.example",
+	}}}
+}
+
+func TestPolicy_Allowed(t *testing.T) {
+	p := testPolicy()
+	test := func(account, domain string, expected bool) {
+		t.Helper()
+		ok, err := p.Allowed(account, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Errorf("%s, %s: want %v, got %v", account, domain, expected, ok)
+		}
+	}
+
+	test("alice@a.example", "a.example", true)
+	test("alice@a.example", "A.Example.net", true)
+	test("alice@a.example", "b.example", false)
+	test("alice@a.example", "sub.a.example", false)
+	test("bob@b.example", "b.example", true)
+	test("unknown@a.example", "a.example", false)
+	test("alice@a.example", "", false)
+}
+
+func TestPolicy_Owners(t *testing.T) {
+	p := testPolicy()
+	owners, err := p.Owners("Shared.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(owners)
+	if !reflect.DeepEqual(owners, []string{"admin@a.example", "bob@b.example"}) {
+		t.Error("Wrong owners:", owners)
+	}
+
+	owners, err = p.Owners("unowned.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 0 {
+		t.Error("Wrong owners:", owners)
+	}
+}
+
+func TestPolicy_CrossTenant(t *testing.T) {
+	p := testPolicy()
+	test := func(a, b string, expected bool) {
+		t.Helper()
+		cross, err := p.CrossTenant(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cross != expected {
+			t.Errorf("%s, %s: want %v, got %v", a, b, expected, cross)
+		}
+	}
+
+	test("a.example", "a.example", false)
+	test("a.example", "a.example.net", false)
+	test("a.example", "b.example", true)
+	test("c.example", "b.example", true)
+	// Shared by admin@a.example and bob@b.example.
+	test("a.example", "shared.example", false)
+	test("b.example", "shared.example", false)
+	test("c.example", "shared.example", true)
+	// Domains without owners are not part of any tenant.
+	test("a.example", "external.example", false)
+	test("external.example", "b.example", false)
+}
+
+func TestPolicy_NotListable(t *testing.T) {
+	p := Policy{Table: lookupOnly{}}
+	if p.Listable() {
+		t.Fatal("Listable should be false")
+	}
+	if _, err := p.CrossTenant("a.example", "b.example"); !errors.Is(err, ErrNotListable) {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+type lookupOnly struct{}
+
+func (lookupOnly) Lookup(string) (string, bool, error) {
+	return "", false, nil
+}
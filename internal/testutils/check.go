@@ -41,9 +41,15 @@ type Check struct {
 	RcptCalls   int
 	BodyCalls   int
 
+	ConnOpenedCalls int
+	ConnClosedCalls int
+
 	UnclosedStates int
 
 	InstName string
+
+	// Cacheable is returned by CacheResults.
+	Cacheable bool
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
@@ -74,6 +80,18 @@ func (c *Check) CheckConnection(ctx context.Context, state *smtp.ConnectionState
 	return c.EarlyErr
 }
 
+func (c *Check) ConnOpened(ctx context.Context, conn *module.ConnState) {
+	c.ConnOpenedCalls++
+}
+
+func (c *Check) ConnClosed(conn *module.ConnState) {
+	c.ConnClosedCalls++
+}
+
+func (c *Check) CacheResults() bool {
+	return c.Cacheable
+}
+
 type checkState struct {
 	msgMeta *module.MsgMetadata
 	check   *Check
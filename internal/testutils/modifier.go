@@ -36,8 +36,10 @@ type Modifier struct {
 	BodyErr     error
 
 	MailFrom map[string]string
-	RcptTo   map[string]string
+	RcptTo   map[string][]string
 	AddHdr   textproto.Header
+	SealHdr  textproto.Header
+	NewBody  []byte
 
 	UnclosedStates int
 }
@@ -82,20 +84,20 @@ func (ms modifierState) RewriteSender(ctx context.Context, mailFrom string) (str
 	return mailFrom, nil
 }
 
-func (ms modifierState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+func (ms modifierState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
 	if ms.m.RcptToErr != nil {
-		return "", ms.m.RcptToErr
+		return nil, ms.m.RcptToErr
 	}
 
 	if ms.m.RcptTo == nil {
-		return rcptTo, nil
+		return []string{rcptTo}, nil
 	}
 
 	newRcptTo, ok := ms.m.RcptTo[rcptTo]
 	if ok {
 		return newRcptTo, nil
 	}
-	return rcptTo, nil
+	return []string{rcptTo}, nil
 }
 
 func (ms modifierState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -109,6 +111,20 @@ func (ms modifierState) RewriteBody(ctx context.Context, h *textproto.Header, bo
 	return nil
 }
 
+func (ms modifierState) SealBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	for field := ms.m.SealHdr.Fields(); field.Next(); {
+		h.Add(field.Key(), field.Value())
+	}
+	return nil
+}
+
+func (ms modifierState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if ms.m.NewBody == nil {
+		return nil, nil
+	}
+	return buffer.MemoryBuffer{Slice: ms.m.NewBody}, nil
+}
+
 func (ms modifierState) Close() error {
 	ms.m.UnclosedStates--
 	return nil
@@ -135,7 +135,7 @@ func (s *session) Mail(from string, opts smtp.MailOptions) error {
 	return nil
 }
 
-func (s *session) Rcpt(to string) error {
+func (s *session) Rcpt(to string, opts smtp.RcptOptions) error {
 	if err := s.backend.RcptErr[to]; err != nil {
 		return err
 	}
@@ -27,3 +27,11 @@ func (m Table) Lookup(a string) (string, bool, error) {
 	b, ok := m.M[a]
 	return b, ok, m.Err
 }
+
+func (m Table) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, m.Err
+}
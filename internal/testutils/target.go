@@ -199,6 +199,11 @@ func DoTestDeliveryMeta(t *testing.T, tgt module.DeliveryTarget, from string, to
 
 func DoTestDeliveryNonAtomic(t *testing.T, c module.StatusCollector, tgt module.DeliveryTarget, from string, to []string) string {
 	t.Helper()
+	return DoTestDeliveryNonAtomicMeta(t, c, tgt, from, to, &module.MsgMetadata{})
+}
+
+func DoTestDeliveryNonAtomicMeta(t *testing.T, c module.StatusCollector, tgt module.DeliveryTarget, from string, to []string, msgMeta *module.MsgMetadata) string {
+	t.Helper()
 
 	IDRaw := sha1.Sum([]byte(t.Name()))
 	encodedID := hex.EncodeToString(IDRaw[:])
@@ -206,13 +211,11 @@ func DoTestDeliveryNonAtomic(t *testing.T, c module.StatusCollector, tgt module.
 	testCtx := context.Background()
 
 	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
-	msgMeta := module.MsgMetadata{
-		DontTraceSender: true,
-		ID:              encodedID,
-		OriginalFrom:    from,
-	}
+	msgMeta.DontTraceSender = true
+	msgMeta.ID = encodedID
+	msgMeta.OriginalFrom = from
 	t.Log("-- tgt.Start", from)
-	delivery, err := tgt.Start(testCtx, &msgMeta, from)
+	delivery, err := tgt.Start(testCtx, msgMeta, from)
 	if err != nil {
 		t.Log("-- ... tgt.Start", from, err, exterrors.Fields(err))
 		t.Fatalf("Unexpected err: %v %+v", err, exterrors.Fields(err))
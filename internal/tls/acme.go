@@ -0,0 +1,454 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tls
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeMinRetry = time.Minute
+	acmeMaxRetry = 12 * time.Hour
+)
+
+// ACMELoader obtains certificates from an ACME CA (e.g. Let's Encrypt) and
+// keeps them renewed.
+//
+// Issuance happens in a background goroutine so server startup is not
+// blocked on CA availability. Until the first certificate is obtained (or
+// loaded from store_path), LoadCerts returns an error and TLS handshakes
+// fail.
+type ACMELoader struct {
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	hostnames   []string
+	email       string
+	agreed      bool
+	caURL       string
+	challenge   string
+	dnsProvider acmeDNSProvider
+	propDelay   time.Duration
+	alpnListen  string
+	keyType     string
+	renewBefore time.Duration
+	storePath   string
+
+	client *acme.Client
+
+	cert     *tls.Certificate
+	certLock sync.RWMutex
+
+	stop     context.CancelFunc
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func NewACMELoader(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &ACMELoader{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: "tls.loader.acme", Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (l *ACMELoader) Init(cfg *config.Map) error {
+	var hostname string
+	cfg.Bool("debug", true, false, &l.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("hostnames", false, false, nil, &l.hostnames)
+	cfg.String("email", false, false, "", &l.email)
+	cfg.Bool("agreed", false, false, &l.agreed)
+	cfg.String("ca", false, false, acme.LetsEncryptURL, &l.caURL)
+	cfg.Enum("challenge", false, false, []string{"dns-01", "tls-alpn-01"}, "tls-alpn-01", &l.challenge)
+	cfg.Custom("dns", false, false, nil, acmeDNSProviderDirective, &l.dnsProvider)
+	cfg.Duration("propagation_delay", false, false, 10*time.Second, &l.propDelay)
+	cfg.String("alpn_listen", false, false, "tcp://0.0.0.0:443", &l.alpnListen)
+	cfg.Enum("key_type", false, false, []string{"ecdsa", "rsa"}, "ecdsa", &l.keyType)
+	cfg.Duration("renew_before", false, false, 30*24*time.Hour, &l.renewBefore)
+	cfg.String("store_path", false, false, "", &l.storePath)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	l.hostnames = append(l.hostnames, l.inlineArgs...)
+	if len(l.hostnames) == 0 && hostname != "" {
+		l.hostnames = []string{hostname}
+	}
+	if len(l.hostnames) == 0 {
+		return errors.New("tls.loader.acme: at least one hostname is required")
+	}
+	for i, name := range l.hostnames {
+		normName, err := dns.ForLookup(name)
+		if err != nil {
+			return fmt.Errorf("tls.loader.acme: invalid hostname %s: %v", name, err)
+		}
+		l.hostnames[i], err = dns.SelectIDNA(false, normName)
+		if err != nil {
+			return fmt.Errorf("tls.loader.acme: invalid hostname %s: %v", name, err)
+		}
+	}
+
+	if !l.agreed {
+		return errors.New("tls.loader.acme: CA terms of service should be accepted using 'agreed' directive")
+	}
+	if l.challenge == "dns-01" && l.dnsProvider == nil {
+		return errors.New("tls.loader.acme: 'dns' directive is required for dns-01 challenge")
+	}
+	if l.challenge == "tls-alpn-01" {
+		for _, name := range l.hostnames {
+			if strings.HasPrefix(name, "*.") {
+				return fmt.Errorf("tls.loader.acme: wildcard name %s requires dns-01 challenge", name)
+			}
+		}
+		if _, err := config.ParseEndpoint(l.alpnListen); err != nil {
+			return fmt.Errorf("tls.loader.acme: alpn_listen: %v", err)
+		}
+	}
+
+	if l.storePath == "" {
+		instName := l.instName
+		if instName == "" {
+			instName = "default"
+		}
+		l.storePath = filepath.Join(config.StateDirectory, "acme", instName)
+	}
+	if config.CheckOnly {
+		return nil
+	}
+	if err := os.MkdirAll(l.storePath, 0o700); err != nil {
+		return fmt.Errorf("tls.loader.acme: %v", err)
+	}
+
+	accountKey, err := acmeLoadAccountKey(l.storePath)
+	if err != nil {
+		return fmt.Errorf("tls.loader.acme: %v", err)
+	}
+	l.client = &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: l.caURL,
+		UserAgent:    "maddy",
+	}
+
+	cert, err := acmeLoadCert(l.storePath)
+	switch {
+	case err == nil:
+		l.cert = cert
+		l.log.Msg("loaded stored certificate", "not_after", cert.Leaf.NotAfter)
+	case os.IsNotExist(err):
+	default:
+		l.log.Error("failed to load stored certificate, a new one will be requested", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.stop = cancel
+	l.stopped = make(chan struct{})
+	go l.renewLoop(ctx)
+
+	return nil
+}
+
+func (l *ACMELoader) Close() error {
+	l.stopOnce.Do(func() {
+		if l.stop != nil {
+			l.stop()
+			<-l.stopped
+		}
+	})
+	return nil
+}
+
+func (l *ACMELoader) Name() string {
+	return "tls.loader.acme"
+}
+
+func (l *ACMELoader) InstanceName() string {
+	return l.instName
+}
+
+func (l *ACMELoader) LoadCerts() ([]tls.Certificate, error) {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+	if l.cert == nil {
+		return nil, errors.New("tls.loader.acme: certificate is not obtained yet")
+	}
+	return []tls.Certificate{*l.cert}, nil
+}
+
+func (l *ACMELoader) currentCert() *tls.Certificate {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+	return l.cert
+}
+
+// acmeRenewTime returns the time when the certificate should be renewed.
+//
+// If renewBefore is larger than the certificate lifetime (e.g. short-lived
+// certificates from a test CA), renewal is scheduled after 2/3 of the
+// lifetime.
+func acmeRenewTime(leaf *x509.Certificate, renewBefore time.Duration) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	if renewBefore >= lifetime {
+		return leaf.NotBefore.Add(lifetime * 2 / 3)
+	}
+	return leaf.NotAfter.Add(-renewBefore)
+}
+
+// acmeRetryDelay returns the delay before the next attempt after the
+// specified amount of consecutive failures.
+func acmeRetryDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := acmeMinRetry
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= acmeMaxRetry {
+			return acmeMaxRetry
+		}
+	}
+	return delay
+}
+
+// acmeCertCovers reports whether the certificate is valid for all names.
+func acmeCertCovers(leaf *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if err := leaf.VerifyHostname(name); err != nil {
+			// VerifyHostname does not match wildcard names against
+			// themselves.
+			found := false
+			for _, dnsName := range leaf.DNSNames {
+				if strings.EqualFold(dnsName, name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (l *ACMELoader) renewLoop(ctx context.Context) {
+	defer close(l.stopped)
+
+	failures := 0
+	for {
+		var wait time.Duration
+		cert := l.currentCert()
+		switch {
+		case failures != 0:
+			wait = acmeRetryDelay(failures)
+		case cert == nil:
+		case !acmeCertCovers(cert.Leaf, l.hostnames):
+			l.log.Msg("stored certificate does not cover all configured hostnames, requesting a new one")
+		default:
+			wait = time.Until(acmeRenewTime(cert.Leaf, l.renewBefore))
+			l.log.DebugMsg("renewal scheduled", "renew_at", time.Now().Add(wait))
+		}
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		if err := l.obtainCert(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			if cert != nil {
+				l.log.Error("certificate renewal failed", err,
+					"expires_in", time.Until(cert.Leaf.NotAfter).Round(time.Minute).String(),
+					"retry_in", acmeRetryDelay(failures).String())
+			} else {
+				l.log.Error("failed to obtain certificate", err,
+					"retry_in", acmeRetryDelay(failures).String())
+			}
+			continue
+		}
+		failures = 0
+	}
+}
+
+func (l *ACMELoader) obtainCert(ctx context.Context) error {
+	l.log.Msg("requesting certificate", "hostnames", l.hostnames, "challenge", l.challenge)
+
+	acct := &acme.Account{}
+	if l.email != "" {
+		acct.Contact = []string{"mailto:" + l.email}
+	}
+	if _, err := l.client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("account registration: %w", err)
+	}
+
+	order, err := l.client.AuthorizeOrder(ctx, acme.DomainIDs(l.hostnames...))
+	if err != nil {
+		return fmt.Errorf("order creation: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := l.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+
+	order, err = l.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("order: %w", err)
+	}
+
+	key, err := acmeGenerateKey(l.keyType)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: l.hostnames,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	der, _, err := l.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("order finalization: %w", err)
+	}
+
+	if err := acmeStoreCert(l.storePath, der, key); err != nil {
+		return err
+	}
+	cert, err := acmeLoadCert(l.storePath)
+	if err != nil {
+		return err
+	}
+
+	l.certLock.Lock()
+	l.cert = cert
+	l.certLock.Unlock()
+
+	l.log.Msg("certificate obtained", "hostnames", l.hostnames, "not_after", cert.Leaf.NotAfter)
+	return nil
+}
+
+func (l *ACMELoader) authorize(ctx context.Context, authzURL string) error {
+	authz, err := l.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == l.challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("authorization: %s challenge is not offered for %s", l.challenge, authz.Identifier.Value)
+	}
+
+	var cleanup func()
+	switch l.challenge {
+	case "dns-01":
+		cleanup, err = l.solveDNS01(ctx, authz.Identifier.Value, chal)
+	case "tls-alpn-01":
+		cleanup, err = l.solveTLSALPN01(authz.Identifier.Value, chal)
+	}
+	if err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", l.challenge, authz.Identifier.Value, err)
+	}
+	defer cleanup()
+
+	if _, err := l.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", l.challenge, authz.Identifier.Value, err)
+	}
+	if _, err := l.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", l.challenge, authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+func (l *ACMELoader) solveDNS01(ctx context.Context, domain string, chal *acme.Challenge) (func(), error) {
+	value, err := l.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return nil, err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+
+	if err := l.dnsProvider.Present(ctx, fqdn, value); err != nil {
+		return nil, err
+	}
+	l.log.DebugMsg("DNS record created, waiting for propagation", "fqdn", fqdn, "delay", l.propDelay)
+
+	cleanup := func() {
+		if err := l.dnsProvider.CleanUp(context.Background(), fqdn, value); err != nil {
+			l.log.Error("failed to remove challenge record", err, "fqdn", fqdn)
+		}
+	}
+
+	timer := time.NewTimer(l.propDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		cleanup()
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	return cleanup, nil
+}
+
+func acmeGenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		return rsaGenerateKey()
+	default:
+		return ecdsaGenerateKey()
+	}
+}
+
+func init() {
+	module.Register("tls.loader.acme", NewACMELoader)
+}
@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tls
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"golang.org/x/crypto/acme"
+)
+
+// solveTLSALPN01 starts a temporary listener on alpn_listen that serves
+// the tls-alpn-01 challenge certificate. The returned function stops it.
+//
+// The listener is bound only while the challenge is being solved.
+func (l *ACMELoader) solveTLSALPN01(domain string, chal *acme.Challenge) (func(), error) {
+	cert, err := l.client.TLSALPN01ChallengeCert(chal.Token, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	endp, err := config.ParseEndpoint(l.alpnListen)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(endp.Network(), endp.Address())
+	if err != nil {
+		return nil, err
+	}
+	tlsLn := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{acme.ALPNProto},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := tlsLn.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+					return
+				}
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					l.log.DebugMsg("tls-alpn-01 handshake failed", "src_ip", conn.RemoteAddr(), "reason", err)
+				}
+			}()
+		}
+	}()
+
+	return func() {
+		tlsLn.Close()
+		wg.Wait()
+	}, nil
+}
@@ -0,0 +1,236 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/miekg/dns"
+)
+
+// acmeDNSProvider manages TXT records used to solve dns-01 challenges.
+//
+// fqdn is always fully qualified (has a trailing dot), value is the
+// record contents as expected by the CA.
+type acmeDNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// acmeDNSProviderDirective parses the dns directive of tls.loader.acme:
+//
+//	dns rfc2136 {
+//	    server <address>
+//	    key_name <name>
+//	    key_alg <algorithm>
+//	    key <base64 secret>
+//	    ttl <duration>
+//	}
+//
+//	dns exec <executable> [args...]
+func acmeDNSProviderDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "provider name is required")
+	}
+
+	switch node.Args[0] {
+	case "rfc2136":
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "unexpected arguments for rfc2136 provider")
+		}
+		return parseRFC2136Provider(node)
+	case "exec":
+		if len(node.Args) < 2 {
+			return nil, config.NodeErr(node, "executable path is required")
+		}
+		if len(node.Children) != 0 {
+			return nil, config.NodeErr(node, "exec provider does not accept a configuration block")
+		}
+		return &execDNSProvider{
+			path: node.Args[1],
+			args: node.Args[2:],
+		}, nil
+	default:
+		return nil, config.NodeErr(node, "unknown DNS provider: %s", node.Args[0])
+	}
+}
+
+var rfc2136Algs = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// rfc2136Provider creates records using DNS UPDATE (RFC 2136) messages
+// optionally authenticated using TSIG (RFC 2845).
+type rfc2136Provider struct {
+	server  string
+	keyName string
+	keyAlg  string
+	key     string
+	ttl     time.Duration
+}
+
+func parseRFC2136Provider(node config.Node) (*rfc2136Provider, error) {
+	p := &rfc2136Provider{}
+	var keyAlg string
+
+	cfg := config.NewMap(nil, node)
+	cfg.String("server", false, true, "", &p.server)
+	cfg.String("key_name", false, false, "", &p.keyName)
+	cfg.Enum("key_alg", false, false, []string{"hmac-sha1", "hmac-sha256", "hmac-sha512"}, "hmac-sha256", &keyAlg)
+	cfg.String("key", false, false, "", &p.key)
+	cfg.Duration("ttl", false, false, time.Minute, &p.ttl)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if (p.keyName == "") != (p.key == "") {
+		return nil, config.NodeErr(node, "key_name and key should be specified together")
+	}
+	if p.keyName != "" {
+		p.keyName = dns.Fqdn(p.keyName)
+	}
+	p.keyAlg = rfc2136Algs[keyAlg]
+	if _, _, err := net.SplitHostPort(p.server); err != nil {
+		p.server = net.JoinHostPort(p.server, "53")
+	}
+
+	return p, nil
+}
+
+func (p *rfc2136Provider) client() *dns.Client {
+	c := &dns.Client{Net: "tcp", Timeout: 30 * time.Second}
+	if p.keyName != "" {
+		c.TsigSecret = map[string]string{p.keyName: p.key}
+	}
+	return c
+}
+
+// findZone returns the name of the zone containing fqdn by looking up the
+// closest SOA record on the configured server.
+func (p *rfc2136Provider) findZone(ctx context.Context, fqdn string) (string, error) {
+	c := p.client()
+	for name := fqdn; name != ""; {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeSOA)
+		resp, _, err := c.ExchangeContext(ctx, msg, p.server)
+		if err != nil {
+			return "", err
+		}
+		for _, rr := range resp.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, name) {
+				return soa.Hdr.Name, nil
+			}
+		}
+
+		i := strings.Index(name, ".")
+		if i == -1 || i == len(name)-1 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return "", fmt.Errorf("rfc2136: no zone found for %s", fqdn)
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, remove bool) error {
+	zone, err := p.findZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(p.ttl / time.Second),
+		},
+		Txt: []string{value},
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(zone)
+	if remove {
+		msg.Remove([]dns.RR{rr})
+	} else {
+		msg.Insert([]dns.RR{rr})
+	}
+	if p.keyName != "" {
+		msg.SetTsig(p.keyName, p.keyAlg, 300, time.Now().Unix())
+	}
+
+	resp, _, err := p.client().ExchangeContext(ctx, msg, p.server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: update rejected: %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+// execDNSProvider delegates record management to an external executable.
+//
+// It is invoked as 'executable [args...] present|cleanup <fqdn> <value>'
+// and should exit with non-zero status on failure.
+type execDNSProvider struct {
+	path string
+	args []string
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	args := append(append([]string(nil), p.args...), action, fqdn, value)
+	cmd := exec.CommandContext(ctx, p.path, args...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("exec: %s %s failed: %v: %s", p.path, action, err, strings.TrimSpace(output.String()))
+		}
+		return fmt.Errorf("exec: %v", err)
+	}
+	return nil
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
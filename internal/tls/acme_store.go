@@ -0,0 +1,164 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Files stored in the ACME loader store_path.
+const (
+	acmeAccountKeyFile = "account.key"
+	acmeCertFile       = "cert.pem"
+	acmeKeyFile        = "cert.key"
+)
+
+func ecdsaGenerateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func rsaGenerateKey() (crypto.Signer, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// then renames it to path so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// acmeLoadAccountKey reads the ACME account key from dir, generating and
+// saving a new one if it does not exist yet.
+func acmeLoadAccountKey(dir string) (crypto.Signer, error) {
+	path := filepath.Join(dir, acmeAccountKeyFile)
+
+	blob, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(blob)
+		if block == nil {
+			return nil, errors.New("malformed account key: no PEM block")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("malformed account key: unsupported key type")
+		}
+		return signer, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsaGenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	blob, err = encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, blob, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeStoreCert saves the certificate chain and the corresponding private
+// key to dir.
+func acmeStoreCert(dir string, chain [][]byte, key crypto.Signer) error {
+	if len(chain) == 0 {
+		return errors.New("empty certificate chain")
+	}
+
+	var certPEM bytes.Buffer
+	for _, der := range chain {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return err
+		}
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Key goes first: if we fail between renames, the old certificate
+	// will not match the new key and will be rejected on load, causing
+	// a new one to be requested.
+	if err := writeFileAtomic(filepath.Join(dir, acmeKeyFile), keyPEM, 0o600); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, acmeCertFile), certPEM.Bytes(), 0o644)
+}
+
+// acmeLoadCert reads the certificate stored by acmeStoreCert. The Leaf
+// field of the returned certificate is always populated.
+func acmeLoadCert(dir string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, acmeCertFile), filepath.Join(dir, acmeKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
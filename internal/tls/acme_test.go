@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tls
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACMEStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-acme-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := acmeLoadCert(dir); !os.IsNotExist(err) {
+		t.Fatal("Expected not exist error for empty store, got", err)
+	}
+
+	certPath, keyPath := writeTestCert(t, dir, "mx.example.org")
+	orig, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := acmeStoreCert(dir, orig.Certificate, orig.PrivateKey.(crypto.Signer)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := acmeLoadCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Certificate, orig.Certificate) {
+		t.Error("Certificate chain mismatch after roundtrip")
+	}
+	if loaded.Leaf == nil || loaded.Leaf.DNSNames[0] != "mx.example.org" {
+		t.Error("Leaf is not populated")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, acmeKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Wrong key file permissions: %v", info.Mode().Perm())
+	}
+}
+
+func TestACMEAccountKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-acme-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1, err := acmeLoadAccountKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := acmeLoadAccountKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(key1.Public(), key2.Public()) {
+		t.Fatal("Account key is not persisted")
+	}
+}
+
+func TestACMERenewTime(t *testing.T) {
+	now := time.Now()
+	leaf := &x509.Certificate{
+		NotBefore: now,
+		NotAfter:  now.Add(90 * 24 * time.Hour),
+	}
+
+	if renew := acmeRenewTime(leaf, 30*24*time.Hour); !renew.Equal(now.Add(60 * 24 * time.Hour)) {
+		t.Error("Wrong renewal time:", renew)
+	}
+
+	// Short-lived certificate, renew_before is too large.
+	leaf.NotAfter = now.Add(24 * time.Hour)
+	if renew := acmeRenewTime(leaf, 30*24*time.Hour); !renew.Equal(now.Add(16 * time.Hour)) {
+		t.Error("Wrong renewal time for short-lived certificate:", renew)
+	}
+}
+
+func TestACMERetryDelay(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		0:   0,
+		1:   time.Minute,
+		2:   2 * time.Minute,
+		5:   16 * time.Minute,
+		10:  512 * time.Minute,
+		11:  acmeMaxRetry,
+		100: acmeMaxRetry,
+	} {
+		if delay := acmeRetryDelay(failures); delay != expected {
+			t.Errorf("acmeRetryDelay(%d) = %v, want %v", failures, delay, expected)
+		}
+	}
+}
+
+func TestACMECertCovers(t *testing.T) {
+	leaf := &x509.Certificate{DNSNames: []string{"mx.example.org", "*.example.com"}}
+
+	if !acmeCertCovers(leaf, []string{"mx.example.org"}) {
+		t.Error("Exact name is not covered")
+	}
+	if !acmeCertCovers(leaf, []string{"*.example.com", "mail.example.com"}) {
+		t.Error("Wildcard name is not covered")
+	}
+	if acmeCertCovers(leaf, []string{"mx.example.org", "mx2.example.org"}) {
+		t.Error("Missing name is covered")
+	}
+}
+
+func TestACMEExecDNSProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-acme-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "log")
+	script := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+
+		"echo \"$@\" >> "+logPath+"\n"+
+		"[ \"$2\" != fail ] || { echo 'no such zone' >&2; exit 1; }\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &execDNSProvider{path: script, args: []string{"extra"}}
+	if err := p.Present(context.Background(), "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp(context.Background(), "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "extra present _acme-challenge.example.org. value\n" +
+		"extra cleanup _acme-challenge.example.org. value\n"
+	if string(log) != expected {
+		t.Errorf("Wrong hook invocations:\n%s\nwant:\n%s", log, expected)
+	}
+
+	p = &execDNSProvider{path: script}
+	err = p.Present(context.Background(), "fail", "value")
+	if err == nil {
+		t.Fatal("Expected an error for failing hook")
+	}
+	if !strings.Contains(err.Error(), "no such zone") {
+		t.Error("Hook output is not included in the error:", err)
+	}
+}
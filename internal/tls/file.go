@@ -22,6 +22,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
 	"time"
@@ -35,13 +36,19 @@ import (
 type FileLoader struct {
 	instName   string
 	inlineArgs []string
-	certPaths  []string
-	keyPaths   []string
 	log        log.Logger
 
+	// Paths can be changed on reload, protected by certsLock.
+	certPaths []string
+	keyPaths  []string
+
 	certs     []tls.Certificate
 	certsLock sync.RWMutex
 
+	// Modification times of certificate and key files as of the last
+	// successful load. Protected by certsLock.
+	modTimes map[string]time.Time
+
 	reloadTick *time.Ticker
 	stopTick   chan struct{}
 }
@@ -56,33 +63,18 @@ func NewFileLoader(_, instName string, _, inlineArgs []string) (module.Module, e
 }
 
 func (f *FileLoader) Init(cfg *config.Map) error {
-	cfg.StringList("certs", false, false, nil, &f.certPaths)
-	cfg.StringList("keys", false, false, nil, &f.keyPaths)
-	if _, err := cfg.Process(); err != nil {
+	var err error
+	f.certPaths, f.keyPaths, err = f.readConfig(cfg)
+	if err != nil {
 		return err
 	}
 
-	if len(f.certPaths) != len(f.keyPaths) {
-		return errors.New("tls.loader.file: mismatch in certs and keys count")
-	}
-
-	if len(f.inlineArgs)%2 != 0 {
-		return errors.New("tls.loader.file: odd amount of arguments")
-	}
-	for i := 0; i < len(f.inlineArgs); i += 2 {
-		f.certPaths = append(f.certPaths, f.inlineArgs[i])
-		f.keyPaths = append(f.keyPaths, f.inlineArgs[i+1])
-	}
-
-	for _, certPath := range f.certPaths {
-		if !filepath.IsAbs(certPath) {
-			return fmt.Errorf("tls.loader.file: only absolute paths allowed in certificate paths: sorry :(")
-		}
-	}
-
 	if err := f.loadCerts(); err != nil {
 		return err
 	}
+	if config.CheckOnly {
+		return nil
+	}
 
 	hooks.AddHook(hooks.EventReload, func() {
 		f.log.Println("reloading certificates")
@@ -96,6 +88,55 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 	return nil
 }
 
+// Reload implements module.ReloadModule.
+func (f *FileLoader) Reload(cfg *config.Map) (func(), error) {
+	certPaths, keyPaths, err := f.readConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	certs, modTimes, err := loadFiles(certPaths, keyPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		f.certsLock.Lock()
+		defer f.certsLock.Unlock()
+		f.certPaths = certPaths
+		f.keyPaths = keyPaths
+		f.certs = certs
+		f.modTimes = modTimes
+	}, nil
+}
+
+func (f *FileLoader) readConfig(cfg *config.Map) (certPaths, keyPaths []string, err error) {
+	cfg.StringList("certs", false, false, nil, &certPaths)
+	cfg.StringList("keys", false, false, nil, &keyPaths)
+	if _, err := cfg.Process(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(certPaths) != len(keyPaths) {
+		return nil, nil, errors.New("tls.loader.file: mismatch in certs and keys count")
+	}
+
+	if len(f.inlineArgs)%2 != 0 {
+		return nil, nil, errors.New("tls.loader.file: odd amount of arguments")
+	}
+	for i := 0; i < len(f.inlineArgs); i += 2 {
+		certPaths = append(certPaths, f.inlineArgs[i])
+		keyPaths = append(keyPaths, f.inlineArgs[i+1])
+	}
+
+	for _, certPath := range certPaths {
+		if !filepath.IsAbs(certPath) {
+			return nil, nil, fmt.Errorf("tls.loader.file: only absolute paths allowed in certificate paths: sorry :(")
+		}
+	}
+
+	return certPaths, keyPaths, nil
+}
+
 func (f *FileLoader) Close() error {
 	f.reloadTick.Stop()
 	f.stopTick <- struct{}{}
@@ -114,7 +155,10 @@ func (f *FileLoader) reloadTicker() {
 	for {
 		select {
 		case <-f.reloadTick.C:
-			f.log.Debugln("reloading certs")
+			if !f.filesChanged() {
+				continue
+			}
+			f.log.Println("certificate files changed, reloading")
 			if err := f.loadCerts(); err != nil {
 				f.log.Error("reload failed", err)
 			}
@@ -124,33 +168,82 @@ func (f *FileLoader) reloadTicker() {
 	}
 }
 
+// fileModTimes returns modification times for all certificate and key
+// files. Files that can't be accessed are not included.
+func fileModTimes(certPaths, keyPaths []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(certPaths)+len(keyPaths))
+	for _, paths := range [][]string{certPaths, keyPaths} {
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			times[path] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// filesChanged reports whether any of certificate or key files were modified
+// since the last successful load.
+func (f *FileLoader) filesChanged() bool {
+	f.certsLock.RLock()
+	defer f.certsLock.RUnlock()
+
+	current := fileModTimes(f.certPaths, f.keyPaths)
+	if len(current) != len(f.modTimes) {
+		return true
+	}
+	for path, modTime := range current {
+		if !modTime.Equal(f.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
 func (f *FileLoader) loadCerts() error {
-	if len(f.certPaths) != len(f.keyPaths) {
-		return errors.New("mismatch in certs and keys count")
+	f.certsLock.RLock()
+	certPaths, keyPaths := f.certPaths, f.keyPaths
+	f.certsLock.RUnlock()
+
+	certs, modTimes, err := loadFiles(certPaths, keyPaths)
+	if err != nil {
+		return err
 	}
 
-	if len(f.certPaths) == 0 {
-		return errors.New("tls.loader.file: at least one certificate required")
+	f.certsLock.Lock()
+	defer f.certsLock.Unlock()
+	f.certs = certs
+	f.modTimes = modTimes
+
+	return nil
+}
+
+func loadFiles(certPaths, keyPaths []string) ([]tls.Certificate, map[string]time.Time, error) {
+	if len(certPaths) != len(keyPaths) {
+		return nil, nil, errors.New("mismatch in certs and keys count")
+	}
+
+	if len(certPaths) == 0 {
+		return nil, nil, errors.New("tls.loader.file: at least one certificate required")
 	}
 
-	certs := make([]tls.Certificate, 0, len(f.certPaths))
+	modTimes := fileModTimes(certPaths, keyPaths)
+	certs := make([]tls.Certificate, 0, len(certPaths))
 
-	for i := range f.certPaths {
-		certPath := f.certPaths[i]
-		keyPath := f.keyPaths[i]
+	for i := range certPaths {
+		certPath := certPaths[i]
+		keyPath := keyPaths[i]
 
 		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 		if err != nil {
-			return fmt.Errorf("failed to load %s and %s: %v", certPath, keyPath, err)
+			return nil, nil, fmt.Errorf("failed to load %s and %s: %v", certPath, keyPath, err)
 		}
 		certs = append(certs, cert)
 	}
 
-	f.certsLock.Lock()
-	defer f.certsLock.Unlock()
-	f.certs = certs
-
-	return nil
+	return certs, modTimes, nil
 }
 
 func (f *FileLoader) LoadCerts() ([]tls.Certificate, error) {
@@ -0,0 +1,221 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func writeTestCert(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, cert, cert, &privKey.PublicKey, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func testFileLoader(t *testing.T, args ...string) *FileLoader {
+	t.Helper()
+
+	mod, err := NewFileLoader("tls.loader.file", "", nil, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.(*FileLoader).Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	return mod.(*FileLoader)
+}
+
+func TestFileLoader_SNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certA, keyA := writeTestCert(t, dir, "a.example.org")
+	certB, keyB := writeTestCert(t, dir, "b.example.org")
+	loader := testFileLoader(t, certA, keyA, certB, keyB)
+	defer loader.Close()
+
+	certs, err := loader.LoadCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvCfg := &tls.Config{Certificates: certs}
+
+	for _, name := range []string{"a.example.org", "b.example.org"} {
+		clConn, srvConn := net.Pipe()
+		go func() {
+			_ = tls.Server(srvConn, srvCfg).Handshake()
+			srvConn.Close()
+		}()
+
+		cl := tls.Client(clConn, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err := cl.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		peerCerts := cl.ConnectionState().PeerCertificates
+		if len(peerCerts) == 0 || peerCerts[0].Subject.CommonName != name {
+			t.Errorf("Wrong certificate selected for %s", name)
+		}
+		cl.Close()
+	}
+}
+
+func TestFileLoader_Changed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir, "a.example.org")
+	loader := testFileLoader(t, cert, key)
+	defer loader.Close()
+
+	if loader.filesChanged() {
+		t.Fatal("Files are reported changed right after loading")
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(cert, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !loader.filesChanged() {
+		t.Fatal("Modified certificate is not detected")
+	}
+
+	if err := loader.loadCerts(); err != nil {
+		t.Fatal(err)
+	}
+	if loader.filesChanged() {
+		t.Fatal("Files are reported changed after reload")
+	}
+}
+
+func TestFileLoader_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certA, keyA := writeTestCert(t, dir, "a.example.org")
+	certB, keyB := writeTestCert(t, dir, "b.example.org")
+
+	loaderCfg := func(cert, key string) *config.Map {
+		return config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "certs", Args: []string{cert}},
+				{Name: "keys", Args: []string{key}},
+			},
+		})
+	}
+	mod, err := NewFileLoader("tls.loader.file", "test_tls", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := mod.(*FileLoader)
+	if err := loader.Init(loaderCfg(certA, keyA)); err != nil {
+		t.Fatal(err)
+	}
+	defer loader.Close()
+
+	commonName := func() string {
+		certs, err := loader.LoadCerts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 1 {
+			t.Fatal("Wrong amount of certificates:", len(certs))
+		}
+		leaf, err := x509.ParseCertificate(certs[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	// Broken configuration should not affect the loaded certificates.
+	if _, err := loader.Reload(loaderCfg(certB, filepath.Join(dir, "nonexistent.key"))); err == nil {
+		t.Fatal("Expected an error for missing key")
+	}
+	if name := commonName(); name != "a.example.org" {
+		t.Fatal("Wrong certificate after failed reload:", name)
+	}
+
+	apply, err := loader.Reload(loaderCfg(certB, keyB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(); name != "a.example.org" {
+		t.Fatal("Certificate changed before apply:", name)
+	}
+	apply()
+	if name := commonName(); name != "b.example.org" {
+		t.Fatal("Wrong certificate after reload:", name)
+	}
+	if loader.filesChanged() {
+		t.Fatal("Files are reported changed after reload")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// mailtoAddress extracts the recipient address from the mailto URI.
+func mailtoAddress(uri *url.URL) (string, error) {
+	addr := uri.Opaque
+	if addr == "" {
+		addr = uri.Path
+	}
+	addr, err := url.PathUnescape(addr)
+	if err != nil {
+		return "", err
+	}
+	if addr == "" {
+		return "", errors.New("tlsrpt: empty mailto URI")
+	}
+	return addr, nil
+}
+
+// writeBase64 writes the base64-encoded data split into 76-character lines.
+func writeBase64(w *bytes.Buffer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		w.WriteString(enc[:76])
+		w.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	w.WriteString(enc)
+	w.WriteString("\r\n")
+}
+
+// buildMail generates the report message as defined in RFC 8460,
+// Section 5.3.
+func (r *Reporter) buildMail(msgID, to, domain string, report Report, reportGz []byte) (textproto.Header, []byte, error) {
+	var body bytes.Buffer
+	partWriter := textproto.NewMultipartWriter(&body)
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", msgID)
+	hdr.Add("Content-Type", `multipart/report; report-type="tlsrpt"; boundary=`+partWriter.Boundary())
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("TLS-Report-Submitter", r.hostname)
+	hdr.Add("TLS-Report-Domain", domain)
+	hdr.Add("To", to)
+	hdr.Add("From", r.from)
+	hdr.Add("Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>", domain, r.hostname, report.ReportID))
+
+	textHdr := textproto.Header{}
+	textHdr.Add("Content-Transfer-Encoding", "8bit")
+	textHdr.Add("Content-Type", `text/plain; charset="utf-8"`)
+	textWriter, err := partWriter.CreatePart(textHdr)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	_, err = fmt.Fprintf(textWriter, "This is an aggregate TLS report from %s for %s.\r\n\r\n"+
+		"The report covers TLS sessions established from %s to %s.\r\n",
+		r.orgName, domain,
+		report.DateRange.Start.Format(time.RFC3339), report.DateRange.End.Format(time.RFC3339))
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	// sender "!" policy-domain "!" begin-timestamp "!" end-timestamp "." extension
+	filename := strings.Join([]string{
+		r.hostname, domain,
+		strconv.FormatInt(report.DateRange.Start.Unix(), 10),
+		strconv.FormatInt(report.DateRange.End.Unix(), 10),
+	}, "!") + ".json.gz"
+
+	reportHdr := textproto.Header{}
+	reportHdr.Add("Content-Transfer-Encoding", "base64")
+	reportHdr.Add("Content-Disposition", `attachment; filename="`+filename+`"`)
+	reportHdr.Add("Content-Type", `application/tlsrpt+gzip; name="`+filename+`"`)
+	reportWriter, err := partWriter.CreatePart(reportHdr)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	var encoded bytes.Buffer
+	writeBase64(&encoded, reportGz)
+	if _, err := reportWriter.Write(encoded.Bytes()); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	if err := partWriter.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return hdr, body.Bytes(), nil
+}
+
+func (r *Reporter) sendMail(ctx context.Context, uri *url.URL, domain string, report Report, reportGz []byte) (err error) {
+	if r.pipeline == nil {
+		return errors.New("tlsrpt: mail_delivery is not configured")
+	}
+
+	to, err := mailtoAddress(uri)
+	if err != nil {
+		return err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	hdr, body, err := r.buildMail("<"+msgID+"@"+r.hostname+">", to, domain, report, reportGz)
+	if err != nil {
+		return err
+	}
+
+	delivery, err := r.pipeline.Start(ctx, &module.MsgMetadata{ID: msgID}, r.from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				r.log.Error("failed to abort report delivery", err, "msg_id", msgID)
+			}
+		}
+	}()
+
+	if err = delivery.AddRcpt(ctx, to); err != nil {
+		return err
+	}
+	if err = delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
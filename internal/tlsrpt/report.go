@@ -0,0 +1,152 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy types defined by RFC 8460, Section 4.3.
+const (
+	PolicyTLSA          = "tlsa"
+	PolicySTS           = "sts"
+	PolicyNoPolicyFound = "no-policy-found"
+)
+
+// Result types defined by RFC 8460, Section 4.3.
+const (
+	ResultSTARTTLSNotSupported    = "starttls-not-supported"
+	ResultCertificateHostMismatch = "certificate-host-mismatch"
+	ResultCertificateExpired      = "certificate-expired"
+	ResultCertificateNotTrusted   = "certificate-not-trusted"
+	ResultValidationFailure       = "validation-failure"
+	ResultTLSAInvalid             = "tlsa-invalid"
+	ResultDNSSECInvalid           = "dnssec-invalid"
+	ResultDANERequired            = "dane-required"
+	ResultSTSPolicyFetchError     = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid        = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid        = "sts-webpki-invalid"
+)
+
+// Policy describes the policy applied to the delivery attempt.
+type Policy struct {
+	Type   string   `json:"policy-type"`
+	String []string `json:"policy-string,omitempty"`
+	Domain string   `json:"policy-domain"`
+	MXHost []string `json:"mx-host,omitempty"`
+}
+
+// Result is the outcome of a single TLS session with the recipient MX.
+type Result struct {
+	Policy Policy
+
+	// ResultType is empty for successful sessions.
+	ResultType string
+
+	SendingMTAIP        string
+	ReceivingMXHostname string
+	ReceivingIP         string
+
+	// FailureReason is the free-form description of the failure, included
+	// in the report as failure-reason-code.
+	FailureReason string
+}
+
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type PolicyResult struct {
+	Policy         Policy          `json:"policy"`
+	Summary        Summary         `json:"summary"`
+	FailureDetails []FailureDetail `json:"failure-details,omitempty"`
+}
+
+type Summary struct {
+	Successful int `json:"total-successful-session-count"`
+	Failed     int `json:"total-failure-session-count"`
+}
+
+type FailureDetail struct {
+	ResultType          string `json:"result-type"`
+	SendingMTAIP        string `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP         string `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int    `json:"failed-session-count"`
+	FailureReasonCode   string `json:"failure-reason-code,omitempty"`
+}
+
+// record is the aggregated counter for a set of equal results.
+type record struct {
+	Result
+	Count int
+}
+
+// policyKey returns the string uniquely identifying the policy.
+func policyKey(p Policy) string {
+	return p.Type + "\x00" + strings.Join(p.String, "\n") + "\x00" + strings.Join(p.MXHost, "\n")
+}
+
+// buildPolicies groups counters for a single policy domain by the policy.
+func buildPolicies(recs []record) []PolicyResult {
+	var (
+		res   []PolicyResult
+		index = map[string]int{}
+	)
+	for _, rec := range recs {
+		key := policyKey(rec.Policy)
+		i, ok := index[key]
+		if !ok {
+			i = len(res)
+			index[key] = i
+			res = append(res, PolicyResult{Policy: rec.Policy})
+		}
+		pr := &res[i]
+
+		if rec.ResultType == "" {
+			pr.Summary.Successful += rec.Count
+			continue
+		}
+		pr.Summary.Failed += rec.Count
+		pr.FailureDetails = append(pr.FailureDetails, FailureDetail{
+			ResultType:          rec.ResultType,
+			SendingMTAIP:        rec.SendingMTAIP,
+			ReceivingMXHostname: rec.ReceivingMXHostname,
+			ReceivingIP:         rec.ReceivingIP,
+			FailedSessionCount:  rec.Count,
+			FailureReasonCode:   rec.FailureReason,
+		})
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Policy.Type < res[j].Policy.Type
+	})
+	return res
+}
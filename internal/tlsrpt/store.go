@@ -0,0 +1,189 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// counterKey identifies the aggregated counter. Lists are stored joined
+// using newlines so the key is comparable.
+type counterKey struct {
+	day           string
+	policyDomain  string
+	policyType    string
+	policyString  string
+	mxHost        string
+	resultType    string
+	sendingIP     string
+	receivingMX   string
+	receivingIP   string
+	failureReason string
+}
+
+func keyFor(day string, res Result) counterKey {
+	return counterKey{
+		day:           day,
+		policyDomain:  res.Policy.Domain,
+		policyType:    res.Policy.Type,
+		policyString:  strings.Join(res.Policy.String, "\n"),
+		mxHost:        strings.Join(res.Policy.MXHost, "\n"),
+		resultType:    res.ResultType,
+		sendingIP:     res.SendingMTAIP,
+		receivingMX:   res.ReceivingMXHostname,
+		receivingIP:   res.ReceivingIP,
+		failureReason: res.FailureReason,
+	}
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// store keeps aggregated counters in the SQL database until they are
+// reported.
+//
+// Queries use $N placeholders supported by sqlite3 and postgres drivers.
+type store struct {
+	db *sql.DB
+}
+
+func openStore(driver, dsn string) (*store, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tlsrpt_results (
+		day TEXT NOT NULL,
+		policy_domain TEXT NOT NULL,
+		policy_type TEXT NOT NULL,
+		policy_string TEXT NOT NULL,
+		mx_host TEXT NOT NULL,
+		result_type TEXT NOT NULL,
+		sending_ip TEXT NOT NULL,
+		receiving_mx TEXT NOT NULL,
+		receiving_ip TEXT NOT NULL,
+		failure_reason TEXT NOT NULL,
+		sessions INTEGER NOT NULL,
+		PRIMARY KEY (day, policy_domain, policy_type, policy_string, mx_host,
+			result_type, sending_ip, receiving_mx, receiving_ip, failure_reason)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+// add increments counters in a single transaction.
+func (s *store) add(counters map[counterKey]int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt, err := tx.Prepare(`INSERT INTO tlsrpt_results VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (day, policy_domain, policy_type, policy_string, mx_host,
+			result_type, sending_ip, receiving_mx, receiving_ip, failure_reason)
+		DO UPDATE SET sessions = tlsrpt_results.sessions + excluded.sessions`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for k, count := range counters {
+		_, err := stmt.Exec(k.day, k.policyDomain, k.policyType, k.policyString, k.mxHost,
+			k.resultType, k.sendingIP, k.receivingMX, k.receivingIP, k.failureReason, count)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *store) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return nil, err
+		}
+		res = append(res, str)
+	}
+	return res, rows.Err()
+}
+
+// daysBefore returns days with stored counters that are before the
+// specified one.
+func (s *store) daysBefore(day string) ([]string, error) {
+	return s.queryStrings(`SELECT DISTINCT day FROM tlsrpt_results WHERE day < $1 ORDER BY day`, day)
+}
+
+func (s *store) domains(day string) ([]string, error) {
+	return s.queryStrings(`SELECT DISTINCT policy_domain FROM tlsrpt_results WHERE day = $1 ORDER BY policy_domain`, day)
+}
+
+func (s *store) load(day, domain string) ([]record, error) {
+	rows, err := s.db.Query(`SELECT policy_type, policy_string, mx_host, result_type,
+		sending_ip, receiving_mx, receiving_ip, failure_reason, sessions
+		FROM tlsrpt_results WHERE day = $1 AND policy_domain = $2
+		ORDER BY policy_type, policy_string, mx_host, result_type, receiving_mx, receiving_ip`, day, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []record
+	for rows.Next() {
+		var (
+			rec                  record
+			policyString, mxHost string
+		)
+		rec.Policy.Domain = domain
+		err := rows.Scan(&rec.Policy.Type, &policyString, &mxHost, &rec.ResultType,
+			&rec.SendingMTAIP, &rec.ReceivingMXHostname, &rec.ReceivingIP, &rec.FailureReason, &rec.Count)
+		if err != nil {
+			return nil, err
+		}
+		rec.Policy.String = splitList(policyString)
+		rec.Policy.MXHost = splitList(mxHost)
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func (s *store) remove(day, domain string) error {
+	_, err := s.db.Exec(`DELETE FROM tlsrpt_results WHERE day = $1 AND policy_domain = $2`, day, domain)
+	return err
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
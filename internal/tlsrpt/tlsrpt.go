@@ -0,0 +1,416 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tlsrpt implements the generation of SMTP TLS reports (RFC 8460).
+//
+// Results of TLS sessions established for outbound delivery are aggregated
+// per UTC day and policy domain in the SQL database. Once the day is over,
+// aggregated results are sent to the reporting URIs published by the
+// policy domain in the _smtp._tls TXT record.
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+)
+
+const modName = "tlsrpt"
+
+const (
+	dayFormat = "2006-01-02"
+
+	// How often the database is checked for completed days.
+	reportInterval = time.Hour
+
+	// Reports that failed to be sent are retried until they are that old.
+	maxReportAge = 3 * 24 * time.Hour
+
+	// Failure reasons are free-form strings coming from remote servers, limit
+	// them to keep the database sane.
+	maxReasonLen = 256
+)
+
+type Reporter struct {
+	instName string
+	driver   string
+	dsn      []string
+	log      log.Logger
+
+	hostname    string
+	orgName     string
+	contactInfo string
+	from        string
+	pipeline    module.DeliveryTarget
+	flushEvery  time.Duration
+
+	resolver   dns.Resolver
+	httpClient *http.Client
+	clock      clock.Clock
+
+	store *store
+
+	pendingLock sync.Mutex
+	pending     map[counterKey]int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	r := &Reporter{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+		clock:    clock.Real,
+		pending:  make(map[counterKey]int),
+	}
+	if len(inlineArgs) != 0 {
+		if len(inlineArgs) == 1 {
+			return nil, errors.New("tlsrpt: expected at least 2 arguments")
+		}
+
+		r.driver = inlineArgs[0]
+		r.dsn = inlineArgs[1:]
+	}
+	return r, nil
+}
+
+func (r *Reporter) Name() string {
+	return modName
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	var httpTimeout time.Duration
+	cfg.String("driver", false, false, r.driver, &r.driver)
+	cfg.StringList("dsn", false, false, r.dsn, &r.dsn)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("organization", false, false, "", &r.orgName)
+	cfg.String("contact_info", false, false, "", &r.contactInfo)
+	cfg.String("from", false, false, "", &r.from)
+	cfg.Custom("mail_delivery", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		return msgpipeline.New(m.Globals, node.Children)
+	}, &r.pipeline)
+	cfg.Duration("flush_interval", false, false, time.Minute, &r.flushEvery)
+	cfg.Duration("http_timeout", false, false, time.Minute, &httpTimeout)
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if r.driver == "" {
+		return errors.New("tlsrpt: driver is required")
+	}
+	if r.dsn == nil {
+		return errors.New("tlsrpt: dsn is required")
+	}
+	if r.flushEvery <= 0 {
+		return errors.New("tlsrpt: flush_interval should be positive")
+	}
+	if r.orgName == "" {
+		r.orgName = r.hostname
+	}
+	if r.contactInfo == "" {
+		r.contactInfo = "postmaster@" + r.hostname
+	}
+	if r.from == "" {
+		r.from = "noreply-tlsrpt@" + r.hostname
+	}
+	if r.pipeline != nil {
+		r.pipeline.(*msgpipeline.MsgPipeline).Hostname = r.hostname
+		r.pipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: modName + "/pipeline", Debug: r.log.Debug}
+	}
+	r.httpClient = &http.Client{Timeout: httpTimeout}
+	if config.CheckOnly {
+		return nil
+	}
+
+	var err error
+	r.store, err = openStore(r.driver, strings.Join(r.dsn, " "))
+	if err != nil {
+		return fmt.Errorf("tlsrpt: %w", err)
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run()
+
+	return nil
+}
+
+// Record adds the result of the TLS session to the aggregated counters.
+//
+// It never blocks on I/O, counters are written to the database
+// periodically.
+func (r *Reporter) Record(res Result) {
+	if len(res.FailureReason) > maxReasonLen {
+		res.FailureReason = res.FailureReason[:maxReasonLen]
+	}
+	key := keyFor(r.clock.Now().UTC().Format(dayFormat), res)
+
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+	r.pending[key]++
+}
+
+// flush writes pending counters to the database.
+func (r *Reporter) flush() {
+	r.pendingLock.Lock()
+	pending := r.pending
+	r.pending = make(map[counterKey]int)
+	r.pendingLock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := r.store.add(pending); err != nil {
+		r.log.Error("failed to save results", err)
+
+		// Put them back to try again later.
+		r.pendingLock.Lock()
+		for k, count := range pending {
+			r.pending[k] += count
+		}
+		r.pendingLock.Unlock()
+	}
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.flushEvery)
+	defer ticker.Stop()
+
+	var lastReport time.Time
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.flush()
+		if time.Since(lastReport) >= reportInterval {
+			lastReport = time.Now()
+			r.sendReports(context.Background())
+		}
+	}
+}
+
+// sendReports sends reports for all completed days present in the database.
+func (r *Reporter) sendReports(ctx context.Context) {
+	now := r.clock.Now().UTC()
+	days, err := r.store.daysBefore(now.Format(dayFormat))
+	if err != nil {
+		r.log.Error("failed to list stored results", err)
+		return
+	}
+
+	for _, day := range days {
+		domains, err := r.store.domains(day)
+		if err != nil {
+			r.log.Error("failed to list stored results", err, "day", day)
+			return
+		}
+
+		for _, domain := range domains {
+			err := r.sendReport(ctx, day, domain)
+			if err != nil {
+				dayStart, _ := time.Parse(dayFormat, day)
+				if now.Sub(dayStart) < maxReportAge {
+					r.log.Error("failed to send report, will retry later", err, "day", day, "domain", domain)
+					continue
+				}
+				r.log.Error("failed to send report, discarding it", err, "day", day, "domain", domain)
+			}
+
+			if err := r.store.remove(day, domain); err != nil {
+				r.log.Error("failed to remove results", err, "day", day, "domain", domain)
+			}
+		}
+	}
+}
+
+// lookupRUA returns the reporting URIs published by the domain.
+//
+// No error is returned if the domain does not publish a valid TLSRPT record.
+func (r *Reporter) lookupRUA(ctx context.Context, domain string) ([]*url.URL, error) {
+	recs, err := r.resolver.LookupTXT(ctx, "_smtp._tls."+dns.FQDN(domain))
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var policy string
+	for _, rec := range recs {
+		if rec != "v=TLSRPTv1" && !strings.HasPrefix(rec, "v=TLSRPTv1;") {
+			continue
+		}
+		// RFC 8460, Section 3: If there are multiple records, they all
+		// must be ignored.
+		if policy != "" {
+			return nil, nil
+		}
+		policy = rec
+	}
+
+	var uris []*url.URL
+	for _, field := range strings.Split(policy, ";") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 || parts[0] != "rua" {
+			continue
+		}
+		for _, uriStr := range strings.Split(parts[1], ",") {
+			uri, err := url.Parse(strings.TrimSpace(uriStr))
+			if err != nil {
+				r.log.Msg("malformed reporting URI", "domain", domain, "uri", uriStr)
+				continue
+			}
+			uris = append(uris, uri)
+		}
+	}
+	return uris, nil
+}
+
+func (r *Reporter) sendReport(ctx context.Context, day, domain string) error {
+	uris, err := r.lookupRUA(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if len(uris) == 0 {
+		r.log.DebugMsg("no reporting URIs published, not sending report", "day", day, "domain", domain)
+		return nil
+	}
+
+	recs, err := r.store.load(day, domain)
+	if err != nil {
+		return err
+	}
+
+	dayStart, err := time.Parse(dayFormat, day)
+	if err != nil {
+		return err
+	}
+	report := Report{
+		OrganizationName: r.orgName,
+		DateRange: DateRange{
+			Start: dayStart,
+			End:   dayStart.Add(24*time.Hour - time.Second),
+		},
+		ContactInfo: r.contactInfo,
+		ReportID:    day + "_" + domain + "@" + r.hostname,
+		Policies:    buildPolicies(recs),
+	}
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	var reportGz bytes.Buffer
+	w := gzip.NewWriter(&reportGz)
+	if _, err := w.Write(reportJSON); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	var (
+		sent    bool
+		lastErr error
+	)
+	for _, uri := range uris {
+		switch uri.Scheme {
+		case "mailto":
+			err = r.sendMail(ctx, uri, domain, report, reportGz.Bytes())
+		case "https":
+			err = r.post(ctx, uri, reportGz.Bytes())
+		default:
+			r.log.Msg("unsupported reporting URI", "domain", domain, "uri", uri.String())
+			continue
+		}
+		if err != nil {
+			r.log.Error("failed to send report", err, "day", day, "domain", domain, "uri", uri.String())
+			lastErr = err
+			continue
+		}
+		r.log.Msg("report sent", "day", day, "domain", domain, "uri", uri.String())
+		sent = true
+	}
+	if !sent {
+		return lastErr
+	}
+	return nil
+}
+
+func (r *Reporter) post(ctx context.Context, uri *url.URL, report []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri.String(), bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/tlsrpt+gzip")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("tlsrpt: unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *Reporter) Close() error {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.done
+	}
+	if r.store == nil {
+		return nil
+	}
+	r.flush()
+	return r.store.Close()
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,320 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/clock"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testReporter(t *testing.T, zones map[string]mockdns.Zone) (*Reporter, *clock.Fake) {
+	t.Helper()
+
+	st, err := openStore("sqlite3", filepath.Join(testutils.Dir(t), "tlsrpt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	clk := clock.NewFake(time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC))
+	return &Reporter{
+		log:         testutils.Logger(t, modName),
+		hostname:    "mx.example.org",
+		orgName:     "Example Org",
+		contactInfo: "postmaster@example.org",
+		from:        "noreply-tlsrpt@mx.example.org",
+		resolver:    &mockdns.Resolver{Zones: zones},
+		httpClient:  http.DefaultClient,
+		clock:       clk,
+		store:       st,
+		pending:     make(map[counterKey]int),
+	}, clk
+}
+
+var stsPolicy = Policy{
+	Type:   PolicySTS,
+	String: []string{"version: STSv1", "mode: enforce", "mx: mx.example.com", "max_age: 86400"},
+	Domain: "example.com",
+	MXHost: []string{"mx.example.com"},
+}
+
+func recordResults(r *Reporter) {
+	r.Record(Result{Policy: stsPolicy, ReceivingMXHostname: "mx.example.com"})
+	r.Record(Result{Policy: stsPolicy, ReceivingMXHostname: "mx.example.com"})
+	r.Record(Result{
+		Policy:              stsPolicy,
+		ResultType:          ResultCertificateExpired,
+		SendingMTAIP:        "192.0.2.1",
+		ReceivingMXHostname: "mx.example.com",
+		ReceivingIP:         "192.0.2.2",
+		FailureReason:       "x509: certificate has expired",
+	})
+	r.Record(Result{
+		Policy:              Policy{Type: PolicyNoPolicyFound, Domain: "example.net"},
+		ResultType:          ResultSTARTTLSNotSupported,
+		ReceivingMXHostname: "mx.example.net",
+	})
+}
+
+func checkReport(t *testing.T, reportJSON []byte) {
+	t.Helper()
+
+	var report Report
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.OrganizationName != "Example Org" {
+		t.Error("Wrong organization-name:", report.OrganizationName)
+	}
+	if !report.DateRange.Start.Equal(time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Wrong start-datetime:", report.DateRange.Start)
+	}
+	if !report.DateRange.End.Equal(time.Date(2020, 4, 1, 23, 59, 59, 0, time.UTC)) {
+		t.Error("Wrong end-datetime:", report.DateRange.End)
+	}
+	if len(report.Policies) != 1 {
+		t.Fatal("Wrong amount of policies:", len(report.Policies))
+	}
+	pr := report.Policies[0]
+	if pr.Policy.Type != PolicySTS || pr.Policy.Domain != "example.com" || len(pr.Policy.String) != 4 {
+		t.Error("Wrong policy:", pr.Policy)
+	}
+	if pr.Summary.Successful != 2 || pr.Summary.Failed != 1 {
+		t.Error("Wrong summary:", pr.Summary)
+	}
+	if len(pr.FailureDetails) != 1 {
+		t.Fatal("Wrong amount of failure details:", len(pr.FailureDetails))
+	}
+	fd := pr.FailureDetails[0]
+	if fd.ResultType != ResultCertificateExpired || fd.FailedSessionCount != 1 ||
+		fd.SendingMTAIP != "192.0.2.1" || fd.ReceivingIP != "192.0.2.2" {
+		t.Error("Wrong failure details:", fd)
+	}
+}
+
+func gunzip(t *testing.T, blob []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(strings.NewReader(string(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestReporter_HTTPS(t *testing.T) {
+	var received [][]byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/tlsrpt+gzip" {
+			t.Error("Wrong Content-Type:", req.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		received = append(received, body)
+	}))
+	defer srv.Close()
+
+	r, clk := testReporter(t, map[string]mockdns.Zone{
+		"_smtp._tls.example.com.": {
+			TXT: []string{"v=TLSRPTv1; rua=" + srv.URL + "/report"},
+		},
+	})
+	r.httpClient = srv.Client()
+
+	recordResults(r)
+	r.flush()
+
+	// Day is not over yet.
+	r.sendReports(context.Background())
+	if len(received) != 0 {
+		t.Fatal("Report sent before the end of the day")
+	}
+
+	clk.Advance(24 * time.Hour)
+	r.sendReports(context.Background())
+	if len(received) != 1 {
+		t.Fatal("Wrong amount of reports sent:", len(received))
+	}
+	checkReport(t, gunzip(t, received[0]))
+
+	// Sent reports and reports for domains without TLSRPT record are
+	// removed.
+	days, err := r.store.daysBefore("2020-04-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 0 {
+		t.Fatal("Results are not removed after sending:", days)
+	}
+}
+
+func TestReporter_HTTPSFailure(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	r, clk := testReporter(t, map[string]mockdns.Zone{
+		"_smtp._tls.example.com.": {
+			TXT: []string{"v=TLSRPTv1; rua=" + srv.URL},
+		},
+	})
+	r.httpClient = srv.Client()
+
+	recordResults(r)
+	r.flush()
+
+	clk.Advance(24 * time.Hour)
+	r.sendReports(context.Background())
+	domains, err := r.store.domains("2020-04-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0] != "example.com" {
+		t.Fatal("Results should be kept for retry:", domains)
+	}
+
+	// Give up eventually.
+	clk.Advance(maxReportAge)
+	r.sendReports(context.Background())
+	domains, err = r.store.domains("2020-04-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 0 {
+		t.Fatal("Old results are not discarded:", domains)
+	}
+}
+
+func TestReporter_Mailto(t *testing.T) {
+	tgt := testutils.Target{}
+	r, clk := testReporter(t, map[string]mockdns.Zone{
+		"_smtp._tls.example.com.": {
+			TXT: []string{"v=TLSRPTv1;rua=mailto:tlsrpt@example.com"},
+		},
+	})
+	r.pipeline = &tgt
+
+	recordResults(r)
+	r.flush()
+	clk.Advance(24 * time.Hour)
+	r.sendReports(context.Background())
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Wrong amount of messages sent:", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "noreply-tlsrpt@mx.example.org" {
+		t.Error("Wrong MAIL FROM:", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tlsrpt@example.com" {
+		t.Error("Wrong RCPT TO:", msg.RcptTo)
+	}
+	if msg.Header.Get("TLS-Report-Domain") != "example.com" {
+		t.Error("Wrong TLS-Report-Domain:", msg.Header.Get("TLS-Report-Domain"))
+	}
+
+	ent, err := message.New(message.Header{Header: msg.Header}, strings.NewReader(string(msg.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := ent.Header.ContentType()
+	if mediaType != "multipart/report" || params["report-type"] != "tlsrpt" {
+		t.Fatal("Wrong Content-Type:", mediaType, params)
+	}
+
+	mr := ent.MultipartReader()
+	var reportJSON []byte
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := part.Header.ContentType()
+		if partType != "application/tlsrpt+gzip" {
+			continue
+		}
+		_, dispParams, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if !strings.HasPrefix(dispParams["filename"], "mx.example.org!example.com!1585699200!") {
+			t.Error("Wrong report filename:", dispParams["filename"])
+		}
+		blob, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reportJSON = gunzip(t, blob)
+	}
+	if reportJSON == nil {
+		t.Fatal("No report attached")
+	}
+	checkReport(t, reportJSON)
+}
+
+func TestLookupRUA(t *testing.T) {
+	r, _ := testReporter(t, map[string]mockdns.Zone{
+		"_smtp._tls.example.com.": {
+			TXT: []string{"v=TLSRPTv1; rua=mailto:a@example.com, https://example.com/tlsrpt"},
+		},
+		"_smtp._tls.example.net.": {
+			TXT: []string{"v=TLSRPTv1; rua=mailto:a@example.net", "v=TLSRPTv1; rua=mailto:b@example.net"},
+		},
+		"_smtp._tls.example.org.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+	})
+
+	uris, err := r.lookupRUA(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uris) != 2 || uris[0].String() != "mailto:a@example.com" || uris[1].String() != "https://example.com/tlsrpt" {
+		t.Error("Wrong URIs:", uris)
+	}
+
+	for _, domain := range []string{"example.net", "example.org", "example.invalid"} {
+		uris, err := r.lookupRUA(context.Background(), domain)
+		if err != nil {
+			t.Fatal(domain, err)
+		}
+		if len(uris) != 0 {
+			t.Error("Unexpected URIs for", domain, uris)
+		}
+	}
+}
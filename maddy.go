@@ -29,6 +29,8 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
@@ -36,36 +38,60 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/profile"
 
 	// Import packages for side-effect of module registration.
+	_ "github.com/foxcpp/maddy/internal/auth/cache"
 	_ "github.com/foxcpp/maddy/internal/auth/dovecot_sasl"
 	_ "github.com/foxcpp/maddy/internal/auth/external"
+	_ "github.com/foxcpp/maddy/internal/auth/ldap"
+	_ "github.com/foxcpp/maddy/internal/auth/oauth2"
 	_ "github.com/foxcpp/maddy/internal/auth/pam"
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/auth/throttle"
+	_ "github.com/foxcpp/maddy/internal/check/arc"
+	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/batv"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/domaintypo"
+	_ "github.com/foxcpp/maddy/internal/check/dynip"
+	_ "github.com/foxcpp/maddy/internal/check/earlytalker"
+	_ "github.com/foxcpp/maddy/internal/check/header"
+	_ "github.com/foxcpp/maddy/internal/check/helo"
+	_ "github.com/foxcpp/maddy/internal/check/iprev"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
+	_ "github.com/foxcpp/maddy/internal/check/size"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/check/tenant_sender"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
+	_ "github.com/foxcpp/maddy/internal/endpoint/pop3"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
 	_ "github.com/foxcpp/maddy/internal/imap_filter/command"
 	_ "github.com/foxcpp/maddy/internal/modify"
+	_ "github.com/foxcpp/maddy/internal/modify/attachments"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
+	_ "github.com/foxcpp/maddy/internal/modify/footer"
+	_ "github.com/foxcpp/maddy/internal/modify/urlrewrite"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
 	_ "github.com/foxcpp/maddy/internal/table"
+	_ "github.com/foxcpp/maddy/internal/target/maildir"
+	_ "github.com/foxcpp/maddy/internal/target/pipe"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
+	_ "github.com/foxcpp/maddy/internal/target/sieve"
 	_ "github.com/foxcpp/maddy/internal/target/smtp"
 	_ "github.com/foxcpp/maddy/internal/tls"
+	_ "github.com/foxcpp/maddy/internal/tlsrpt"
 )
 
 var (
@@ -106,6 +132,8 @@ func Run() int {
 		logTargets   = flag.String("log", "stderr", "default logging target(s)")
 		printVersion = flag.Bool("v", false, "print version and build metadata, then exit")
 	)
+	flag.BoolVar(&config.CheckOnly, "check", false, "check the configuration for errors, then exit")
+	dumpConfig := flag.Bool("dump-config", false, "print the configuration with profiles expanded, then exit")
 
 	if enableDebugFlags {
 		profileEndpoint = flag.String("debug.pprof", "", "enable live profiler HTTP endpoint and listen on the specified address")
@@ -145,14 +173,26 @@ func Run() int {
 	}
 	defer f.Close()
 
-	cfg, err := parser.Read(f, *configPath)
+	cfg, err := readConfig(f, *configPath)
 	if err != nil {
 		systemdStatusErr(err)
 		log.Println(err)
 		return 2
 	}
 
-	if err := moduleMain(cfg); err != nil {
+	if *dumpConfig {
+		if err := parser.Write(os.Stdout, cfg); err != nil {
+			log.Println(err)
+			return 2
+		}
+		return 0
+	}
+
+	if config.CheckOnly {
+		return checkMain(cfg)
+	}
+
+	if err := moduleMain(*configPath, cfg); err != nil {
 		systemdStatusErr(err)
 		log.Println(err)
 		return 2
@@ -161,6 +201,16 @@ func Run() int {
 	return 0
 }
 
+// readConfig reads the configuration and expands the profile directives
+// (see internal/profile).
+func readConfig(r io.Reader, path string) ([]config.Node, error) {
+	cfg, err := parser.Read(r, path)
+	if err != nil {
+		return nil, err
+	}
+	return profile.Expand(cfg)
+}
+
 func initDebug() {
 	if !enableDebugFlags {
 		return
@@ -194,11 +244,13 @@ func InitDirs() error {
 		config.LibexecDirectory = DefaultLibexecDirectory
 	}
 
-	if err := ensureDirectoryWritable(config.StateDirectory); err != nil {
-		return err
-	}
-	if err := ensureDirectoryWritable(config.RuntimeDirectory); err != nil {
-		return err
+	if !config.CheckOnly {
+		if err := ensureDirectoryWritable(config.StateDirectory); err != nil {
+			return err
+		}
+		if err := ensureDirectoryWritable(config.RuntimeDirectory); err != nil {
+			return err
+		}
 	}
 
 	// Make sure all paths we are going to use are absolute
@@ -250,17 +302,25 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Duration("shutdown_timeout", false, false, 30*time.Second, nil)
 	globals.AllowUnknown()
 	unknown, err := globals.Process()
 	return globals.Values, unknown, err
 }
 
-func moduleMain(cfg []config.Node) error {
+func moduleMain(configPath string, cfg []config.Node) error {
 	globals, modBlocks, err := ReadGlobals(cfg)
 	if err != nil {
 		return err
 	}
 
+	// The configuration is read again on reload, after InitDirs changes the
+	// working directory.
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return err
+	}
+
 	if err := InitDirs(); err != nil {
 		return err
 	}
@@ -279,9 +339,11 @@ func moduleMain(cfg []config.Node) error {
 		return err
 	}
 
+	live := newLiveConfig(configPath, globals, cfg, endpoints)
+
 	systemdStatus(SDReady, "Listening for incoming connections...")
 
-	handleSignals()
+	handleSignals(live.reload)
 
 	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
 
@@ -296,6 +358,16 @@ type ModInfo struct {
 }
 
 func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpoints, mods []ModInfo, err error) {
+	endpoints, mods, errs := registerModules(globals, nodes)
+	if len(errs) != 0 {
+		return nil, nil, errs[0]
+	}
+	return endpoints, mods, nil
+}
+
+// registerModules is RegisterModules that does not stop on the first invalid
+// block and returns all errors found.
+func registerModules(globals map[string]interface{}, nodes []config.Node) (endpoints, mods []ModInfo, errs []error) {
 	mods = make([]ModInfo, 0, len(nodes))
 
 	for _, block := range nodes {
@@ -314,7 +386,8 @@ func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpo
 		if endpFactory != nil {
 			inst, err := endpFactory(modName, block.Args)
 			if err != nil {
-				return nil, nil, err
+				errs = append(errs, err)
+				continue
 			}
 
 			endpoints = append(endpoints, ModInfo{Instance: inst, Cfg: block})
@@ -323,23 +396,33 @@ func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpo
 
 		factory := module.Get(modName)
 		if factory == nil {
-			return nil, nil, config.NodeErr(block, "unknown module or global directive: %s", modName)
+			known := append(module.RegisteredModules(), module.RegisteredEndpoints()...)
+			known = append(known, profile.Names()...)
+			if suggestion := config.Suggest(modName, known); suggestion != "" {
+				errs = append(errs, config.NodeErr(block, "unknown module or global directive: %s, did you mean %s?", modName, suggestion))
+			} else {
+				errs = append(errs, config.NodeErr(block, "unknown module or global directive: %s", modName))
+			}
+			continue
 		}
 
 		if module.HasInstance(instName) {
-			return nil, nil, config.NodeErr(block, "config block named %s already exists", instName)
+			errs = append(errs, config.NodeErr(block, "config block named %s already exists", instName))
+			continue
 		}
 
 		inst, err := factory(modName, instName, modAliases, nil)
 		if err != nil {
-			return nil, nil, err
+			errs = append(errs, err)
+			continue
 		}
 
 		block := block
 		module.RegisterInstance(inst, config.NewMap(globals, block))
 		for _, alias := range modAliases {
 			if module.HasInstance(alias) {
-				return nil, nil, config.NodeErr(block, "config block named %s already exists", alias)
+				errs = append(errs, config.NodeErr(block, "config block named %s already exists", alias))
+				continue
 			}
 			module.RegisterAlias(alias, instName)
 		}
@@ -347,37 +430,55 @@ func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpo
 	}
 
 	if len(endpoints) == 0 {
-		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+		errs = append(errs, fmt.Errorf("at least one endpoint should be configured"))
 	}
 
-	return endpoints, mods, nil
+	return endpoints, mods, errs
 }
 
 func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) error {
 	for _, endp := range endpoints {
 		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
-			return err
+			return config.WrapBlockErr(endp.Cfg, err)
 		}
+	}
 
-		if closer, ok := endp.Instance.(io.Closer); ok {
+	// Endpoints are closed before other modules since they are initialized
+	// last and hooks are executed in the reverse order. They are closed in
+	// parallel so all of them stop accepting new connections at once while
+	// waiting for the running transactions to complete.
+	hooks.AddHook(hooks.EventShutdown, func() {
+		var wg sync.WaitGroup
+		for _, endp := range endpoints {
+			closer, ok := endp.Instance.(io.Closer)
+			if !ok {
+				continue
+			}
 			endp := endp
-			hooks.AddHook(hooks.EventShutdown, func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 				log.Debugf("close %s (%s)", endp.Instance.Name(), endp.Instance.InstanceName())
 				if err := closer.Close(); err != nil {
 					log.Printf("module %s (%s) close failed: %v", endp.Instance.Name(), endp.Instance.InstanceName(), err)
 				}
-			})
+			}()
 		}
-	}
+		wg.Wait()
+	})
 
 	for _, inst := range mods {
 		if module.Initialized[inst.Instance.InstanceName()] {
 			continue
 		}
 
-		return fmt.Errorf("Unused configuration block at %s:%d - %s (%s)",
-			inst.Cfg.File, inst.Cfg.Line, inst.Instance.InstanceName(), inst.Instance.Name())
+		return unusedBlockErr(inst)
 	}
 
 	return nil
 }
+
+func unusedBlockErr(inst ModInfo) error {
+	return fmt.Errorf("Unused configuration block at %s:%d - %s (%s)",
+		inst.Cfg.File, inst.Cfg.Line, inst.Instance.InstanceName(), inst.Instance.Name())
+}
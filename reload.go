@@ -0,0 +1,228 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// liveConfig is the configuration the server is running with. It is used to
+// find changed blocks when the configuration is reloaded.
+type liveConfig struct {
+	path    string
+	globals map[string]interface{}
+
+	globalNodes []config.Node
+	endpoints   []ModInfo
+	blocks      map[string]config.Node
+}
+
+func newLiveConfig(path string, globals map[string]interface{}, cfg []config.Node, endpoints []ModInfo) *liveConfig {
+	c := &liveConfig{
+		path:      path,
+		globals:   globals,
+		endpoints: endpoints,
+	}
+	var blocks []config.Node
+	c.globalNodes, _, blocks = splitConfig(cfg)
+	c.blocks = make(map[string]config.Node, len(blocks))
+	for _, block := range blocks {
+		c.blocks[blockInstName(block)] = block
+	}
+	return c
+}
+
+// splitConfig separates global directives, endpoint blocks and module
+// blocks. Unknown directives are considered global.
+func splitConfig(cfg []config.Node) (globals, endpoints, blocks []config.Node) {
+	for _, node := range cfg {
+		switch {
+		case module.GetEndpoint(node.Name) != nil:
+			endpoints = append(endpoints, node)
+		case module.Get(node.Name) != nil:
+			blocks = append(blocks, node)
+		default:
+			globals = append(globals, node)
+		}
+	}
+	return
+}
+
+func blockInstName(block config.Node) string {
+	if len(block.Args) == 0 {
+		return block.Name
+	}
+	return block.Args[0]
+}
+
+// sameHeader reports whether blocks have the same module name and arguments
+// (addresses for endpoints, instance name and aliases for other modules).
+func sameHeader(a, b config.Node) bool {
+	a.Children, b.Children = nil, nil
+	return config.NodesEqual([]config.Node{a}, []config.Node{b})
+}
+
+func (c *liveConfig) reload() {
+	if err := c.reloadFrom(c.path); err != nil {
+		log.Println("configuration reload failed, running configuration is not changed:", err)
+	}
+}
+
+// reloadChange is the prepared configuration change of a single block.
+type reloadChange struct {
+	block config.Node
+	apply func()
+	// Updates the liveConfig after apply.
+	commit func()
+}
+
+// reloadFrom reads the configuration file and applies the changes to module
+// instances that support it (module.ReloadModule). Other changes are
+// reported as requiring the server restart and are not applied.
+//
+// Changes are applied only if all changed blocks are processed successfully.
+// Otherwise the running configuration stays in effect.
+func (c *liveConfig) reloadFrom(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, err := readConfig(f, path)
+	if err != nil {
+		return err
+	}
+
+	globals, endpoints, blocks := splitConfig(cfg)
+
+	var (
+		changes []reloadChange
+		restart []string
+		errs    []error
+	)
+	prepare := func(inst module.Module, old, block config.Node, commit func()) {
+		if config.NodesEqual([]config.Node{old}, []config.Node{block}) {
+			return
+		}
+		reloader, ok := inst.(module.ReloadModule)
+		if !ok {
+			restart = append(restart, fmt.Sprintf("%s:%d: %s (%s): module does not support reload, %v",
+				block.File, block.Line, inst.InstanceName(), inst.Name(), module.ErrRestartRequired))
+			return
+		}
+		apply, err := reloader.Reload(config.NewMap(c.globals, block))
+		if err != nil {
+			if errors.Is(err, module.ErrRestartRequired) {
+				restart = append(restart, fmt.Sprintf("%s:%d: %v", block.File, block.Line, err))
+				return
+			}
+			errs = append(errs, config.WrapBlockErr(block, err))
+			return
+		}
+		changes = append(changes, reloadChange{block: block, apply: apply, commit: commit})
+	}
+
+	if !config.NodesEqual(globals, c.globalNodes) {
+		restart = append(restart, fmt.Sprintf("%v to global directives", module.ErrRestartRequired))
+	}
+
+	if len(endpoints) != len(c.endpoints) {
+		restart = append(restart, fmt.Sprintf("%v to the list of endpoints", module.ErrRestartRequired))
+	} else {
+		for i, block := range endpoints {
+			i, block := i, block
+			endp := c.endpoints[i]
+			if !sameHeader(endp.Cfg, block) {
+				restart = append(restart, fmt.Sprintf("%s:%d: %s: %v to endpoint addresses",
+					block.File, block.Line, block.Name, module.ErrRestartRequired))
+				continue
+			}
+			prepare(endp.Instance, endp.Cfg, block, func() {
+				c.endpoints[i].Cfg = block
+			})
+		}
+	}
+
+	seen := make(map[string]bool, len(blocks))
+	for _, block := range blocks {
+		block := block
+		name := blockInstName(block)
+		seen[name] = true
+
+		old, ok := c.blocks[name]
+		if !ok {
+			restart = append(restart, fmt.Sprintf("%s:%d: %s: %v to add the block", block.File, block.Line, name, module.ErrRestartRequired))
+			continue
+		}
+		if !sameHeader(old, block) {
+			restart = append(restart, fmt.Sprintf("%s:%d: %s: %v to module name or aliases", block.File, block.Line, name, module.ErrRestartRequired))
+			continue
+		}
+
+		inst, err := module.GetInstance(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		prepare(inst, old, block, func() {
+			c.blocks[name] = block
+		})
+	}
+	for name, old := range c.blocks {
+		if !seen[name] {
+			restart = append(restart, fmt.Sprintf("%s:%d: %s: %v to remove the block", old.File, old.Line, name, module.ErrRestartRequired))
+		}
+	}
+
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		return fmt.Errorf("%d error(s) found", len(errs))
+	}
+
+	sort.Strings(restart)
+	for _, r := range restart {
+		log.Println(r)
+	}
+
+	for _, ch := range changes {
+		ch.apply()
+		ch.commit()
+		log.Printf("%s:%d: %s configuration is reloaded", ch.block.File, ch.block.Line, ch.block.Name)
+	}
+
+	// Also reload secondary files such as alias mappings and TLS
+	// certificates.
+	hooks.RunHooks(hooks.EventReload)
+
+	log.Printf("configuration reload completed, %d block(s) reloaded, %d change(s) require restart",
+		len(changes), len(restart))
+
+	return nil
+}
@@ -28,13 +28,13 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 )
 
-func handleSignals() os.Signal {
+func handleSignals(reload func()) os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
 
 	s := <-sig
 	go func() {
-		s := handleSignals()
+		s := handleSignals(nil)
 		log.Printf("forced shutdown due to signal (%v)!", s)
 		os.Exit(1)
 	}()
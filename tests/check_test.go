@@ -0,0 +1,113 @@
+//+build integration
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tests_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/tests"
+)
+
+func TestCheck(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+	t.Port("smtp")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+			hostname mx.maddy.test
+			tls off
+
+			deliver_to target.queue queue {
+				hostname mx.maddy.test
+				target &test_store
+			}
+		}
+	`)
+
+	if out, err := t.Check(); err != nil {
+		t.Fatal("check failed:", err, out)
+	}
+
+	// Nothing should be created in the check mode, including the imapsql
+	// database and queue directory.
+	files, err := ioutil.ReadDir(t.StateDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		t.Error("unexpected file in statedir:", f.Name())
+	}
+}
+
+func TestCheck_Errors(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+	t.Port("smtp")
+	t.Port("submission")
+	t.Config(`
+		storage.imapsql test_store {
+			driver nonexistent
+			dsn imapsql.db
+		}
+
+		target.queue unused_queue {
+			hostname mx.maddy.test
+			target &test_store
+		}
+
+		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+			hostname mx.maddy.test
+			tls off
+
+			deliver_to &test_store
+		}
+
+		submission tcp://127.0.0.1:{env:TEST_PORT_submission} {
+			hostname mx.maddy.test
+			tls off
+
+			deliver_to &nonexistent_target
+		}
+	`)
+
+	out, err := t.Check()
+	if err == nil {
+		t.Fatal("check succeeded, expected an error")
+	}
+
+	for _, msg := range []string{
+		`unknown driver "nonexistent"`,
+		"unknown config block: nonexistent_target",
+		"Unused configuration block",
+		"3 error(s) found",
+	} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("%q is not reported", msg)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+//+build integration
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package tests_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/tests"
+)
+
+func TestSMTPDSN_Forwarding(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+	t.DNS(map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	})
+	t.Port("smtp")
+	t.Port("remote_smtp")
+	t.Port("unused")
+	t.Config(`
+		hostname mx.maddy.test
+		tls off
+
+		target.queue outbound {
+			target remote
+		}
+
+		# Next hop, messages stay in the queue since the target is down.
+		target.queue inbound {
+			target smtp {
+				targets tcp://127.0.0.1:{env:TEST_PORT_unused}
+			}
+		}
+
+		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+			deliver_to &outbound
+		}
+
+		smtp tcp://127.0.0.1:{env:TEST_PORT_remote_smtp} {
+			deliver_to &inbound
+		}`)
+	t.Run(1)
+	defer t.Close()
+
+	c := t.Conn("smtp")
+	defer c.Close()
+	c.ExpectPattern("220 *")
+	c.Writeln("EHLO client.maddy.test")
+	sawCap := false
+	for {
+		line, err := c.Readln()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line[4:] == "DSN" {
+			sawCap = true
+		}
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	if !sawCap {
+		t.Fatal("DSN is not advertised")
+	}
+
+	c.Writeln("MAIL FROM:<user@maddy.test> RET=HDRS ENVID=test+2Benv")
+	c.ExpectPattern("250 *")
+	c.Writeln("RCPT TO:<rcpt1@example.invalid> NOTIFY=DELAY ORCPT=rfc822;orig+2Balias@example.org")
+	c.ExpectPattern("250 *")
+	c.Writeln("RCPT TO:<rcpt2@example.invalid> NOTIFY=NEVER")
+	c.ExpectPattern("250 *")
+	c.Writeln("DATA")
+	c.ExpectPattern("354 *")
+	c.Writeln("From: <user@maddy.test>")
+	c.Writeln("To: <rcpt1@example.invalid>")
+	c.Writeln("Subject: Hello!")
+	c.Writeln("")
+	c.Writeln("Hello!")
+	c.Writeln(".")
+	c.ExpectPattern("250 2.0.0 OK: queued")
+	c.Writeln("QUIT")
+	c.ExpectPattern("221 *")
+
+	var metaFiles []string
+	for i := 0; i < 10; i++ {
+		time.Sleep(500 * time.Millisecond)
+		var err error
+		metaFiles, err = filepath.Glob(filepath.Join(t.StateDir(), "inbound", "*.meta"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metaFiles) != 0 {
+			break
+		}
+	}
+	if len(metaFiles) != 1 {
+		t.Fatal("Expected one message in the next hop queue, got", len(metaFiles))
+	}
+	metaBlob, err := ioutil.ReadFile(metaFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta struct {
+		MsgMeta struct {
+			DSN module.DSNOpts
+		}
+	}
+	if err := json.Unmarshal(metaBlob, &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := module.DSNOpts{
+		Return: module.DSNReturnHeaders,
+		EnvID:  "test+env",
+		Rcpts: map[string]module.DSNRcptOpts{
+			"rcpt1@example.invalid": {
+				Notify:       []string{module.DSNNotifyDelay},
+				OriginalRcpt: "rfc822;orig+alias@example.org",
+			},
+			"rcpt2@example.invalid": {
+				Notify: []string{module.DSNNotifyNever},
+			},
+		},
+	}
+	if !reflect.DeepEqual(meta.MsgMeta.DSN, expected) {
+		t.Errorf("Wrong DSN parameters at the next hop: %+v", meta.MsgMeta.DSN)
+	}
+}
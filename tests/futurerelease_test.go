@@ -0,0 +1,160 @@
+//+build integration
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tests_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/tests"
+)
+
+func TestSubmission_FutureRelease(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+	t.DNS(map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	})
+	t.Port("submission")
+	tgtPort := t.Port("remote_smtp")
+	t.Config(`
+		hostname mx.maddy.test
+		tls off
+
+		target.queue outbound {
+			target remote
+		}
+
+		submission tcp://127.0.0.1:{env:TEST_PORT_submission} {
+			insecure_auth yes
+			auth dummy
+			max_hold_time 2h
+			deliver_to &outbound
+		}`)
+	t.Run(1)
+	defer t.Close()
+
+	be, s := testutils.SMTPServer(tt, "127.0.0.1:"+strconv.Itoa(int(tgtPort)))
+	defer s.Close()
+
+	c := t.Conn("submission")
+	defer c.Close()
+	c.ExpectPattern("220 *")
+	c.Writeln("EHLO client.maddy.test")
+	sawCap := false
+	for {
+		line, err := c.Readln()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line[4:], "FUTURERELEASE 7200 ") {
+			sawCap = true
+		}
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	if !sawCap {
+		t.Fatal("FUTURERELEASE is not advertised")
+	}
+	c.Writeln("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user@maddy.test\x00password")))
+	c.ExpectPattern("235 *")
+
+	sendMsg := func(mailArgs, rcpt string) {
+		c.Writeln("MAIL FROM:<user@maddy.test>" + mailArgs)
+		c.ExpectPattern("250 *")
+		c.Writeln("RCPT TO:<" + rcpt + ">")
+		c.ExpectPattern("250 *")
+		c.Writeln("DATA")
+		c.ExpectPattern("354 *")
+		c.Writeln("From: <user@maddy.test>")
+		c.Writeln("To: <" + rcpt + ">")
+		c.Writeln("Subject: Hello!")
+		c.Writeln("")
+		c.Writeln("Hello!")
+		c.Writeln(".")
+		c.ExpectPattern("250 2.0.0 OK: queued")
+	}
+
+	c.Writeln("MAIL FROM:<user@maddy.test> HOLDFOR=7201")
+	c.ExpectPattern("501 5.5.4 *")
+	start := time.Now()
+	sendMsg(" HOLDFOR=3600", "later@example.invalid")
+	sendMsg("", "now@example.invalid")
+	c.Writeln("QUIT")
+	c.ExpectPattern("221 *")
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(500 * time.Millisecond)
+		if len(be.Messages) != 0 {
+			break
+		}
+	}
+	// Give the deferred message a chance to be (incorrectly) delivered.
+	time.Sleep(1 * time.Second)
+
+	if len(be.Messages) != 1 {
+		t.Fatal("Expected exactly one message delivered, got", len(be.Messages))
+	}
+	if to := be.Messages[0].To; len(to) != 1 || to[0] != "now@example.invalid" {
+		t.Fatal("Wrong message delivered:", to)
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(t.StateDir(), "outbound", "*.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metaFiles) != 1 {
+		t.Fatal("Expected one message in the queue, got", len(metaFiles))
+	}
+	metaBlob, err := ioutil.ReadFile(metaFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta struct {
+		To           []string
+		DeliverAfter time.Time
+	}
+	if err := json.Unmarshal(metaBlob, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.To) != 1 || meta.To[0] != "later@example.invalid" {
+		t.Error("Wrong message in the queue:", meta.To)
+	}
+	expected := start.Add(time.Hour)
+	if meta.DeliverAfter.Before(expected.Add(-1*time.Second)) || meta.DeliverAfter.After(expected.Add(5*time.Second)) {
+		t.Errorf("Wrong release time: %v, expected %v", meta.DeliverAfter, expected)
+	}
+}
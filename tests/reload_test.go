@@ -0,0 +1,102 @@
+//+build integration
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package tests_test
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/tests"
+)
+
+func TestReload(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+	t.DNS(nil)
+	t.Port("smtp")
+
+	cfg := func(domains, extra string) string {
+		return `
+			hostname mx.maddy.test
+			tls off
+
+			smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+				destination ` + domains + ` {
+					deliver_to dummy
+				}
+				default_destination {
+					reject 550 5.1.1 "Unknown domain"
+				}
+				` + extra + `
+			}`
+	}
+
+	t.Config(cfg("maddy.test", ""))
+	t.Run(1)
+	defer t.Close()
+
+	// Transaction started before the reload uses the old configuration.
+	oldConn := t.Conn("smtp")
+	defer oldConn.Close()
+	oldConn.SMTPNegotation("localhost", nil, nil)
+	oldConn.Writeln("MAIL FROM:<testing@maddy.test>")
+	oldConn.ExpectPattern("250 *")
+
+	conn := t.Conn("smtp")
+	defer conn.Close()
+	conn.SMTPNegotation("localhost", nil, nil)
+	conn.Writeln("MAIL FROM:<testing@maddy.test>")
+	conn.ExpectPattern("250 *")
+	conn.Writeln("RCPT TO:<testing@example.org>")
+	conn.ExpectPattern("550 5.1.1 *")
+	conn.Writeln("QUIT")
+	conn.ExpectPattern("221 *")
+
+	// Error in the new configuration, old one is still used.
+	t.Reload(cfg("maddy.test example.org", "check { nonexistent_check }"))
+
+	conn = t.Conn("smtp")
+	defer conn.Close()
+	conn.SMTPNegotation("localhost", nil, nil)
+	conn.Writeln("MAIL FROM:<testing@maddy.test>")
+	conn.ExpectPattern("250 *")
+	conn.Writeln("RCPT TO:<testing@example.org>")
+	conn.ExpectPattern("550 5.1.1 *")
+	conn.Writeln("QUIT")
+	conn.ExpectPattern("221 *")
+
+	t.Reload(cfg("maddy.test example.org", ""))
+
+	conn = t.Conn("smtp")
+	defer conn.Close()
+	conn.SMTPNegotation("localhost", nil, nil)
+	conn.Writeln("MAIL FROM:<testing@maddy.test>")
+	conn.ExpectPattern("250 *")
+	conn.Writeln("RCPT TO:<testing@example.org>")
+	conn.ExpectPattern("250 *")
+	conn.Writeln("QUIT")
+	conn.ExpectPattern("221 *")
+
+	oldConn.Writeln("RCPT TO:<testing@example.org>")
+	oldConn.ExpectPattern("550 5.1.1 *")
+	oldConn.Writeln("QUIT")
+	oldConn.ExpectPattern("221 *")
+}
@@ -35,6 +35,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -59,6 +60,10 @@ type T struct {
 	portsRev map[uint16]string
 
 	servProc *exec.Cmd
+
+	// Receives a value each time the server finishes the configuration
+	// reload.
+	reloadMsg chan struct{}
 }
 
 func NewT(t *testing.T) *T {
@@ -142,15 +147,6 @@ func (t *T) Run(waitListeners int) {
 		t.DNS(nil)
 	}
 
-	// Setup file system, create statedir, runtimedir, write out config.
-	testDir, err := ioutil.TempDir("", "maddy-tests-")
-	if err != nil {
-		t.Fatal("Test configuration failed:", err)
-	}
-	t.testDir = testDir
-
-	t.Log("Using", t.testDir)
-
 	defer func() {
 		if !t.Failed() {
 			return
@@ -165,20 +161,7 @@ func (t *T) Run(waitListeners int) {
 		t.testDir = ""
 	}()
 
-	if err := os.MkdirAll(filepath.Join(t.testDir, "statedir"), os.ModePerm); err != nil {
-		t.Fatal("Test configuration failed:", err)
-	}
-	if err := os.MkdirAll(filepath.Join(t.testDir, "runtimedir"), os.ModePerm); err != nil {
-		t.Fatal("Test configuration failed:", err)
-	}
-
-	configPreable := "state_dir " + filepath.Join(t.testDir, "statedir") + "\n" +
-		"runtime_dir " + filepath.Join(t.testDir, "runtime") + "\n\n"
-
-	err = ioutil.WriteFile(filepath.Join(t.testDir, "maddy.conf"), []byte(configPreable+t.cfg), os.ModePerm)
-	if err != nil {
-		t.Fatal("Test configuration failed:", err)
-	}
+	t.setupDir()
 
 	// Assigning 0 by default will make outbound SMTP unusable.
 	remoteSmtp := "0"
@@ -206,17 +189,7 @@ func (t *T) Run(waitListeners int) {
 		t.Fatal("Test configuration failed:", err)
 	}
 
-	// Set environment variables.
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env,
-		"TEST_PWD="+pwd,
-		"TEST_STATE_DIR="+filepath.Join(t.testDir, "statedir"),
-		"TEST_RUNTIME_DIR="+filepath.Join(t.testDir, "statedir"),
-	)
-	for name, port := range t.ports {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TEST_PORT_%s=%d", name, port))
-	}
-	cmd.Env = append(cmd.Env, t.env...)
+	cmd.Env = t.cmdEnv(pwd)
 
 	// Capture maddy log and redirect it.
 	logOut, err := cmd.StderrPipe()
@@ -231,6 +204,7 @@ func (t *T) Run(waitListeners int) {
 	// Log scanning goroutine checks for the "listening" messages and sends 'true'
 	// on the channel each time.
 	listeningMsg := make(chan bool)
+	reloadMsg := make(chan struct{}, 1)
 
 	go func() {
 		defer logOut.Close()
@@ -243,6 +217,12 @@ func (t *T) Run(waitListeners int) {
 				listeningMsg <- true
 				line += " (test runner>listener wait trigger<)"
 			}
+			if strings.Contains(line, "configuration reload") {
+				select {
+				case reloadMsg <- struct{}{}:
+				default:
+				}
+			}
 
 			t.Log("maddy:", line)
 		}
@@ -258,6 +238,113 @@ func (t *T) Run(waitListeners int) {
 	}
 
 	t.servProc = cmd
+	t.reloadMsg = reloadMsg
+}
+
+// Reload replaces the configuration file of the running server and sends the
+// SIGHUP signal to it. It returns after the server finishes the reload.
+func (t *T) Reload(cfg string) {
+	t.Helper()
+
+	if t.servProc == nil {
+		panic("tests: Reload called before Run")
+	}
+
+	t.cfg = cfg
+	t.writeConfig()
+
+	if err := t.servProc.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal("Unable to send SIGHUP:", err)
+	}
+
+	select {
+	case <-t.reloadMsg:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the configuration reload")
+	}
+}
+
+// setupDir creates the test directory with statedir and runtimedir and writes
+// out the configuration file.
+func (t *T) setupDir() {
+	testDir, err := ioutil.TempDir("", "maddy-tests-")
+	if err != nil {
+		t.Fatal("Test configuration failed:", err)
+	}
+	t.testDir = testDir
+
+	t.Log("Using", t.testDir)
+
+	if err := os.MkdirAll(filepath.Join(t.testDir, "statedir"), os.ModePerm); err != nil {
+		t.Fatal("Test configuration failed:", err)
+	}
+	if err := os.MkdirAll(filepath.Join(t.testDir, "runtimedir"), os.ModePerm); err != nil {
+		t.Fatal("Test configuration failed:", err)
+	}
+
+	t.writeConfig()
+}
+
+func (t *T) writeConfig() {
+	configPreable := "state_dir " + filepath.Join(t.testDir, "statedir") + "\n" +
+		"runtime_dir " + filepath.Join(t.testDir, "runtime") + "\n\n"
+
+	err := ioutil.WriteFile(filepath.Join(t.testDir, "maddy.conf"), []byte(configPreable+t.cfg), os.ModePerm)
+	if err != nil {
+		t.Fatal("Test configuration failed:", err)
+	}
+}
+
+func (t *T) cmdEnv(pwd string) []string {
+	env := os.Environ()
+	env = append(env,
+		"TEST_PWD="+pwd,
+		"TEST_STATE_DIR="+filepath.Join(t.testDir, "statedir"),
+		"TEST_RUNTIME_DIR="+filepath.Join(t.testDir, "statedir"),
+	)
+	for name, port := range t.ports {
+		env = append(env, fmt.Sprintf("TEST_PORT_%s=%d", name, port))
+	}
+	return append(env, t.env...)
+}
+
+// Check runs the server in the configuration check mode (-check) and returns
+// its output. The error is returned if the check failed.
+//
+// The test directory is kept until the end of the test, so StateDir can be
+// inspected. Close should not be called.
+func (t *T) Check() (string, error) {
+	if t.cfg == "" {
+		panic("tests: Check called without configuration set")
+	}
+
+	t.setupDir()
+	testDir := t.testDir
+	t.Cleanup(func() {
+		os.RemoveAll(testDir)
+	})
+
+	cmd := exec.Command(TestBinary,
+		"-config", filepath.Join(t.testDir, "maddy.conf"),
+		"-check",
+		"-log", "stderr")
+	if CoverageOut != "" {
+		cmd.Args = append(cmd.Args, "-test.coverprofile", CoverageOut+"."+strconv.FormatInt(time.Now().UnixNano(), 16))
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal("Test configuration failed:", err)
+	}
+	cmd.Env = t.cmdEnv(pwd)
+
+	t.Logf("launching %v", cmd.Args)
+
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		t.Log("maddy:", line)
+	}
+	return string(out), err
 }
 
 func (t *T) StateDir() string {
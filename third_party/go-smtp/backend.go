@@ -0,0 +1,160 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrAuthRequired    = errors.New("Please authenticate first")
+	ErrAuthUnsupported = errors.New("Authentication not supported")
+)
+
+// A SMTP server backend.
+type Backend interface {
+	// Authenticate a user. Return smtp.ErrAuthUnsupported if you don't want to
+	// support this.
+	Login(state *ConnectionState, username, password string) (Session, error)
+
+	// Called if the client attempts to send mail without logging in first.
+	// Return smtp.ErrAuthRequired if you don't want to support this.
+	AnonymousLogin(state *ConnectionState) (Session, error)
+}
+
+type BodyType string
+
+const (
+	Body7Bit       BodyType = "7BIT"
+	Body8BitMIME   BodyType = "8BITMIME"
+	BodyBinaryMIME BodyType = "BINARYMIME"
+)
+
+// MailOptions contains custom arguments that were
+// passed as an argument to the MAIL command.
+type MailOptions struct {
+	// Value of BODY= argument, 7BIT, 8BITMIME or BINARYMIME.
+	Body BodyType
+
+	// Size of the body. Can be 0 if not specified by client.
+	Size int
+
+	// TLS is required for the message transmission.
+	//
+	// The message should be rejected if it can't be transmitted
+	// with TLS.
+	RequireTLS bool
+
+	// The message envelope or message header contains UTF-8-encoded strings.
+	// This flag is set by SMTPUTF8-aware (RFC 6531) client.
+	UTF8 bool
+
+	// The authorization identity asserted by the message sender in decoded
+	// form with angle brackets stripped.
+	//
+	// nil value indicates missing AUTH, non-nil empty string indicates
+	// AUTH=<>.
+	//
+	// Defined in RFC 4954.
+	Auth *string
+
+	// Time the message should be released for delivery at, requested using
+	// HOLDFOR or HOLDUNTIL parameters. Zero value means the message should
+	// be delivered immediately.
+	//
+	// Defined in RFC 4865.
+	ReleaseTime time.Time
+
+	// Value of RET= argument, FULL or HDRS. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	Return DSNReturn
+
+	// Value of ENVID= argument decoded from xtext. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	EnvelopeID string
+}
+
+// DSNReturn is the value of the RET MAIL parameter.
+type DSNReturn string
+
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// DSNNotify is one of the conditions listed in the NOTIFY RCPT parameter.
+type DSNNotify string
+
+const (
+	DSNNotifyNever   DSNNotify = "NEVER"
+	DSNNotifyDelayed DSNNotify = "DELAY"
+	DSNNotifyFailure DSNNotify = "FAILURE"
+	DSNNotifySuccess DSNNotify = "SUCCESS"
+)
+
+// RcptOptions contains custom arguments that were
+// passed as an argument to the RCPT command.
+type RcptOptions struct {
+	// Value of NOTIFY= argument. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	Notify []DSNNotify
+
+	// Address type and address decoded from xtext specified using ORCPT=
+	// argument. Both are empty if not specified.
+	//
+	// Defined in RFC 3461.
+	OriginalRecipientType string
+	OriginalRecipient     string
+}
+
+type Session interface {
+	// Discard currently processed message.
+	Reset()
+
+	// Free all resources associated with session.
+	Logout() error
+
+	// Set return path for currently processed message.
+	Mail(from string, opts MailOptions) error
+	// Add recipient for currently processed message.
+	Rcpt(to string, opts RcptOptions) error
+	// Set currently processed message contents and send it.
+	Data(r io.Reader) error
+}
+
+// VerifyBackend is an optional interface Backend can implement to handle
+// VRFY and EXPN commands (RFC 5321 Section 3.5). The server replies 252 to
+// VRFY and 502 to EXPN if it is not implemented.
+type VerifyBackend interface {
+	// Verify is called for the VRFY command and returns the mailbox the
+	// argument refers to.
+	Verify(state *ConnectionState, arg string) (string, error)
+
+	// Expand is called for the EXPN command and returns mailboxes of the
+	// mailing list members.
+	Expand(state *ConnectionState, arg string) ([]string, error)
+}
+
+type LMTPSession interface {
+	// LMTPData is the LMTP-specific version of Data method.
+	// It can be optionally implemented by the backend to provide
+	// per-recipient status information when it is used over LMTP
+	// protocol.
+	//
+	// LMTPData implementation sets status information using passed
+	// StatusCollector by calling SetStatus once per each AddRcpt
+	// call, even if AddRcpt was called multiple times with
+	// the same argument. SetStatus must not be called after
+	// LMTPData returns.
+	//
+	// Return value of LMTPData itself is used as a status for
+	// recipients that got no status set before using StatusCollector.
+	LMTPData(r io.Reader, status StatusCollector) error
+}
+
+type StatusCollector interface {
+	SetStatus(rcptTo string, err error)
+}
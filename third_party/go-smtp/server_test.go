@@ -0,0 +1,1492 @@
+package smtp_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type message struct {
+	From string
+	To   []string
+	Data []byte
+	Opts smtp.MailOptions
+
+	RcptOpts []smtp.RcptOptions
+}
+
+type backend struct {
+	messages []*message
+	anonmsgs []*message
+
+	implementLMTPData bool
+	lmtpStatus        []struct {
+		addr string
+		err  error
+	}
+	lmtpStatusSync chan struct{}
+
+	// Errors returned by Data method.
+	dataErrors chan error
+
+	// Error that will be returned by Data method.
+	dataErr error
+
+	// Read N bytes of message before returning dataErr.
+	dataErrOffset int64
+
+	panicOnMail bool
+	userErr     error
+}
+
+func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if be.userErr != nil {
+		return &session{}, be.userErr
+	}
+
+	if username != "username" || password != "password" {
+		return nil, errors.New("Invalid username or password")
+	}
+
+	if be.implementLMTPData {
+		return &lmtpSession{&session{backend: be}}, nil
+	}
+
+	return &session{backend: be}, nil
+}
+
+func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+	if be.userErr != nil {
+		return &session{}, be.userErr
+	}
+
+	if be.implementLMTPData {
+		return &lmtpSession{&session{backend: be, anonymous: true}}, nil
+	}
+
+	return &session{backend: be, anonymous: true}, nil
+}
+
+type lmtpSession struct {
+	*session
+}
+
+type session struct {
+	backend   *backend
+	anonymous bool
+
+	msg *message
+}
+
+func (s *session) Reset() {
+	s.msg = &message{}
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts smtp.MailOptions) error {
+	if s.backend.panicOnMail {
+		panic("Everything is on fire!")
+	}
+	s.Reset()
+	s.msg.From = from
+	s.msg.Opts = opts
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts smtp.RcptOptions) error {
+	s.msg.To = append(s.msg.To, to)
+	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	if s.backend.dataErr != nil {
+
+		if s.backend.dataErrOffset != 0 {
+			io.CopyN(ioutil.Discard, r, s.backend.dataErrOffset)
+		}
+
+		err := s.backend.dataErr
+		if s.backend.dataErrors != nil {
+			s.backend.dataErrors <- err
+		}
+		return err
+	}
+
+	if b, err := ioutil.ReadAll(r); err != nil {
+		if s.backend.dataErrors != nil {
+			s.backend.dataErrors <- err
+		}
+		return err
+	} else {
+		s.msg.Data = b
+		if s.anonymous {
+			s.backend.anonmsgs = append(s.backend.anonmsgs, s.msg)
+		} else {
+			s.backend.messages = append(s.backend.messages, s.msg)
+		}
+		if s.backend.dataErrors != nil {
+			s.backend.dataErrors <- nil
+		}
+	}
+	return nil
+}
+
+func (s *session) LMTPData(r io.Reader, collector smtp.StatusCollector) error {
+	if err := s.Data(r); err != nil {
+		return err
+	}
+
+	for _, val := range s.backend.lmtpStatus {
+		collector.SetStatus(val.addr, val.err)
+
+		if s.backend.lmtpStatusSync != nil {
+			s.backend.lmtpStatusSync <- struct{}{}
+		}
+	}
+
+	return nil
+}
+
+type serverConfigureFunc func(*smtp.Server)
+
+var (
+	authDisabled = func(s *smtp.Server) {
+		s.AuthDisabled = true
+	}
+)
+
+func testServer(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be = new(backend)
+	s = smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	for _, f := range fn {
+		f(s)
+	}
+
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner = bufio.NewScanner(c)
+	return
+}
+
+func testServerGreeted(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner = testServer(t, fn...)
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	return
+}
+
+func testServerEhlo(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner, caps map[string]bool) {
+	be, s, c, scanner = testServerGreeted(t, fn...)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+
+	expectedCaps := []string{"PIPELINING", "8BITMIME"}
+	caps = make(map[string]bool)
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			caps[strings.TrimPrefix(s, "250 ")] = true
+			break
+		} else {
+			if !strings.HasPrefix(s, "250-") {
+				t.Fatal("Invalid capability response:", s)
+			}
+			caps[strings.TrimPrefix(s, "250-")] = true
+		}
+	}
+
+	for _, cap := range expectedCaps {
+		if !caps[cap] {
+			t.Fatal("Missing capability:", cap)
+		}
+	}
+
+	return
+}
+
+func TestServer_helo(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid HELO response:", scanner.Text())
+	}
+}
+
+func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t)
+
+	if _, ok := caps["AUTH PLAIN"]; !ok {
+		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
+	}
+
+	io.WriteString(c, "AUTH PLAIN\r\n")
+	scanner.Scan()
+	if scanner.Text() != "334 " {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	return
+}
+
+func TestServerCancelSASL(t *testing.T) {
+	_, _, c, scanner, caps := testServerEhlo(t)
+
+	if _, ok := caps["AUTH PLAIN"]; !ok {
+		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
+	}
+
+	io.WriteString(c, "AUTH PLAIN\r\n")
+	scanner.Scan()
+	if scanner.Text() != "334 " {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "*\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+}
+
+func TestServerEmptyFrom1(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerEmptyFrom2(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerPanicRecover(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.Backend.(*backend).panicOnMail = true
+	// Don't log panic in tests to not confuse people who run 'go test'.
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerSMTPUTF8(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	s.EnableSMTPUTF8 = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SMTPUTF8\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerSMTPUTF8_Disabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SMTPUTF8\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer8BITMIME(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=8BITMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_BODYInvalidValue(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=RABIIT\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerUnknownArg(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> RABIIT\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerBadSize(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=rabbit\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerTooBig(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=4294967295\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_futureRelease(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.MaxHoldTime = 2 * time.Hour
+	})
+	defer s.Close()
+	defer c.Close()
+
+	found := false
+	for cap := range caps {
+		if strings.HasPrefix(cap, "FUTURERELEASE 7200 ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("FUTURERELEASE is not advertised:", caps)
+	}
+
+	for _, arg := range []string{
+		"HOLDFOR=abc",
+		"HOLDFOR=-1",
+		"HOLDFOR",
+		"HOLDFOR=7201",
+		"HOLDUNTIL=yesterday",
+		"HOLDUNTIL=2020-01-01",
+		"HOLDFOR=60 HOLDUNTIL=2000-01-01T00:00:00Z",
+	} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+			t.Fatalf("Invalid MAIL response for %s: %s", arg, scanner.Text())
+		}
+	}
+
+	start := time.Now()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDFOR=3600\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	releaseTime := be.anonmsgs[0].Opts.ReleaseTime
+	if releaseTime.Before(start.Add(time.Hour)) || releaseTime.After(time.Now().Add(time.Hour)) {
+		t.Fatal("Invalid release time:", releaseTime)
+	}
+}
+
+func TestServer_futureReleaseDisabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDFOR=60\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_DSN(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableDSN = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["DSN"]; !ok {
+		t.Fatal("DSN is not advertised:", caps)
+	}
+
+	for _, arg := range []string{
+		"RET=BODY",
+		"RET=FULL RET=HDRS",
+		"ENVID=",
+		"ENVID=a+1",
+		"ENVID=a+0A",
+		"ENVID=" + strings.Repeat("a", 101),
+	} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+			t.Fatalf("Invalid MAIL response for %s: %s", arg, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=hdrs ENVID=QQ+2B1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	for _, arg := range []string{
+		"NOTIFY=NEVER,SUCCESS",
+		"NOTIFY=SOMETIMES",
+		"NOTIFY=NEVER NOTIFY=NEVER",
+		"ORCPT=root@gchq.gov.uk",
+		"ORCPT=rfc822;",
+		"ORCPT=;root@gchq.gov.uk",
+		"ORCPT=rfc822;a+ZZ",
+	} {
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> "+arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+			t.Fatalf("Invalid RCPT response for %s: %s", arg, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=success,failure ORCPT=rfc822;root+2Balias@gchq.gov.uk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	msg := be.anonmsgs[0]
+	if msg.Opts.Return != smtp.DSNReturnHeaders {
+		t.Fatal("Invalid RET value:", msg.Opts.Return)
+	}
+	if msg.Opts.EnvelopeID != "QQ+1" {
+		t.Fatal("Invalid ENVID value:", msg.Opts.EnvelopeID)
+	}
+	expected := []smtp.RcptOptions{
+		{
+			Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure},
+			OriginalRecipientType: "rfc822",
+			OriginalRecipient:     "root+alias@gchq.gov.uk",
+		},
+		{},
+	}
+	if !reflect.DeepEqual(msg.RcptOpts, expected) {
+		t.Fatalf("Invalid RCPT options: %+v", msg.RcptOpts)
+	}
+}
+
+func TestServer_DSNDisabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=FULL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=NEVER\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServerEmptyTo(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServer(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "From: root@nsa.gov\r\n")
+	io.WriteString(c, "\r\n")
+	io.WriteString(c, "Hey\r <3\r\n")
+	io.WriteString(c, "..this dot is fine\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	if string(msg.Data) != "From: root@nsa.gov\r\n\r\nHey\r <3\r\n.this dot is fine\r\n" {
+		t.Fatal("Invalid mail data:", string(msg.Data))
+	}
+}
+
+func TestServer_LFDotLF(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "From: root@nsa.gov\r\n")
+	io.WriteString(c, "\r\n")
+	io.WriteString(c, "hey\r\n")
+	io.WriteString(c, "\n.\n")
+	io.WriteString(c, "this is going to break your server\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if string(msg.Data) != "From: root@nsa.gov\r\n\r\nhey\r\n\n.\nthis is going to break your server\r\n" {
+		t.Fatal("Invalid mail data:", string(msg.Data))
+	}
+}
+
+func TestServer_authDisabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, authDisabled)
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["AUTH PLAIN"]; ok {
+		t.Fatal("AUTH PLAIN capability is present when auth is disabled")
+	}
+
+	io.WriteString(c, "AUTH PLAIN\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Syntax error, AUTH command unrecognized" {
+		t.Fatal("Invalid AUTH response with auth disabled:", scanner.Text())
+	}
+}
+
+func TestServer_otherCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	io.WriteString(c, "HELP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid HELP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+}
+
+type verifyBackend struct {
+	backend
+}
+
+func (be *verifyBackend) Verify(_ *smtp.ConnectionState, arg string) (string, error) {
+	if arg != "root@nsa.gov" {
+		return "", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		}
+	}
+	return arg, nil
+}
+
+func (be *verifyBackend) Expand(_ *smtp.ConnectionState, arg string) ([]string, error) {
+	switch arg {
+	case "staff@nsa.gov":
+		return []string{"root@nsa.gov", "admin@nsa.gov"}, nil
+	case "broken@nsa.gov":
+		return nil, errors.New("lookup failed")
+	}
+	return nil, nil
+}
+
+func TestServer_verify(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := smtp.NewServer(&verifyBackend{})
+	s.Domain = "localhost"
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+
+	for _, cmd := range []struct {
+		line  string
+		reply []string
+	}{
+		{"VRFY root@nsa.gov", []string{"250 2.1.5 <root@nsa.gov>"}},
+		{"VRFY admin@nsa.gov", []string{"550 5.1.1 No such user"}},
+		{"EXPN staff@nsa.gov", []string{"250-2.1.5 <root@nsa.gov>", "250 2.1.5 <admin@nsa.gov>"}},
+		{"EXPN root@nsa.gov", []string{"550 5.1.1 Not a mailing list"}},
+		{"EXPN broken@nsa.gov", []string{"451 4.0.0 lookup failed"}},
+	} {
+		io.WriteString(c, cmd.line+"\r\n")
+		for _, reply := range cmd.reply {
+			scanner.Scan()
+			if scanner.Text() != reply {
+				t.Fatalf("Invalid %s response: %s", cmd.line, scanner.Text())
+			}
+		}
+	}
+}
+
+type xclientBackend struct {
+	backend
+	state *smtp.ConnectionState
+}
+
+func (be *xclientBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	be.state = state
+	return be.backend.AnonymousLogin(state)
+}
+
+func TestServer_xclient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := &xclientBackend{}
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.XClientTrusted = func(remoteAddr net.Addr) bool {
+		return remoteAddr.(*net.TCPAddr).IP.IsLoopback()
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+
+	expect := func(line, reply string) {
+		t.Helper()
+		io.WriteString(c, line+"\r\n")
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), reply[:3]+"-") {
+				break
+			}
+		}
+		if !strings.HasPrefix(scanner.Text(), reply) {
+			t.Fatalf("Invalid %s response: %s", line, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	found := false
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text()[4:], "XCLIENT ") {
+			found = true
+		}
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+	if !found {
+		t.Fatal("XCLIENT is not advertised")
+	}
+
+	for _, arg := range []string{
+		"",
+		"FOO=bar",
+		"ADDR",
+		"ADDR=not-an-ip",
+		"PORT=25",
+		"ADDR=192.0.2.1 PORT=100000",
+		"PROTO=LMTP",
+		"HELO=+4",
+	} {
+		expect("XCLIENT "+arg, "501 5.5.4 ")
+	}
+
+	expect("XCLIENT ADDR=IPV6:2001:db8::1 PORT=2525 NAME=[UNAVAILABLE] HELO=client+2Dhelo.example.org", "220 localhost ")
+	expect("XCLIENT LOGIN=user+2Bfoo proto=esmtp", "220 localhost ")
+	expect("MAIL FROM:<root@nsa.gov>", "502 ")
+	expect("EHLO localhost", "250 ")
+	expect("MAIL FROM:<root@nsa.gov>", "250 ")
+	expect("XCLIENT ADDR=192.0.2.2", "503 5.5.1 ")
+
+	if be.state == nil {
+		t.Fatal("AnonymousLogin is not called")
+	}
+	if addr := be.state.RemoteAddr.String(); addr != "[2001:db8::1]:2525" {
+		t.Error("Invalid RemoteAddr:", addr)
+	}
+	if be.state.Hostname != "client-helo.example.org" {
+		t.Error("Invalid Hostname:", be.state.Hostname)
+	}
+	expected := smtp.XClientAttrs{
+		Addr:    be.state.XClient.Addr,
+		HeloSet: true,
+		Helo:    "client-helo.example.org",
+		NameSet: true,
+		Login:   "user+foo",
+		Proto:   "ESMTP",
+	}
+	if *be.state.XClient != expected {
+		t.Errorf("Invalid XCLIENT attributes: %+v", be.state.XClient)
+	}
+}
+
+func TestServer_xclientUntrusted(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.XClientTrusted = func(net.Addr) bool {
+			return false
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "XCLIENT") {
+			t.Fatal("XCLIENT is advertised to untrusted client")
+		}
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 5.7.0 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+}
+
+func TestServer_tooManyInvalidCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	// Let's assume XXXX is a non-existing command
+	for i := 0; i < 4; i++ {
+		io.WriteString(c, "XXXX\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "500 ") {
+			t.Fatal("Invalid invalid command response:", scanner.Text())
+		}
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid invalid command response:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	s.MaxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "This is a very long message.\r\n")
+	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
+	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_tooLongLine(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+strings.Repeat("A", 2000))
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response, expected an error but got:", scanner.Text())
+	}
+}
+
+func TestServer_anonymousUserError(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.userErr = smtp.ErrAuthRequired
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.7.0 Please authenticate first" {
+		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	}
+}
+
+func TestServer_anonymousUserOK(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_authParam(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	// Invalid HEXCHAR
+	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<hey+A>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// Invalid HEXCHAR
+	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<he+YYa>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// https://tools.ietf.org/html/rfc4954#section-4
+	// >servers that advertise support for this
+	// >extension MUST support the AUTH parameter to the MAIL FROM
+	// >command even when the client has not authenticated itself to the
+	// >server.
+	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<hey+3Da>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// Go on as usual.
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+	if val := be.anonmsgs[0].Opts.Auth; val == nil || *val != "hey=a" {
+		t.Fatal("Invalid Auth value:", val)
+	}
+}
+
+func testStrictServer(t *testing.T) (s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = smtp.NewServer(new(backend))
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	s.AuthDisabled = true
+	s.Strict = true
+
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+
+	expectedCaps := []string{"PIPELINING", "8BITMIME"}
+	caps := make(map[string]bool)
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			caps[strings.TrimPrefix(s, "250 ")] = true
+			break
+		} else {
+			if !strings.HasPrefix(s, "250-") {
+				t.Fatal("Invalid capability response:", s)
+			}
+			caps[strings.TrimPrefix(s, "250-")] = true
+		}
+	}
+
+	for _, cap := range expectedCaps {
+		if !caps[cap] {
+			t.Fatal("Missing capability:", cap)
+		}
+	}
+
+	return
+}
+
+func TestStrictServerGood(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestStrictServerBad(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
+		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	}
+}
+
+func TestServer_Chunking_LMTP(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.LMTP = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<toor@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
+		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	}
+}
+
+func TestServer_Chunking_Reset(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	be.dataErrors = make(chan error, 10)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	// Client changed its mind... Note, in this case Data method error is discarded and not returned to the cilent.
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if err := <-be.dataErrors; err != smtp.ErrDataReset {
+		t.Fatal("Backend received a different error:", err)
+	}
+}
+
+func TestServer_Chunking_ClosedInTheMiddle(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	be.dataErrors = make(chan error, 10)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <")
+
+	// Bye!
+	c.Close()
+
+	if err := <-be.dataErrors; err != smtp.ErrDataReset {
+		t.Fatal("Backend received a different error:", err)
+	}
+}
+
+func TestServer_Chunking_EarlyError(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.dataErr = &smtp.SMTPError{
+		Code:         555,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      "I failed",
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "555 5.0.0 I failed") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking_EarlyErrorDuringChunk(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.dataErr = &smtp.SMTPError{
+		Code:         555,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      "I failed",
+	}
+	be.dataErrOffset = 5
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "555 5.0.0 I failed") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	// See that command stream state is not corrupted e.g. server is still not
+	// waiting for remaining chunk octets.
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking_tooLongMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	s.MaxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 30\r\n")
+	io.WriteString(c, "This is a very long message.\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "BDAT 96 LAST\r\n")
+	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
+	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_Chunking_Binarymime(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	s.EnableBINARYMIME = true
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
+		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	}
+}